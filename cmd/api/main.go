@@ -13,7 +13,9 @@ import (
 	_ "tp25-api/docs"
 	"tp25-api/internal/config"
 	"tp25-api/internal/server"
+	"tp25-api/internal/version"
 	"tp25-api/lib/database"
+	"tp25-api/lib/tracing"
 )
 
 // @title TP-API Documentation
@@ -29,11 +31,23 @@ import (
 // @name Authorization
 // @description Bearer token for JWT authentication (format: Bearer <token>)
 func main() {
+	log.Printf("tp25-api %s starting", version.String())
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal("Failed to load configuration:", err)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize tracing:", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
 	db, err := database.NewMongoDB(cfg)
 	if err != nil {
 		log.Fatal("Failed to connect to MongoDB:", err)
@@ -42,7 +56,7 @@ func main() {
 
 	log.Println("Connected to MongoDB successfully")
 
-	router := server.New(cfg, db)
+	router, shutdown := server.New(cfg, db)
 
 	addr := fmt.Sprintf(":%s", cfg.Server.Port)
 	srv := &http.Server{
@@ -67,7 +81,15 @@ func main() {
 	defer cancel()
 
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		log.Println("Server forced to shutdown:", err)
+	}
+
+	// Write records still waiting in the ingestion queue
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFlush()
+
+	if err := shutdown(flushCtx); err != nil {
+		log.Println("Failed to flush ingestion queue:", err)
 	}
 
 	log.Println("Server exited successfully")
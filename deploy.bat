@@ -17,7 +17,10 @@ REM ===============================
 REM Step 1: Build Docker image
 REM ===============================
 echo Building Docker image...
-docker build -t %IMAGE% .
+for /f %%i in ('git describe --tags --always --dirty') do set VERSION=%%i
+for /f %%i in ('git rev-parse --short HEAD') do set COMMIT=%%i
+for /f %%i in ('powershell -NoProfile -Command "(Get-Date).ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ')"') do set BUILD_DATE=%%i
+docker build --build-arg VERSION=%VERSION% --build-arg COMMIT=%COMMIT% --build-arg BUILD_DATE=%BUILD_DATE% -t %IMAGE% .
 
 REM ===============================
 REM Step 2: Push Docker image to Artifact Registry
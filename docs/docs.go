@@ -2718,7 +2718,15 @@ const docTemplate = `{
         "domain.ViewBox": {
             "type": "object",
             "properties": {
+                "boxes": {
+                    "description": "Boxes of the group, by sort_order then ID",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/domain.Box"
+                    }
+                },
                 "boxs": {
+                    "description": "Deprecated: same as boxes, only served on the unversioned /api",
                     "type": "array",
                     "items": {
                         "$ref": "#/definitions/domain.Box"
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -10,36 +14,184 @@ type Config struct {
 	Server   ServerConfig
 	Database DatabaseConfig
 	Auth     AuthConfig
+	Tracing  TracingConfig
+	Notify   NotifyConfig
+	Ingest   IngestConfig
+	Export   ExportConfig
+	Jobs     JobsConfig
+	Sites    SitesConfig
+
+	// Features turned on or off for the deployment by name, over their defaults; admins can
+	// still override them at runtime
+	Features map[string]bool
 }
 
 type ServerConfig struct {
-	Port string
+	Port           string
+	DebugEndpoints bool   // mount /debug/pprof and /debug/stats (admin only)
+	MetricsToken   string // bearer token Prometheus scrapes /metrics with, which is not mounted when empty
+	LegacyBoxs     bool   // also list group boxes under the misspelled "boxs" key on the unversioned /api
+	PublicURL      string // address the API is reached at, prefixing links sent to users
+
+	PollMaxHeld    int // long polls for new records held at once, 0 for no limit
+	RecordPageSize int // page_size record listings default to
+
+	// Record list and report responses for a time_max more than HistoryClosedAfter ago may be
+	// cached for HistoryCacheMaxAge; 0 disables caching
+	HistoryClosedAfter time.Duration
+	HistoryCacheMaxAge time.Duration
 }
 
 type DatabaseConfig struct {
 	URL  string
 	Name string
+
+	QueryTimeout time.Duration // longest a report or group record query may run on Mongo, 0 for no limit
 }
 
 type AuthConfig struct {
-	JWTSecret string
+	JWTSecret               string        // signs tokens; the first of JWTSecrets
+	JWTSecrets              []string      // verify tokens, so those signed before a rotation stay valid
+	PasswordResetTTL        time.Duration // lifetime of a password reset token
+	PasswordResetMaxPerHour int           // reset requests allowed per user per hour
+	TOTPEncryptionKey       string        // encrypts TOTP secrets at rest; required, and kept apart from JWTSecrets so they can rotate
+
+	// Concurrent sessions allowed per role, 0 for no limit. A login over the limit is rejected,
+	// or ends the oldest session when SessionLimitEvict is set.
+	SessionLimitAdmin   int
+	SessionLimitMonitor int
+	SessionLimitEvict   bool
+
+	SecurityEventRetention time.Duration // security events are pruned after this long, 0 keeps them forever
+}
+
+type IngestConfig struct {
+	QueueSize int // records buffered before POST /boxes/{id}/records answers 429
+	Workers   int
+	BatchSize int // max records per write
+
+	ReplayInterval time.Duration // how often records that failed to write are tried again
+
+	RateHorizon int // seconds; no rate of change is derived across a longer gap between samples
+}
+
+type ExportConfig struct {
+	MaxRows int // exports estimated above this many rows answer 413 instead of streaming a file the proxy would cut; 0 disables
+
+	DownloadKey string        // signs the download links of export jobs, random per process when empty
+	DownloadTTL time.Duration // how long export job files and their links last
+}
+
+type JobsConfig struct {
+	MaintenanceWorkers int // collections a reindex or rollup rebuild works on at once
+}
+
+type SitesConfig struct {
+	VietnamOnly bool // reject zone, group and box coordinates outside Vietnam's bounding box
+
+	CameraCheckInterval time.Duration // how often group cameras are probed, 0 disables the checks
+	CameraCheckTimeout  time.Duration // how long a camera has to answer a probe
+	CameraAlerts        bool          // raise an info alert on the group when a camera starts failing
+}
+
+type NotifyConfig struct {
+	WebhookURL string // SMS/Zalo gateway, messages are only logged when empty
+}
+
+type TracingConfig struct {
+	Endpoint    string  // OTLP/HTTP endpoint URL, tracing is disabled when empty
+	SampleRatio float64 // fraction of root traces sampled, 0..1
+	ServiceName string
 }
 
+// Enabled reports whether an exporter endpoint is configured
+func (t TracingConfig) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+// ErrNoTOTPKey is returned by Load when TOTP_ENCRYPTION_KEY is not set
+var ErrNoTOTPKey = errors.New("TOTP_ENCRYPTION_KEY is required; deployments enrolled before it was set must set it to the last JWT_SECRET")
+
 func Load() (*Config, error) {
 	// Load .env file if exists
 	_ = godotenv.Load()
 
+	jwtSecrets := getEnvList("JWT_SECRET")
+	jwtSecret := ""
+	if len(jwtSecrets) > 0 {
+		jwtSecret = jwtSecrets[0]
+	}
+
+	// Falling back to a JWT secret would lock every 2FA user out once that secret is rotated away
+	totpKey := getEnv("TOTP_ENCRYPTION_KEY", "")
+	if totpKey == "" {
+		return nil, ErrNoTOTPKey
+	}
+
 	return &Config{
 		Server: ServerConfig{
-			Port: getEnv("PORT", "8080"),
+			Port:           getEnv("PORT", "8080"),
+			DebugEndpoints: getEnvBool("DEBUG_ENDPOINTS", false),
+			MetricsToken:   getEnv("METRICS_TOKEN", ""),
+			LegacyBoxs:     getEnvBool("LEGACY_BOXS_FIELD", true),
+			PublicURL:      getEnv("PUBLIC_URL", ""),
+			PollMaxHeld:    getEnvInt("POLL_MAX_HELD", 1000),
+			RecordPageSize: getEnvInt("RECORD_PAGE_SIZE", 10),
+
+			HistoryClosedAfter: getEnvDuration("HISTORY_CLOSED_AFTER", 24*time.Hour),
+			HistoryCacheMaxAge: getEnvDuration("HISTORY_CACHE_MAX_AGE", time.Hour),
 		},
 		Database: DatabaseConfig{
 			URL:  getEnv("MONGO_URI", ""),
 			Name: getEnv("MONGO_DB", ""),
+
+			QueryTimeout: getEnvDuration("MONGO_QUERY_TIMEOUT", 2*time.Minute),
 		},
 		Auth: AuthConfig{
-			JWTSecret: getEnv("JWT_SECRET", ""),
+			JWTSecret:               jwtSecret,
+			JWTSecrets:              jwtSecrets,
+			PasswordResetTTL:        getEnvDuration("PASSWORD_RESET_TTL", 15*time.Minute),
+			PasswordResetMaxPerHour: getEnvInt("PASSWORD_RESET_MAX_PER_HOUR", 3),
+			TOTPEncryptionKey:       totpKey,
+			SessionLimitAdmin:       getEnvInt("SESSION_LIMIT_ADMIN", 0),
+			SessionLimitMonitor:     getEnvInt("SESSION_LIMIT_MONITOR", 0),
+			SessionLimitEvict:       getEnvBool("SESSION_LIMIT_EVICT", false),
+			SecurityEventRetention:  getEnvDuration("SECURITY_EVENT_RETENTION", 180*24*time.Hour),
+		},
+		Tracing: TracingConfig{
+			Endpoint:    getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+			SampleRatio: getEnvFloat("OTEL_TRACES_SAMPLER_RATIO", 1),
+			ServiceName: getEnv("OTEL_SERVICE_NAME", "tp25-api"),
 		},
+		Notify: NotifyConfig{
+			WebhookURL: getEnv("NOTIFY_WEBHOOK_URL", ""),
+		},
+		Ingest: IngestConfig{
+			QueueSize: getEnvInt("INGEST_QUEUE_SIZE", 10000),
+			Workers:   getEnvInt("INGEST_WORKERS", 4),
+			BatchSize: getEnvInt("INGEST_BATCH_SIZE", 500),
+
+			ReplayInterval: getEnvDuration("INGEST_REPLAY_INTERVAL", time.Minute),
+
+			RateHorizon: getEnvInt("INGEST_RATE_HORIZON", 3*3600),
+		},
+		Export: ExportConfig{
+			MaxRows: getEnvInt("EXPORT_MAX_ROWS", 1000000),
+
+			DownloadKey: getEnv("EXPORT_DOWNLOAD_KEY", ""),
+			DownloadTTL: getEnvDuration("EXPORT_DOWNLOAD_TTL", 24*time.Hour),
+		},
+		Jobs: JobsConfig{
+			MaintenanceWorkers: getEnvInt("MAINTENANCE_WORKERS", 2),
+		},
+		Sites: SitesConfig{
+			VietnamOnly: getEnvBool("LOCATION_VIETNAM_ONLY", false),
+
+			CameraCheckInterval: getEnvDuration("CAMERA_CHECK_INTERVAL", 15*time.Minute),
+			CameraCheckTimeout:  getEnvDuration("CAMERA_CHECK_TIMEOUT", 10*time.Second),
+			CameraAlerts:        getEnvBool("CAMERA_ALERTS", false),
+		},
+		Features: getEnvFlags("FEATURE_FLAGS"),
 	}, nil
 }
 
@@ -49,3 +201,69 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvList splits a comma-separated value, dropping blank entries
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvFlags reads a comma-separated list of name=bool entries, e.g. "record_poll=false,anomaly_detection=true".
+// A bare name turns the flag on; entries whose value is not a boolean are dropped.
+func getEnvFlags(key string) map[string]bool {
+	flags := map[string]bool{}
+	for _, entry := range getEnvList(key) {
+		name, value, found := strings.Cut(entry, "=")
+		enabled := true
+		if found {
+			b, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			enabled = b
+		}
+		flags[strings.TrimSpace(name)] = enabled
+	}
+	return flags
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadRequiresTOTPKey(t *testing.T) {
+	t.Setenv("JWT_SECRET", "new,old")
+	t.Setenv("TOTP_ENCRYPTION_KEY", "")
+
+	if _, err := Load(); err != ErrNoTOTPKey {
+		t.Fatalf("Load() error = %v, want ErrNoTOTPKey", err)
+	}
+}
+
+func TestLoadJWTSecrets(t *testing.T) {
+	t.Setenv("JWT_SECRET", " new , ,old")
+	t.Setenv("TOTP_ENCRYPTION_KEY", "totp")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auth.JWTSecret != "new" {
+		t.Errorf("JWTSecret = %q, want the first secret", cfg.Auth.JWTSecret)
+	}
+	if want := []string{"new", "old"}; !reflect.DeepEqual(cfg.Auth.JWTSecrets, want) {
+		t.Errorf("JWTSecrets = %q, want %q", cfg.Auth.JWTSecrets, want)
+	}
+	// Rotating the JWT secrets leaves the key of the TOTP secrets alone
+	if cfg.Auth.TOTPEncryptionKey != "totp" {
+		t.Errorf("TOTPEncryptionKey = %q, want the TOTP_ENCRYPTION_KEY", cfg.Auth.TOTPEncryptionKey)
+	}
+}
+
+// pprof and the runtime stats are only served when asked for
+func TestLoadDebugEndpointsOffByDefault(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("TOTP_ENCRYPTION_KEY", "totp")
+	t.Setenv("DEBUG_ENDPOINTS", "")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.DebugEndpoints {
+		t.Error("DebugEndpoints is on without DEBUG_ENDPOINTS")
+	}
+
+	t.Setenv("DEBUG_ENDPOINTS", "true")
+	if cfg, err = Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Server.DebugEndpoints {
+		t.Error("DebugEndpoints is off with DEBUG_ENDPOINTS=true")
+	}
+}
@@ -0,0 +1,89 @@
+package domain
+
+import (
+	"time"
+	"tp25-api/lib"
+)
+
+type AlertSeverity string
+
+const (
+	AlertInfo     AlertSeverity = "info"
+	AlertWarning  AlertSeverity = "warning"
+	AlertCritical AlertSeverity = "critical"
+)
+
+// Valid reports whether the severity is one the API knows
+func (s AlertSeverity) Valid() bool {
+	return s == AlertInfo || s == AlertWarning || s == AlertCritical
+}
+
+type AlertStatus string
+
+const (
+	AlertOpen         AlertStatus = "open"
+	AlertAcknowledged AlertStatus = "acknowledged"
+	AlertResolved     AlertStatus = "resolved"
+)
+
+// Valid reports whether the status is one the API knows
+func (s AlertStatus) Valid() bool {
+	return s == AlertOpen || s == AlertAcknowledged || s == AlertResolved
+}
+
+// Alert is raised against a box, usually for one of its metrics, or against a group with no box_id
+// (a camera that stopped answering). The zone and group are copied from the box when the alert is
+// raised so alerts can be listed by scope without a lookup.
+type Alert struct {
+	ID         string        `json:"id" bson:"_id"`
+	BoxID      string        `json:"box_id" bson:"box_id"`
+	GroupID    string        `json:"group_id" bson:"group_id"`
+	ZoneID     string        `json:"zone_id" bson:"zone_id"`
+	Metric     string        `json:"metric,omitempty" bson:"metric,omitempty"`
+	Severity   AlertSeverity `json:"severity" bson:"severity"`
+	Status     AlertStatus   `json:"status" bson:"status"`
+	Message    string        `json:"message" bson:"message"`
+	Value      *float64      `json:"value,omitempty" bson:"value,omitempty"`
+	Threshold  *float64      `json:"threshold,omitempty" bson:"threshold,omitempty"`
+	Timestamp  int64         `json:"timestamp" bson:"timestamp"` // when the alert was raised (seconds)
+	ResolvedAt *int64        `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	CTime      int64         `json:"ctime" bson:"ctime"`
+	MTime      int64         `json:"mtime" bson:"mtime"`
+}
+
+// FilterAlertParams selects alerts; every set field must match. Severities and Statuses match any of
+// their values, From/To bound the timestamp (seconds, inclusive). Groups, when not nil and GroupID is
+// empty, restricts the result to alerts of those groups; it is set from the caller's access, not the query.
+type FilterAlertParams struct {
+	Severities []AlertSeverity
+	Statuses   []AlertStatus
+	ZoneID     string
+	GroupID    string
+	BoxID      string
+	Metric     string
+	From       *int64
+	To         *int64
+	Groups     []string
+}
+
+// NewAlert creates an open alert for a box raised now
+func NewAlert(box *Box, severity AlertSeverity, message string) *Alert {
+	now := time.Now()
+	return &Alert{
+		ID:        lib.Rand.Char(12),
+		BoxID:     box.ID,
+		GroupID:   box.GroupID,
+		ZoneID:    box.ZoneID,
+		Severity:  severity,
+		Status:    AlertOpen,
+		Message:   message,
+		Timestamp: now.Unix(),
+		CTime:     now.UnixMilli(),
+		MTime:     now.UnixMilli(),
+	}
+}
+
+// NewGroupAlert creates an open alert for a group, with no box, raised now
+func NewGroupAlert(group *BoxGroup, severity AlertSeverity, message string) *Alert {
+	return NewAlert(&Box{GroupID: group.ID, ZoneID: group.ZoneID}, severity, message)
+}
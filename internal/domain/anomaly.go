@@ -0,0 +1,182 @@
+package domain
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"time"
+
+	"tp25-api/lib"
+)
+
+// RecordFlagsKey is the stored record field holding the flags set on its metric values, by metric
+// code, e.g. {"WAU": "anomaly"}
+const RecordFlagsKey = "_flags"
+
+// RecordFlagAnomaly flags a metric value the box's anomaly policy found far off its recent values
+const RecordFlagAnomaly = "anomaly"
+
+// Anomaly policy bounds
+const (
+	MinAnomalyZScore     = 1.0
+	DefaultAnomalyWindow = 100
+	MinAnomalyWindow     = 10
+	MaxAnomalyWindow     = 10000
+)
+
+// AnomalyWarmup is how many samples of a metric the rolling statistics need before values are scored
+const AnomalyWarmup = 10
+
+// anomalyMinStdDev keeps a metric that held a constant value from scoring every change as infinitely far
+const anomalyMinStdDev = 1e-6
+
+// AnomalyPolicy flags, without rejecting them, the metric values of a box lying more than ZScore
+// standard deviations from the rolling mean of the metric's recent samples
+type AnomalyPolicy struct {
+	ZScore  float64  `json:"z_score" bson:"z_score"`                     // 0 turns detection off
+	Window  int      `json:"window,omitempty" bson:"window,omitempty"`   // samples the statistics follow, DefaultAnomalyWindow when 0
+	Metrics []string `json:"metrics,omitempty" bson:"metrics,omitempty"` // the metrics watched, every reported one when empty
+}
+
+func (p *AnomalyPolicy) Validate() error {
+	if math.IsNaN(p.ZScore) || math.IsInf(p.ZScore, 0) || p.ZScore < 0 || (p.ZScore > 0 && p.ZScore < MinAnomalyZScore) {
+		return ErrInvalidAnomalyPolicy
+	}
+	if p.Window != 0 && (p.Window < MinAnomalyWindow || p.Window > MaxAnomalyWindow) {
+		return ErrInvalidAnomalyPolicy
+	}
+	return nil
+}
+
+// Enabled reports whether the policy scores values
+func (p *AnomalyPolicy) Enabled() bool {
+	return p != nil && p.ZScore > 0
+}
+
+// Watches reports whether the policy scores the values of the metric
+func (p *AnomalyPolicy) Watches(code string) bool {
+	return len(p.Metrics) == 0 || containsString(p.Metrics, code)
+}
+
+// WindowSize returns the number of samples the rolling statistics follow
+func (p *AnomalyPolicy) WindowSize() int {
+	if p.Window == 0 {
+		return DefaultAnomalyWindow
+	}
+	return p.Window
+}
+
+// RollingStats are the exponentially weighted mean and variance of the recent samples of a metric
+type RollingStats struct {
+	Count int64   `json:"count" bson:"n"`
+	Mean  float64 `json:"mean" bson:"mean"`
+	Var   float64 `json:"var" bson:"var"`
+}
+
+// Observe scores value against the statistics, then adds it to them; it returns true when value lies
+// more than zScore standard deviations from the mean. A flagged value is added clamped to that bound,
+// so a spike barely moves the statistics while a lasting change of level is followed after a while.
+func (s *RollingStats) Observe(value, zScore float64, window int) bool {
+	flagged := false
+	if s.Count >= AnomalyWarmup {
+		bound := zScore * math.Max(math.Sqrt(s.Var), anomalyMinStdDev)
+		if math.Abs(value-s.Mean) > bound {
+			flagged = true
+			value = s.Mean + math.Copysign(bound, value-s.Mean)
+		}
+	}
+
+	s.Count++
+	// Early samples are averaged evenly, later ones weighted over the window
+	alpha := math.Max(2/float64(window+1), 1/float64(s.Count))
+	diff := value - s.Mean
+	s.Mean += alpha * diff
+	s.Var = (1 - alpha) * (s.Var + alpha*diff*diff)
+	return flagged
+}
+
+// AnomalyState holds the rolling statistics of the metrics of a box, by metric code
+type AnomalyState struct {
+	BoxID   string                  `json:"box_id" bson:"_id"`
+	Metrics map[string]RollingStats `json:"metrics" bson:"metrics"`
+	MTime   int64                   `json:"mtime" bson:"mtime"`
+}
+
+// StoredFlags returns the flags stored on the record, by metric code
+func (r Record) StoredFlags() map[string]string {
+	// Stored flags decode as the map type the record was read into, bson.M or Record
+	value := reflect.ValueOf(r[RecordFlagsKey])
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	flags := make(map[string]string, value.Len())
+	iter := value.MapRange()
+	for iter.Next() {
+		if flag, ok := iter.Value().Interface().(string); ok {
+			flags[iter.Key().String()] = flag
+		}
+	}
+	return flags
+}
+
+// AnomalousMetrics returns the metrics of the record flagged as anomalies
+func (r Record) AnomalousMetrics() []string {
+	var codes []string
+	for code, flag := range r.StoredFlags() {
+		if flag == RecordFlagAnomaly {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// DropAnomalies removes the values flagged as anomalies from the record, with the rates of change
+// derived from them
+func (r Record) DropAnomalies() {
+	for _, code := range r.AnomalousMetrics() {
+		delete(r, code)
+		delete(r, code+RateSuffix)
+	}
+}
+
+// RecordCorrectionAction names what a correction changed on a stored record
+type RecordCorrectionAction string
+
+const RecordCorrectionAnomalyCleared RecordCorrectionAction = "anomaly_cleared"
+
+// RecordCorrection is the audit entry of a change made by hand to a stored record
+type RecordCorrection struct {
+	ID        string                 `json:"id" bson:"_id"`
+	BoxID     string                 `json:"box_id" bson:"box_id"`
+	Timestamp int64                  `json:"timestamp" bson:"timestamp"` // sensor time of the record (seconds)
+	Metric    string                 `json:"metric" bson:"metric"`
+	Action    RecordCorrectionAction `json:"action" bson:"action"`
+	Previous  string                 `json:"previous,omitempty" bson:"previous,omitempty"` // the flag cleared
+	Note      string                 `json:"note,omitempty" bson:"note,omitempty"`
+	ActorID   string                 `json:"actor_id" bson:"actor_id"`
+	CTime     int64                  `json:"ctime" bson:"ctime"`
+}
+
+// ClearFlagParams explains why a flag is cleared
+type ClearFlagParams struct {
+	Note string `json:"note"`
+}
+
+// NewRecordCorrection creates the audit entry of a correction made now
+func NewRecordCorrection(boxID string, timestamp int64, metric string, action RecordCorrectionAction, actorID string) *RecordCorrection {
+	return &RecordCorrection{
+		ID:        lib.Rand.Char(12),
+		BoxID:     boxID,
+		Timestamp: timestamp,
+		Metric:    metric,
+		Action:    action,
+		ActorID:   actorID,
+		CTime:     time.Now().UnixMilli(),
+	}
+}
+
+var (
+	ErrInvalidAnomalyPolicy = errors.New("anomaly z_score must be 0 or at least 1 and window between 10 and 10000 samples")
+	ErrRecordNotFound       = errors.New("record not found")
+	ErrRecordFlagNotFound   = errors.New("the record has no flag on this metric")
+)
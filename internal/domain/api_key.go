@@ -0,0 +1,92 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"tp25-api/lib"
+)
+
+// APIKeyHeader carries the API key of a request
+const APIKeyHeader = "X-Api-Key"
+
+// APIKeyPrefix starts every API key, so leaked keys are recognizable
+const APIKeyPrefix = "tp25_"
+
+// APIKey lets an external integration read the records of some groups without signing in. Only the
+// SHA-256 hash of the key is stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID         string   `json:"id" bson:"_id"`
+	Name       string   `json:"name" bson:"name"`
+	Hint       string   `json:"hint" bson:"hint"` // the first characters of the key, to tell keys apart
+	Hash       string   `json:"-" bson:"hash"`
+	Groups     []string `json:"groups" bson:"groups"`
+	ExpiresAt  *int64   `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // seconds, never when nil
+	LastUsedAt *int64   `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *int64   `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	CreatedBy  string   `json:"created_by" bson:"created_by"`
+	CTime      int64    `json:"ctime" bson:"ctime"`
+}
+
+// Expired reports whether the key's expiry has passed
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && *k.ExpiresAt <= now.Unix()
+}
+
+// Principal returns the user requests bearing the key act as: read-only, and reading only the
+// key's groups
+func (k *APIKey) Principal() *User {
+	return &User{
+		ID:       "api_key:" + k.ID,
+		Username: k.Name,
+		Role:     RoleAPIKey,
+		Groups:   k.Groups,
+	}
+}
+
+type CreateAPIKeyParams struct {
+	Name      string   `json:"name" binding:"required"`
+	Groups    []string `json:"groups" binding:"required,min=1,dive,required"`
+	ExpiresAt *int64   `json:"expires_at"` // seconds, never expires when omitted
+}
+
+// CreatedAPIKey is a new key along with the key itself, which is not shown again
+type CreatedAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// NewAPIKey creates a key for params whose hint is taken from key and hash is its hash
+func NewAPIKey(params CreateAPIKeyParams, key, hash, createdBy string) *APIKey {
+	return &APIKey{
+		ID:        lib.Rand.Char(12),
+		Name:      params.Name,
+		Hint:      key[:len(APIKeyPrefix)+4],
+		Hash:      hash,
+		Groups:    params.Groups,
+		ExpiresAt: params.ExpiresAt,
+		CreatedBy: createdBy,
+		CTime:     time.Now().UnixMilli(),
+	}
+}
+
+// APIKeyProblems checks the expiry of a new key and that its groups exist; missing lists the
+// groups not found
+func APIKeyProblems(params CreateAPIKeyParams, missing []string) []FieldError {
+	var problems []FieldError
+	if params.ExpiresAt != nil && *params.ExpiresAt <= time.Now().Unix() {
+		problems = append(problems, FieldError{Field: "expires_at", Rule: "future", Code: "field_expires_at_past"})
+	}
+	for i, group := range params.Groups {
+		if containsString(missing, group) {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("groups[%d]", i), Rule: "exists", Code: "field_group_not_found"})
+		}
+	}
+	return problems
+}
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrAPIKeyInvalid  = errors.New("invalid api key")
+	ErrAPIKeyExpired  = errors.New("api key expired")
+)
@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"errors"
+	"time"
+	"tp25-api/lib"
+)
+
+// BoxLog is a note recorded against a box by a technician, e.g. "replaced pressure transducer, offset +2cm".
+// Logs are a history: only admins may correct or delete them.
+type BoxLog struct {
+	ID         string `json:"id" bson:"_id"`
+	BoxID      string `json:"box_id" bson:"box_id"`
+	Text       string `json:"text" bson:"text"`
+	Category   string `json:"category,omitempty" bson:"category,omitempty"`
+	Timestamp  int64  `json:"timestamp" bson:"timestamp"` // when the work happened (seconds)
+	AuthorID   string `json:"author_id" bson:"author_id"`
+	AuthorName string `json:"author_name" bson:"author_name"`
+	CTime      int64  `json:"ctime" bson:"ctime"`
+	MTime      int64  `json:"mtime" bson:"mtime"`
+	DTime      *int64 `json:"dtime,omitempty" bson:"dtime,omitempty"`
+}
+
+// MaxBoxLogTextLength caps the length of a log note in characters
+const MaxBoxLogTextLength = 4000
+
+type CreateBoxLogParams struct {
+	Text      string `json:"text" binding:"required"`
+	Category  string `json:"category"`
+	Timestamp *int64 `json:"timestamp"` // seconds, the current time when omitted
+}
+
+type UpdateBoxLogParams struct {
+	Text      *string `json:"text"`
+	Category  *string `json:"category"`
+	Timestamp *int64  `json:"timestamp"`
+}
+
+// FilterBoxLogParams selects the logs of a box, From/To bound the timestamp (seconds, inclusive)
+type FilterBoxLogParams struct {
+	BoxID string
+	From  *int64
+	To    *int64
+}
+
+// ValidateBoxLogText rejects empty and overlong notes
+func ValidateBoxLogText(text string) error {
+	if text == "" || len([]rune(text)) > MaxBoxLogTextLength {
+		return ErrInvalidBoxLog
+	}
+	return nil
+}
+
+// NewBoxLog creates a new box log with timestamps
+func NewBoxLog(boxID string, params CreateBoxLogParams, author *User) *BoxLog {
+	now := time.Now()
+	timestamp := now.Unix()
+	if params.Timestamp != nil {
+		timestamp = *params.Timestamp
+	}
+	return &BoxLog{
+		ID:         lib.Rand.Char(12),
+		BoxID:      boxID,
+		Text:       params.Text,
+		Category:   params.Category,
+		Timestamp:  timestamp,
+		AuthorID:   author.ID,
+		AuthorName: author.FullName,
+		CTime:      now.UnixMilli(),
+		MTime:      now.UnixMilli(),
+	}
+}
+
+var (
+	ErrBoxLogNotFound = errors.New("box log not found")
+	ErrInvalidBoxLog  = errors.New("log text is required and must be at most 4000 characters")
+)
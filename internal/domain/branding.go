@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MaxBrandingTitleLength  = 200
+	MaxBrandingFooterLength = 1000
+)
+
+// Branding customizes the public dashboard served on a group's subdomain
+type Branding struct {
+	Title        string `json:"title,omitempty" bson:"title,omitempty"`
+	LogoURL      string `json:"logo_url,omitempty" bson:"logo_url,omitempty"`           // https only
+	PrimaryColor string `json:"primary_color,omitempty" bson:"primary_color,omitempty"` // #rgb or #rrggbb
+	FooterText   string `json:"footer_text,omitempty" bson:"footer_text,omitempty"`
+}
+
+var hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Validate checks the fields that are set; empty fields fall back to the default theme
+func (b *Branding) Validate() error {
+	if utf8.RuneCountInString(b.Title) > MaxBrandingTitleLength || utf8.RuneCountInString(b.FooterText) > MaxBrandingFooterLength {
+		return ErrBrandingTextTooLong
+	}
+	if b.PrimaryColor != "" && !hexColorPattern.MatchString(b.PrimaryColor) {
+		return ErrInvalidBrandingColor
+	}
+	if b.LogoURL != "" {
+		u, err := url.Parse(b.LogoURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return ErrInvalidBrandingLogoURL
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether no field is set
+func (b *Branding) IsZero() bool {
+	return *b == Branding{}
+}
+
+// PublicGroup is what the public dashboard of a subdomain may see of its group
+type PublicGroup struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Subdomain string    `json:"subdomain"`
+	Center    *Location `json:"center,omitempty"`
+	Zoom      *int      `json:"zoom,omitempty"`
+	Branding  *Branding `json:"branding,omitempty"`
+}
+
+// brandingSettingFields maps the field suffix of legacy branding_* setting keys to the Branding field they held
+var brandingSettingFields = map[string]func(*Branding) *string{
+	"title":         func(b *Branding) *string { return &b.Title },
+	"logo_url":      func(b *Branding) *string { return &b.LogoURL },
+	"primary_color": func(b *Branding) *string { return &b.PrimaryColor },
+	"footer_text":   func(b *Branding) *string { return &b.FooterText },
+}
+
+// ParseBrandingSettingKey splits a legacy setting key of the form branding_<subdomain or group ID>_<field>,
+// e.g. branding_dautieng_logo_url, into the group reference and the field
+func ParseBrandingSettingKey(key string) (group, field string, ok bool) {
+	rest, ok := strings.CutPrefix(key, "branding_")
+	if !ok {
+		return "", "", false
+	}
+	for field := range brandingSettingFields {
+		if group, ok := strings.CutSuffix(rest, "_"+field); ok && group != "" {
+			return group, field, true
+		}
+	}
+	return "", "", false
+}
+
+// SetField sets a field named like the legacy setting suffixes; unknown fields are ignored
+func (b *Branding) SetField(field, value string) {
+	if f, ok := brandingSettingFields[field]; ok {
+		*f(b) = value
+	}
+}
+
+// MergeMissing fills the fields of b that are empty from other
+func (b *Branding) MergeMissing(other *Branding) {
+	for _, f := range brandingSettingFields {
+		if *f(b) == "" {
+			*f(b) = *f(other)
+		}
+	}
+}
+
+var (
+	ErrInvalidBrandingColor   = errors.New("primary_color must be a hex color like #1a73e8")
+	ErrInvalidBrandingLogoURL = errors.New("logo_url must be an https URL")
+	ErrBrandingTextTooLong    = errors.New("branding title or footer_text too long")
+)
@@ -0,0 +1,85 @@
+package domain
+
+import (
+	"net/url"
+	"strings"
+)
+
+type CameraState string
+
+const (
+	CameraOK      CameraState = "ok"
+	CameraFailing CameraState = "failing"
+	// CameraUnchecked is a camera not probed yet, or whose entry is not an http(s) or rtsp URL
+	CameraUnchecked CameraState = "unchecked"
+)
+
+// CameraCheck is the last outcome of probing one camera URL of a group. Times are in seconds.
+type CameraCheck struct {
+	ID          string `json:"-" bson:"_id"`
+	GroupID     string `json:"group_id" bson:"group_id"`
+	URL         string `json:"url" bson:"url"`
+	LastSuccess *int64 `json:"last_success,omitempty" bson:"last_success,omitempty"`
+	LastFailure *int64 `json:"last_failure,omitempty" bson:"last_failure,omitempty"`
+	Error       string `json:"error,omitempty" bson:"error,omitempty"` // why the last probe failed
+	CheckedAt   int64  `json:"checked_at" bson:"checked_at"`
+}
+
+// State reports whether the last probe of the camera succeeded
+func (c *CameraCheck) State() CameraState {
+	if c == nil || (c.LastSuccess == nil && c.LastFailure == nil) {
+		return CameraUnchecked
+	}
+	if c.LastFailure != nil && (c.LastSuccess == nil || *c.LastFailure > *c.LastSuccess) {
+		return CameraFailing
+	}
+	return CameraOK
+}
+
+// CameraStatus is the health of one configured camera of a group
+type CameraStatus struct {
+	URL         string      `json:"url"`
+	State       CameraState `json:"state"`
+	LastSuccess *int64      `json:"last_success,omitempty"`
+	LastFailure *int64      `json:"last_failure,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	CheckedAt   *int64      `json:"checked_at,omitempty"`
+}
+
+// CameraStatuses returns the status of each camera, in the group's order, from the stored checks.
+// Checks of cameras no longer configured are ignored.
+func CameraStatuses(cameras []string, checks []CameraCheck) []CameraStatus {
+	byURL := make(map[string]*CameraCheck, len(checks))
+	for i := range checks {
+		byURL[checks[i].URL] = &checks[i]
+	}
+
+	statuses := make([]CameraStatus, 0, len(cameras))
+	for _, camera := range cameras {
+		status := CameraStatus{URL: camera, State: CameraUnchecked}
+		if check, ok := byURL[camera]; ok {
+			status.State = check.State()
+			status.LastSuccess = check.LastSuccess
+			status.LastFailure = check.LastFailure
+			status.Error = check.Error
+			checkedAt := check.CheckedAt
+			status.CheckedAt = &checkedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// ProbeableCamera reports whether a camera entry is a URL the checker knows how to probe:
+// http(s), probed with HEAD, or rtsp, probed with DESCRIBE
+func ProbeableCamera(camera string) bool {
+	u, err := url.Parse(strings.TrimSpace(camera))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "rtsp":
+		return true
+	}
+	return false
+}
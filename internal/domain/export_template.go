@@ -0,0 +1,53 @@
+package domain
+
+import "errors"
+
+// MaxExportTemplateSize bounds uploaded export templates (bytes)
+const MaxExportTemplateSize = 5 << 20
+
+// MaxTemplateExportRows bounds the record rows filled into a template; narrower time ranges are needed beyond it
+const MaxTemplateExportRows = 50000
+
+// Defined names read from export templates. TemplateRecordsName is required, the others are filled when present.
+//
+// Row names refer to one row whose cells hold column keys. Record rows accept index, time, timestamp,
+// box_id, box_name, device_id and metric codes; statistics rows accept index, box_id, box_name, metric,
+// metric_name, unit, count, min, max, avg and stddev.
+//
+// time, tp_from, tp_to and tp_generated are written as Excel datetimes, shown with the number format
+// of their template cell, or Excel's default datetime format when the cell has none.
+const (
+	TemplateRecordsName   = "tp_records"   // row: one line per record, box by box
+	TemplateStatsName     = "tp_stats"     // row: one line per box and metric over the range
+	TemplateGroupName     = "tp_group"     // cell: group name
+	TemplateFromName      = "tp_from"      // cell: start of the range
+	TemplateToName        = "tp_to"        // cell: end of the range
+	TemplateGeneratedName = "tp_generated" // cell: generation time
+)
+
+// ExportTemplate is the xlsx layout a group's records are exported into, one per group
+type ExportTemplate struct {
+	GroupID    string   `json:"group_id" bson:"_id"`
+	Filename   string   `json:"filename" bson:"filename"`
+	Size       int64    `json:"size" bson:"size"`
+	Names      []string `json:"names" bson:"names"` // defined names found in the file
+	Data       []byte   `json:"-" bson:"data"`
+	UploadedBy string   `json:"uploaded_by" bson:"uploaded_by"`
+	CTime      int64    `json:"ctime" bson:"ctime"`
+	MTime      int64    `json:"mtime" bson:"mtime"`
+}
+
+// TemplateValidationError lists why a template cannot be used
+type TemplateValidationError struct {
+	Problems []string
+}
+
+func (e *TemplateValidationError) Error() string {
+	return "invalid export template"
+}
+
+var (
+	ErrExportTemplateNotFound = errors.New("export template not found")
+	ErrExportTemplateTooLarge = errors.New("export template too large")
+	ErrTooManyTemplateRows    = errors.New("too many records for a template export, narrow the time range")
+)
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+)
+
+// Feature names a feature that can be turned on or off per deployment without a separate build
+type Feature string
+
+const (
+	FeatureAnomalyDetection Feature = "anomaly_detection" // flag anomalous values at ingest and clear the flags by hand
+	FeatureRecordPoll       Feature = "record_poll"       // long polls for new records
+)
+
+// FeatureDefinition is a feature with its state when neither the environment nor an admin set it
+type FeatureDefinition struct {
+	Name        Feature `json:"name"`
+	Default     bool    `json:"default"`
+	Description string  `json:"description"`
+}
+
+// FeatureDefinitions are the features the API knows
+var FeatureDefinitions = []FeatureDefinition{
+	{Name: FeatureAnomalyDetection, Default: true, Description: "Flag record values far off the box's recent values (boxes' anomaly_policy)"},
+	{Name: FeatureRecordPoll, Default: true, Description: "GET /boxes/{id}/records/poll"},
+}
+
+// FeatureFlagsSettingKey is the key of the setting holding the features turned on or off by an
+// admin, by name, e.g. {"record_poll": false}
+const FeatureFlagsSettingKey = "feature_flags"
+
+// Where the state of a feature comes from, by increasing precedence
+const (
+	FeatureSourceDefault = "default"
+	FeatureSourceEnv     = "env"
+	FeatureSourceRuntime = "runtime"
+)
+
+// FeatureState is the state of a feature and where it comes from
+type FeatureState struct {
+	FeatureDefinition
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+}
+
+// FeatureFlags holds which features are on, by name
+type FeatureFlags map[Feature]bool
+
+// Enabled reports whether the feature is on
+func (f FeatureFlags) Enabled(feature Feature) bool {
+	return f[feature]
+}
+
+// ResolveFeatures applies the environment's overrides, then the runtime ones, to the defaults of
+// the known features; overrides of unknown features are ignored
+func ResolveFeatures(env, runtime map[string]bool) []FeatureState {
+	states := make([]FeatureState, len(FeatureDefinitions))
+	for i, def := range FeatureDefinitions {
+		states[i] = FeatureState{FeatureDefinition: def, Enabled: def.Default, Source: FeatureSourceDefault}
+		if enabled, ok := env[string(def.Name)]; ok {
+			states[i].Enabled, states[i].Source = enabled, FeatureSourceEnv
+		}
+		if enabled, ok := runtime[string(def.Name)]; ok {
+			states[i].Enabled, states[i].Source = enabled, FeatureSourceRuntime
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// KnownFeature reports whether the API knows the feature
+func KnownFeature(name string) bool {
+	for _, def := range FeatureDefinitions {
+		if string(def.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFeatureParams turns a feature on or off at runtime; a null enabled drops the runtime override
+type SetFeatureParams struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// ErrFeatureNotFound is returned for a feature the API does not know
+var ErrFeatureNotFound = errors.New("feature not found")
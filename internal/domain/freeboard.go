@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Freeboard levels (m) at or below which the freeboard of a dam is a warning, then critical
+const (
+	FreeboardWarningLevel  = 1.0
+	FreeboardCriticalLevel = 0.5
+)
+
+// Configuration problems keeping the freeboard of a group from being computed
+const (
+	FreeboardNoCrestElevation   = "crest_elevation_missing" // note.crest_elevation is not set
+	FreeboardNoPrimaryBox       = "primary_box_missing"     // primary_box_id is not set
+	FreeboardPrimaryBoxNotFound = "primary_box_not_found"   // the primary box was deleted or moved to another group
+	FreeboardNoWaterLevel       = "water_level_missing"     // the primary box has no record with a WAU value
+)
+
+// Freeboard is the height (m) of the dam crest above the latest water level of the group's primary
+// box. Value is nil, with the reasons listed in Problems, when it cannot be computed.
+type Freeboard struct {
+	Value          *float64      `json:"value"`
+	Severity       AlertSeverity `json:"severity,omitempty"`
+	CrestElevation *float64      `json:"crest_elevation"`
+	WaterLevel     *float64      `json:"water_level"`
+	BoxID          string        `json:"box_id,omitempty"`
+	Time           *int64        `json:"time,omitempty"` // sensor time of the water level (seconds)
+	Problems       []string      `json:"problems,omitempty"`
+}
+
+// Classify computes the freeboard once the crest elevation and water level are known
+func (f *Freeboard) Classify() {
+	if f.CrestElevation == nil || f.WaterLevel == nil {
+		return
+	}
+	value := RoundValue(*f.CrestElevation - *f.WaterLevel)
+	f.Value = &value
+	switch {
+	case value <= FreeboardCriticalLevel:
+		f.Severity = AlertCritical
+	case value <= FreeboardWarningLevel:
+		f.Severity = AlertWarning
+	default:
+		f.Severity = AlertInfo
+	}
+}
+
+// GroupStatus holds the indicators computed for a group from its configuration and latest records
+type GroupStatus struct {
+	GroupID   string    `json:"group_id"`
+	Freeboard Freeboard `json:"freeboard"`
+}
+
+var elevationNumber = regexp.MustCompile(`[-+]?\d+(?:[.,]\d+)?`)
+
+// ParseElevation reads the first number of an elevation entered as text in a group note, such as
+// "+25,50 m" or "25.5m", accepting a decimal comma
+func ParseElevation(s string) (float64, bool) {
+	match := elevationNumber.FindString(s)
+	if match == "" {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.Replace(match, ",", ".", 1), 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"tp25-api/lib/interpolation"
+)
+
+// MaxCurvePoints bounds the points of a hydraulic curve
+const MaxCurvePoints = 500
+
+// CurvePoint maps a water level (X) to a volume or flow (Y)
+type CurvePoint struct {
+	X float64 `json:"x" bson:"x"`
+	Y float64 `json:"y" bson:"y"`
+}
+
+// HydraulicsConfig holds the curves V, Q and Q_of are derived from for the boxes of a group.
+// It is stored as the setting HydraulicsSettingKey(group ID), so every change is kept in the
+// settings history and can be restored from there.
+type HydraulicsConfig struct {
+	VolumeCurve []CurvePoint `json:"volume_curve" bson:"volume_curve"`                 // WAU -> V (10^6 m³)
+	FlowCurve   []CurvePoint `json:"flow_curve,omitempty" bson:"flow_curve,omitempty"` // WAU -> Q (m³/s); Q follows DR when empty
+	OverflowM   float64      `json:"overflow_m" bson:"overflow_m"`                     // overflow coefficient
+	OverflowB   float64      `json:"overflow_b" bson:"overflow_b"`                     // weir width (m)
+}
+
+// HydraulicsSettingKey is the key of the setting holding a group's hydraulic configuration
+func HydraulicsSettingKey(groupID string) string {
+	return hydraulicsSettingPrefix + groupID
+}
+
+// IsHydraulicsSettingKey reports whether key is the key of a group's hydraulic configuration
+func IsHydraulicsSettingKey(key string) bool {
+	return strings.HasPrefix(key, hydraulicsSettingPrefix)
+}
+
+const hydraulicsSettingPrefix = "hydraulics_"
+
+// Validate checks that the curves are usable for interpolation: between 2 and MaxCurvePoints
+// finite points, levels strictly increasing and values never decreasing. A rejected configuration
+// fails with a *HydraulicsError listing every offending point.
+func (c *HydraulicsConfig) Validate() error {
+	var problems []HydraulicsProblem
+	problems = append(problems, curveProblems("volume_curve", c.VolumeCurve)...)
+	if len(c.FlowCurve) > 0 {
+		problems = append(problems, curveProblems("flow_curve", c.FlowCurve)...)
+	}
+	if !isPositive(c.OverflowM) {
+		problems = append(problems, HydraulicsProblem{Field: "overflow_m", Reason: "must be positive"})
+	}
+	if !isPositive(c.OverflowB) {
+		problems = append(problems, HydraulicsProblem{Field: "overflow_b", Reason: "must be positive"})
+	}
+
+	if len(problems) > 0 {
+		return &HydraulicsError{Problems: problems}
+	}
+	return nil
+}
+
+func curveProblems(field string, points []CurvePoint) []HydraulicsProblem {
+	var problems []HydraulicsProblem
+	if len(points) > MaxCurvePoints {
+		problems = append(problems, HydraulicsProblem{Field: field, Reason: fmt.Sprintf("at most %d points", MaxCurvePoints)})
+	}
+
+	if err := interpolation.ValidatePoints(InterpolationPoints(points)); err != nil {
+		for _, p := range err.(*interpolation.CurveError).Problems {
+			problem := HydraulicsProblem{Field: field, Reason: p.Err.Error()}
+			if p.Index >= 0 {
+				index := p.Index
+				problem.Index = &index
+				if p.Err != interpolation.ErrNonFinite {
+					problem.Point = &points[p.Index]
+				}
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	for i := 1; i < len(points); i++ {
+		if points[i].Y < points[i-1].Y {
+			index := i
+			problems = append(problems, HydraulicsProblem{Field: field, Index: &index, Point: &points[i], Reason: "y lower than the previous point"})
+		}
+	}
+	return problems
+}
+
+// InterpolationPoints converts curve points for the interpolation package
+func InterpolationPoints(points []CurvePoint) []interpolation.Point {
+	result := make([]interpolation.Point, len(points))
+	for i, p := range points {
+		result[i] = interpolation.Point{X: p.X, Y: p.Y}
+	}
+	return result
+}
+
+func isPositive(f float64) bool {
+	return f > 0 && !math.IsInf(f, 0)
+}
+
+// HydraulicsExport is the document exchanged by the hydraulics export and import endpoints.
+// Default is set when the group has no configuration of its own and the built-in curves apply.
+// Warnings flag boxes of the group whose recorded levels the curves do not cover; they are
+// ignored on import.
+type HydraulicsExport struct {
+	GroupID    string           `json:"group_id"`
+	Default    bool             `json:"default"`
+	SettingID  string           `json:"setting_id,omitempty"`
+	Hydraulics HydraulicsConfig `json:"hydraulics"`
+	Warnings   []string         `json:"warnings,omitempty"`
+}
+
+// HydraulicsProblem is one reason a hydraulic configuration was rejected. Index and Point locate
+// the offending curve point, when the problem is about one.
+type HydraulicsProblem struct {
+	Field  string      `json:"field"`
+	Index  *int        `json:"index,omitempty"`
+	Point  *CurvePoint `json:"point,omitempty"`
+	Reason string      `json:"reason"`
+}
+
+// HydraulicsError lists every problem of a rejected hydraulic configuration
+type HydraulicsError struct {
+	Problems []HydraulicsProblem
+}
+
+func (e *HydraulicsError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		messages[i] = p.Field
+		if p.Index != nil {
+			messages[i] += fmt.Sprintf("[%d]", *p.Index)
+		}
+		messages[i] += ": " + p.Reason
+	}
+	return "invalid hydraulic configuration: " + strings.Join(messages, "; ")
+}
+
+var (
+	ErrHydraulicsNotConfigured = errors.New("group has no hydraulic configuration")
+)
+
+// UnconfiguredHydraulicsWindow is how far back GET /admin/hydraulics/unconfigured looks
+const UnconfiguredHydraulicsWindow = 24 * 3600 // seconds
+
+// UnconfiguredGroup is a group whose boxes recently had V, Q and Q_of derived with the built-in
+// curves and weir parameters because the group has no hydraulic configuration of its own
+type UnconfiguredGroup struct {
+	GroupID string            `json:"group_id"`
+	Name    string            `json:"name,omitempty"`
+	Boxes   []UnconfiguredBox `json:"boxes"`
+}
+
+// UnconfiguredBox counts the records of a box derived with the built-in hydraulics
+type UnconfiguredBox struct {
+	BoxID   string `json:"box_id"`
+	Name    string `json:"name,omitempty"`
+	Records int64  `json:"records"` // within the window, since the server started
+	LastAt  int64  `json:"last_at"` // when the latest one was received (seconds)
+}
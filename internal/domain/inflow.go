@@ -0,0 +1,134 @@
+package domain
+
+import "errors"
+
+// Inflow intervals accepted by GET /groups/{id}/inflow, in seconds
+var InflowIntervals = map[string]int64{
+	"hour": 3600,
+	"day":  86400,
+}
+
+// MaxInflowIntervals bounds the points of an inflow series
+const MaxInflowIntervals = 5000
+
+// Quality flags of an inflow point
+const (
+	InflowComplete = "complete" // at least the expected number of level samples
+	InflowPartial  = "partial"  // fewer level samples than expected, or no outflow for some of them
+	InflowMissing  = "missing"  // not enough level samples to estimate a storage change
+)
+
+// InflowSample is one record of the box the inflow is estimated for
+type InflowSample struct {
+	Time    int64    // seconds
+	WAU     float64  // water level
+	Q       *float64 // m³/s, nil when the record has none
+	QOf     *float64 // m³/s, nil when the record has none
+	Volume  float64  // 10^6 m³, from the volume curve
+	HasFlow bool     // Q or Q_of is set
+}
+
+// InflowPoint is the estimated inflow over [From, To). StorageChange is dV/dt and Outflow the mean
+// Q + Q_of over the interval, all in m³/s; Inflow is their sum. The values are nil when Quality
+// is InflowMissing.
+type InflowPoint struct {
+	From            int64    `json:"from"`
+	To              int64    `json:"to"`
+	Inflow          *float64 `json:"inflow"`
+	StorageChange   *float64 `json:"storage_change"`
+	Outflow         *float64 `json:"outflow"`
+	Samples         int      `json:"samples"`          // level samples in the interval
+	OutflowSamples  int      `json:"outflow_samples"`  // those with Q or Q_of
+	ExpectedSamples int64    `json:"expected_samples"` // at the box's expected interval
+	Quality         string   `json:"quality"`
+}
+
+// InflowSeries is the inflow of a reservoir estimated from the records of the box measuring its level
+type InflowSeries struct {
+	GroupID          string        `json:"group_id"`
+	BoxID            string        `json:"box_id"`
+	TimeMin          int64         `json:"time_min"`
+	TimeMax          int64         `json:"time_max"`
+	Interval         int64         `json:"interval"`          // seconds
+	ExpectedInterval int64         `json:"expected_interval"` // of the level box, at time_min
+	DefaultCurve     bool          `json:"default_curve"`     // the group has no volume curve of its own
+	Points           []InflowPoint `json:"points"`
+}
+
+// EstimateInflow computes the inflow of each interval of [from, to] from samples sorted by time;
+// expectedSamples gives the level samples expected in a time range, see Box.ExpectedSamplesIn.
+// The storage change of an interval runs from the last sample before it, when there is one no
+// more than an interval earlier, or else its first sample, to its last sample, so consecutive
+// intervals chain and an interval with a single sample still gets an estimate.
+func EstimateInflow(samples []InflowSample, from, to, interval int64, expectedSamples func(from, to int64) int64) []InflowPoint {
+	points := []InflowPoint{}
+	var previous *InflowSample
+	i := 0
+	for start := from; start <= to; start += interval {
+		end := start + interval
+		point := InflowPoint{From: start, To: end, ExpectedSamples: expectedSamples(start, end-1)}
+
+		// The last sample before the interval
+		for i < len(samples) && samples[i].Time < start {
+			previous = &samples[i]
+			i++
+		}
+		first := previous
+		if first != nil && start-first.Time > interval {
+			first = nil
+		}
+
+		var last *InflowSample
+		var outflow float64
+		for ; i < len(samples) && samples[i].Time < end; i++ {
+			sample := &samples[i]
+			if first == nil {
+				first = sample
+			}
+			last = sample
+			point.Samples++
+			if sample.HasFlow {
+				point.OutflowSamples++
+				if sample.Q != nil {
+					outflow += *sample.Q
+				}
+				if sample.QOf != nil {
+					outflow += *sample.QOf
+				}
+			}
+		}
+		if last != nil {
+			previous = last
+		}
+
+		if last == nil || first == last || last.Time <= first.Time {
+			point.Quality = InflowMissing
+			points = append(points, point)
+			continue
+		}
+
+		// 10^6 m³ over seconds to m³/s
+		storage := RoundValue((last.Volume - first.Volume) * 1e6 / float64(last.Time-first.Time))
+		point.StorageChange = &storage
+		mean := 0.0
+		if point.OutflowSamples > 0 {
+			mean = RoundValue(outflow / float64(point.OutflowSamples))
+		}
+		point.Outflow = &mean
+		inflow := RoundValue(storage + mean)
+		point.Inflow = &inflow
+
+		point.Quality = InflowComplete
+		if int64(point.Samples) < point.ExpectedSamples || point.OutflowSamples < point.Samples {
+			point.Quality = InflowPartial
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+var (
+	ErrInvalidInflowInterval = errors.New("interval must be hour or day")
+	ErrInflowRangeTooLong    = errors.New("time range holds too many intervals")
+	ErrNoLevelBox            = errors.New("group has no box reporting WAU")
+)
@@ -0,0 +1,162 @@
+package domain
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// IngestRecord is the body devices post a reading with. Metrics maps the box's metric codes to
+// the values read, in the box's input units (see IngestSchema).
+type IngestRecord struct {
+	Timestamp *int64                 `json:"timestamp" example:"1718000000"` // sensor time, seconds since the epoch (UTC)
+	Metrics   map[string]interface{} `json:"metrics" swaggertype:"object,number" example:"WAU:12.34,DR:0.5"`
+}
+
+// Validate checks the reading field by field and fails with an *IngestValidationError
+func (r *IngestRecord) Validate() error {
+	var problems []IngestProblem
+	switch {
+	case r.Timestamp == nil:
+		problems = append(problems, IngestProblem{Field: "timestamp", Reason: "required"})
+	case *r.Timestamp <= 0:
+		problems = append(problems, IngestProblem{Field: "timestamp", Reason: "must be positive"})
+	case *r.Timestamp > 1e12:
+		problems = append(problems, IngestProblem{Field: "timestamp", Reason: "must be in seconds, not milliseconds"})
+	}
+
+	if len(r.Metrics) == 0 {
+		problems = append(problems, IngestProblem{Field: "metrics", Reason: "at least one metric is required"})
+	}
+	for code, value := range r.Metrics {
+		field := "metrics." + code
+		if code == "" || strings.ContainsAny(code, ".$") {
+			problems = append(problems, IngestProblem{Field: field, Reason: "invalid metric code"})
+			continue
+		}
+		if recordMetaKeys[code] || strings.HasPrefix(code, RawValuePrefix) {
+			problems = append(problems, IngestProblem{Field: field, Reason: "reserved field name"})
+			continue
+		}
+		v, ok := value.(float64)
+		if !ok {
+			problems = append(problems, IngestProblem{Field: field, Reason: "must be a number"})
+			continue
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			problems = append(problems, IngestProblem{Field: field, Reason: "must be finite"})
+		}
+	}
+
+	if len(problems) > 0 {
+		// Metrics come from a map: order the problems so responses are stable
+		sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+		return &IngestValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ToRecord converts a validated reading to the record stored for it
+func (r *IngestRecord) ToRecord() Record {
+	record := Record{"_id": *r.Timestamp}
+	for code, value := range r.Metrics {
+		record[code] = value
+	}
+	return record
+}
+
+// IngestProblem is one reason a reading was rejected; Field is its JSON path, e.g. metrics.WAU
+type IngestProblem struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// IngestValidationError lists every problem of a rejected reading
+type IngestValidationError struct {
+	Problems []IngestProblem
+}
+
+func (e *IngestValidationError) Error() string {
+	return "invalid record"
+}
+
+// IngestSchema describes what a box's logger is expected to post
+type IngestSchema struct {
+	BoxID         string               `json:"box_id"`
+	TimestampUnit string               `json:"timestamp_unit" example:"s"`
+	Metrics       []IngestSchemaMetric `json:"metrics"`
+	Derived       []string             `json:"derived"` // fields the server computes, not to be sent
+	Example       IngestRecord         `json:"example"`
+}
+
+// IngestSchemaMetric is a metric a box reports. Unit is the unit to send the value in, which is
+// the conversion's input unit when the box reports the metric in another unit than the catalog.
+type IngestSchemaMetric struct {
+	Code   string `json:"code"`
+	Name   string `json:"name"`
+	Unit   string `json:"unit"`
+	Manual bool   `json:"manual,omitempty"`
+}
+
+// BoxIngestStats counts the records a box sent over the last hour, day and week, by sensor timestamp
+type BoxIngestStats struct {
+	BoxID    string `json:"box_id"`
+	LastHour int64  `json:"last_hour"`
+	Last24h  int64  `json:"last_24h"`
+	Last7d   int64  `json:"last_7d"`
+	Latest   *int64 `json:"latest,omitempty"` // timestamp of the newest record (seconds), nil when there is none
+	At       int64  `json:"at"`               // when the counts were taken (seconds)
+}
+
+// GroupIngestStats sums the ingest stats of a group's boxes; Latest is the newest record of any box
+type GroupIngestStats struct {
+	GroupID  string           `json:"group_id"`
+	LastHour int64            `json:"last_hour"`
+	Last24h  int64            `json:"last_24h"`
+	Last7d   int64            `json:"last_7d"`
+	Latest   *int64           `json:"latest,omitempty"`
+	At       int64            `json:"at"`
+	Boxes    []BoxIngestStats `json:"boxes"`
+}
+
+// NewGroupIngestStats totals the stats of a group's boxes
+func NewGroupIngestStats(groupID string, boxes []BoxIngestStats, at int64) *GroupIngestStats {
+	stats := &GroupIngestStats{GroupID: groupID, At: at, Boxes: boxes}
+	for _, box := range boxes {
+		stats.LastHour += box.LastHour
+		stats.Last24h += box.Last24h
+		stats.Last7d += box.Last7d
+		if box.Latest != nil && (stats.Latest == nil || *box.Latest > *stats.Latest) {
+			latest := *box.Latest
+			stats.Latest = &latest
+		}
+	}
+	return stats
+}
+
+// MetricsMatrix tells, for every box of a zone, which of its configured metrics have records since Since
+type MetricsMatrix struct {
+	ZoneID  string               `json:"zone_id"`
+	Days    int                  `json:"days"`
+	Since   int64                `json:"since"`   // seconds
+	Metrics []string             `json:"metrics"` // every code configured on a box, sorted
+	Groups  []MetricsMatrixGroup `json:"groups"`
+}
+
+type MetricsMatrixGroup struct {
+	ID    string             `json:"id"`
+	Name  string             `json:"name"`
+	Boxes []MetricsMatrixBox `json:"boxes"`
+}
+
+// MetricsMatrixBox lists the metrics configured on a box, in the order of Box.Metrics
+type MetricsMatrixBox struct {
+	ID      string               `json:"id"`
+	Name    string               `json:"name"`
+	Metrics []MetricAvailability `json:"metrics"`
+}
+
+type MetricAvailability struct {
+	Code    string `json:"code"`
+	HasData bool   `json:"has_data"`
+}
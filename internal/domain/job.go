@@ -0,0 +1,94 @@
+package domain
+
+import (
+	"errors"
+	"time"
+	"tp25-api/lib"
+)
+
+// JobStatus is the state of a background job
+type JobStatus string
+
+const (
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+	JobPending JobStatus = "pending"
+)
+
+// Job types
+const (
+	JobRecomputeConversion = "recompute_conversion"
+	JobRollupBackfill      = "rollup_backfill"
+	JobReindex             = "reindex"
+	JobRebuildRollups      = "rebuild_rollups"
+	JobExportRecords       = "export_records"
+)
+
+// MaintenanceJobs are the job types that rebuild derived data; only one of them runs at a time
+var MaintenanceJobs = []string{JobReindex, JobRebuildRollups, JobRollupBackfill}
+
+// Job tracks a long-running operation started through the API. Jobs run inside the API process
+// that started them, which refreshes their heartbeat; jobs whose heartbeat stopped, their process
+// having stopped, are marked failed by any instance.
+type Job struct {
+	ID        string                 `json:"id" bson:"_id"`
+	Type      string                 `json:"type" bson:"type"`
+	Status    JobStatus              `json:"status" bson:"status"`
+	Params    map[string]interface{} `json:"params,omitempty" bson:"params,omitempty"`
+	Processed int64                  `json:"processed" bson:"processed"`
+	Updated   int64                  `json:"updated" bson:"updated"`
+	Error     string                 `json:"error,omitempty" bson:"error,omitempty"`
+	// Collections reports the progress of a maintenance job per collection
+	Collections []JobCollection `json:"collections,omitempty" bson:"collections,omitempty"`
+	CreatedBy   string          `json:"created_by" bson:"created_by"`
+	CTime       int64           `json:"ctime" bson:"ctime"`
+	MTime       int64           `json:"mtime" bson:"mtime"`
+	FinishedAt  *int64          `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+	Heartbeat   int64           `json:"-" bson:"heartbeat"` // milliseconds, when the process running the job last reported
+	// File is the file an export job produced, downloadable until it expires
+	File *JobFile `json:"file,omitempty" bson:"file,omitempty"`
+	// DownloadURL is a signed link to File that works without signing in, shown to the job's owner
+	DownloadURL string `json:"download_url,omitempty" bson:"-"`
+}
+
+// JobFile describes the file stored for an export job
+type JobFile struct {
+	Filename    string `json:"filename" bson:"filename"`
+	ContentType string `json:"content_type" bson:"content_type"`
+	Size        int64  `json:"size" bson:"size"`
+	ExpiresAt   int64  `json:"expires_at" bson:"expires_at"` // seconds
+}
+
+// JobCollection is the progress of a job over one collection. Status is pending until a worker
+// picks the collection up.
+type JobCollection struct {
+	Name      string    `json:"name" bson:"name"`
+	Status    JobStatus `json:"status" bson:"status"`
+	Processed int64     `json:"processed" bson:"processed"`
+	Updated   int64     `json:"updated" bson:"updated"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// NewJob creates a running job
+func NewJob(jobType, createdBy string, params map[string]interface{}) *Job {
+	now := time.Now().UnixMilli()
+	return &Job{
+		ID:        lib.Rand.Char(12),
+		Type:      jobType,
+		Status:    JobRunning,
+		Params:    params,
+		CreatedBy: createdBy,
+		CTime:     now,
+		MTime:     now,
+		Heartbeat: now,
+	}
+}
+
+var (
+	ErrJobNotFound           = errors.New("job not found")
+	ErrMaintenanceJobRunning = errors.New("another maintenance job is running")
+	ErrExportFileNotFound    = errors.New("export file not found")
+	ErrExportFileExpired     = errors.New("export file expired")
+	ErrInvalidDownloadToken  = errors.New("invalid download link")
+)
@@ -0,0 +1,112 @@
+package domain
+
+import (
+	"errors"
+	"time"
+	"tp25-api/lib"
+)
+
+// MaintenanceWindow is planned sensor work on one box or on every box of a group, in seconds.
+// Windows may overlap; a box is in maintenance while any window covering it is active.
+// Windows that have started cannot be deleted so they stay available for audit.
+type MaintenanceWindow struct {
+	ID        string `json:"id" bson:"_id"`
+	BoxID     string `json:"box_id,omitempty" bson:"box_id,omitempty"`
+	GroupID   string `json:"group_id,omitempty" bson:"group_id,omitempty"`
+	Start     int64  `json:"start" bson:"start"`
+	End       int64  `json:"end" bson:"end"`
+	Reason    string `json:"reason" bson:"reason"`
+	CreatedBy string `json:"created_by" bson:"created_by"`
+	CTime     int64  `json:"ctime" bson:"ctime"`
+	MTime     int64  `json:"mtime" bson:"mtime"`
+	DTime     *int64 `json:"dtime,omitempty" bson:"dtime,omitempty"`
+}
+
+// ActiveAt reports whether the window covers t (seconds)
+func (w *MaintenanceWindow) ActiveAt(t int64) bool {
+	return w.Start <= t && t < w.End
+}
+
+type CreateMaintenanceParams struct {
+	BoxID   string `json:"box_id"`
+	GroupID string `json:"group_id"`
+	Start   int64  `json:"start" binding:"required"`
+	End     int64  `json:"end" binding:"required"`
+	Reason  string `json:"reason" binding:"required"`
+}
+
+// UpdateMaintenanceParams changes a window; setting end to now closes a running window early
+type UpdateMaintenanceParams struct {
+	Start  *int64  `json:"start"`
+	End    *int64  `json:"end"`
+	Reason *string `json:"reason"`
+}
+
+// FilterMaintenanceParams selects windows; From/To keep the windows overlapping that range
+type FilterMaintenanceParams struct {
+	BoxID   *string
+	GroupID *string
+	From    *int64
+	To      *int64
+}
+
+// MaintenanceStatus is the maintenance state of a box at a point in time
+type MaintenanceStatus struct {
+	Active bool  `json:"active"`
+	Until  int64 `json:"until,omitempty"` // end of the latest active window
+}
+
+// BoxMaintenanceStatus merges the windows active at t covering each box, keyed by box ID
+func BoxMaintenanceStatus(windows []MaintenanceWindow, boxes []Box, t int64) map[string]MaintenanceStatus {
+	statuses := make(map[string]MaintenanceStatus)
+	for _, box := range boxes {
+		var covering []MaintenanceWindow
+		for _, w := range windows {
+			if w.BoxID == box.ID || (w.GroupID != "" && w.GroupID == box.GroupID) {
+				covering = append(covering, w)
+			}
+		}
+		if status := MaintenanceStatusAt(covering, t); status.Active {
+			statuses[box.ID] = status
+		}
+	}
+	return statuses
+}
+
+// MaintenanceStatusAt merges the windows active at t, which may overlap
+func MaintenanceStatusAt(windows []MaintenanceWindow, t int64) MaintenanceStatus {
+	var status MaintenanceStatus
+	for i := range windows {
+		if windows[i].ActiveAt(t) {
+			status.Active = true
+			if windows[i].End > status.Until {
+				status.Until = windows[i].End
+			}
+		}
+	}
+	return status
+}
+
+// NewMaintenanceWindow creates a new maintenance window with timestamps
+func NewMaintenanceWindow(params CreateMaintenanceParams, createdBy string) *MaintenanceWindow {
+	now := time.Now().UnixMilli()
+	return &MaintenanceWindow{
+		ID:        lib.Rand.Char(12),
+		BoxID:     params.BoxID,
+		GroupID:   params.GroupID,
+		Start:     params.Start,
+		End:       params.End,
+		Reason:    params.Reason,
+		CreatedBy: createdBy,
+		CTime:     now,
+		MTime:     now,
+	}
+}
+
+var (
+	ErrMaintenanceNotFound     = errors.New("maintenance window not found")
+	ErrInvalidMaintenanceScope = errors.New("maintenance window needs exactly one of box_id or group_id")
+	ErrInvalidMaintenanceRange = errors.New("maintenance window end must be after start")
+	ErrMaintenanceStarted      = errors.New("maintenance window has started and can only be ended early")
+	ErrMaintenanceEnded        = errors.New("maintenance window has ended and is kept unchanged for audit")
+)
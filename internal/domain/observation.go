@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+	"tp25-api/lib"
+)
+
+// Observation is a reading taken by staff on site, e.g. from a staff gauge. Observations are kept
+// apart from the telemetry records of the box and merged into listings and reports on request.
+type Observation struct {
+	ID           string             `json:"id" bson:"_id"`
+	BoxID        string             `json:"box_id" bson:"box_id"`
+	Timestamp    int64              `json:"timestamp" bson:"timestamp"` // when the reading was taken (seconds)
+	Metrics      map[string]float64 `json:"metrics" bson:"metrics"`
+	ObserverName string             `json:"observer_name" bson:"observer_name"`
+	Note         string             `json:"note,omitempty" bson:"note,omitempty"`
+	PhotoRef     string             `json:"photo_ref,omitempty" bson:"photo_ref,omitempty"` // URL or storage key of a photo of the gauge
+	AuthorID     string             `json:"author_id" bson:"author_id"`
+	CTime        int64              `json:"ctime" bson:"ctime"`
+	MTime        int64              `json:"mtime" bson:"mtime"`
+	DTime        *int64             `json:"dtime,omitempty" bson:"dtime,omitempty"`
+}
+
+const (
+	MaxObservationNoteLength  = 4000
+	MaxObservationFieldLength = 500 // observer name and photo reference
+)
+
+// IncludeObservations is the include value merging the observations of a box into its record listing
+const IncludeObservations = "observations"
+
+// ObservationRecordKey holds, in an observation merged into a record listing, the observation's
+// own fields: id, observer_name, note and photo_ref. Its values are the record's metrics.
+const ObservationRecordKey = "observation"
+
+type CreateObservationParams struct {
+	Timestamp    *int64             `json:"timestamp"` // seconds, the current time when omitted
+	Metrics      map[string]float64 `json:"metrics" binding:"required" swaggertype:"object,number" example:"WAU:12.34"`
+	ObserverName string             `json:"observer_name" binding:"required"`
+	Note         string             `json:"note"`
+	PhotoRef     string             `json:"photo_ref"`
+}
+
+// UpdateObservationParams corrects an observation; Metrics replaces all the values when set
+type UpdateObservationParams struct {
+	Timestamp    *int64             `json:"timestamp"`
+	Metrics      map[string]float64 `json:"metrics" swaggertype:"object,number"`
+	ObserverName *string            `json:"observer_name"`
+	Note         *string            `json:"note"`
+	PhotoRef     *string            `json:"photo_ref"`
+}
+
+// FilterObservationParams selects the observations of a box, From/To bound the timestamp (seconds, inclusive)
+type FilterObservationParams struct {
+	BoxID string
+	From  *int64
+	To    *int64
+}
+
+// Validate rejects observations without values, with values under reserved or malformed codes,
+// with a timestamp not in seconds and with overlong text
+func (o *Observation) Validate() error {
+	if o.Timestamp <= 0 || o.Timestamp > 1e12 || len(o.Metrics) == 0 {
+		return ErrInvalidObservation
+	}
+	for code, value := range o.Metrics {
+		if code == "" || strings.ContainsAny(code, ".$") || recordMetaKeys[code] || recordInfoKeys[code] ||
+			strings.HasPrefix(code, RawValuePrefix) {
+			return ErrInvalidObservation
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return ErrInvalidObservation
+		}
+	}
+	if strings.TrimSpace(o.ObserverName) == "" || len([]rune(o.ObserverName)) > MaxObservationFieldLength ||
+		len([]rune(o.PhotoRef)) > MaxObservationFieldLength || len([]rune(o.Note)) > MaxObservationNoteLength {
+		return ErrInvalidObservation
+	}
+	return nil
+}
+
+// Apply sets the fields present in params
+func (o *Observation) Apply(params UpdateObservationParams) {
+	if params.Timestamp != nil {
+		o.Timestamp = *params.Timestamp
+	}
+	if params.Metrics != nil {
+		o.Metrics = params.Metrics
+	}
+	if params.ObserverName != nil {
+		o.ObserverName = *params.ObserverName
+	}
+	if params.Note != nil {
+		o.Note = *params.Note
+	}
+	if params.PhotoRef != nil {
+		o.PhotoRef = *params.PhotoRef
+	}
+}
+
+// NewObservation creates a new observation with timestamps
+func NewObservation(boxID string, params CreateObservationParams, author *User) *Observation {
+	now := time.Now()
+	timestamp := now.Unix()
+	if params.Timestamp != nil {
+		timestamp = *params.Timestamp
+	}
+	return &Observation{
+		ID:           lib.Rand.Char(12),
+		BoxID:        boxID,
+		Timestamp:    timestamp,
+		Metrics:      params.Metrics,
+		ObserverName: params.ObserverName,
+		Note:         params.Note,
+		PhotoRef:     params.PhotoRef,
+		AuthorID:     author.ID,
+		CTime:        now.UnixMilli(),
+		MTime:        now.UnixMilli(),
+	}
+}
+
+// ObservationAction is the kind of change that produced an observation history entry
+type ObservationAction string
+
+const (
+	ObservationActionUpdate ObservationAction = "update"
+	ObservationActionDelete ObservationAction = "delete"
+)
+
+// ObservationVersion is a snapshot of an observation taken just before it was corrected or deleted.
+// The snapshot was in force from its MTime until CTime (milliseconds).
+type ObservationVersion struct {
+	ID            string            `json:"id" bson:"_id"`
+	ObservationID string            `json:"observation_id" bson:"observation_id"`
+	Observation   Observation       `json:"observation" bson:"observation"`
+	Action        ObservationAction `json:"action" bson:"action"`
+	ActorID       string            `json:"actor_id" bson:"actor_id"`
+	CTime         int64             `json:"ctime" bson:"ctime"`
+}
+
+var (
+	ErrObservationNotFound = errors.New("observation not found")
+	ErrInvalidObservation  = errors.New("an observation needs an observer name and at least one finite metric value, with its timestamp in seconds")
+)
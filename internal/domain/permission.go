@@ -0,0 +1,89 @@
+package domain
+
+// Capability is an action the API lets a role perform. Routes are guarded by the capability they need,
+// so the capabilities reported to clients are the ones the server enforces.
+type Capability string
+
+const (
+	// Granted to every role
+	CapViewSites     Capability = "sites:view"
+	CapViewRecords   Capability = "records:view"
+	CapExportRecords Capability = "records:export"
+	CapAddRecords    Capability = "records:add"
+	CapWriteBoxLogs  Capability = "box_logs:write"
+
+	// Admin only
+	CapManageSites           Capability = "sites:manage" // zones, groups and boxes
+	CapManageMetrics         Capability = "metrics:manage"
+	CapManageMaintenance     Capability = "maintenance:manage"
+	CapManageExportTemplates Capability = "export_templates:manage"
+	CapManageUsers           Capability = "users:manage"
+	CapManageSettings        Capability = "settings:manage"
+	CapEditBoxLogs           Capability = "box_logs:edit"
+	CapEditObservations      Capability = "observations:edit"
+	CapViewQuality           Capability = "quality:view"
+	CapRecomputeRecords      Capability = "records:recompute" // also reads the resulting jobs
+	CapCorrectRecords        Capability = "records:correct"   // clears the flags of stored values
+	CapManageCalibrations    Capability = "calibrations:manage"
+	CapDebug                 Capability = "debug"
+)
+
+var baseCapabilities = []Capability{
+	CapViewSites,
+	CapViewRecords,
+	CapExportRecords,
+	CapAddRecords,
+	CapWriteBoxLogs,
+}
+
+var roleCapabilities = map[Role][]Capability{
+	RoleAdmin: append(append([]Capability{}, baseCapabilities...),
+		CapManageSites,
+		CapManageMetrics,
+		CapManageMaintenance,
+		CapManageExportTemplates,
+		CapManageUsers,
+		CapManageSettings,
+		CapEditBoxLogs,
+		CapEditObservations,
+		CapViewQuality,
+		CapRecomputeRecords,
+		CapCorrectRecords,
+		CapManageCalibrations,
+		CapDebug,
+	),
+	RoleMonitor: baseCapabilities,
+	// API keys only read, see APIKey
+	RoleAPIKey: {CapViewSites, CapViewRecords, CapExportRecords},
+}
+
+// Capabilities returns what the role may do, empty for unknown roles
+func (r Role) Capabilities() []Capability {
+	return append([]Capability{}, roleCapabilities[r]...)
+}
+
+// Can reports whether the role has the capability
+func (r Role) Can(capability Capability) bool {
+	for _, c := range roleCapabilities[r] {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupRef names a box group
+type GroupRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Permissions is what the authenticated user may see and do
+type Permissions struct {
+	UserID       string       `json:"user_id"`
+	Role         Role         `json:"role"`
+	AllGroups    bool         `json:"all_groups"`         // admins read every group, Groups then lists them all
+	ZoneIDs      []string     `json:"zone_ids,omitempty"` // zones whose groups are all readable, listed in Groups too
+	Groups       []GroupRef   `json:"groups"`
+	Capabilities []Capability `json:"capabilities"`
+}
@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+// Capabilities are reported to clients as what the server enforces, so each one guards a route
+func TestEveryCapabilityIsEnforced(t *testing.T) {
+	fset := token.NewFileSet()
+	declared, err := parser.ParseFile(fset, "permission.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parser.ParseFile(fset, "../server/server.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := map[string]bool{}
+	ast.Inspect(routes, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 1 {
+			return true
+		}
+		if fn, ok := call.Fun.(*ast.SelectorExpr); !ok || fn.Sel.Name != "RequireCapability" {
+			return true
+		}
+		if arg, ok := call.Args[0].(*ast.SelectorExpr); ok {
+			required[arg.Sel.Name] = true
+		}
+		return true
+	})
+
+	found := 0
+	ast.Inspect(declared, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		if typ, ok := spec.Type.(*ast.Ident); !ok || typ.Name != "Capability" {
+			return true
+		}
+		for _, name := range spec.Names {
+			found++
+			if !required[name.Name] {
+				t.Errorf("%s guards no route", name.Name)
+			}
+		}
+		return true
+	})
+	if found == 0 {
+		t.Fatal("no capabilities found")
+	}
+}
@@ -0,0 +1,210 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultExpectedInterval is the reporting interval assumed when neither the request nor the box
+// gives one (seconds)
+const DefaultExpectedInterval int64 = 600
+
+// MinExpectedInterval is the shortest reporting interval a box can be configured with (seconds)
+const MinExpectedInterval int64 = 10
+
+// ReportingPeriod sets the expected interval of a box over the months FromMonth through ToMonth
+// (1-12, UTC). A period whose ToMonth comes before its FromMonth runs over the new year.
+type ReportingPeriod struct {
+	FromMonth int   `json:"from_month" bson:"from_month"`
+	ToMonth   int   `json:"to_month" bson:"to_month"`
+	Interval  int64 `json:"interval_seconds" bson:"interval_seconds"`
+}
+
+func (p ReportingPeriod) covers(month time.Month) bool {
+	m := int(month)
+	if p.FromMonth <= p.ToMonth {
+		return m >= p.FromMonth && m <= p.ToMonth
+	}
+	return m >= p.FromMonth || m <= p.ToMonth
+}
+
+// ValidateReportingSchedule checks the expected interval of a box and its seasonal schedule,
+// whose periods may not overlap
+func ValidateReportingSchedule(interval *int64, schedule []ReportingPeriod) error {
+	if interval != nil && *interval < MinExpectedInterval {
+		return ErrInvalidExpectedInterval
+	}
+	var covered [13]bool
+	for _, period := range schedule {
+		if period.FromMonth < 1 || period.FromMonth > 12 || period.ToMonth < 1 || period.ToMonth > 12 {
+			return ErrInvalidReportingSchedule
+		}
+		if period.Interval < MinExpectedInterval {
+			return ErrInvalidExpectedInterval
+		}
+		for m := time.January; m <= time.December; m++ {
+			if period.covers(m) {
+				if covered[m] {
+					return ErrInvalidReportingSchedule
+				}
+				covered[m] = true
+			}
+		}
+	}
+	return nil
+}
+
+// ExpectedIntervalAt returns how often the box is expected to report at t (seconds): the interval
+// of the schedule period covering t's month, else the box's own interval, else DefaultExpectedInterval
+func (b *Box) ExpectedIntervalAt(t int64) int64 {
+	month := time.Unix(t, 0).UTC().Month()
+	for _, period := range b.Schedule {
+		if period.covers(month) {
+			return period.Interval
+		}
+	}
+	if b.ExpectedIntervalSeconds != nil {
+		return *b.ExpectedIntervalSeconds
+	}
+	return DefaultExpectedInterval
+}
+
+// ExpectedSamplesIn is the number of samples the box is expected to produce in [from, to],
+// counted month by month when it has a schedule
+func (b *Box) ExpectedSamplesIn(from, to int64) int64 {
+	if len(b.Schedule) == 0 {
+		return ExpectedSamples(from, to, b.ExpectedIntervalAt(from))
+	}
+	var samples int64
+	for start := from; start <= to; {
+		t := time.Unix(start, 0).UTC()
+		next := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		end := next - 1
+		if end > to {
+			end = to
+		}
+		samples += ExpectedSamples(start, end, b.ExpectedIntervalAt(start))
+		start = next
+	}
+	return samples
+}
+
+// Gap is a period without samples, in seconds
+type Gap struct {
+	From     int64 `json:"from"`
+	To       int64 `json:"to"`
+	Duration int64 `json:"duration"`
+}
+
+// FindGaps returns the periods longer than interval without samples inside [from, to].
+// timestamps must be sorted ascending and in seconds; the range edges count as gap bounds
+// so a box that stopped reporting before `to` shows a trailing gap.
+func FindGaps(timestamps []int64, from, to, interval int64) []Gap {
+	return FindGapsBy(timestamps, from, to, func(int64) int64 { return interval })
+}
+
+// FindGapsBy is FindGaps with an interval that varies over time, such as Box.ExpectedIntervalAt;
+// a gap is longer than the interval at its start
+func FindGapsBy(timestamps []int64, from, to int64, intervalAt func(t int64) int64) []Gap {
+	var gaps []Gap
+	prev := from
+	for _, t := range timestamps {
+		if t < from || t > to {
+			continue
+		}
+		if t-prev > intervalAt(prev) {
+			gaps = append(gaps, Gap{From: prev, To: t, Duration: t - prev})
+		}
+		prev = t
+	}
+	if to-prev > intervalAt(prev) {
+		gaps = append(gaps, Gap{From: prev, To: to, Duration: to - prev})
+	}
+	return gaps
+}
+
+// LongestGap returns the longest gap found by FindGaps, nil when there is none
+func LongestGap(timestamps []int64, from, to, interval int64) *Gap {
+	return LongestGapBy(timestamps, from, to, func(int64) int64 { return interval })
+}
+
+// LongestGapBy returns the longest gap found by FindGapsBy, nil when there is none
+func LongestGapBy(timestamps []int64, from, to int64, intervalAt func(t int64) int64) *Gap {
+	var longest *Gap
+	for _, gap := range FindGapsBy(timestamps, from, to, intervalAt) {
+		if longest == nil || gap.Duration > longest.Duration {
+			g := gap
+			longest = &g
+		}
+	}
+	return longest
+}
+
+// ExpectedSamples is the number of samples a box reporting every interval seconds produces in [from, to]
+func ExpectedSamples(from, to, interval int64) int64 {
+	if interval <= 0 || to < from {
+		return 0
+	}
+	return (to-from)/interval + 1
+}
+
+// QualityStats is the raw output of the quality aggregation for one box
+type QualityStats struct {
+	Duplicates int64
+	Timestamps []int64
+	OutOfRange map[string]int64
+}
+
+// MetricQuality counts values of one metric outside its configured bounds
+type MetricQuality struct {
+	Metric     string  `json:"metric"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	OutOfRange int64   `json:"out_of_range"`
+}
+
+// QualityReport describes the completeness of a box's data over a time range
+type QualityReport struct {
+	BoxID            string `json:"box_id"`
+	BoxName          string `json:"box_name"`
+	TimeMin          int64  `json:"time_min"`
+	TimeMax          int64  `json:"time_max"`
+	ExpectedInterval int64  `json:"expected_interval"` // at time_min
+	// The box schedule the expected samples and gaps followed, when no interval was requested
+	ReportingSchedule   []ReportingPeriod `json:"reporting_schedule,omitempty"`
+	ExpectedSamples     int64             `json:"expected_samples"`
+	ActualSamples       int64             `json:"actual_samples"`
+	Completeness        float64           `json:"completeness"` // percent
+	DuplicateTimestamps int64             `json:"duplicate_timestamps"`
+	LongestGap          *Gap              `json:"longest_gap,omitempty"`
+	OutOfRange          []MetricQuality   `json:"out_of_range"`
+}
+
+// GroupQualityReport rolls up the quality reports of all boxes in a group
+type GroupQualityReport struct {
+	GroupID             string          `json:"group_id"`
+	TimeMin             int64           `json:"time_min"`
+	TimeMax             int64           `json:"time_max"`
+	ExpectedInterval    int64           `json:"expected_interval,omitempty"` // when requested, else each box uses its own
+	ExpectedSamples     int64           `json:"expected_samples"`
+	ActualSamples       int64           `json:"actual_samples"`
+	Completeness        float64         `json:"completeness"` // percent
+	DuplicateTimestamps int64           `json:"duplicate_timestamps"`
+	OutOfRange          int64           `json:"out_of_range"`
+	LongestGapBoxID     string          `json:"longest_gap_box_id,omitempty"`
+	LongestGap          *Gap            `json:"longest_gap,omitempty"`
+	Boxes               []QualityReport `json:"boxes"`
+}
+
+// Completeness returns actual/expected as a rounded percentage
+func Completeness(actual, expected int64) float64 {
+	if expected <= 0 {
+		return 0
+	}
+	return RoundValue(float64(actual) * 100 / float64(expected))
+}
+
+var (
+	ErrInvalidExpectedInterval  = errors.New("invalid expected interval")
+	ErrInvalidReportingSchedule = errors.New("invalid reporting schedule")
+)
@@ -0,0 +1,38 @@
+package domain
+
+import "errors"
+
+// ReadOnlySettingKey is the key of the setting holding the read-only mode, so the mode survives
+// restarts and every toggle is kept in the settings history
+const ReadOnlySettingKey = "read_only"
+
+// DefaultReadOnlyRetryAfter is the Retry-After, in seconds, of writes refused in read-only mode
+const DefaultReadOnlyRetryAfter = 300
+
+// ReadOnlyMode keeps the API serving reads while refusing writes, e.g. during database migrations.
+// With BufferIngest, records posted by boxes are still accepted and held in the ingestion queue
+// until the mode is turned off, instead of being refused.
+type ReadOnlyMode struct {
+	Enabled      bool   `json:"enabled" bson:"enabled"`
+	BufferIngest bool   `json:"buffer_ingest" bson:"buffer_ingest"`
+	Reason       string `json:"reason,omitempty" bson:"reason,omitempty"`
+	RetryAfter   int    `json:"retry_after" bson:"retry_after"` // seconds
+	Since        int64  `json:"since,omitempty" bson:"since,omitempty"`
+	ActorID      string `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+}
+
+// BuffersIngest reports whether records are held in the ingestion queue rather than written
+func (m ReadOnlyMode) BuffersIngest() bool {
+	return m.Enabled && m.BufferIngest
+}
+
+// SetReadOnlyParams for turning the read-only mode on or off
+type SetReadOnlyParams struct {
+	Enabled      *bool  `json:"enabled" binding:"required"`
+	BufferIngest bool   `json:"buffer_ingest"`
+	Reason       string `json:"reason" binding:"max=500"`
+	RetryAfter   int    `json:"retry_after" binding:"omitempty,min=1,max=86400"`
+}
+
+// ErrReadOnly is returned for writes refused in read-only mode
+var ErrReadOnly = errors.New("server is read-only for maintenance")
@@ -0,0 +1,111 @@
+package domain
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Normalize turns a record read from the database into the one every endpoint returns. Values of
+// BSON types become plain JSON values: integers int64, decimals float64, dates milliseconds, object
+// IDs hex strings, and nested documents and arrays alike. Values with no JSON counterpart, such as
+// binary data, and non-finite numbers are dropped. The time fields of WithTimes and the flags of
+// WithFlags are added, and the stored flags they are read from removed.
+func (r Record) Normalize() Record {
+	for key, value := range r {
+		if normalized, ok := normalizeRecordValue(value); ok {
+			r[key] = normalized
+		} else {
+			delete(r, key)
+		}
+	}
+
+	r.WithTimes().WithFlags()
+	delete(r, RecordFlagsKey)
+	return r
+}
+
+// normalizeRecordValue converts a value decoded from BSON to a plain JSON value, reporting false
+// for values to drop. Values the services set themselves, such as maintenance times, are kept.
+func normalizeRecordValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil, bool, string, int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case float64:
+		return finiteFloat(v)
+	case float32:
+		return finiteFloat(float64(v))
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil, false
+		}
+		return finiteFloat(f)
+	case primitive.DateTime:
+		return int64(v), true
+	case time.Time:
+		return v.UnixMilli(), true
+	case primitive.Timestamp:
+		return int64(v.T), true
+	case primitive.ObjectID:
+		return v.Hex(), true
+	case primitive.Symbol:
+		return string(v), true
+	case primitive.Null:
+		return nil, true
+	case primitive.Binary, primitive.Regex, primitive.JavaScript, primitive.CodeWithScope,
+		primitive.DBPointer, primitive.MinKey, primitive.MaxKey, primitive.Undefined:
+		return nil, false
+	case primitive.A:
+		return normalizeRecordArray(v), true
+	case []interface{}:
+		return normalizeRecordArray(v), true
+	case primitive.D:
+		doc := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			if normalized, ok := normalizeRecordValue(e.Value); ok {
+				doc[e.Key] = normalized
+			}
+		}
+		return doc, true
+	case primitive.M:
+		return normalizeRecordDocument(v), true
+	case Record:
+		return normalizeRecordDocument(v), true
+	case map[string]interface{}:
+		return normalizeRecordDocument(v), true
+	}
+	return value, true
+}
+
+func normalizeRecordDocument(m map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		if normalized, ok := normalizeRecordValue(value); ok {
+			doc[key] = normalized
+		}
+	}
+	return doc
+}
+
+// normalizeRecordArray keeps the positions of the elements, dropped ones becoming null
+func normalizeRecordArray(a []interface{}) []interface{} {
+	array := make([]interface{}, len(a))
+	for i, value := range a {
+		array[i], _ = normalizeRecordValue(value)
+	}
+	return array
+}
+
+func finiteFloat(f float64) (interface{}, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	return f, true
+}
@@ -0,0 +1,97 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNormalizeBSONTypes(t *testing.T) {
+	id, _ := primitive.ObjectIDFromHex("65a1f0c2e4b0a1b2c3d4e5f6")
+	at := time.Date(2024, 1, 12, 8, 30, 0, 0, time.UTC)
+	decimal, _ := primitive.ParseDecimal128("12.375")
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"object id", id, "65a1f0c2e4b0a1b2c3d4e5f6"},
+		{"date time", primitive.NewDateTimeFromTime(at), at.UnixMilli()},
+		{"time", at, at.UnixMilli()},
+		{"decimal128", decimal, 12.375},
+		{"int32", int32(7), int64(7)},
+		{"nested document", primitive.D{{Key: "id", Value: id}, {Key: "n", Value: int32(1)}}, map[string]interface{}{"id": "65a1f0c2e4b0a1b2c3d4e5f6", "n": int64(1)}},
+		{"nested map", primitive.M{"at": primitive.NewDateTimeFromTime(at)}, map[string]interface{}{"at": at.UnixMilli()}},
+		{"array", primitive.A{int32(1), decimal, id}, []interface{}{int64(1), 12.375, "65a1f0c2e4b0a1b2c3d4e5f6"}},
+		{"array keeps the position of dropped values", primitive.A{primitive.Binary{Data: []byte{1}}, int32(2)}, []interface{}{nil, int64(2)}},
+		{"nested array in a document", primitive.D{{Key: "v", Value: primitive.A{primitive.D{{Key: "x", Value: int32(3)}}}}}, map[string]interface{}{"v": []interface{}{map[string]interface{}{"x": int64(3)}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := Record{"_id": int64(1705048200), "v": tt.value}.Normalize()
+			if !reflect.DeepEqual(record["v"], tt.want) {
+				t.Errorf("got %#v, want %#v", record["v"], tt.want)
+			}
+			if _, err := json.Marshal(record); err != nil {
+				t.Errorf("does not serialize: %v", err)
+			}
+		})
+	}
+}
+
+func TestNormalizeDropsValuesWithoutJSON(t *testing.T) {
+	record := Record{
+		"_id":    int64(1705048200),
+		"binary": primitive.Binary{Data: []byte{1, 2}},
+		"regex":  primitive.Regex{Pattern: "a"},
+		"minkey": primitive.MinKey{},
+		"bad":    primitive.NewDecimal128(0x7c00000000000000, 0), // NaN
+	}.Normalize()
+	for _, key := range []string{"binary", "regex", "minkey", "bad"} {
+		if value, ok := record[key]; ok {
+			t.Errorf("%s kept as %#v", key, value)
+		}
+	}
+}
+
+// Records decoded from stored documents normalize the same as built ones
+func TestNormalizeDecodedRecord(t *testing.T) {
+	id := primitive.NewObjectID()
+	at := time.Date(2024, 1, 12, 8, 30, 0, 0, time.UTC)
+	decimal, _ := primitive.ParseDecimal128("0.5")
+	data, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: int32(1705048200)},
+		{Key: "ref", Value: id},
+		{Key: "WAU", Value: decimal},
+		{Key: "seen", Value: primitive.NewDateTimeFromTime(at)},
+		{Key: "meta", Value: bson.D{{Key: "tags", Value: bson.A{"a", int32(2)}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record Record
+	if err := bson.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	record.Normalize()
+
+	want := Record{
+		"_id":       int64(1705048200),
+		"ref":       id.Hex(),
+		"WAU":       0.5,
+		"seen":      at.UnixMilli(),
+		"meta":      map[string]interface{}{"tags": []interface{}{"a", int64(2)}},
+		"timestamp": int64(1705048200),
+		// Fields holding anything but numbers are flagged
+		"flags": map[string][]string{RecordFlagNonNumeric: {"meta", "ref"}},
+	}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("got %#v\nwant %#v", record, want)
+	}
+}
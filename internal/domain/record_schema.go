@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Record schema sampling bounds, in records
+const (
+	DefaultSchemaSample = 10000
+	MaxSchemaSample     = 100000
+)
+
+// Kinds of the fields observed in the records of a box
+const (
+	RecordFieldConfigured = "configured" // the value of a metric configured on the box
+	RecordFieldDerived    = "derived"    // a raw value or rate of change kept for a configured metric
+	RecordFieldOrphan     = "orphan"     // a value no metric of the box is configured for
+)
+
+// RecordSchemaField is a field observed in the sampled records of a box. First and Last are the
+// sensor times (seconds) of the earliest and latest sampled records holding it, and Count how many
+// sampled records hold it, so they are exact only when the whole range was sampled.
+type RecordSchemaField struct {
+	Name  string   `json:"name"`
+	Kind  string   `json:"kind"`
+	Types []string `json:"types"` // BSON type names, e.g. double, int, string
+	First int64    `json:"first"`
+	Last  int64    `json:"last"`
+	Count int64    `json:"count"`
+}
+
+// RecordSchema lists the fields observed in a sample of the records of a box, with the configured
+// metrics that never showed up in it
+type RecordSchema struct {
+	BoxID   string              `json:"box_id"`
+	TimeMin *int64              `json:"time_min,omitempty"`
+	TimeMax *int64              `json:"time_max,omitempty"`
+	Sample  int                 `json:"sample"`  // records sampled at most
+	Sampled int64               `json:"sampled"` // records sampled
+	Fields  []RecordSchemaField `json:"fields"`
+	Missing []string            `json:"missing"`
+}
+
+// NewRecordSchema classifies the fields observed in the records of the box against its metrics,
+// leaving out the fields every record carries, and sorts them by name
+func NewRecordSchema(box *Box, observed []RecordSchemaField) *RecordSchema {
+	configured := make(map[string]bool, len(box.Metrics))
+	for _, m := range box.Metrics {
+		configured[m.Code] = true
+	}
+
+	schema := &RecordSchema{BoxID: box.ID, Fields: []RecordSchemaField{}, Missing: []string{}}
+	seen := map[string]bool{}
+	for _, field := range observed {
+		if recordMetaKeys[field.Name] {
+			continue
+		}
+		switch {
+		case configured[field.Name]:
+			field.Kind = RecordFieldConfigured
+		case strings.HasPrefix(field.Name, RawValuePrefix) && configured[strings.TrimPrefix(field.Name, RawValuePrefix)],
+			strings.HasSuffix(field.Name, RateSuffix) && configured[strings.TrimSuffix(field.Name, RateSuffix)]:
+			field.Kind = RecordFieldDerived
+		default:
+			field.Kind = RecordFieldOrphan
+		}
+		sort.Strings(field.Types)
+		schema.Fields = append(schema.Fields, field)
+		seen[field.Name] = true
+	}
+	sort.Slice(schema.Fields, func(i, j int) bool { return schema.Fields[i].Name < schema.Fields[j].Name })
+
+	for _, m := range box.Metrics {
+		if !seen[m.Code] {
+			schema.Missing = append(schema.Missing, m.Code)
+		}
+	}
+	return schema
+}
+
+var ErrInvalidSchemaSample = errors.New("sample must be between 1 and 100000 records")
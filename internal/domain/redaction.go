@@ -0,0 +1,80 @@
+package domain
+
+// Monitor users only read the data of their groups. The device IDs, subdomain and the engineering
+// part of the group note belong to the companies owning the sites and are shown to admins only.
+
+// Redacted returns a copy of the box without the fields hidden from non-admin users
+func (b Box) Redacted() Box {
+	b.DeviceID = ""
+	return b
+}
+
+// Redacted returns a copy of the note keeping only its general description: mission, place and level
+func (n *NoteGroup) Redacted() *NoteGroup {
+	if n == nil {
+		return nil
+	}
+	return &NoteGroup{
+		Mission: n.Mission,
+		Region:  n.Region,
+		City:    n.City,
+		Level:   n.Level,
+	}
+}
+
+// Redacted returns a copy of the group without the fields hidden from non-admin users
+func (g BoxGroup) Redacted() BoxGroup {
+	g.Subdomain = nil
+	g.Note = g.Note.Redacted()
+	return g
+}
+
+// Redacted returns a copy of the view with the group and each of its boxes redacted
+func (v ViewBox) Redacted() ViewBox {
+	v.BoxGroup = v.BoxGroup.Redacted()
+	v.Boxes = RedactBoxes(v.Boxes)
+	return v
+}
+
+// RedactBoxes returns redacted copies of the boxes
+func RedactBoxes(boxes []Box) []Box {
+	if boxes == nil {
+		return nil
+	}
+	redacted := make([]Box, len(boxes))
+	for i := range boxes {
+		redacted[i] = boxes[i].Redacted()
+	}
+	return redacted
+}
+
+// RedactGroups returns redacted copies of the groups
+func RedactGroups(groups []BoxGroup) []BoxGroup {
+	if groups == nil {
+		return nil
+	}
+	redacted := make([]BoxGroup, len(groups))
+	for i := range groups {
+		redacted[i] = groups[i].Redacted()
+	}
+	return redacted
+}
+
+// RedactViewBoxes returns redacted copies of the views
+func RedactViewBoxes(views []ViewBox) []ViewBox {
+	if views == nil {
+		return nil
+	}
+	redacted := make([]ViewBox, len(views))
+	for i := range views {
+		redacted[i] = views[i].Redacted()
+	}
+	return redacted
+}
+
+// RedactRecords removes the box fields hidden from non-admin users from enriched records, in place
+func RedactRecords(records []Record) {
+	for _, record := range records {
+		delete(record, "device_id")
+	}
+}
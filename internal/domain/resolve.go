@@ -0,0 +1,53 @@
+package domain
+
+import "errors"
+
+// MaxResolveIDs caps the IDs of all kinds resolved in one request
+const MaxResolveIDs = 500
+
+// ResolveParams lists the IDs to resolve to names, per kind
+type ResolveParams struct {
+	Boxes  []string `json:"boxes"`
+	Groups []string `json:"groups"`
+	Zones  []string `json:"zones"`
+	Users  []string `json:"users"`
+}
+
+// Count returns the number of IDs requested
+func (p *ResolveParams) Count() int {
+	return len(p.Boxes) + len(p.Groups) + len(p.Zones) + len(p.Users)
+}
+
+type ResolvedBox struct {
+	Name    string `json:"name"`
+	GroupID string `json:"group_id"`
+	ZoneID  string `json:"zone_id"`
+}
+
+type ResolvedGroup struct {
+	Name   string `json:"name"`
+	ZoneID string `json:"zone_id"`
+}
+
+type ResolvedZone struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+type ResolvedUser struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+// ResolveResult maps each resolved ID to its name and a few identifying fields.
+// IDs that are unknown or outside the caller's groups are left out.
+type ResolveResult struct {
+	Boxes  map[string]ResolvedBox   `json:"boxes"`
+	Groups map[string]ResolvedGroup `json:"groups"`
+	Zones  map[string]ResolvedZone  `json:"zones"`
+	Users  map[string]ResolvedUser  `json:"users"`
+}
+
+var (
+	ErrTooManyResolveIDs = errors.New("too many ids, at most 500 can be resolved per request")
+)
@@ -0,0 +1,158 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+// DailyRollup accumulates the numeric fields of a box's records over one UTC day, so arithmetic
+// daily reports do not have to re-read the raw records. It is updated as records are written.
+type DailyRollup struct {
+	ID      string                  `json:"id" bson:"_id"` // <box_id>:<date>
+	BoxID   string                  `json:"box_id" bson:"box_id"`
+	Date    string                  `json:"date" bson:"date"` // 2006-01-02
+	Count   int                     `json:"count" bson:"count"`
+	Metrics map[string]RollupMetric `json:"metrics" bson:"metrics"`
+	// Stale is set when a stored record of the day was changed in place; the day is then
+	// reported from the raw records until the rollup is rebuilt
+	Stale bool `json:"stale,omitempty" bson:"stale,omitempty"`
+}
+
+// RollupMetric holds the running statistics of one metric over a day
+type RollupMetric struct {
+	N     int     `json:"n" bson:"n"`
+	Sum   float64 `json:"sum" bson:"sum"`
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	SumSq float64 `json:"sumsq" bson:"sumsq"`
+}
+
+// RollupState records which days of a box have complete rollups: the days from CompleteFrom on,
+// whose records were all written after rollups started, and the days before BackfilledThrough,
+// which the backfill job rebuilt from the raw records. Both are UTC day starts in seconds.
+type RollupState struct {
+	BoxID             string `json:"box_id" bson:"_id"`
+	CompleteFrom      int64  `json:"complete_from" bson:"complete_from"`
+	BackfilledThrough int64  `json:"backfilled_through" bson:"backfilled_through"`
+}
+
+// Complete reports whether the rollup of the day starting at dayStart covers all its records
+func (s *RollupState) Complete(dayStart int64) bool {
+	return dayStart < s.BackfilledThrough || dayStart >= s.CompleteFrom
+}
+
+// RollupDaySeconds is the length of a rollup day
+const RollupDaySeconds int64 = 24 * 60 * 60
+
+// RollupDayStart returns the start of the UTC day holding timestamp (seconds)
+func RollupDayStart(timestamp int64) int64 {
+	start := timestamp - timestamp%RollupDaySeconds
+	if timestamp < 0 && timestamp%RollupDaySeconds != 0 {
+		start -= RollupDaySeconds
+	}
+	return start
+}
+
+// RollupDate formats the UTC day holding timestamp (seconds) like the daily report dates
+func RollupDate(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format("2006-01-02")
+}
+
+// NewDailyRollup creates an empty rollup of a box's day
+func NewDailyRollup(boxID, date string) *DailyRollup {
+	return &DailyRollup{
+		ID:      boxID + ":" + date,
+		BoxID:   boxID,
+		Date:    date,
+		Metrics: map[string]RollupMetric{},
+	}
+}
+
+// Add counts a record into the rollup. Like the raw daily report, every float field except the
+// timestamps is a metric. It returns false when a field name cannot be used in an update path
+// ("." or a leading "$"), in which case the day can only be reported from the raw records.
+func (r *DailyRollup) Add(record Record) bool {
+	r.Count++
+	ok := true
+	for key, value := range record {
+		if key == "_id" || key == "c" {
+			continue
+		}
+		v, isFloat := value.(float64)
+		if !isFloat {
+			continue
+		}
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			ok = false
+			continue
+		}
+
+		m, exists := r.Metrics[key]
+		if !exists || v < m.Min {
+			m.Min = v
+		}
+		if !exists || v > m.Max {
+			m.Max = v
+		}
+		m.N++
+		m.Sum += v
+		m.SumSq += v * v
+		r.Metrics[key] = m
+	}
+	return ok
+}
+
+// Report turns the rollup into the arithmetic daily report of its day
+func (r *DailyRollup) Report() DailyReport {
+	report := DailyReport{
+		Date:  r.Date,
+		Count: r.Count,
+		Avg:   make(map[string]float64),
+		Min:   make(map[string]float64),
+		Max:   make(map[string]float64),
+	}
+	for key, m := range r.Metrics {
+		if m.N == 0 {
+			continue
+		}
+		report.Avg[key] = RoundValue(m.Sum / float64(m.N))
+		report.Min[key] = RoundValue(m.Min)
+		report.Max[key] = RoundValue(m.Max)
+	}
+	return report
+}
+
+// RollupRecords groups records by UTC day into rollups of the box. Days with a record that
+// cannot be rolled up are returned in unsafe instead.
+func RollupRecords(boxID string, records []Record) (rollups []*DailyRollup, unsafe []string) {
+	byDate := map[string]*DailyRollup{}
+	unsafeDates := map[string]bool{}
+	for _, record := range records {
+		date := RollupDate(record.GetTimestamp())
+		if unsafeDates[date] {
+			continue
+		}
+		rollup, exists := byDate[date]
+		if !exists {
+			rollup = NewDailyRollup(boxID, date)
+			byDate[date] = rollup
+		}
+		if !rollup.Add(record) {
+			unsafeDates[date] = true
+			delete(byDate, date)
+		}
+	}
+
+	for _, rollup := range byDate {
+		rollups = append(rollups, rollup)
+	}
+	for date := range unsafeDates {
+		unsafe = append(unsafe, date)
+	}
+	return rollups, unsafe
+}
+
+// RollupBackfillParams selects the boxes the backfill job rebuilds, every box when BoxID is empty
+type RollupBackfillParams struct {
+	BoxID string `json:"box_id"`
+}
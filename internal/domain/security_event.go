@@ -0,0 +1,92 @@
+package domain
+
+import (
+	"time"
+	"tp25-api/lib"
+)
+
+// SecurityEventType names something that happened to an account, kept apart from other logs for incident response
+type SecurityEventType string
+
+const (
+	SecurityLoginSucceeded   SecurityEventType = "login_succeeded"
+	SecurityLoginFailed      SecurityEventType = "login_failed"
+	SecurityPasswordChanged  SecurityEventType = "password_changed"
+	SecurityTwoFactorEnabled SecurityEventType = "2fa_enabled"
+	SecurityTwoFactorReset   SecurityEventType = "2fa_reset"
+	SecurityTokensRevoked    SecurityEventType = "tokens_revoked"
+	SecurityRecordsExported  SecurityEventType = "records_exported"
+)
+
+// Reasons recorded with security events
+const (
+	SecurityReasonUnknownUsername = "unknown_username"
+	SecurityReasonWrongPassword   = "wrong_password"
+	SecurityReasonTwoFactorCode   = "invalid_2fa_code"
+	SecurityReasonTwoFactorLocked = "2fa_locked"
+	SecurityReasonSessionLimit    = "session_limit"
+	SecurityReasonSelf            = "self"
+	SecurityReasonAdmin           = "admin"
+	SecurityReasonResetToken      = "reset_token"
+	SecurityReasonLogout          = "logout"
+	SecurityReasonInterrupted     = "interrupted"   // a streamed export cut short, Rows were sent
+	SecurityReasonDownloadLink    = "download_link" // an export job file fetched through its signed link
+)
+
+// Formats of record exports
+const (
+	ExportFormatXLSX     = "xlsx"
+	ExportFormatCSVLong  = "csv_long"
+	ExportFormatTemplate = "template"
+)
+
+// ExportAudit describes the records an export let out: of a box, or of every box of a group when
+// BoxID is empty. From and To are the time range asked for (seconds), Rows the rows written.
+type ExportAudit struct {
+	Format  string `json:"format" bson:"format"`
+	BoxID   string `json:"box_id,omitempty" bson:"box_id,omitempty"`
+	GroupID string `json:"group_id" bson:"group_id"`
+	From    *int64 `json:"time_min,omitempty" bson:"time_min,omitempty"`
+	To      *int64 `json:"time_max,omitempty" bson:"time_max,omitempty"`
+	Rows    int64  `json:"rows" bson:"rows"`
+}
+
+// SecurityEvent records who did what to which account, from where. Actor is empty when nobody was
+// signed in, e.g. for failed logins, which keep the username as typed and never the password.
+type SecurityEvent struct {
+	ID        string            `json:"id" bson:"_id"`
+	Type      SecurityEventType `json:"type" bson:"type"`
+	ActorID   string            `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	SubjectID string            `json:"subject_id,omitempty" bson:"subject_id,omitempty"`
+	Username  string            `json:"username,omitempty" bson:"username,omitempty"`
+	Reason    string            `json:"reason,omitempty" bson:"reason,omitempty"`
+	Export    *ExportAudit      `json:"export,omitempty" bson:"export,omitempty"` // records_exported events
+	IP        string            `json:"ip" bson:"ip"`
+	UserAgent string            `json:"user_agent" bson:"user_agent"`
+	Timestamp int64             `json:"timestamp" bson:"timestamp"`   // seconds
+	ExpireAt  *time.Time        `json:"-" bson:"expire_at,omitempty"` // removed by a TTL index after the retention period
+}
+
+// FilterSecurityEventParams selects security events; From/To bound the timestamp (seconds, inclusive)
+type FilterSecurityEventParams struct {
+	Type     SecurityEventType
+	UserID   string // matches the actor or the subject
+	Username string
+	IP       string
+	From     *int64
+	To       *int64
+
+	// Of records_exported events
+	ExportBoxID   string
+	ExportGroupID string
+	ExportFormat  string
+}
+
+// NewSecurityEvent creates an event of the given type happening now
+func NewSecurityEvent(eventType SecurityEventType) *SecurityEvent {
+	return &SecurityEvent{
+		ID:        lib.Rand.Char(12),
+		Type:      eventType,
+		Timestamp: time.Now().Unix(),
+	}
+}
@@ -2,6 +2,11 @@ package domain
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 	"tp25-api/lib"
 )
@@ -36,30 +41,127 @@ type Range struct {
 }
 
 type Metric struct {
-	ID    string  `json:"id" bson:"_id"`
-	Code  string  `json:"code" bson:"code"`
-	Name  string  `json:"name" bson:"name"`
-	Unit  string  `json:"unit" bson:"unit"`
-	Alias *string `json:"alias,omitempty" bson:"alias,omitempty"`
-	Range []Range `json:"range,omitempty" bson:"range,omitempty"`
-	CTime int64   `json:"ctime" bson:"ctime"`
-	MTime int64   `json:"mtime" bson:"mtime"`
-	DTime *int64  `json:"dtime,omitempty" bson:"dtime,omitempty"`
+	ID        string  `json:"id" bson:"_id"`
+	Code      string  `json:"code" bson:"code"`
+	Name      string  `json:"name" bson:"name"`
+	Unit      string  `json:"unit" bson:"unit"`
+	Alias     *string `json:"alias,omitempty" bson:"alias,omitempty"`
+	Range     []Range `json:"range,omitempty" bson:"range,omitempty"`
+	SortOrder int     `json:"sort_order" bson:"sort_order"`
+	Category  string  `json:"category,omitempty" bson:"category,omitempty"`   // dashboard heading, e.g. "Water level"
+	Precision *int    `json:"precision,omitempty" bson:"precision,omitempty"` // decimals values are shown with, DefaultMetricPrecision when unset
+	CTime     int64   `json:"ctime" bson:"ctime"`
+	MTime     int64   `json:"mtime" bson:"mtime"`
+	DTime     *int64  `json:"dtime,omitempty" bson:"dtime,omitempty"`
+}
+
+// DefaultMetricPrecision is the number of decimals values are stored with, see RoundValue
+const DefaultMetricPrecision = 2
+
+// Decimals returns the number of decimals the metric's values are shown with
+func (m *Metric) Decimals() int {
+	if m.Precision == nil {
+		return DefaultMetricPrecision
+	}
+	return *m.Precision
+}
+
+// MetricBounds is the accepted value range of a metric
+type MetricBounds struct {
+	Code string  `json:"code"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// Bounds returns the outermost limits of the metric's configured ranges, false when none are set
+func (m *Metric) Bounds() (MetricBounds, bool) {
+	if len(m.Range) == 0 {
+		return MetricBounds{}, false
+	}
+
+	bounds := MetricBounds{Code: m.Code, Min: m.Range[0].Min, Max: m.Range[0].Max}
+	for _, r := range m.Range[1:] {
+		if r.Min < bounds.Min {
+			bounds.Min = r.Min
+		}
+		if r.Max > bounds.Max {
+			bounds.Max = r.Max
+		}
+	}
+	return bounds, true
+}
+
+// InRange reports whether v lies within the bounds
+func (b MetricBounds) InRange(v float64) bool {
+	return v >= b.Min && v <= b.Max
 }
 
 type CreateMetricParams struct {
-	Alias *string `json:"alias"`
-	Unit  string  `json:"unit" binding:"required"`
-	Code  string  `json:"code" binding:"required"`
-	Name  string  `json:"name" binding:"required"`
-	Range []Range `json:"range"`
+	Alias     *string `json:"alias"`
+	Unit      string  `json:"unit" binding:"required"`
+	Code      string  `json:"code" binding:"required"`
+	Name      string  `json:"name" binding:"required"`
+	Range     []Range `json:"range"`
+	SortOrder int     `json:"sort_order"`
+	Category  string  `json:"category"`
+	Precision *int    `json:"precision" binding:"omitempty,min=0,max=6"`
 }
 
 type UpdateMetricParams struct {
-	Unit  *string `json:"unit"`
-	Code  *string `json:"code"`
-	Name  *string `json:"name"`
-	Range []Range `json:"range"`
+	Unit      *string `json:"unit"`
+	Code      *string `json:"code"`
+	Name      *string `json:"name"`
+	Range     []Range `json:"range"`
+	SortOrder *int    `json:"sort_order"`
+	Category  *string `json:"category"`
+	Precision *int    `json:"precision" binding:"omitempty,min=0,max=6"`
+}
+
+// MetricOrderParams lists metric IDs in display order; their sort_order becomes their position
+type MetricOrderParams struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+// MetricLayout is a metric as displayed for one box, resolved from the metric and the box's overrides
+type MetricLayout struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	Unit      string `json:"unit"`
+	Category  string `json:"category,omitempty"`
+	SortOrder int    `json:"sort_order"`
+	Precision int    `json:"precision"` // decimals the values are shown with
+}
+
+// SortMetricLayout orders a layout by sort_order, then code
+func SortMetricLayout(layout []MetricLayout) {
+	sort.SliceStable(layout, func(i, j int) bool {
+		if layout[i].SortOrder != layout[j].SortOrder {
+			return layout[i].SortOrder < layout[j].SortOrder
+		}
+		return layout[i].Code < layout[j].Code
+	})
+}
+
+// OrderMetricCodes returns codes in layout order, followed by the codes missing from the layout sorted by code
+func OrderMetricCodes(codes []string, layout []MetricLayout) []string {
+	position := make(map[string]int, len(layout))
+	for i, m := range layout {
+		position[m.Code] = i
+	}
+
+	ordered := append([]string(nil), codes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		pi, iok := position[ordered[i]]
+		pj, jok := position[ordered[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok {
+			return pi < pj
+		}
+		return ordered[i] < ordered[j]
+	})
+	return ordered
 }
 
 // Record represents a sensor data record with dynamic metric fields
@@ -70,11 +172,15 @@ type Record map[string]interface{}
 
 // GetTimestamp returns the sensor timestamp (_id field) in seconds
 func (r Record) GetTimestamp() int64 {
-	if t, ok := r["_id"].(int32); ok {
-		return int64(t)
-	}
-	if t, ok := r["id"].(int32); ok {
-		return int64(t)
+	for _, key := range []string{"_id", "id"} {
+		switch t := r[key].(type) {
+		case int32:
+			return int64(t)
+		case int64:
+			return t
+		case float64:
+			return int64(t)
+		}
 	}
 
 	return 0
@@ -82,12 +188,33 @@ func (r Record) GetTimestamp() int64 {
 
 // GetCreateTime returns the server create timestamp (c field) in milliseconds
 func (r Record) GetCreateTime() int64 {
-	if c, ok := r["c"].(int64); ok {
+	switch c := r["c"].(type) {
+	case int64:
 		return c
+	case int32:
+		return int64(c)
+	case float64:
+		return int64(c)
 	}
 	return 0
 }
 
+// WithTimes adds the standardized time fields to a record returned by the API:
+// timestamp (sensor time, seconds), received_at (server receive time, milliseconds) and
+// ingest_latency_ms (received_at - timestamp*1000), which exposes buffering loggers.
+// The raw id/_id and c fields are kept for backwards compatibility.
+func (r Record) WithTimes() Record {
+	timestamp := r.GetTimestamp()
+	r["timestamp"] = timestamp
+
+	if receivedAt := r.GetCreateTime(); receivedAt > 0 {
+		r["received_at"] = receivedAt
+		r["ingest_latency_ms"] = receivedAt - timestamp*1000
+	}
+
+	return r
+}
+
 // GetFloat gets a float value from the record
 func (r Record) GetFloat(key string) float64 {
 	if v, ok := r[key].(float64); ok {
@@ -96,21 +223,306 @@ func (r Record) GetFloat(key string) float64 {
 	if v, ok := r[key].(int64); ok {
 		return float64(v)
 	}
+	if v, ok := r[key].(int32); ok {
+		return float64(v)
+	}
 	if v, ok := r[key].(int); ok {
 		return float64(v)
 	}
 	return 0
 }
 
+// HasNumber reports whether the record holds a numeric value under key
+func (r Record) HasNumber(key string) bool {
+	switch r[key].(type) {
+	case float64, int64, int32, int:
+		return true
+	}
+	return false
+}
+
+// RawValuePrefix prefixes the reported value of a metric whose unit was converted at ingest
+const RawValuePrefix = "raw_"
+
+// RateSuffix suffixes the derived rate of change of a metric, in metric units per hour
+const RateSuffix = "_rate"
+
+// DefaultRateHorizon is the longest gap (seconds) between two samples a rate of change is derived over
+const DefaultRateHorizon int64 = 3 * 3600
+
+// RecordSourceManual marks records entered by staff in the src field; device records have no src
+const RecordSourceManual = "manual"
+
+// recordMetaKeys are record fields that do not hold metric values
+var recordMetaKeys = map[string]bool{"_id": true, "id": true, "c": true, "n": true, "box_id": true, "src": true, RecordFlagsKey: true}
+
+// recordInfoKeys are fields added to records when they are listed, not stored ones
+var recordInfoKeys = map[string]bool{"box_name": true, "device_id": true, "box_deleted": true, "maintenance": true, "maintenance_until": true, "flags": true, ObservationRecordKey: true,
+	"timestamp": true, "received_at": true, "ingest_latency_ms": true}
+
+// RecordFlagNonNumeric flags the metrics of a record holding something other than a number, such
+// as the error codes some loggers sent before ingest validation existed
+const RecordFlagNonNumeric = "non_numeric"
+
+// NonNumericMetrics returns, sorted, the metric fields holding a value that is neither a number nor null
+func (r Record) NonNumericMetrics() []string {
+	var codes []string
+	for key, value := range r {
+		if recordMetaKeys[key] || recordInfoKeys[key] || strings.HasPrefix(key, RawValuePrefix) || value == nil {
+			continue
+		}
+		if !r.HasNumber(key) {
+			codes = append(codes, key)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ValueFields returns the fields of the record holding metric values, numeric or not, leaving out
+// its meta and listing fields and the raw values of converted metrics
+func (r Record) ValueFields() []string {
+	var keys []string
+	for key := range r {
+		if !recordMetaKeys[key] && !recordInfoKeys[key] && !strings.HasPrefix(key, RawValuePrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// WithFlags adds a flags field naming, per flag, the metrics it applies to when the record has any
+func (r Record) WithFlags() Record {
+	flags := map[string][]string{}
+	if codes := r.NonNumericMetrics(); len(codes) > 0 {
+		flags[RecordFlagNonNumeric] = codes
+	}
+	if codes := r.AnomalousMetrics(); len(codes) > 0 {
+		sort.Strings(codes)
+		flags[RecordFlagAnomaly] = codes
+	}
+	if len(flags) > 0 {
+		r["flags"] = flags
+	}
+	return r
+}
+
+// IsManual reports whether the record was entered by staff
+func (r Record) IsManual() bool {
+	return r["src"] == RecordSourceManual
+}
+
+// Repeats reports whether r carries the same measurement as stored: both report at least one metric
+// in common and every metric they have in common differs by at most epsilon
+func (r Record) Repeats(stored Record, epsilon float64) bool {
+	common := 0
+	for _, code := range r.MetricCodes() {
+		if !stored.HasNumber(code) {
+			continue
+		}
+		if math.Abs(r.GetFloat(code)-stored.GetFloat(code)) > epsilon {
+			return false
+		}
+		common++
+	}
+	return common > 0
+}
+
+// MergeRecords returns the fields of incoming to set on a stored record it is merged into.
+// Metrics missing from the stored record are always taken. For metrics present in both, manual
+// records win for manual metrics and device records win for sensor metrics; otherwise the
+// stored value is kept.
+func MergeRecords(existing, incoming Record, manualMetrics map[string]bool) Record {
+	fields := Record{}
+	for _, code := range incoming.MetricCodes() {
+		if _, ok := existing[code]; !ok {
+			fields[code] = incoming[code]
+			continue
+		}
+
+		if manualMetrics[code] {
+			if incoming.IsManual() && !existing.IsManual() {
+				fields[code] = incoming[code]
+			}
+		} else if !incoming.IsManual() && existing.IsManual() {
+			fields[code] = incoming[code]
+		}
+	}
+	return fields
+}
+
+// MetricCodes returns the fields of the record holding numeric metric values, sorted by code
+func (r Record) MetricCodes() []string {
+	var codes []string
+	for key, value := range r {
+		if recordMetaKeys[key] || strings.HasPrefix(key, RawValuePrefix) {
+			continue
+		}
+		switch value.(type) {
+		case float64, int64, int32, int:
+			codes = append(codes, key)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// RecomputeConversionParams re-derives the stored values of one box metric from the values the box reported,
+// after its unit conversion was corrected. Records keeping a raw_ value use it; for the others Previous is the
+// conversion their values were stored with, nil when they were stored unconverted.
+type RecomputeConversionParams struct {
+	Previous *UnitConversion `json:"previous"`
+	TimeMin  *int64          `json:"time_min"` // seconds
+	TimeMax  *int64          `json:"time_max"` // seconds
+}
+
+// QueryRecord filters records by sensor timestamp (seconds); either bound may be left open
 type QueryRecord struct {
-	Time  []int64 `json:"time" form:"time"`
-	Limit *int    `json:"limit" form:"limit"`
-	Skip  *int    `json:"skip" form:"skip"`
+	TimeMin *int64 `json:"time_min,omitempty" form:"time_min"`
+	TimeMax *int64 `json:"time_max,omitempty" form:"time_max"`
+	Limit   *int   `json:"limit" form:"limit"`
+	Skip    *int   `json:"skip" form:"skip"`
+
+	// Calibrate applies the calibrations of the box to the values read
+	Calibrate bool `json:"-" form:"apply_calibration"`
+
+	// Observations merges the manual observations of the box with its records
+	Observations bool `json:"-" form:"-"`
+
+	// DeletedBoxes also reads the records of the group's boxes deleted after the start of the range
+	DeletedBoxes bool `json:"-" form:"include_deleted_boxes"`
+
+	// ExcludeAnomalies leaves out the values flagged as anomalies
+	ExcludeAnomalies bool `json:"-" form:"exclude_anomalies"`
 }
 
 type RecordsResult struct {
 	Records []Record
 	Total   int64
+	Layouts map[string][]MetricLayout // box ID -> metric layout, set for group queries
+}
+
+// BoxRecords holds the records of one box when group records are nested per box
+type BoxRecords struct {
+	BoxID    string         `json:"box_id"`
+	BoxName  string         `json:"box_name"`
+	DeviceID string         `json:"device_id,omitempty"` // admins only
+	Deleted  bool           `json:"deleted,omitempty"`   // the box was deleted since
+	Metrics  []MetricLayout `json:"metrics,omitempty"`
+	Records  []Record       `json:"records"`
+}
+
+// NestRecordsByBox groups enriched records per box, keeping the order in which boxes first appear.
+// Each box carries its metric layout from layouts when present.
+func NestRecordsByBox(records []Record, layouts map[string][]MetricLayout) []BoxRecords {
+	nested := []BoxRecords{}
+	index := make(map[string]int)
+	for _, record := range records {
+		boxID, _ := record["box_id"].(string)
+		i, ok := index[boxID]
+		if !ok {
+			boxName, _ := record["box_name"].(string)
+			deviceID, _ := record["device_id"].(string)
+			deleted, _ := record["box_deleted"].(bool)
+			i = len(nested)
+			index[boxID] = i
+			nested = append(nested, BoxRecords{BoxID: boxID, BoxName: boxName, DeviceID: deviceID, Deleted: deleted, Metrics: layouts[boxID]})
+		}
+		nested[i].Records = append(nested[i].Records, record)
+	}
+	return nested
+}
+
+// GroupExport is the resolved metadata of a group whose records are being exported
+type GroupExport struct {
+	Group   *BoxGroup
+	Boxes   []Box
+	Units   map[string]map[string]string // box ID -> record field -> metric unit
+	Layouts map[string][]MetricLayout    // box ID -> metric layout
+}
+
+// LongRecordRow is one (timestamp, box, metric, value) row of a long/tidy export
+type LongRecordRow struct {
+	Timestamp int64 // seconds
+	BoxID     string
+	BoxName   string
+	Metric    string
+	Unit      string
+	Value     float64
+}
+
+// LongRecordCSVHeader heads the columns of LongRecordRow.CSV
+var LongRecordCSVHeader = []string{"timestamp", "time", "box_id", "box_name", "metric", "unit", "value"}
+
+// CSV returns the row as the columns of a csv_long export
+func (r LongRecordRow) CSV() []string {
+	return []string{
+		strconv.FormatInt(r.Timestamp, 10),
+		time.Unix(r.Timestamp, 0).Format("2006-01-02 15:04:05"),
+		r.BoxID,
+		r.BoxName,
+		r.Metric,
+		r.Unit,
+		strconv.FormatFloat(r.Value, 'f', -1, 64),
+	}
+}
+
+// Approximate bytes per exported row, used to tell users how large a refused export would be
+const (
+	ExportXLSXRowBytes = 200 // one record per row, compressed
+	ExportCSVRowBytes  = 80  // one (timestamp, box, metric, value) per row
+)
+
+// ExportTooLargeError refuses an export whose estimated row count exceeds the cap,
+// since the proxy cuts responses short and the truncated file cannot be opened
+type ExportTooLargeError struct {
+	EstimatedRows  int64
+	EstimatedBytes int64
+	MaxRows        int64
+}
+
+func (e *ExportTooLargeError) Error() string {
+	return fmt.Sprintf("export of about %d rows exceeds the limit of %d rows, narrow the time range", e.EstimatedRows, e.MaxRows)
+}
+
+// IngestReceipt acknowledges a record accepted into the ingestion queue; it is written shortly after
+type IngestReceipt struct {
+	ID        string `json:"receipt"`
+	BoxID     string `json:"box_id"`
+	Timestamp int64  `json:"timestamp"`
+	QueuedAt  int64  `json:"queued_at"` // milliseconds
+}
+
+// IngestStats is a snapshot of the ingestion queue
+type IngestStats struct {
+	Depth       int     `json:"depth"`
+	Capacity    int     `json:"capacity"`
+	Enqueued    int64   `json:"enqueued_total"`
+	Rejected    int64   `json:"rejected_total"`
+	Inserted    int64   `json:"inserted_total"`
+	Duplicates  int64   `json:"duplicates_total"` // timestamp already stored for the box
+	Failed      int64   `json:"failed_total"`     // acknowledged but not written after every attempt
+	Batches     int64   `json:"batches_total"`
+	LastBatchMs int64   `json:"last_batch_ms"`
+	AvgBatchMs  float64 `json:"avg_batch_ms"`
+	Paused      bool    `json:"paused"` // writes held in read-only mode
+
+	// What became of the failed records: kept in the dead letters, written from them later, or
+	// lost when they could not be kept either, with only the log holding them
+	DeadLettered int64 `json:"dead_lettered_total"`
+	Replayed     int64 `json:"replayed_total"`
+	Lost         int64 `json:"lost_total"`
+}
+
+// IngestDeadLetter is a record the ingestion queue acknowledged but failed to write, kept until a
+// later attempt writes it
+type IngestDeadLetter struct {
+	ID       string `json:"id" bson:"_id"` // the receipt the record was acknowledged with
+	BoxID    string `json:"box_id" bson:"box_id"`
+	Record   Record `json:"record" bson:"record"`
+	Error    string `json:"error" bson:"error"`
+	Attempts int    `json:"attempts" bson:"attempts"`
+	CTime    int64  `json:"ctime" bson:"ctime"`
 }
 
 type ExportType string
@@ -121,6 +533,29 @@ const (
 	ExportReport ExportType = "report"
 )
 
+// AvgMode selects how DailyReport.Avg is computed
+type AvgMode string
+
+const (
+	// AvgArithmetic is the plain mean of the samples received that day
+	AvgArithmetic AvgMode = "arithmetic"
+	// AvgTimeWeighted weights each sample by the time until the next one, capped at MaxGap,
+	// so bursts of frequent samples (e.g. during a flood) do not dominate the day
+	AvgTimeWeighted AvgMode = "time_weighted"
+)
+
+// DefaultReportMaxGap caps the weight of a single sample in time-weighted averages (seconds)
+const DefaultReportMaxGap int64 = 3600
+
+// ReportOptions controls how daily reports are aggregated
+type ReportOptions struct {
+	Avg              AvgMode
+	MaxGap           int64          // seconds
+	Calibration      CalibrationSet // corrections applied to the samples before aggregating, if any
+	Observations     bool           // aggregate the manual observations of the box with its records
+	ExcludeAnomalies bool           // leave out the values flagged as anomalies
+}
+
 type DailyReport struct {
 	Date  string             `json:"date" bson:"date"`
 	Avg   map[string]float64 `json:"avg" bson:"avg"`
@@ -129,24 +564,161 @@ type DailyReport struct {
 	Count int                `json:"count" bson:"count"`
 }
 
+// RecordValueAt is a metric value with the sensor timestamp (seconds) it was measured at
+type RecordValueAt struct {
+	Time  int64   `json:"time" bson:"t"`
+	Value float64 `json:"value" bson:"v"`
+}
+
+// MetricStats summarizes one metric over a time range; Count is 0 when the metric has no values
+type MetricStats struct {
+	Metric string         `json:"metric"`
+	Count  int64          `json:"count"`
+	Min    *float64       `json:"min,omitempty"`
+	Max    *float64       `json:"max,omitempty"`
+	Avg    *float64       `json:"avg,omitempty"`
+	StdDev *float64       `json:"stddev,omitempty"`
+	First  *RecordValueAt `json:"first,omitempty"`
+	Last   *RecordValueAt `json:"last,omitempty"`
+}
+
+type RecordStats struct {
+	BoxID   string        `json:"box_id"`
+	TimeMin int64         `json:"time_min"`
+	TimeMax int64         `json:"time_max"`
+	Metrics []MetricStats `json:"metrics"`
+}
+
+// DefaultCompareBuckets and MaxCompareBuckets bound the resolution of comparison series
+const (
+	DefaultCompareBuckets = 500
+	MaxCompareBuckets     = 2000
+)
+
+// SeriesPoint is the average of a metric over one bucket starting at Time (seconds)
+type SeriesPoint struct {
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+	Count int64   `json:"count"`
+}
+
+type BoxSeries struct {
+	BoxID   string        `json:"box_id"`
+	BoxName string        `json:"box_name"`
+	Points  []SeriesPoint `json:"points"`
+	Note    string        `json:"note,omitempty"`
+}
+
+// CompareResult holds one downsampled series per box, all aligned to the same bucket boundaries
+type CompareResult struct {
+	Metric     string      `json:"metric"`
+	TimeMin    int64       `json:"time_min"`
+	TimeMax    int64       `json:"time_max"`
+	BucketSize int64       `json:"bucket_size"`
+	Series     []BoxSeries `json:"series"`
+}
+
+// MaxHistogramBins caps the number of bins of a metric histogram
+const MaxHistogramBins = 1000
+
+// HistogramParams selects the bins of a metric histogram: either a fixed BinWidth starting at a
+// multiple of it, or explicit ascending Edges (n edges make n-1 bins)
+type HistogramParams struct {
+	Metric   string
+	BinWidth *float64
+	Edges    []float64
+}
+
+// Validate checks that exactly one way of binning is given and that explicit edges are usable
+func (p HistogramParams) Validate() error {
+	if (p.BinWidth == nil) == (len(p.Edges) == 0) {
+		return ErrInvalidHistogramBins
+	}
+	if p.BinWidth != nil {
+		if !(*p.BinWidth > 0) || math.IsInf(*p.BinWidth, 0) {
+			return ErrInvalidHistogramBins
+		}
+		return nil
+	}
+	if len(p.Edges) < 2 {
+		return ErrInvalidHistogramBins
+	}
+	if len(p.Edges)-1 > MaxHistogramBins {
+		return ErrTooManyHistogramBins
+	}
+	for i, edge := range p.Edges {
+		if math.IsNaN(edge) || math.IsInf(edge, 0) || (i > 0 && edge <= p.Edges[i-1]) {
+			return ErrInvalidHistogramBins
+		}
+	}
+	return nil
+}
+
+// HistogramBin counts the samples with Min <= value < Max
+type HistogramBin struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int64   `json:"count"`
+}
+
+// ThresholdExceedance is the share of samples above one of the box's warning levels for the metric
+type ThresholdExceedance struct {
+	Name    string  `json:"name"` // warning1, warning2 or warning3
+	Value   float64 `json:"value"`
+	Count   int64   `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// Histogram is the frequency distribution of a metric of a box over a time range.
+// Outside counts the samples beyond explicit edges; it is always 0 with a bin width.
+type Histogram struct {
+	BoxID      string                `json:"box_id"`
+	Metric     string                `json:"metric"`
+	TimeMin    int64                 `json:"time_min"`
+	TimeMax    int64                 `json:"time_max"`
+	Count      int64                 `json:"count"`
+	Outside    int64                 `json:"outside"`
+	Bins       []HistogramBin        `json:"bins"`
+	Thresholds []ThresholdExceedance `json:"thresholds"`
+}
+
 var (
 	ErrMetricNotFound     = errors.New("metric not found")
+	ErrDuplicateMetricID  = errors.New("metric listed more than once")
 	ErrMetricCodeExisted  = errors.New("metric code existed")
+	ErrMetricInUse        = errors.New("metric code is used by boxes and their records")
 	ErrMetricMustHaveCode = errors.New("metric must have code")
 	ErrRecordIDExisted    = errors.New("record id existed")
+	ErrInvalidAvgMode     = errors.New("invalid avg mode")
+	ErrTimeRangeRequired  = errors.New("time_min and time_max are required")
+	ErrInvalidMetricCode  = errors.New("invalid metric code")
+	ErrInvalidTimeRange   = errors.New("time_min must not be greater than time_max")
+	ErrIngestQueueFull    = errors.New("ingest queue full")
+	ErrIngestQueueClosed  = errors.New("ingest queue closed")
+	ErrTooManyPolls       = errors.New("too many long polls held")
+	ErrPollsStopped       = errors.New("long polls stopped")
+	ErrRecordConflict     = errors.New("record conflicts with a stored record")
+	ErrDuplicateRecord    = errors.New("record repeats a stored record")
+	ErrBoxMetricNotFound  = errors.New("box does not report this metric")
+
+	ErrInvalidHistogramBins = errors.New("either bin_width > 0 or at least two ascending edges are required")
+	ErrTooManyHistogramBins = fmt.Errorf("a histogram has at most %d bins", MaxHistogramBins)
 )
 
 // NewMetric creates a new metric with timestamps
 func NewMetric(params CreateMetricParams) *Metric {
 	now := time.Now().UnixMilli()
 	return &Metric{
-		ID:    lib.Rand.Char(12),
-		Code:  params.Code,
-		Name:  params.Name,
-		Unit:  params.Unit,
-		Alias: params.Alias,
-		Range: params.Range,
-		CTime: now,
-		MTime: now,
+		ID:        lib.Rand.Char(12),
+		Code:      params.Code,
+		Name:      params.Name,
+		Unit:      params.Unit,
+		Alias:     params.Alias,
+		Range:     params.Range,
+		SortOrder: params.SortOrder,
+		Category:  params.Category,
+		Precision: params.Precision,
+		CTime:     now,
+		MTime:     now,
 	}
 }
@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Manual records win for the metrics entered by staff, device records for the others, and metrics
+// the stored record lacks are always taken
+func TestMergeRecords(t *testing.T) {
+	manual := map[string]bool{"GAUGE": true}
+	device := func(fields Record) Record { return fields }
+	staff := func(fields Record) Record {
+		fields["src"] = RecordSourceManual
+		return fields
+	}
+
+	tests := []struct {
+		name     string
+		existing Record
+		incoming Record
+		want     Record
+	}{
+		{"manual reading over a device one", device(Record{"GAUGE": 1.0, "WAU": 2.0}), staff(Record{"GAUGE": 1.5, "WAU": 2.5}), Record{"GAUGE": 1.5}},
+		{"device reading over a manual one", staff(Record{"GAUGE": 1.5, "WAU": 2.5}), device(Record{"GAUGE": 1.0, "WAU": 2.0}), Record{"WAU": 2.0}},
+		{"device readings keep the stored values", device(Record{"GAUGE": 1.0, "WAU": 2.0}), device(Record{"GAUGE": 3.0, "WAU": 4.0}), Record{}},
+		{"manual readings keep the stored values", staff(Record{"GAUGE": 1.0}), staff(Record{"GAUGE": 3.0}), Record{}},
+		{"missing metrics are taken", device(Record{"WAU": 2.0}), staff(Record{"GAUGE": 1.5, "DR": int64(3)}), Record{"GAUGE": 1.5, "DR": int64(3)}},
+		{"fields that are not metrics are left", device(Record{"_id": int64(1), "WAU": 2.0}), staff(Record{"_id": int64(2), "c": int64(3), "note": "ok"}), Record{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MergeRecords(tt.existing, tt.incoming, manual); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy MergePolicy
+		valid  bool
+	}{
+		{MergePolicy{Mode: MergeKeepBoth}, true},
+		{MergePolicy{Mode: MergeReject, Window: 60}, true},
+		{MergePolicy{Mode: MergeFields, Window: MaxMergeWindow}, true},
+		{MergePolicy{Mode: MergeFields, Window: MaxMergeWindow + 1}, false},
+		{MergePolicy{Mode: MergeReject, Window: -1}, false},
+		{MergePolicy{Mode: "replace", Window: 60}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.policy.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%+v: %v", tt.policy, err)
+		}
+		if !tt.valid && err != ErrInvalidMergePolicy {
+			t.Errorf("%+v: got %v, want ErrInvalidMergePolicy", tt.policy, err)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
 
 // Setting represents a key-value configuration setting
 type Setting struct {
@@ -11,6 +17,131 @@ type Setting struct {
 	MTime int64       `json:"mtime" bson:"mtime"`
 }
 
+// settingKeyPattern is the naming convention of setting keys: lowercase segments of letters, digits
+// and underscores separated by dots, the first naming the feature area, e.g. alerts.email_to
+var settingKeyPattern = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+
+// ValidSettingKey reports whether key follows the naming convention of setting keys
+func ValidSettingKey(key string) bool {
+	return settingKeyPattern.MatchString(key)
+}
+
+// SuggestSettingKey converts a key to the naming convention: camelCase words are split with
+// underscores, letters lowered and any other character replaced, e.g. alertEmail to alert_email
+func SuggestSettingKey(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		switch {
+		case r == '.':
+			b.WriteRune(r)
+		case r < unicode.MaxASCII && (unicode.IsLower(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	// Empty segments would not match the convention
+	segments := strings.Split(b.String(), ".")
+	kept := segments[:0]
+	for _, segment := range segments {
+		if segment != "" {
+			kept = append(kept, segment)
+		}
+	}
+	return strings.Join(kept, ".")
+}
+
+// SettingKeyReport lists an existing setting whose key does not follow the naming convention
+type SettingKeyReport struct {
+	ID         string `json:"id"`
+	Key        string `json:"key"`
+	Suggestion string `json:"suggestion"`
+	Conflict   bool   `json:"conflict,omitempty"` // another setting already uses the suggestion
+}
+
+// NonconformingSettingKeys reports the settings whose keys do not follow the naming convention,
+// by key. The settings of group hydraulics are keyed by the API itself and left out.
+func NonconformingSettingKeys(settings []Setting) []SettingKeyReport {
+	keys := make(map[string]bool, len(settings))
+	for _, setting := range settings {
+		keys[setting.Key] = true
+	}
+
+	reports := []SettingKeyReport{}
+	for _, setting := range settings {
+		if ValidSettingKey(setting.Key) || IsHydraulicsSettingKey(setting.Key) {
+			continue
+		}
+		suggestion := SuggestSettingKey(setting.Key)
+		reports = append(reports, SettingKeyReport{
+			ID:         setting.ID,
+			Key:        setting.Key,
+			Suggestion: suggestion,
+			Conflict:   keys[suggestion],
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Key < reports[j].Key })
+	return reports
+}
+
+// SettingTree nests the values of the settings under namespace by the dot-separated segments of
+// their keys relative to it, e.g. alerts.email.to under "alerts" as {"email": {"to": value}}.
+// When a key is also the namespace of others, its own value is kept under "" in their object.
+func SettingTree(settings []Setting, namespace string) map[string]interface{} {
+	namespace = strings.TrimSuffix(namespace, ".")
+
+	// Shorter keys first, so a subtree always finds its parent in place
+	sorted := append([]Setting(nil), settings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	tree := map[string]interface{}{}
+	for _, setting := range sorted {
+		relative := setting.Key
+		if namespace != "" {
+			if setting.Key == namespace {
+				if _, ok := tree[""]; !ok {
+					tree[""] = setting.Value
+				}
+				continue
+			}
+			if !strings.HasPrefix(setting.Key, namespace+".") {
+				continue
+			}
+			relative = strings.TrimPrefix(setting.Key, namespace+".")
+		}
+
+		segments := strings.Split(relative, ".")
+		node := tree
+		for _, segment := range segments[:len(segments)-1] {
+			switch child := node[segment].(type) {
+			case map[string]interface{}:
+				node = child
+			default:
+				subtree := map[string]interface{}{}
+				if child != nil {
+					subtree[""] = child
+				}
+				node[segment] = subtree
+				node = subtree
+			}
+		}
+		leaf := segments[len(segments)-1]
+		if subtree, ok := node[leaf].(map[string]interface{}); ok {
+			subtree[""] = setting.Value
+		} else {
+			node[leaf] = setting.Value
+		}
+	}
+	return tree
+}
+
 // CreateSettingParams for creating a new setting
 type CreateSettingParams struct {
 	Key   string      `json:"key" binding:"required"`
@@ -22,10 +153,33 @@ type UpdateSettingParams struct {
 	Value interface{} `json:"value" binding:"required"`
 }
 
+// SettingAction is the kind of change that produced a setting history entry
+type SettingAction string
+
+const (
+	SettingActionUpdate  SettingAction = "update"
+	SettingActionDelete  SettingAction = "delete"
+	SettingActionRestore SettingAction = "restore"
+)
+
+// SettingVersion is a snapshot of a setting taken just before it was changed.
+// The value was in force from MTime until CTime.
+type SettingVersion struct {
+	ID        string        `json:"id" bson:"_id"`
+	SettingID string        `json:"setting_id" bson:"setting_id"`
+	Key       string        `json:"key" bson:"key"`
+	Value     interface{}   `json:"value" bson:"value"`
+	MTime     int64         `json:"mtime" bson:"mtime"`
+	Action    SettingAction `json:"action" bson:"action"`
+	ActorID   string        `json:"actor_id" bson:"actor_id"`
+	CTime     int64         `json:"ctime" bson:"ctime"`
+}
+
 // Errors
 var (
-	ErrSettingNotFound      = errors.New("setting not found")
-	ErrSettingKeyExists     = errors.New("setting key already exists")
-	ErrInvalidSettingKey    = errors.New("invalid setting key")
-	ErrInvalidSettingValue  = errors.New("invalid setting value")
+	ErrSettingNotFound        = errors.New("setting not found")
+	ErrSettingKeyExists       = errors.New("setting key already exists")
+	ErrInvalidSettingKey      = errors.New("invalid setting key")
+	ErrInvalidSettingValue    = errors.New("invalid setting value")
+	ErrSettingVersionNotFound = errors.New("setting version not found")
 )
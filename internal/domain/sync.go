@@ -0,0 +1,47 @@
+package domain
+
+import "errors"
+
+// Kinds of the objects a delta sync carries
+const (
+	SyncKindZone    = "zone"
+	SyncKindGroup   = "group"
+	SyncKindBox     = "box"
+	SyncKindMetric  = "metric"
+	SyncKindSetting = "setting"
+)
+
+// SyncDeletion tells an offline client to purge its copy of an object. Besides soft deletions it
+// is sent for groups and boxes that changed since the cursor but that the user may no longer read.
+type SyncDeletion struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted"` // always true
+}
+
+// SyncChanges is what changed since a client's last sync. ServerTime (milliseconds) is the cursor
+// to send as since next time. With Reset the payload holds every object the user may read and the
+// client drops the ones it has that are not in it: on the first sync, and when the user's access
+// may have changed since the cursor.
+type SyncChanges struct {
+	Since      int64          `json:"since"`
+	ServerTime int64          `json:"server_time"`
+	Reset      bool           `json:"reset"`
+	Zones      []Zone         `json:"zones"`
+	Groups     []BoxGroup     `json:"groups"`
+	Boxes      []Box          `json:"boxes"`
+	Metrics    []Metric       `json:"metrics"`
+	Settings   []Setting      `json:"settings,omitempty"` // admins only
+	Deleted    []SyncDeletion `json:"deleted"`
+}
+
+// AddDeletion tells the client to purge an object, unless the sync is a reset whose payload already
+// leaves out everything not to keep
+func (c *SyncChanges) AddDeletion(kind, id string) {
+	if !c.Reset {
+		c.Deleted = append(c.Deleted, SyncDeletion{Kind: kind, ID: id, Deleted: true})
+	}
+}
+
+// ErrInvalidSyncCursor is returned for a since cursor that is negative or in the future
+var ErrInvalidSyncCursor = errors.New("since must be a server_time returned by a previous sync, in milliseconds")
@@ -0,0 +1,70 @@
+package domain
+
+import "sort"
+
+// TreeZone is a zone of the navigation tree, with its groups and their boxes by name and ID only
+type TreeZone struct {
+	ID     string      `json:"id"`
+	Code   string      `json:"code"`
+	Name   string      `json:"name"`
+	Groups []TreeGroup `json:"groups"`
+}
+
+type TreeGroup struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	Boxes []TreeBox `json:"boxes"`
+}
+
+type TreeBox struct {
+	ID   string  `json:"id"`
+	Name string  `json:"name"`
+	Type *string `json:"type,omitempty"`
+}
+
+// BuildTree nests boxes in their groups and groups in their zones. Zones are sorted by name, groups
+// and boxes by sort order then ID, as they are listed elsewhere; groups and boxes whose parent is
+// not among those given are left out.
+func BuildTree(zones []Zone, groups []BoxGroup, boxes []Box) []TreeZone {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].SortOrder != groups[j].SortOrder {
+			return groups[i].SortOrder < groups[j].SortOrder
+		}
+		return groups[i].ID < groups[j].ID
+	})
+	sort.Slice(boxes, func(i, j int) bool {
+		if boxes[i].SortOrder != boxes[j].SortOrder {
+			return boxes[i].SortOrder < boxes[j].SortOrder
+		}
+		return boxes[i].ID < boxes[j].ID
+	})
+
+	boxesByGroup := make(map[string][]TreeBox)
+	for _, box := range boxes {
+		boxesByGroup[box.GroupID] = append(boxesByGroup[box.GroupID], TreeBox{ID: box.ID, Name: box.Name, Type: box.Type})
+	}
+	groupsByZone := make(map[string][]TreeGroup)
+	for _, group := range groups {
+		entry := TreeGroup{ID: group.ID, Name: group.Name, Boxes: boxesByGroup[group.ID]}
+		if entry.Boxes == nil {
+			entry.Boxes = []TreeBox{}
+		}
+		groupsByZone[group.ZoneID] = append(groupsByZone[group.ZoneID], entry)
+	}
+
+	tree := make([]TreeZone, 0, len(zones))
+	for _, zone := range zones {
+		entry := TreeZone{ID: zone.ID, Code: zone.Code, Name: zone.Name, Groups: groupsByZone[zone.ID]}
+		if entry.Groups == nil {
+			entry.Groups = []TreeGroup{}
+		}
+		tree = append(tree, entry)
+	}
+	sort.Slice(tree, func(i, j int) bool {
+		if tree[i].Name != tree[j].Name {
+			return tree[i].Name < tree[j].Name
+		}
+		return tree[i].ID < tree[j].ID
+	})
+	return tree
+}
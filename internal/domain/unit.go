@@ -0,0 +1,136 @@
+package domain
+
+import (
+	"sort"
+	"strings"
+)
+
+// Dimension is the physical quantity a unit measures; values convert only between units of one dimension
+type Dimension string
+
+const (
+	DimensionLength        Dimension = "length"
+	DimensionVolume        Dimension = "volume"
+	DimensionFlow          Dimension = "flow"
+	DimensionVelocity      Dimension = "velocity"
+	DimensionRainfallRate  Dimension = "rainfall_rate"
+	DimensionArea          Dimension = "area"
+	DimensionTemperature   Dimension = "temperature"
+	DimensionPressure      Dimension = "pressure"
+	DimensionVoltage       Dimension = "voltage"
+	DimensionCurrent       Dimension = "current"
+	DimensionRatio         Dimension = "ratio"
+	DimensionTime          Dimension = "time"
+	DimensionConcentration Dimension = "concentration"
+	DimensionTurbidity     Dimension = "turbidity"
+	DimensionNone          Dimension = "none"
+)
+
+// Unit is an entry of the unit catalog. Metric.Unit holds its code; Aliases are the free-text spellings
+// found in metrics created before units were validated, used to suggest a code for them.
+type Unit struct {
+	Code      string            `json:"code"`
+	Names     map[string]string `json:"names"` // display name by locale (vi, en)
+	Dimension Dimension         `json:"dimension"`
+	Aliases   []string          `json:"-"`
+}
+
+// Units is the unit catalog, grouped by dimension
+var Units = []Unit{
+	{Code: "mm", Names: map[string]string{"vi": "milimét", "en": "millimetre"}, Dimension: DimensionLength, Aliases: []string{"milimet", "millimeter"}},
+	{Code: "cm", Names: map[string]string{"vi": "xentimét", "en": "centimetre"}, Dimension: DimensionLength, Aliases: []string{"centimet", "centimeter"}},
+	{Code: "m", Names: map[string]string{"vi": "mét", "en": "metre"}, Dimension: DimensionLength, Aliases: []string{"met", "meter", "metre", "mét"}},
+	{Code: "km", Names: map[string]string{"vi": "kilômét", "en": "kilometre"}, Dimension: DimensionLength, Aliases: []string{"kilomet", "kilometer"}},
+
+	{Code: "m3", Names: map[string]string{"vi": "mét khối", "en": "cubic metre"}, Dimension: DimensionVolume, Aliases: []string{"m³", "m^3", "khối"}},
+	{Code: "10^6 m3", Names: map[string]string{"vi": "triệu mét khối", "en": "million cubic metres"}, Dimension: DimensionVolume, Aliases: []string{"10^6 m³", "10^6m3", "10^6m³", "triệu m3", "triệu m³", "mcm"}},
+
+	{Code: "m3/s", Names: map[string]string{"vi": "mét khối trên giây", "en": "cubic metres per second"}, Dimension: DimensionFlow, Aliases: []string{"m³/s", "m^3/s", "cms"}},
+	{Code: "m3/h", Names: map[string]string{"vi": "mét khối trên giờ", "en": "cubic metres per hour"}, Dimension: DimensionFlow, Aliases: []string{"m³/h", "m^3/h"}},
+	{Code: "l/s", Names: map[string]string{"vi": "lít trên giây", "en": "litres per second"}, Dimension: DimensionFlow, Aliases: []string{"lít/s", "lit/s"}},
+
+	{Code: "m/s", Names: map[string]string{"vi": "mét trên giây", "en": "metres per second"}, Dimension: DimensionVelocity},
+
+	{Code: "mm/h", Names: map[string]string{"vi": "milimét trên giờ", "en": "millimetres per hour"}, Dimension: DimensionRainfallRate},
+
+	{Code: "ha", Names: map[string]string{"vi": "héc-ta", "en": "hectare"}, Dimension: DimensionArea, Aliases: []string{"hecta", "hectare"}},
+	{Code: "km2", Names: map[string]string{"vi": "kilômét vuông", "en": "square kilometre"}, Dimension: DimensionArea, Aliases: []string{"km²", "km^2"}},
+
+	{Code: "°C", Names: map[string]string{"vi": "độ C", "en": "degree Celsius"}, Dimension: DimensionTemperature, Aliases: []string{"c", "oc", "độ c", "deg c"}},
+
+	{Code: "kPa", Names: map[string]string{"vi": "kilôpascal", "en": "kilopascal"}, Dimension: DimensionPressure},
+	{Code: "bar", Names: map[string]string{"vi": "bar", "en": "bar"}, Dimension: DimensionPressure},
+
+	{Code: "V", Names: map[string]string{"vi": "vôn", "en": "volt"}, Dimension: DimensionVoltage, Aliases: []string{"volt", "vôn"}},
+	{Code: "mA", Names: map[string]string{"vi": "miliampe", "en": "milliampere"}, Dimension: DimensionCurrent},
+
+	{Code: "%", Names: map[string]string{"vi": "phần trăm", "en": "percent"}, Dimension: DimensionRatio, Aliases: []string{"percent", "phần trăm"}},
+
+	{Code: "s", Names: map[string]string{"vi": "giây", "en": "second"}, Dimension: DimensionTime, Aliases: []string{"giây", "sec"}},
+	{Code: "h", Names: map[string]string{"vi": "giờ", "en": "hour"}, Dimension: DimensionTime, Aliases: []string{"giờ", "hr", "hour"}},
+
+	{Code: "mg/l", Names: map[string]string{"vi": "miligam trên lít", "en": "milligrams per litre"}, Dimension: DimensionConcentration, Aliases: []string{"mg/L"}},
+	{Code: "NTU", Names: map[string]string{"vi": "NTU", "en": "NTU"}, Dimension: DimensionTurbidity},
+
+	{Code: "-", Names: map[string]string{"vi": "không đơn vị", "en": "dimensionless"}, Dimension: DimensionNone, Aliases: []string{"", "pH"}},
+}
+
+// LookupUnit returns the catalog unit with the given code
+func LookupUnit(code string) (Unit, bool) {
+	for _, u := range Units {
+		if u.Code == code {
+			return u, true
+		}
+	}
+	return Unit{}, false
+}
+
+// SuggestUnit returns the catalog unit a free-text unit most likely means, matching codes and aliases
+// without regard to case and surrounding spaces
+func SuggestUnit(text string) (Unit, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	for _, u := range Units {
+		if strings.ToLower(u.Code) == text {
+			return u, true
+		}
+		for _, alias := range u.Aliases {
+			if strings.ToLower(alias) == text {
+				return u, true
+			}
+		}
+	}
+	return Unit{}, false
+}
+
+// UnitCodes lists the catalog codes, sorted
+func UnitCodes() []string {
+	codes := make([]string, len(Units))
+	for i, u := range Units {
+		codes[i] = u.Code
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ValidateUnit rejects a unit code missing from the catalog, listing the valid codes
+func ValidateUnit(field, code string) error {
+	if _, ok := LookupUnit(code); ok {
+		return nil
+	}
+	problem := FieldError{Field: field, Rule: "oneof", Code: "field_unit_not_in_catalog", Params: map[string]string{"units": strings.Join(UnitCodes(), ", ")}}
+	if suggestion, ok := SuggestUnit(code); ok {
+		problem.Code = "field_unit_not_in_catalog_suggestion"
+		problem.Params["suggestion"] = suggestion.Code
+	}
+	return &ValidationError{Problems: []FieldError{problem}}
+}
+
+// UnitMismatch is a metric whose unit is not a catalog code. Suggestion is the catalog code the unit
+// most likely means, empty when none matches.
+type UnitMismatch struct {
+	ID         string `json:"id"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	Unit       string `json:"unit"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
@@ -2,6 +2,7 @@ package domain
 
 import (
 	"errors"
+	"regexp"
 	"time"
 	"tp25-api/lib"
 )
@@ -11,6 +12,9 @@ type Role string
 const (
 	RoleAdmin   Role = "admin"
 	RoleMonitor Role = "monitor" // readonly
+
+	// RoleAPIKey is the role of the principal of an API key, never stored on a user
+	RoleAPIKey Role = "api_key"
 )
 
 type User struct {
@@ -19,19 +23,78 @@ type User struct {
 	FullName string   `json:"full_name" bson:"full_name"`
 	Role     Role     `json:"role" bson:"role"`
 	Phone    string   `json:"phone" bson:"phone"`
-	ZoneID   *string  `json:"zone_id,omitempty" bson:"zone_id,omitempty"`
+	ZoneIDs  []string `json:"zone_ids" bson:"zone_ids,omitempty"` // zones whose every group the user may read
 	Groups   []string `json:"groups" bson:"groups"`
 	ZaloID   *string  `json:"zalo_id,omitempty" bson:"zalo_id,omitempty"`
 	CTime    int64    `json:"ctime" bson:"ctime"`
 	MTime    int64    `json:"mtime" bson:"mtime"`
 	DTime    *int64   `json:"dtime,omitempty" bson:"dtime,omitempty"`
+
+	// TokenVersion is embedded in the user's access tokens. Raising it revokes the tokens issued
+	// before, which carry an access the user may no longer have.
+	TokenVersion int64 `json:"-" bson:"token_version,omitempty"`
+
+	// LegacyZoneID is the single zone users were stored with before ZoneIDs; see MigrateZones
+	LegacyZoneID *string `json:"-" bson:"zone_id,omitempty"`
+
+	// zoneGroups are the groups of ZoneIDs, resolved when the user is loaded for a request
+	zoneGroups []string
+}
+
+// MigrateZones moves the zone of a user stored before ZoneIDs into it. The old field is dropped
+// the next time the user is saved.
+func (u *User) MigrateZones() {
+	if u.LegacyZoneID == nil {
+		return
+	}
+	if *u.LegacyZoneID != "" && !containsString(u.ZoneIDs, *u.LegacyZoneID) {
+		u.ZoneIDs = append(u.ZoneIDs, *u.LegacyZoneID)
+	}
+	u.LegacyZoneID = nil
+}
+
+// SetZoneGroups records the groups of the user's zones, which the user may read besides Groups
+func (u *User) SetZoneGroups(groupIDs []string) {
+	u.zoneGroups = groupIDs
+}
+
+// ZoneGroups returns the groups of the user's zones as set by SetZoneGroups
+func (u *User) ZoneGroups() []string {
+	return u.zoneGroups
+}
+
+// ReadableGroups returns the groups assigned to the user and those of the user's zones.
+// It is meaningless for admins, who read every group.
+func (u *User) ReadableGroups() []string {
+	groups := append([]string{}, u.Groups...)
+	for _, g := range u.zoneGroups {
+		if !containsString(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// CanAccessZone reports whether the user may read every group of the zone
+func (u *User) CanAccessZone(zoneID string) bool {
+	return u.Role == RoleAdmin || containsString(u.ZoneIDs, zoneID)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 type CreateUserParams struct {
 	Username string   `json:"username" binding:"required"`
 	FullName string   `json:"full_name" binding:"required"`
-	Role     Role     `json:"role" binding:"required"`
+	Role     Role     `json:"role" binding:"required,oneof=admin monitor"`
 	Phone    string   `json:"phone"`
+	ZoneIDs  []string `json:"zone_ids"`
 	Groups   []string `json:"groups"`
 	ZaloID   *string  `json:"zalo_id"`
 }
@@ -39,15 +102,111 @@ type CreateUserParams struct {
 type UpdateUserParams struct {
 	FullName *string  `json:"full_name"`
 	Phone    *string  `json:"phone"`
+	ZoneIDs  []string `json:"zone_ids"` // replaces the user's zones when present, [] removes them
 	Groups   []string `json:"groups"`
 	ZaloID   *string  `json:"zalo_id"`
 }
 
+// CanAccessGroup reports whether the user may read data of the given box group.
+// Admins see every group, other roles the groups assigned to them and every group of their zones.
+func (u *User) CanAccessGroup(groupID string) bool {
+	if u.Role == RoleAdmin {
+		return true
+	}
+	return containsString(u.Groups, groupID) || containsString(u.zoneGroups, groupID)
+}
+
+// UpdateProfileParams is the subset of user fields a user may change on their own account
+type UpdateProfileParams struct {
+	FullName *string `json:"full_name"`
+	Phone    *string `json:"phone"`
+	ZaloID   *string `json:"zalo_id"`
+}
+
+// MaxImportUsers caps the number of data rows accepted by a single user import
+const MaxImportUsers = 500
+
+// ImportUserRow is one data row of a user import spreadsheet.
+// Groups holds the raw cell values, which may be group IDs or names.
+type ImportUserRow struct {
+	Row      int
+	Username string
+	FullName string
+	Role     Role
+	Phone    string
+	Groups   []string
+}
+
+// ImportUsersOptions controls how an import is applied
+type ImportUsersOptions struct {
+	DryRun            bool
+	GeneratePasswords bool
+}
+
+// ImportUserResult reports the outcome of one import row
+type ImportUserResult struct {
+	Row          int      `json:"row"`
+	Username     string   `json:"username"`
+	UserID       string   `json:"user_id,omitempty"`
+	TempPassword string   `json:"temp_password,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// ImportUsersResult reports a whole import; nothing is created unless every row is valid
+type ImportUsersResult struct {
+	DryRun  bool               `json:"dry_run"`
+	Valid   bool               `json:"valid"`
+	Created int                `json:"created"`
+	Rows    []ImportUserResult `json:"rows"`
+}
+
 type UserSecret struct {
-	UserID string `json:"user_id" bson:"user_id"`
-	Name   string `json:"name" bson:"name"`
-	Value  string `json:"value" bson:"value"`
-	Encode string `json:"encode" bson:"encode"`
+	UserID string   `json:"user_id" bson:"user_id"`
+	Name   string   `json:"name" bson:"name"`
+	Value  string   `json:"value" bson:"value"`
+	Encode string   `json:"encode" bson:"encode"`
+	Codes  []string `json:"-" bson:"codes,omitempty"` // hashed single-use codes, see SecretTOTPBackup
+
+	// Counter is the time step of the last TOTP code accepted, which no code may reuse. See SecretTOTP.
+	Counter int64 `json:"-" bson:"counter,omitempty"`
+}
+
+// User secret names used for two-factor authentication
+const (
+	SecretTOTPPending = "totp_pending" // enrolled but not yet verified
+	SecretTOTP        = "totp"         // active; its presence enables 2FA on login
+	SecretTOTPBackup  = "totp_backup"  // hashed backup codes
+)
+
+// TwoFactorSetup is returned when enrolling an authenticator app
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URL    string `json:"otpauth_url"`
+}
+
+// Two-factor login attempts are capped per challenge and per user, so a 6-digit code cannot be guessed
+const (
+	MaxTwoFactorChallengeAttempts = 5
+	MaxTwoFactorUserAttempts      = 10
+	TwoFactorAttemptWindow        = 15 * time.Minute
+)
+
+// TwoFactorAttempt is a code sent to complete a login. Attempts are dropped once the login succeeds.
+type TwoFactorAttempt struct {
+	ID          string `json:"id" bson:"_id"`
+	UserID      string `json:"user_id" bson:"user_id"`
+	ChallengeID string `json:"challenge_id" bson:"challenge_id"`
+	CTime       int64  `json:"ctime" bson:"ctime"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// TwoFactorLoginRequest completes a login that answered "2fa_required"; Code may be a TOTP or backup code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
 }
 
 type RefreshToken struct {
@@ -57,6 +216,39 @@ type RefreshToken struct {
 	CTime     int64  `json:"ctime" bson:"ctime"`
 }
 
+// UserSessions lists the active sessions of a user against the limit of their role (0 for none)
+type UserSessions struct {
+	Count    int            `json:"count"`
+	Limit    int            `json:"limit"`
+	Sessions []RefreshToken `json:"sessions"`
+}
+
+// SessionStats counts active sessions across users; DuplicateUsers are logged in more than once
+type SessionStats struct {
+	Active         int64 `json:"active"`
+	Users          int64 `json:"users"`
+	DuplicateUsers int64 `json:"duplicate_users"`
+}
+
+// PasswordResetToken is a single-use password reset token; only the SHA-256 hash of the token is stored
+type PasswordResetToken struct {
+	ID        string `json:"id" bson:"_id"` // hex SHA-256 of the token
+	UserID    string `json:"user_id" bson:"user_id"`
+	ExpiresAt int64  `json:"expires_at" bson:"expires_at"`
+	UsedAt    *int64 `json:"used_at,omitempty" bson:"used_at,omitempty"`
+	CTime     int64  `json:"ctime" bson:"ctime"`
+}
+
+// ForgotPasswordRequest identifies the account by username or phone number
+type ForgotPasswordRequest struct {
+	Login string `json:"login" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
 type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
@@ -67,16 +259,38 @@ type SetPasswordRequest struct {
 }
 
 var (
-	ErrUserNotFound        = errors.New("user not found")
-	ErrUsernameNotFound    = errors.New("username not found")
-	ErrUsernameExisted     = errors.New("username existed")
-	ErrUserHasNoLogin      = errors.New("user has no login")
-	ErrWrongPassword       = errors.New("wrong password")
-	ErrInvalidSession      = errors.New("invalid session")
-	ErrInvalidRefreshToken = errors.New("invalid refresh token")
-	ErrUnauthorized        = errors.New("unauthorized")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrUsernameNotFound     = errors.New("username not found")
+	ErrUsernameExisted      = errors.New("username existed")
+	ErrUserHasNoLogin       = errors.New("user has no login")
+	ErrWrongPassword        = errors.New("wrong password")
+	ErrInvalidSession       = errors.New("invalid session")
+	ErrInvalidRefreshToken  = errors.New("invalid refresh token")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrInvalidPhone         = errors.New("invalid phone number")
+	ErrTooManyImportRows    = errors.New("too many rows in import")
+	ErrInvalidResetToken    = errors.New("invalid or expired reset token")
+	ErrTooManyResetRequests = errors.New("too many password reset requests")
+	ErrSessionLimitReached  = errors.New("concurrent session limit reached")
+	ErrNoResetChannel       = errors.New("user has no phone or zalo id")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotSetup    = errors.New("two-factor authentication not set up")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrInvalidChallenge     = errors.New("invalid or expired two-factor challenge")
+	ErrTwoFactorLocked      = errors.New("too many two-factor attempts, retry later")
 )
 
+// phonePattern matches Vietnamese mobile numbers in local (0xx) or international (+84/84) form
+var phonePattern = regexp.MustCompile(`^(0|\+84|84)(3|5|7|8|9)[0-9]{8}$`)
+
+// ValidatePhone checks that phone is a Vietnamese mobile number
+func ValidatePhone(phone string) error {
+	if !phonePattern.MatchString(phone) {
+		return ErrInvalidPhone
+	}
+	return nil
+}
+
 // NewUser creates a new user with timestamps
 func NewUser(params CreateUserParams) *User {
 	now := time.Now().UnixMilli()
@@ -86,6 +300,7 @@ func NewUser(params CreateUserParams) *User {
 		FullName: params.FullName,
 		Role:     params.Role,
 		Phone:    params.Phone,
+		ZoneIDs:  params.ZoneIDs,
 		Groups:   params.Groups,
 		ZaloID:   params.ZaloID,
 		CTime:    now,
@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A user updating their own profile cannot reach the fields that grant access
+func TestUpdateProfileParamsIgnoresAccessFields(t *testing.T) {
+	body := `{"full_name":"Nguyễn Văn A","role":"admin","groups":["g1","g2"],"zone_ids":["z1"],"token_version":0}`
+
+	var params UpdateProfileParams
+	if err := json.Unmarshal([]byte(body), &params); err != nil {
+		t.Fatal(err)
+	}
+	if params.FullName == nil || *params.FullName != "Nguyễn Văn A" {
+		t.Errorf("full_name = %v, want it bound", params.FullName)
+	}
+	if want := (UpdateProfileParams{FullName: params.FullName}); !reflect.DeepEqual(params, want) {
+		t.Errorf("bound %+v, want only full_name", params)
+	}
+
+	forbidden := map[string]bool{"role": true, "groups": true, "zone_ids": true}
+	fields := reflect.TypeOf(UpdateProfileParams{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := strings.Split(fields.Field(i).Tag.Get("json"), ",")[0]
+		if forbidden[name] {
+			t.Errorf("UpdateProfileParams binds %q", name)
+		}
+	}
+}
+
+// A user reads the groups of every zone assigned, and none once the zones are cleared
+func TestCanAccessGroupThroughZones(t *testing.T) {
+	user := &User{ID: "u1", Role: RoleMonitor, ZoneIDs: []string{"z1", "z2"}}
+	user.SetZoneGroups([]string{"z1-g1", "z1-g2", "z2-g1"})
+
+	for group, want := range map[string]bool{"z1-g1": true, "z1-g2": true, "z2-g1": true, "z3-g1": false} {
+		if got := user.CanAccessGroup(group); got != want {
+			t.Errorf("CanAccessGroup(%s) = %v, want %v", group, got, want)
+		}
+	}
+
+	user.ZoneIDs = []string{}
+	user.SetZoneGroups(nil)
+	for _, group := range []string{"z1-g1", "z2-g1", "z3-g1"} {
+		if user.CanAccessGroup(group) {
+			t.Errorf("CanAccessGroup(%s) after the zones were cleared", group)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"fmt"
+	"reflect"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -59,6 +61,11 @@ func NewPaginatedResponse(data interface{}, page, pageSize int, totalItems int64
 		totalPages = 1
 	}
 
+	// Empty results are sent as [] rather than null
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice && v.IsNil() {
+		data = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+
 	return &PaginatedResponse{
 		Data: data,
 		Meta: PaginationMeta{
@@ -77,3 +84,43 @@ func ParsePaginationParams(c *gin.Context) *Pagination {
 	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "10"))
 	return NewPagination(page, pageSize)
 }
+
+// PageLimits are the default and maximum page size of a route that opts out of the global 10/100
+type PageLimits struct {
+	Default int
+	Max     int
+}
+
+var (
+	// RecordPageLimits apply to record listings, whose items are small
+	RecordPageLimits = PageLimits{Default: 10, Max: 1000}
+	// GroupBoxesPageLimits apply to group listings that expand every group's boxes
+	GroupBoxesPageLimits = PageLimits{Default: 10, Max: 50}
+)
+
+// PageSizeError reports a page_size above the route's maximum
+type PageSizeError struct {
+	Max int
+}
+
+func (e *PageSizeError) Error() string {
+	return fmt.Sprintf("page_size must be at most %d", e.Max)
+}
+
+// ParsePaginationWithLimits parses pagination parameters using the route's limits.
+// Unlike ParsePaginationParams it rejects a page_size above the maximum instead of capping it.
+func ParsePaginationWithLimits(c *gin.Context, limits PageLimits) (*Pagination, error) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(limits.Default)))
+	if pageSize > limits.Max {
+		return nil, &PageSizeError{Max: limits.Max}
+	}
+
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = limits.Default
+	}
+	return &Pagination{Page: page, PageSize: pageSize}, nil
+}
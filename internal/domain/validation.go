@@ -0,0 +1,37 @@
+package domain
+
+import "strings"
+
+// FieldError is one reason a request was rejected. Field is the JSON path of the offending value
+// (e.g. location.lat), Rule the failed check and Code the i18n message to show, whose {name}
+// placeholders Params fill. Message is that text in the language of the request, which the frontend
+// can show as is; handlers set it when answering.
+type FieldError struct {
+	Field   string            `json:"field"`
+	Rule    string            `json:"rule"`
+	Code    string            `json:"code"`
+	Params  map[string]string `json:"-"`
+	Message string            `json:"message"`
+}
+
+// ValidationError lists every field a request was rejected for
+type ValidationError struct {
+	Problems []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		fields[i] = p.Field + " (" + p.Rule + ")"
+	}
+	return "invalid " + strings.Join(fields, ", ")
+}
+
+// Warnings are problems a request was accepted despite, returned next to its result so clients can
+// show them without the request failing
+type Warnings []FieldError
+
+// Add appends problems as warnings
+func (w *Warnings) Add(problems ...FieldError) {
+	*w = append(*w, problems...)
+}
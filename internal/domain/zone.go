@@ -1,7 +1,13 @@
 package domain
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 	"tp25-api/lib"
 )
@@ -11,11 +17,66 @@ type Location struct {
 	Lng float64 `json:"lng" bson:"lng"`
 }
 
+// CoordinateBounds restricts where locations may lie, within the valid latitude/longitude ranges
+type CoordinateBounds struct {
+	MinLat float64 `json:"min_lat"`
+	MaxLat float64 `json:"max_lat"`
+	MinLng float64 `json:"min_lng"`
+	MaxLng float64 `json:"max_lng"`
+}
+
+// VietnamBounds covers mainland Vietnam and its islands
+var VietnamBounds = CoordinateBounds{MinLat: 6, MaxLat: 24, MinLng: 102, MaxLng: 118}
+
+// Problems checks that the location is a plausible WGS84 coordinate, inside bounds when given.
+// field prefixes the reported fields, e.g. "location" reports location.lat.
+func (l Location) Problems(field string, bounds *CoordinateBounds) []FieldError {
+	var problems []FieldError
+	if math.IsNaN(l.Lat) || l.Lat < -90 || l.Lat > 90 {
+		problems = append(problems, FieldError{Field: field + ".lat", Rule: "range", Code: "field_lat_range"})
+	}
+	if math.IsNaN(l.Lng) || l.Lng < -180 || l.Lng > 180 {
+		problems = append(problems, FieldError{Field: field + ".lng", Rule: "range", Code: "field_lng_range"})
+	}
+	if len(problems) == 0 && bounds != nil &&
+		(l.Lat < bounds.MinLat || l.Lat > bounds.MaxLat || l.Lng < bounds.MinLng || l.Lng > bounds.MaxLng) {
+		problems = append(problems, FieldError{Field: field, Rule: "bounds", Code: "field_location_bounds"})
+	}
+	return problems
+}
+
+// ValidateLocation fails with a *ValidationError when the location is not plausible, see Location.Problems
+func ValidateLocation(field string, location Location, bounds *CoordinateBounds) error {
+	if problems := location.Problems(field, bounds); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// InvalidLocation is a stored zone, group or box whose coordinates fail validation
+type InvalidLocation struct {
+	Kind     string       `json:"kind"` // zone, group or box
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Location Location     `json:"location"`
+	Problems []FieldError `json:"problems"`
+}
+
+// BoxZoneMismatch is a stored box whose zone_id is not the zone of its group, which hides it from
+// the listings of its group's zone
+type BoxZoneMismatch struct {
+	BoxID       string `json:"box_id"`
+	Name        string `json:"name"`
+	GroupID     string `json:"group_id"`
+	ZoneID      string `json:"zone_id"`       // the box's
+	GroupZoneID string `json:"group_zone_id"` // the group's, which the fix sets on the box
+}
+
 type Zone struct {
 	ID     string      `json:"id" bson:"_id"`
 	Code   string      `json:"code" bson:"code"`
 	Name   string      `json:"name" bson:"name"`
-	Detail interface{} `json:"detail" bson:"detail"`
+	Detail interface{} `json:"detail,omitempty" bson:"detail"` // omitted from lists unless ?fields=detail
 	Center Location    `json:"center" bson:"center"`
 	CTime  int64       `json:"ctime" bson:"ctime"`
 	MTime  int64       `json:"mtime" bson:"mtime"`
@@ -35,6 +96,41 @@ type UpdateZoneParams struct {
 	Center *Location   `json:"center"`
 }
 
+// MaxZoneDetailSize caps the JSON-serialized size of Zone.Detail in bytes
+const MaxZoneDetailSize = 64 * 1024
+
+// ZoneDetailSize returns the JSON-serialized size of a zone detail in bytes
+func ZoneDetailSize(detail interface{}) (int, error) {
+	if detail == nil {
+		return 0, nil
+	}
+	b, err := json.Marshal(detail)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ValidateZoneDetail rejects details larger than MaxZoneDetailSize
+func ValidateZoneDetail(detail interface{}) error {
+	size, err := ZoneDetailSize(detail)
+	if err != nil {
+		return err
+	}
+	if size > MaxZoneDetailSize {
+		return ErrZoneDetailTooLarge
+	}
+	return nil
+}
+
+// OversizedZoneDetail lists a zone whose stored Detail exceeds MaxZoneDetailSize
+type OversizedZoneDetail struct {
+	ID         string `json:"id"`
+	Code       string `json:"code"`
+	Name       string `json:"name"`
+	DetailSize int    `json:"detail_size"`
+}
+
 type MissionGroup struct {
 	Name      string `json:"name" bson:"name"`
 	Unit      string `json:"unit" bson:"unit"`           // Đơn vị
@@ -67,13 +163,14 @@ type NoteGroup struct {
 	AreaRiseHight      string `json:"area_rise_hight,omitempty" bson:"area_rise_hight,omitempty"`           // Diện tích hồ ứng với MNDGC(Ha)
 
 	// Đập chính
-	Structure         string `json:"structure,omitempty" bson:"structure,omitempty"`                         // Kết cấu đập
-	Elevation         string `json:"elevation,omitempty" bson:"elevation,omitempty"`                         // Cao trình đập
-	Height            string `json:"height,omitempty" bson:"height,omitempty"`                               // Chiều cao đập lớn nhất(m)
-	Longs             string `json:"longs,omitempty" bson:"longs,omitempty"`                                 // Chiều dài đập(m)
-	Width             string `json:"width,omitempty" bson:"width,omitempty"`                                 // Bề rộng mặt đập(m)
-	RoofCoefficientUp string `json:"roof_coefficient_up,omitempty" bson:"roof_coefficient_up,omitempty"`     // Hệ số mái thượng lưu
-	RoofCoefficientDn string `json:"roof_coefficient_down,omitempty" bson:"roof_coefficient_down,omitempty"` // Hệ số mái hạ lưu
+	Structure         string   `json:"structure,omitempty" bson:"structure,omitempty"`                         // Kết cấu đập
+	Elevation         string   `json:"elevation,omitempty" bson:"elevation,omitempty"`                         // Cao trình đập
+	CrestElevation    *float64 `json:"crest_elevation,omitempty" bson:"crest_elevation,omitempty"`             // Cao trình đỉnh đập (m), Elevation as a number
+	Height            string   `json:"height,omitempty" bson:"height,omitempty"`                               // Chiều cao đập lớn nhất(m)
+	Longs             string   `json:"longs,omitempty" bson:"longs,omitempty"`                                 // Chiều dài đập(m)
+	Width             string   `json:"width,omitempty" bson:"width,omitempty"`                                 // Bề rộng mặt đập(m)
+	RoofCoefficientUp string   `json:"roof_coefficient_up,omitempty" bson:"roof_coefficient_up,omitempty"`     // Hệ số mái thượng lưu
+	RoofCoefficientDn string   `json:"roof_coefficient_down,omitempty" bson:"roof_coefficient_down,omitempty"` // Hệ số mái hạ lưu
 
 	// Tràn xả lũ
 	StructuralDischargeDam  string `json:"structural_discharge_dam,omitempty" bson:"structural_discharge_dam,omitempty"`     // Đặc điểm cấu kết cấu tràn xả lũ
@@ -103,35 +200,114 @@ type NoteGroup struct {
 
 type BoxGroup struct {
 	ID        string     `json:"id" bson:"_id"`
+	Code      string     `json:"code" bson:"code"` // short label, e.g. of export files; empty for groups created without one
 	Name      string     `json:"name" bson:"name"`
 	SortOrder int        `json:"sort_order" bson:"sort_order"`
 	ZoneID    string     `json:"zone_id" bson:"zone_id"`
 	Center    *Location  `json:"center,omitempty" bson:"center,omitempty"`
-	Zoom      *int       `json:"zoom,omitempty" bson:"zoom,omitempty"` // 10-16
+	Zoom      *int       `json:"zoom,omitempty" bson:"zoom,omitempty"` // MinGroupZoom-MaxGroupZoom
 	Cameras   []string   `json:"cameras,omitempty" bson:"cameras,omitempty"`
 	Note      *NoteGroup `json:"note,omitempty" bson:"note,omitempty"`
 	CTime     int64      `json:"ctime" bson:"ctime"`
 	MTime     int64      `json:"mtime" bson:"mtime"`
 	DTime     *int64     `json:"dtime,omitempty" bson:"dtime,omitempty"`
 	Subdomain *string    `json:"subdomain,omitempty" bson:"subdomain,omitempty"`
+	Branding  *Branding  `json:"branding,omitempty" bson:"branding,omitempty"`
+
+	// An archived group is hidden from group listings but stays readable and its boxes keep
+	// accepting records, unlike a deleted one
+	Archived bool `json:"archived,omitempty" bson:"archived,omitempty"`
+
+	// The box measuring the reservoir level (WAU) the freeboard of the group is computed from
+	PrimaryBoxID *string `json:"primary_box_id,omitempty" bson:"primary_box_id,omitempty"`
 }
 
 type CreateGroupParams struct {
 	Name      string    `json:"name" binding:"required"`
+	Code      string    `json:"code"`
 	ZoneID    string    `json:"zone_id" binding:"required"`
 	Center    *Location `json:"center"`
-	Zoom      *int      `json:"zoom"`
-	Cameras   []string  `json:"cameras"`
+	Zoom      *int      `json:"zoom" binding:"omitempty,min=10,max=16"`
+	Cameras   []string  `json:"cameras" binding:"omitempty,dive,required"`
 	Subdomain *string   `json:"subdomain"`
 }
 
 type UpdateGroupParams struct {
+	ZoneID    *string   `json:"zone_id"` // moves the group and its boxes to another zone
 	Name      *string   `json:"name"`
+	Code      *string   `json:"code"`
 	SortOrder *int      `json:"sort_order"`
 	Center    *Location `json:"center"`
-	Zoom      *int      `json:"zoom"`
-	Cameras   []string  `json:"cameras"`
+	Zoom      *int      `json:"zoom" binding:"omitempty,min=10,max=16"`
+	Cameras   []string  `json:"cameras" binding:"omitempty,dive,required"`
 	Subdomain *string   `json:"subdomain"`
+	Branding  *Branding `json:"branding"` // replaces the whole branding; {} resets to the default theme
+
+	PrimaryBoxID   *string  `json:"primary_box_id"`  // a box of the group; "" clears it
+	CrestElevation *float64 `json:"crest_elevation"` // sets note.crest_elevation (m)
+}
+
+// Zoom levels the map of a group may open at; beyond them the map tiles do not render
+const (
+	MinGroupZoom = 10
+	MaxGroupZoom = 16
+)
+
+// GroupMapProblems checks the map settings of a group: the zoom within MinGroupZoom-MaxGroupZoom,
+// the center a plausible coordinate (see Location.Problems) and no blank camera entry. Nil settings
+// are not checked.
+func GroupMapProblems(center *Location, zoom *int, cameras []string, bounds *CoordinateBounds) []FieldError {
+	var problems []FieldError
+	if center != nil {
+		problems = append(problems, center.Problems("center", bounds)...)
+	}
+	if zoom != nil && (*zoom < MinGroupZoom || *zoom > MaxGroupZoom) {
+		problems = append(problems, FieldError{Field: "zoom", Rule: "range", Code: "field_zoom_range", Params: map[string]string{"min": strconv.Itoa(MinGroupZoom), "max": strconv.Itoa(MaxGroupZoom)}})
+	}
+	for i, camera := range cameras {
+		if strings.TrimSpace(camera) == "" {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("cameras[%d]", i), Rule: "required", Code: "field_camera_required"})
+		}
+	}
+	return problems
+}
+
+// ValidateGroupMap fails with a *ValidationError listing every problem found by GroupMapProblems
+func ValidateGroupMap(center *Location, zoom *int, cameras []string, bounds *CoordinateBounds) error {
+	if problems := GroupMapProblems(center, zoom, cameras, bounds); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// InvalidGroupMap is a stored group whose zoom or cameras fail validation. Invalid centers are
+// reported with the other coordinates, see InvalidLocation.
+type InvalidGroupMap struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	ZoneID   string       `json:"zone_id"`
+	Zoom     *int         `json:"zoom,omitempty"`
+	Cameras  []string     `json:"cameras,omitempty"`
+	Problems []FieldError `json:"problems"`
+}
+
+// CloneGroupParams names the copy of a group. Device IDs must stay unique, so the copied boxes get the
+// source device ID followed by DeviceIDSuffix, "-copy-" and a random tag when omitted; the copies receive
+// no records until devices report under the new IDs.
+type CloneGroupParams struct {
+	Name           string  `json:"name" binding:"required"`
+	Subdomain      *string `json:"subdomain"`
+	ZoneID         *string `json:"zone_id"` // the source group's zone when omitted
+	DeviceIDSuffix string  `json:"device_id_suffix" binding:"max=32"`
+}
+
+type FilterGroupParams struct {
+	ZoneID          string  `json:"zone_id" form:"zone_id"`
+	Query           *string `json:"q,omitempty" form:"q"`
+	IncludeArchived bool    `json:"include_archived,omitempty" form:"include_archived"`
+
+	// GroupIDs restricts the listing to these groups when not nil, e.g. to those a monitor may read
+	GroupIDs []string `json:"-" form:"-"`
 }
 
 type BoxMetric struct {
@@ -143,54 +319,420 @@ type BoxMetric struct {
 	Warning1 *string  `json:"warning1,omitempty" bson:"warning1,omitempty"`
 	Warning2 *string  `json:"warning2,omitempty" bson:"warning2,omitempty"`
 	Warning3 *string  `json:"warning3,omitempty" bson:"warning3,omitempty"`
+	Manual   bool     `json:"manual,omitempty" bson:"manual,omitempty"` // entered by staff, e.g. staff-gauge readings
+	Rate     bool     `json:"rate,omitempty" bson:"rate,omitempty"`     // derive <code>_rate at ingest
+
+	// Display overrides of the metric's sort_order and category for this box
+	SortOrder *int    `json:"sort_order,omitempty" bson:"sort_order,omitempty"`
+	Category  *string `json:"category,omitempty" bson:"category,omitempty"`
+
+	// Conversion applies when the box reports the metric in another unit than the catalog metric
+	Conversion *UnitConversion `json:"conversion,omitempty" bson:"conversion,omitempty"`
+}
+
+// UnitConversion converts values reported in InputUnit to the catalog unit: value*Factor + Offset
+type UnitConversion struct {
+	InputUnit string  `json:"input_unit" bson:"input_unit"`
+	Factor    float64 `json:"factor" bson:"factor"`
+	Offset    float64 `json:"offset,omitempty" bson:"offset,omitempty"`
+	KeepRaw   bool    `json:"keep_raw,omitempty" bson:"keep_raw,omitempty"` // keep the reported value as raw_<code>
+}
+
+func (c *UnitConversion) Validate() error {
+	if c.Factor == 0 || math.IsNaN(c.Factor) || math.IsInf(c.Factor, 0) || math.IsNaN(c.Offset) || math.IsInf(c.Offset, 0) {
+		return ErrInvalidUnitConversion
+	}
+	return nil
+}
+
+// Apply converts a reported value to the catalog unit
+func (c *UnitConversion) Apply(v float64) float64 {
+	return v*c.Factor + c.Offset
+}
+
+// Invert recovers the reported value from a converted one
+func (c *UnitConversion) Invert(v float64) float64 {
+	return (v - c.Offset) / c.Factor
+}
+
+// ValidateBoxMetrics checks the unit conversions of a box's metrics
+func ValidateBoxMetrics(metrics []BoxMetric) error {
+	for _, m := range metrics {
+		if m.Conversion != nil {
+			if err := m.Conversion.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnknownMetricProblems reports the box metrics matching no metric of the catalog: by their metric
+// reference when they have one (a catalog ID or code), by their code otherwise. A typo leaves the
+// values of a box out of everything resolved through the catalog, such as units and bounds.
+func UnknownMetricProblems(metrics []BoxMetric, catalog []Metric) []FieldError {
+	known := make(map[string]bool, 2*len(catalog))
+	for _, m := range catalog {
+		known[m.ID] = true
+		known[m.Code] = true
+	}
+
+	var problems []FieldError
+	for i, m := range metrics {
+		if m.Metric != nil {
+			if !known[*m.Metric] {
+				problems = append(problems, FieldError{Field: fmt.Sprintf("metrics[%d].metric", i), Rule: "catalog", Code: "field_metric_not_in_catalog", Params: map[string]string{"metric": *m.Metric}})
+			}
+			continue
+		}
+		if !known[m.Code] {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("metrics[%d].code", i), Rule: "catalog", Code: "field_metric_code_not_in_catalog", Params: map[string]string{"code": m.Code}})
+		}
+	}
+	return problems
+}
+
+// UnknownReportMetricProblems reports the requested report metrics whose code matches no metric of
+// the catalog; a typo would otherwise just leave the metric out of the report
+func UnknownReportMetricProblems(metrics []string, catalog []Metric) []FieldError {
+	known := make(map[string]bool, len(catalog))
+	for _, m := range catalog {
+		known[m.Code] = true
+	}
+
+	var problems []FieldError
+	for i, code := range metrics {
+		if !known[code] {
+			problems = append(problems, FieldError{Field: fmt.Sprintf("metrics[%d]", i), Rule: "catalog", Code: "field_metric_code_not_in_catalog", Params: map[string]string{"code": code}})
+		}
+	}
+	return problems
+}
+
+// MergeMode decides what happens to a record arriving within the merge window of a stored one
+type MergeMode string
+
+const (
+	MergeKeepBoth MergeMode = "keep_both"
+	MergeReject   MergeMode = "reject"
+	MergeFields   MergeMode = "merge" // see MergeRecords
+)
+
+// MaxMergeWindow bounds MergePolicy.Window (seconds)
+const MaxMergeWindow = 3600
+
+// MergePolicy controls how near-duplicate records of a box are handled
+type MergePolicy struct {
+	Mode   MergeMode `json:"mode" bson:"mode"`
+	Window int64     `json:"window" bson:"window"` // seconds
+}
+
+func (p *MergePolicy) Validate() error {
+	switch p.Mode {
+	case MergeKeepBoth, MergeReject, MergeFields:
+	default:
+		return ErrInvalidMergePolicy
+	}
+	if p.Window < 0 || p.Window > MaxMergeWindow {
+		return ErrInvalidMergePolicy
+	}
+	return nil
+}
+
+// MaxDedupWindow bounds DedupPolicy.Window (seconds)
+const MaxDedupWindow = 60
+
+// DefaultDedupEpsilon is the tolerance used when a DedupPolicy sets none
+const DefaultDedupEpsilon = 1e-6
+
+// DedupPolicy drops a record repeating a stored one: one within Window seconds whose metric values,
+// for the metrics both report, all differ by at most Epsilon. It covers loggers whose clock jitters
+// and resend a measurement with a timestamp a second apart.
+type DedupPolicy struct {
+	Window  int64   `json:"window" bson:"window"` // seconds
+	Epsilon float64 `json:"epsilon,omitempty" bson:"epsilon,omitempty"`
+}
+
+func (p *DedupPolicy) Validate() error {
+	if p.Window < 0 || p.Window > MaxDedupWindow || p.Epsilon < 0 {
+		return ErrInvalidDedupPolicy
+	}
+	return nil
+}
+
+// Tolerance returns the epsilon values are compared with
+func (p *DedupPolicy) Tolerance() float64 {
+	if p.Epsilon == 0 {
+		return DefaultDedupEpsilon
+	}
+	return p.Epsilon
 }
 
 type Box struct {
-	ID        string      `json:"id" bson:"_id"`
-	Name      string      `json:"name" bson:"name"`
-	Desc      string      `json:"desc" bson:"desc"`
-	GroupID   string      `json:"group_id" bson:"group_id"`
-	SortOrder int         `json:"sort_order" bson:"sort_order"`
-	ZoneID    string      `json:"zone_id" bson:"zone_id"`
-	Location  Location    `json:"location" bson:"location"`
-	DeviceID  string      `json:"device_id" bson:"device_id"`
-	Metrics   []BoxMetric `json:"metrics" bson:"metrics"`
-	Type      *string     `json:"type,omitempty" bson:"type,omitempty"`
-	CTime     int64       `json:"ctime" bson:"ctime"`
-	MTime     int64       `json:"mtime" bson:"mtime"`
-	DTime     *int64      `json:"dtime,omitempty" bson:"dtime,omitempty"`
+	ID        string         `json:"id" bson:"_id"`
+	Name      string         `json:"name" bson:"name"`
+	Desc      string         `json:"desc" bson:"desc"`
+	GroupID   string         `json:"group_id" bson:"group_id"`
+	SortOrder int            `json:"sort_order" bson:"sort_order"`
+	ZoneID    string         `json:"zone_id" bson:"zone_id"`
+	Location  Location       `json:"location" bson:"location"`
+	DeviceID  string         `json:"device_id,omitempty" bson:"device_id"` // admins only
+	Metrics   []BoxMetric    `json:"metrics" bson:"metrics"`
+	Type      *string        `json:"type,omitempty" bson:"type,omitempty"`
+	Merge     *MergePolicy   `json:"merge_policy,omitempty" bson:"merge_policy,omitempty"`
+	Dedup     *DedupPolicy   `json:"dedup_policy,omitempty" bson:"dedup_policy,omitempty"`
+	Anomaly   *AnomalyPolicy `json:"anomaly_policy,omitempty" bson:"anomaly_policy,omitempty"`
+
+	// How often the box is expected to report (seconds), see ExpectedIntervalAt
+	ExpectedIntervalSeconds *int64            `json:"expected_interval_seconds,omitempty" bson:"expected_interval_seconds,omitempty"`
+	Schedule                []ReportingPeriod `json:"reporting_schedule,omitempty" bson:"reporting_schedule,omitempty"`
+
+	// Previous locations, oldest first; see Locations and LocationAt
+	LocationHistory []LocationPeriod `json:"-" bson:"location_history,omitempty"`
+
+	// A decommissioned box stays listed with its history but accepts no records timestamped after DecommissionedAt (seconds)
+	Decommissioned   bool   `json:"decommissioned" bson:"decommissioned,omitempty"`
+	DecommissionedAt *int64 `json:"decommissioned_at,omitempty" bson:"decommissioned_at,omitempty"`
+
+	LatestLog *BoxLog `json:"latest_log,omitempty" bson:"-"` // set on single-box reads
+
+	CTime int64  `json:"ctime" bson:"ctime"`
+	MTime int64  `json:"mtime" bson:"mtime"`
+	DTime *int64 `json:"dtime,omitempty" bson:"dtime,omitempty"`
+}
+
+// LocationPeriod is where a box stood from From to To (seconds). From is nil for the location
+// the box was created with, To is nil for its current location.
+type LocationPeriod struct {
+	Location `bson:",inline"`
+	From     *int64 `json:"from,omitempty" bson:"from,omitempty"`
+	To       *int64 `json:"to,omitempty" bson:"to,omitempty"`
+}
+
+// LocationSince returns when the box was moved to its current location, nil when it never moved
+func (b *Box) LocationSince() *int64 {
+	if len(b.LocationHistory) == 0 {
+		return nil
+	}
+	return b.LocationHistory[len(b.LocationHistory)-1].To
+}
+
+// MoveTo records the current location in the history as valid until at (seconds) and makes
+// location the current one. Nothing is recorded when the location does not change.
+func (b *Box) MoveTo(location Location, at int64) error {
+	if location == b.Location {
+		return nil
+	}
+	since := b.LocationSince()
+	if since != nil && at < *since {
+		return ErrInvalidMoveTime
+	}
+
+	b.LocationHistory = append(b.LocationHistory, LocationPeriod{Location: b.Location, From: since, To: &at})
+	b.Location = location
+	return nil
+}
+
+// Locations returns every location of the box, oldest first, ending with the current one
+func (b *Box) Locations() []LocationPeriod {
+	locations := append([]LocationPeriod{}, b.LocationHistory...)
+	return append(locations, LocationPeriod{Location: b.Location, From: b.LocationSince()})
+}
+
+// LocationAt returns the location the box stood at at timestamp (seconds), for placing
+// historical records on a map
+func (b *Box) LocationAt(timestamp int64) LocationPeriod {
+	for _, period := range b.LocationHistory {
+		if timestamp < *period.To && (period.From == nil || timestamp >= *period.From) {
+			return period
+		}
+	}
+	return LocationPeriod{Location: b.Location, From: b.LocationSince()}
+}
+
+// AcceptsRecordAt reports whether a record with the given timestamp (seconds) may still be stored
+func (b *Box) AcceptsRecordAt(timestamp int64) bool {
+	return b.DecommissionedAt == nil || timestamp <= *b.DecommissionedAt
+}
+
+// ConvertUnits converts the values of metrics the box reports in another unit, in place.
+// The reported value is kept under RawValuePrefix+code when the conversion asks for it.
+func (b *Box) ConvertUnits(record Record) {
+	for _, m := range b.Metrics {
+		if m.Conversion == nil || !record.HasNumber(m.Code) {
+			continue
+		}
+		raw := record.GetFloat(m.Code)
+		if m.Conversion.KeepRaw {
+			record[RawValuePrefix+m.Code] = raw
+		}
+		record[m.Code] = m.Conversion.Apply(raw)
+	}
+}
+
+// RateMetrics returns the codes of the metrics whose rate of change is derived at ingest
+func (b *Box) RateMetrics() []string {
+	var codes []string
+	for _, m := range b.Metrics {
+		if m.Rate {
+			codes = append(codes, m.Code)
+		}
+	}
+	return codes
+}
+
+// ManualMetrics returns the record fields of the box's manually entered metrics
+func (b *Box) ManualMetrics() map[string]bool {
+	manual := make(map[string]bool)
+	for _, m := range b.Metrics {
+		if m.Manual {
+			manual[m.Code] = true
+		}
+	}
+	return manual
 }
 
 type CreateBoxParams struct {
-	Name     string      `json:"name" binding:"required"`
-	GroupID  string      `json:"group_id" binding:"required"`
-	ZoneID   string      `json:"zone_id" binding:"required"`
-	Location Location    `json:"location" binding:"required"`
-	DeviceID string      `json:"device_id" binding:"required"`
-	Metrics  []BoxMetric `json:"metrics" binding:"required"`
-	Desc     string      `json:"desc"`
-	Type     *string     `json:"type"`
+	Name     string         `json:"name" binding:"required"`
+	GroupID  string         `json:"group_id" binding:"required"`
+	ZoneID   string         `json:"zone_id"` // the group's zone when omitted, which it must match
+	Location Location       `json:"location" binding:"required"`
+	DeviceID string         `json:"device_id" binding:"required"`
+	Metrics  []BoxMetric    `json:"metrics" binding:"required"`
+	Desc     string         `json:"desc"`
+	Type     *string        `json:"type"`
+	Merge    *MergePolicy   `json:"merge_policy"`
+	Dedup    *DedupPolicy   `json:"dedup_policy"`
+	Anomaly  *AnomalyPolicy `json:"anomaly_policy"`
+
+	ExpectedIntervalSeconds *int64            `json:"expected_interval_seconds"`
+	Schedule                []ReportingPeriod `json:"reporting_schedule"`
+
+	// AllowUnknownMetrics accepts metrics missing from the catalog, reported as warnings
+	AllowUnknownMetrics bool `json:"-"`
 }
 
 type UpdateBoxParams struct {
-	Name      *string     `json:"name"`
-	Desc      *string     `json:"desc"`
-	Type      *string     `json:"type"`
-	GroupID   *string     `json:"group_id"`
-	SortOrder *int        `json:"sort_order"`
-	Location  *Location   `json:"location"`
-	DeviceID  *string     `json:"device_id"`
-	Metrics   []BoxMetric `json:"metrics"`
+	Name      *string        `json:"name"`
+	Desc      *string        `json:"desc"`
+	Type      *string        `json:"type"`
+	GroupID   *string        `json:"group_id"`
+	SortOrder *int           `json:"sort_order"`
+	Location  *Location      `json:"location"`
+	MovedAt   *int64         `json:"moved_at"` // seconds the new location took effect, now when omitted
+	DeviceID  *string        `json:"device_id"`
+	Metrics   []BoxMetric    `json:"metrics"`
+	Merge     *MergePolicy   `json:"merge_policy"`
+	Dedup     *DedupPolicy   `json:"dedup_policy"`   // a zero window turns deduplication off
+	Anomaly   *AnomalyPolicy `json:"anomaly_policy"` // a zero z_score turns anomaly flagging off
+
+	ExpectedIntervalSeconds *int64            `json:"expected_interval_seconds"` // 0 removes it
+	Schedule                []ReportingPeriod `json:"reporting_schedule"`        // an empty list removes it
+
+	// AllowUnknownMetrics accepts metrics missing from the catalog, reported as warnings
+	AllowUnknownMetrics bool `json:"-"`
 }
 
 type FilterBoxParams struct {
 	GroupID *string `json:"group_id" form:"group_id"`
+
+	// GroupIDs restricts the listing to boxes of these groups when not nil, e.g. to those a monitor may read
+	GroupIDs []string `json:"-" form:"-"`
+
+	// IncludeDeleted also lists soft-deleted boxes, those deleted at or after DeletedSince
+	// (milliseconds) when set. Only ListBoxes reads them, for reports over past data.
+	IncludeDeleted bool  `json:"-" form:"-"`
+	DeletedSince   int64 `json:"-" form:"-"`
 }
 
+// DecommissionBoxParams sets when a box stopped reporting; the current time when omitted
+type DecommissionBoxParams struct {
+	DecommissionedAt *int64 `json:"decommissioned_at"` // seconds
+}
+
+// ViewBox is a group with its boxes, ordered by SortBoxes
 type ViewBox struct {
 	BoxGroup
-	Boxes []Box `json:"boxs" bson:"boxs"`
+	Boxes []Box `json:"boxes" bson:"boxes"`
 	Total *int  `json:"total,omitempty" bson:"total,omitempty"`
+
+	// The health of each camera as of its last check, see GET /groups/{id}/cameras/status
+	CameraStatus []CameraStatus `json:"camera_status,omitempty" bson:"-"`
+
+	// legacyBoxes also serializes Boxes under "boxs", the misspelled key of the unversioned API
+	legacyBoxes bool
+	// withoutMetrics serializes Boxes without their metrics key
+	withoutMetrics bool
+}
+
+// ViewBox fields a client may leave out of GET /groups/{id} with ?exclude=
+const (
+	ViewExcludeNote    = "note"
+	ViewExcludeMetrics = "metrics"
+)
+
+// WithLegacyBoxes returns a copy of the view also listing its boxes under the deprecated "boxs" key
+func (v ViewBox) WithLegacyBoxes() ViewBox {
+	v.legacyBoxes = true
+	return v
+}
+
+// Excluding returns a copy of the view without the group's note and/or the boxes' metrics
+func (v ViewBox) Excluding(fields ...string) ViewBox {
+	for _, field := range fields {
+		switch field {
+		case ViewExcludeNote:
+			v.Note = nil
+		case ViewExcludeMetrics:
+			v.withoutMetrics = true
+		}
+	}
+	return v
+}
+
+// boxWithoutMetrics shadows the metrics of the embedded box, so a nil one is left out
+type boxWithoutMetrics struct {
+	Box
+	Metrics []BoxMetric `json:"metrics,omitempty"`
+}
+
+func (v ViewBox) MarshalJSON() ([]byte, error) {
+	// The conversion drops this method, so the view is not marshaled through it again
+	type view ViewBox
+	if !v.legacyBoxes && !v.withoutMetrics {
+		return json.Marshal(view(v))
+	}
+
+	var boxes interface{} = v.Boxes
+	if v.withoutMetrics && v.Boxes != nil {
+		trimmed := make([]boxWithoutMetrics, len(v.Boxes))
+		for i := range v.Boxes {
+			trimmed[i] = boxWithoutMetrics{Box: v.Boxes[i]}
+		}
+		boxes = trimmed
+	}
+	if !v.legacyBoxes {
+		return json.Marshal(struct {
+			view
+			Boxes interface{} `json:"boxes"`
+		}{view(v), boxes})
+	}
+	return json.Marshal(struct {
+		view
+		Boxes       interface{} `json:"boxes"`
+		LegacyBoxes interface{} `json:"boxs"`
+	}{view(v), boxes, boxes})
+}
+
+// SortBoxes orders boxes by sort_order, then by ID so that boxes sharing a sort_order keep
+// the same order from one response to the next
+func SortBoxes(boxes []Box) {
+	sort.Slice(boxes, func(i, j int) bool {
+		if boxes[i].SortOrder != boxes[j].SortOrder {
+			return boxes[i].SortOrder < boxes[j].SortOrder
+		}
+		return boxes[i].ID < boxes[j].ID
+	})
 }
 
 type Report struct {
@@ -201,15 +743,141 @@ type Report struct {
 	} `json:"info" bson:"info"`
 	Count int     `json:"count" bson:"count"`
 	Total float64 `json:"total" bson:"total"`
+
+	BoxID      string `json:"box_id" bson:"box_id"`
+	BoxDeleted bool   `json:"box_deleted,omitempty" bson:"box_deleted,omitempty"` // the box was deleted since
+}
+
+// MonthlyTotals sums the numeric fields of one box's records over a calendar month (UTC)
+type MonthlyTotals struct {
+	Year   int                `bson:"year"`
+	Month  int                `bson:"month"`
+	Count  int                `bson:"count"`
+	Totals map[string]float64 `bson:"totals"` // only fields with at least one value
+}
+
+// Start returns the first second of the month
+func (m MonthlyTotals) Start() int64 {
+	return time.Date(m.Year, time.Month(m.Month), 1, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// ReportCache keeps the totals of a box's closed months, which only change when records are
+// written into the past. It holds every numeric field, so one entry serves any metric set.
+type ReportCache struct {
+	BoxID   string          `bson:"_id"`
+	Through int64           `bson:"through"` // start of the first month not cached (seconds)
+	Months  []MonthlyTotals `bson:"months"`
+	CTime   int64           `bson:"ctime"`
+}
+
+// ReportCacheStatus tells how much of a report was served from the cache
+type ReportCacheStatus string
+
+const (
+	ReportCacheHit     ReportCacheStatus = "hit"     // every box's closed months were cached
+	ReportCachePartial ReportCacheStatus = "partial" // some boxes were computed from their records
+	ReportCacheMiss    ReportCacheStatus = "miss"
+)
+
+// MaxZoneReportCombinations bounds the metrics times groups a zone report may aggregate
+const MaxZoneReportCombinations = 500
+
+// ReportBoxFailure is a box left out of a report because its records could not be aggregated
+type ReportBoxFailure struct {
+	BoxID string `json:"box_id"`
+	Error string `json:"error"`
+}
+
+// ZoneGroupReport is the report of one group, on its own or within a zone report. Partial is set
+// when some boxes were left out, listed in FailedBoxes; Error is set, and Reports empty, when the
+// group's report could not be computed at all.
+type ZoneGroupReport struct {
+	Reports     []Report           `json:"reports"`
+	Cache       ReportCacheStatus  `json:"cache,omitempty"`
+	Partial     bool               `json:"partial,omitempty"`
+	FailedBoxes []ReportBoxFailure `json:"failed_boxes,omitempty"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// FailedBoxIDs returns the IDs of the boxes left out of the report
+func (r *ZoneGroupReport) FailedBoxIDs() []string {
+	ids := make([]string, len(r.FailedBoxes))
+	for i, failure := range r.FailedBoxes {
+		ids[i] = failure.BoxID
+	}
+	return ids
+}
+
+// ZoneReport holds the reports of the groups of a zone, by group ID
+type ZoneReport struct {
+	ZoneID string                     `json:"zone_id"`
+	Groups map[string]ZoneGroupReport `json:"groups"`
+}
+
+// CombinedCacheStatus tells how much of several reports was served from the cache
+func CombinedCacheStatus(statuses []ReportCacheStatus) ReportCacheStatus {
+	hits, misses := 0, 0
+	for _, status := range statuses {
+		switch status {
+		case ReportCacheHit:
+			hits++
+		case ReportCacheMiss:
+			misses++
+		}
+	}
+	switch {
+	case misses == len(statuses):
+		return ReportCacheMiss
+	case hits == len(statuses):
+		return ReportCacheHit
+	}
+	return ReportCachePartial
+}
+
+// MonthStart returns the first second of the UTC month containing t
+func MonthStart(t time.Time) int64 {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+// MonthlyReports turns monthly totals into one report per month and metric with values, oldest first
+func MonthlyReports(months []MonthlyTotals, metrics []string) []Report {
+	sort.SliceStable(months, func(i, j int) bool { return months[i].Start() < months[j].Start() })
+
+	var reports []Report
+	for _, m := range months {
+		for _, metric := range metrics {
+			total, ok := m.Totals[metric]
+			if !ok {
+				continue
+			}
+			report := Report{Count: m.Count, Total: RoundValue(total)}
+			report.Info.Year = m.Year
+			report.Info.Month = m.Month
+			report.Info.Metric = metric
+			reports = append(reports, report)
+		}
+	}
+	return reports
 }
 
 var (
-	ErrZoneNotFound     = errors.New("zone not found")
-	ErrZoneCodeExisted  = errors.New("zone code existed")
-	ErrBoxNotFound      = errors.New("box not found")
-	ErrBoxDeviceExisted = errors.New("box device existed")
-	ErrBoxGroupNotFound = errors.New("box group not found")
-	ErrBoxGroupExisted  = errors.New("box group existed")
+	ErrZoneNotFound          = errors.New("zone not found")
+	ErrZoneCodeExisted       = errors.New("zone code existed")
+	ErrZoneDetailTooLarge    = errors.New("zone detail too large")
+	ErrBoxNotFound           = errors.New("box not found")
+	ErrBoxDeviceExisted      = errors.New("box device existed")
+	ErrBoxGroupNotFound      = errors.New("box group not found")
+	ErrBoxGroupExisted       = errors.New("box group existed")
+	ErrSubdomainTaken        = errors.New("subdomain already in use")
+	ErrBoxAccessDenied       = errors.New("box access denied")
+	ErrInvalidMergePolicy    = errors.New("invalid merge policy")
+	ErrInvalidDedupPolicy    = errors.New("invalid dedup policy")
+	ErrBoxDecommissioned     = errors.New("box decommissioned")
+	ErrInvalidUnitConversion = errors.New("unit conversion factor must be a nonzero number")
+	ErrInvalidMoveTime       = errors.New("moved_at must not be before the box's last move nor in the future")
+	ErrBoxZoneMismatch       = errors.New("zone_id does not match the zone of the group")
+	ErrTooManyReportGroups   = fmt.Errorf("a zone report covers at most %d metrics times groups, request fewer metrics", MaxZoneReportCombinations)
 )
 
 // NewZone creates a new zone with timestamps
@@ -235,6 +903,7 @@ func NewBoxGroup(params CreateGroupParams) *BoxGroup {
 	now := time.Now().UnixMilli()
 	return &BoxGroup{
 		ID:        lib.Rand.Char(12),
+		Code:      params.Code,
 		Name:      params.Name,
 		ZoneID:    params.ZoneID,
 		Center:    params.Center,
@@ -260,10 +929,51 @@ func NewBox(params CreateBoxParams) *Box {
 		DeviceID:  params.DeviceID,
 		Metrics:   params.Metrics,
 		Type:      params.Type,
+		Merge:     params.Merge,
+		Dedup:     params.Dedup,
+		Anomaly:   params.Anomaly,
 		SortOrder: 0,
 		CTime:     now,
 		MTime:     now,
+
+		ExpectedIntervalSeconds: params.ExpectedIntervalSeconds,
+		Schedule:                params.Schedule,
+	}
+}
+
+// CloneGroup returns a copy of group and its boxes with new IDs and timestamps, named per params.
+// The copy starts unarchived, and boxes keep their configuration but not their location history.
+func CloneGroup(group *BoxGroup, boxes []Box, params CloneGroupParams) (*BoxGroup, []Box) {
+	now := time.Now().UnixMilli()
+
+	clone := *group
+	clone.ID = lib.Rand.Char(12)
+	clone.Name = params.Name
+	clone.Subdomain = params.Subdomain
+	if params.ZoneID != nil {
+		clone.ZoneID = *params.ZoneID
+	}
+	clone.Archived = false
+	clone.CTime = now
+	clone.MTime = now
+
+	suffix := params.DeviceIDSuffix
+	if suffix == "" {
+		suffix = "-copy-" + lib.Rand.Char(6)
+	}
+
+	copies := make([]Box, len(boxes))
+	for i, box := range boxes {
+		box.ID = lib.Rand.Char(12)
+		box.GroupID = clone.ID
+		box.ZoneID = clone.ZoneID
+		box.DeviceID += suffix
+		box.LocationHistory = nil
+		box.CTime = now
+		box.MTime = now
+		copies[i] = box
 	}
+	return &clone, copies
 }
 
 // RoundValue rounds a float to 2 decimal places
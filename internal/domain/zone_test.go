@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+// A detail is measured as the JSON it is sent as, so a string of the limit is over it by its quotes
+func TestValidateZoneDetail(t *testing.T) {
+	tests := []struct {
+		name   string
+		detail interface{}
+		want   error
+	}{
+		{"no detail", nil, nil},
+		{"at the limit", strings.Repeat("x", MaxZoneDetailSize-2), nil},
+		{"over the limit", strings.Repeat("x", MaxZoneDetailSize-1), ErrZoneDetailTooLarge},
+		{"nested over the limit", map[string]interface{}{"html": strings.Repeat("x", MaxZoneDetailSize)}, ErrZoneDetailTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateZoneDetail(tt.detail); err != tt.want {
+				t.Errorf("ValidateZoneDetail = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireGroupAccess refuses with 403 the users who may not read the group in the :id path parameter
+func (h *SensorHandler) RequireGroupAccess(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	if !user.CanAccessGroup(c.Param("id")) {
+		i18n.RespondError(c, http.StatusForbidden, "group access denied")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// RequireBoxAccess refuses with 403 the users who may not read the group of the box in the :id
+// (or legacy :box_id) path parameter
+func (h *SensorHandler) RequireBoxAccess(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	boxID := c.Param("id")
+	if boxID == "" {
+		boxID = c.Param("box_id")
+	}
+	if err := h.service.AuthorizeBox(c.Request.Context(), user, boxID); err != nil {
+		switch err {
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxAccessDenied:
+			i18n.RespondError(c, http.StatusForbidden, "box access denied")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		c.Abort()
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/httputil"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseAlertFilter reads the alert filters from the query string. severity and status take comma
+// separated values. Every invalid parameter is reported in the returned *domain.ValidationError; the
+// map holds the accepted filters for the response envelope.
+func parseAlertFilter(c *gin.Context) (domain.FilterAlertParams, map[string]interface{}, error) {
+	var filter domain.FilterAlertParams
+	filterInfo := map[string]interface{}{}
+	var problems []domain.FieldError
+
+	for _, value := range httputil.QueryList(c, "severity") {
+		severity := domain.AlertSeverity(value)
+		if !severity.Valid() {
+			problems = append(problems, domain.FieldError{Field: "severity", Rule: "oneof", Code: "field_oneof", Params: map[string]string{"values": "info, warning, critical"}})
+			break
+		}
+		filter.Severities = append(filter.Severities, severity)
+	}
+	if len(filter.Severities) > 0 {
+		filterInfo["severity"] = filter.Severities
+	}
+
+	for _, value := range httputil.QueryList(c, "status") {
+		status := domain.AlertStatus(value)
+		if !status.Valid() {
+			problems = append(problems, domain.FieldError{Field: "status", Rule: "oneof", Code: "field_oneof", Params: map[string]string{"values": "open, acknowledged, resolved"}})
+			break
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+	if len(filter.Statuses) > 0 {
+		filterInfo["status"] = filter.Statuses
+	}
+
+	for key, field := range map[string]*string{"zone_id": &filter.ZoneID, "group_id": &filter.GroupID, "box_id": &filter.BoxID, "metric": &filter.Metric} {
+		if value := strings.TrimSpace(c.Query(key)); value != "" {
+			*field = value
+			filterInfo[key] = value
+		}
+	}
+
+	bounds := []struct {
+		key   string
+		bound **int64
+	}{{"time_min", &filter.From}, {"time_max", &filter.To}}
+	for _, b := range bounds {
+		key, bound := b.key, b.bound
+		value := c.Query(key)
+		if value == "" {
+			continue
+		}
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			problems = append(problems, domain.FieldError{Field: key, Rule: "type", Code: "field_type_integer"})
+			continue
+		}
+		*bound = &t
+		filterInfo[key] = t
+	}
+	if filter.From != nil && filter.To != nil && *filter.From > *filter.To {
+		problems = append(problems, domain.FieldError{Field: "time_max", Rule: "gtefield", Code: "field_gte_field", Params: map[string]string{"field": "time_min"}})
+	}
+
+	if len(problems) > 0 {
+		return filter, nil, &domain.ValidationError{Problems: problems}
+	}
+	return filter, filterInfo, nil
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AlertHandler struct {
+	service *service.AlertService
+}
+
+func NewAlertHandler(service *service.AlertService) *AlertHandler {
+	return &AlertHandler{service: service}
+}
+
+// ListAlerts godoc
+// @Summary List alerts, newest first
+// @Description All filters combine. severity and status take comma separated values, e.g. severity=warning,critical.
+// @Description Users other than admins only see alerts of their groups; asking for another group by group_id is denied.
+// @Description Invalid filters are rejected with 400 and the offending parameters in problems.
+// @Tags alerts
+// @Security BearerAuth
+// @Produce json
+// @Param severity query string false "Severities (info, warning, critical)"
+// @Param status query string false "Statuses (open, acknowledged, resolved)"
+// @Param zone_id query string false "Zone ID"
+// @Param group_id query string false "Group ID"
+// @Param box_id query string false "Box ID"
+// @Param metric query string false "Metric code"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /alerts [get]
+func (h *AlertHandler) ListAlerts(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	pagination := domain.ParsePaginationParams(c)
+
+	filter, filterInfo, err := parseAlertFilter(c)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	alerts, total, err := h.service.ListWithPagination(c.Request.Context(), user, pagination, filter)
+	if err != nil {
+		if err == domain.ErrBoxAccessDenied {
+			i18n.RespondError(c, http.StatusForbidden, "group access denied")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(alerts, pagination.Page, pagination.PageSize, total, filterInfo))
+}
+
+// ExportAlerts godoc
+// @Summary Export the filtered alert list as CSV, newest first
+// @Description Takes the filters of GET /alerts and streams every matching alert, for incident reports.
+// @Tags alerts
+// @Security BearerAuth
+// @Produce text/csv
+// @Param severity query string false "Severities (info, warning, critical)"
+// @Param status query string false "Statuses (open, acknowledged, resolved)"
+// @Param zone_id query string false "Zone ID"
+// @Param group_id query string false "Group ID"
+// @Param box_id query string false "Box ID"
+// @Param metric query string false "Metric code"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /alerts/export [get]
+func (h *AlertHandler) ExportAlerts(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	filter, _, err := parseAlertFilter(c)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+	if filter.GroupID != "" && !user.CanAccessGroup(filter.GroupID) {
+		i18n.RespondError(c, http.StatusForbidden, "group access denied")
+		return
+	}
+
+	filename := fmt.Sprintf("alerts_%s_%s.csv", exportRangeLabel(filter.From, "begin"), exportRangeLabel(filter.To, "now"))
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"timestamp", "time", "severity", "status", "zone_id", "group_id", "box_id", "metric", "value", "threshold", "message", "resolved_at"})
+
+	err = h.service.Stream(c.Request.Context(), user, filter, func(alert domain.Alert) error {
+		resolvedAt := ""
+		if alert.ResolvedAt != nil {
+			resolvedAt = time.Unix(*alert.ResolvedAt, 0).Format("2006-01-02 15:04:05")
+		}
+		return w.Write([]string{
+			strconv.FormatInt(alert.Timestamp, 10),
+			time.Unix(alert.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			string(alert.Severity),
+			string(alert.Status),
+			alert.ZoneID,
+			alert.GroupID,
+			alert.BoxID,
+			alert.Metric,
+			formatOptionalFloat(alert.Value),
+			formatOptionalFloat(alert.Threshold),
+			alert.Message,
+			resolvedAt,
+		})
+	})
+	w.Flush()
+
+	// Headers are already sent, so a failure can only cut the stream short
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		log.Printf("Export alerts: %v", err)
+	}
+}
+
+func formatOptionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyHandler struct {
+	service *service.APIKeyService
+}
+
+func NewAPIKeyHandler(service *service.APIKeyService) *APIKeyHandler {
+	return &APIKeyHandler{service: service}
+}
+
+// ListAPIKeys godoc
+// @Summary List the API keys
+// @Description Every key issued, revoked ones included, newest first. Keys themselves are never listed; the hint is their first characters.
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/api-keys [get]
+func (h *APIKeyHandler) ListAPIKeys(c *gin.Context) {
+	keys, err := h.service.List(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": keys})
+}
+
+// CreateAPIKey godoc
+// @Summary Issue an API key
+// @Description A key lets an external integration read the sites and records of the given groups, sending it in the X-Api-Key
+// @Description header instead of signing in. Requests with a key may only read. The key is only returned in this response.
+// @Tags admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param body body domain.CreateAPIKeyParams true "Key name, groups and optional expiry in seconds"
+// @Success 201 {object} domain.CreatedAPIKey
+// @Failure 400 {object} map[string]interface{}
+// @Router /admin/api-keys [post]
+func (h *APIKeyHandler) CreateAPIKey(c *gin.Context) {
+	var params domain.CreateAPIKeyParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	key, err := h.service.Create(c.Request.Context(), params, currentUserID(c))
+	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusCreated, key)
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key
+// @Description Requests with the key are refused from now on. The key stays listed, with its revocation time.
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "API key ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /admin/api-keys/{id} [delete]
+func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
+	if err := h.service.Revoke(c.Request.Context(), c.Param("id")); err != nil {
+		if err == domain.ErrAPIKeyNotFound {
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "api key revoked"})
+}
@@ -7,11 +7,11 @@ import (
 
 	"tp25-api/internal/config"
 	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
 	"tp25-api/internal/middleware"
 	"tp25-api/internal/service"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
 type AuthHandler struct {
@@ -31,50 +31,72 @@ func NewAuthHandler(service *service.UserService, cfg *config.Config) *AuthHandl
 // @Tags auth
 // @Accept json
 // @Produce json
+// @Description Users with two-factor authentication receive {"status": "2fa_required", "challenge_token"} instead of tokens
+// @Description and must call POST /auth/2fa/login.
+// @Description When the user's role has a concurrent session limit, a login over it answers 409, or ends the user's
+// @Description oldest session when SESSION_LIMIT_EVICT is set.
 // @Param request body domain.LoginRequest true "Login credentials"
 // @Success 200 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
 // @Router /auth/login [post]
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req domain.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
-	user, refreshToken, err := h.service.Login(c.Request.Context(), req.Username, req.Password)
+	user, err := h.service.Authenticate(c.Request.Context(), req.Username, req.Password)
 	if err != nil {
 		log.Println("Login error:", err)
 		if err == domain.ErrWrongPassword || err == domain.ErrUsernameNotFound {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+			event := domain.NewSecurityEvent(domain.SecurityLoginFailed)
+			event.Username = req.Username
+			event.Reason = domain.SecurityReasonWrongPassword
+			if err == domain.ErrUsernameNotFound {
+				event.Reason = domain.SecurityReasonUnknownUsername
+			}
+			recordSecurityEvent(c, h.service, event)
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid credentials")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	log.Println("User logged in successfully:", user.ID)
-
-	// Generate JWT access token (1 day)
-	claims := &middleware.Claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	enabled, err := h.service.TwoFactorEnabled(c.Request.Context(), user.ID)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if enabled {
+		challenge, err := h.service.NewTwoFactorChallenge(user)
+		if err != nil {
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":          "2fa_required",
+			"challenge_token": challenge,
+		})
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	accessToken, err := token.SignedString([]byte(h.config.Auth.JWTSecret))
+	refreshToken, err := h.service.IssueRefreshToken(c.Request.Context(), user)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		if err == domain.ErrSessionLimitReached {
+			recordLoginFailure(c, h.service, user, domain.SecurityReasonSessionLimit)
+			i18n.RespondError(c, http.StatusConflict, "too many active sessions, log out on another device first")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"refresh_token": refreshToken,
-		"user":          user,
-	})
+	log.Println("User logged in successfully:", user.ID)
+	recordLogin(c, h.service, user)
+
+	h.respondWithTokens(c, user, refreshToken)
 }
 
 // RefreshToken godoc
@@ -91,39 +113,36 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	user, newRefreshToken, err := h.service.RefreshToken(c.Request.Context(), req.RefreshToken)
 	if err != nil {
 		if err == domain.ErrInvalidRefreshToken {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid refresh token")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Generate new JWT access token (1 day)
-	claims := &middleware.Claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
-	}
+	h.respondWithTokens(c, user, newRefreshToken)
+}
+
+// respondWithTokens generates the JWT access token (1 day) and responds with both tokens
+func (h *AuthHandler) respondWithTokens(c *gin.Context, user *domain.User, refreshToken string) {
+	claims := middleware.NewClaims(user, 24*time.Hour)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	accessToken, err := token.SignedString([]byte(h.config.Auth.JWTSecret))
+	accessToken, err := h.service.SignToken(claims)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		i18n.RespondError(c, http.StatusInternalServerError, "failed to generate token")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"access_token":  accessToken,
-		"refresh_token": newRefreshToken,
+		"refresh_token": refreshToken,
 		"user":          user,
 	})
 }
@@ -137,16 +156,46 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 func (h *AuthHandler) Logout(c *gin.Context) {
 	userVal, exists := c.Get("user")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
 		return
 	}
 	user := userVal.(*domain.User)
 
-	_ = h.service.Logout(c.Request.Context(), user.ID)
+	if err := h.service.Logout(c.Request.Context(), user.ID); err == nil {
+		event := domain.NewSecurityEvent(domain.SecurityTokensRevoked)
+		event.SubjectID = user.ID
+		event.Reason = domain.SecurityReasonLogout
+		recordSecurityEvent(c, h.service, event)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
 }
 
+// ListSessions godoc
+// @Summary List the current user's active sessions
+// @Description One session per login, oldest first; limit is the concurrent sessions allowed for the user's role, 0 for none.
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} domain.UserSessions
+// @Router /auth/sessions [get]
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	userVal, exists := c.Get("user")
+	if !exists {
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
+		return
+	}
+	user := userVal.(*domain.User)
+
+	sessions, err := h.service.Sessions(c.Request.Context(), user)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
 // GetProfile godoc
 // @Summary Get current user info
 // @Tags auth
@@ -160,6 +209,129 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
+// GetPermissions godoc
+// @Summary Get what the current user may see and do
+// @Description Returns the role, the readable groups with their names and the capabilities the server enforces for the role.
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} domain.Permissions
+// @Router /auth/permissions [get]
+func (h *AuthHandler) GetPermissions(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	perms, err := h.service.Permissions(c.Request.Context(), user)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, perms)
+}
+
+// UpdateProfile godoc
+// @Summary Update current user info
+// @Description Only full_name, phone and zalo_id can be changed; role and groups are ignored.
+// @Tags auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body domain.UpdateProfileParams true "Profile data"
+// @Success 200 {object} domain.User
+// @Failure 400 {object} map[string]interface{}
+// @Router /auth/profile [put]
+func (h *AuthHandler) UpdateProfile(c *gin.Context) {
+	userVal, exists := c.Get("user")
+	if !exists {
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
+		return
+	}
+	user := userVal.(*domain.User)
+
+	var params domain.UpdateProfileParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	updated, err := h.service.UpdateProfile(c.Request.Context(), user.ID, params)
+	if err != nil {
+		if err == domain.ErrInvalidPhone {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid phone number")
+			return
+		}
+		if err == domain.ErrUserNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// ForgotPassword godoc
+// @Summary Request a password reset token
+// @Description Sends a single-use reset token over Zalo or SMS. Always responds 200 so accounts cannot be enumerated.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body domain.ForgotPasswordRequest true "Username or phone"
+// @Success 200 {object} map[string]interface{}
+// @Router /auth/forgot [post]
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req domain.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if err := h.service.RequestPasswordReset(c.Request.Context(), req.Login); err != nil {
+		log.Println("Password reset request error:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "if the account exists, a reset code has been sent"})
+}
+
+// ResetPassword godoc
+// @Summary Reset password with a reset token
+// @Description Consumes the token, sets the new password and revokes all refresh tokens of the user.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body domain.ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /auth/reset [post]
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req domain.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	userID, err := h.service.ResetPassword(c.Request.Context(), req.Token, req.NewPassword)
+	if err != nil {
+		if err == domain.ErrInvalidResetToken {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid or expired reset token")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, eventType := range []domain.SecurityEventType{domain.SecurityPasswordChanged, domain.SecurityTokensRevoked} {
+		event := domain.NewSecurityEvent(eventType)
+		event.SubjectID = userID
+		event.Reason = domain.SecurityReasonResetToken
+		recordSecurityEvent(c, h.service, event)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password reset successfully"})
+}
+
 // SetPassword godoc
 // @Summary Set user password
 // @Tags auth
@@ -172,7 +344,7 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 func (h *AuthHandler) SetPassword(c *gin.Context) {
 	userVal, exists := c.Get("user")
 	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
 		return
 	}
 	user := userVal.(*domain.User)
@@ -182,14 +354,173 @@ func (h *AuthHandler) SetPassword(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	if err := h.service.SetPassword(c.Request.Context(), user.ID, req.Password); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	event := domain.NewSecurityEvent(domain.SecurityPasswordChanged)
+	event.SubjectID = user.ID
+	event.Reason = domain.SecurityReasonSelf
+	recordSecurityEvent(c, h.service, event)
+
 	c.JSON(http.StatusOK, gin.H{"message": "password set successfully"})
 }
+
+// SetupTwoFactor godoc
+// @Summary Start two-factor enrollment
+// @Description Returns a TOTP secret and otpauth URL for an authenticator app. Two-factor authentication is enabled by POST /auth/2fa/verify.
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} domain.TwoFactorSetup
+// @Failure 409 {object} map[string]interface{}
+// @Router /auth/2fa/setup [post]
+func (h *AuthHandler) SetupTwoFactor(c *gin.Context) {
+	userVal, exists := c.Get("user")
+	if !exists {
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
+		return
+	}
+	user := userVal.(*domain.User)
+
+	setup, err := h.service.SetupTwoFactor(c.Request.Context(), user)
+	if err != nil {
+		if err == domain.ErrTwoFactorEnabled {
+			i18n.RespondError(c, http.StatusConflict, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, setup)
+}
+
+// VerifyTwoFactor godoc
+// @Summary Activate two-factor authentication
+// @Description Checks the first code from the authenticator app and returns single-use backup codes, which are not shown again.
+// @Tags auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body domain.TwoFactorCodeRequest true "TOTP code"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /auth/2fa/verify [post]
+func (h *AuthHandler) VerifyTwoFactor(c *gin.Context) {
+	userVal, exists := c.Get("user")
+	if !exists {
+		i18n.RespondError(c, http.StatusUnauthorized, "user not authenticated")
+		return
+	}
+	user := userVal.(*domain.User)
+
+	var req domain.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	backupCodes, err := h.service.ActivateTwoFactor(c.Request.Context(), user.ID, req.Code)
+	if err != nil {
+		if err == domain.ErrTwoFactorNotSetup || err == domain.ErrInvalidTwoFactorCode {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event := domain.NewSecurityEvent(domain.SecurityTwoFactorEnabled)
+	event.SubjectID = user.ID
+	recordSecurityEvent(c, h.service, event)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "two-factor authentication enabled",
+		"backup_codes": backupCodes,
+	})
+}
+
+// TwoFactorLogin godoc
+// @Summary Complete a login with a two-factor code
+// @Description A challenge accepts 5 codes, a user 10 within 15 minutes; past that the login answers 429.
+// @Description A TOTP code is accepted once, and never after a newer one.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body domain.TwoFactorLoginRequest true "Challenge token and TOTP or backup code"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 429 {object} map[string]interface{}
+// @Router /auth/2fa/login [post]
+func (h *AuthHandler) TwoFactorLogin(c *gin.Context) {
+	var req domain.TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	user, refreshToken, err := h.service.CompleteTwoFactorLogin(c.Request.Context(), req.ChallengeToken, req.Code)
+	if err != nil {
+		log.Println("2FA login error:", err)
+		if err == domain.ErrInvalidTwoFactorCode {
+			recordLoginFailure(c, h.service, user, domain.SecurityReasonTwoFactorCode)
+		}
+		if err == domain.ErrTwoFactorLocked {
+			recordLoginFailure(c, h.service, user, domain.SecurityReasonTwoFactorLocked)
+			i18n.RespondError(c, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if err == domain.ErrInvalidChallenge || err == domain.ErrInvalidTwoFactorCode || err == domain.ErrUserNotFound {
+			i18n.RespondError(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err == domain.ErrSessionLimitReached {
+			recordLoginFailure(c, h.service, user, domain.SecurityReasonSessionLimit)
+			i18n.RespondError(c, http.StatusConflict, "too many active sessions, log out on another device first")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Println("User logged in successfully:", user.ID)
+	recordLogin(c, h.service, user)
+
+	h.respondWithTokens(c, user, refreshToken)
+}
+
+// recordSecurityEvent stores event with the origin of the request; the signed-in user, if any, is the actor
+func recordSecurityEvent(c *gin.Context, users *service.UserService, event *domain.SecurityEvent) {
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	if userVal, exists := c.Get("user"); exists && event.ActorID == "" {
+		event.ActorID = userVal.(*domain.User).ID
+	}
+	users.RecordSecurityEvent(c.Request.Context(), event)
+}
+
+func recordLogin(c *gin.Context, users *service.UserService, user *domain.User) {
+	event := domain.NewSecurityEvent(domain.SecurityLoginSucceeded)
+	event.ActorID = user.ID
+	event.SubjectID = user.ID
+	event.Username = user.Username
+	recordSecurityEvent(c, users, event)
+}
+
+// recordLoginFailure records a login that failed after the password step; user may be nil
+func recordLoginFailure(c *gin.Context, users *service.UserService, user *domain.User, reason string) {
+	event := domain.NewSecurityEvent(domain.SecurityLoginFailed)
+	event.Reason = reason
+	if user != nil {
+		event.SubjectID = user.ID
+		event.Username = user.Username
+	}
+	recordSecurityEvent(c, users, event)
+}
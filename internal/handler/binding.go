@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	validator "github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report validation errors with the names clients send rather than the Go field names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(requestFieldName)
+	}
+}
+
+func requestFieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "form"} {
+		name := strings.Split(field.Tag.Get(tag), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// respondBindingError answers 400 to a request whose body or query could not be bound, listing
+// the offending fields under "problems" when the error names them
+func respondBindingError(c *gin.Context, err error) {
+	problems := bindingProblems(err)
+	if len(problems) == 0 {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	body := i18n.Envelope(c, http.StatusBadRequest, "invalid request")
+	body["problems"] = localizeProblems(c, problems)
+	c.JSON(http.StatusBadRequest, body)
+}
+
+// respondValidationError answers 400 with the offending fields when err is a *domain.ValidationError,
+// in the same shape as binding errors, and reports whether it did
+func respondValidationError(c *gin.Context, err error) bool {
+	verr, ok := err.(*domain.ValidationError)
+	if !ok {
+		return false
+	}
+	body := i18n.Envelope(c, http.StatusBadRequest, "invalid request")
+	body["problems"] = localizeProblems(c, verr.Problems)
+	c.JSON(http.StatusBadRequest, body)
+	return true
+}
+
+// respondWithWarnings answers body, adding the warnings the request was accepted despite under
+// "warnings" when there are any. A body that is not a JSON object is answered under "data".
+func respondWithWarnings(c *gin.Context, status int, body interface{}, warnings domain.Warnings) {
+	if len(warnings) == 0 {
+		c.JSON(status, body)
+		return
+	}
+	warnings = localizeProblems(c, warnings)
+	raw, err := json.Marshal(body)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+		c.JSON(status, gin.H{"data": json.RawMessage(raw), "warnings": warnings})
+		return
+	}
+	encoded, err := json.Marshal(warnings)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	fields["warnings"] = encoded
+	c.JSON(status, fields)
+}
+
+func bindingProblems(err error) []domain.FieldError {
+	switch e := err.(type) {
+	case validator.ValidationErrors:
+		problems := make([]domain.FieldError, len(e))
+		for i, fe := range e {
+			code, params := validationCode(fe)
+			problems[i] = domain.FieldError{
+				Field:  validationField(fe.Namespace()),
+				Rule:   fe.Tag(),
+				Code:   code,
+				Params: params,
+			}
+		}
+		return problems
+	case *json.UnmarshalTypeError:
+		return []domain.FieldError{{
+			Field: e.Field,
+			Rule:  "type",
+			Code:  jsonTypeCode(e.Type),
+		}}
+	}
+	return nil
+}
+
+// localizeProblems sets the message of each problem in the language of the request
+func localizeProblems(c *gin.Context, problems []domain.FieldError) []domain.FieldError {
+	lang := i18n.Locale(c)
+	for i := range problems {
+		problems[i].Message = i18n.Format(lang, problems[i].Code, problems[i].Params)
+	}
+	return problems
+}
+
+// validationField drops the name of the bound struct from a namespace such as CreateBoxParams.location.lat
+func validationField(namespace string) string {
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}
+
+// validationCode returns the catalog code and parameters of the message for a failed validation.
+// Lengths of strings and of lists are worded apart from bounds on numbers.
+func validationCode(fe validator.FieldError) (string, map[string]string) {
+	unit := ""
+	switch fe.Kind() {
+	case reflect.String:
+		unit = "_length"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		unit = "_items"
+	}
+
+	switch fe.Tag() {
+	case "required":
+		return "field_required", nil
+	case "min", "gte":
+		return "field_min" + unit, map[string]string{"min": fe.Param()}
+	case "max", "lte":
+		return "field_max" + unit, map[string]string{"max": fe.Param()}
+	case "oneof":
+		return "field_oneof", map[string]string{"values": strings.Join(strings.Fields(fe.Param()), ", ")}
+	}
+	return "field_invalid", nil
+}
+
+// jsonTypeCode returns the catalog code of the message naming the JSON type a field expects
+func jsonTypeCode(t reflect.Type) string {
+	if t == nil {
+		return "field_type_valid"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonTypeCode(t.Elem())
+	case reflect.String:
+		return "field_type_string"
+	case reflect.Bool:
+		return "field_type_boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "field_type_integer"
+	case reflect.Float32, reflect.Float64:
+		return "field_type_number"
+	case reflect.Slice, reflect.Array:
+		return "field_type_array"
+	case reflect.Map, reflect.Struct:
+		return "field_type_object"
+	}
+	return "field_type_valid"
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tp25-api/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+type bindingTestParams struct {
+	Name  string   `json:"name" binding:"required,min=3"`
+	Zoom  int      `json:"zoom" binding:"max=16"`
+	Kind  string   `json:"kind" binding:"omitempty,oneof=river lake"`
+	Tags  []string `json:"tags" binding:"max=2"`
+	Count int      `json:"count"`
+}
+
+// Field problems are answered in the language of the request, with the same codes
+func TestBindingProblemsFollowTheRequestLanguage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/", func(c *gin.Context) {
+		var params bindingTestParams
+		if err := c.ShouldBindJSON(&params); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		body     string
+		language string
+		want     map[string]string // field -> message
+	}{
+		{
+			name:     "validation in en",
+			body:     `{"name":"ab","zoom":20,"kind":"sea","tags":["a","b","c"]}`,
+			language: "en",
+			want: map[string]string{
+				"name": "Must have at least 3 characters",
+				"zoom": "Must be less than or equal to 16",
+				"kind": "Must be one of: river, lake",
+				"tags": "Must not exceed 2 items",
+			},
+		},
+		{
+			name:     "validation in vi",
+			body:     `{"zoom":1}`,
+			language: "vi",
+			want:     map[string]string{"name": "Trường này là bắt buộc"},
+		},
+		{
+			name:     "type in en",
+			body:     `{"name":"abc","count":"many"}`,
+			language: "en",
+			want:     map[string]string{"count": "Must be an integer"},
+		},
+		{
+			name:     "type in vi",
+			body:     `{"name":"abc","count":"many"}`,
+			language: "vi",
+			want:     map[string]string{"count": "Phải là số nguyên"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept-Language", tt.language)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+
+			var body struct {
+				Problems []struct {
+					Field   string `json:"field"`
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"problems"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, problem := range body.Problems {
+				if !strings.HasPrefix(problem.Code, "field_") {
+					t.Errorf("%s has code %q", problem.Field, problem.Code)
+				}
+				got[problem.Field] = problem.Message
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("problems %v, want %v", got, tt.want)
+			}
+			for field, want := range tt.want {
+				if got[field] != want {
+					t.Errorf("%s = %q, want %q", field, got[field], want)
+				}
+			}
+		})
+	}
+}
+
+// Every handler answers a body it cannot bind with the fields at fault, by their JSON path, before
+// reaching its service
+func TestHandlersAnswerFieldProblems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		handle gin.HandlerFunc
+		body   string
+		want   map[string]string // field -> rule
+	}{
+		{"login", (&AuthHandler{}).Login, `{"username":"admin"}`, map[string]string{"password": "required"}},
+		{"create box log", (&BoxLogHandler{}).CreateBoxLog, `{"category":"repair"}`, map[string]string{"text": "required"}},
+		{"create maintenance window", (&MaintenanceHandler{}).CreateMaintenance, `{"start":1,"end":"tomorrow"}`, map[string]string{"end": "type"}},
+		{"resolve", (&ResolveHandler{}).Resolve, `{"boxes":"b1"}`, map[string]string{"boxes": "type"}},
+		{"create metric", (&SensorHandler{}).CreateMetric, `{"code":"WAU","name":"Water level","unit":"m","precision":9}`, map[string]string{"precision": "max"}},
+		{"create setting", (&SettingHandler{}).CreateSetting, `{"key":"map.zoom"}`, map[string]string{"value": "required"}},
+		{"create user", (&UserHandler{}).CreateUser, `{"username":"a","full_name":"A","role":"owner"}`, map[string]string{"role": "oneof"}},
+		{"create zone", (&ZoneHandler{}).CreateZone, `{"code":"Z1"}`, map[string]string{"name": "required"}},
+		{"update group", (&ZoneHandler{}).UpdateGroup, `{"zoom":20}`, map[string]string{"zoom": "max"}},
+		{"create box", (&ZoneHandler{}).CreateBox, `{"name":"Box","group_id":"g1","device_id":"d1","metrics":[],"location":{"lat":"north"}}`, map[string]string{"location.lat": "type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			c.Params = gin.Params{{Key: "id", Value: "routetest"}}
+			c.Set("user", &domain.User{ID: "u1", Role: domain.RoleAdmin})
+
+			tt.handle(c)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+			}
+			var body struct {
+				Problems []domain.FieldError `json:"problems"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, problem := range body.Problems {
+				if problem.Message == "" {
+					t.Errorf("%s has no message", problem.Field)
+				}
+				got[problem.Field] = problem.Rule
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("problems %v, want %v", got, tt.want)
+			}
+			for field, rule := range tt.want {
+				if got[field] != rule {
+					t.Errorf("%s failed %q, want %q", field, got[field], rule)
+				}
+			}
+		})
+	}
+}
+
+// Filters of alerts are rejected in English for English clients
+func TestAlertFilterProblemsInEnglish(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/?severity=loud&time_min=20&time_max=10", nil)
+	c.Request.Header.Set("Accept-Language", "en")
+
+	_, _, err := parseAlertFilter(c)
+	if err == nil {
+		t.Fatal("filter accepted")
+	}
+	if !respondValidationError(c, err) {
+		t.Fatalf("%v is not a validation error", err)
+	}
+	for _, want := range []string{"Must be one of: info, warning, critical", "Must be greater than or equal to time_min"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("body %s, want %q", w.Body, want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BoxLogHandler struct {
+	service *service.BoxLogService
+}
+
+func NewBoxLogHandler(service *service.BoxLogService) *BoxLogHandler {
+	return &BoxLogHandler{service: service}
+}
+
+// ListBoxLogs godoc
+// @Summary List the notes recorded against a box, newest first
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/logs [get]
+func (h *BoxLogHandler) ListBoxLogs(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	pagination := domain.ParsePaginationParams(c)
+
+	filter := domain.FilterBoxLogParams{BoxID: c.Param("id")}
+	filterInfo := map[string]interface{}{}
+	if timeMin := c.Query("time_min"); timeMin != "" {
+		t, err := strconv.ParseInt(timeMin, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_min")
+			return
+		}
+		filter.From = &t
+		filterInfo["time_min"] = t
+	}
+	if timeMax := c.Query("time_max"); timeMax != "" {
+		t, err := strconv.ParseInt(timeMax, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_max")
+			return
+		}
+		filter.To = &t
+		filterInfo["time_max"] = t
+	}
+
+	logs, total, err := h.service.ListWithPagination(c.Request.Context(), user, pagination, filter)
+	if err != nil {
+		switch err {
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxAccessDenied:
+			i18n.RespondError(c, http.StatusForbidden, "box access denied")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(logs, pagination.Page, pagination.PageSize, total, filterInfo))
+}
+
+// CreateBoxLog godoc
+// @Summary Record a note against a box
+// @Description The author is the authenticated user. Logs cannot be changed afterwards except by admins.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param request body domain.CreateBoxLogParams true "Log entry"
+// @Success 201 {object} domain.BoxLog
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/logs [post]
+func (h *BoxLogHandler) CreateBoxLog(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	var params domain.CreateBoxLogParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	log, err := h.service.Create(c.Request.Context(), user, c.Param("id"), params)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidBoxLog:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxAccessDenied:
+			i18n.RespondError(c, http.StatusForbidden, "box access denied")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, log)
+}
+
+// UpdateBoxLog godoc
+// @Summary Correct a box log
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param log_id path string true "Log ID"
+// @Param request body domain.UpdateBoxLogParams true "Update data"
+// @Success 200 {object} domain.BoxLog
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/logs/{log_id} [put]
+func (h *BoxLogHandler) UpdateBoxLog(c *gin.Context) {
+	var params domain.UpdateBoxLogParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	log, err := h.service.Update(c.Request.Context(), c.Param("id"), c.Param("log_id"), params)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidBoxLog:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxLogNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box log not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, log)
+}
+
+// DeleteBoxLog godoc
+// @Summary Delete a box log (soft delete)
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param log_id path string true "Log ID"
+// @Success 200 {object} domain.BoxLog
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/logs/{log_id} [delete]
+func (h *BoxLogHandler) DeleteBoxLog(c *gin.Context) {
+	log, err := h.service.Delete(c.Request.Context(), c.Param("id"), c.Param("log_id"))
+	if err != nil {
+		if err == domain.ErrBoxLogNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box log not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, log)
+}
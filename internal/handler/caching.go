@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyCaching is how long record history of a closed period may be cached
+type historyCaching struct {
+	closedAfter int64 // seconds time_max must be in the past for the period to count as closed
+	maxAge      int64 // seconds, 0 disables caching
+}
+
+// SetHistoryCaching lets responses for time ranges ending more than closedAfter ago be cached for maxAge
+func (h *SensorHandler) SetHistoryCaching(closedAfter, maxAge time.Duration) {
+	h.caching = historyCaching{closedAfter: int64(closedAfter.Seconds()), maxAge: int64(maxAge.Seconds())}
+}
+
+// setHistoryCaching sets the Cache-Control of a record history response. Records of a closed
+// period do not change short of a recompute or a late import, so they may be cached: privately
+// when the request was authenticated, by shared caches too otherwise. Other ranges are no-cache.
+func (h *SensorHandler) setHistoryCaching(c *gin.Context, query *domain.QueryRecord) {
+	if h.caching.maxAge <= 0 || query.TimeMax == nil || *query.TimeMax > time.Now().Unix()-h.caching.closedAfter {
+		c.Header("Cache-Control", "no-cache")
+		return
+	}
+
+	scope := "public"
+	if _, ok := c.Get("user"); ok {
+		scope = "private"
+	}
+	c.Header("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, h.caching.maxAge))
+}
+
+// respondWithETag answers body as JSON with an ETag hashed from it, or 304 when the request's
+// If-None-Match already names it. For rarely changing payloads clients refetch often: they are
+// still built on every request, but not sent again.
+func respondWithETag(c *gin.Context, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusOK, body)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	for _, candidate := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == etag || candidate == "W/"+etag || candidate == "*" {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
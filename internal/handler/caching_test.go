@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Record history may be cached once its range ended more than a day ago, privately for signed in
+// users, and never before
+func TestSetHistoryCaching(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	now := time.Now().Unix()
+	past, recent := now-2*24*3600, now-3600
+
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		timeMax *int64
+		user    bool
+		want    string
+	}{
+		{"closed period signed in", time.Hour, &past, true, "private, max-age=3600"},
+		{"closed period anonymous", time.Hour, &past, false, "public, max-age=3600"},
+		{"current period", time.Hour, &recent, true, "no-cache"},
+		{"open range", time.Hour, nil, true, "no-cache"},
+		{"caching disabled", 0, &past, true, "no-cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &SensorHandler{}
+			h.SetHistoryCaching(24*time.Hour, tt.maxAge)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.user {
+				c.Set("user", &domain.User{ID: "u1", Role: domain.RoleMonitor})
+			}
+
+			h.setHistoryCaching(c, &domain.QueryRecord{TimeMax: tt.timeMax})
+			if got := w.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CalibrationHandler struct {
+	service *service.CalibrationService
+}
+
+func NewCalibrationHandler(service *service.CalibrationService) *CalibrationHandler {
+	return &CalibrationHandler{service: service}
+}
+
+// ListCalibrations godoc
+// @Summary List the calibrations of a box, by metric and effect time
+// @Description Each calibration corrects a metric from effective_from until the next one of the same metric:
+// @Description corrected = raw * scale + offset. Stored records keep their raw values; record lists, exports and
+// @Description reports apply the corrections when asked with apply_calibration=true.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/calibrations [get]
+func (h *CalibrationHandler) ListCalibrations(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	calibrations, err := h.service.List(c.Request.Context(), user, c.Param("id"))
+	if err != nil {
+		switch err {
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxAccessDenied:
+			i18n.RespondError(c, http.StatusForbidden, "box access denied")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": calibrations})
+}
+
+// CreateCalibration godoc
+// @Summary Add a calibration to a box metric
+// @Description scale defaults to 1. End a correction by adding one with scale 1 and offset 0.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param request body domain.CreateCalibrationParams true "Calibration"
+// @Success 201 {object} domain.Calibration
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /boxes/{id}/calibrations [post]
+func (h *CalibrationHandler) CreateCalibration(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	var params domain.CreateCalibrationParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	calibration, err := h.service.Create(c.Request.Context(), user, c.Param("id"), params)
+	if err != nil {
+		respondCalibrationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, calibration)
+}
+
+// UpdateCalibration godoc
+// @Summary Correct a calibration
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param calibration_id path string true "Calibration ID"
+// @Param request body domain.UpdateCalibrationParams true "Update data"
+// @Success 200 {object} domain.Calibration
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /boxes/{id}/calibrations/{calibration_id} [put]
+func (h *CalibrationHandler) UpdateCalibration(c *gin.Context) {
+	var params domain.UpdateCalibrationParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	calibration, err := h.service.Update(c.Request.Context(), c.Param("id"), c.Param("calibration_id"), params)
+	if err != nil {
+		respondCalibrationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, calibration)
+}
+
+// DeleteCalibration godoc
+// @Summary Delete a calibration (soft delete)
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param calibration_id path string true "Calibration ID"
+// @Success 200 {object} domain.Calibration
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/calibrations/{calibration_id} [delete]
+func (h *CalibrationHandler) DeleteCalibration(c *gin.Context) {
+	calibration, err := h.service.Delete(c.Request.Context(), c.Param("id"), c.Param("calibration_id"))
+	if err != nil {
+		respondCalibrationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, calibration)
+}
+
+func respondCalibrationError(c *gin.Context, err error) {
+	switch err {
+	case domain.ErrInvalidCalibration, domain.ErrCalibrationMetric:
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+	case domain.ErrCalibrationExists:
+		i18n.RespondError(c, http.StatusConflict, err.Error())
+	case domain.ErrCalibrationNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "calibration not found")
+	case domain.ErrBoxNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "box not found")
+	case domain.ErrBoxAccessDenied:
+		i18n.RespondError(c, http.StatusForbidden, "box access denied")
+	default:
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+	"tp25-api/lib/database"
+	"tp25-api/lib/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DebugHandler struct {
+	db            *database.MongoDB
+	sensorService *service.SensorService
+	userService   *service.UserService
+}
+
+func NewDebugHandler(db *database.MongoDB, sensorService *service.SensorService, userService *service.UserService) *DebugHandler {
+	return &DebugHandler{db: db, sensorService: sensorService, userService: userService}
+}
+
+// Pprof serves the net/http/pprof handlers mounted under /debug/pprof
+func (h *DebugHandler) Pprof(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index also serves named profiles such as /debug/pprof/heap
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// Stats returns goroutine count, heap statistics, Mongo connection pool, ingestion queue and session counters
+func (h *DebugHandler) Stats(c *gin.Context) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	sessions, err := h.userService.SessionStats(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"goroutines": runtime.NumGoroutine(),
+		"heap": gin.H{
+			"alloc":       mem.HeapAlloc,
+			"sys":         mem.HeapSys,
+			"idle":        mem.HeapIdle,
+			"in_use":      mem.HeapInuse,
+			"objects":     mem.HeapObjects,
+			"total_alloc": mem.TotalAlloc,
+			"num_gc":      mem.NumGC,
+		},
+		"mongo_pool": h.db.PoolStats(),
+		"ingest":     h.sensorService.IngestStats(),
+		"sessions":   sessions,
+	})
+}
+
+// Metrics serves the ingestion metrics in the Prometheus text format
+func (h *DebugHandler) Metrics(c *gin.Context) {
+	c.Header("Content-Type", metrics.ContentType)
+	c.Status(http.StatusOK)
+	if err := h.sensorService.WriteMetrics(c.Writer); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// excelDateTimeFormat shows Excel datetimes the way exports wrote times as text before
+const excelDateTimeFormat = "yyyy-mm-dd hh:mm:ss"
+
+// excelNumberStyles creates the number format styles of a workbook, once per format. Formats only
+// fix the digits; Excel shows the date order and decimal separator of the reader's locale.
+type excelNumberStyles struct {
+	file     *excelize.File
+	byFormat map[string]int
+}
+
+func newExcelNumberStyles(f *excelize.File) *excelNumberStyles {
+	return &excelNumberStyles{file: f, byFormat: map[string]int{}}
+}
+
+// dateTime returns the style of datetime cells, whose value is a time.Time
+func (s *excelNumberStyles) dateTime() (int, error) {
+	return s.style(excelDateTimeFormat)
+}
+
+// decimals returns the style of numbers shown with the given number of decimals
+func (s *excelNumberStyles) decimals(n int) (int, error) {
+	format := "0"
+	if n > 0 {
+		format += "." + strings.Repeat("0", n)
+	}
+	return s.style(format)
+}
+
+func (s *excelNumberStyles) style(format string) (int, error) {
+	if id, ok := s.byFormat[format]; ok {
+		return id, nil
+	}
+	id, err := s.file.NewStyle(&excelize.Style{CustomNumFmt: &format})
+	if err != nil {
+		return 0, err
+	}
+	s.byFormat[format] = id
+	return id, nil
+}
+
+// writeRecordsSheet writes the Records sheet of a box export: a header row in headerStyle, then a row
+// per record with its number, its time as an Excel datetime and its values, each shown with the
+// decimals of its metric. Values a faulty logger sent as text are highlighted and counted below.
+func writeRecordsSheet(f *excelize.File, sheet string, records []domain.Record, layout []domain.MetricLayout, numbers *excelNumberStyles, headerStyle int) error {
+	headers := []string{"STT", "Time"}
+	metricKeys := []string{}
+
+	if len(records) > 0 {
+		metricKeys = domain.OrderMetricCodes(records[0].ValueFields(), layout)
+		headers = append(headers, metricKeys...)
+	}
+
+	// Column styles go first, as setting them restyles written cells
+	dateTimeStyle, err := numbers.dateTime()
+	if err != nil {
+		return err
+	}
+	f.SetColStyle(sheet, "B", dateTimeStyle)
+	precision := make(map[string]int, len(layout))
+	for _, m := range layout {
+		precision[m.Code] = m.Precision
+	}
+	for i, key := range metricKeys {
+		decimals, ok := precision[key]
+		if !ok {
+			decimals = domain.DefaultMetricPrecision
+		}
+		style, err := numbers.decimals(decimals)
+		if err != nil {
+			return err
+		}
+		col, _ := excelize.ColumnNumberToName(i + 3)
+		f.SetColStyle(sheet, col, style)
+	}
+
+	for i, header := range headers {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheet, cell, header)
+	}
+	f.SetRowStyle(sheet, 1, 1, headerStyle)
+
+	warningStyle, _ := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Color: "9C5700"},
+		Fill: excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{"FFEB9C"}},
+	})
+	nonNumeric := 0
+
+	// Set column widths
+	f.SetColWidth(sheet, "A", "A", 6)  // STT
+	f.SetColWidth(sheet, "B", "B", 20) // Time
+	if len(metricKeys) > 0 {
+		lastCol, _ := excelize.ColumnNumberToName(len(metricKeys) + 2)
+		f.SetColWidth(sheet, "C", lastCol, 12) // Metric columns
+	}
+
+	for rowIdx, record := range records {
+		row := rowIdx + 2
+
+		// STT
+		cellSTT, _ := excelize.CoordinatesToCellName(1, row)
+		f.SetCellValue(sheet, cellSTT, rowIdx+1)
+
+		// Time - check if timestamp is in seconds or milliseconds
+		timestamp := record.GetTimestamp()
+		if timestamp > 1e12 {
+			timestamp = timestamp / 1000
+		}
+		cellTime, _ := excelize.CoordinatesToCellName(2, row)
+		f.SetCellValue(sheet, cellTime, time.Unix(timestamp, 0))
+
+		for colIdx, key := range metricKeys {
+			cell, _ := excelize.CoordinatesToCellName(colIdx+3, row)
+			// Values a faulty logger sent as text are written as is rather than as 0
+			if value, ok := record[key]; ok && value != nil && !record.HasNumber(key) {
+				f.SetCellValue(sheet, cell, fmt.Sprint(value))
+				f.SetCellStyle(sheet, cell, cell, warningStyle)
+				nonNumeric++
+				continue
+			}
+			f.SetCellValue(sheet, cell, record.GetFloat(key))
+		}
+	}
+
+	if nonNumeric > 0 {
+		row := len(records) + 3
+		label, _ := excelize.CoordinatesToCellName(1, row)
+		count, _ := excelize.CoordinatesToCellName(3, row)
+		f.SetCellValue(sheet, label, "Non-numeric values")
+		f.SetCellValue(sheet, count, nonNumeric)
+		f.SetCellStyle(sheet, label, count, warningStyle)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// The Records sheet of a box export, read back as a client would: times are datetimes and values
+// numbers, shown with the decimals of their metric
+func TestWriteRecordsSheetReadBack(t *testing.T) {
+	at := time.Date(2024, 1, 12, 8, 30, 0, 0, time.Local)
+	records := []domain.Record{
+		{"_id": at.Unix(), "WAU": 1.5, "DR": 2.0, "Q": 0.123456},
+		{"_id": at.Add(10 * time.Minute).UnixMilli() /* milliseconds */, "WAU": "err", "DR": int32(3), "Q": 0.1},
+	}
+	layout := []domain.MetricLayout{
+		{Code: "WAU", SortOrder: 1, Precision: 3},
+		{Code: "DR", SortOrder: 2, Precision: 0},
+		// Q has no layout, so it gets the default precision
+	}
+
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", "Records")
+	header, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err := writeRecordsSheet(f, "Records", records, layout, newExcelNumberStyles(f), header); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := excelize.OpenReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer book.Close()
+
+	rows, err := book.GetRows("Records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"STT", "Time", "WAU", "DR", "Q"},
+		{"1", "2024-01-12 08:30:00", "1.500", "2", "0.12"},
+		{"2", "2024-01-12 08:40:00", "err", "3", "0.10"},
+		nil,
+		{"Non-numeric values", "", "1"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d: %q", len(rows), len(want), rows)
+	}
+	for i := range want {
+		if !equalRow(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i+1, rows[i], want[i])
+		}
+	}
+
+	// Shown values are formats over numbers, not text
+	for _, cell := range []string{"B2", "C2", "E2"} {
+		got, err := book.GetCellType("Records", cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == excelize.CellTypeSharedString || got == excelize.CellTypeInlineString {
+			t.Errorf("%s holds text", cell)
+		}
+	}
+	raw, err := book.GetCellValue("Records", "E2", excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw != "0.123456" {
+		t.Errorf("E2 holds %s, want the full value 0.123456", raw)
+	}
+	raw, err = book.GetCellValue("Records", "B2", excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Excel serial dates count days from 1899-12-30
+	serial, err := strconv.ParseFloat(raw, 64)
+	wantSerial := 45303 + (8*60+30)/1440.0
+	if err != nil || math.Abs(serial-wantSerial) > 1e-6 {
+		t.Errorf("B2 holds %s, want the serial date %v", raw, wantSerial)
+	}
+}
+
+func equalRow(got, want []string) bool {
+	// GetRows drops trailing empty cells
+	for len(want) > 0 && want[len(want)-1] == "" {
+		want = want[:len(want)-1]
+	}
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
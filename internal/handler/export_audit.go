@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"log"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetExportAudit records every record export as a security event through users
+func (h *SensorHandler) SetExportAudit(users *service.UserService) {
+	h.users = users
+}
+
+// auditBoxExport records an export of the records of a box, looking up its group
+func (h *SensorHandler) auditBoxExport(c *gin.Context, boxID string, export *domain.ExportAudit, reason string) {
+	groupID, err := h.service.BoxGroupID(c.Request.Context(), boxID)
+	if err != nil {
+		log.Printf("Audit export of box %s: look up group: %v", boxID, err)
+	}
+	export.BoxID = boxID
+	export.GroupID = groupID
+	h.auditExport(c, export, reason)
+}
+
+// auditExport records that the signed-in user exported records. It runs once the export was sent,
+// so the event is stored even when the client went away before the end of the stream.
+func (h *SensorHandler) auditExport(c *gin.Context, export *domain.ExportAudit, reason string) {
+	if h.users == nil {
+		return
+	}
+	event := domain.NewSecurityEvent(domain.SecurityRecordsExported)
+	event.ActorID = currentUserID(c)
+	event.Reason = reason
+	event.Export = export
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	h.users.RecordSecurityEvent(context.WithoutCancel(c.Request.Context()), event)
+}
+
+// auditDownload records that an export job's file was fetched through its download link. Whoever
+// held the link is unknown, so the event names the job's owner, who shared it.
+func (h *SensorHandler) auditDownload(c *gin.Context, job *domain.Job) {
+	if h.users == nil {
+		return
+	}
+	export := &domain.ExportAudit{Rows: job.Processed}
+	export.Format, _ = job.Params["format"].(string)
+	export.GroupID, _ = job.Params["group_id"].(string)
+	if from, ok := job.Params["time_min"].(int64); ok {
+		export.From = &from
+	}
+	if to, ok := job.Params["time_max"].(int64); ok {
+		export.To = &to
+	}
+
+	event := domain.NewSecurityEvent(domain.SecurityRecordsExported)
+	event.ActorID = job.CreatedBy
+	event.Reason = domain.SecurityReasonDownloadLink
+	event.Export = export
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	h.users.RecordSecurityEvent(context.WithoutCancel(c.Request.Context()), event)
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StartGroupExport godoc
+// @Summary Export the records of a group in the background
+// @Description Takes the parameters of GET /groups/{id}/records/export and is refused on the same checks,
+// @Description then writes the file in the background. Once it is ready, GET /export-jobs/{id} returns a
+// @Description download_url that works without signing in until the file expires, and the owner is sent
+// @Description the link over Zalo or SMS.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param format query string true "Export format" Enums(csv_long, template)
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param apply_calibration query bool false "Apply the box calibrations to the values (csv_long only)" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies (csv_long only)" default(false)
+// @Success 202 {object} domain.Job
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Router /groups/{id}/records/export-jobs [post]
+func (h *SensorHandler) StartGroupExport(c *gin.Context) {
+	groupID := c.Param("id")
+	format, query, ok := parseGroupExport(c)
+	if !ok {
+		return
+	}
+
+	filename := fmt.Sprintf("records_%s_%s_%s.csv", groupID, exportRangeLabel(query.TimeMin, "begin"), exportRangeLabel(query.TimeMax, "now"))
+	if format == domain.ExportFormatTemplate {
+		filename = fmt.Sprintf("report_%s_%s_%s.xlsx", groupID, exportRangeLabel(query.TimeMin, "begin"), exportRangeLabel(query.TimeMax, "now"))
+	}
+
+	job, err := h.service.StartGroupExport(c.Request.Context(), groupID, format, filename, query, !isAdmin(c), currentUserID(c))
+	if err != nil {
+		respondGroupExportError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetExportJob godoc
+// @Summary Get an export job
+// @Description Only the user who started the job, or an admin, sees it. download_url is set while the file is kept.
+// @Tags jobs
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} domain.Job
+// @Failure 404 {object} map[string]interface{}
+// @Router /export-jobs/{id} [get]
+func (h *SensorHandler) GetExportJob(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	job, err := h.service.GetExportJob(c.Request.Context(), c.Param("id"), userVal.(*domain.User))
+	if err != nil {
+		if err == domain.ErrJobNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "job not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// DownloadExport godoc
+// @Summary Download the file of an export job
+// @Description Needs no session: the token of the job's download_url is checked instead, until it expires.
+// @Description Every download is recorded as a records_exported security event of the job's owner.
+// @Tags jobs
+// @Produce text/csv
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param id path string true "Job ID"
+// @Param token query string true "Download token"
+// @Success 200 {file} file
+// @Failure 401 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 410 {object} map[string]interface{}
+// @Router /export-jobs/{id}/download [get]
+func (h *SensorHandler) DownloadExport(c *gin.Context) {
+	job, file, err := h.service.OpenExportDownload(c.Request.Context(), c.Param("id"), c.Query("token"))
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidDownloadToken:
+			i18n.RespondError(c, http.StatusUnauthorized, err.Error())
+		case domain.ErrExportFileExpired:
+			i18n.RespondError(c, http.StatusGone, err.Error())
+		case domain.ErrExportFileNotFound:
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", job.File.ContentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", job.File.Filename))
+	c.Header("Content-Length", strconv.FormatInt(job.File.Size, 10))
+	c.Status(http.StatusOK)
+
+	// Headers are already sent, so a failure can only cut the download short
+	if _, err := io.Copy(c.Writer, file); err != nil {
+		log.Printf("Download export %s: %v", job.ID, err)
+		return
+	}
+	h.auditDownload(c, job)
+}
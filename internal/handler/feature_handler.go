@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FeatureHandler struct {
+	service *service.FeatureFlagService
+}
+
+func NewFeatureHandler(service *service.FeatureFlagService) *FeatureHandler {
+	return &FeatureHandler{service: service}
+}
+
+// ListFeatures godoc
+// @Summary List the feature flags
+// @Description Every feature with its default, its current state and where that comes from: default, env (FEATURE_FLAGS) or runtime
+// @Description (PUT /admin/features/{name}), by increasing precedence. The routes of a feature turned off answer 404.
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} domain.FeatureState
+// @Router /admin/features [get]
+func (h *FeatureHandler) ListFeatures(c *gin.Context) {
+	c.JSON(http.StatusOK, h.service.States(c.Request.Context()))
+}
+
+// SetFeature godoc
+// @Summary Turn a feature on or off at runtime
+// @Description The override is kept as the feature_flags setting, so it survives restarts and applies to every instance within
+// @Description 10 seconds. A null enabled drops the override, leaving the feature to FEATURE_FLAGS or its default.
+// @Tags admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param name path string true "Feature name"
+// @Param body body domain.SetFeatureParams true "Feature state"
+// @Success 200 {object} domain.FeatureState
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /admin/features/{name} [put]
+func (h *FeatureHandler) SetFeature(c *gin.Context) {
+	var params domain.SetFeatureParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	state, err := h.service.Set(c.Request.Context(), c.Param("name"), params, currentUserID(c))
+	if err != nil {
+		if err == domain.ErrFeatureNotFound {
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,229 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MaintenanceHandler struct {
+	service *service.MaintenanceService
+}
+
+func NewMaintenanceHandler(service *service.MaintenanceService) *MaintenanceHandler {
+	return &MaintenanceHandler{service: service}
+}
+
+// ListMaintenance godoc
+// @Summary List maintenance windows, newest first
+// @Description Past windows are kept for audit. box_id also returns the windows of the box's group.
+// @Tags maintenance
+// @Security BearerAuth
+// @Produce json
+// @Param box_id query string false "Box ID"
+// @Param group_id query string false "Group ID"
+// @Param from query int false "Keep windows ending after (seconds)"
+// @Param to query int false "Keep windows starting before (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Router /maintenance [get]
+func (h *MaintenanceHandler) ListMaintenance(c *gin.Context) {
+	pagination := domain.ParsePaginationParams(c)
+
+	var filter domain.FilterMaintenanceParams
+	filterInfo := map[string]interface{}{}
+	if boxID := c.Query("box_id"); boxID != "" {
+		filter.BoxID = &boxID
+		filterInfo["box_id"] = boxID
+	}
+	if groupID := c.Query("group_id"); groupID != "" {
+		filter.GroupID = &groupID
+		filterInfo["group_id"] = groupID
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid from")
+			return
+		}
+		filter.From = &t
+		filterInfo["from"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid to")
+			return
+		}
+		filter.To = &t
+		filterInfo["to"] = t
+	}
+
+	windows, total, err := h.service.ListWithPagination(c.Request.Context(), pagination, filter)
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(windows, pagination.Page, pagination.PageSize, total, filterInfo))
+}
+
+// GetMaintenance godoc
+// @Summary Get maintenance window
+// @Tags maintenance
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Maintenance window ID"
+// @Success 200 {object} domain.MaintenanceWindow
+// @Failure 404 {object} map[string]interface{}
+// @Router /maintenance/{id} [get]
+func (h *MaintenanceHandler) GetMaintenance(c *gin.Context) {
+	window, err := h.service.Get(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrMaintenanceNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "maintenance window not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, window)
+}
+
+// CreateMaintenance godoc
+// @Summary Schedule a maintenance window
+// @Description Covers one box (box_id) or every box of a group (group_id). Windows may overlap.
+// @Tags maintenance
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body domain.CreateMaintenanceParams true "Maintenance window"
+// @Success 201 {object} domain.MaintenanceWindow
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /maintenance [post]
+func (h *MaintenanceHandler) CreateMaintenance(c *gin.Context) {
+	var params domain.CreateMaintenanceParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	window, err := h.service.Create(c.Request.Context(), params, currentUserID(c))
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidMaintenanceScope, domain.ErrInvalidMaintenanceRange:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxGroupNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, window)
+}
+
+// UpdateMaintenance godoc
+// @Summary Update maintenance window
+// @Description A running window only accepts a new reason or end (not in the past); an ended one cannot change.
+// @Tags maintenance
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Maintenance window ID"
+// @Param request body domain.UpdateMaintenanceParams true "Update data"
+// @Success 200 {object} domain.MaintenanceWindow
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /maintenance/{id} [put]
+func (h *MaintenanceHandler) UpdateMaintenance(c *gin.Context) {
+	var params domain.UpdateMaintenanceParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	window, err := h.service.Update(c.Request.Context(), c.Param("id"), params)
+	if err != nil {
+		switch err {
+		case domain.ErrInvalidMaintenanceRange:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrMaintenanceStarted, domain.ErrMaintenanceEnded:
+			i18n.RespondError(c, http.StatusConflict, err.Error())
+		case domain.ErrMaintenanceNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "maintenance window not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, window)
+}
+
+// DeleteMaintenance godoc
+// @Summary Delete a maintenance window that has not started
+// @Tags maintenance
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Maintenance window ID"
+// @Success 200 {object} domain.MaintenanceWindow
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /maintenance/{id} [delete]
+func (h *MaintenanceHandler) DeleteMaintenance(c *gin.Context) {
+	window, err := h.service.Delete(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		switch err {
+		case domain.ErrMaintenanceStarted:
+			i18n.RespondError(c, http.StatusConflict, err.Error())
+		case domain.ErrMaintenanceNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "maintenance window not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, window)
+}
+
+// BoxMaintenanceStatus godoc
+// @Summary Get whether a box is in maintenance now
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Success 200 {object} domain.MaintenanceStatus
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/maintenance [get]
+func (h *MaintenanceHandler) BoxMaintenanceStatus(c *gin.Context) {
+	status, err := h.service.BoxStatus(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+)
+
+// Days back GET /zones/{id}/metrics-matrix looks for records
+const (
+	defaultMatrixDays = 30
+	maxMatrixDays     = 365
+)
+
+// MetricsMatrix godoc
+// @Summary Tell which configured metrics of a zone's boxes have recent data
+// @Description Lists every box of the zone's groups the user may read, with the metric codes configured on it and
+// @Description whether each has records from the last days. format=xlsx answers a workbook with the boxes as rows and
+// @Description the metrics as columns: ✓ when the box has data for the metric, ✗ when it has none, empty when the
+// @Description metric is not configured on the box.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param id path string true "Zone ID"
+// @Param days query int false "Days back to look for records" default(30) maximum(365)
+// @Param format query string false "Response format" Enums(json, xlsx) default(json)
+// @Success 200 {object} domain.MetricsMatrix
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /zones/{id}/metrics-matrix [get]
+func (h *SensorHandler) MetricsMatrix(c *gin.Context) {
+	zoneID := c.Param("id")
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(defaultMatrixDays)))
+	if err != nil || days < 1 || days > maxMatrixDays {
+		i18n.RespondError(c, http.StatusBadRequest, "days must be between 1 and 365")
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "xlsx" {
+		i18n.RespondError(c, http.StatusBadRequest, "format must be json or xlsx")
+		return
+	}
+
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	matrix, err := h.service.MetricsMatrix(c.Request.Context(), zoneID, days, user)
+	if err != nil {
+		if err == domain.ErrZoneNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "zone not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if format == "json" {
+		c.JSON(http.StatusOK, matrix)
+		return
+	}
+
+	f := excelize.NewFile()
+	sheet := "Metrics"
+	f.SetSheetName("Sheet1", sheet)
+
+	headers := append([]string{"Group", "Box"}, matrix.Metrics...)
+	for col, header := range headers {
+		cell, _ := excelize.CoordinatesToCellName(col+1, 1)
+		f.SetCellValue(sheet, cell, header)
+	}
+
+	columns := make(map[string]int, len(matrix.Metrics))
+	for i, code := range matrix.Metrics {
+		columns[code] = i + 3
+	}
+	row := 2
+	for _, group := range matrix.Groups {
+		for _, box := range group.Boxes {
+			f.SetCellValue(sheet, fmt.Sprintf("A%d", row), group.Name)
+			f.SetCellValue(sheet, fmt.Sprintf("B%d", row), box.Name)
+			for _, metric := range box.Metrics {
+				mark := "✗"
+				if metric.HasData {
+					mark = "✓"
+				}
+				cell, _ := excelize.CoordinatesToCellName(columns[metric.Code], row)
+				f.SetCellValue(sheet, cell, mark)
+			}
+			row++
+		}
+	}
+
+	filename := fmt.Sprintf("metrics_matrix_%s_%s.xlsx", zoneID, time.Now().Format("20060102_150405"))
+	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	if err := f.Write(c.Writer); err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+	}
+}
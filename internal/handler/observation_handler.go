@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ObservationHandler struct {
+	service *service.ObservationService
+}
+
+func NewObservationHandler(service *service.ObservationService) *ObservationHandler {
+	return &ObservationHandler{service: service}
+}
+
+// respondObservationError maps the errors of observation requests to responses
+func respondObservationError(c *gin.Context, err error) {
+	switch err {
+	case domain.ErrInvalidObservation:
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+	case domain.ErrBoxNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "box not found")
+	case domain.ErrObservationNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "observation not found")
+	case domain.ErrBoxAccessDenied:
+		i18n.RespondError(c, http.StatusForbidden, "box access denied")
+	default:
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// ListObservations godoc
+// @Summary List the manual observations of a box, newest first
+// @Description Record listings merge them with the telemetry when asked with include=observations.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations [get]
+func (h *ObservationHandler) ListObservations(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	pagination := domain.ParsePaginationParams(c)
+
+	filter := domain.FilterObservationParams{BoxID: c.Param("id")}
+	filterInfo := map[string]interface{}{}
+	if timeMin := c.Query("time_min"); timeMin != "" {
+		t, err := strconv.ParseInt(timeMin, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_min")
+			return
+		}
+		filter.From = &t
+		filterInfo["time_min"] = t
+	}
+	if timeMax := c.Query("time_max"); timeMax != "" {
+		t, err := strconv.ParseInt(timeMax, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_max")
+			return
+		}
+		filter.To = &t
+		filterInfo["time_max"] = t
+	}
+
+	observations, total, err := h.service.ListWithPagination(c.Request.Context(), user, pagination, filter)
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(observations, pagination.Page, pagination.PageSize, total, filterInfo))
+}
+
+// GetObservation godoc
+// @Summary Get a manual observation
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param observation_id path string true "Observation ID"
+// @Success 200 {object} domain.Observation
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations/{observation_id} [get]
+func (h *ObservationHandler) GetObservation(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	observation, err := h.service.Get(c.Request.Context(), user, c.Param("id"), c.Param("observation_id"))
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, observation)
+}
+
+// CreateObservation godoc
+// @Summary Record a manual observation of a box
+// @Description Stores a reading taken on site, e.g. from a staff gauge, apart from the telemetry records.
+// @Description metrics holds the values read by metric code, e.g. {"WAU": 12.34}. The author is the authenticated user.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param request body domain.CreateObservationParams true "Observation"
+// @Success 201 {object} domain.Observation
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations [post]
+func (h *ObservationHandler) CreateObservation(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	var params domain.CreateObservationParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	observation, err := h.service.Create(c.Request.Context(), user, c.Param("id"), params)
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, observation)
+}
+
+// UpdateObservation godoc
+// @Summary Correct a manual observation
+// @Description The version replaced is kept in the observation's history.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param observation_id path string true "Observation ID"
+// @Param request body domain.UpdateObservationParams true "Update data"
+// @Success 200 {object} domain.Observation
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations/{observation_id} [put]
+func (h *ObservationHandler) UpdateObservation(c *gin.Context) {
+	var params domain.UpdateObservationParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	observation, err := h.service.Update(c.Request.Context(), currentUserID(c), c.Param("id"), c.Param("observation_id"), params)
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, observation)
+}
+
+// DeleteObservation godoc
+// @Summary Delete a manual observation (soft delete)
+// @Description The observation deleted is kept in its history.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param observation_id path string true "Observation ID"
+// @Success 200 {object} domain.Observation
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations/{observation_id} [delete]
+func (h *ObservationHandler) DeleteObservation(c *gin.Context) {
+	observation, err := h.service.Delete(c.Request.Context(), currentUserID(c), c.Param("id"), c.Param("observation_id"))
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, observation)
+}
+
+// ListObservationHistory godoc
+// @Summary List the previous versions of a manual observation
+// @Description Every correction and the deletion record the version they replaced, newest first, with who made the change.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param observation_id path string true "Observation ID"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/observations/{observation_id}/history [get]
+func (h *ObservationHandler) ListObservationHistory(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	pagination := domain.ParsePaginationParams(c)
+
+	versions, total, err := h.service.ListHistory(c.Request.Context(), user, c.Param("id"), c.Param("observation_id"), pagination)
+	if err != nil {
+		respondObservationError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(versions, pagination.Page, pagination.PageSize, total, nil))
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReadOnlyHandler struct {
+	service *service.ReadOnlyService
+}
+
+func NewReadOnlyHandler(service *service.ReadOnlyService) *ReadOnlyHandler {
+	return &ReadOnlyHandler{service: service}
+}
+
+// GetReadOnly godoc
+// @Summary Get the read-only mode
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} domain.ReadOnlyMode
+// @Router /admin/read-only [get]
+func (h *ReadOnlyHandler) GetReadOnly(c *gin.Context) {
+	c.JSON(http.StatusOK, h.service.Mode(c.Request.Context()))
+}
+
+// SetReadOnly godoc
+// @Summary Turn the read-only mode on or off
+// @Description In read-only mode every request other than GET is refused with 503 and a Retry-After of retry_after seconds
+// @Description (300 by default), except signing in and this endpoint. With buffer_ingest, records posted to /boxes/{id}/records
+// @Description are accepted and held in the ingestion queue until the mode is turned off; records that would be merged into
+// @Description stored ones or fall in a closed month are still refused. The mode is kept as the read_only setting, so it survives restarts.
+// @Tags admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param body body domain.SetReadOnlyParams true "Read-only mode"
+// @Success 200 {object} domain.ReadOnlyMode
+// @Failure 400 {object} map[string]interface{}
+// @Router /admin/read-only [put]
+func (h *ReadOnlyHandler) SetReadOnly(c *gin.Context) {
+	var params domain.SetReadOnlyParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	mode, err := h.service.Set(c.Request.Context(), params, currentUserID(c))
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, mode)
+}
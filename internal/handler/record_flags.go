@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClearRecordFlag godoc
+// @Summary Clear the flag set on a metric value of a stored record
+// @Description For a value flagged as an anomaly that was a real change. The value is kept either way; once
+// @Description cleared, exclude_anomalies no longer leaves it out. The correction is listed by GET /boxes/{id}/corrections.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param timestamp path int true "Record timestamp (seconds), its id"
+// @Param code path string true "Metric code"
+// @Param request body domain.ClearFlagParams false "Why the flag is cleared"
+// @Success 200 {object} domain.RecordCorrection
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/records/{timestamp}/flags/{code}/clear [post]
+func (h *SensorHandler) ClearRecordFlag(c *gin.Context) {
+	timestamp, err := strconv.ParseInt(c.Param("timestamp"), 10, 64)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "timestamp must be a record timestamp in seconds")
+		return
+	}
+
+	var params domain.ClearFlagParams
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&params); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+
+	correction, err := h.service.ClearRecordFlag(c.Request.Context(), c.Param("id"), timestamp, c.Param("code"), params, currentUserID(c))
+	if err != nil {
+		switch err {
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrRecordNotFound, domain.ErrRecordFlagNotFound:
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, correction)
+}
+
+// ListRecordCorrections godoc
+// @Summary List the corrections made to the stored records of a box
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Success 200 {array} domain.RecordCorrection
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/corrections [get]
+func (h *SensorHandler) ListRecordCorrections(c *gin.Context) {
+	corrections, err := h.service.RecordCorrections(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, corrections)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Long poll timeouts, in seconds
+const (
+	defaultPollTimeout = 30
+	maxPollTimeout     = 60
+)
+
+// PollRecords godoc
+// @Summary Wait for new sensor records of a box
+// @Description Answers at once with the records newer than since when there are any, newest first and at most 500.
+// @Description Otherwise holds the request until the box reports records or the timeout passes, then answers 204.
+// @Description For clients that cannot use WebSockets or server-sent events; pass the newest timestamp received as the next since.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param since query int true "Timestamp (seconds) of the newest record the client has"
+// @Param timeout query int false "Seconds to wait for new records" default(30) maximum(60)
+// @Success 200 {object} domain.PaginatedResponse
+// @Success 204 "No new records before the timeout"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 503 {object} map[string]interface{}
+// @Router /boxes/{id}/records/poll [get]
+func (h *SensorHandler) PollRecords(c *gin.Context) {
+	boxID := c.Param("id")
+
+	since, err := strconv.ParseInt(c.Query("since"), 10, 64)
+	if err != nil || since < 0 {
+		i18n.RespondError(c, http.StatusBadRequest, "since must be a timestamp in seconds")
+		return
+	}
+	timeout, err := strconv.Atoi(c.DefaultQuery("timeout", strconv.Itoa(defaultPollTimeout)))
+	if err != nil || timeout < 1 || timeout > maxPollTimeout {
+		i18n.RespondError(c, http.StatusBadRequest, "timeout must be between 1 and 60 seconds")
+		return
+	}
+
+	h.watchShutdown(c)
+	result, err := h.service.PollRecords(c.Request.Context(), boxID, since, time.Duration(timeout)*time.Second)
+	if err != nil {
+		switch {
+		case err == domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case err == domain.ErrTooManyPolls:
+			c.Header("Retry-After", strconv.Itoa(defaultPollTimeout))
+			i18n.RespondError(c, http.StatusServiceUnavailable, "too many long polls, retry later")
+		case err == domain.ErrPollsStopped:
+			i18n.RespondError(c, http.StatusServiceUnavailable, "server shutting down")
+		case c.Request.Context().Err() != nil:
+			// The client went away, nobody reads the answer
+			c.Abort()
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if len(result.Records) == 0 {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(result.Records, 1, len(result.Records), result.Total, gin.H{"since": since}))
+}
+
+// watchShutdown ends the held long polls once the server serving c starts shutting down, since
+// http.Server.Shutdown waits for every request to finish
+func (h *SensorHandler) watchShutdown(c *gin.Context) {
+	srv, ok := c.Request.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok {
+		return
+	}
+	if _, watched := h.pollServers.LoadOrStore(srv, struct{}{}); !watched {
+		srv.RegisterOnShutdown(h.service.StopPolls)
+	}
+}
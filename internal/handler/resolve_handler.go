@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ResolveHandler struct {
+	service *service.ResolveService
+}
+
+func NewResolveHandler(service *service.ResolveService) *ResolveHandler {
+	return &ResolveHandler{service: service}
+}
+
+// Resolve godoc
+// @Summary Resolve box, group, zone and user IDs to names
+// @Description At most 500 IDs in total. IDs that are unknown or outside the caller's groups are left out of the maps.
+// @Tags resolve
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body domain.ResolveParams true "IDs per kind"
+// @Success 200 {object} domain.ResolveResult
+// @Failure 400 {object} map[string]interface{}
+// @Router /resolve [post]
+func (h *ResolveHandler) Resolve(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	var params domain.ResolveParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	result, err := h.service.Resolve(c.Request.Context(), user, params)
+	if err != nil {
+		if err == domain.ErrTooManyResolveIDs {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
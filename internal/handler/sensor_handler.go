@@ -1,12 +1,21 @@
 package handler
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"tp25-api/internal/domain"
+	"tp25-api/internal/httputil"
+	"tp25-api/internal/i18n"
 	"tp25-api/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -16,10 +25,27 @@ import (
 
 type SensorHandler struct {
 	service *service.SensorService
+	caching historyCaching
+	users   *service.UserService // records exports, see SetExportAudit
+
+	recordPages domain.PageLimits // page sizes of the record listings, see SetRecordPageSize
+
+	pollServers sync.Map // *http.Server -> struct{}, those told to end the long polls on shutdown
 }
 
 func NewSensorHandler(service *service.SensorService) *SensorHandler {
-	return &SensorHandler{service: service}
+	return &SensorHandler{service: service, recordPages: domain.RecordPageLimits}
+}
+
+// SetRecordPageSize sets the page_size record listings default to, at most their maximum
+func (h *SensorHandler) SetRecordPageSize(size int) {
+	if size <= 0 {
+		return
+	}
+	if size > h.recordPages.Max {
+		size = h.recordPages.Max
+	}
+	h.recordPages.Default = size
 }
 
 // Metric endpoints
@@ -41,7 +67,7 @@ func (h *SensorHandler) ListMetrics(c *gin.Context) {
 
 	metrics, total, err := h.service.ListMetricsWithPagination(c.Request.Context(), pagination, filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -61,17 +87,17 @@ func (h *SensorHandler) ListMetrics(c *gin.Context) {
 func (h *SensorHandler) GetMetric(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	metric, err := h.service.GetMetric(c.Request.Context(), bson.M{"_id": id})
 	if err != nil {
 		if err == domain.ErrMetricNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "metric not found"})
+			i18n.RespondError(c, http.StatusNotFound, "metric not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -80,32 +106,37 @@ func (h *SensorHandler) GetMetric(c *gin.Context) {
 
 // CreateMetric godoc
 // @Summary Create a new metric
+// @Description unit must be a code of the unit catalog, see GET /units.
 // @Tags metrics
 // @Security BearerAuth
 // @Accept json
 // @Produce json
 // @Param request body domain.CreateMetricParams true "Metric data"
 // @Success 201 {object} domain.Metric
+// @Failure 400 {object} map[string]interface{}
 // @Failure 409 {object} map[string]interface{}
 // @Router /metrics [post]
 func (h *SensorHandler) CreateMetric(c *gin.Context) {
 	var params domain.CreateMetricParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	metric, err := h.service.CreateMetric(c.Request.Context(), params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
 		if err == domain.ErrMetricCodeExisted {
-			c.JSON(http.StatusConflict, gin.H{"error": "metric code already exists"})
+			i18n.RespondError(c, http.StatusConflict, "metric code already exists")
 			return
 		}
 		if err == domain.ErrMetricMustHaveCode {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "metric must have code"})
+			i18n.RespondError(c, http.StatusBadRequest, "metric must have code")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -114,6 +145,8 @@ func (h *SensorHandler) CreateMetric(c *gin.Context) {
 
 // UpdateMetric godoc
 // @Summary Update metric
+// @Description The code cannot change while any box reports or refers to the metric. A new unit must be a code of the
+// @Description unit catalog; metrics keep a unit stored before units were validated until it is changed.
 // @Tags metrics
 // @Security BearerAuth
 // @Accept json
@@ -121,34 +154,113 @@ func (h *SensorHandler) CreateMetric(c *gin.Context) {
 // @Param id path string true "Metric ID"
 // @Param request body domain.UpdateMetricParams true "Update data"
 // @Success 200 {object} domain.Metric
+// @Failure 400 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
 // @Router /metrics/{id} [put]
 func (h *SensorHandler) UpdateMetric(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateMetricParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	metric, err := h.service.UpdateMetric(c.Request.Context(), id, params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
 		if err == domain.ErrMetricNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "metric not found"})
+			i18n.RespondError(c, http.StatusNotFound, "metric not found")
+			return
+		}
+		if err == domain.ErrMetricCodeExisted {
+			i18n.RespondError(c, http.StatusConflict, "metric code already exists")
+			return
+		}
+		if err == domain.ErrMetricInUse {
+			i18n.RespondError(c, http.StatusConflict, err.Error())
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, metric)
 }
 
+// ListUnits godoc
+// @Summary List the unit catalog
+// @Description The codes metrics may use as unit, with display names by locale and the dimension they measure.
+// @Tags metrics
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /units [get]
+func (h *SensorHandler) ListUnits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"items": domain.Units})
+}
+
+// UnitReport godoc
+// @Summary List metrics whose unit is not in the unit catalog
+// @Description Metrics created before units were validated, with the catalog code their unit most likely means in suggestion.
+// @Tags metrics
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /metrics/unit-report [get]
+func (h *SensorHandler) UnitReport(c *gin.Context) {
+	mismatches, err := h.service.UnitMismatches(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": mismatches})
+}
+
+// ReorderMetrics godoc
+// @Summary Set the display order of metrics
+// @Description Each listed metric gets its position (from 1) as sort_order; unlisted metrics keep theirs.
+// @Tags metrics
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body domain.MetricOrderParams true "Metric IDs in display order"
+// @Success 200 {array} domain.Metric
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /metrics/order [put]
+func (h *SensorHandler) ReorderMetrics(c *gin.Context) {
+	var params domain.MetricOrderParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	metrics, err := h.service.ReorderMetrics(c.Request.Context(), params.IDs)
+	if err != nil {
+		if err == domain.ErrDuplicateMetricID {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == domain.ErrMetricNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "metric not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
+
 // DeleteMetric godoc
 // @Summary Delete metric (soft delete)
 // @Tags metrics
@@ -162,17 +274,17 @@ func (h *SensorHandler) UpdateMetric(c *gin.Context) {
 func (h *SensorHandler) DeleteMetric(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	metric, err := h.service.DeleteMetric(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrMetricNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "metric not found"})
+			i18n.RespondError(c, http.StatusNotFound, "metric not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -190,27 +302,45 @@ func (h *SensorHandler) DeleteMetric(c *gin.Context) {
 // @Param time_min query int false "Min timestamp (seconds)"
 // @Param time_max query int false "Max timestamp (seconds)"
 // @Param page query int false "Page number" default(1)
-// @Param page_size query int false "Page size" default(10)
+// @Param page_size query int false "Page size, RECORD_PAGE_SIZE by default" default(10) maximum(1000)
+// @Param apply_calibration query bool false "Apply the box calibrations to the values" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies" default(false)
+// @Param include query string false "Merge the manual observations of the box by timestamp, marked with src=manual and their details in observation" Enums(observations)
 // @Success 200 {object} domain.PaginatedResponse
+// @Header 200 {string} Cache-Control "private, max-age=N when time_max is in a closed period, no-cache otherwise"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /boxes/{id}/records [get]
 func (h *SensorHandler) ListRecords(c *gin.Context) {
 	boxID := c.Param("id")
 	if boxID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
-	pagination := domain.ParsePaginationParams(c)
+	pagination, err := domain.ParsePaginationWithLimits(c, h.recordPages)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	var query domain.QueryRecord
 
-	// Parse time range
-	if timeMin := c.Query("time_min"); timeMin != "" {
-		if timeMax := c.Query("time_max"); timeMax != "" {
-			min, _ := strconv.ParseInt(timeMin, 10, 64)
-			max, _ := strconv.ParseInt(timeMax, 10, 64)
-			query.Time = []int64{min, max}
-		}
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseCalibration(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseAnomalies(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseInclude(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	limit := pagination.GetLimit()
@@ -220,293 +350,1659 @@ func (h *SensorHandler) ListRecords(c *gin.Context) {
 
 	result, err := h.service.ListRecords(c.Request.Context(), boxID, &query)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	filterInfo := map[string]interface{}{}
-	if len(query.Time) == 2 {
-		filterInfo["time_min"] = query.Time[0]
-		filterInfo["time_max"] = query.Time[1]
-	}
+	filterInfo := timeRangeInfo(&query)
 
+	markCalibrated(c, &query)
+	h.setHistoryCaching(c, &query)
 	c.JSON(http.StatusOK, domain.NewPaginatedResponse(result.Records, pagination.Page, pagination.PageSize, result.Total, filterInfo))
 }
 
 // CountRecords godoc
 // @Summary Count sensor records for a box
-// @Tags data
+// @Description Also served at /data/box/{box_id}/count for older clients.
+// @Tags boxes
 // @Security BearerAuth
 // @Produce json
-// @Param box_id path string true "Box ID"
+// @Param id path string true "Box ID"
 // @Param time_min query int false "Min timestamp (seconds)"
 // @Param time_max query int false "Max timestamp (seconds)"
 // @Success 200 {object} map[string]interface{}
-// @Router /data/box/{box_id}/count [get]
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/records/count [get]
 func (h *SensorHandler) CountRecords(c *gin.Context) {
-	boxID := c.Param("box_id")
+	boxID := c.Param("id")
+	if boxID == "" {
+		// Legacy /data/box/:box_id/count route
+		boxID = c.Param("box_id")
+	}
+	if boxID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
 
 	var query domain.QueryRecord
 
-	// Parse time range
-	if timeMin := c.Query("time_min"); timeMin != "" {
-		if timeMax := c.Query("time_max"); timeMax != "" {
-			min, _ := strconv.ParseInt(timeMin, 10, 64)
-			max, _ := strconv.ParseInt(timeMax, 10, 64)
-			query.Time = []int64{min, max}
-		}
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
 	count, err := h.service.CountRecords(c.Request.Context(), boxID, &query)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"count": count})
 }
 
+// BoxIngestStats godoc
+// @Summary Count the records a box sent recently
+// @Description Records timestamped within the last hour, 24 hours and 7 days, and the timestamp of the newest record.
+// @Description Counts are cached for 30 seconds; at is when they were taken.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Success 200 {object} domain.BoxIngestStats
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/ingest-stats [get]
+func (h *SensorHandler) BoxIngestStats(c *gin.Context) {
+	stats, err := h.service.BoxIngestStats(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// GroupIngestStats godoc
+// @Summary Count the records the boxes of a group sent recently
+// @Description The per-box stats of GET /boxes/{id}/ingest-stats for every box of the group, with their totals.
+// @Description Counts are cached for 30 seconds; at is when they were taken.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.GroupIngestStats
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/ingest-stats [get]
+func (h *SensorHandler) GroupIngestStats(c *gin.Context) {
+	stats, err := h.service.GroupIngestStats(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
 // AddRecord godoc
 // @Summary Add a sensor record
+// @Description The record is queued and written shortly after; the receipt identifies it in the server logs if the write fails.
+// @Description source=manual marks the record as entered by hand. When the box has a merge policy, a record within its
+// @Description window of a stored one is merged into it (200) or rejected (409) instead of being queued. When the box
+// @Description has a dedup policy, a record repeating the values of one stored within its window is dropped and
+// @Description answered with 200 and {"duplicate": true}.
+// @Description The body holds the sensor time in seconds and the values read by metric code, in the units listed by
+// @Description GET /boxes/{id}/ingest-schema, e.g. {"timestamp": 1718000000, "metrics": {"WAU": 12.34, "DR": 0.5}}.
+// @Description V, Q, Q_of and rates of change are derived by the server. An invalid body is rejected with 422 and
+// @Description the offending fields in problems, e.g. [{"field": "metrics.WAU", "reason": "must be a number"}].
 // @Tags boxes
 // @Security BearerAuth
 // @Accept json
 // @Produce json
 // @Param id path string true "Box ID"
-// @Param request body domain.Record true "Record data"
-// @Success 201 {object} map[string]interface{}
+// @Param source query string false "Record source" Enums(manual)
+// @Param request body domain.IngestRecord true "Reading"
+// @Success 200 {object} map[string]interface{}
+// @Success 202 {object} domain.IngestReceipt
+// @Failure 400 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Failure 429 {object} map[string]interface{}
 // @Router /boxes/{id}/records [post]
 func (h *SensorHandler) AddRecord(c *gin.Context) {
 	boxID := c.Param("id")
 
-	var record domain.Record
-	if err := c.ShouldBindJSON(&record); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Unknown fields are rejected so that metrics posted at the top level are not silently dropped
+	var body domain.IngestRecord
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		h.service.CountRejection("malformed body")
+		respondBindingError(c, err)
+		return
+	}
+	if err := body.Validate(); err != nil {
+		for _, problem := range err.(*domain.IngestValidationError).Problems {
+			h.service.CountRejection(problem.Reason)
+		}
+		body := i18n.Envelope(c, http.StatusUnprocessableEntity, err.Error())
+		body["problems"] = err.(*domain.IngestValidationError).Problems
+		c.JSON(http.StatusUnprocessableEntity, body)
+		return
+	}
+	record := body.ToRecord()
+
+	switch c.Query("source") {
+	case "":
+	case domain.RecordSourceManual:
+		record["src"] = domain.RecordSourceManual
+	default:
+		i18n.RespondError(c, http.StatusBadRequest, "invalid source")
 		return
 	}
 
-	// Use ImportRecord service method (assuming it handles the logic)
-	if err := h.service.ImportRecord(c.Request.Context(), boxID, record); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	receipt, err := h.service.AddRecord(c.Request.Context(), boxID, record)
+	if err != nil {
+		if err == domain.ErrDuplicateRecord {
+			c.JSON(http.StatusOK, gin.H{"duplicate": true})
+			return
+		}
+		if err == domain.ErrRecordConflict {
+			i18n.RespondError(c, http.StatusConflict, "a record already exists near this timestamp")
+			return
+		}
+		if err == domain.ErrBoxDecommissioned {
+			i18n.RespondError(c, http.StatusUnprocessableEntity, "box decommissioned before this record's timestamp")
+			return
+		}
+		if err == domain.ErrIngestQueueFull {
+			c.Header("Retry-After", "5")
+			i18n.RespondError(c, http.StatusTooManyRequests, "ingest queue full, retry later")
+			return
+		}
+		if err == domain.ErrIngestQueueClosed {
+			i18n.RespondError(c, http.StatusServiceUnavailable, "server shutting down")
+			return
+		}
+		if err == domain.ErrReadOnly {
+			c.Header("Retry-After", strconv.Itoa(domain.DefaultReadOnlyRetryAfter))
+			i18n.RespondError(c, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if receipt == nil {
+		c.JSON(http.StatusOK, gin.H{"merged": true})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "record added successfully"})
+	c.JSON(http.StatusAccepted, receipt)
 }
 
-// ReportRecords godoc
-// @Summary Generate daily report for a box
+// IngestSchema godoc
+// @Summary Describe the records a box's logger should post
+// @Description Lists the metric codes the box reports with the unit to send each in (the input unit when the box
+// @Description converts the metric), the fields derived by the server, and an example body for POST /boxes/{id}/records.
 // @Tags boxes
 // @Security BearerAuth
 // @Produce json
 // @Param id path string true "Box ID"
-// @Param time_min query int false "Min timestamp (seconds)"
-// @Param time_max query int false "Max timestamp (seconds)"
-// @Success 200 {array} domain.DailyReport
-// @Router /boxes/{id}/reports [get]
-func (h *SensorHandler) ReportRecords(c *gin.Context) {
-	boxID := c.Param("id")
-	if boxID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+// @Success 200 {object} domain.IngestSchema
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/ingest-schema [get]
+func (h *SensorHandler) IngestSchema(c *gin.Context) {
+	schema, err := h.service.IngestSchema(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	var query domain.QueryRecord
+	c.JSON(http.StatusOK, schema)
+}
 
-	// Parse time range
-	if timeMin := c.Query("time_min"); timeMin != "" {
-		if timeMax := c.Query("time_max"); timeMax != "" {
-			min, _ := strconv.ParseInt(timeMin, 10, 64)
-			max, _ := strconv.ParseInt(timeMax, 10, 64)
-			query.Time = []int64{min, max}
-		}
+// RecomputeConversion godoc
+// @Summary Recompute stored values of a box metric after its unit conversion was corrected
+// @Description Starts a background job. Records that kept a raw_ value are converted from it; the others are first
+// @Description reverted with previous, or taken as reported when previous is omitted. V, Q and Q_of are recalculated.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param code path string true "Metric code"
+// @Param request body domain.RecomputeConversionParams true "Previous conversion and time range"
+// @Success 202 {object} domain.Job
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/metrics/{code}/recompute [post]
+func (h *SensorHandler) RecomputeConversion(c *gin.Context) {
+	var params domain.RecomputeConversionParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
 	}
 
-	reports, err := h.service.ReportRecords(c.Request.Context(), boxID, &query)
+	job, err := h.service.RecomputeConversion(c.Request.Context(), c.Param("id"), c.Param("code"), params, currentUserID(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		switch err {
+		case domain.ErrBoxNotFound, domain.ErrBoxMetricNotFound:
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+		case domain.ErrInvalidUnitConversion, domain.ErrInvalidTimeRange:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, reports)
+	c.JSON(http.StatusAccepted, job)
 }
 
-// ListRecordsByGroup godoc
-// @Summary List sensor records for all boxes in a group
-// @Tags groups
+// BackfillRollups godoc
+// @Summary Rebuild the daily rollups of past days from the raw records
+// @Description Arithmetic daily reports read days from their rollups once rebuilt. Without box_id every box is rebuilt.
+// @Description Avoid running it while historical records are being imported.
+// @Tags jobs
 // @Security BearerAuth
+// @Accept json
 // @Produce json
-// @Param id path string true "Group ID"
-// @Param time_min query int false "Min timestamp (seconds)"
-// @Param time_max query int false "Max timestamp (seconds)"
-// @Param page query int false "Page number" default(1)
-// @Param page_size query int false "Page size" default(10)
-// @Success 200 {object} domain.PaginatedResponse
-// @Router /groups/{id}/records [get]
-func (h *SensorHandler) ListRecordsByGroup(c *gin.Context) {
-	groupID := c.Param("id")
-	if groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
-		return
+// @Param request body domain.RollupBackfillParams false "Box to rebuild"
+// @Success 202 {object} domain.Job
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /rollups/backfill [post]
+func (h *SensorHandler) BackfillRollups(c *gin.Context) {
+	var params domain.RollupBackfillParams
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&params); err != nil {
+			respondBindingError(c, err)
+			return
+		}
 	}
 
-	pagination := domain.ParsePaginationParams(c)
-
-	var query domain.QueryRecord
-
-	if timeMin := c.Query("time_min"); timeMin != "" {
-		if timeMax := c.Query("time_max"); timeMax != "" {
-			min, _ := strconv.ParseInt(timeMin, 10, 64)
-			max, _ := strconv.ParseInt(timeMax, 10, 64)
-			query.Time = []int64{min, max}
+	job, err := h.service.BackfillRollups(c.Request.Context(), params, currentUserID(c))
+	if err != nil {
+		switch err {
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, err.Error())
+		case domain.ErrMaintenanceJobRunning:
+			i18n.RespondError(c, http.StatusConflict, err.Error())
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		}
+		return
 	}
 
-	limit := pagination.GetLimit()
-	skip := pagination.GetSkip()
-	query.Limit = &limit
-	query.Skip = &skip
+	c.JSON(http.StatusAccepted, job)
+}
 
-	result, err := h.service.ListRecordsByGroup(c.Request.Context(), groupID, &query)
+// Reindex godoc
+// @Summary Drop and recreate the declared indexes of every collection
+// @Description Runs as a job reporting progress per collection at GET /jobs/{id}. Queries run unindexed
+// @Description while their index is rebuilt and a unique index fails to rebuild if duplicates are written
+// @Description meanwhile, so prefer running it in read-only mode. Only one maintenance job runs at a time.
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 202 {object} domain.Job
+// @Failure 409 {object} map[string]interface{}
+// @Router /admin/maintenance/reindex [post]
+func (h *SensorHandler) Reindex(c *gin.Context) {
+	job, err := h.service.Reindex(c.Request.Context(), currentUserID(c))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.respondMaintenanceError(c, err)
 		return
 	}
 
-	filterInfo := map[string]interface{}{}
-	if len(query.Time) == 2 {
-		filterInfo["time_min"] = query.Time[0]
-		filterInfo["time_max"] = query.Time[1]
-	}
-
-	c.JSON(http.StatusOK, domain.NewPaginatedResponse(result.Records, pagination.Page, pagination.PageSize, result.Total, filterInfo))
+	c.JSON(http.StatusAccepted, job)
 }
 
-// ListRecordsLatestByGroup godoc
-// @Summary List sensor records latest for all boxes in a group
-// @Tags groups
+// RebuildRollups godoc
+// @Summary Regenerate the daily rollups and cached report totals of every box from its raw records
+// @Description Runs as a job reporting progress per record collection at GET /jobs/{id}. Avoid running it
+// @Description while historical records are being imported. Only one maintenance job runs at a time.
+// @Tags admin
 // @Security BearerAuth
 // @Produce json
-// @Param id path string true "Group ID"
-// @Success 200 {object} domain.PaginatedResponse
-// @Router /groups/{id}/records/latest [get]
-func (h *SensorHandler) ListRecordsLatestByGroup(c *gin.Context) {
-	groupID := c.Param("id")
-	if groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+// @Success 202 {object} domain.Job
+// @Failure 409 {object} map[string]interface{}
+// @Router /admin/maintenance/rebuild-rollups [post]
+func (h *SensorHandler) RebuildRollups(c *gin.Context) {
+	job, err := h.service.RebuildRollups(c.Request.Context(), currentUserID(c))
+	if err != nil {
+		h.respondMaintenanceError(c, err)
 		return
 	}
 
-	result, err := h.service.ListRecordsLatestByGroup(c.Request.Context(), groupID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+func (h *SensorHandler) respondMaintenanceError(c *gin.Context, err error) {
+	if err == domain.ErrMaintenanceJobRunning {
+		i18n.RespondError(c, http.StatusConflict, err.Error())
+		return
+	}
+	i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// GetJob godoc
+// @Summary Get the status of a background job
+// @Tags jobs
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} domain.Job
+// @Failure 404 {object} map[string]interface{}
+// @Router /jobs/{id} [get]
+func (h *SensorHandler) GetJob(c *gin.Context) {
+	job, err := h.service.GetJob(c.Request.Context(), c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrJobNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "job not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, domain.PaginatedResponse{
-		Data: result.Records,
-		Meta: domain.PaginationMeta{
-			TotalItems: result.Total,
-		},
-	})
+	c.JSON(http.StatusOK, job)
 }
 
-// ExportRecords godoc
-// @Summary Export records to Excel for a box
+// ReportRecords godoc
+// @Summary Generate daily report for a box
+// @Description avg=arithmetic (default) averages the samples received each day.
+// @Description avg=time_weighted weights each sample by the time until the next one, capped at max_gap seconds,
+// @Description so days with bursts of frequent samples are not skewed towards the burst.
 // @Tags boxes
 // @Security BearerAuth
-// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Produce json
 // @Param id path string true "Box ID"
 // @Param time_min query int false "Min timestamp (seconds)"
 // @Param time_max query int false "Max timestamp (seconds)"
-// @Success 200 {file} file
-// @Router /boxes/{id}/records/export [get]
-func (h *SensorHandler) ExportRecords(c *gin.Context) {
+// @Param avg query string false "Average mode" Enums(arithmetic, time_weighted) default(arithmetic)
+// @Param max_gap query int false "Max weight of one sample in seconds (time_weighted only)" default(3600)
+// @Param apply_calibration query bool false "Apply the box calibrations to the values" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies" default(false)
+// @Param include_observations query bool false "Aggregate the manual observations of the box with its records" default(false)
+// @Success 200 {array} domain.DailyReport
+// @Header 200 {string} Cache-Control "private, max-age=N when time_max is in a closed period, no-cache otherwise"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/reports [get]
+func (h *SensorHandler) ReportRecords(c *gin.Context) {
 	boxID := c.Param("id")
 	if boxID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var query domain.QueryRecord
-	if timeMin := c.Query("time_min"); timeMin != "" {
-		if timeMax := c.Query("time_max"); timeMax != "" {
-			min, _ := strconv.ParseInt(timeMin, 10, 64)
-			max, _ := strconv.ParseInt(timeMax, 10, 64)
-			query.Time = []int64{min, max}
-		}
-	}
 
-	result, err := h.service.ListRecords(c.Request.Context(), boxID, &query)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	f := excelize.NewFile()
-	sheet := "Records"
-	f.SetSheetName("Sheet1", sheet)
-
-	headers := []string{"STT", "Time"}
-	metricKeys := []string{}
+	if err := parseCalibration(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseAnomalies(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if len(result.Records) > 0 {
-		for key := range result.Records[0] {
-			if key != "c" && key != "_id" && key != "id" && key != "box_id" && key != "n" {
-				metricKeys = append(metricKeys, key)
-				headers = append(headers, key)
-			}
+	opts := domain.ReportOptions{Avg: domain.AvgMode(c.Query("avg"))}
+	if maxGap := c.Query("max_gap"); maxGap != "" {
+		gap, err := strconv.ParseInt(maxGap, 10, 64)
+		if err != nil || gap <= 0 {
+			i18n.RespondError(c, http.StatusBadRequest, "max_gap must be a positive number of seconds")
+			return
 		}
+		opts.MaxGap = gap
+	}
+	observations, err := strconv.ParseBool(c.DefaultQuery("include_observations", "false"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "include_observations must be a boolean")
+		return
+	}
+	opts.Observations = observations
+
+	reports, err := h.service.ReportRecords(c.Request.Context(), boxID, &query, opts)
+	if err != nil {
+		if err == domain.ErrInvalidAvgMode {
+			i18n.RespondError(c, http.StatusBadRequest, "avg must be arithmetic or time_weighted")
+			return
+		}
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	markCalibrated(c, &query)
+	h.setHistoryCaching(c, &query)
+	c.JSON(http.StatusOK, reports)
+}
+
+// RecordStats godoc
+// @Summary Statistics of metrics for a box over a time range
+// @Description Returns count, min, max, avg, stddev, first and last value per metric. Metrics without values in the range have count 0.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param metrics query string true "Comma-separated metrics list"
+// @Success 200 {object} domain.RecordStats
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/records/stats [get]
+func (h *SensorHandler) RecordStats(c *gin.Context) {
+	boxID := c.Param("id")
+	if boxID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metrics := httputil.QueryList(c, "metrics")
+	if len(metrics) == 0 {
+		i18n.RespondError(c, http.StatusBadRequest, "at least one metric is required")
+		return
+	}
+
+	stats, err := h.service.RecordStats(c.Request.Context(), boxID, &query, metrics)
+	if err != nil {
+		if err == domain.ErrTimeRangeRequired || err == domain.ErrInvalidMetricCode {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// RecordSchema godoc
+// @Summary List the fields observed in the records of a box
+// @Description Samples up to sample random records of the box in the time range (all of its records when omitted) and lists
+// @Description each field they hold with its BSON types, the earliest and latest sampled record holding it and how many do.
+// @Description kind tells a configured metric from a derived value (raw_<code>, <code>_rate) and from an orphan no metric
+// @Description of the box is configured for; missing lists the configured metrics absent from the sample.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param sample query int false "Records sampled at most" default(10000) maximum(100000)
+// @Success 200 {object} domain.RecordSchema
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/records/schema [get]
+func (h *SensorHandler) RecordSchema(c *gin.Context) {
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sample, err := strconv.Atoi(c.DefaultQuery("sample", strconv.Itoa(domain.DefaultSchemaSample)))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, domain.ErrInvalidSchemaSample.Error())
+		return
+	}
+
+	schema, err := h.service.RecordSchema(c.Request.Context(), c.Param("id"), &query, sample)
+	if err != nil {
+		if err == domain.ErrInvalidSchemaSample {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, schema)
+}
+
+// MetricHistogram godoc
+// @Summary Frequency distribution of a metric for a box over a time range
+// @Description Bins are either bin_width wide, starting at a multiple of it, or given as comma-separated ascending edges;
+// @Description a bin holds the values >= its min and < its max. At most 1000 bins. thresholds gives the share of samples
+// @Description above each numeric warning level configured on the box for the metric.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param metric query string true "Metric code"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param bin_width query number false "Bin width"
+// @Param edges query string false "Comma-separated bin edges"
+// @Success 200 {object} domain.Histogram
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/records/histogram [get]
+func (h *SensorHandler) MetricHistogram(c *gin.Context) {
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := domain.HistogramParams{Metric: c.Query("metric")}
+	if params.Metric == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "metric is required")
+		return
+	}
+	if binWidth := c.Query("bin_width"); binWidth != "" {
+		width, err := strconv.ParseFloat(binWidth, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid bin_width")
+			return
+		}
+		params.BinWidth = &width
+	}
+	for _, e := range httputil.QueryList(c, "edges") {
+		edge, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid edges")
+			return
+		}
+		params.Edges = append(params.Edges, edge)
+	}
+
+	histogram, err := h.service.MetricHistogram(c.Request.Context(), c.Param("id"), &query, params)
+	if err != nil {
+		switch err {
+		case domain.ErrTimeRangeRequired, domain.ErrInvalidTimeRange, domain.ErrInvalidMetricCode,
+			domain.ErrInvalidHistogramBins, domain.ErrTooManyHistogramBins:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, histogram)
+}
+
+// QualityReport godoc
+// @Summary Data-quality report for a box
+// @Description Expected vs actual samples, duplicate timestamps, out-of-range values and the longest gap.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param expected_interval query int false "Expected reporting interval (seconds), defaults to the box's expected interval and schedule, else 600"
+// @Success 200 {object} domain.QualityReport
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/quality [get]
+func (h *SensorHandler) QualityReport(c *gin.Context) {
+	boxID := c.Param("id")
+	if boxID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	query, interval, ok := parseQualityParams(c)
+	if !ok {
+		return
+	}
+
+	report, err := h.service.QualityReport(c.Request.Context(), boxID, query, interval)
+	if err != nil {
+		respondQualityError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GroupQualityReport godoc
+// @Summary Data-quality rollup for all boxes in a group
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param expected_interval query int false "Expected reporting interval (seconds), defaults to the box's expected interval and schedule, else 600"
+// @Success 200 {object} domain.GroupQualityReport
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/quality [get]
+func (h *SensorHandler) GroupQualityReport(c *gin.Context) {
+	groupID := c.Param("id")
+	if groupID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	query, interval, ok := parseQualityParams(c)
+	if !ok {
+		return
+	}
+
+	report, err := h.service.GroupQualityReport(c.Request.Context(), groupID, query, interval)
+	if err != nil {
+		respondQualityError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GroupInflow godoc
+// @Summary Estimate the inflow of a group's reservoir
+// @Description Inflow = dV/dt + Q + Q_of, per interval, in m³/s. V comes from the group's volume curve applied to the water level (WAU)
+// @Description of the level box: box_id, or the group's first box reporting WAU. The storage change of an interval runs from the last
+// @Description sample before it (no more than an interval earlier) to its last sample; outflow is the mean Q + Q_of of its samples.
+// @Description quality is complete, partial (fewer samples than the box's expected interval gives, or some without outflow) or missing (no estimate).
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param interval query string false "Interval" Enums(hour, day) default(hour)
+// @Param box_id query string false "Box measuring the reservoir level"
+// @Success 200 {object} domain.InflowSeries
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /groups/{id}/inflow [get]
+func (h *SensorHandler) GroupInflow(c *gin.Context) {
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	interval, ok := domain.InflowIntervals[c.DefaultQuery("interval", "hour")]
+	if !ok {
+		i18n.RespondError(c, http.StatusBadRequest, domain.ErrInvalidInflowInterval.Error())
+		return
+	}
+
+	series, err := h.service.GroupInflow(c.Request.Context(), c.Param("id"), c.Query("box_id"), &query, interval)
+	if err != nil {
+		switch err {
+		case domain.ErrTimeRangeRequired, domain.ErrInvalidTimeRange, domain.ErrInflowRangeTooLong:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxGroupNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrNoLevelBox:
+			i18n.RespondError(c, http.StatusUnprocessableEntity, err.Error())
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, series)
+}
+
+// GroupStatus godoc
+// @Summary Get the computed indicators of a group
+// @Description freeboard is the crest elevation of the dam (note.crest_elevation) minus the latest water level (WAU) of the group's
+// @Description primary box (primary_box_id), in m. severity is critical at or below 0.5 m, warning at or below 1 m, info above.
+// @Description When it cannot be computed, value is null and problems lists why: crest_elevation_missing, primary_box_missing,
+// @Description primary_box_not_found or water_level_missing.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.GroupStatus
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/status [get]
+func (h *SensorHandler) GroupStatus(c *gin.Context) {
+	status, err := h.service.GroupStatus(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func parseQualityParams(c *gin.Context) (*domain.QueryRecord, int64, bool) {
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return nil, 0, false
+	}
+
+	// 0 lets each box use its own expected interval
+	var interval int64
+	if v := c.Query("expected_interval"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			i18n.RespondError(c, http.StatusBadRequest, "expected_interval must be a positive number of seconds")
+			return nil, 0, false
+		}
+		interval = n
+	}
+
+	return &query, interval, true
+}
+
+func respondQualityError(c *gin.Context, err error) {
+	switch err {
+	case domain.ErrTimeRangeRequired, domain.ErrInvalidTimeRange, domain.ErrInvalidExpectedInterval:
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+	case domain.ErrBoxNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "box not found")
+	case domain.ErrBoxGroupNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "box group not found")
+	default:
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// CompareRecords godoc
+// @Summary Compare one metric across boxes
+// @Description Returns one series per box, averaged into buckets aligned to time_min so they can be charted together.
+// @Description Boxes without values for the metric return an empty series with a note.
+// @Tags records
+// @Security BearerAuth
+// @Produce json
+// @Param boxes query string true "Comma-separated box IDs"
+// @Param metric query string true "Metric code"
+// @Param time_min query int true "Min timestamp (seconds)"
+// @Param time_max query int true "Max timestamp (seconds)"
+// @Param buckets query int false "Number of buckets" default(500)
+// @Success 200 {object} domain.CompareResult
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /records/compare [get]
+func (h *SensorHandler) CompareRecords(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	boxIDs := httputil.QueryList(c, "boxes")
+	if len(boxIDs) == 0 {
+		i18n.RespondError(c, http.StatusBadRequest, "boxes parameter is required")
+		return
+	}
+
+	metric := c.Query("metric")
+	if metric == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "metric parameter is required")
+		return
+	}
+
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	buckets := domain.DefaultCompareBuckets
+	if b := c.Query("buckets"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n <= 0 {
+			i18n.RespondError(c, http.StatusBadRequest, "buckets must be a positive number")
+			return
+		}
+		buckets = n
+	}
+
+	result, err := h.service.CompareRecords(c.Request.Context(), user, boxIDs, metric, &query, buckets)
+	if err != nil {
+		switch err {
+		case domain.ErrTimeRangeRequired, domain.ErrInvalidTimeRange, domain.ErrInvalidMetricCode:
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		case domain.ErrBoxNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+		case domain.ErrBoxAccessDenied:
+			i18n.RespondError(c, http.StatusForbidden, "box access denied")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// ListRecordsByGroup godoc
+// @Summary List sensor records for all boxes in a group
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size, RECORD_PAGE_SIZE by default" default(10) maximum(1000)
+// @Param group_by query string false "Nest the page of records per box, with each box's metrics in display order" Enums(box)
+// @Param apply_calibration query bool false "Apply the box calibrations to the values" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies" default(false)
+// @Param include_deleted_boxes query bool false "Also read the boxes deleted after time_min, whose records are flagged with box_deleted" default(false)
+// @Success 200 {object} domain.PaginatedResponse
+// @Header 200 {string} Cache-Control "private, max-age=N when time_max is in a closed period, no-cache otherwise"
+// @Failure 400 {object} map[string]interface{}
+// @Router /groups/{id}/records [get]
+func (h *SensorHandler) ListRecordsByGroup(c *gin.Context) {
+	groupID := c.Param("id")
+	if groupID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	groupBy := c.Query("group_by")
+	if groupBy != "" && groupBy != "box" {
+		i18n.RespondError(c, http.StatusBadRequest, "group_by must be box")
+		return
+	}
+
+	pagination, err := domain.ParsePaginationWithLimits(c, h.recordPages)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var query domain.QueryRecord
+
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseCalibration(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseAnomalies(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	deletedBoxes, err := strconv.ParseBool(c.DefaultQuery("include_deleted_boxes", "false"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "include_deleted_boxes must be a boolean")
+		return
+	}
+	query.DeletedBoxes = deletedBoxes
+
+	limit := pagination.GetLimit()
+	skip := pagination.GetSkip()
+	query.Limit = &limit
+	query.Skip = &skip
+
+	result, err := h.service.ListRecordsByGroup(c.Request.Context(), groupID, &query)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filterInfo := timeRangeInfo(&query)
+	if deletedBoxes {
+		filterInfo["include_deleted_boxes"] = true
+	}
+
+	records := result.Records
+	if !isAdmin(c) {
+		domain.RedactRecords(records)
+	}
+	markCalibrated(c, &query)
+	h.setHistoryCaching(c, &query)
+	if groupBy == "box" {
+		filterInfo["group_by"] = groupBy
+		c.JSON(http.StatusOK, domain.NewPaginatedResponse(domain.NestRecordsByBox(records, result.Layouts), pagination.Page, pagination.PageSize, result.Total, filterInfo))
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(records, pagination.Page, pagination.PageSize, result.Total, filterInfo))
+}
+
+// ListRecordsLatestByGroup godoc
+// @Summary List sensor records latest for all boxes in a group
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param group_by query string false "Nest the records per box, with each box's metrics in display order" Enums(box)
+// @Success 200 {object} domain.PaginatedResponse
+// @Router /groups/{id}/records/latest [get]
+func (h *SensorHandler) ListRecordsLatestByGroup(c *gin.Context) {
+	groupID := c.Param("id")
+	if groupID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	groupBy := c.Query("group_by")
+	if groupBy != "" && groupBy != "box" {
+		i18n.RespondError(c, http.StatusBadRequest, "group_by must be box")
+		return
+	}
+
+	result, err := h.service.ListRecordsLatestByGroup(c.Request.Context(), groupID)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	records := result.Records
+	if !isAdmin(c) {
+		domain.RedactRecords(records)
+	}
+	var data interface{} = records
+	if groupBy == "box" {
+		data = domain.NestRecordsByBox(records, result.Layouts)
+	}
+
+	c.JSON(http.StatusOK, domain.PaginatedResponse{
+		Data: data,
+		Meta: domain.PaginationMeta{
+			TotalItems: result.Total,
+		},
+	})
+}
+
+// ExportRecords godoc
+// @Summary Export records to Excel for a box
+// @Description The box logs of the same period are exported on a second sheet.
+// @Description With apply_calibration=true the values are corrected and the box calibrations are listed on a third sheet.
+// @Description Non-numeric values are written as text on a highlighted cell and counted below the records.
+// @Description Answers 413 with the estimated rows and bytes when the range holds more rows than the export limit.
+// @Description Every export is recorded as a records_exported security event, listed by GET /admin/exports.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param id path string true "Box ID"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param apply_calibration query bool false "Apply the box calibrations to the values" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies" default(false)
+// @Success 200 {file} file
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Router /boxes/{id}/records/export [get]
+func (h *SensorHandler) ExportRecords(c *gin.Context) {
+	boxID := c.Param("id")
+	if boxID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
 	}
 
-	for i, header := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		f.SetCellValue(sheet, cell, header)
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseCalibration(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := parseAnomalies(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := h.service.CheckBoxExport(c.Request.Context(), boxID, &query); err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		if !respondExportTooLarge(c, err) {
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	result, err := h.service.ListRecords(c.Request.Context(), boxID, &query)
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	f := excelize.NewFile()
+	sheet := "Records"
+	f.SetSheetName("Sheet1", sheet)
+
+	layout, err := h.service.MetricLayout(c.Request.Context(), boxID)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
 	}
 
+	// Times are Excel datetimes, so they sort and show in the reader's locale
+	numbers := newExcelNumberStyles(f)
+	dateTimeStyle, err := numbers.dateTime()
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
 	style, _ := f.NewStyle(&excelize.Style{
 		Font:      &excelize.Font{Bold: true},
 		Alignment: &excelize.Alignment{Horizontal: "center"},
 	})
-	f.SetRowStyle(sheet, 1, 1, style)
-
-	// Set column widths
-	f.SetColWidth(sheet, "A", "A", 6)  // STT
-	f.SetColWidth(sheet, "B", "B", 20) // Time
-	if len(metricKeys) > 0 {
-		lastCol, _ := excelize.ColumnNumberToName(len(metricKeys) + 2)
-		f.SetColWidth(sheet, "C", lastCol, 12) // Metric columns
+	if err := writeRecordsSheet(f, sheet, result.Records, layout, numbers, style); err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	for rowIdx, record := range result.Records {
-		row := rowIdx + 2
+	// The box logs of the same period go on their own sheet
+	logs, err := h.service.BoxLogs(c.Request.Context(), boxID, &query)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-		// STT
-		cellSTT, _ := excelize.CoordinatesToCellName(1, row)
-		f.SetCellValue(sheet, cellSTT, rowIdx+1)
+	logSheet := "Logs"
+	f.NewSheet(logSheet)
+	f.SetColStyle(logSheet, "B", dateTimeStyle)
+	for i, header := range []string{"STT", "Time", "Category", "Author", "Note"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(logSheet, cell, header)
+	}
+	f.SetRowStyle(logSheet, 1, 1, style)
+	f.SetColWidth(logSheet, "A", "A", 6)
+	f.SetColWidth(logSheet, "B", "B", 20)
+	f.SetColWidth(logSheet, "C", "D", 16)
+	f.SetColWidth(logSheet, "E", "E", 60)
+
+	for i, entry := range logs {
+		row := i + 2
+		values := []interface{}{
+			i + 1,
+			time.Unix(entry.Timestamp, 0),
+			entry.Category,
+			entry.AuthorName,
+			entry.Text,
+		}
+		for col, value := range values {
+			cell, _ := excelize.CoordinatesToCellName(col+1, row)
+			f.SetCellValue(logSheet, cell, value)
+		}
+	}
 
-		// Time - check if timestamp is in seconds or milliseconds
-		timestamp := record.GetTimestamp()
-		if timestamp > 1e12 {
-			timestamp = timestamp / 1000
+	if query.Calibrate {
+		calibrations, err := h.service.BoxCalibrations(c.Request.Context(), boxID)
+		if err != nil {
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			return
 		}
-		timeStr := time.Unix(timestamp, 0).Format("2006-01-02 15:04:05")
-		cellTime, _ := excelize.CoordinatesToCellName(2, row)
-		f.SetCellValue(sheet, cellTime, timeStr)
 
-		for colIdx, key := range metricKeys {
-			cell, _ := excelize.CoordinatesToCellName(colIdx+3, row)
-			f.SetCellValue(sheet, cell, record.GetFloat(key))
+		calibrationSheet := "Calibrations"
+		f.NewSheet(calibrationSheet)
+		f.SetColStyle(calibrationSheet, "B", dateTimeStyle)
+		for i, header := range []string{"Metric", "Effective from", "Scale", "Offset", "Note"} {
+			cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+			f.SetCellValue(calibrationSheet, cell, header)
+		}
+		f.SetRowStyle(calibrationSheet, 1, 1, style)
+		f.SetColWidth(calibrationSheet, "B", "B", 20)
+		f.SetColWidth(calibrationSheet, "E", "E", 60)
+
+		for i, calibration := range calibrations {
+			row := i + 2
+			values := []interface{}{
+				calibration.Metric,
+				time.Unix(calibration.EffectiveFrom, 0),
+				calibration.Scale,
+				calibration.Offset,
+				calibration.Note,
+			}
+			for col, value := range values {
+				cell, _ := excelize.CoordinatesToCellName(col+1, row)
+				f.SetCellValue(calibrationSheet, cell, value)
+			}
 		}
 	}
 
 	filename := fmt.Sprintf("records_%s_%s.xlsx", boxID, time.Now().Format("20060102_150405"))
 
+	markCalibrated(c, &query)
 	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
 
+	audit := &domain.ExportAudit{Format: domain.ExportFormatXLSX, From: query.TimeMin, To: query.TimeMax, Rows: int64(len(result.Records))}
 	if err := f.Write(c.Writer); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		h.auditBoxExport(c, boxID, audit, domain.SecurityReasonInterrupted)
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.auditBoxExport(c, boxID, audit, "")
+}
+
+// ExportGroupRecords godoc
+// @Summary Export the records of every box in a group
+// @Description csv_long: one row per (timestamp, box, metric, value), streamed box by box.
+// @Description template: the group's export template filled with records and statistics; time_min and time_max are required.
+// @Description Answers 413 with the estimated rows and bytes when the range holds more rows than the export limit.
+// @Description Every export is recorded as a records_exported security event, listed by GET /admin/exports.
+// @Tags groups
+// @Security BearerAuth
+// @Produce text/csv
+// @Produce application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+// @Param id path string true "Group ID"
+// @Param format query string true "Export format" Enums(csv_long, template)
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param apply_calibration query bool false "Apply the box calibrations to the values (csv_long only)" default(false)
+// @Param exclude_anomalies query bool false "Leave out the values flagged as anomalies (csv_long only)" default(false)
+// @Success 200 {file} file
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Router /groups/{id}/records/export [get]
+func (h *SensorHandler) ExportGroupRecords(c *gin.Context) {
+	groupID := c.Param("id")
+	if groupID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	format, query, ok := parseGroupExport(c)
+	if !ok {
+		return
+	}
+	if format == "template" {
+		h.exportGroupTemplate(c, groupID, query)
+		return
+	}
+
+	export, err := h.service.PrepareGroupExport(c.Request.Context(), groupID)
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := h.service.CheckGroupExport(c.Request.Context(), export, query); err != nil {
+		if !respondExportTooLarge(c, err) {
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// Groups created without a code are identified by their ID
+	label := export.Group.Code
+	if label == "" {
+		label = export.Group.ID
+	}
+	filename := fmt.Sprintf("records_%s_%s_%s.csv", label, exportRangeLabel(query.TimeMin, "begin"), exportRangeLabel(query.TimeMax, "now"))
+
+	markCalibrated(c, query)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(domain.LongRecordCSVHeader)
+
+	audit := &domain.ExportAudit{Format: domain.ExportFormatCSVLong, GroupID: groupID, From: query.TimeMin, To: query.TimeMax}
+	err = h.service.StreamGroupExport(c.Request.Context(), export, query, func(row domain.LongRecordRow) error {
+		audit.Rows++
+		return w.Write(row.CSV())
+	})
+	w.Flush()
+
+	// Headers are already sent, so a failure can only cut the stream short
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		log.Printf("Export group %s records: %v", groupID, err)
+		h.auditExport(c, audit, domain.SecurityReasonInterrupted)
+		return
+	}
+	h.auditExport(c, audit, "")
+}
+
+// parseGroupExport reads the format and filters of a group export, answering 400 when they are invalid
+func parseGroupExport(c *gin.Context) (string, *domain.QueryRecord, bool) {
+	format := c.Query("format")
+	if format != "csv_long" && format != "template" {
+		i18n.RespondError(c, http.StatusBadRequest, "format must be csv_long or template")
+		return "", nil, false
+	}
+
+	var query domain.QueryRecord
+	if err := parseTimeRange(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	if err := parseCalibration(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+	if err := parseAnomalies(c, &query); err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return "", nil, false
+	}
+
+	if format == "template" {
+		if query.Calibrate {
+			i18n.RespondError(c, http.StatusBadRequest, "apply_calibration is not supported by template exports")
+			return "", nil, false
+		}
+		if query.ExcludeAnomalies {
+			i18n.RespondError(c, http.StatusBadRequest, "exclude_anomalies is not supported by template exports")
+			return "", nil, false
+		}
+	}
+	return format, &query, true
+}
+
+// exportGroupTemplate responds with the group's export template filled for the time range
+func (h *SensorHandler) exportGroupTemplate(c *gin.Context, groupID string, query *domain.QueryRecord) {
+	data, rows, err := h.service.ExportWithTemplate(c.Request.Context(), groupID, query, !isAdmin(c))
+	if err != nil {
+		respondGroupExportError(c, err)
+		return
+	}
+
+	filename := fmt.Sprintf("report_%s_%s_%s.xlsx", groupID, exportRangeLabel(query.TimeMin, "begin"), exportRangeLabel(query.TimeMax, "now"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", data)
+	h.auditExport(c, &domain.ExportAudit{Format: domain.ExportFormatTemplate, GroupID: groupID, From: query.TimeMin, To: query.TimeMax, Rows: rows}, "")
+}
+
+// respondGroupExportError answers a group export refused before any of it was sent
+func respondGroupExportError(c *gin.Context, err error) {
+	if verr, ok := err.(*domain.TemplateValidationError); ok {
+		body := i18n.Envelope(c, http.StatusUnprocessableEntity, verr.Error())
+		body["problems"] = verr.Problems
+		c.JSON(http.StatusUnprocessableEntity, body)
+		return
+	}
+	if respondExportTooLarge(c, err) {
+		return
+	}
+	switch err {
+	case domain.ErrTimeRangeRequired:
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+	case domain.ErrTooManyTemplateRows:
+		i18n.RespondError(c, http.StatusRequestEntityTooLarge, err.Error())
+	case domain.ErrBoxGroupNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "group not found")
+	case domain.ErrExportTemplateNotFound:
+		i18n.RespondError(c, http.StatusNotFound, "group has no export template")
+	default:
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// GetExportTemplate godoc
+// @Summary Get the export template of a group
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.ExportTemplate
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/export-template [get]
+func (h *SensorHandler) GetExportTemplate(c *gin.Context) {
+	template, err := h.service.GetExportTemplate(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrExportTemplateNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "export template not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
+
+// UploadExportTemplate godoc
+// @Summary Upload the export template of a group
+// @Description An xlsx file whose defined names mark where exported data goes. tp_records (required) and tp_stats
+// @Description refer to one row whose cells hold column keys; the row is repeated per record or statistic.
+// @Description tp_group, tp_from, tp_to and tp_generated refer to single cells. Replaces the previous template.
+// @Tags groups
+// @Security BearerAuth
+// @Accept multipart/form-data
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param file formData file true "xlsx template"
+// @Success 200 {object} domain.ExportTemplate
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /groups/{id}/export-template [put]
+func (h *SensorHandler) UploadExportTemplate(c *gin.Context) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "file is required")
+		return
+	}
+	if !strings.EqualFold(filepath.Ext(fileHeader.Filename), ".xlsx") {
+		i18n.RespondError(c, http.StatusBadRequest, "file must be .xlsx")
+		return
+	}
+	if fileHeader.Size > domain.MaxExportTemplateSize {
+		i18n.RespondError(c, http.StatusRequestEntityTooLarge, domain.ErrExportTemplateTooLarge.Error())
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, domain.MaxExportTemplateSize+1))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	template, err := h.service.SaveExportTemplate(c.Request.Context(), c.Param("id"), fileHeader.Filename, data, currentUserID(c))
+	if err != nil {
+		if verr, ok := err.(*domain.TemplateValidationError); ok {
+			body := i18n.Envelope(c, http.StatusUnprocessableEntity, verr.Error())
+			body["problems"] = verr.Problems
+			c.JSON(http.StatusUnprocessableEntity, body)
+			return
+		}
+		switch err {
+		case domain.ErrExportTemplateTooLarge:
+			i18n.RespondError(c, http.StatusRequestEntityTooLarge, err.Error())
+		case domain.ErrBoxGroupNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, template)
+}
+
+// DeleteExportTemplate godoc
+// @Summary Delete the export template of a group
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/export-template [delete]
+func (h *SensorHandler) DeleteExportTemplate(c *gin.Context) {
+	if err := h.service.DeleteExportTemplate(c.Request.Context(), c.Param("id")); err != nil {
+		if err == domain.ErrExportTemplateNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "export template not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "export template deleted"})
+}
+
+// UnconfiguredHydraulics godoc
+// @Summary List the groups whose boxes used the built-in hydraulics in the last 24 hours
+// @Description V, Q and Q_of of a group without a hydraulic configuration are derived with the built-in curves and a 10 m weir.
+// @Description Lists those groups with the boxes concerned and how many of their records this server derived that way
+// @Description since it started; each server of a deployment only sees the records it received.
+// @Tags admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /admin/hydraulics/unconfigured [get]
+func (h *SensorHandler) UnconfiguredHydraulics(c *gin.Context) {
+	groups, err := h.service.UnconfiguredHydraulics(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": groups})
+}
+
+// ExportHydraulics godoc
+// @Summary Export the hydraulic curves of a group
+// @Description The volume and flow curves and overflow parameters V, Q and Q_of are derived with. default is true when
+// @Description the group has no configuration of its own. The document can be imported into another group as is.
+// @Description warnings lists the boxes of the group whose recorded WAU range the curves do not cover.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.HydraulicsExport
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/hydraulics/export [get]
+func (h *SensorHandler) ExportHydraulics(c *gin.Context) {
+	export, err := h.service.ExportHydraulics(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, export)
+}
+
+// ImportHydraulics godoc
+// @Summary Import the hydraulic curves of a group
+// @Description Takes the document returned by the export endpoint, or copies the configuration of from_group.
+// @Description Curves need 2 to 500 finite points with strictly increasing levels and non-decreasing values; an invalid
+// @Description configuration is rejected with 422 and the offending points in problems. warnings lists the boxes of the
+// @Description group whose recorded WAU range the curves do not cover, which does not prevent the import.
+// @Description Each import is a new version of the group's hydraulics_<group id> setting, so it can be rolled back
+// @Description with POST /settings/{setting_id}/history/{version_id}/restore. Records already stored are not recomputed.
+// @Tags groups
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param from_group query string false "Group to copy the configuration from"
+// @Param request body domain.HydraulicsExport false "Exported configuration"
+// @Success 200 {object} domain.HydraulicsExport
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
+// @Router /groups/{id}/hydraulics/import [post]
+func (h *SensorHandler) ImportHydraulics(c *gin.Context) {
+	var export *domain.HydraulicsExport
+	var err error
+	if fromGroup := c.Query("from_group"); fromGroup != "" {
+		export, err = h.service.CopyHydraulics(c.Request.Context(), c.Param("id"), fromGroup, currentUserID(c))
+	} else {
+		var params domain.HydraulicsExport
+		if err := c.ShouldBindJSON(&params); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+		export, err = h.service.ImportHydraulics(c.Request.Context(), c.Param("id"), params.Hydraulics, currentUserID(c))
+	}
+	if err != nil {
+		if herr, ok := err.(*domain.HydraulicsError); ok {
+			body := i18n.Envelope(c, http.StatusUnprocessableEntity, "invalid hydraulic configuration")
+			body["problems"] = herr.Problems
+			c.JSON(http.StatusUnprocessableEntity, body)
+			return
+		}
+		switch err {
+		case domain.ErrBoxGroupNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+		case domain.ErrHydraulicsNotConfigured:
+			i18n.RespondError(c, http.StatusNotFound, "from_group has no hydraulic configuration")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
+
+	c.JSON(http.StatusOK, export)
+}
+
+// exportRangeLabel formats an optional time bound (seconds) for an export filename
+func exportRangeLabel(t *int64, open string) string {
+	if t == nil {
+		return open
+	}
+	return time.Unix(*t, 0).Format("20060102")
+}
+
+// parseTimeRange reads the optional time_min/time_max query params (seconds) into query
+func parseTimeRange(c *gin.Context, query *domain.QueryRecord) error {
+	if timeMin := c.Query("time_min"); timeMin != "" {
+		min, err := strconv.ParseInt(timeMin, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid time_min: %s", timeMin)
+		}
+		query.TimeMin = &min
+	}
+
+	if timeMax := c.Query("time_max"); timeMax != "" {
+		max, err := strconv.ParseInt(timeMax, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid time_max: %s", timeMax)
+		}
+		query.TimeMax = &max
+	}
+
+	return nil
+}
+
+// parseCalibration reads apply_calibration into query
+func parseCalibration(c *gin.Context, query *domain.QueryRecord) error {
+	apply, err := strconv.ParseBool(c.DefaultQuery("apply_calibration", "false"))
+	if err != nil {
+		return fmt.Errorf("apply_calibration must be a boolean")
+	}
+	query.Calibrate = apply
+	return nil
+}
+
+// parseAnomalies reads exclude_anomalies into query
+func parseAnomalies(c *gin.Context, query *domain.QueryRecord) error {
+	exclude, err := strconv.ParseBool(c.DefaultQuery("exclude_anomalies", "false"))
+	if err != nil {
+		return fmt.Errorf("exclude_anomalies must be a boolean")
+	}
+	query.ExcludeAnomalies = exclude
+	return nil
+}
+
+// parseInclude reads the include parameter listing what to merge into the records
+func parseInclude(c *gin.Context, query *domain.QueryRecord) error {
+	for _, include := range httputil.QueryList(c, "include") {
+		switch include {
+		case domain.IncludeObservations:
+			query.Observations = true
+		default:
+			return fmt.Errorf("include must list observations only")
+		}
+	}
+	return nil
+}
+
+// markCalibrated reports in X-Calibration-Applied that the values were corrected by the box calibrations
+func markCalibrated(c *gin.Context, query *domain.QueryRecord) {
+	if query.Calibrate {
+		c.Header("X-Calibration-Applied", "true")
+	}
+}
+
+// timeRangeInfo describes the applied time range, and whether values were calibrated or anomalies left out, for the response filter meta
+func timeRangeInfo(query *domain.QueryRecord) map[string]interface{} {
+	filterInfo := map[string]interface{}{}
+	if query.TimeMin != nil {
+		filterInfo["time_min"] = *query.TimeMin
+	}
+	if query.TimeMax != nil {
+		filterInfo["time_max"] = *query.TimeMax
+	}
+	if query.Calibrate {
+		filterInfo["apply_calibration"] = true
+	}
+	if query.ExcludeAnomalies {
+		filterInfo["exclude_anomalies"] = true
+	}
+	return filterInfo
+}
+
+// respondExportTooLarge answers 413 with the size estimate when err refuses an oversized export
+func respondExportTooLarge(c *gin.Context, err error) bool {
+	tooLarge, ok := err.(*domain.ExportTooLargeError)
+	if !ok {
+		return false
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error":           tooLarge.Error(),
+		"estimated_rows":  tooLarge.EstimatedRows,
+		"estimated_bytes": tooLarge.EstimatedBytes,
+		"max_rows":        tooLarge.MaxRows,
+	})
+	return true
 }
@@ -2,8 +2,10 @@ package handler
 
 import (
 	"net/http"
+	"regexp"
 
 	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
 	"tp25-api/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -26,6 +28,7 @@ func NewSettingHandler(service *service.SettingService) *SettingHandler {
 // @Security BearerAuth
 // @Produce json
 // @Param key query string false "Filter by key"
+// @Param prefix query string false "Filter by key prefix, e.g. alerts. for the alerts settings; ignored with key"
 // @Param page query int false "Page number" default(1)
 // @Param page_size query int false "Page size" default(10)
 // @Success 200 {object} domain.PaginatedResponse
@@ -36,13 +39,16 @@ func (h *SettingHandler) ListSettings(c *gin.Context) {
 	// Build filter
 	filter := bson.M{}
 	key := c.Query("key")
+	prefix := c.Query("prefix")
 	if key != "" {
 		filter["key"] = key
+	} else if prefix != "" {
+		filter["key"] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
 	}
 
 	settings, total, err := h.service.ListWithPagination(c.Request.Context(), pagination, filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -50,12 +56,53 @@ func (h *SettingHandler) ListSettings(c *gin.Context) {
 	var filterInfo interface{}
 	if key != "" {
 		filterInfo = map[string]string{"key": key}
+	} else if prefix != "" {
+		filterInfo = map[string]string{"prefix": prefix}
 	}
 
 	response := domain.NewPaginatedResponse(settings, pagination.Page, pagination.PageSize, total, filterInfo)
 	c.JSON(http.StatusOK, response)
 }
 
+// SettingValues godoc
+// @Summary Get the values of the settings under a prefix as a nested object
+// @Description Keys are split on dots below the prefix: alerts.email.to is returned as {"email": {"to": value}}
+// @Description for prefix=alerts. A key that is also the prefix of others has its own value under "" in their object.
+// @Tags settings
+// @Security BearerAuth
+// @Produce json
+// @Param prefix query string false "Namespace of the keys, with or without the trailing dot; every setting when empty"
+// @Success 200 {object} map[string]interface{}
+// @Router /settings/values [get]
+func (h *SettingHandler) SettingValues(c *gin.Context) {
+	values, err := h.service.Values(c.Request.Context(), c.Query("prefix"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, values)
+}
+
+// SettingKeyReport godoc
+// @Summary List the settings whose keys do not follow the naming convention
+// @Description Keys are lowercase segments of letters, digits and underscores separated by dots. Each older key
+// @Description is listed with the key to rename it to; conflict tells that another setting already uses it.
+// @Tags settings
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} domain.SettingKeyReport
+// @Router /settings/key-report [get]
+func (h *SettingHandler) SettingKeyReport(c *gin.Context) {
+	reports, err := h.service.KeyReport(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, reports)
+}
+
 // GetSetting godoc
 // @Summary Get setting by ID
 // @Tags settings
@@ -68,17 +115,17 @@ func (h *SettingHandler) ListSettings(c *gin.Context) {
 func (h *SettingHandler) GetSetting(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	setting, err := h.service.GetByID(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrSettingNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -89,17 +136,17 @@ func (h *SettingHandler) GetSetting(c *gin.Context) {
 func (h *SettingHandler) GetSettingByKey(c *gin.Context) {
 	key := c.Query("key")
 	if key == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "key parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "key parameter is required")
 		return
 	}
 
 	setting, err := h.service.GetByKey(c.Request.Context(), key)
 	if err != nil {
 		if err == domain.ErrSettingNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -112,6 +159,8 @@ func (h *SettingHandler) GetSettingByKey(c *gin.Context) {
 // @Security BearerAuth
 // @Accept json
 // @Produce json
+// @Description The key is lowercase segments of letters, digits and underscores separated by dots, the first naming
+// @Description the feature area, e.g. alerts.email_to
 // @Param request body domain.CreateSettingParams true "Setting data"
 // @Success 201 {object} domain.Setting
 // @Failure 400 {object} map[string]interface{}
@@ -119,17 +168,21 @@ func (h *SettingHandler) GetSettingByKey(c *gin.Context) {
 func (h *SettingHandler) CreateSetting(c *gin.Context) {
 	var params domain.CreateSettingParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	setting, err := h.service.Create(c.Request.Context(), params)
 	if err != nil {
+		if err == domain.ErrInvalidSettingKey {
+			i18n.RespondError(c, http.StatusBadRequest, "setting key must be lowercase segments of letters, digits and underscores separated by dots, e.g. alerts.email_to")
+			return
+		}
 		if err == domain.ErrSettingKeyExists {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "setting key already exists"})
+			i18n.RespondError(c, http.StatusBadRequest, "setting key already exists")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -155,17 +208,17 @@ func (h *SettingHandler) UpdateSetting(c *gin.Context) {
 	if key != "" {
 		var params domain.UpdateSettingParams
 		if err := c.ShouldBindJSON(&params); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			respondBindingError(c, err)
 			return
 		}
 
-		setting, err := h.service.UpdateByKey(c.Request.Context(), key, params)
+		setting, err := h.service.UpdateByKey(c.Request.Context(), key, params, currentUserID(c))
 		if err != nil {
 			if err == domain.ErrSettingNotFound {
-				c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+				i18n.RespondError(c, http.StatusNotFound, "setting not found")
 				return
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 			return
 		}
 
@@ -174,23 +227,23 @@ func (h *SettingHandler) UpdateSetting(c *gin.Context) {
 	}
 
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateSettingParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
-	setting, err := h.service.Update(c.Request.Context(), id, params)
+	setting, err := h.service.Update(c.Request.Context(), id, params, currentUserID(c))
 	if err != nil {
 		if err == domain.ErrSettingNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -201,23 +254,23 @@ func (h *SettingHandler) UpdateSetting(c *gin.Context) {
 func (h *SettingHandler) UpdateSettingByKey(c *gin.Context) {
 	key := c.Query("key")
 	if key == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "key parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "key parameter is required")
 		return
 	}
 
 	var params domain.UpdateSettingParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
-	setting, err := h.service.UpdateByKey(c.Request.Context(), key, params)
+	setting, err := h.service.UpdateByKey(c.Request.Context(), key, params, currentUserID(c))
 	if err != nil {
 		if err == domain.ErrSettingNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -236,19 +289,104 @@ func (h *SettingHandler) UpdateSettingByKey(c *gin.Context) {
 func (h *SettingHandler) DeleteSetting(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
-	err := h.service.Delete(c.Request.Context(), id)
+	err := h.service.Delete(c.Request.Context(), id, currentUserID(c))
 	if err != nil {
 		if err == domain.ErrSettingNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "setting not found"})
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "setting deleted successfully"})
 }
+
+// ListSettingHistory godoc
+// @Summary List the previous versions of a setting
+// @Description Every update, delete and restore records the value it replaced, newest first.
+// @Tags settings
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Setting ID"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Router /settings/{id}/history [get]
+func (h *SettingHandler) ListSettingHistory(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	pagination := domain.ParsePaginationParams(c)
+
+	versions, total, err := h.service.ListHistory(c.Request.Context(), id, pagination)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(versions, pagination.Page, pagination.PageSize, total, nil))
+}
+
+// RestoreSetting godoc
+// @Summary Restore a previous version of a setting
+// @Description Re-applies the version's value as a new version; the current value is kept in the history.
+// @Tags settings
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Setting ID"
+// @Param version_id path string true "Version ID"
+// @Success 200 {object} domain.Setting
+// @Failure 404 {object} map[string]interface{}
+// @Router /settings/{id}/history/{version_id}/restore [post]
+func (h *SettingHandler) RestoreSetting(c *gin.Context) {
+	id := c.Param("id")
+	versionID := c.Param("version_id")
+	if id == "" || versionID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id and version_id parameters are required")
+		return
+	}
+
+	setting, err := h.service.Restore(c.Request.Context(), id, versionID, currentUserID(c))
+	if err != nil {
+		if err == domain.ErrSettingVersionNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "setting version not found")
+			return
+		}
+		if err == domain.ErrSettingNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "setting not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, setting)
+}
+
+// currentUserID returns the ID of the authenticated user, used as the actor of setting changes
+func currentUserID(c *gin.Context) string {
+	if userVal, exists := c.Get("user"); exists {
+		if user, ok := userVal.(*domain.User); ok {
+			return user.ID
+		}
+	}
+	return ""
+}
+
+// isAdmin reports whether the authenticated user is an admin; responses hide admin-only fields otherwise
+func isAdmin(c *gin.Context) bool {
+	if userVal, exists := c.Get("user"); exists {
+		if user, ok := userVal.(*domain.User); ok {
+			return user.Role == domain.RoleAdmin
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SyncHandler struct {
+	service *service.SyncService
+}
+
+func NewSyncHandler(service *service.SyncService) *SyncHandler {
+	return &SyncHandler{service: service}
+}
+
+// Sync godoc
+// @Summary Zones, groups, boxes, metrics and settings changed since the last sync
+// @Description For offline clients keeping a local copy. Send the server_time of the previous response as since,
+// @Description or omit it on the first sync. Objects created or modified since are sent whole; deleted ones, and
+// @Description groups and boxes the user may no longer read, are listed in deleted as {kind, id, deleted: true}.
+// @Description With reset=true the response holds everything the user may read and local objects missing from it
+// @Description are to be dropped. Only the groups and boxes the user may read are sent, settings to admins only.
+// @Tags sync
+// @Security BearerAuth
+// @Produce json
+// @Param since query int false "server_time of the previous sync (milliseconds)" default(0)
+// @Success 200 {object} domain.SyncChanges
+// @Failure 400 {object} map[string]interface{}
+// @Router /sync [get]
+func (h *SyncHandler) Sync(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, domain.ErrInvalidSyncCursor.Error())
+		return
+	}
+
+	changes, err := h.service.Changes(c.Request.Context(), user, since)
+	if err != nil {
+		if err == domain.ErrInvalidSyncCursor {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
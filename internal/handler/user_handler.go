@@ -1,12 +1,22 @@
 package handler
 
 import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"tp25-api/internal/domain"
+	"tp25-api/internal/httputil"
+	"tp25-api/internal/i18n"
 	"tp25-api/internal/service"
 
 	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -37,7 +47,7 @@ func (h *UserHandler) ListUsers(c *gin.Context) {
 
 	users, total, err := h.service.ListUsersWithPagination(c.Request.Context(), pagination, filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -56,17 +66,17 @@ func (h *UserHandler) ListUsers(c *gin.Context) {
 func (h *UserHandler) GetUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	user, err := h.service.GetUser(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrUserNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -75,35 +85,184 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 
 // CreateUser godoc
 // @Summary Create a new user
+// @Description A monitor reads the groups listed in groups and every group of the zones in zone_ids.
 // @Tags users
 // @Security BearerAuth
 // @Accept json
 // @Produce json
 // @Param request body domain.CreateUserParams true "Create user params"
 // @Success 201 {object} domain.User
+// @Failure 400 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
 // @Router /users [post]
 func (h *UserHandler) CreateUser(c *gin.Context) {
 	var params domain.CreateUserParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	user, err := h.service.CreateUser(c.Request.Context(), params)
 	if err != nil {
 		if err == domain.ErrUsernameExisted {
-			c.JSON(http.StatusConflict, gin.H{"error": "username already exists"})
+			i18n.RespondError(c, http.StatusConflict, "username already exists")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrZoneNotFound {
+			i18n.RespondError(c, http.StatusBadRequest, "zone not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusCreated, user)
 }
 
+// ImportUsers godoc
+// @Summary Import users from a CSV or xlsx file
+// @Description Columns: username, full_name, role, phone, groups (semicolon-separated group IDs or names).
+// @Description Every row is validated first; if any row has errors nothing is created and the report is returned with 422.
+// @Tags users
+// @Security BearerAuth
+// @Accept multipart/form-data
+// @Produce json
+// @Param file formData file true "CSV or xlsx file"
+// @Param dry_run query bool false "Only validate, never create users"
+// @Param generate_passwords query bool false "Set a temporary password for each created user and return it"
+// @Success 200 {object} domain.ImportUsersResult
+// @Failure 400 {object} map[string]interface{}
+// @Failure 422 {object} domain.ImportUsersResult
+// @Router /users/import [post]
+func (h *UserHandler) ImportUsers(c *gin.Context) {
+	var opts domain.ImportUsersOptions
+	var err error
+	if v := c.Query("dry_run"); v != "" {
+		if opts.DryRun, err = strconv.ParseBool(v); err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid dry_run")
+			return
+		}
+	}
+	if v := c.Query("generate_passwords"); v != "" {
+		if opts.GeneratePasswords, err = strconv.ParseBool(v); err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid generate_passwords")
+			return
+		}
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	cells, err := readSpreadsheet(file, fileHeader.Filename)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rows, err := parseImportUserRows(cells)
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := h.service.ImportUsers(c.Request.Context(), rows, opts)
+	if err != nil {
+		if err == domain.ErrTooManyImportRows {
+			i18n.RespondError(c, http.StatusBadRequest, fmt.Sprintf("at most %d users can be imported at once", domain.MaxImportUsers))
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !result.Valid {
+		c.JSON(http.StatusUnprocessableEntity, result)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// readSpreadsheet returns the cells of a CSV file or of the first sheet of an xlsx file
+func readSpreadsheet(r io.Reader, filename string) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		return reader.ReadAll()
+	case ".xlsx":
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return f.GetRows(f.GetSheetName(0))
+	default:
+		return nil, errors.New("file must be .csv or .xlsx")
+	}
+}
+
+// parseImportUserRows maps spreadsheet cells to import rows using the header row.
+// Row numbers are 1-based spreadsheet rows so errors point at the right line; blank rows are skipped.
+func parseImportUserRows(cells [][]string) ([]domain.ImportUserRow, error) {
+	if len(cells) == 0 {
+		return nil, errors.New("file is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range cells[0] {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	for _, required := range []string{"username", "full_name", "role"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	cell := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []domain.ImportUserRow
+	for i, record := range cells[1:] {
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		row := domain.ImportUserRow{
+			Row:      i + 2,
+			Username: cell(record, "username"),
+			FullName: cell(record, "full_name"),
+			Role:     domain.Role(strings.ToLower(cell(record, "role"))),
+			Phone:    cell(record, "phone"),
+		}
+		if groups := httputil.SplitList(cell(record, "groups"), ";"); len(groups) > 0 {
+			row.Groups = groups
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
 // UpdateUser godoc
 // @Summary Update user
+// @Description zone_ids and groups replace the user's zones and groups when present.
 // @Tags users
 // @Security BearerAuth
 // @Accept json
@@ -111,27 +270,33 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 // @Param id path string true "User ID"
 // @Param request body domain.UpdateUserParams true "Update user params"
 // @Success 200 {object} domain.User
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /users/{id} [put]
 func (h *UserHandler) UpdateUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateUserParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	user, err := h.service.UpdateUser(c.Request.Context(), id, params)
 	if err != nil {
 		if err == domain.ErrUserNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		if err == domain.ErrZoneNotFound {
+			i18n.RespondError(c, http.StatusBadRequest, "zone not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -150,17 +315,17 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 func (h *UserHandler) DeleteUser(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	user, err := h.service.DeleteUser(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrUserNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -176,11 +341,12 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 // @Param id path string true "User ID"
 // @Param request body object{password=string} true "New Password"
 // @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /users/{id}/password [put]
 func (h *UserHandler) SetUserPassword(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
@@ -189,14 +355,181 @@ func (h *UserHandler) SetUserPassword(c *gin.Context) {
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	if err := h.service.SetPassword(c.Request.Context(), id, req.Password); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrUserNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	event := domain.NewSecurityEvent(domain.SecurityPasswordChanged)
+	event.SubjectID = id
+	event.Reason = domain.SecurityReasonAdmin
+	recordSecurityEvent(c, h.service, event)
+
 	c.JSON(http.StatusOK, gin.H{"message": "password set successfully"})
 }
+
+// ResetTwoFactor godoc
+// @Summary Reset two-factor authentication of a user (admin only)
+// @Description Removes the TOTP secret and backup codes so the user can log in with their password and enroll again.
+// @Tags users
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /users/{id}/2fa [delete]
+func (h *UserHandler) ResetTwoFactor(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	if err := h.service.ResetTwoFactor(c.Request.Context(), id); err != nil {
+		if err == domain.ErrUserNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "user not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	event := domain.NewSecurityEvent(domain.SecurityTwoFactorReset)
+	event.SubjectID = id
+	event.Reason = domain.SecurityReasonAdmin
+	recordSecurityEvent(c, h.service, event)
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication reset"})
+}
+
+// ListSecurityEvents godoc
+// @Summary List security events, newest first
+// @Description Logins, password and two-factor changes and session revocations, kept for SECURITY_EVENT_RETENTION.
+// @Description user_id matches the actor or the affected user; failed logins for unknown accounts only carry the username as typed.
+// @Tags users
+// @Security BearerAuth
+// @Produce json
+// @Param type query string false "Event type" Enums(login_succeeded, login_failed, password_changed, 2fa_enabled, 2fa_reset, tokens_revoked, records_exported)
+// @Param user_id query string false "Actor or affected user ID"
+// @Param username query string false "Username"
+// @Param ip query string false "Client IP"
+// @Param time_min query int false "Min timestamp (seconds)"
+// @Param time_max query int false "Max timestamp (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 400 {object} map[string]interface{}
+// @Router /admin/security-events [get]
+func (h *UserHandler) ListSecurityEvents(c *gin.Context) {
+	pagination := domain.ParsePaginationParams(c)
+
+	filter := domain.FilterSecurityEventParams{
+		Type:     domain.SecurityEventType(c.Query("type")),
+		UserID:   c.Query("user_id"),
+		Username: c.Query("username"),
+		IP:       c.Query("ip"),
+	}
+	filterInfo := map[string]interface{}{}
+	for key, value := range map[string]string{"type": string(filter.Type), "user_id": filter.UserID, "username": filter.Username, "ip": filter.IP} {
+		if value != "" {
+			filterInfo[key] = value
+		}
+	}
+	if timeMin := c.Query("time_min"); timeMin != "" {
+		t, err := strconv.ParseInt(timeMin, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_min")
+			return
+		}
+		filter.From = &t
+		filterInfo["time_min"] = t
+	}
+	if timeMax := c.Query("time_max"); timeMax != "" {
+		t, err := strconv.ParseInt(timeMax, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_max")
+			return
+		}
+		filter.To = &t
+		filterInfo["time_max"] = t
+	}
+
+	events, total, err := h.service.ListSecurityEvents(c.Request.Context(), pagination, filter)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(events, pagination.Page, pagination.PageSize, total, filterInfo))
+}
+
+// ListExports godoc
+// @Summary List record exports, newest first
+// @Description Who exported the records of which box or group, over which time range, in which format and how many rows,
+// @Description for data-protection reviews. Exports are records_exported security events, kept for SECURITY_EVENT_RETENTION;
+// @Description reason interrupted marks a stream cut short after rows were sent.
+// @Tags users
+// @Security BearerAuth
+// @Produce json
+// @Param user_id query string false "ID of the user who exported"
+// @Param box_id query string false "Box ID"
+// @Param group_id query string false "Group ID, also matching exports of its boxes"
+// @Param format query string false "Export format" Enums(xlsx, csv_long, template)
+// @Param time_min query int false "Min export time (seconds)"
+// @Param time_max query int false "Max export time (seconds)"
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size" default(10)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 400 {object} map[string]interface{}
+// @Router /admin/exports [get]
+func (h *UserHandler) ListExports(c *gin.Context) {
+	pagination := domain.ParsePaginationParams(c)
+
+	filter := domain.FilterSecurityEventParams{
+		Type:          domain.SecurityRecordsExported,
+		UserID:        c.Query("user_id"),
+		ExportBoxID:   c.Query("box_id"),
+		ExportGroupID: c.Query("group_id"),
+		ExportFormat:  c.Query("format"),
+	}
+	filterInfo := map[string]interface{}{}
+	for key, value := range map[string]string{"user_id": filter.UserID, "box_id": filter.ExportBoxID, "group_id": filter.ExportGroupID, "format": filter.ExportFormat} {
+		if value != "" {
+			filterInfo[key] = value
+		}
+	}
+	if timeMin := c.Query("time_min"); timeMin != "" {
+		t, err := strconv.ParseInt(timeMin, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_min")
+			return
+		}
+		filter.From = &t
+		filterInfo["time_min"] = t
+	}
+	if timeMax := c.Query("time_max"); timeMax != "" {
+		t, err := strconv.ParseInt(timeMax, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid time_max")
+			return
+		}
+		filter.To = &t
+		filterInfo["time_max"] = t
+	}
+
+	events, total, err := h.service.ListSecurityEvents(c.Request.Context(), pagination, filter)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, domain.NewPaginatedResponse(events, pagination.Page, pagination.PageSize, total, filterInfo))
+}
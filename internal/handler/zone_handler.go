@@ -1,20 +1,53 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"tp25-api/internal/domain"
+	"tp25-api/internal/httputil"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/middleware"
 	"tp25-api/internal/service"
 )
 
 type ZoneHandler struct {
-	service *service.ZoneService
+	service     *service.ZoneService
+	legacyBoxes bool
 }
 
 func NewZoneHandler(service *service.ZoneService) *ZoneHandler {
-	return &ZoneHandler{service: service}
+	return &ZoneHandler{service: service, legacyBoxes: true}
+}
+
+// SetLegacyBoxes sets whether the unversioned API still lists the boxes of a group under "boxs"
+// besides "boxes"
+func (h *ZoneHandler) SetLegacyBoxes(enabled bool) {
+	h.legacyBoxes = enabled
+}
+
+// legacyViews adds the deprecated "boxs" key to views served by the unversioned API and flags the
+// response as deprecated; /api/v2 only has "boxes"
+func (h *ZoneHandler) legacyViews(c *gin.Context, views []domain.ViewBox) []domain.ViewBox {
+	if !h.legacyBoxes || middleware.RequestAPIVersion(c) >= 2 {
+		return views
+	}
+	c.Header("Deprecation", "true")
+	c.Writer.Header().Add("Warning", `299 - "boxs is deprecated, read boxes or use /api/v2"`)
+	for i := range views {
+		views[i] = views[i].WithLegacyBoxes()
+	}
+	return views
+}
+
+func (h *ZoneHandler) legacyView(c *gin.Context, view *domain.ViewBox) *domain.ViewBox {
+	views := h.legacyViews(c, []domain.ViewBox{*view})
+	return &views[0]
 }
 
 // Zone endpoints
@@ -26,6 +59,7 @@ func NewZoneHandler(service *service.ZoneService) *ZoneHandler {
 // @Produce json
 // @Param page query int false "Page number" default(1)
 // @Param page_size query int false "Page size" default(10)
+// @Param fields query string false "Comma-separated optional fields to include" Enums(detail)
 // @Success 200 {object} domain.PaginatedResponse
 // @Router /zones [get]
 func (h *ZoneHandler) ListZones(c *gin.Context) {
@@ -34,9 +68,17 @@ func (h *ZoneHandler) ListZones(c *gin.Context) {
 	// Build filter
 	filter := bson.M{}
 
-	zones, total, err := h.service.ListZonesWithPagination(c.Request.Context(), pagination, filter)
+	// Detail can be large, so it is only listed on request; GET /zones/{id} always returns it
+	includeDetail := false
+	for _, field := range httputil.QueryList(c, "fields") {
+		if field == "detail" {
+			includeDetail = true
+		}
+	}
+
+	zones, total, err := h.service.ListZonesWithPagination(c.Request.Context(), pagination, filter, includeDetail)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -56,17 +98,17 @@ func (h *ZoneHandler) ListZones(c *gin.Context) {
 func (h *ZoneHandler) GetZone(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	zone, err := h.service.GetZone(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrZoneNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
+			i18n.RespondError(c, http.StatusNotFound, "zone not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -81,22 +123,31 @@ func (h *ZoneHandler) GetZone(c *gin.Context) {
 // @Produce json
 // @Param request body domain.CreateZoneParams true "Zone data"
 // @Success 201 {object} domain.Zone
+// @Failure 400 {object} map[string]interface{}
 // @Failure 409 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
 // @Router /zones [post]
 func (h *ZoneHandler) CreateZone(c *gin.Context) {
 	var params domain.CreateZoneParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	zone, err := h.service.CreateZone(c.Request.Context(), params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
 		if err == domain.ErrZoneCodeExisted {
-			c.JSON(http.StatusConflict, gin.H{"error": "zone code already exists"})
+			i18n.RespondError(c, http.StatusConflict, "zone code already exists")
+			return
+		}
+		if err == domain.ErrZoneDetailTooLarge {
+			i18n.RespondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("zone detail exceeds %d bytes", domain.MaxZoneDetailSize))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -112,83 +163,380 @@ func (h *ZoneHandler) CreateZone(c *gin.Context) {
 // @Param id path string true "Zone ID"
 // @Param request body domain.UpdateZoneParams true "Update data"
 // @Success 200 {object} domain.Zone
+// @Failure 400 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Failure 413 {object} map[string]interface{}
 // @Router /zones/{id} [put]
 func (h *ZoneHandler) UpdateZone(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateZoneParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	zone, err := h.service.UpdateZone(c.Request.Context(), id, params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
 		if err == domain.ErrZoneNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
+			i18n.RespondError(c, http.StatusNotFound, "zone not found")
+			return
+		}
+		if err == domain.ErrZoneCodeExisted {
+			i18n.RespondError(c, http.StatusConflict, "zone code already exists")
+			return
+		}
+		if err == domain.ErrZoneDetailTooLarge {
+			i18n.RespondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("zone detail exceeds %d bytes", domain.MaxZoneDetailSize))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, zone)
 }
 
+// OversizedZoneDetails godoc
+// @Summary List zones whose detail exceeds the size limit
+// @Description Zones saved before the limit was enforced; their detail must be trimmed before the next update.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /zones/oversized-details [get]
+func (h *ZoneHandler) OversizedZoneDetails(c *gin.Context) {
+	zones, err := h.service.OversizedZoneDetails(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"limit": domain.MaxZoneDetailSize, "zones": zones})
+}
+
+// InvalidLocations godoc
+// @Summary List zones, groups and boxes with invalid coordinates
+// @Description Documents saved before coordinates were validated; their location must be fixed before the next update.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /zones/invalid-locations [get]
+func (h *ZoneHandler) InvalidLocations(c *gin.Context) {
+	invalid, err := h.service.InvalidLocations(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := range invalid {
+		localizeProblems(c, invalid[i].Problems)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": invalid})
+}
+
+// InvalidGroupMaps godoc
+// @Summary List groups with an out-of-range zoom or blank camera entries
+// @Description Groups saved before their map settings were validated; zoom must be within 10-16 and cameras non-blank
+// @Description before the next update. Invalid centers are listed by /zones/invalid-locations.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /zones/invalid-group-maps [get]
+func (h *ZoneHandler) InvalidGroupMaps(c *gin.Context) {
+	invalid, err := h.service.InvalidGroupMaps(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := range invalid {
+		localizeProblems(c, invalid[i].Problems)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": invalid})
+}
+
+// BoxZoneMismatches godoc
+// @Summary List boxes whose zone is not their group's
+// @Description Such boxes are missing from the listings of their group's zone. Boxes of deleted groups are not listed.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /zones/box-zone-mismatches [get]
+func (h *ZoneHandler) BoxZoneMismatches(c *gin.Context) {
+	mismatches, err := h.service.BoxZoneMismatches(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": mismatches})
+}
+
+// FixBoxZoneMismatches godoc
+// @Summary Move boxes to the zone of their group
+// @Description Sets zone_id of every box listed by GET /zones/box-zone-mismatches to its group's zone and lists the boxes moved.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /zones/box-zone-mismatches/fix [post]
+func (h *ZoneHandler) FixBoxZoneMismatches(c *gin.Context) {
+	fixed, err := h.service.FixBoxZoneMismatches(c.Request.Context())
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": fixed, "fixed": len(fixed)})
+}
+
 // BoxGroup endpoints
 
 // ListGroups godoc
 // @Summary List box groups
+// @Description Without page, page_size, q or include_boxes the unpaginated array of groups with boxes is returned (deprecated).
+// @Description Users given the zone (zone_ids) see all of its groups, others only the groups assigned to them.
+// @Description Boxes are listed under boxes, by sort_order then ID. The unversioned API also lists them under the deprecated
+// @Description boxs key, which /api/v2 drops.
 // @Tags zones
 // @Security BearerAuth
 // @Produce json
 // @Param id path string true "Zone ID"
-// @Success 200 {array} domain.ViewBox
+// @Param page query int false "Page number" default(1)
+// @Param page_size query int false "Page size; at most 50 with include_boxes, otherwise capped at 100" default(10) maximum(100)
+// @Param q query string false "Search by group name"
+// @Param include_boxes query bool false "Expand boxes of each group" default(true)
+// @Param include_archived query bool false "Also list archived groups (admins only, ignored for other roles)" default(false)
+// @Success 200 {object} domain.PaginatedResponse
+// @Failure 400 {object} map[string]interface{}
 // @Router /zones/{id}/groups [get]
 func (h *ZoneHandler) ListGroups(c *gin.Context) {
 	zoneID := c.Param("id")
 
-	groups, err := h.service.ListGroups(c.Request.Context(), zoneID)
+	// Users without access to the whole zone only see the groups they may read in it
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
+	restricted := !user.CanAccessZone(zoneID)
+
+	_, hasPage := c.GetQuery("page")
+	_, hasPageSize := c.GetQuery("page_size")
+	_, hasIncludeBoxes := c.GetQuery("include_boxes")
+	q := c.Query("q")
+
+	includeArchived, err := strconv.ParseBool(c.DefaultQuery("include_archived", "false"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "include_archived must be a boolean")
+		return
+	}
+	includeArchived = includeArchived && isAdmin(c)
+
+	// Legacy behavior: every group with its boxes, no envelope
+	if !hasPage && !hasPageSize && !hasIncludeBoxes && q == "" {
+		groups, err := h.service.ListGroups(c.Request.Context(), zoneID, includeArchived)
+		if err != nil {
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if restricted {
+			readable := groups[:0]
+			for _, group := range groups {
+				if user.CanAccessGroup(group.ID) {
+					readable = append(readable, group)
+				}
+			}
+			groups = readable
+		}
+		if !isAdmin(c) {
+			groups = domain.RedactViewBoxes(groups)
+		}
+
+		c.Header("Deprecation", "true")
+		c.Header("Warning", `299 - "unpaginated group listing is deprecated, use page and page_size"`)
+		c.JSON(http.StatusOK, h.legacyViews(c, groups))
+		return
+	}
+
+	includeBoxes, err := strconv.ParseBool(c.DefaultQuery("include_boxes", "true"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusBadRequest, "include_boxes must be a boolean")
 		return
 	}
 
-	c.JSON(http.StatusOK, groups)
+	// Expanding boxes makes each group heavy, so those pages are kept smaller
+	pagination := domain.ParsePaginationParams(c)
+	if includeBoxes {
+		pagination, err = domain.ParsePaginationWithLimits(c, domain.GroupBoxesPageLimits)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	filter := domain.FilterGroupParams{ZoneID: zoneID, IncludeArchived: includeArchived}
+	if restricted {
+		filter.GroupIDs = user.ReadableGroups()
+	}
+	if q != "" {
+		filter.Query = &q
+	}
+
+	groups, total, err := h.service.ListGroupsWithPagination(c.Request.Context(), pagination, filter)
+	if err != nil {
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Build filter info
+	filterInfo := map[string]interface{}{
+		"zone_id":          zoneID,
+		"include_boxes":    includeBoxes,
+		"include_archived": includeArchived,
+	}
+	if q != "" {
+		filterInfo["q"] = q
+	}
+
+	var data interface{} = groups
+	if includeBoxes {
+		views := h.service.ExpandGroups(c.Request.Context(), groups)
+		if !isAdmin(c) {
+			views = domain.RedactViewBoxes(views)
+		}
+		data = h.legacyViews(c, views)
+	} else if !isAdmin(c) {
+		data = domain.RedactGroups(groups)
+	}
+
+	response := domain.NewPaginatedResponse(data, pagination.Page, pagination.PageSize, total, filterInfo)
+	c.JSON(http.StatusOK, response)
 }
 
 // GetGroup godoc
 // @Summary Get box group by ID
+// @Description subdomain, the boxes' device_id and the engineering part of note are returned to admins only.
+// @Description Boxes are listed under boxes, by sort_order then ID; see GET /zones/{id}/groups about the deprecated boxs key.
+// @Description camera_status holds the health of each camera, see GET /groups/{id}/cameras/status.
+// @Description Last-Modified is the latest change to the group, its boxes or its camera checks; given it back as
+// @Description If-Modified-Since, or as modified_since in seconds, the group is only sent again once it changed.
+// @Description exclude leaves out the note of the group and/or the metrics of every box, most of a large group's payload.
 // @Tags groups
 // @Security BearerAuth
 // @Produce json
 // @Param id path string true "Group ID"
+// @Param modified_since query int false "Answer 304 unless the group changed after this time (seconds); overrides If-Modified-Since"
+// @Param If-Modified-Since header string false "Answer 304 unless the group changed after this HTTP date"
+// @Param exclude query string false "Comma-separated fields to leave out" Enums(note, metrics)
 // @Success 200 {object} domain.ViewBox
+// @Success 304 "Not modified"
+// @Header 200 {string} Last-Modified "Latest change to the group, its boxes or its camera checks"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
 // @Router /groups/{id} [get]
 func (h *ZoneHandler) GetGroup(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	exclude := httputil.QueryList(c, "exclude")
+	for _, field := range exclude {
+		if field != domain.ViewExcludeNote && field != domain.ViewExcludeMetrics {
+			i18n.RespondError(c, http.StatusBadRequest, "exclude must list note or metrics")
+			return
+		}
+	}
+
+	var since *int64
+	if value := c.Query("modified_since"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid modified_since")
+			return
+		}
+		since = &seconds
+	} else if value := c.GetHeader("If-Modified-Since"); value != "" {
+		// An unparsable date is ignored, as HTTP has it
+		if t, err := http.ParseTime(value); err == nil {
+			seconds := t.Unix()
+			since = &seconds
+		}
+	}
+
+	// The modification time is read before the view is built, so an unchanged group costs one aggregation
+	modifiedAt, err := h.service.GroupModifiedAt(c.Request.Context(), id)
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Header("Last-Modified", time.UnixMilli(modifiedAt).UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "private, no-cache")
+	if since != nil && modifiedAt/1000 <= *since {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
 	group, err := h.service.GetGroup(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrBoxGroupNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box group not found"})
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusOK, group)
+	if !isAdmin(c) {
+		redacted := group.Redacted()
+		group = &redacted
+	}
+	view := group.Excluding(exclude...)
+
+	c.JSON(http.StatusOK, h.legacyView(c, &view))
+}
+
+// CameraStatus godoc
+// @Summary Get the health of a group's cameras
+// @Description Each camera as of its last check: http(s) URLs are probed with HEAD (OPTIONS when HEAD is not allowed), rtsp URLs with DESCRIBE.
+// @Description state is ok, failing, or unchecked for a camera not probed yet or not given as such a URL. Times are in seconds.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {array} domain.CameraStatus
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/cameras/status [get]
+func (h *ZoneHandler) CameraStatus(c *gin.Context) {
+	statuses, err := h.service.CameraStatus(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, statuses)
 }
 
 // CreateGroup godoc
@@ -200,11 +548,13 @@ func (h *ZoneHandler) GetGroup(c *gin.Context) {
 // @Param id path string true "Zone ID"
 // @Param request body domain.CreateGroupParams true "Group data"
 // @Success 201 {object} domain.BoxGroup
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /zones/{id}/groups [post]
 func (h *ZoneHandler) CreateGroup(c *gin.Context) {
 	var params domain.CreateGroupParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -216,7 +566,14 @@ func (h *ZoneHandler) CreateGroup(c *gin.Context) {
 
 	group, err := h.service.CreateGroup(c.Request.Context(), params)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if respondValidationError(c, err) {
+			return
+		}
+		if err == domain.ErrZoneNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "zone not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -225,6 +582,10 @@ func (h *ZoneHandler) CreateGroup(c *gin.Context) {
 
 // UpdateGroup godoc
 // @Summary Update box group
+// @Description branding replaces the public dashboard theme: primary_color is a #rgb or #rrggbb hex color and logo_url an https URL.
+// @Description zone_id moves the group and all of its boxes to another zone; users keep access through their groups.
+// @Description primary_box_id names the box of the group whose water level the freeboard of GET /groups/{id}/status is computed from
+// @Description ("" clears it); crest_elevation sets note.crest_elevation, the dam crest elevation in m.
 // @Tags groups
 // @Security BearerAuth
 // @Accept json
@@ -232,34 +593,156 @@ func (h *ZoneHandler) CreateGroup(c *gin.Context) {
 // @Param id path string true "Group ID"
 // @Param request body domain.UpdateGroupParams true "Update data"
 // @Success 200 {object} domain.ViewBox
+// @Failure 400 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
 // @Router /groups/{id} [put]
 func (h *ZoneHandler) UpdateGroup(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateGroupParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	group, err := h.service.UpdateGroup(c.Request.Context(), id, params)
+	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
+		if err == domain.ErrInvalidBrandingColor || err == domain.ErrInvalidBrandingLogoURL || err == domain.ErrBrandingTextTooLong {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, h.legacyView(c, group))
+}
+
+// GetPublicGroup godoc
+// @Summary Get the group and branding of a public dashboard subdomain
+// @Tags public
+// @Produce json
+// @Param subdomain path string true "Subdomain"
+// @Success 200 {object} domain.PublicGroup
+// @Failure 404 {object} map[string]interface{}
+// @Router /public/groups/{subdomain} [get]
+func (h *ZoneHandler) GetPublicGroup(c *gin.Context) {
+	group, err := h.service.GetPublicGroup(c.Request.Context(), c.Param("subdomain"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+// ArchiveGroup godoc
+// @Summary Archive box group
+// @Description Hides the group from group listings unless include_archived=true. Unlike delete, the group stays readable
+// @Description and its boxes keep accepting records.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.BoxGroup
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/archive [put]
+func (h *ZoneHandler) ArchiveGroup(c *gin.Context) {
+	group, err := h.service.ArchiveGroup(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+// UnarchiveGroup godoc
+// @Summary Unarchive box group
+// @Description Lists the group again.
+// @Tags groups
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} domain.BoxGroup
+// @Failure 404 {object} map[string]interface{}
+// @Router /groups/{id}/unarchive [put]
+func (h *ZoneHandler) UnarchiveGroup(c *gin.Context) {
+	group, err := h.service.UnarchiveGroup(c.Request.Context(), c.Param("id"))
 	if err != nil {
 		if err == domain.ErrBoxGroupNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box group not found"})
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, group)
 }
 
+// CloneGroup godoc
+// @Summary Copy a group with its boxes and hydraulic configuration
+// @Description Records are not copied. The copied boxes get the source device IDs followed by device_id_suffix
+// @Description ("-copy-" and a random tag when omitted), since device IDs must stay unique. zone_id defaults to the source group's zone.
+// @Tags groups
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param request body domain.CloneGroupParams true "Name of the copy"
+// @Success 201 {object} domain.ViewBox
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /groups/{id}/clone [post]
+func (h *ZoneHandler) CloneGroup(c *gin.Context) {
+	var params domain.CloneGroupParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	group, err := h.service.CloneGroup(c.Request.Context(), c.Param("id"), params)
+	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
+		switch err {
+		case domain.ErrBoxGroupNotFound:
+			i18n.RespondError(c, http.StatusNotFound, "group not found")
+		case domain.ErrSubdomainTaken:
+			i18n.RespondError(c, http.StatusConflict, err.Error())
+		case domain.ErrBoxDeviceExisted:
+			i18n.RespondError(c, http.StatusConflict, "box device already exists")
+		default:
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, h.legacyView(c, group))
+}
+
 // DeleteGroup godoc
 // @Summary Delete box group (soft delete)
 // @Tags groups
@@ -273,17 +756,17 @@ func (h *ZoneHandler) UpdateGroup(c *gin.Context) {
 func (h *ZoneHandler) DeleteGroup(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	group, err := h.service.DeleteGroup(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrBoxGroupNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box group not found"})
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -294,6 +777,7 @@ func (h *ZoneHandler) DeleteGroup(c *gin.Context) {
 
 // ListAllBoxes godoc
 // @Summary List all boxes
+// @Description Non-admins, API keys included, only get the boxes of the groups they may read.
 // @Tags boxes
 // @Security BearerAuth
 // @Produce json
@@ -305,13 +789,21 @@ func (h *ZoneHandler) ListAllBoxes(c *gin.Context) {
 	pagination := domain.ParsePaginationParams(c)
 
 	var filter domain.FilterBoxParams
+	if !isAdmin(c) {
+		userVal, _ := c.Get("user")
+		filter.GroupIDs = userVal.(*domain.User).ReadableGroups()
+	}
 
 	boxes, total, err := h.service.ListBoxesWithPagination(c.Request.Context(), pagination, filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if !isAdmin(c) {
+		boxes = domain.RedactBoxes(boxes)
+	}
+
 	response := domain.NewPaginatedResponse(boxes, pagination.Page, pagination.PageSize, total, nil)
 	c.JSON(http.StatusOK, response)
 }
@@ -325,6 +817,7 @@ func (h *ZoneHandler) ListAllBoxes(c *gin.Context) {
 // @Param page query int false "Page number" default(1)
 // @Param page_size query int false "Page size" default(10)
 // @Success 200 {object} domain.PaginatedResponse
+// @Failure 403 {object} map[string]interface{}
 // @Router /groups/{id}/boxes [get]
 func (h *ZoneHandler) ListBoxes(c *gin.Context) {
 	groupID := c.Param("id")
@@ -336,10 +829,14 @@ func (h *ZoneHandler) ListBoxes(c *gin.Context) {
 
 	boxes, total, err := h.service.ListBoxesWithPagination(c.Request.Context(), pagination, filter)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if !isAdmin(c) {
+		boxes = domain.RedactBoxes(boxes)
+	}
+
 	// Build filter info
 	filterInfo := map[string]interface{}{
 		"group_id": groupID,
@@ -351,30 +848,37 @@ func (h *ZoneHandler) ListBoxes(c *gin.Context) {
 
 // GetBox godoc
 // @Summary Get box by ID
+// @Description Includes the latest box log. device_id is returned to admins only.
 // @Tags boxes
 // @Security BearerAuth
 // @Produce json
 // @Param id path string true "Box ID"
 // @Success 200 {object} domain.Box
+// @Failure 403 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
 // @Router /boxes/{id} [get]
 func (h *ZoneHandler) GetBox(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	box, err := h.service.GetBox(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrBoxNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box not found"})
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if !isAdmin(c) {
+		redacted := box.Redacted()
+		box = &redacted
+	}
+
 	c.JSON(http.StatusOK, box)
 }
 
@@ -385,14 +889,19 @@ func (h *ZoneHandler) GetBox(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path string true "Group ID"
+// @Description zone_id defaults to the group's zone; another zone answers 422.
 // @Param request body domain.CreateBoxParams true "Box data"
+// @Param allow_unknown_metrics query bool false "Accept metrics missing from the metric catalog, listing them under warnings"
 // @Success 201 {object} domain.Box
+// @Failure 400 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Failure 409 {object} map[string]interface{}
+// @Failure 422 {object} map[string]interface{}
 // @Router /groups/{id}/boxes [post]
 func (h *ZoneHandler) CreateBox(c *gin.Context) {
 	var params domain.CreateBoxParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -401,18 +910,39 @@ func (h *ZoneHandler) CreateBox(c *gin.Context) {
 	if groupID != "" {
 		params.GroupID = groupID
 	}
+	allowUnknown, err := strconv.ParseBool(c.DefaultQuery("allow_unknown_metrics", "false"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "allow_unknown_metrics must be a boolean")
+		return
+	}
+	params.AllowUnknownMetrics = allowUnknown
 
-	box, err := h.service.CreateBox(c.Request.Context(), params)
+	box, warnings, err := h.service.CreateBox(c.Request.Context(), params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
+			return
+		}
 		if err == domain.ErrBoxDeviceExisted {
-			c.JSON(http.StatusConflict, gin.H{"error": "box device already exists"})
+			i18n.RespondError(c, http.StatusConflict, "box device already exists")
+			return
+		}
+		if err == domain.ErrBoxZoneMismatch {
+			i18n.RespondError(c, http.StatusUnprocessableEntity, "zone_id does not match the zone of the group")
+			return
+		}
+		if err == domain.ErrInvalidMergePolicy || err == domain.ErrInvalidDedupPolicy || err == domain.ErrInvalidAnomalyPolicy || err == domain.ErrInvalidExpectedInterval || err == domain.ErrInvalidReportingSchedule || err == domain.ErrInvalidUnitConversion || err == domain.ErrInvalidMoveTime {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	c.JSON(http.StatusCreated, box)
+	respondWithWarnings(c, http.StatusCreated, box, warnings)
 }
 
 // UpdateBox godoc
@@ -422,30 +952,176 @@ func (h *ZoneHandler) CreateBox(c *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param id path string true "Box ID"
+// @Description Changing location keeps the previous one in the box's location history (GET /boxes/{id}/locations),
+// @Description valid until moved_at (seconds, now when omitted). Changing group_id also moves the box to that group's zone.
 // @Param request body domain.UpdateBoxParams true "Update data"
+// @Param allow_unknown_metrics query bool false "Accept metrics missing from the metric catalog, listing them under warnings"
 // @Success 200 {object} domain.Box
+// @Failure 400 {object} map[string]interface{}
 // @Failure 404 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
 // @Router /boxes/{id} [put]
 func (h *ZoneHandler) UpdateBox(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	var params domain.UpdateBoxParams
 	if err := c.ShouldBindJSON(&params); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
+	allowUnknown, err := strconv.ParseBool(c.DefaultQuery("allow_unknown_metrics", "false"))
+	if err != nil {
+		i18n.RespondError(c, http.StatusBadRequest, "allow_unknown_metrics must be a boolean")
+		return
+	}
+	params.AllowUnknownMetrics = allowUnknown
 
-	box, err := h.service.UpdateBox(c.Request.Context(), id, params)
+	box, warnings, err := h.service.UpdateBox(c.Request.Context(), id, params)
 	if err != nil {
+		if respondValidationError(c, err) {
+			return
+		}
 		if err == domain.ErrBoxNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box not found"})
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		if err == domain.ErrBoxGroupNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box group not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if err == domain.ErrBoxDeviceExisted {
+			i18n.RespondError(c, http.StatusConflict, "box device already exists")
+			return
+		}
+		if err == domain.ErrInvalidMergePolicy || err == domain.ErrInvalidDedupPolicy || err == domain.ErrInvalidAnomalyPolicy || err == domain.ErrInvalidExpectedInterval || err == domain.ErrInvalidReportingSchedule || err == domain.ErrInvalidUnitConversion || err == domain.ErrInvalidMoveTime {
+			i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithWarnings(c, http.StatusOK, box, warnings)
+}
+
+// ListBoxLocations godoc
+// @Summary List the locations of a box
+// @Description Every location the box stood at, oldest first, ending with the current one. from and to are in seconds;
+// @Description from is omitted for the location the box was created with, to for the current one.
+// @Description With at (seconds), only the location valid at that time is returned.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param at query int false "Time the location was valid at (seconds)"
+// @Success 200 {array} domain.LocationPeriod
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/locations [get]
+func (h *ZoneHandler) ListBoxLocations(c *gin.Context) {
+	id := c.Param("id")
+
+	if at := c.Query("at"); at != "" {
+		timestamp, err := strconv.ParseInt(at, 10, 64)
+		if err != nil {
+			i18n.RespondError(c, http.StatusBadRequest, "invalid at")
+			return
+		}
+		location, err := h.service.BoxLocationAt(c.Request.Context(), id, timestamp)
+		if err != nil {
+			if err == domain.ErrBoxNotFound {
+				i18n.RespondError(c, http.StatusNotFound, "box not found")
+				return
+			}
+			i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, location)
+		return
+	}
+
+	locations, err := h.service.BoxLocations(c.Request.Context(), id)
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, locations)
+}
+
+// DecommissionBox godoc
+// @Summary Decommission box
+// @Description The box stays listed and its records readable, but records timestamped after decommissioned_at are rejected.
+// @Tags boxes
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path string true "Box ID"
+// @Param request body domain.DecommissionBoxParams false "Decommission date, now when omitted"
+// @Success 200 {object} domain.Box
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/decommission [put]
+func (h *ZoneHandler) DecommissionBox(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	var params domain.DecommissionBoxParams
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&params); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+
+	box, err := h.service.DecommissionBox(c.Request.Context(), id, params.DecommissionedAt)
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, box)
+}
+
+// RecommissionBox godoc
+// @Summary Recommission box
+// @Description Clears the decommission date so the box accepts records again.
+// @Tags boxes
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Box ID"
+// @Success 200 {object} domain.Box
+// @Failure 404 {object} map[string]interface{}
+// @Router /boxes/{id}/decommission [delete]
+func (h *ZoneHandler) RecommissionBox(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
+		return
+	}
+
+	box, err := h.service.RecommissionBox(c.Request.Context(), id)
+	if err != nil {
+		if err == domain.ErrBoxNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -465,17 +1141,17 @@ func (h *ZoneHandler) UpdateBox(c *gin.Context) {
 func (h *ZoneHandler) DeleteBox(c *gin.Context) {
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "id parameter is required")
 		return
 	}
 
 	box, err := h.service.DeleteBox(c.Request.Context(), id)
 	if err != nil {
 		if err == domain.ErrBoxNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "box not found"})
+			i18n.RespondError(c, http.StatusNotFound, "box not found")
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
@@ -489,86 +1165,134 @@ func (h *ZoneHandler) DeleteBox(c *gin.Context) {
 // @Tags zones
 // @Security BearerAuth
 // @Produce json
-// @Param group query string true "Group ID"
+// @Param group query string false "Group ID, required without zone"
+// @Param zone query string false "Zone ID: report every group of the zone the user may read instead of one group"
+// @Description Closed months are served from a cache; the X-Report-Cache header tells whether every box (hit), some (partial) or none (miss) came from it.
+// @Description With zone, the response is a domain.ZoneReport: the reports of each group keyed by group ID, with an error entry for a group
+// @Description whose report failed. Metrics times groups may not exceed 500. Metrics must be codes of the metric catalog.
+// @Description Boxes that never received a record are skipped. Boxes whose records could not be aggregated are left out: a group
+// @Description report then carries X-Report-Partial: true and the box IDs in X-Report-Failed-Boxes, and a group of a zone report
+// @Description is flagged partial, with its failed_boxes.
 // @Param metrics query string false "Comma-separated metrics list"
+// @Param refresh query bool false "Recompute every month and rebuild the cache (admins only)"
+// @Param include_deleted_boxes query bool false "Also report the months of the group's deleted boxes, flagged with box_deleted" default(false)
 // @Success 200 {array} domain.Report
+// @Header 200 {string} X-Report-Cache "hit, partial or miss"
+// @Header 200 {string} X-Report-Partial "true when boxes were left out"
+// @Header 200 {string} X-Report-Failed-Boxes "Comma-separated IDs of the boxes left out"
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Failure 404 {object} map[string]interface{}
 // @Router /zones/reports [get]
 func (h *ZoneHandler) ReportByMetric(c *gin.Context) {
 	groupID := c.Query("group")
-	if groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "group parameter is required"})
+	zoneID := c.Query("zone")
+	if groupID == "" && zoneID == "" {
+		i18n.RespondError(c, http.StatusBadRequest, "group or zone parameter is required")
+		return
+	}
+	if groupID != "" && zoneID != "" {
+		i18n.RespondError(c, http.StatusBadRequest, "group and zone cannot be combined")
 		return
 	}
 
 	metricsStr := c.Query("metrics")
 	if metricsStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "metrics parameter is required"})
+		i18n.RespondError(c, http.StatusBadRequest, "metrics parameter is required")
 		return
 	}
 
-	// Split comma-separated metrics
-	metrics := []string{}
-	for _, m := range splitAndTrim(metricsStr, ",") {
-		if m != "" {
-			metrics = append(metrics, m)
-		}
+	metrics := httputil.SplitList(metricsStr, ",")
+	if len(metrics) == 0 {
+		i18n.RespondError(c, http.StatusBadRequest, "at least one metric is required")
+		return
 	}
 
-	if len(metrics) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one metric is required"})
+	refresh := c.Query("refresh") == "true"
+	if refresh && !isAdmin(c) {
+		i18n.RespondError(c, http.StatusForbidden, "only admins can refresh reports")
 		return
 	}
 
-	reports, err := h.service.ReportByMetric(c.Request.Context(), groupID, metrics)
+	deletedBoxes, err := strconv.ParseBool(c.DefaultQuery("include_deleted_boxes", "false"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		i18n.RespondError(c, http.StatusBadRequest, "include_deleted_boxes must be a boolean")
 		return
 	}
 
-	c.JSON(http.StatusOK, reports)
-}
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
 
-// Helper function to split and trim strings
-func splitAndTrim(s, sep string) []string {
-	parts := []string{}
-	for _, part := range splitString(s, sep) {
-		trimmed := trimString(part)
-		parts = append(parts, trimmed)
+	if zoneID != "" {
+		report, status, err := h.service.ReportByZone(c.Request.Context(), zoneID, metrics, refresh, deletedBoxes, user)
+		if err != nil {
+			if respondValidationError(c, err) {
+				return
+			}
+			switch err {
+			case domain.ErrZoneNotFound:
+				i18n.RespondError(c, http.StatusNotFound, "zone not found")
+			case domain.ErrTooManyReportGroups:
+				i18n.RespondError(c, http.StatusBadRequest, err.Error())
+			default:
+				i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		c.Header("X-Report-Cache", string(status))
+		c.JSON(http.StatusOK, report)
+		return
 	}
-	return parts
-}
 
-func splitString(s, sep string) []string {
-	if s == "" {
-		return []string{}
+	if !user.CanAccessGroup(groupID) {
+		i18n.RespondError(c, http.StatusForbidden, "group access denied")
+		return
 	}
-	result := []string{}
-	current := ""
-	for _, char := range s {
-		if string(char) == sep {
-			result = append(result, current)
-			current = ""
-		} else {
-			current += string(char)
+
+	report, err := h.service.ReportByMetric(c.Request.Context(), groupID, metrics, refresh, deletedBoxes)
+	if err != nil {
+		if respondValidationError(c, err) {
+			return
 		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
 	}
-	if current != "" || len(result) > 0 {
-		result = append(result, current)
+
+	c.Header("X-Report-Cache", string(report.Cache))
+	if report.Partial {
+		c.Header("X-Report-Partial", "true")
+		c.Header("X-Report-Failed-Boxes", strings.Join(report.FailedBoxIDs(), ","))
 	}
-	return result
+	c.JSON(http.StatusOK, report.Reports)
 }
 
-func trimString(s string) string {
-	start := 0
-	end := len(s)
-
-	for start < end && (s[start] == ' ' || s[start] == '\t' || s[start] == '\n' || s[start] == '\r') {
-		start++
-	}
+// Tree godoc
+// @Summary Get the zone → group → box hierarchy for navigation
+// @Description Zones with their groups with their boxes, by name and ID only. Non-admins get the groups they may read
+// @Description and their zones. The response carries an ETag: send it back in If-None-Match to get 304 when nothing changed.
+// @Tags zones
+// @Security BearerAuth
+// @Produce json
+// @Param zone_id query string false "Only the subtree of this zone"
+// @Param If-None-Match header string false "ETag of the tree the client has"
+// @Success 200 {array} domain.TreeZone
+// @Success 304 "The tree did not change"
+// @Failure 404 {object} map[string]interface{}
+// @Router /tree [get]
+func (h *ZoneHandler) Tree(c *gin.Context) {
+	userVal, _ := c.Get("user")
+	user := userVal.(*domain.User)
 
-	for end > start && (s[end-1] == ' ' || s[end-1] == '\t' || s[end-1] == '\n' || s[end-1] == '\r') {
-		end--
+	tree, err := h.service.Tree(c.Request.Context(), user, c.Query("zone_id"))
+	if err != nil {
+		if err == domain.ErrZoneNotFound {
+			i18n.RespondError(c, http.StatusNotFound, "zone not found")
+			return
+		}
+		i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	return s[start:end]
+	respondWithETag(c, tree)
 }
@@ -0,0 +1,30 @@
+// Package httputil parses request parameters shared by the HTTP handlers
+package httputil
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SplitList splits a list of values separated by sep, trimming the whitespace around each value
+// and dropping empty ones: "a,,b ," gives [a b], while "" and "," give an empty, non-nil list.
+func SplitList(s, sep string) []string {
+	values := []string{}
+	for _, value := range strings.Split(s, sep) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// QueryList returns the values of a comma-separated query parameter, as split by SplitList. A
+// repeated parameter gives the values of every occurrence: "?m=a,b&m=c" gives [a b c].
+func QueryList(c *gin.Context, key string) []string {
+	values := []string{}
+	for _, list := range c.QueryArray(key) {
+		values = append(values, SplitList(list, ",")...)
+	}
+	return values
+}
@@ -0,0 +1,55 @@
+package httputil
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{}},
+		{" ", []string{}},
+		{",", []string{}},
+		{"a", []string{"a"}},
+		{" a , b ", []string{"a", "b"}},
+		{"a,,b", []string{"a", "b"}},
+		{"a,b,", []string{"a", "b"}},
+		{",a", []string{"a"}},
+		{"a,a", []string{"a", "a"}},
+		{"a\t,\nb", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitList(tt.in, ","); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitList(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQueryList(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{}},
+		{"metrics=", []string{}},
+		{"metrics=WAU", []string{"WAU"}},
+		{"metrics=WAU,%20Q%20,", []string{"WAU", "Q"}},
+		{"metrics=WAU,,Q", []string{"WAU", "Q"}},
+		{"metrics=WAU&metrics=Q,V", []string{"WAU", "Q", "V"}},
+		{"metrics=WAU&metrics=", []string{"WAU"}},
+		{"other=WAU", []string{}},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/?"+tt.query, nil)
+		if got := QueryList(c, "metrics"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("QueryList(%q) = %#v, want %#v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package i18n translates API error messages. Every error response carries a stable code next to the
+// English error text, and a message in the language of the request, Vietnamese unless the client asks
+// for English. The English catalog holds the error texts the handlers and domain errors produce, so an
+// error text is mapped back to its code; texts missing from it get the generic code of their status.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Vietnamese = "vi"
+	English    = "en"
+
+	// Default is used when the request names no supported language
+	Default = Vietnamese
+)
+
+// contextKey is where the Locale middleware stores the language of the request
+const contextKey = "locale"
+
+//go:embed locales/*.json
+var files embed.FS
+
+var (
+	catalogs = map[string]map[string]string{} // language -> code -> message
+	codes    = map[string]string{}            // English message -> code
+)
+
+func init() {
+	for _, lang := range []string{Vietnamese, English} {
+		data, err := files.ReadFile("locales/" + lang + ".json")
+		if err != nil {
+			panic(fmt.Sprintf("i18n: read %s messages: %v", lang, err))
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("i18n: parse %s messages: %v", lang, err))
+		}
+		catalogs[lang] = catalog
+	}
+	for code, message := range catalogs[English] {
+		codes[message] = code
+	}
+}
+
+// statusCodes are the generic codes of error texts missing from the catalog
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusServiceUnavailable:    "service_unavailable",
+}
+
+// Code returns the code of an error text, or the generic code of status when the text is not in the catalog
+func Code(status int, message string) string {
+	if code, ok := codes[message]; ok {
+		return code
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "bad_request"
+}
+
+// Translate returns the message of code in lang, falling back to English and then to the code itself
+func Translate(lang, code string) string {
+	if message, ok := catalogs[lang][code]; ok {
+		return message
+	}
+	if message, ok := catalogs[English][code]; ok {
+		return message
+	}
+	return code
+}
+
+// Format returns the message of code in lang, as Translate does, with its {name} placeholders
+// replaced by params
+func Format(lang, code string, params map[string]string) string {
+	message := Translate(lang, code)
+	for name, value := range params {
+		message = strings.ReplaceAll(message, "{"+name+"}", value)
+	}
+	return message
+}
+
+// Negotiate picks the supported language the Accept-Language header prefers, Default when none is listed
+func Negotiate(acceptLanguage string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.SplitN(strings.TrimSpace(fields[0]), "-", 2)[0])
+		if _, ok := catalogs[lang]; !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return Default
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// Locale is the language of the request, as negotiated by the Locale middleware
+func Locale(c *gin.Context) string {
+	if lang := c.GetString(contextKey); lang != "" {
+		return lang
+	}
+	return Negotiate(c.GetHeader("Accept-Language"))
+}
+
+// SetLocale stores the language of the request for Locale
+func SetLocale(c *gin.Context, lang string) {
+	c.Set(contextKey, lang)
+}
+
+// Envelope is the body of an error response: the English error text clients matched on so far, its
+// code and the message to show, in the language of the request
+func Envelope(c *gin.Context, status int, message string) gin.H {
+	code := Code(status, message)
+	translated := Translate(Locale(c), code)
+	if _, known := codes[message]; !known && Locale(c) == English {
+		// The generic English text says less than the error itself
+		translated = message
+	}
+	return gin.H{"error": message, "code": code, "message": translated}
+}
+
+// RespondError answers status with the error envelope of message
+func RespondError(c *gin.Context, status int, message string) {
+	c.JSON(status, Envelope(c, status, message))
+}
@@ -0,0 +1,262 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCatalogsHaveTheSameCodes(t *testing.T) {
+	for code, message := range catalogs[English] {
+		if message == "" {
+			t.Errorf("en %s is empty", code)
+		}
+		if catalogs[Vietnamese][code] == "" {
+			t.Errorf("vi has no message for %s", code)
+		}
+	}
+	for code := range catalogs[Vietnamese] {
+		if _, ok := catalogs[English][code]; !ok {
+			t.Errorf("en has no message for %s", code)
+		}
+	}
+	if len(codes) != len(catalogs[English]) {
+		t.Errorf("%d en messages for %d codes; two codes share a message", len(codes), len(catalogs[English]))
+	}
+}
+
+// internalTexts are domain errors the handlers answer with another text, never sent as they are
+var internalTexts = map[string]bool{
+	"ingest queue full":        true, // "ingest queue full, retry later"
+	"too many long polls held": true, // "too many long polls, retry later"
+	"long polls stopped":       true, // "server shutting down"
+}
+
+// Every error text the domain package and the handlers produce has a code with a message in both languages
+func TestErrorTextsResolve(t *testing.T) {
+	texts := map[string]string{}
+	for _, pattern := range []string{"../domain/*.go", "../handler/*.go", "../middleware/*.go"} {
+		for text, pos := range errorTexts(t, pattern) {
+			texts[text] = pos
+		}
+	}
+	if len(texts) == 0 {
+		t.Fatal("no error texts found")
+	}
+
+	for text, pos := range texts {
+		if internalTexts[text] {
+			continue
+		}
+		code, ok := codes[text]
+		if !ok {
+			t.Errorf("%s: %q has no code", pos, text)
+			continue
+		}
+		for _, lang := range []string{Vietnamese, English} {
+			if _, ok := catalogs[lang][code]; !ok {
+				t.Errorf("%s: %s has no %s message", pos, code, lang)
+			}
+		}
+	}
+}
+
+// Every field problem code the domain, the handlers and the services set has a message in both
+// languages, with the same placeholders
+func TestFieldCodesResolve(t *testing.T) {
+	found := 0
+	for _, pattern := range []string{"../domain/*.go", "../handler/*.go", "../service/*.go"} {
+		for code, pos := range fieldCodes(t, pattern) {
+			found++
+			for _, lang := range []string{Vietnamese, English} {
+				if _, ok := catalogs[lang][code]; !ok {
+					t.Errorf("%s: %s has no %s message", pos, code, lang)
+				}
+			}
+		}
+	}
+	if found == 0 {
+		t.Fatal("no field codes found")
+	}
+
+	placeholder := regexp.MustCompile(`\{[a-z_]+\}`)
+	for code, message := range catalogs[English] {
+		en := placeholder.FindAllString(message, -1)
+		vi := placeholder.FindAllString(catalogs[Vietnamese][code], -1)
+		sort.Strings(en)
+		sort.Strings(vi)
+		if strings.Join(en, ",") != strings.Join(vi, ",") {
+			t.Errorf("%s: en has placeholders %v, vi %v", code, en, vi)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	params := map[string]string{"min": "10", "max": "16"}
+	if got, want := Format(English, "field_zoom_range", params), "Zoom must be between 10 and 16"; got != want {
+		t.Errorf("en = %q, want %q", got, want)
+	}
+	if got := Format(Vietnamese, "field_zoom_range", params); strings.Contains(got, "{") || !strings.Contains(got, "10") {
+		t.Errorf("vi = %q, want the placeholders filled", got)
+	}
+	if got, want := Format(English, "field_required", nil), "This field is required"; got != want {
+		t.Errorf("en = %q, want %q", got, want)
+	}
+}
+
+// The generic codes of statuses are translated too
+func TestStatusCodesResolve(t *testing.T) {
+	generic := []string{"internal_error"}
+	for _, code := range statusCodes {
+		generic = append(generic, code)
+	}
+	for _, code := range generic {
+		for _, lang := range []string{Vietnamese, English} {
+			if _, ok := catalogs[lang][code]; !ok {
+				t.Errorf("%s has no %s message", code, lang)
+			}
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		status         int
+		text           string
+		code           string
+		message        string
+	}{
+		{"vi by default", "", http.StatusNotFound, "box not found", "box_not_found", catalogs[Vietnamese]["box_not_found"]},
+		{"en", "en-US,en;q=0.9", http.StatusNotFound, "box not found", "box_not_found", "box not found"},
+		{"unknown text in vi", "vi", http.StatusInternalServerError, "connection reset", "internal_error", catalogs[Vietnamese]["internal_error"]},
+		{"unknown text in en keeps the text", "en", http.StatusInternalServerError, "connection reset", "internal_error", "connection reset"},
+		{"unknown text of a 4xx", "vi", http.StatusConflict, "already there", "conflict", catalogs[Vietnamese]["conflict"]},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptLanguage != "" {
+				c.Request.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+
+			envelope := Envelope(c, tt.status, tt.text)
+			if envelope["error"] != tt.text || envelope["code"] != tt.code || envelope["message"] != tt.message {
+				t.Errorf("got %v, want error %q, code %q, message %q", envelope, tt.text, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                       Vietnamese,
+		"en":                     English,
+		"en-GB":                  English,
+		"EN-us":                  English,
+		"fr-FR,fr;q=0.9":         Vietnamese,
+		"fr,en;q=0.5":            English,
+		"vi;q=0.4,en;q=0.8":      English,
+		"en;q=0,vi":              Vietnamese,
+		"en;q=0":                 Vietnamese,
+		"vi-VN,vi;q=0.9,en;q=.8": Vietnamese,
+	}
+	for header, want := range tests {
+		if got := Negotiate(header); got != want {
+			t.Errorf("Negotiate(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+// errorTexts returns the texts of the errors.New calls and of the literal messages passed to
+// RespondError in the files matching pattern, with where they are
+func errorTexts(t *testing.T, pattern string) map[string]string {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	texts := map[string]string{}
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			var arg ast.Expr
+			switch pkg, _ := sel.X.(*ast.Ident); {
+			case pkg != nil && pkg.Name == "errors" && sel.Sel.Name == "New" && len(call.Args) == 1:
+				arg = call.Args[0]
+			case pkg != nil && pkg.Name == "i18n" && sel.Sel.Name == "RespondError" && len(call.Args) == 3:
+				arg = call.Args[2]
+			default:
+				return true
+			}
+			if lit, ok := arg.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if text, err := strconv.Unquote(lit.Value); err == nil {
+					texts[text] = fset.Position(lit.Pos()).String()
+				}
+			}
+			return true
+		})
+	}
+	return texts
+}
+
+// fieldCodes returns the field_ string literals of the files matching pattern, with where they are.
+// Codes built from a prefix, such as "field_min" + unit, are checked by their prefix.
+func fieldCodes(t *testing.T, pattern string) map[string]string {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := map[string]string{}
+	fset := token.NewFileSet()
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if text, err := strconv.Unquote(lit.Value); err == nil && strings.HasPrefix(text, "field_") {
+					codes[text] = fset.Position(lit.Pos()).String()
+				}
+			}
+			return true
+		})
+	}
+	return codes
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyKey marks contexts authenticated by an API key rather than an access token
+const apiKeyKey = "api_key_id"
+
+// APIKey authenticates requests bearing an X-Api-Key header as the principal of the key: a user of
+// the api_key role reading only the key's groups. Whatever route they reach, such requests may only
+// read. Auth lets them through, and the capability and group checks of the route apply as to anyone.
+func APIKey(keys *service.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(domain.APIKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			i18n.RespondError(c, http.StatusForbidden, "api keys are read-only")
+			c.Abort()
+			return
+		}
+
+		apiKey, err := keys.Authenticate(c.Request.Context(), key)
+		if err != nil {
+			if err == domain.ErrAPIKeyInvalid || err == domain.ErrAPIKeyExpired {
+				i18n.RespondError(c, http.StatusUnauthorized, err.Error())
+			} else {
+				i18n.RespondError(c, http.StatusInternalServerError, err.Error())
+			}
+			c.Abort()
+			return
+		}
+
+		principal := apiKey.Principal()
+		c.Set("user", principal)
+		c.Set("user_id", principal.ID)
+		c.Set(apiKeyKey, apiKey.ID)
+		c.Next()
+	}
+}
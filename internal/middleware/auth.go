@@ -1,114 +1,213 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"tp25-api/internal/config"
 	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
 	"tp25-api/internal/service"
+	"tp25-api/lib/jwtkeys"
 )
 
 type AuthMiddleware struct {
 	config      *config.Config
 	userService *service.UserService
+	jwtKeys     *jwtkeys.Keys
 }
 
 func NewAuthMiddleware(cfg *config.Config, userService *service.UserService) *AuthMiddleware {
 	return &AuthMiddleware{
 		config:      cfg,
 		userService: userService,
+		jwtKeys:     jwtkeys.New(cfg.Auth.JWTSecrets),
 	}
 }
 
-// Claims represents JWT claims
+// Claims represents JWT claims. Role and the groups the user may read are those at issuance, so
+// requests are authorized without loading the user; Version is the user's TokenVersion, which
+// revokes the token when raised. Tokens issued before these claims carry no role.
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID     string      `json:"user_id"`
+	Role       domain.Role `json:"role,omitempty"`
+	ZoneIDs    []string    `json:"zone_ids,omitempty"`
+	Groups     []string    `json:"groups,omitempty"`
+	ZoneGroups []string    `json:"zone_groups,omitempty"`
+	Version    int64       `json:"ver,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// Auth middleware for JWT-based authentication
+// NewClaims returns the claims of an access token of the user valid for ttl. The groups of the
+// user's zones must be resolved, as by UserService.GetUser.
+func NewClaims(user *domain.User, ttl time.Duration) *Claims {
+	now := time.Now()
+	return &Claims{
+		UserID:     user.ID,
+		Role:       user.Role,
+		ZoneIDs:    user.ZoneIDs,
+		Groups:     user.Groups,
+		ZoneGroups: user.ZoneGroups(),
+		Version:    user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+}
+
+// Principal returns the user the claims stand for, holding only their ID, role and group access
+func (c *Claims) Principal() *domain.User {
+	user := &domain.User{
+		ID:           c.UserID,
+		Role:         c.Role,
+		ZoneIDs:      c.ZoneIDs,
+		Groups:       c.Groups,
+		TokenVersion: c.Version,
+	}
+	user.SetZoneGroups(c.ZoneGroups)
+	return user
+}
+
+// Auth middleware for JWT-based authentication. The user set on the context is the principal of
+// the token's claims; routes needing the rest of the user add LoadUser. Requests the APIKey
+// middleware authenticated are let through.
 func (m *AuthMiddleware) Auth() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if _, ok := c.Get(apiKeyKey); ok {
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "missing authorization header"})
+			i18n.RespondError(c, http.StatusUnauthorized, "missing authorization header")
 			c.Abort()
 			return
 		}
 
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization format"})
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid authorization format")
 			c.Abort()
 			return
 		}
 
 		tokenString := parts[1]
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(m.config.Auth.JWTSecret), nil
-		})
+		// Any of the configured secrets verifies, so tokens outlive a secret rotation
+		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, m.jwtKeys.Keyfunc)
 
 		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid token")
 			c.Abort()
 			return
 		}
 
 		claims, ok := token.Claims.(*Claims)
 		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid token claims")
 			c.Abort()
 			return
 		}
 
+		if m.userService.TokenRevoked(c.Request.Context(), claims.UserID, claims.Version) {
+			i18n.RespondError(c, http.StatusUnauthorized, "token revoked")
+			c.Abort()
+			return
+		}
+
+		if claims.Role != "" {
+			c.Set("user", claims.Principal())
+			c.Set("user_id", claims.UserID)
+			c.Next()
+			return
+		}
+
 		user, err := m.userService.GetUser(c.Request.Context(), claims.UserID)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			i18n.RespondError(c, http.StatusUnauthorized, "user not found")
 			c.Abort()
 			return
 		}
 
 		c.Set("user", user)
 		c.Set("user_id", user.ID)
+		c.Set(userLoadedKey, true)
+		c.Next()
+	}
+}
+
+// userLoadedKey marks contexts whose user was loaded in full rather than taken from the token
+const userLoadedKey = "user_loaded"
+
+// LoadUser replaces the principal set by Auth with the full user, for routes that need more than
+// the role and group access, such as the profile. API keys stand for no user and are refused.
+func (m *AuthMiddleware) LoadUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool(userLoadedKey) {
+			c.Next()
+			return
+		}
+		if _, ok := c.Get(apiKeyKey); ok {
+			i18n.RespondError(c, http.StatusForbidden, "insufficient permissions")
+			c.Abort()
+			return
+		}
+
+		user, err := m.userService.GetUser(c.Request.Context(), c.GetString("user_id"))
+		if err != nil {
+			i18n.RespondError(c, http.StatusUnauthorized, "user not found")
+			c.Abort()
+			return
+		}
+
+		c.Set("user", user)
+		c.Set(userLoadedKey, true)
 		c.Next()
 	}
 }
 
-// RequireRole middleware to check user role
-func (m *AuthMiddleware) RequireRole(roles ...domain.Role) gin.HandlerFunc {
+// RequireCapability rejects users whose role lacks the capability
+func (m *AuthMiddleware) RequireCapability(capability domain.Capability) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userVal, exists := c.Get("user")
 		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			i18n.RespondError(c, http.StatusUnauthorized, "unauthorized")
 			c.Abort()
 			return
 		}
 
 		user, ok := userVal.(*domain.User)
 		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid user context"})
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid user context")
 			c.Abort()
 			return
 		}
 
-		hasRole := false
-		for _, role := range roles {
-			if user.Role == role {
-				hasRole = true
-				break
-			}
+		if !user.Role.Can(capability) {
+			i18n.RespondError(c, http.StatusForbidden, "insufficient permissions")
+			c.Abort()
+			return
 		}
 
-		if !hasRole {
-			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions"})
+		c.Next()
+	}
+}
+
+// StaticToken admits requests bearing token, for machine clients such as a Prometheus scraper
+func StaticToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			i18n.RespondError(c, http.StatusUnauthorized, "invalid token")
 			c.Abort()
 			return
 		}
-
 		c.Next()
 	}
 }
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tp25-api/internal/config"
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/internal/service"
+	"tp25-api/lib/jwtkeys"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// offlineUserService is a user service whose database cannot be reached. Revocations cannot be read
+// then, so no token is revoked.
+func offlineUserService(t testing.TB, secrets []string) *service.UserService {
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return service.NewUserService(mongodb.NewUserRepository(client.Database("test")), nil, secrets)
+}
+
+// authenticate sends a request bearing token through Auth and returns the status
+func authenticate(t *testing.T, secrets []string, token string) int {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{Auth: config.AuthConfig{JWTSecret: secrets[0], JWTSecrets: secrets}}
+	m := NewAuthMiddleware(cfg, offlineUserService(t, secrets))
+
+	router := gin.New()
+	router.GET("/", m.Auth(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestAuthAcrossSecretRotation(t *testing.T) {
+	user := &domain.User{ID: "user", Role: domain.RoleMonitor}
+	signed, err := jwtkeys.New([]string{"old"}).Sign(NewClaims(user, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := authenticate(t, []string{"new", "old"}, signed); status != http.StatusNoContent {
+		t.Errorf("token signed with the secondary secret answered %d, want %d", status, http.StatusNoContent)
+	}
+	if status := authenticate(t, []string{"new"}, signed); status != http.StatusUnauthorized {
+		t.Errorf("token signed with a removed secret answered %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestUserServiceSignsWithPrimarySecret(t *testing.T) {
+	user := &domain.User{ID: "user", Role: domain.RoleMonitor}
+	signed, err := offlineUserService(t, []string{"new", "old"}).SignToken(NewClaims(user, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := authenticate(t, []string{"new"}, signed); status != http.StatusNoContent {
+		t.Errorf("new token answered %d with the primary secret alone, want %d", status, http.StatusNoContent)
+	}
+	if status := authenticate(t, []string{"old"}, signed); status != http.StatusUnauthorized {
+		t.Errorf("new token answered %d with the secondary secret alone, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+// Routes guarded by a capability refuse the roles lacking it, such as API keys adding records
+func TestRequireCapability(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	m := NewAuthMiddleware(&config.Config{}, offlineUserService(t, []string{"secret"}))
+
+	tests := []struct {
+		role       domain.Role
+		capability domain.Capability
+		status     int
+	}{
+		{domain.RoleMonitor, domain.CapAddRecords, http.StatusNoContent},
+		{domain.RoleMonitor, domain.CapWriteBoxLogs, http.StatusNoContent},
+		{domain.RoleMonitor, domain.CapManageSites, http.StatusForbidden},
+		{domain.RoleAPIKey, domain.CapViewRecords, http.StatusNoContent},
+		{domain.RoleAPIKey, domain.CapAddRecords, http.StatusForbidden},
+		{domain.RoleAPIKey, domain.CapWriteBoxLogs, http.StatusForbidden},
+		{"", domain.CapViewSites, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		router := gin.New()
+		router.GET("/", func(c *gin.Context) {
+			c.Set("user", &domain.User{ID: "user", Role: tt.role})
+		}, m.RequireCapability(tt.capability), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tt.status {
+			t.Errorf("%q with %s answered %d, want %d", tt.role, tt.capability, w.Code, tt.status)
+		}
+	}
+}
+
+// BenchmarkAuthFromClaims authenticates requests bearing an access token with claims, as the hot
+// read endpoints receive them. The database cannot be reached: loading the user would answer 401
+// after the server selection timeout, so every request answering 204 quickly shows Auth no longer
+// queries the users per request. Token versions are read once, before the timer starts.
+func BenchmarkAuthFromClaims(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	secrets := []string{"secret"}
+	m := NewAuthMiddleware(&config.Config{Auth: config.AuthConfig{JWTSecret: secrets[0], JWTSecrets: secrets}}, offlineUserService(b, secrets))
+
+	user := &domain.User{ID: "user", Role: domain.RoleMonitor, ZoneIDs: []string{"z1"}, Groups: []string{"g1"}}
+	user.SetZoneGroups([]string{"z1-g1", "z1-g2"})
+	signed, err := jwtkeys.New(secrets).Sign(NewClaims(user, time.Hour))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/", m.Auth(), m.RequireCapability(domain.CapViewRecords), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	serve := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	serve()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if status := serve(); status != http.StatusNoContent {
+			b.Fatalf("request answered %d, want %d", status, http.StatusNoContent)
+		}
+	}
+	b.StopTimer()
+	if perRequest := b.Elapsed() / time.Duration(b.N); perRequest >= 10*time.Millisecond {
+		b.Errorf("%v per request, as long as a database query timing out", perRequest)
+	}
+}
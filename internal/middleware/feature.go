@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"net/http"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireFeature answers 404 to the routes of a feature turned off, as if the build did not have them
+func RequireFeature(flags *service.FeatureFlagService, feature domain.Feature) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !flags.Enabled(c.Request.Context(), feature) {
+			i18n.RespondError(c, http.StatusNotFound, "not found")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,17 @@
+package middleware
+
+import (
+	"tp25-api/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Locale picks the language of error messages from the Accept-Language header and reports it in Content-Language
+func Locale() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lang := i18n.Negotiate(c.GetHeader("Accept-Language"))
+		i18n.SetLocale(c, lang)
+		c.Writer.Header().Set("Content-Language", lang)
+		c.Next()
+	}
+}
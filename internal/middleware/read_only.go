@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/i18n"
+	"tp25-api/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadOnly refuses requests other than GET with 503 and a Retry-After while the server is in read-only
+// mode. Signing in and the toggle itself stay available, and records posted by boxes are let through
+// when the mode buffers them in the ingestion queue.
+func ReadOnly(readOnly *service.ReadOnlyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		mode := readOnly.Mode(c.Request.Context())
+		if !mode.Enabled || readOnlyExempt(c, mode) {
+			c.Next()
+			return
+		}
+
+		c.Header("Retry-After", strconv.Itoa(mode.RetryAfter))
+		i18n.RespondError(c, http.StatusServiceUnavailable, domain.ErrReadOnly.Error())
+		c.Abort()
+	}
+}
+
+func readOnlyExempt(c *gin.Context, mode domain.ReadOnlyMode) bool {
+	path := strings.Replace(c.FullPath(), "/api/v2/", "/api/", 1)
+	switch {
+	case strings.HasPrefix(path, "/api/auth/"), strings.HasPrefix(path, "/debug/"):
+		return true
+	case path == "/api/admin/read-only":
+		return true
+	case path == "/api/boxes/:id/records" && c.Request.Method == http.MethodPost:
+		return mode.BufferIngest
+	}
+	return false
+}
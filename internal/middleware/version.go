@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"tp25-api/internal/version"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version middleware reports the server version in the X-Api-Version header of every response
+func Version() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Set("X-Api-Version", version.Version)
+		c.Next()
+	}
+}
+
+// apiVersionKey is the context key of the API version a route was matched under
+const apiVersionKey = "api_version"
+
+// APIVersion marks the requests of a versioned route group, e.g. /api/v2
+func APIVersion(version int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(apiVersionKey, version)
+		c.Next()
+	}
+}
+
+// RequestAPIVersion returns the API version of the request, 0 for the unversioned /api routes
+func RequestAPIVersion(c *gin.Context) int {
+	return c.GetInt(apiVersionKey)
+}
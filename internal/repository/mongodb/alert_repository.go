@@ -0,0 +1,129 @@
+package mongodb
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type AlertRepository struct {
+	collection *mongo.Collection
+}
+
+func NewAlertRepository(db *mongo.Database) *AlertRepository {
+	return &AlertRepository{
+		collection: db.Collection("alerts"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *AlertRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the indexes listing alerts newest first, overall and within a scope, optionally
+// narrowed by status. Severity and metric filters are applied on top of these.
+func (r *AlertRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "zone_id", Value: 1}, {Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "status", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "metric", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	return err
+}
+
+func alertFilter(filter domain.FilterAlertParams) bson.M {
+	query := bson.M{}
+	if len(filter.Severities) > 0 {
+		query["severity"] = bson.M{"$in": filter.Severities}
+	}
+	if len(filter.Statuses) > 0 {
+		query["status"] = bson.M{"$in": filter.Statuses}
+	}
+	if filter.ZoneID != "" {
+		query["zone_id"] = filter.ZoneID
+	}
+	if filter.GroupID != "" {
+		query["group_id"] = filter.GroupID
+	} else if filter.Groups != nil {
+		query["group_id"] = bson.M{"$in": filter.Groups}
+	}
+	if filter.BoxID != "" {
+		query["box_id"] = filter.BoxID
+	}
+	if filter.Metric != "" {
+		query["metric"] = filter.Metric
+	}
+	timestamp := bson.M{}
+	if filter.From != nil {
+		timestamp["$gte"] = *filter.From
+	}
+	if filter.To != nil {
+		timestamp["$lte"] = *filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
+
+// alertSort lists newest first; _id breaks ties so pages do not overlap
+var alertSort = bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}
+
+// ListWithPagination lists alerts, newest first
+func (r *AlertRepository) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterAlertParams) ([]domain.Alert, int64, error) {
+	query := alertFilter(filter)
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(alertSort)
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	alerts := []domain.Alert{}
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return nil, 0, err
+	}
+	return alerts, total, nil
+}
+
+// Stream calls fn for every matching alert, newest first, stopping at the first error
+func (r *AlertRepository) Stream(ctx context.Context, filter domain.FilterAlertParams, fn func(domain.Alert) error) error {
+	cursor, err := r.collection.Find(ctx, alertFilter(filter), options.Find().SetSort(alertSort))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var alert domain.Alert
+		if err := cursor.Decode(&alert); err != nil {
+			return err
+		}
+		if err := fn(alert); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (r *AlertRepository) Create(ctx context.Context, alert *domain.Alert) error {
+	_, err := r.collection.InsertOne(ctx, alert)
+	return err
+}
@@ -0,0 +1,87 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AnomalyRepository stores the rolling statistics anomalies are scored against, and the audit of
+// the corrections made to stored records
+type AnomalyRepository struct {
+	states      *mongo.Collection
+	corrections *mongo.Collection
+}
+
+func NewAnomalyRepository(db *mongo.Database) *AnomalyRepository {
+	return &AnomalyRepository{
+		states:      db.Collection("anomaly_state"),
+		corrections: db.Collection("record_corrections"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *AnomalyRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.corrections}
+}
+
+// EnsureIndexes creates the index used to list the corrections of a box, newest first
+func (r *AnomalyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.corrections.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "ctime", Value: -1}},
+	})
+	return err
+}
+
+// State returns the rolling statistics of a box, nil when none were kept yet
+func (r *AnomalyRepository) State(ctx context.Context, boxID string) (*domain.AnomalyState, error) {
+	var state domain.AnomalyState
+	err := r.states.FindOne(ctx, bson.M{"_id": boxID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SaveStats stores the rolling statistics of the given metrics of a box, leaving its other metrics as they are
+func (r *AnomalyRepository) SaveStats(ctx context.Context, boxID string, stats map[string]domain.RollingStats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	set := bson.M{"mtime": time.Now().UnixMilli()}
+	for code, s := range stats {
+		set["metrics."+code] = s
+	}
+	_, err := r.states.UpdateOne(ctx, bson.M{"_id": boxID}, bson.M{"$set": set}, options.Update().SetUpsert(true))
+	return err
+}
+
+// AddCorrection records a correction made to a stored record
+func (r *AnomalyRepository) AddCorrection(ctx context.Context, correction *domain.RecordCorrection) error {
+	_, err := r.corrections.InsertOne(ctx, correction)
+	return err
+}
+
+// ListCorrections returns the corrections made to the records of a box, newest first
+func (r *AnomalyRepository) ListCorrections(ctx context.Context, boxID string) ([]domain.RecordCorrection, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "ctime", Value: -1}})
+	cursor, err := r.corrections.Find(ctx, bson.M{"box_id": boxID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	corrections := []domain.RecordCorrection{}
+	if err := cursor.All(ctx, &corrections); err != nil {
+		return nil, err
+	}
+	return corrections, nil
+}
@@ -0,0 +1,92 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type APIKeyRepository struct {
+	collection *mongo.Collection
+}
+
+func NewAPIKeyRepository(db *mongo.Database) *APIKeyRepository {
+	return &APIKeyRepository{
+		collection: db.Collection("api_keys"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *APIKeyRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the unique index keys are looked up by
+func (r *APIKeyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("hash_unique"),
+	})
+	return err
+}
+
+func (r *APIKeyRepository) Create(ctx context.Context, key *domain.APIKey) error {
+	_, err := r.collection.InsertOne(ctx, key)
+	return err
+}
+
+// List returns every key, revoked ones included, newest first
+func (r *APIKeyRepository) List(ctx context.Context) ([]domain.APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "ctime", Value: -1}})
+	cursor, err := r.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []domain.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetByHash returns the unrevoked key with the hash
+func (r *APIKeyRepository) GetByHash(ctx context.Context, hash string) (*domain.APIKey, error) {
+	var key domain.APIKey
+	err := r.collection.FindOne(ctx, bson.M{"hash": hash, "revoked_at": bson.M{"$exists": false}}).Decode(&key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrAPIKeyInvalid
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Revoke stops a key from being accepted; it stays listed
+func (r *APIKeyRepository) Revoke(ctx context.Context, id string) error {
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now().Unix()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// SetLastUsed records when a key was last used (seconds)
+func (r *APIKeyRepository) SetLastUsed(ctx context.Context, id string, at int64) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": at}})
+	return err
+}
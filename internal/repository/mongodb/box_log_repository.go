@@ -0,0 +1,158 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type BoxLogRepository struct {
+	collection *mongo.Collection
+}
+
+func NewBoxLogRepository(db *mongo.Database) *BoxLogRepository {
+	return &BoxLogRepository{
+		collection: db.Collection("box_logs"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *BoxLogRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the index used to list the logs of a box by time
+func (r *BoxLogRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	return err
+}
+
+func boxLogFilter(filter domain.FilterBoxLogParams) bson.M {
+	query := bson.M{"box_id": filter.BoxID, "dtime": bson.M{"$exists": false}}
+	timestamp := bson.M{}
+	if filter.From != nil {
+		timestamp["$gte"] = *filter.From
+	}
+	if filter.To != nil {
+		timestamp["$lte"] = *filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
+
+// ListWithPagination lists the logs of a box, newest first
+func (r *BoxLogRepository) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterBoxLogParams) ([]domain.BoxLog, int64, error) {
+	query := boxLogFilter(filter)
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	logs := []domain.BoxLog{}
+	if err := cursor.All(ctx, &logs); err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
+
+// List returns every log of a box in the filter's range, oldest first
+func (r *BoxLogRepository) List(ctx context.Context, filter domain.FilterBoxLogParams) ([]domain.BoxLog, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}})
+
+	cursor, err := r.collection.Find(ctx, boxLogFilter(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	logs := []domain.BoxLog{}
+	if err := cursor.All(ctx, &logs); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// Latest returns the most recent log of a box, or nil when it has none
+func (r *BoxLogRepository) Latest(ctx context.Context, boxID string) (*domain.BoxLog, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	var log domain.BoxLog
+	err := r.collection.FindOne(ctx, bson.M{"box_id": boxID, "dtime": bson.M{"$exists": false}}, opts).Decode(&log)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (r *BoxLogRepository) Get(ctx context.Context, boxID, id string) (*domain.BoxLog, error) {
+	var log domain.BoxLog
+	err := r.collection.FindOne(ctx, bson.M{"_id": id, "box_id": boxID, "dtime": bson.M{"$exists": false}}).Decode(&log)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrBoxLogNotFound
+		}
+		return nil, err
+	}
+	return &log, nil
+}
+
+func (r *BoxLogRepository) Create(ctx context.Context, log *domain.BoxLog) error {
+	_, err := r.collection.InsertOne(ctx, log)
+	return err
+}
+
+func (r *BoxLogRepository) Update(ctx context.Context, log *domain.BoxLog) error {
+	log.MTime = time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": log.ID, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": log},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxLogNotFound
+	}
+	return nil
+}
+
+func (r *BoxLogRepository) Delete(ctx context.Context, id string) error {
+	now := time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"dtime": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxLogNotFound
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CalibrationRepository struct {
+	collection *mongo.Collection
+}
+
+func NewCalibrationRepository(db *mongo.Database) *CalibrationRepository {
+	return &CalibrationRepository{
+		collection: db.Collection("calibrations"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *CalibrationRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the index used to read the calibrations of a box in effect order
+func (r *CalibrationRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "metric", Value: 1}, {Key: "effective_from", Value: 1}},
+	})
+	return err
+}
+
+// List returns the calibrations of the given boxes, by metric and effect time
+func (r *CalibrationRepository) List(ctx context.Context, boxIDs ...string) ([]domain.Calibration, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "box_id", Value: 1}, {Key: "metric", Value: 1}, {Key: "effective_from", Value: 1}})
+
+	filter := bson.M{"box_id": bson.M{"$in": boxIDs}, "dtime": bson.M{"$exists": false}}
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	calibrations := []domain.Calibration{}
+	if err := cursor.All(ctx, &calibrations); err != nil {
+		return nil, err
+	}
+	return calibrations, nil
+}
+
+func (r *CalibrationRepository) Get(ctx context.Context, boxID, id string) (*domain.Calibration, error) {
+	var calibration domain.Calibration
+	err := r.collection.FindOne(ctx, bson.M{"_id": id, "box_id": boxID, "dtime": bson.M{"$exists": false}}).Decode(&calibration)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrCalibrationNotFound
+		}
+		return nil, err
+	}
+	return &calibration, nil
+}
+
+func (r *CalibrationRepository) Create(ctx context.Context, calibration *domain.Calibration) error {
+	_, err := r.collection.InsertOne(ctx, calibration)
+	return err
+}
+
+func (r *CalibrationRepository) Update(ctx context.Context, calibration *domain.Calibration) error {
+	calibration.MTime = time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": calibration.ID, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": calibration},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrCalibrationNotFound
+	}
+	return nil
+}
+
+func (r *CalibrationRepository) Delete(ctx context.Context, id string) error {
+	now := time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"dtime": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrCalibrationNotFound
+	}
+	return nil
+}
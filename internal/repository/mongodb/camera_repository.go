@@ -0,0 +1,64 @@
+package mongodb
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CameraRepository stores the outcome of the last probe of each group camera
+type CameraRepository struct {
+	checks *mongo.Collection
+}
+
+func NewCameraRepository(db *mongo.Database) *CameraRepository {
+	return &CameraRepository{
+		checks: db.Collection("camera_checks"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *CameraRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.checks}
+}
+
+// EnsureIndexes creates the unique index of the check of a camera URL within its group
+func (r *CameraRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.checks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "group_id", Value: 1}, {Key: "url", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("group_camera_unique"),
+	})
+	return err
+}
+
+// Checks returns the stored checks of the cameras of a group
+func (r *CameraRepository) Checks(ctx context.Context, groupID string) ([]domain.CameraCheck, error) {
+	cursor, err := r.checks.Find(ctx, bson.M{"group_id": groupID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	checks := []domain.CameraCheck{}
+	if err := cursor.All(ctx, &checks); err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
+
+// SaveCheck stores the check of a camera, replacing the previous one
+func (r *CameraRepository) SaveCheck(ctx context.Context, check *domain.CameraCheck) error {
+	filter := bson.M{"group_id": check.GroupID, "url": check.URL}
+	_, err := r.checks.ReplaceOne(ctx, filter, check, options.Replace().SetUpsert(true))
+	return err
+}
+
+// PruneChecks deletes the checks of a group's cameras that are no longer configured
+func (r *CameraRepository) PruneChecks(ctx context.Context, groupID string, cameras []string) error {
+	_, err := r.checks.DeleteMany(ctx, bson.M{"group_id": groupID, "url": bson.M{"$nin": cameras}})
+	return err
+}
@@ -0,0 +1,81 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExportFileRepository stores the files of export jobs in GridFS, keyed by job ID. Exports can
+// exceed the 16MB document limit the export templates live under.
+type ExportFileRepository struct {
+	db *mongo.Database
+}
+
+func NewExportFileRepository(db *mongo.Database) *ExportFileRepository {
+	return &ExportFileRepository{db: db}
+}
+
+// bucket opens the export bucket. Buckets hold their read and write buffers, so each use gets its own.
+func (r *ExportFileRepository) bucket() *gridfs.Bucket {
+	// NewBucket only fails on options it is never given here
+	bucket, _ := gridfs.NewBucket(r.db, options.GridFSBucket().SetName("export_files"))
+	return bucket
+}
+
+type exportFileMetadata struct {
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+// Create opens the file of a job for writing. It is stored once the stream is closed, and kept
+// until expireAt.
+func (r *ExportFileRepository) Create(jobID, filename string, expireAt time.Time) (*gridfs.UploadStream, error) {
+	opts := options.GridFSUpload().SetMetadata(exportFileMetadata{ExpireAt: expireAt})
+	return r.bucket().OpenUploadStreamWithID(jobID, filename, opts)
+}
+
+// Open opens the file of a job for reading
+func (r *ExportFileRepository) Open(ctx context.Context, jobID string) (*gridfs.DownloadStream, error) {
+	stream, err := r.bucket().OpenDownloadStream(jobID)
+	if err != nil {
+		if errors.Is(err, gridfs.ErrFileNotFound) {
+			return nil, domain.ErrExportFileNotFound
+		}
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+	}
+	return stream, nil
+}
+
+// DeleteExpired removes the files kept past their expiry and returns how many went
+func (r *ExportFileRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	bucket := r.bucket()
+	cursor, err := bucket.FindContext(ctx, bson.M{"metadata.expire_at": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	var files []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, file := range files {
+		if err := bucket.DeleteContext(ctx, file.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,90 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ExportTemplateRepository struct {
+	collection *mongo.Collection
+}
+
+func NewExportTemplateRepository(db *mongo.Database) *ExportTemplateRepository {
+	return &ExportTemplateRepository{
+		collection: db.Collection("export_templates"),
+	}
+}
+
+// Get returns the template of a group including its file
+func (r *ExportTemplateRepository) Get(ctx context.Context, groupID string) (*domain.ExportTemplate, error) {
+	var template domain.ExportTemplate
+	err := r.collection.FindOne(ctx, bson.M{"_id": groupID}).Decode(&template)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrExportTemplateNotFound
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// GetInfo returns the template of a group without loading its file
+func (r *ExportTemplateRepository) GetInfo(ctx context.Context, groupID string) (*domain.ExportTemplate, error) {
+	opts := options.FindOne().SetProjection(bson.M{"data": 0})
+
+	var template domain.ExportTemplate
+	err := r.collection.FindOne(ctx, bson.M{"_id": groupID}, opts).Decode(&template)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrExportTemplateNotFound
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// Save stores the template of a group, replacing the previous one but keeping its ctime
+func (r *ExportTemplateRepository) Save(ctx context.Context, template *domain.ExportTemplate) error {
+	now := time.Now().UnixMilli()
+	template.MTime = now
+
+	update := bson.M{
+		"$set": bson.M{
+			"filename":    template.Filename,
+			"size":        template.Size,
+			"names":       template.Names,
+			"data":        template.Data,
+			"uploaded_by": template.UploadedBy,
+			"mtime":       now,
+		},
+		"$setOnInsert": bson.M{"ctime": now},
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"ctime": 1})
+
+	var saved domain.ExportTemplate
+	if err := r.collection.FindOneAndUpdate(ctx, bson.M{"_id": template.GroupID}, update, opts).Decode(&saved); err != nil {
+		return err
+	}
+	template.CTime = saved.CTime
+	return nil
+}
+
+func (r *ExportTemplateRepository) Delete(ctx context.Context, groupID string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": groupID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return domain.ErrExportTemplateNotFound
+	}
+	return nil
+}
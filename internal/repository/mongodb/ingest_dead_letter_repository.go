@@ -0,0 +1,103 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IngestDeadLetterRepository keeps the records the ingestion queue acknowledged but could not
+// write, until a later attempt writes them
+type IngestDeadLetterRepository struct {
+	collection *mongo.Collection
+}
+
+func NewIngestDeadLetterRepository(db *mongo.Database) *IngestDeadLetterRepository {
+	return &IngestDeadLetterRepository{
+		collection: db.Collection("ingest_dead_letters"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *IngestDeadLetterRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the index the oldest letters are replayed through
+func (r *IngestDeadLetterRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ctime", Value: 1}},
+	})
+	return err
+}
+
+// Save keeps letters. Letters already kept under the same receipt are left as they are.
+func (r *IngestDeadLetterRepository) Save(ctx context.Context, letters []domain.IngestDeadLetter) error {
+	docs := make([]interface{}, len(letters))
+	for i := range letters {
+		docs[i] = letters[i]
+	}
+	_, err := r.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+	return nil
+}
+
+// Oldest returns up to limit letters, oldest first
+func (r *IngestDeadLetterRepository) Oldest(ctx context.Context, limit int) ([]domain.IngestDeadLetter, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "ctime", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := r.collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var letters []domain.IngestDeadLetter
+	if err := cursor.All(ctx, &letters); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+// Failed records another failed attempt at writing the letters
+func (r *IngestDeadLetterRepository) Failed(ctx context.Context, ids []string, writeErr error) error {
+	_, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{
+			"$inc": bson.M{"attempts": 1},
+			"$set": bson.M{"error": writeErr.Error(), "mtime": time.Now().UnixMilli()},
+		},
+	)
+	return err
+}
+
+// Delete forgets the letters that were written
+func (r *IngestDeadLetterRepository) Delete(ctx context.Context, ids []string) error {
+	_, err := r.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// Count returns how many letters are kept
+func (r *IngestDeadLetterRepository) Count(ctx context.Context) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{})
+}
+
+// onlyDuplicateKeys reports whether err is a bulk write that only failed on duplicate keys
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
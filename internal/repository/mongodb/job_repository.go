@@ -0,0 +1,131 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type JobRepository struct {
+	collection *mongo.Collection
+}
+
+func NewJobRepository(db *mongo.Database) *JobRepository {
+	return &JobRepository{
+		collection: db.Collection("jobs"),
+	}
+}
+
+func (r *JobRepository) Create(ctx context.Context, job *domain.Job) error {
+	_, err := r.collection.InsertOne(ctx, job)
+	return err
+}
+
+func (r *JobRepository) Get(ctx context.Context, id string) (*domain.Job, error) {
+	var job domain.Job
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrJobNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// UpdateProgress records how far a running job got
+func (r *JobRepository) UpdateProgress(ctx context.Context, id string, processed, updated int64) error {
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"processed": processed, "updated": updated, "mtime": time.Now().UnixMilli()}},
+	)
+	return err
+}
+
+// UpdateCollections records how far a running job got over each of its collections
+func (r *JobRepository) UpdateCollections(ctx context.Context, id string, processed, updated int64, collections []domain.JobCollection) error {
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{
+			"processed":   processed,
+			"updated":     updated,
+			"collections": collections,
+			"mtime":       time.Now().UnixMilli(),
+		}},
+	)
+	return err
+}
+
+// SetFile records the file an export job produced
+func (r *JobRepository) SetFile(ctx context.Context, id string, file *domain.JobFile) error {
+	_, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"file": file, "mtime": time.Now().UnixMilli()}},
+	)
+	return err
+}
+
+// CountRunning counts the running jobs of the given types
+func (r *JobRepository) CountRunning(ctx context.Context, types []string) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{"status": domain.JobRunning, "type": bson.M{"$in": types}})
+}
+
+// Finish marks a job done, or failed with jobErr
+func (r *JobRepository) Finish(ctx context.Context, id string, processed, updated int64, jobErr error) error {
+	now := time.Now().UnixMilli()
+	set := bson.M{
+		"status":      domain.JobDone,
+		"processed":   processed,
+		"updated":     updated,
+		"mtime":       now,
+		"finished_at": now,
+	}
+	if jobErr != nil {
+		set["status"] = domain.JobFailed
+		set["error"] = jobErr.Error()
+	}
+
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+// Heartbeat marks the running jobs among ids alive
+func (r *JobRepository) Heartbeat(ctx context.Context, ids []string) error {
+	_, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "status": domain.JobRunning},
+		bson.M{"$set": bson.M{"heartbeat": time.Now().UnixMilli()}},
+	)
+	return err
+}
+
+// FailInterrupted marks as failed the running jobs without a heartbeat since staleBefore
+// (milliseconds), whose process stopped. Jobs stored before heartbeats were are judged by their
+// last change.
+func (r *JobRepository) FailInterrupted(ctx context.Context, staleBefore int64) (int64, error) {
+	now := time.Now().UnixMilli()
+	result, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"status": domain.JobRunning, "$or": bson.A{
+			bson.M{"heartbeat": bson.M{"$lt": staleBefore}},
+			bson.M{"heartbeat": bson.M{"$exists": false}, "mtime": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{"$set": bson.M{
+			"status":      domain.JobFailed,
+			"error":       "interrupted: the server running it stopped",
+			"mtime":       now,
+			"finished_at": now,
+		}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,156 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MaintenanceRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMaintenanceRepository(db *mongo.Database) *MaintenanceRepository {
+	return &MaintenanceRepository{
+		collection: db.Collection("maintenance_windows"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *MaintenanceRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the indexes used to find the windows of a box or group around a time
+func (r *MaintenanceRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "end", Value: 1}}},
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "end", Value: 1}}},
+	})
+	return err
+}
+
+// maintenanceFilter builds the list query; with both a box and a group it keeps the windows of either
+func maintenanceFilter(filter domain.FilterMaintenanceParams) bson.M {
+	query := bson.M{"dtime": bson.M{"$exists": false}}
+	switch {
+	case filter.BoxID != nil && filter.GroupID != nil:
+		query["$or"] = bson.A{bson.M{"box_id": *filter.BoxID}, bson.M{"group_id": *filter.GroupID}}
+	case filter.BoxID != nil:
+		query["box_id"] = *filter.BoxID
+	case filter.GroupID != nil:
+		query["group_id"] = *filter.GroupID
+	}
+	if filter.From != nil {
+		query["end"] = bson.M{"$gt": *filter.From}
+	}
+	if filter.To != nil {
+		query["start"] = bson.M{"$lt": *filter.To}
+	}
+	return query
+}
+
+func (r *MaintenanceRepository) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterMaintenanceParams) ([]domain.MaintenanceWindow, int64, error) {
+	query := maintenanceFilter(filter)
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "start", Value: -1}})
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	windows := []domain.MaintenanceWindow{}
+	if err := cursor.All(ctx, &windows); err != nil {
+		return nil, 0, err
+	}
+	return windows, total, nil
+}
+
+// ListActive returns the windows active at t (seconds) covering any of the boxes or groups
+func (r *MaintenanceRepository) ListActive(ctx context.Context, boxIDs, groupIDs []string, t int64) ([]domain.MaintenanceWindow, error) {
+	query := bson.M{
+		"dtime": bson.M{"$exists": false},
+		"start": bson.M{"$lte": t},
+		"end":   bson.M{"$gt": t},
+		"$or": bson.A{
+			bson.M{"box_id": bson.M{"$in": boxIDs}},
+			bson.M{"group_id": bson.M{"$in": groupIDs}},
+		},
+	}
+
+	cursor, err := r.collection.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	windows := []domain.MaintenanceWindow{}
+	if err := cursor.All(ctx, &windows); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+func (r *MaintenanceRepository) Get(ctx context.Context, id string) (*domain.MaintenanceWindow, error) {
+	var window domain.MaintenanceWindow
+	err := r.collection.FindOne(ctx, bson.M{"_id": id, "dtime": bson.M{"$exists": false}}).Decode(&window)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrMaintenanceNotFound
+		}
+		return nil, err
+	}
+	return &window, nil
+}
+
+func (r *MaintenanceRepository) Create(ctx context.Context, window *domain.MaintenanceWindow) error {
+	_, err := r.collection.InsertOne(ctx, window)
+	return err
+}
+
+func (r *MaintenanceRepository) Update(ctx context.Context, window *domain.MaintenanceWindow) error {
+	window.MTime = time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": window.ID, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": window},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrMaintenanceNotFound
+	}
+	return nil
+}
+
+func (r *MaintenanceRepository) Delete(ctx context.Context, id string) error {
+	now := time.Now().UnixMilli()
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"dtime": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrMaintenanceNotFound
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/lib"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// observationCollection holds the manual observations of every box, which record queries
+// asking for them union with the box's records
+const observationCollection = "observations"
+
+type ObservationRepository struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+	history    *mongo.Collection
+}
+
+func NewObservationRepository(db *mongo.Database) *ObservationRepository {
+	return &ObservationRepository{
+		client:     db.Client(),
+		collection: db.Collection(observationCollection),
+		history:    db.Collection("observations_history"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *ObservationRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection, r.history}
+}
+
+// EnsureIndexes creates the indexes used to read the observations of a box by time and the
+// history of an observation
+func (r *ObservationRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "observation_id", Value: 1}, {Key: "ctime", Value: -1}},
+	})
+	return err
+}
+
+func observationFilter(filter domain.FilterObservationParams) bson.M {
+	query := bson.M{"box_id": filter.BoxID, "dtime": bson.M{"$exists": false}}
+	timestamp := bson.M{}
+	if filter.From != nil {
+		timestamp["$gte"] = *filter.From
+	}
+	if filter.To != nil {
+		timestamp["$lte"] = *filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
+
+// ListWithPagination lists the observations of a box, newest first
+func (r *ObservationRepository) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterObservationParams) ([]domain.Observation, int64, error) {
+	query := observationFilter(filter)
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	observations := []domain.Observation{}
+	if err := cursor.All(ctx, &observations); err != nil {
+		return nil, 0, err
+	}
+	return observations, total, nil
+}
+
+func (r *ObservationRepository) Get(ctx context.Context, boxID, id string) (*domain.Observation, error) {
+	var observation domain.Observation
+	err := r.collection.FindOne(ctx, bson.M{"_id": id, "box_id": boxID, "dtime": bson.M{"$exists": false}}).Decode(&observation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrObservationNotFound
+		}
+		return nil, err
+	}
+	return &observation, nil
+}
+
+func (r *ObservationRepository) Create(ctx context.Context, observation *domain.Observation) error {
+	_, err := r.collection.InsertOne(ctx, observation)
+	return err
+}
+
+// Update replaces an observation and records the previous document in its history. The previous
+// document comes from the replacement itself, so concurrent corrections cannot slip a version in between.
+func (r *ObservationRepository) Update(ctx context.Context, observation *domain.Observation, actorID string) error {
+	return withTransaction(ctx, r.client, func(ctx context.Context) error {
+		now := time.Now().UnixMilli()
+		observation.MTime = now
+
+		opts := options.FindOneAndReplace().SetReturnDocument(options.Before)
+		var previous domain.Observation
+		err := r.collection.FindOneAndReplace(
+			ctx,
+			bson.M{"_id": observation.ID, "dtime": bson.M{"$exists": false}},
+			observation,
+			opts,
+		).Decode(&previous)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return domain.ErrObservationNotFound
+			}
+			return err
+		}
+
+		return r.appendHistory(ctx, &previous, domain.ObservationActionUpdate, actorID, now)
+	})
+}
+
+// Delete soft deletes an observation, recording it in its history
+func (r *ObservationRepository) Delete(ctx context.Context, id string, actorID string) error {
+	return withTransaction(ctx, r.client, func(ctx context.Context) error {
+		now := time.Now().UnixMilli()
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		var previous domain.Observation
+		err := r.collection.FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"dtime": now}},
+			opts,
+		).Decode(&previous)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return domain.ErrObservationNotFound
+			}
+			return err
+		}
+
+		return r.appendHistory(ctx, &previous, domain.ObservationActionDelete, actorID, now)
+	})
+}
+
+func (r *ObservationRepository) appendHistory(ctx context.Context, previous *domain.Observation, action domain.ObservationAction, actorID string, now int64) error {
+	version := domain.ObservationVersion{
+		ID:            lib.Rand.Char(16),
+		ObservationID: previous.ID,
+		Observation:   *previous,
+		Action:        action,
+		ActorID:       actorID,
+		CTime:         now,
+	}
+
+	_, err := r.history.InsertOne(ctx, version)
+	return err
+}
+
+// ListHistory returns the previous versions of an observation of a box, newest first
+func (r *ObservationRepository) ListHistory(ctx context.Context, boxID, observationID string, pagination *domain.Pagination) ([]domain.ObservationVersion, int64, error) {
+	filter := bson.M{"observation_id": observationID, "observation.box_id": boxID}
+
+	total, err := r.history.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "ctime", Value: -1}, {Key: "_id", Value: -1}})
+
+	cursor, err := r.history.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	versions := []domain.ObservationVersion{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, 0, err
+	}
+
+	return versions, total, nil
+}
+
+// unionObservations is the pipeline stage adding to a record aggregation the observations of a box
+// whose timestamp matches timeFilter, shaped as records: the timestamp as _id, the values as metric
+// fields and src set to manual. With info the observation's own fields are kept under
+// ObservationRecordKey, which reports leave out.
+func unionObservations(boxID string, timeFilter bson.M, info bool) bson.D {
+	match := bson.M{"box_id": boxID, "dtime": bson.M{"$exists": false}}
+	if timeFilter != nil {
+		match["timestamp"] = timeFilter
+	}
+
+	fields := bson.M{"_id": "$timestamp", "src": domain.RecordSourceManual}
+	if info {
+		fields[domain.ObservationRecordKey] = bson.M{
+			"id":            "$_id",
+			"observer_name": "$observer_name",
+			"note":          "$note",
+			"photo_ref":     "$photo_ref",
+		}
+	}
+
+	return bson.D{{Key: "$unionWith", Value: bson.M{
+		"coll": observationCollection,
+		"pipeline": []bson.M{
+			{"$match": match},
+			{"$replaceWith": bson.M{"$mergeObjects": []interface{}{"$metrics", fields}}},
+		},
+	}}}
+}
@@ -0,0 +1,27 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+)
+
+// boundQuery bounds a heavy query by timeout, unless ctx ends sooner; 0 leaves it unbounded.
+// The caller cancels the returned context once the query's cursor is read.
+func boundQuery(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// queryMaxTime is the maxTimeMS to send with a query so the server stops it at the deadline of ctx.
+// Canceling ctx only stops the driver waiting: without it, an aggregation whose client went away
+// keeps running on the server to completion. It is 0 when ctx has no deadline.
+func queryMaxTime(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	// The server reads a maxTimeMS of 0 as no limit
+	return max(time.Until(deadline), time.Millisecond)
+}
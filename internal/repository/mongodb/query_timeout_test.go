@@ -0,0 +1,139 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// unreachableDB is a database on a port nothing listens on. The driver connects lazily, so
+// repositories can be built on it; their queries wait for a server until ctx or the selection
+// timeout ends.
+func unreachableDB(t *testing.T) *mongo.Database {
+	t.Helper()
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client.Database("tp25_test")
+}
+
+// Report and group record queries give up with the error of their context, whether the caller went
+// away or the query timeout passed, rather than waiting for the server
+func TestQueriesReturnContextErrors(t *testing.T) {
+	db := unreachableDB(t)
+	sensors := NewSensorRepository(db)
+	zones := NewZoneRepository(db)
+	boxIDs := []string{"box-1", "box-2", "box-3"}
+	from, to := int64(1705000000), int64(1705086400)
+	query := &domain.QueryRecord{TimeMin: &from, TimeMax: &to}
+
+	calls := map[string]func(ctx context.Context) error{
+		"ReportRecords": func(ctx context.Context) error {
+			_, err := sensors.ReportRecords(ctx, "box-1", query, domain.ReportOptions{})
+			return err
+		},
+		"ListRecordsByGroup": func(ctx context.Context) error {
+			_, err := sensors.ListRecordsByGroup(ctx, boxIDs, query)
+			return err
+		},
+		"ListRecordsLatestByGroup": func(ctx context.Context) error {
+			_, err := sensors.ListRecordsLatestByGroup(ctx, boxIDs)
+			return err
+		},
+		"MetricsWithData": func(ctx context.Context) error {
+			_, err := sensors.MetricsWithData(ctx, boxIDs, [][]string{{"WAU"}, {"WAU"}, {"DR"}}, from)
+			return err
+		},
+		"MonthlyTotals": func(ctx context.Context) error {
+			_, err := zones.MonthlyTotals(ctx, "box-1", from)
+			return err
+		},
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	for name, call := range calls {
+		t.Run(name+" canceled", func(t *testing.T) {
+			if err := call(canceled); !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want %v", err, context.Canceled)
+			}
+		})
+		t.Run(name+" past its deadline", func(t *testing.T) {
+			if err := call(expired); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+			}
+		})
+	}
+
+	sensors.SetQueryTimeout(50 * time.Millisecond)
+	zones.SetQueryTimeout(50 * time.Millisecond)
+	for name, call := range calls {
+		t.Run(name+" past the query timeout", func(t *testing.T) {
+			start := time.Now()
+			err := call(context.Background())
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("returned after %v, want about the query timeout", elapsed)
+			}
+		})
+	}
+}
+
+// Boxes not started when the caller gives up are skipped and the context error returned, so the
+// results are not taken for complete
+func TestForEachBoxCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls atomic.Int32
+	err := forEachBox(ctx, []string{"box-1", "box-2", "box-3", "box-4"}, func(ctx context.Context, i int, boxID string) error {
+		calls.Add(1)
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("%d boxes queried after the cancel", n)
+	}
+}
+
+func TestQueryMaxTime(t *testing.T) {
+	if got := queryMaxTime(context.Background()); got != 0 {
+		t.Errorf("without a deadline got %v, want 0", got)
+	}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if got := queryMaxTime(expired); got != time.Millisecond {
+		t.Errorf("past the deadline got %v, want 1ms, as 0 is no limit to the server", got)
+	}
+
+	bounded, cancel := boundQuery(context.Background(), time.Minute)
+	defer cancel()
+	if got := queryMaxTime(bounded); got <= 59*time.Second || got > time.Minute {
+		t.Errorf("with a minute left got %v", got)
+	}
+
+	unbounded, cancel := boundQuery(context.Background(), 0)
+	defer cancel()
+	if _, ok := unbounded.Deadline(); ok {
+		t.Error("a zero timeout set a deadline")
+	}
+}
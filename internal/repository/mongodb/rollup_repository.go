@@ -0,0 +1,181 @@
+package mongodb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type RollupRepository struct {
+	rollups *mongo.Collection
+	states  *mongo.Collection
+
+	started sync.Map // box IDs whose rollup state is known to exist
+}
+
+func NewRollupRepository(db *mongo.Database) *RollupRepository {
+	return &RollupRepository{
+		rollups: db.Collection("daily_rollups"),
+		states:  db.Collection("rollup_state"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *RollupRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.rollups}
+}
+
+// EnsureIndexes creates the index used to read the rollups of a box by date
+func (r *RollupRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.rollups.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "box_id", Value: 1}, {Key: "date", Value: 1}},
+	})
+	return err
+}
+
+// Apply adds freshly inserted records, already grouped by day, to the stored rollups of a box
+func (r *RollupRepository) Apply(ctx context.Context, boxID string, rollups []*domain.DailyRollup) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	if err := r.start(ctx, boxID); err != nil {
+		return err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(rollups))
+	for _, rollup := range rollups {
+		inc := bson.M{"count": rollup.Count}
+		min := bson.M{}
+		max := bson.M{}
+		for key, m := range rollup.Metrics {
+			path := "metrics." + key + "."
+			inc[path+"n"] = m.N
+			inc[path+"sum"] = m.Sum
+			inc[path+"sumsq"] = m.SumSq
+			min[path+"min"] = m.Min
+			max[path+"max"] = m.Max
+		}
+
+		update := bson.M{
+			"$setOnInsert": bson.M{"box_id": boxID, "date": rollup.Date},
+			"$inc":         inc,
+		}
+		if len(min) > 0 {
+			update["$min"] = min
+			update["$max"] = max
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": rollup.ID}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+
+	_, err := r.rollups.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// start creates the rollup state of a box on its first rolled up record. Rollups are only
+// complete from the next day on: earlier records of the current day were not counted.
+func (r *RollupRepository) start(ctx context.Context, boxID string) error {
+	if _, ok := r.started.Load(boxID); ok {
+		return nil
+	}
+
+	completeFrom := domain.RollupDayStart(time.Now().Unix()) + domain.RollupDaySeconds
+	_, err := r.states.UpdateOne(ctx,
+		bson.M{"_id": boxID},
+		bson.M{"$setOnInsert": bson.M{"complete_from": completeFrom, "backfilled_through": int64(0)}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	r.started.Store(boxID, true)
+	return nil
+}
+
+// MarkStale flags days of a box whose stored records changed in place
+func (r *RollupRepository) MarkStale(ctx context.Context, boxID string, dates []string) error {
+	if len(dates) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(dates))
+	for i, date := range dates {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": boxID + ":" + date}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{"box_id": boxID, "date": date},
+				"$set":         bson.M{"stale": true},
+			}).
+			SetUpsert(true)
+	}
+
+	_, err := r.rollups.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// Replace stores a rollup rebuilt from the raw records, clearing its stale flag
+func (r *RollupRepository) Replace(ctx context.Context, rollup *domain.DailyRollup) error {
+	_, err := r.rollups.ReplaceOne(ctx, bson.M{"_id": rollup.ID}, rollup, options.Replace().SetUpsert(true))
+	return err
+}
+
+// List returns the rollups of a box between two dates (inclusive, either may be empty), by date
+func (r *RollupRepository) List(ctx context.Context, boxID, fromDate, toDate string) ([]domain.DailyRollup, error) {
+	filter := bson.M{"box_id": boxID}
+	date := bson.M{}
+	if fromDate != "" {
+		date["$gte"] = fromDate
+	}
+	if toDate != "" {
+		date["$lte"] = toDate
+	}
+	if len(date) > 0 {
+		filter["date"] = date
+	}
+
+	cursor, err := r.rollups.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "date", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	rollups := []domain.DailyRollup{}
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
+
+// State returns the rollup state of a box, nil when nothing was rolled up yet
+func (r *RollupRepository) State(ctx context.Context, boxID string) (*domain.RollupState, error) {
+	var state domain.RollupState
+	err := r.states.FindOne(ctx, bson.M{"_id": boxID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SetBackfilled records that the rollups of every day before through were rebuilt
+func (r *RollupRepository) SetBackfilled(ctx context.Context, boxID string, through int64) error {
+	if err := r.start(ctx, boxID); err != nil {
+		return err
+	}
+	_, err := r.states.UpdateOne(ctx,
+		bson.M{"_id": boxID},
+		bson.M{"$max": bson.M{"backfilled_through": through}},
+	)
+	return err
+}
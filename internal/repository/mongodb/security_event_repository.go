@@ -0,0 +1,106 @@
+package mongodb
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SecurityEventRepository struct {
+	collection *mongo.Collection
+}
+
+func NewSecurityEventRepository(db *mongo.Database) *SecurityEventRepository {
+	return &SecurityEventRepository{
+		collection: db.Collection("security_events"),
+	}
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *SecurityEventRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.collection}
+}
+
+// EnsureIndexes creates the index used to list events by time and the TTL index pruning them
+func (r *SecurityEventRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{
+			Keys:    bson.D{{Key: "expire_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+func securityEventFilter(filter domain.FilterSecurityEventParams) bson.M {
+	query := bson.M{}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.UserID != "" {
+		query["$or"] = bson.A{bson.M{"actor_id": filter.UserID}, bson.M{"subject_id": filter.UserID}}
+	}
+	if filter.Username != "" {
+		query["username"] = filter.Username
+	}
+	if filter.IP != "" {
+		query["ip"] = filter.IP
+	}
+	if filter.ExportBoxID != "" {
+		query["export.box_id"] = filter.ExportBoxID
+	}
+	if filter.ExportGroupID != "" {
+		query["export.group_id"] = filter.ExportGroupID
+	}
+	if filter.ExportFormat != "" {
+		query["export.format"] = filter.ExportFormat
+	}
+	timestamp := bson.M{}
+	if filter.From != nil {
+		timestamp["$gte"] = *filter.From
+	}
+	if filter.To != nil {
+		timestamp["$lte"] = *filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
+
+// ListWithPagination lists security events, newest first
+func (r *SecurityEventRepository) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterSecurityEventParams) ([]domain.SecurityEvent, int64, error) {
+	query := securityEventFilter(filter)
+
+	total, err := r.collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []domain.SecurityEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+func (r *SecurityEventRepository) Create(ctx context.Context, event *domain.SecurityEvent) error {
+	_, err := r.collection.InsertOne(ctx, event)
+	return err
+}
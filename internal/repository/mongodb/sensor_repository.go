@@ -2,7 +2,11 @@ package mongodb
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"tp25-api/internal/domain"
@@ -15,6 +19,8 @@ import (
 type SensorRepository struct {
 	db      *mongo.Database
 	metrics *mongo.Collection
+
+	queryTimeout time.Duration // longest a report or group record query may run, 0 for no limit
 }
 
 func NewSensorRepository(db *mongo.Database) *SensorRepository {
@@ -24,16 +30,54 @@ func NewSensorRepository(db *mongo.Database) *SensorRepository {
 	}
 }
 
+// SetQueryTimeout bounds how long a report or group record query may run, on the server too
+func (r *SensorRepository) SetQueryTimeout(timeout time.Duration) {
+	r.queryTimeout = timeout
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *SensorRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.metrics}
+}
+
+// EnsureIndexes creates the unique index for metric codes.
+// dtime is part of the key so a code only has to be unique among live metrics.
+func (r *SensorRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.metrics.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}, {Key: "dtime", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("code_live_unique"),
+	})
+	return err
+}
+
 // Metric operations
 
 func (r *SensorRepository) ListMetrics(ctx context.Context) ([]domain.Metric, error) {
-	cursor, err := r.metrics.Find(ctx, bson.M{"dtime": bson.M{"$exists": false}})
+	opts := options.Find().SetSort(bson.D{{Key: "sort_order", Value: 1}, {Key: "code", Value: 1}})
+	cursor, err := r.metrics.Find(ctx, bson.M{"dtime": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	metrics := []domain.Metric{}
+	if err := cursor.All(ctx, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// ListMetricsChangedSince returns the metrics changed since a sync cursor (milliseconds), deleted
+// ones included, or every live one when since is 0
+func (r *SensorRepository) ListMetricsChangedSince(ctx context.Context, since int64) ([]domain.Metric, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "sort_order", Value: 1}, {Key: "code", Value: 1}})
+	cursor, err := r.metrics.Find(ctx, changedSinceFilter(since), opts)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var metrics []domain.Metric
+	metrics := []domain.Metric{}
 	if err := cursor.All(ctx, &metrics); err != nil {
 		return nil, err
 	}
@@ -56,7 +100,7 @@ func (r *SensorRepository) ListMetricsWithPagination(ctx context.Context, pagina
 	opts := options.Find().
 		SetSkip(int64(pagination.GetSkip())).
 		SetLimit(int64(pagination.GetLimit())).
-		SetSort(bson.D{{Key: "ctime", Value: -1}})
+		SetSort(bson.D{{Key: "sort_order", Value: 1}, {Key: "ctime", Value: -1}})
 
 	cursor, err := r.metrics.Find(ctx, filter, opts)
 	if err != nil {
@@ -64,7 +108,7 @@ func (r *SensorRepository) ListMetricsWithPagination(ctx context.Context, pagina
 	}
 	defer cursor.Close(ctx)
 
-	var metrics []domain.Metric
+	metrics := []domain.Metric{}
 	if err := cursor.All(ctx, &metrics); err != nil {
 		return nil, 0, err
 	}
@@ -95,50 +139,125 @@ func (r *SensorRepository) CreateMetric(ctx context.Context, metric *domain.Metr
 	}
 
 	_, err = r.metrics.InsertOne(ctx, metric)
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrMetricCodeExisted
+	}
 	return err
 }
 
 func (r *SensorRepository) UpdateMetric(ctx context.Context, metric *domain.Metric) error {
 	metric.MTime = time.Now().UnixMilli()
-	_, err := r.metrics.UpdateOne(
+	result, err := r.metrics.UpdateOne(
 		ctx,
-		bson.M{"_id": metric.ID},
+		bson.M{"_id": metric.ID, "dtime": bson.M{"$exists": false}},
 		bson.M{"$set": metric},
 	)
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrMetricCodeExisted
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrMetricNotFound
+	}
+	return nil
+}
+
+// CountMetrics counts the live metrics among ids
+func (r *SensorRepository) CountMetrics(ctx context.Context, ids []string) (int64, error) {
+	return r.metrics.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": ids}, "dtime": bson.M{"$exists": false}})
+}
+
+// SetMetricOrder sets the sort_order of each metric to its position in ids, starting at 1
+func (r *SensorRepository) SetMetricOrder(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	models := make([]mongo.WriteModel, len(ids))
+	for i, id := range ids {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$set": bson.M{"sort_order": i + 1, "mtime": now}})
+	}
+
+	_, err := r.metrics.BulkWrite(ctx, models)
 	return err
 }
 
 func (r *SensorRepository) DeleteMetric(ctx context.Context, id string) error {
 	now := time.Now().UnixMilli()
-	_, err := r.metrics.UpdateOne(
+	result, err := r.metrics.UpdateOne(
 		ctx,
-		bson.M{"_id": id},
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
 		bson.M{"$set": bson.M{"dtime": now}},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrMetricNotFound
+	}
+	return nil
 }
 
 // Record operations
 
-// getRecordCollection returns the collection name for a box's sensor data
+// RecordCollectionName returns the name of the collection holding a box's sensor data
+func (r *SensorRepository) RecordCollectionName(boxID string) string {
+	return "sensor_data_" + boxID
+}
+
+// getRecordCollection returns the collection for a box's sensor data
 func (r *SensorRepository) getRecordCollection(boxID string) *mongo.Collection {
-	collectionName := "sensor_data_" + boxID
-	return r.db.Collection(collectionName)
+	return r.db.Collection(r.RecordCollectionName(boxID))
+}
+
+// isNamespaceNotFound reports whether err means the record collection does not exist yet.
+// Depending on the deployment an aggregation on a missing collection either returns no
+// documents or fails with NamespaceNotFound; both mean "no data".
+func isNamespaceNotFound(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(26)
+}
+
+// recordTimeFilter builds the _id range condition for a record query, nil when unbounded
+func recordTimeFilter(query *domain.QueryRecord) bson.M {
+	if query == nil {
+		return nil
+	}
+
+	filter := bson.M{}
+	if query.TimeMin != nil {
+		filter["$gte"] = *query.TimeMin
+	}
+	if query.TimeMax != nil {
+		filter["$lte"] = *query.TimeMax
+	}
+
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
 }
 
+// recordSortDesc orders records newest first. Records sharing a sensor time (a record and an
+// observation, or a resend) fall back to the server create time so pages are deterministic.
+var recordSortDesc = bson.D{{Key: "_id", Value: -1}, {Key: "c", Value: -1}}
+
 func (r *SensorRepository) ListRecords(ctx context.Context, boxID string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
 	collection := r.getRecordCollection(boxID)
 
 	filter := bson.M{}
-	if query != nil && len(query.Time) == 2 {
-		filter["_id"] = bson.M{
-			"$gte": query.Time[0],
-			"$lte": query.Time[1],
-		}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
 	}
 
+	// The page size comes from the query alone; the handler owns the default
 	skip := int64(0)
-	limit := int64(20)
+	var limit int64
 	if query != nil {
 		if query.Skip != nil {
 			skip = int64(*query.Skip)
@@ -148,25 +267,37 @@ func (r *SensorRepository) ListRecords(ctx context.Context, boxID string, query
 		}
 	}
 
+	page := []bson.M{
+		{"$sort": recordSortDesc},
+		{"$skip": skip},
+	}
+	if limit > 0 {
+		page = append(page, bson.M{"$limit": limit})
+	}
+	page = append(page,
+		bson.M{"$addFields": bson.M{"id": "$_id"}},
+		bson.M{"$unset": "_id"},
+	)
+
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: filter}},
-		{{Key: "$facet", Value: bson.M{
-			"records": []bson.M{
-				{"$sort": bson.M{"_id": -1}},
-				{"$skip": skip},
-				{"$limit": limit},
-				{"$addFields": bson.M{"id": "$_id"}},
-				{"$unset": "_id"},
-			},
-			"total": []bson.M{
-				{"$count": "count"},
-			},
-		}}},
 	}
+	if query != nil && query.Observations {
+		pipeline = append(pipeline, unionObservations(boxID, recordTimeFilter(query), true))
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$facet", Value: bson.M{
+		"records": page,
+		"total": []bson.M{
+			{"$count": "count"},
+		},
+	}}})
 
 	opts := options.Aggregate().SetAllowDiskUse(true)
 	cursor, err := collection.Aggregate(ctx, pipeline, opts)
 	if err != nil {
+		if isNamespaceNotFound(err) {
+			return &domain.RecordsResult{Records: []domain.Record{}, Total: 0}, nil
+		}
 		return nil, err
 	}
 	defer cursor.Close(ctx)
@@ -176,7 +307,7 @@ func (r *SensorRepository) ListRecords(ctx context.Context, boxID string, query
 		return nil, err
 	}
 
-	var records []domain.Record
+	records := []domain.Record{}
 	var totalCount int64
 
 	if len(result) > 0 {
@@ -203,18 +334,58 @@ func (r *SensorRepository) ListRecords(ctx context.Context, boxID string, query
 	}, nil
 }
 
-func (r *SensorRepository) CountRecords(ctx context.Context, boxID string, query *domain.QueryRecord) (int64, error) {
+// recordStreamBatchSize bounds how many records a streaming cursor holds per round trip
+const recordStreamBatchSize = 1000
+
+// StreamRecords calls fn for each record of a box in ascending time order, reading through a
+// cursor so memory stays bounded regardless of the range size. A non-nil error from fn stops the scan.
+func (r *SensorRepository) StreamRecords(ctx context.Context, boxID string, query *domain.QueryRecord, fn func(domain.Record) error) error {
 	collection := r.getRecordCollection(boxID)
 
 	filter := bson.M{}
-	if query != nil && len(query.Time) == 2 {
-		filter["_id"] = bson.M{
-			"$gte": query.Time[0],
-			"$lte": query.Time[1],
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
+	}
+
+	opts := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetBatchSize(recordStreamBatchSize)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var record domain.Record
+		if err := cursor.Decode(&record); err != nil {
+			return err
 		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
+
+func (r *SensorRepository) CountRecords(ctx context.Context, boxID string, query *domain.QueryRecord) (int64, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
 	}
 
-	return collection.CountDocuments(ctx, filter)
+	count, err := collection.CountDocuments(ctx, filter)
+	if isNamespaceNotFound(err) {
+		return 0, nil
+	}
+	return count, err
 }
 
 func (r *SensorRepository) AddRecord(ctx context.Context, boxID string, record domain.Record) error {
@@ -229,6 +400,248 @@ func (r *SensorRepository) AddRecord(ctx context.Context, boxID string, record d
 	return err
 }
 
+// LatestRecord returns the stored record of a box with the highest timestamp, nil when there is none
+func (r *SensorRepository) LatestRecord(ctx context.Context, boxID string) (domain.Record, error) {
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+
+	var record domain.Record
+	err := r.getRecordCollection(boxID).FindOne(ctx, bson.M{}, opts).Decode(&record)
+	if err != nil {
+		if err == mongo.ErrNoDocuments || isNamespaceNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// LatestValue returns the newest numeric value of a metric of a box, nil when it has none
+func (r *SensorRepository) LatestValue(ctx context.Context, boxID, code string) (*domain.RecordValueAt, error) {
+	filter := bson.M{}
+	filter[code] = bson.M{"$type": "number"}
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.M{code: 1})
+
+	var record domain.Record
+	err := r.getRecordCollection(boxID).FindOne(ctx, filter, opts).Decode(&record)
+	if err != nil {
+		if err == mongo.ErrNoDocuments || isNamespaceNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &domain.RecordValueAt{Time: record.GetTimestamp(), Value: record.GetFloat(code)}, nil
+}
+
+// BoxIngestStats counts the records of a box timestamped within the hour, day and week before now (seconds),
+// each with a range count on _id, and reads the timestamp of its newest record
+func (r *SensorRepository) BoxIngestStats(ctx context.Context, boxID string, now int64) (domain.BoxIngestStats, error) {
+	stats := domain.BoxIngestStats{BoxID: boxID, At: now}
+	collection := r.getRecordCollection(boxID)
+
+	for _, window := range []struct {
+		seconds int64
+		count   *int64
+	}{
+		{3600, &stats.LastHour},
+		{24 * 3600, &stats.Last24h},
+		{7 * 24 * 3600, &stats.Last7d},
+	} {
+		count, err := collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$gte": now - window.seconds, "$lte": now}})
+		if isNamespaceNotFound(err) {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("counting records of box %s failed: %w", boxID, err)
+		}
+		*window.count = count
+	}
+
+	latest, err := r.LatestRecord(ctx, boxID)
+	if err != nil {
+		return stats, err
+	}
+	if latest != nil {
+		timestamp := latest.GetTimestamp()
+		if timestamp > 1e12 {
+			timestamp = timestamp / 1000
+		}
+		stats.Latest = &timestamp
+	}
+	return stats, nil
+}
+
+// GroupIngestStats takes the ingest stats of several boxes, at most groupQueryConcurrency at once
+func (r *SensorRepository) GroupIngestStats(ctx context.Context, boxIDs []string, now int64) ([]domain.BoxIngestStats, error) {
+	stats := make([]domain.BoxIngestStats, len(boxIDs))
+	err := forEachBox(ctx, boxIDs, func(ctx context.Context, i int, boxID string) error {
+		var err error
+		stats[i], err = r.BoxIngestStats(ctx, boxID, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// MetricsWithData tells which codes of every box have a record since (seconds): codes[i] are looked up
+// in the records of boxIDs[i]. Each code costs one range query on _id that stops at the first match.
+func (r *SensorRepository) MetricsWithData(ctx context.Context, boxIDs []string, codes [][]string, since int64) ([][]bool, error) {
+	found := make([][]bool, len(boxIDs))
+
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
+
+	err := forEachBox(ctx, boxIDs, func(ctx context.Context, i int, boxID string) error {
+		collection := r.getRecordCollection(boxID)
+		found[i] = make([]bool, len(codes[i]))
+		for j, code := range codes[i] {
+			filter := bson.M{"_id": bson.M{"$gte": since}, code: bson.M{"$ne": nil}}
+			opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+			if maxTime := queryMaxTime(ctx); maxTime > 0 {
+				opts.SetMaxTime(maxTime)
+			}
+
+			err := collection.FindOne(ctx, filter, opts).Err()
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			if err != nil {
+				if isNamespaceNotFound(err) {
+					return nil
+				}
+				return fmt.Errorf("looking up %s records of box %s failed: %w", code, boxID, err)
+			}
+			found[i][j] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// NearestRecord returns the stored record closest to timestamp within window seconds, nil when there is none
+func (r *SensorRepository) NearestRecord(ctx context.Context, boxID string, timestamp, window int64) (domain.Record, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{"_id": bson.M{"$gte": timestamp - window, "$lte": timestamp + window}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var nearest domain.Record
+	var nearestDistance int64
+	for cursor.Next(ctx) {
+		var record domain.Record
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+
+		distance := record.GetTimestamp() - timestamp
+		if distance < 0 {
+			distance = -distance
+		}
+		if nearest == nil || distance < nearestDistance {
+			nearest = record
+			nearestDistance = distance
+		}
+	}
+
+	return nearest, cursor.Err()
+}
+
+// RecordsNear returns the stored records within window seconds of timestamp, read with a single range query on _id
+func (r *SensorRepository) RecordsNear(ctx context.Context, boxID string, timestamp, window int64) ([]domain.Record, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{"_id": bson.M{"$gte": timestamp - window, "$lte": timestamp + window}}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var records []domain.Record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// UpdateRecordFields sets fields on the stored record with the given _id
+func (r *SensorRepository) UpdateRecordFields(ctx context.Context, boxID string, id interface{}, fields domain.Record) error {
+	collection := r.getRecordCollection(boxID)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M(fields)})
+	return err
+}
+
+// ClearRecordFlag removes the flag set on a metric of the stored record timestamped at timestamp
+// (seconds) and returns it. It fails with ErrRecordNotFound when there is no such record and with
+// ErrRecordFlagNotFound when the metric carries no flag.
+func (r *SensorRepository) ClearRecordFlag(ctx context.Context, boxID string, timestamp int64, code string) (string, error) {
+	collection := r.getRecordCollection(boxID)
+	path := domain.RecordFlagsKey + "." + code
+	filter := bson.M{"_id": timestamp}
+	filter[path] = bson.M{"$exists": true}
+
+	var before domain.Record
+	err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$unset": bson.M{path: ""}}).Decode(&before)
+	if err == nil {
+		return before.StoredFlags()[code], nil
+	}
+	if err != mongo.ErrNoDocuments && !isNamespaceNotFound(err) {
+		return "", err
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{"_id": timestamp})
+	if err != nil && !isNamespaceNotFound(err) {
+		return "", err
+	}
+	if count == 0 {
+		return "", domain.ErrRecordNotFound
+	}
+	return "", domain.ErrRecordFlagNotFound
+}
+
+// InsertRecords writes records of a box in one unordered batch. Records whose timestamp is
+// already stored are skipped and their indexes returned in duplicates; any other failure is returned.
+func (r *SensorRepository) InsertRecords(ctx context.Context, boxID string, records []domain.Record) ([]int, error) {
+	collection := r.getRecordCollection(boxID)
+
+	docs := make([]interface{}, len(records))
+	for i, record := range records {
+		docs[i] = record
+	}
+
+	_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil, nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return nil, err
+	}
+	duplicates := make([]int, 0, len(bulkErr.WriteErrors))
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return nil, err
+		}
+		duplicates = append(duplicates, writeErr.Index)
+	}
+	return duplicates, nil
+}
+
 func (r *SensorRepository) ImportRecord(ctx context.Context, boxID string, record domain.Record) error {
 	collection := r.getRecordCollection(boxID)
 
@@ -243,22 +656,29 @@ func (r *SensorRepository) ImportRecord(ctx context.Context, boxID string, recor
 
 // ReportRecords generates daily reports for a box within a time range
 // This implementation FIXES the N+1 query problem from the TypeScript version
-func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, query *domain.QueryRecord) ([]domain.DailyReport, error) {
+func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, query *domain.QueryRecord, opts domain.ReportOptions) ([]domain.DailyReport, error) {
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
+
 	collection := r.getRecordCollection(boxID)
 
 	matchStage := bson.M{"_id": bson.M{"$exists": true}}
-	if query != nil && len(query.Time) == 2 {
-		matchStage["_id"] = bson.M{
-			"$gte": query.Time[0],
-			"$lte": query.Time[1],
-		}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		matchStage["_id"] = timeFilter
 	}
 
 	// Use aggregation pipeline to generate daily reports in a single query
 	// This FIXES the N+1 query problem from the original TypeScript implementation
 	pipeline := mongo.Pipeline{
 		{{Key: "$match", Value: matchStage}},
-		{{Key: "$addFields", Value: bson.M{
+	}
+	if opts.Observations {
+		pipeline = append(pipeline, unionObservations(boxID, recordTimeFilter(query), false))
+	}
+	pipeline = append(pipeline,
+		// Keep samples in time order inside each day for time-weighted averages
+		bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		bson.D{{Key: "$addFields", Value: bson.M{
 			"date": bson.M{
 				"$dateToString": bson.M{
 					"format": "%Y-%m-%d",
@@ -266,16 +686,24 @@ func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, quer
 				},
 			},
 		}}},
-		{{Key: "$group", Value: bson.M{
+		bson.D{{Key: "$group", Value: bson.M{
 			"_id":   "$date",
 			"count": bson.M{"$sum": 1},
 			"data":  bson.M{"$push": "$$ROOT"},
 		}}},
-		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		bson.D{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	)
+
+	aggregateOpts := options.Aggregate()
+	if maxTime := queryMaxTime(ctx); maxTime > 0 {
+		aggregateOpts.SetMaxTime(maxTime)
 	}
 
-	cursor, err := collection.Aggregate(ctx, pipeline)
+	cursor, err := collection.Aggregate(ctx, pipeline, aggregateOpts)
 	if err != nil {
+		if isNamespaceNotFound(err) {
+			return []domain.DailyReport{}, nil
+		}
 		return nil, err
 	}
 	defer cursor.Close(ctx)
@@ -285,7 +713,7 @@ func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, quer
 		return nil, err
 	}
 
-	var reports []domain.DailyReport
+	reports := []domain.DailyReport{}
 	for _, result := range results {
 		date := result["_id"].(string)
 		count := int(result["count"].(int32))
@@ -307,6 +735,12 @@ func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, quer
 
 		for _, item := range data {
 			if record, ok := item.(bson.M); ok {
+				// Corrected in place, so time-weighted averages see the corrected samples too
+				if opts.ExcludeAnomalies {
+					domain.Record(record).DropAnomalies()
+				}
+				opts.Calibration.Apply(domain.Record(record))
+
 				for key, value := range record {
 					// Skip non-metric fields
 					if key == "_id" || key == "c" || key == "date" {
@@ -334,9 +768,17 @@ func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, quer
 		}
 
 		// Calculate averages
-		for key, sum := range metricSums {
-			if count := metricCounts[key]; count > 0 {
-				report.Avg[key] = domain.RoundValue(sum / float64(count))
+		if opts.Avg == domain.AvgTimeWeighted {
+			dayStart, _ := time.Parse("2006-01-02", date)
+			dayEnd := dayStart.Add(24 * time.Hour).Unix()
+			for key, avg := range timeWeightedAverages(data, dayEnd, opts.MaxGap) {
+				report.Avg[key] = domain.RoundValue(avg)
+			}
+		} else {
+			for key, sum := range metricSums {
+				if count := metricCounts[key]; count > 0 {
+					report.Avg[key] = domain.RoundValue(sum / float64(count))
+				}
 			}
 		}
 
@@ -354,92 +796,642 @@ func (r *SensorRepository) ReportRecords(ctx context.Context, boxID string, quer
 	return reports, nil
 }
 
-func (r *SensorRepository) ListRecordsByGroup(ctx context.Context, boxIDs []string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
-	if len(boxIDs) == 0 {
-		return &domain.RecordsResult{Records: []domain.Record{}, Total: 0}, nil
+// RecordStats computes count/min/max/avg/stddev and first/last value per metric in one aggregation
+func (r *SensorRepository) RecordStats(ctx context.Context, boxID string, query *domain.QueryRecord, metrics []string) ([]domain.MetricStats, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
 	}
 
-	skip := int64(0)
-	limit := int64(20)
-	if query != nil {
-		if query.Skip != nil {
-			skip = int64(*query.Skip)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: recordStatsGroup(metrics)}},
+	}
+
+	var results []bson.M
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil && !isNamespaceNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer cursor.Close(ctx)
+		if err := cursor.All(ctx, &results); err != nil {
+			return nil, err
 		}
-		if query.Limit != nil {
-			limit = int64(*query.Limit)
+	}
+
+	stats := make([]domain.MetricStats, len(metrics))
+	for i, metric := range metrics {
+		stats[i] = domain.MetricStats{Metric: metric}
+		if len(results) == 0 {
+			continue
 		}
+
+		doc := domain.Record(results[0])
+		suffix := strconv.Itoa(i)
+		stats[i].Count = int64(doc.GetFloat("count" + suffix))
+		if stats[i].Count == 0 {
+			continue
+		}
+
+		stats[i].Min = roundedValue(doc, "min"+suffix)
+		stats[i].Max = roundedValue(doc, "max"+suffix)
+		stats[i].Avg = roundedValue(doc, "avg"+suffix)
+		stats[i].StdDev = roundedValue(doc, "std"+suffix)
+
+		stats[i].First = decodeValueAt(doc["first"+suffix])
+		stats[i].Last = decodeValueAt(doc["last"+suffix])
+	}
+
+	return stats, nil
+}
+
+// recordStatsGroup is the $group stage of RecordStats. Output fields are keyed by index so metric
+// codes never end up in field paths.
+func recordStatsGroup(metrics []string) bson.M {
+	group := bson.M{"_id": nil}
+	for i, metric := range metrics {
+		field := "$" + metric
+		value := bson.M{"$cond": bson.A{bson.M{"$isNumber": field}, field, nil}}
+		// Documents compare field by field in order, so the smallest {t, v} is the earliest sample.
+		// A bson.M could be encoded with v first, comparing values instead of times.
+		point := bson.M{"$cond": bson.A{bson.M{"$isNumber": field}, bson.D{{Key: "t", Value: "$_id"}, {Key: "v", Value: field}}, nil}}
+		suffix := strconv.Itoa(i)
+
+		group["count"+suffix] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$isNumber": field}, 1, 0}}}
+		group["min"+suffix] = bson.M{"$min": value}
+		group["max"+suffix] = bson.M{"$max": value}
+		group["avg"+suffix] = bson.M{"$avg": value}
+		group["std"+suffix] = bson.M{"$stdDevPop": value}
+		group["first"+suffix] = bson.M{"$min": point}
+		group["last"+suffix] = bson.M{"$max": point}
+	}
+	return group
+}
+
+// RecordFields samples up to sample records of a box in the query's time range and returns every
+// field they hold with its BSON types, the earliest and latest sampled record holding it and how
+// many do, along with how many records were sampled
+func (r *SensorRepository) RecordFields(ctx context.Context, boxID string, query *domain.QueryRecord, sample int) ([]domain.RecordSchemaField, int64, error) {
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
+
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
 	}
 
-	matchStage := bson.M{}
-	if query != nil && len(query.Time) == 2 {
-		matchStage["_id"] = bson.M{
-			"$gte": query.Time[0],
-			"$lte": query.Time[1],
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sample", Value: bson.M{"size": sample}}},
+		{{Key: "$project", Value: bson.M{"_id": 1, "fields": bson.M{"$objectToArray": "$$ROOT"}}}},
+		{{Key: "$unwind", Value: "$fields"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"k": "$fields.k", "t": bson.M{"$type": "$fields.v"}},
+			"first": bson.M{"$min": "$_id"},
+			"last":  bson.M{"$max": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	if maxTime := queryMaxTime(ctx); maxTime > 0 {
+		opts.SetMaxTime(maxTime)
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return []domain.RecordSchemaField{}, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		ID struct {
+			Key  string `bson:"k"`
+			Type string `bson:"t"`
+		} `bson:"_id"`
+		First int64 `bson:"first"`
+		Last  int64 `bson:"last"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, 0, err
+	}
+
+	// One result per field and type; a field stored with several types is merged back
+	var sampled int64
+	byName := map[string]*domain.RecordSchemaField{}
+	names := []string{}
+	for _, result := range results {
+		if result.ID.Key == "_id" {
+			// Every record has an _id
+			sampled += result.Count
+			continue
+		}
+		field, ok := byName[result.ID.Key]
+		if !ok {
+			field = &domain.RecordSchemaField{Name: result.ID.Key, First: result.First, Last: result.Last}
+			byName[result.ID.Key] = field
+			names = append(names, result.ID.Key)
 		}
+		field.Types = append(field.Types, result.ID.Type)
+		field.First = min(field.First, result.First)
+		field.Last = max(field.Last, result.Last)
+		field.Count += result.Count
+	}
+
+	fields := make([]domain.RecordSchemaField, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, *byName[name])
+	}
+	return fields, sampled, nil
+}
+
+// BucketSeries averages a metric of a box into fixed-size buckets aligned to query.TimeMin
+func (r *SensorRepository) BucketSeries(ctx context.Context, boxID string, metric string, query *domain.QueryRecord, bucketSize int64) ([]domain.SeriesPoint, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{metric: bson.M{"$type": "number"}}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
 	}
 
-	firstBoxID := boxIDs[0]
-	collection := r.getRecordCollection(firstBoxID)
+	var origin int64
+	if query != nil && query.TimeMin != nil {
+		origin = *query.TimeMin
+	}
 
 	pipeline := mongo.Pipeline{
-		{{Key: "$match", Value: matchStage}},
-		{{Key: "$addFields", Value: bson.M{"box_id": firstBoxID}}},
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			// Bucket start: _id - ((_id - origin) mod bucketSize)
+			"_id": bson.M{"$subtract": bson.A{
+				"$_id",
+				bson.M{"$mod": bson.A{bson.M{"$subtract": bson.A{"$_id", origin}}, bucketSize}},
+			}},
+			"value": bson.M{"$avg": "$" + metric},
+			"count": bson.M{"$sum": 1},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
 	}
 
-	for i := 1; i < len(boxIDs); i++ {
-		pipeline = append(pipeline, bson.D{{Key: "$unionWith", Value: bson.M{
-			"coll": "sensor_data_" + boxIDs[i],
-			"pipeline": []bson.M{
-				{"$match": matchStage},
-				{"$addFields": bson.M{"box_id": boxIDs[i]}},
-			},
-		}}})
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
 	}
+	defer cursor.Close(ctx)
 
-	pipeline = append(pipeline, bson.D{{Key: "$facet", Value: bson.M{
-		"records": []bson.M{
-			{"$sort": bson.M{"_id": -1}},
-			{"$skip": skip},
-			{"$limit": limit},
-			{"$addFields": bson.M{"id": "$_id"}},
-			{"$unset": "_id"},
-		},
-		"total": []bson.M{
-			{"$count": "count"},
-		},
-	}}})
+	var results []bson.M
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	points := make([]domain.SeriesPoint, 0, len(results))
+	for _, result := range results {
+		doc := domain.Record(result)
+		points = append(points, domain.SeriesPoint{
+			Time:  int64(doc.GetFloat("_id")),
+			Value: domain.RoundValue(doc.GetFloat("value")),
+			Count: int64(doc.GetFloat("count")),
+		})
+	}
+
+	return points, nil
+}
+
+// MetricRange returns the unrounded lowest and highest value of a metric, nil when it has no values
+func (r *SensorRepository) MetricRange(ctx context.Context, boxID string, metric string, query *domain.QueryRecord) (min, max *float64, err error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{metric: bson.M{"$type": "number"}}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id": nil,
+			"min": bson.M{"$min": "$" + metric},
+			"max": bson.M{"$max": "$" + metric},
+		}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		if isNamespaceNotFound(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []bson.M
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil, nil
+	}
+
+	doc := domain.Record(results[0])
+	lo, hi := doc.GetFloat("min"), doc.GetFloat("max")
+	return &lo, &hi, nil
+}
+
+// MetricHistogram counts the samples of a metric falling in each bin between consecutive edges, plus
+// the samples outside the edges and, for each threshold, the samples above it, in one aggregation
+func (r *SensorRepository) MetricHistogram(ctx context.Context, boxID string, metric string, query *domain.QueryRecord, edges []float64, thresholds []float64) (*domain.Histogram, []int64, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{metric: bson.M{"$type": "number"}}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
+	}
+
+	field := "$" + metric
+	boundaries := make(bson.A, len(edges))
+	for i, edge := range edges {
+		boundaries[i] = edge
+	}
+
+	// Threshold counts are keyed by index so values never end up in field paths
+	totals := bson.M{"_id": nil, "count": bson.M{"$sum": 1}}
+	for i, threshold := range thresholds {
+		totals["above"+strconv.Itoa(i)] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{field, threshold}}, 1, 0}}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: bson.M{
+			"bins": bson.A{bson.M{"$bucket": bson.M{
+				"groupBy":    field,
+				"boundaries": boundaries,
+				"default":    "outside",
+				"output":     bson.M{"count": bson.M{"$sum": 1}},
+			}}},
+			"totals": bson.A{bson.M{"$group": totals}},
+		}}},
+	}
+
+	histogram := &domain.Histogram{Bins: make([]domain.HistogramBin, len(edges)-1)}
+	for i := range histogram.Bins {
+		histogram.Bins[i] = domain.HistogramBin{Min: edges[i], Max: edges[i+1]}
+	}
+	above := make([]int64, len(thresholds))
 
 	opts := options.Aggregate().SetAllowDiskUse(true)
 	cursor, err := collection.Aggregate(ctx, pipeline, opts)
 	if err != nil {
-		return nil, fmt.Errorf("aggregation failed: %w", err)
+		if isNamespaceNotFound(err) {
+			return histogram, above, nil
+		}
+		return nil, nil, err
 	}
 	defer cursor.Close(ctx)
 
-	var result []bson.M
-	if err := cursor.All(ctx, &result); err != nil {
-		return nil, fmt.Errorf("reading aggregation result failed: %w", err)
+	var results []struct {
+		Bins   []bson.M `bson:"bins"`
+		Totals []bson.M `bson:"totals"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, nil, err
+	}
+	if len(results) == 0 {
+		return histogram, above, nil
 	}
 
-	var allRecords []domain.Record
-	var totalCount int64
+	for _, bin := range results[0].Bins {
+		doc := domain.Record(bin)
+		count := int64(doc.GetFloat("count"))
+		lower, ok := bin["_id"].(float64)
+		if !ok {
+			histogram.Outside += count
+			continue
+		}
+		// $bucket names each bin by its lower boundary
+		i := sort.SearchFloat64s(edges, lower)
+		if i < len(histogram.Bins) && edges[i] == lower {
+			histogram.Bins[i].Count = count
+		}
+	}
 
-	if len(result) > 0 {
-		if recordsData, ok := result[0]["records"].(bson.A); ok {
-			for _, item := range recordsData {
-				if record, ok := item.(bson.M); ok {
-					allRecords = append(allRecords, domain.Record(record))
-				}
+	if len(results[0].Totals) > 0 {
+		doc := domain.Record(results[0].Totals[0])
+		histogram.Count = int64(doc.GetFloat("count"))
+		for i := range thresholds {
+			above[i] = int64(doc.GetFloat("above" + strconv.Itoa(i)))
+		}
+	}
+
+	return histogram, above, nil
+}
+
+// QualityStats reads the timestamps of a box in order with the values of the bounded metrics,
+// counting repeated timestamps and the values outside their bounds. Records are streamed, so a long
+// range is not gathered into one document.
+func (r *SensorRepository) QualityStats(ctx context.Context, boxID string, query *domain.QueryRecord, bounds []domain.MetricBounds) (*domain.QualityStats, error) {
+	collection := r.getRecordCollection(boxID)
+
+	filter := bson.M{}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
+	}
+	projection := bson.M{"_id": 1}
+	for _, b := range bounds {
+		projection[b.Code] = 1
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(projection)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	stats := &domain.QualityStats{Timestamps: []int64{}, OutOfRange: make(map[string]int64)}
+	for cursor.Next(ctx) {
+		var record domain.Record
+		if err := cursor.Decode(&record); err != nil {
+			return nil, err
+		}
+		record = record.Normalize()
+
+		timestamp := record.GetTimestamp()
+		if n := len(stats.Timestamps); n > 0 && stats.Timestamps[n-1] == timestamp {
+			stats.Duplicates++
+		} else {
+			stats.Timestamps = append(stats.Timestamps, timestamp)
+		}
+		for _, b := range bounds {
+			if record.HasNumber(b.Code) && !b.InRange(record.GetFloat(b.Code)) {
+				stats.OutOfRange[b.Code]++
 			}
 		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
 
-		if totalData, ok := result[0]["total"].(bson.A); ok && len(totalData) > 0 {
-			if countDoc, ok := totalData[0].(bson.M); ok {
-				if count, ok := countDoc["count"].(int32); ok {
-					totalCount = int64(count)
-				}
+// roundedValue returns the rounded numeric value of key, nil when absent
+func roundedValue(doc domain.Record, key string) *float64 {
+	if doc[key] == nil {
+		return nil
+	}
+	v := domain.RoundValue(doc.GetFloat(key))
+	return &v
+}
+
+// decodeValueAt converts a {t, v} aggregation result into a RecordValueAt
+func decodeValueAt(raw interface{}) *domain.RecordValueAt {
+	point, ok := raw.(bson.M)
+	if !ok {
+		return nil
+	}
+	record := domain.Record(point)
+	return &domain.RecordValueAt{
+		Time:  int64(record.GetFloat("t")),
+		Value: record.GetFloat("v"),
+	}
+}
+
+// timeWeightedAverages computes per-metric averages over one day of samples sorted by _id.
+// Each sample is weighted by the seconds until the next sample carrying the same metric
+// (or until dayEnd for the last one), capped at maxGap so a value reported right before
+// an outage does not dominate the rest of the day.
+func timeWeightedAverages(data []interface{}, dayEnd, maxGap int64) map[string]float64 {
+	type sample struct {
+		t int64
+		v float64
+	}
+	series := make(map[string][]sample)
+
+	for _, item := range data {
+		record, ok := item.(bson.M)
+		if !ok {
+			continue
+		}
+		t := domain.Record(record).GetTimestamp()
+		for key, value := range record {
+			if key == "_id" || key == "c" || key == "date" {
+				continue
 			}
+			if floatVal, ok := value.(float64); ok {
+				series[key] = append(series[key], sample{t: t, v: floatVal})
+			}
+		}
+	}
+
+	averages := make(map[string]float64)
+	for key, samples := range series {
+		var weighted, totalWeight float64
+		for i, smp := range samples {
+			next := dayEnd
+			if i+1 < len(samples) {
+				next = samples[i+1].t
+			}
+			weight := next - smp.t
+			if weight > maxGap {
+				weight = maxGap
+			}
+			if weight <= 0 {
+				continue
+			}
+			weighted += smp.v * float64(weight)
+			totalWeight += float64(weight)
 		}
+
+		if totalWeight > 0 {
+			averages[key] = weighted / totalWeight
+		} else {
+			// All samples share one timestamp, fall back to the plain mean
+			var sum float64
+			for _, smp := range samples {
+				sum += smp.v
+			}
+			averages[key] = sum / float64(len(samples))
+		}
+	}
+
+	return averages
+}
+
+// groupQueryConcurrency bounds how many box collections are queried at once for a group.
+// A single pipeline with one $unionWith per box exceeded Mongo's memory limits on large groups.
+const groupQueryConcurrency = 8
+
+// forEachBox runs fn for every box with at most groupQueryConcurrency calls in flight.
+// The first error cancels the remaining calls and is returned, as is the error of ctx once it ends.
+func forEachBox(parent context.Context, boxIDs []string, fn func(ctx context.Context, i int, boxID string) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	sem := make(chan struct{}, groupQueryConcurrency)
+	errs := make(chan error, len(boxIDs))
+	var wg sync.WaitGroup
+
+	for i, boxID := range boxIDs {
+		wg.Add(1)
+		go func(i int, boxID string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			// select picks at random when both are ready, so a slot may come after the cancel
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err := fn(ctx, i, boxID); err != nil {
+				errs <- err
+				cancel()
+			}
+		}(i, boxID)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if err, ok := <-errs; ok {
+		return err
+	}
+	// Boxes not started when the caller gave up were skipped, so the results are partial
+	return parent.Err()
+}
+
+// sortRecordsDesc orders records newest first, by box_id on equal timestamps so pages are stable
+func sortRecordsDesc(records []domain.Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		ti, tj := records[i].GetTimestamp(), records[j].GetTimestamp()
+		if ti != tj {
+			return ti > tj
+		}
+		if ci, cj := records[i].GetCreateTime(), records[j].GetCreateTime(); ci != cj {
+			return ci > cj
+		}
+		bi, _ := records[i]["box_id"].(string)
+		bj, _ := records[j]["box_id"].(string)
+		return bi < bj
+	})
+}
+
+// ListRecordsByGroup pages through the merged records of several boxes, newest first.
+// Each box is queried separately for at most skip+limit records, then the results are merged here.
+func (r *SensorRepository) ListRecordsByGroup(ctx context.Context, boxIDs []string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
+	if len(boxIDs) == 0 {
+		return &domain.RecordsResult{Records: []domain.Record{}, Total: 0}, nil
+	}
+
+	skip := int64(0)
+	var limit int64
+	if query != nil {
+		if query.Skip != nil {
+			skip = int64(*query.Skip)
+		}
+		if query.Limit != nil {
+			limit = int64(*query.Limit)
+		}
+	}
+
+	filter := bson.M{}
+	if timeFilter := recordTimeFilter(query); timeFilter != nil {
+		filter["_id"] = timeFilter
+	}
+
+	perBox := make([][]domain.Record, len(boxIDs))
+	counts := make([]int64, len(boxIDs))
+
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
+
+	err := forEachBox(ctx, boxIDs, func(ctx context.Context, i int, boxID string) error {
+		collection := r.getRecordCollection(boxID)
+
+		countOpts := options.Count()
+		if maxTime := queryMaxTime(ctx); maxTime > 0 {
+			countOpts.SetMaxTime(maxTime)
+		}
+		count, err := collection.CountDocuments(ctx, filter, countOpts)
+		if err != nil {
+			if isNamespaceNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("counting records of box %s failed: %w", boxID, err)
+		}
+		if count == 0 {
+			return nil
+		}
+		counts[i] = count
+
+		opts := options.Find().SetSort(recordSortDesc)
+		if limit > 0 {
+			opts.SetLimit(skip + limit)
+		}
+		if maxTime := queryMaxTime(ctx); maxTime > 0 {
+			opts.SetMaxTime(maxTime)
+		}
+
+		cursor, err := collection.Find(ctx, filter, opts)
+		if err != nil {
+			return fmt.Errorf("reading records of box %s failed: %w", boxID, err)
+		}
+		defer cursor.Close(ctx)
+
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return fmt.Errorf("reading records of box %s failed: %w", boxID, err)
+		}
+
+		records := make([]domain.Record, 0, len(docs))
+		for _, doc := range docs {
+			doc["box_id"] = boxID
+			records = append(records, domain.Record(doc))
+		}
+		perBox[i] = records
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var totalCount int64
+	var merged []domain.Record
+	for i := range boxIDs {
+		totalCount += counts[i]
+		merged = append(merged, perBox[i]...)
+	}
+
+	sortRecordsDesc(merged)
+
+	if skip >= int64(len(merged)) {
+		merged = nil
+	} else {
+		end := skip + limit
+		if limit <= 0 || end > int64(len(merged)) {
+			end = int64(len(merged))
+		}
+		merged = merged[skip:end]
+	}
+
+	allRecords := make([]domain.Record, 0, len(merged))
+	for _, record := range merged {
+		record["id"] = record["_id"]
+		delete(record, "_id")
+		allRecords = append(allRecords, record)
 	}
 
 	return &domain.RecordsResult{
@@ -448,48 +1440,52 @@ func (r *SensorRepository) ListRecordsByGroup(ctx context.Context, boxIDs []stri
 	}, nil
 }
 
+// ListRecordsLatestByGroup returns the newest record of every box, newest first
 func (r *SensorRepository) ListRecordsLatestByGroup(ctx context.Context, boxIDs []string) (*domain.RecordsResult, error) {
 	if len(boxIDs) == 0 {
 		return &domain.RecordsResult{Records: []domain.Record{}, Total: 0}, nil
 	}
 
-	firstBoxID := boxIDs[0]
-	collection := r.getRecordCollection(firstBoxID)
+	latest := make([]domain.Record, len(boxIDs))
 
-	pipeline := mongo.Pipeline{
-		bson.D{{Key: "$sort", Value: bson.M{"_id": -1}}},
-		bson.D{{Key: "$limit", Value: 1}},
-		bson.D{{Key: "$addFields", Value: bson.M{"box_id": firstBoxID}}},
-	}
-
-	for i := 1; i < len(boxIDs); i++ {
-		pipeline = append(pipeline, bson.D{{Key: "$unionWith", Value: bson.M{
-			"coll": "sensor_data_" + boxIDs[i],
-			"pipeline": mongo.Pipeline{
-				bson.D{{Key: "$sort", Value: bson.M{"_id": -1}}},
-				bson.D{{Key: "$limit", Value: 1}},
-				bson.D{{Key: "$addFields", Value: bson.M{"box_id": boxIDs[i]}}},
-			},
-		}}})
-	}
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
 
-	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.M{"_id": -1}}})
+	err := forEachBox(ctx, boxIDs, func(ctx context.Context, i int, boxID string) error {
+		opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+		if maxTime := queryMaxTime(ctx); maxTime > 0 {
+			opts.SetMaxTime(maxTime)
+		}
 
-	pipeline = append(pipeline,
-		bson.D{{Key: "$addFields", Value: bson.M{"id": "$_id"}}},
-		bson.D{{Key: "$unset", Value: "_id"}},
-	)
+		var doc bson.M
+		err := r.getRecordCollection(boxID).FindOne(ctx, bson.M{}, opts).Decode(&doc)
+		if err != nil {
+			if err == mongo.ErrNoDocuments || isNamespaceNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("reading latest record of box %s failed: %w", boxID, err)
+		}
 
-	opts := options.Aggregate()
-	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+		doc["box_id"] = boxID
+		latest[i] = domain.Record(doc)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("aggregation failed: %w", err)
+		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	var result []domain.Record
-	if err := cursor.All(ctx, &result); err != nil {
-		return nil, fmt.Errorf("reading aggregation result failed: %w", err)
+	result := make([]domain.Record, 0, len(boxIDs))
+	for _, record := range latest {
+		if record != nil {
+			result = append(result, record)
+		}
+	}
+
+	sortRecordsDesc(result)
+
+	for _, record := range result {
+		record["id"] = record["_id"]
+		delete(record, "_id")
 	}
 
 	return &domain.RecordsResult{
@@ -0,0 +1,135 @@
+package mongodb
+
+import (
+	"math"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTimeWeightedAverages(t *testing.T) {
+	const hour = 3600
+
+	tests := []struct {
+		name   string
+		data   []interface{}
+		dayEnd int64
+		want   map[string]float64
+	}{
+		{
+			name:   "regular sampling is the plain mean",
+			data:   []interface{}{bson.M{"_id": int64(0), "WAU": 1.0}, bson.M{"_id": int64(hour), "WAU": 2.0}, bson.M{"_id": int64(2 * hour), "WAU": 6.0}},
+			dayEnd: 3 * hour,
+			want:   map[string]float64{"WAU": 3},
+		},
+		{
+			// A burst of samples counts for the minutes it lasted, not for its number of samples:
+			// 1 for 10 min, 4 for 50 min, 10 for an hour
+			name: "irregular sampling",
+			data: []interface{}{
+				bson.M{"_id": int64(0), "WAU": 1.0},
+				bson.M{"_id": int64(600), "WAU": 4.0},
+				bson.M{"_id": int64(hour), "WAU": 10.0},
+			},
+			dayEnd: 2 * hour,
+			want:   map[string]float64{"WAU": (1*600 + 4*3000 + 10*3600) / 7200.0},
+		},
+		{
+			name: "flood burst does not dominate the day",
+			data: []interface{}{
+				bson.M{"_id": int64(0), "WAU": 1.0},
+				bson.M{"_id": int64(hour), "WAU": 9.0},
+				bson.M{"_id": int64(hour + 60), "WAU": 9.0},
+				bson.M{"_id": int64(hour + 120), "WAU": 9.0},
+				bson.M{"_id": int64(hour + 180), "WAU": 1.0},
+			},
+			dayEnd: 4*hour + 180,
+			want:   map[string]float64{"WAU": (1*3600 + 9*180 + 1*3600) / 7380.0},
+		},
+		{
+			// Before an outage the last value counts for maxGap only
+			name:   "gap capped at maxGap",
+			data:   []interface{}{bson.M{"_id": int64(0), "WAU": 2.0}, bson.M{"_id": int64(10 * hour), "WAU": 8.0}},
+			dayEnd: 24 * hour,
+			want:   map[string]float64{"WAU": 5},
+		},
+		{
+			name:   "single sample",
+			data:   []interface{}{bson.M{"_id": int64(5 * hour), "WAU": 3.25}},
+			dayEnd: 24 * hour,
+			want:   map[string]float64{"WAU": 3.25},
+		},
+		{
+			// Its weight until the end of the day is 0, so the plain mean is used
+			name:   "single sample at the end of the day",
+			data:   []interface{}{bson.M{"_id": int64(24 * hour), "WAU": 3.25}},
+			dayEnd: 24 * hour,
+			want:   map[string]float64{"WAU": 3.25},
+		},
+		{
+			name:   "samples sharing one timestamp",
+			data:   []interface{}{bson.M{"_id": int64(24 * hour), "WAU": 1.0}, bson.M{"_id": int64(24 * hour), "WAU": 2.0}},
+			dayEnd: 24 * hour,
+			want:   map[string]float64{"WAU": 1.5},
+		},
+		{
+			// DR is weighted by the time to its own next sample, not to the next record
+			name: "metrics sampled at different times",
+			data: []interface{}{
+				bson.M{"_id": int64(0), "WAU": 1.0, "DR": 2.0},
+				bson.M{"_id": int64(1800), "WAU": 3.0},
+				bson.M{"_id": int64(hour), "WAU": 5.0, "DR": 6.0},
+			},
+			dayEnd: 2 * hour,
+			want:   map[string]float64{"WAU": (1*1800 + 3*1800 + 5*3600) / 7200.0, "DR": 4},
+		},
+		{
+			name:   "fields that are not metric values are skipped",
+			data:   []interface{}{bson.M{"_id": int64(0), "c": 4.0, "date": "2024-01-12", "WAU": 1.0, "note": "ok", "n": int32(2)}, "not a record"},
+			dayEnd: hour,
+			want:   map[string]float64{"WAU": 1},
+		},
+		{
+			name:   "no samples",
+			dayEnd: hour,
+			want:   map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := timeWeightedAverages(tt.data, tt.dayEnd, hour)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for key, want := range tt.want {
+				if math.Abs(got[key]-want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+// first and last pick the {t, v} documents with the smallest and largest time. The server compares
+// documents field by field in order, so t has to be encoded before v on every request.
+func TestRecordStatsGroupOrdersPointsByTime(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		group := recordStatsGroup([]string{"WAU", "DR"})
+		for _, key := range []string{"first0", "last0", "first1", "last1"} {
+			_, raw, err := bson.MarshalValue(group[key])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var accumulator bson.D
+			if err := bson.Unmarshal(raw, &accumulator); err != nil {
+				t.Fatal(err)
+			}
+			cond := accumulator[0].Value.(bson.D)[0].Value.(bson.A)
+			point, ok := cond[1].(bson.D)
+			if !ok || len(point) != 2 || point[0].Key != "t" || point[1].Key != "v" {
+				t.Fatalf("%s compares %v, want {t, v}", key, cond[1])
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package mongodb
 
 import (
 	"context"
+	"errors"
+	"regexp"
 	"time"
 
 	"tp25-api/internal/domain"
@@ -13,15 +15,32 @@ import (
 )
 
 type SettingRepository struct {
+	client     *mongo.Client
 	collection *mongo.Collection
+	history    *mongo.Collection
 }
 
 func NewSettingRepository(db *mongo.Database) *SettingRepository {
 	return &SettingRepository{
+		client:     db.Client(),
 		collection: db.Collection("settings"),
+		history:    db.Collection("settings_history"),
 	}
 }
 
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *SettingRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.history}
+}
+
+// EnsureIndexes creates the index used to list a setting's versions newest first
+func (r *SettingRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "setting_id", Value: 1}, {Key: "ctime", Value: -1}},
+	})
+	return err
+}
+
 func (r *SettingRepository) List(ctx context.Context) ([]domain.Setting, error) {
 	cursor, err := r.collection.Find(ctx, bson.M{})
 	if err != nil {
@@ -29,7 +48,7 @@ func (r *SettingRepository) List(ctx context.Context) ([]domain.Setting, error)
 	}
 	defer cursor.Close(ctx)
 
-	var settings []domain.Setting
+	settings := []domain.Setting{}
 	if err := cursor.All(ctx, &settings); err != nil {
 		return nil, err
 	}
@@ -59,7 +78,7 @@ func (r *SettingRepository) ListWithPagination(ctx context.Context, pagination *
 	}
 	defer cursor.Close(ctx)
 
-	var settings []domain.Setting
+	settings := []domain.Setting{}
 	if err := cursor.All(ctx, &settings); err != nil {
 		return nil, 0, err
 	}
@@ -67,6 +86,57 @@ func (r *SettingRepository) ListWithPagination(ctx context.Context, pagination *
 	return settings, total, nil
 }
 
+// ListByPrefix returns the settings whose key starts with prefix
+func (r *SettingRepository) ListByPrefix(ctx context.Context, prefix string) ([]domain.Setting, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"key": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	settings := []domain.Setting{}
+	if err := cursor.All(ctx, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// ListChangedSince returns the settings created or modified at or after since (seconds), all of
+// them when since is 0
+func (r *SettingRepository) ListChangedSince(ctx context.Context, since int64) ([]domain.Setting, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"mtime": bson.M{"$gte": since}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	settings := []domain.Setting{}
+	if err := cursor.All(ctx, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// ListDeletedSince returns the IDs of the settings deleted at or after since (seconds). Settings
+// are deleted for good, so these come from their history.
+func (r *SettingRepository) ListDeletedSince(ctx context.Context, since int64) ([]string, error) {
+	values, err := r.history.Distinct(ctx, "setting_id", bson.M{
+		"action": domain.SettingActionDelete,
+		"ctime":  bson.M{"$gte": since},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, value := range values {
+		if id, ok := value.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
 func (r *SettingRepository) GetByID(ctx context.Context, id string) (*domain.Setting, error) {
 	var setting domain.Setting
 	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&setting)
@@ -115,55 +185,150 @@ func (r *SettingRepository) Create(ctx context.Context, params domain.CreateSett
 	return &setting, nil
 }
 
-func (r *SettingRepository) Update(ctx context.Context, id string, params domain.UpdateSettingParams) (*domain.Setting, error) {
-	update := bson.M{
-		"$set": bson.M{
-			"value": params.Value,
-			"mtime": time.Now().Unix(),
-		},
-	}
+func (r *SettingRepository) Update(ctx context.Context, id string, params domain.UpdateSettingParams, actorID string) (*domain.Setting, error) {
+	return r.setValue(ctx, bson.M{"_id": id}, params.Value, domain.SettingActionUpdate, actorID)
+}
 
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+func (r *SettingRepository) UpdateByKey(ctx context.Context, key string, params domain.UpdateSettingParams, actorID string) (*domain.Setting, error) {
+	return r.setValue(ctx, bson.M{"key": key}, params.Value, domain.SettingActionUpdate, actorID)
+}
+
+// Restore re-applies the value of a history version as a new version of its setting
+func (r *SettingRepository) Restore(ctx context.Context, version *domain.SettingVersion, actorID string) (*domain.Setting, error) {
+	return r.setValue(ctx, bson.M{"_id": version.SettingID}, version.Value, domain.SettingActionRestore, actorID)
+}
+
+func (r *SettingRepository) Delete(ctx context.Context, id string, actorID string) error {
+	return withTransaction(ctx, r.client, func(ctx context.Context) error {
+		var previous domain.Setting
+		err := r.collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&previous)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return domain.ErrSettingNotFound
+			}
+			return err
+		}
+
+		return r.appendHistory(ctx, &previous, domain.SettingActionDelete, actorID, time.Now().Unix())
+	})
+}
+
+// setValue updates the value of the setting matching filter and records the previous document
+// in the history. The previous document comes from the update itself, so concurrent writers
+// cannot slip a version in between.
+func (r *SettingRepository) setValue(ctx context.Context, filter bson.M, value interface{}, action domain.SettingAction, actorID string) (*domain.Setting, error) {
 	var setting domain.Setting
-	err := r.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&setting)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, domain.ErrSettingNotFound
+	err := withTransaction(ctx, r.client, func(ctx context.Context) error {
+		now := time.Now().Unix()
+		update := bson.M{
+			"$set": bson.M{
+				"value": value,
+				"mtime": now,
+			},
+		}
+
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+		var previous domain.Setting
+		err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return domain.ErrSettingNotFound
+			}
+			return err
+		}
+
+		if err := r.appendHistory(ctx, &previous, action, actorID, now); err != nil {
+			return err
 		}
+
+		setting = previous
+		setting.Value = value
+		setting.MTime = now
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return &setting, nil
 }
 
-func (r *SettingRepository) UpdateByKey(ctx context.Context, key string, params domain.UpdateSettingParams) (*domain.Setting, error) {
-	update := bson.M{
-		"$set": bson.M{
-			"value": params.Value,
-			"mtime": time.Now().Unix(),
-		},
+func (r *SettingRepository) appendHistory(ctx context.Context, previous *domain.Setting, action domain.SettingAction, actorID string, now int64) error {
+	version := domain.SettingVersion{
+		ID:        lib.Rand.Char(16),
+		SettingID: previous.ID,
+		Key:       previous.Key,
+		Value:     previous.Value,
+		MTime:     previous.MTime,
+		Action:    action,
+		ActorID:   actorID,
+		CTime:     now,
 	}
 
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
-	var setting domain.Setting
-	err := r.collection.FindOneAndUpdate(ctx, bson.M{"key": key}, update, opts).Decode(&setting)
+	_, err := r.history.InsertOne(ctx, version)
+	return err
+}
+
+// ListHistory returns the versions of a setting, newest first
+func (r *SettingRepository) ListHistory(ctx context.Context, settingID string, pagination *domain.Pagination) ([]domain.SettingVersion, int64, error) {
+	filter := bson.M{"setting_id": settingID}
+
+	total, err := r.history.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "ctime", Value: -1}, {Key: "_id", Value: -1}})
+
+	cursor, err := r.history.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	versions := []domain.SettingVersion{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, 0, err
+	}
+
+	return versions, total, nil
+}
+
+func (r *SettingRepository) GetVersion(ctx context.Context, settingID, versionID string) (*domain.SettingVersion, error) {
+	var version domain.SettingVersion
+	err := r.history.FindOne(ctx, bson.M{"_id": versionID, "setting_id": settingID}).Decode(&version)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, domain.ErrSettingNotFound
+			return nil, domain.ErrSettingVersionNotFound
 		}
 		return nil, err
 	}
-
-	return &setting, nil
+	return &version, nil
 }
 
-func (r *SettingRepository) Delete(ctx context.Context, id string) error {
-	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+// withTransaction runs fn inside a transaction when the deployment supports one. Standalone
+// servers reject transactions with IllegalOperation before anything is written, in which case
+// fn runs again without one.
+func withTransaction(ctx context.Context, client *mongo.Client, fn func(ctx context.Context) error) error {
+	session, err := client.StartSession()
 	if err != nil {
-		return err
+		return fn(ctx)
 	}
-	if result.DeletedCount == 0 {
-		return domain.ErrSettingNotFound
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	if isTransactionUnsupported(err) {
+		return fn(ctx)
 	}
-	return nil
+	return err
+}
+
+func isTransactionUnsupported(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(20)
 }
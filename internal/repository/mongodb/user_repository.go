@@ -16,6 +16,8 @@ type UserRepository struct {
 	users    *mongo.Collection
 	secrets  *mongo.Collection
 	sessions *mongo.Collection
+	resets   *mongo.Collection
+	attempts *mongo.Collection
 }
 
 func NewUserRepository(db *mongo.Database) *UserRepository {
@@ -24,6 +26,8 @@ func NewUserRepository(db *mongo.Database) *UserRepository {
 		users:    db.Collection("user"),
 		secrets:  db.Collection("user_secret"),
 		sessions: db.Collection("user_sessions"),
+		resets:   db.Collection("password_resets"),
+		attempts: db.Collection("two_factor_attempts"),
 	}
 }
 
@@ -36,6 +40,7 @@ func (r *UserRepository) GetUser(ctx context.Context, id string) (*domain.User,
 		}
 		return nil, err
 	}
+	user.MigrateZones()
 	return &user, nil
 }
 
@@ -48,6 +53,7 @@ func (r *UserRepository) GetUserByUsername(ctx context.Context, username string)
 		}
 		return nil, err
 	}
+	user.MigrateZones()
 	return &user, nil
 }
 
@@ -60,6 +66,7 @@ func (r *UserRepository) GetUserByPhone(ctx context.Context, phone string) (*dom
 		}
 		return nil, err
 	}
+	user.MigrateZones()
 	return &user, nil
 }
 
@@ -70,10 +77,27 @@ func (r *UserRepository) ListUsers(ctx context.Context) ([]domain.User, error) {
 	}
 	defer cursor.Close(ctx)
 
-	var users []domain.User
+	users := []domain.User{}
 	if err := cursor.All(ctx, &users); err != nil {
 		return nil, err
 	}
+	migrateZones(users)
+	return users, nil
+}
+
+// ListUsersByIDs returns the live users among ids, in no particular order
+func (r *UserRepository) ListUsersByIDs(ctx context.Context, ids []string) ([]domain.User, error) {
+	cursor, err := r.users.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "dtime": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []domain.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	migrateZones(users)
 	return users, nil
 }
 
@@ -101,14 +125,22 @@ func (r *UserRepository) ListUsersWithPagination(ctx context.Context, pagination
 	}
 	defer cursor.Close(ctx)
 
-	var users []domain.User
+	users := []domain.User{}
 	if err := cursor.All(ctx, &users); err != nil {
 		return nil, 0, err
 	}
+	migrateZones(users)
 
 	return users, total, nil
 }
 
+// migrateZones moves the single zone of users stored before zone_ids
+func migrateZones(users []domain.User) {
+	for i := range users {
+		users[i].MigrateZones()
+	}
+}
+
 func (r *UserRepository) CreateUser(ctx context.Context, user *domain.User) error {
 	// Check if username already exists
 	existing, err := r.GetUserByUsername(ctx, user.Username)
@@ -122,20 +154,89 @@ func (r *UserRepository) CreateUser(ctx context.Context, user *domain.User) erro
 
 func (r *UserRepository) UpdateUser(ctx context.Context, user *domain.User) error {
 	user.MTime = time.Now().UnixMilli()
-	_, err := r.users.UpdateOne(
+	result, err := r.users.UpdateOne(
 		ctx,
-		bson.M{"_id": user.ID},
-		bson.M{"$set": user},
+		bson.M{"_id": user.ID, "dtime": bson.M{"$exists": false}},
+		userUpdate(user),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrUserNotFound
+	}
+	return nil
+}
+
+// userUpdate is the update that stores user. Cleared zones are left out of $set and have to be removed.
+func userUpdate(user *domain.User) bson.M {
+	// zone_id is the single zone stored before zone_ids, already moved over by MigrateZones
+	unset := bson.M{"zone_id": ""}
+	if len(user.ZoneIDs) == 0 {
+		unset["zone_ids"] = ""
+	}
+	return bson.M{"$set": user, "$unset": unset}
 }
 
 func (r *UserRepository) DeleteUser(ctx context.Context, id string) error {
 	now := time.Now().UnixMilli()
-	_, err := r.users.UpdateOne(
+	result, err := r.users.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+		// mtime tells the instances caching token versions that the user's tokens are no longer valid
+		bson.M{"$set": bson.M{"dtime": now, "mtime": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrUserNotFound
+	}
+	return nil
+}
+
+// ListTokenVersions returns the ID, token version and deletion time of the users modified since
+// (milliseconds). With since 0 it returns those whose tokens may have been revoked: users with a
+// token version and deleted users.
+func (r *UserRepository) ListTokenVersions(ctx context.Context, since int64) ([]domain.User, error) {
+	filter := bson.M{"mtime": bson.M{"$gte": since}}
+	if since == 0 {
+		filter = bson.M{"$or": []bson.M{
+			{"token_version": bson.M{"$gt": 0}},
+			{"dtime": bson.M{"$exists": true}},
+		}}
+	}
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "token_version": 1, "dtime": 1})
+	cursor, err := r.users.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	users := []domain.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// RevokeZoneTokens raises the token version of the users of any of the zones, whose tokens list
+// the groups of their zones as they were at issuance
+func (r *UserRepository) RevokeZoneTokens(ctx context.Context, zoneIDs []string) error {
+	_, err := r.users.UpdateMany(
 		ctx,
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"dtime": now}},
+		bson.M{
+			"$or": []bson.M{
+				{"zone_ids": bson.M{"$in": zoneIDs}},
+				{"zone_id": bson.M{"$in": zoneIDs}}, // not yet migrated, see User.MigrateZones
+			},
+			"dtime": bson.M{"$exists": false},
+		},
+		bson.M{
+			"$inc": bson.M{"token_version": 1},
+			"$set": bson.M{"mtime": time.Now().UnixMilli()},
+		},
 	)
 	return err
 }
@@ -165,6 +266,46 @@ func (r *UserRepository) GetUserSecret(ctx context.Context, userID, name string)
 	return &secret, nil
 }
 
+func (r *UserRepository) DeleteUserSecrets(ctx context.Context, userID string, names ...string) error {
+	_, err := r.secrets.DeleteMany(ctx, bson.M{"user_id": userID, "name": bson.M{"$in": names}})
+	return err
+}
+
+// ConsumeSecretCode removes code from the codes of a secret, reporting whether it was present.
+// The removal is atomic, so a code can only be consumed once.
+func (r *UserRepository) ConsumeSecretCode(ctx context.Context, userID, name, code string) (bool, error) {
+	result, err := r.secrets.UpdateOne(
+		ctx,
+		bson.M{"user_id": userID, "name": name, "codes": code},
+		bson.M{"$pull": bson.M{"codes": code}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// AdvanceSecretCounter raises the counter of a secret to counter, reporting whether it was lower.
+// The check and the update are a single operation, so a TOTP time step can only be used once.
+func (r *UserRepository) AdvanceSecretCounter(ctx context.Context, userID, name string, counter int64) (bool, error) {
+	result, err := r.secrets.UpdateOne(
+		ctx,
+		bson.M{
+			"user_id": userID,
+			"name":    name,
+			"$or": bson.A{
+				bson.M{"counter": bson.M{"$exists": false}},
+				bson.M{"counter": bson.M{"$lt": counter}},
+			},
+		},
+		bson.M{"$set": bson.M{"counter": counter}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
 func (r *UserRepository) SaveRefreshToken(ctx context.Context, token *domain.RefreshToken) error {
 	_, err := r.sessions.InsertOne(ctx, token)
 	return err
@@ -182,12 +323,178 @@ func (r *UserRepository) GetRefreshToken(ctx context.Context, token string) (*do
 	return &rt, nil
 }
 
+// DeleteRefreshToken ends a session; ErrInvalidRefreshToken means it was already gone
 func (r *UserRepository) DeleteRefreshToken(ctx context.Context, token string) error {
-	_, err := r.sessions.DeleteOne(ctx, bson.M{"_id": token})
-	return err
+	result, err := r.sessions.DeleteOne(ctx, bson.M{"_id": token})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return domain.ErrInvalidRefreshToken
+	}
+	return nil
 }
 
 func (r *UserRepository) DeleteRefreshTokensByUserID(ctx context.Context, userID string) error {
 	_, err := r.sessions.DeleteMany(ctx, bson.M{"user_id": userID})
 	return err
 }
+
+// ListActiveSessions returns the unexpired sessions of a user, oldest first. Sessions created in
+// the same millisecond are ordered by ID, so concurrent logins agree on which ones are the oldest.
+func (r *UserRepository) ListActiveSessions(ctx context.Context, userID string, now int64) ([]domain.RefreshToken, error) {
+	cursor, err := r.sessions.Find(ctx,
+		bson.M{"user_id": userID, "expires_at": bson.M{"$gt": now}},
+		options.Find().SetSort(bson.D{{Key: "ctime", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []domain.RefreshToken{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteRefreshTokens deletes sessions by ID
+func (r *UserRepository) DeleteRefreshTokens(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := r.sessions.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// SessionStats counts the unexpired sessions and the users holding more than one
+func (r *UserRepository) SessionStats(ctx context.Context, now int64) (*domain.SessionStats, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"expires_at": bson.M{"$gt": now}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$user_id", "n": bson.M{"$sum": 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        nil,
+			"active":     bson.M{"$sum": "$n"},
+			"users":      bson.M{"$sum": 1},
+			"duplicates": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{"$n", 1}}, 1, 0}}},
+		}}},
+	}
+	cursor, err := r.sessions.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Active     int64 `bson:"active"`
+		Users      int64 `bson:"users"`
+		Duplicates int64 `bson:"duplicates"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	stats := &domain.SessionStats{}
+	if len(results) > 0 {
+		stats.Active = results[0].Active
+		stats.Users = results[0].Users
+		stats.DuplicateUsers = results[0].Duplicates
+	}
+	return stats, nil
+}
+
+// Password reset tokens
+
+// SavePasswordResetToken stores a new reset token and drops the user's tokens created before since,
+// which no longer count towards the rate limit
+func (r *UserRepository) SavePasswordResetToken(ctx context.Context, token *domain.PasswordResetToken, since int64) error {
+	if _, err := r.resets.DeleteMany(ctx, bson.M{"user_id": token.UserID, "ctime": bson.M{"$lt": since}}); err != nil {
+		return err
+	}
+	_, err := r.resets.InsertOne(ctx, token)
+	return err
+}
+
+// CountPasswordResetTokens counts the reset tokens issued to a user since the given time (ms)
+func (r *UserRepository) CountPasswordResetTokens(ctx context.Context, userID string, since int64) (int64, error) {
+	return r.resets.CountDocuments(ctx, bson.M{"user_id": userID, "ctime": bson.M{"$gte": since}})
+}
+
+// GetPasswordResetToken returns an unused, unexpired token
+func (r *UserRepository) GetPasswordResetToken(ctx context.Context, id string) (*domain.PasswordResetToken, error) {
+	filter := bson.M{
+		"_id":        id,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now().UnixMilli()},
+	}
+
+	var token domain.PasswordResetToken
+	if err := r.resets.FindOne(ctx, filter).Decode(&token); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrInvalidResetToken
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ResetPassword marks an unused, unexpired token of the password's user as used and saves the
+// password. The check and the update are a single operation, so a token can only be consumed once,
+// and the token stays usable when the password could not be saved.
+func (r *UserRepository) ResetPassword(ctx context.Context, id string, password *domain.UserSecret) error {
+	return withTransaction(ctx, r.db.Client(), func(ctx context.Context) error {
+		now := time.Now().UnixMilli()
+		filter := bson.M{
+			"_id":        id,
+			"user_id":    password.UserID,
+			"used_at":    bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": now},
+		}
+		result, err := r.resets.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"used_at": now}})
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return domain.ErrInvalidResetToken
+		}
+
+		if err := r.SaveUserSecret(ctx, password); err != nil {
+			// Aborting the transaction gives the token back; without one it is given back here
+			r.resets.UpdateOne(ctx, bson.M{"_id": id, "used_at": now}, bson.M{"$unset": bson.M{"used_at": ""}})
+			return err
+		}
+		return nil
+	})
+}
+
+// Two-factor login attempts
+
+// SaveTwoFactorAttempt stores an attempt and drops the user's attempts created before since, which
+// no longer count towards the limits
+func (r *UserRepository) SaveTwoFactorAttempt(ctx context.Context, attempt *domain.TwoFactorAttempt, since int64) error {
+	if _, err := r.attempts.DeleteMany(ctx, bson.M{"user_id": attempt.UserID, "ctime": bson.M{"$lt": since}}); err != nil {
+		return err
+	}
+	_, err := r.attempts.InsertOne(ctx, attempt)
+	return err
+}
+
+// CountTwoFactorAttempts counts the attempts of a challenge, and those of its user since the given time (ms)
+func (r *UserRepository) CountTwoFactorAttempts(ctx context.Context, userID, challengeID string, since int64) (int64, int64, error) {
+	challenge, err := r.attempts.CountDocuments(ctx, bson.M{"user_id": userID, "challenge_id": challengeID})
+	if err != nil {
+		return 0, 0, err
+	}
+	user, err := r.attempts.CountDocuments(ctx, bson.M{"user_id": userID, "ctime": bson.M{"$gte": since}})
+	if err != nil {
+		return 0, 0, err
+	}
+	return challenge, user, nil
+}
+
+// DeleteTwoFactorAttempts drops the attempts of a user, once they signed in
+func (r *UserRepository) DeleteTwoFactorAttempts(ctx context.Context, userID string) error {
+	_, err := r.attempts.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
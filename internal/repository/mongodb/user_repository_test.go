@@ -0,0 +1,47 @@
+package mongodb
+
+import (
+	"testing"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Emptying a user's zones removes zone_ids from the stored user: bson leaves the empty slice out of
+// $set, which would keep the old zones
+func TestUserUpdateClearsZones(t *testing.T) {
+	tests := []struct {
+		name      string
+		zoneIDs   []string
+		wantUnset bool
+	}{
+		{"zones kept", []string{"z1", "z2"}, false},
+		{"zones cleared", []string{}, true},
+		{"no zones", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(userUpdate(&domain.User{ID: "u1", Role: domain.RoleMonitor, ZoneIDs: tt.zoneIDs}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var update struct {
+				Set   bson.M `bson:"$set"`
+				Unset bson.M `bson:"$unset"`
+			}
+			if err := bson.Unmarshal(data, &update); err != nil {
+				t.Fatal(err)
+			}
+
+			_, unset := update.Unset["zone_ids"]
+			_, set := update.Set["zone_ids"]
+			if unset != tt.wantUnset || set == tt.wantUnset {
+				t.Errorf("zone_ids set %v, unset %v; want unset %v", set, unset, tt.wantUnset)
+			}
+			if _, ok := update.Unset["zone_id"]; !ok {
+				t.Error("the legacy zone_id is not removed")
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package mongodb
 
 import (
 	"context"
+	"regexp"
+	"strings"
 	"time"
 
 	"tp25-api/internal/domain"
@@ -12,19 +14,93 @@ import (
 )
 
 type ZoneRepository struct {
-	db     *mongo.Database
-	zones  *mongo.Collection
-	groups *mongo.Collection
-	boxes  *mongo.Collection
+	db      *mongo.Database
+	zones   *mongo.Collection
+	groups  *mongo.Collection
+	boxes   *mongo.Collection
+	reports *mongo.Collection
+
+	queryTimeout time.Duration // longest a report query may run, 0 for no limit
 }
 
 func NewZoneRepository(db *mongo.Database) *ZoneRepository {
 	return &ZoneRepository{
-		db:     db,
-		zones:  db.Collection("zone"),
-		groups: db.Collection("groups"),
-		boxes:  db.Collection("box"),
+		db:      db,
+		zones:   db.Collection("zone"),
+		groups:  db.Collection("groups"),
+		boxes:   db.Collection("box"),
+		reports: db.Collection("reports_cache"),
+	}
+}
+
+// SetQueryTimeout bounds how long a report query may run, on the server too
+func (r *ZoneRepository) SetQueryTimeout(timeout time.Duration) {
+	r.queryTimeout = timeout
+}
+
+// IndexedCollections returns the collections EnsureIndexes declares indexes on
+func (r *ZoneRepository) IndexedCollections() []*mongo.Collection {
+	return []*mongo.Collection{r.zones, r.boxes}
+}
+
+// EnsureIndexes creates the unique indexes for zone codes and box device IDs.
+// dtime is part of each key: live documents all index it as null and so must be unique,
+// while soft-deleted ones carry their deletion time and never block reuse of the code.
+func (r *ZoneRepository) EnsureIndexes(ctx context.Context) error {
+	if _, err := r.zones.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "code", Value: 1}, {Key: "dtime", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("code_live_unique"),
+	}); err != nil {
+		return err
 	}
+
+	_, err := r.boxes.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "device_id", Value: 1}, {Key: "dtime", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("device_id_live_unique"),
+	})
+	return err
+}
+
+// changedSinceFilter selects the documents created, modified or soft-deleted at or after since
+// (milliseconds), or every live document when since is 0
+func changedSinceFilter(since int64) bson.M {
+	if since <= 0 {
+		return bson.M{"dtime": bson.M{"$exists": false}}
+	}
+	return bson.M{"$or": []bson.M{
+		{"ctime": bson.M{"$gte": since}},
+		{"mtime": bson.M{"$gte": since}},
+		{"dtime": bson.M{"$gte": since}},
+	}}
+}
+
+// ListChangedSince returns the zones, groups and boxes changed since a sync cursor (milliseconds),
+// soft-deleted ones included, or every live one when since is 0
+func (r *ZoneRepository) ListChangedSince(ctx context.Context, since int64) ([]domain.Zone, []domain.BoxGroup, []domain.Box, error) {
+	filter := changedSinceFilter(since)
+
+	zones := []domain.Zone{}
+	groups := []domain.BoxGroup{}
+	boxes := []domain.Box{}
+	for _, list := range []struct {
+		collection *mongo.Collection
+		into       interface{}
+	}{
+		{r.zones, &zones},
+		{r.groups, &groups},
+		{r.boxes, &boxes},
+	} {
+		cursor, err := list.collection.Find(ctx, filter)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = cursor.All(ctx, list.into)
+		cursor.Close(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return zones, groups, boxes, nil
 }
 
 // Zone operations
@@ -36,14 +112,94 @@ func (r *ZoneRepository) ListZones(ctx context.Context) ([]domain.Zone, error) {
 	}
 	defer cursor.Close(ctx)
 
-	var zones []domain.Zone
+	zones := []domain.Zone{}
+	if err := cursor.All(ctx, &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// ListZonesByIDs returns the zones among ids without their detail, in no particular order
+func (r *ZoneRepository) ListZonesByIDs(ctx context.Context, ids []string) ([]domain.Zone, error) {
+	opts := options.Find().SetProjection(bson.M{"detail": 0})
+	cursor, err := r.zones.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	zones := []domain.Zone{}
+	if err := cursor.All(ctx, &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// ListTreeZones returns the zones among ids, every zone when ids is nil, with the fields of the
+// navigation tree only
+func (r *ZoneRepository) ListTreeZones(ctx context.Context, ids []string) ([]domain.Zone, error) {
+	filter := bson.M{}
+	if ids != nil {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	opts := options.Find().SetProjection(bson.M{"code": 1, "name": 1})
+	cursor, err := r.zones.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	zones := []domain.Zone{}
 	if err := cursor.All(ctx, &zones); err != nil {
 		return nil, err
 	}
 	return zones, nil
 }
 
-func (r *ZoneRepository) ListZonesWithPagination(ctx context.Context, pagination *domain.Pagination, filter bson.M) ([]domain.Zone, int64, error) {
+// ListTreeGroups returns the live, unarchived groups of the zones among zoneIDs, restricted to ids
+// unless nil, with the fields of the navigation tree only
+func (r *ZoneRepository) ListTreeGroups(ctx context.Context, zoneIDs, ids []string) ([]domain.BoxGroup, error) {
+	filter := bson.M{"dtime": bson.M{"$exists": false}, "archived": bson.M{"$ne": true}}
+	if zoneIDs != nil {
+		filter["zone_id"] = bson.M{"$in": zoneIDs}
+	}
+	if ids != nil {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	opts := options.Find().SetProjection(bson.M{"name": 1, "zone_id": 1, "sort_order": 1})
+	cursor, err := r.groups.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := []domain.BoxGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// ListTreeBoxes returns the live boxes of the groups among groupIDs, with the fields of the
+// navigation tree only
+func (r *ZoneRepository) ListTreeBoxes(ctx context.Context, groupIDs []string) ([]domain.Box, error) {
+	filter := bson.M{"group_id": bson.M{"$in": groupIDs}, "dtime": bson.M{"$exists": false}}
+	opts := options.Find().SetProjection(bson.M{"name": 1, "group_id": 1, "type": 1, "sort_order": 1})
+	cursor, err := r.boxes.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	boxes := []domain.Box{}
+	if err := cursor.All(ctx, &boxes); err != nil {
+		return nil, err
+	}
+	return boxes, nil
+}
+
+// ListZonesWithPagination lists zones; Detail is only loaded when includeDetail is set since it can be large
+func (r *ZoneRepository) ListZonesWithPagination(ctx context.Context, pagination *domain.Pagination, filter bson.M, includeDetail bool) ([]domain.Zone, int64, error) {
 	if filter == nil {
 		filter = bson.M{}
 	}
@@ -59,6 +215,9 @@ func (r *ZoneRepository) ListZonesWithPagination(ctx context.Context, pagination
 		SetSkip(int64(pagination.GetSkip())).
 		SetLimit(int64(pagination.GetLimit())).
 		SetSort(bson.D{{Key: "ctime", Value: -1}})
+	if !includeDetail {
+		opts.SetProjection(bson.M{"detail": 0})
+	}
 
 	cursor, err := r.zones.Find(ctx, filter, opts)
 	if err != nil {
@@ -66,7 +225,7 @@ func (r *ZoneRepository) ListZonesWithPagination(ctx context.Context, pagination
 	}
 	defer cursor.Close(ctx)
 
-	var zones []domain.Zone
+	zones := []domain.Zone{}
 	if err := cursor.All(ctx, &zones); err != nil {
 		return nil, 0, err
 	}
@@ -89,23 +248,49 @@ func (r *ZoneRepository) GetZone(ctx context.Context, id string) (*domain.Zone,
 func (r *ZoneRepository) CreateZone(ctx context.Context, zone *domain.Zone) error {
 	// Check if code already exists
 	var existing domain.Zone
-	err := r.zones.FindOne(ctx, bson.M{"code": zone.Code}).Decode(&existing)
+	err := r.zones.FindOne(ctx, bson.M{"code": zone.Code, "dtime": bson.M{"$exists": false}}).Decode(&existing)
 	if err == nil {
 		return domain.ErrZoneCodeExisted
 	}
 
 	_, err = r.zones.InsertOne(ctx, zone)
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrZoneCodeExisted
+	}
 	return err
 }
 
+// ZoneCodeExists reports whether a live zone other than excludeID already uses code
+func (r *ZoneRepository) ZoneCodeExists(ctx context.Context, code, excludeID string) (bool, error) {
+	filter := bson.M{
+		"code":  code,
+		"_id":   bson.M{"$ne": excludeID},
+		"dtime": bson.M{"$exists": false},
+	}
+	count, err := r.zones.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 func (r *ZoneRepository) UpdateZone(ctx context.Context, zone *domain.Zone) error {
 	zone.MTime = time.Now().UnixMilli()
-	_, err := r.zones.UpdateOne(
+	result, err := r.zones.UpdateOne(
 		ctx,
 		bson.M{"_id": zone.ID},
 		bson.M{"$set": zone},
 	)
-	return err
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrZoneCodeExisted
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrZoneNotFound
+	}
+	return nil
 }
 
 // BoxGroup operations
@@ -122,13 +307,69 @@ func (r *ZoneRepository) ListGroups(ctx context.Context, zoneID string) ([]domai
 	}
 	defer cursor.Close(ctx)
 
-	var groups []domain.BoxGroup
+	groups := []domain.BoxGroup{}
 	if err := cursor.All(ctx, &groups); err != nil {
 		return nil, err
 	}
 	return groups, nil
 }
 
+// ListGroupsByIDs returns the live groups among ids, in no particular order
+func (r *ZoneRepository) ListGroupsByIDs(ctx context.Context, ids []string) ([]domain.BoxGroup, error) {
+	cursor, err := r.groups.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "dtime": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := []domain.BoxGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r *ZoneRepository) ListGroupsWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterGroupParams) ([]domain.BoxGroup, int64, error) {
+	query := bson.M{"dtime": bson.M{"$exists": false}}
+	if filter.ZoneID != "" {
+		query["zone_id"] = filter.ZoneID
+	}
+	if filter.Query != nil && *filter.Query != "" {
+		query["name"] = bson.M{"$regex": regexp.QuoteMeta(*filter.Query), "$options": "i"}
+	}
+	if !filter.IncludeArchived {
+		query["archived"] = bson.M{"$ne": true}
+	}
+	if filter.GroupIDs != nil {
+		query["_id"] = bson.M{"$in": filter.GroupIDs}
+	}
+
+	// Get total count
+	total, err := r.groups.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Find with pagination
+	opts := options.Find().
+		SetSkip(int64(pagination.GetSkip())).
+		SetLimit(int64(pagination.GetLimit())).
+		SetSort(bson.D{{Key: "sort_order", Value: 1}, {Key: "_id", Value: 1}})
+
+	cursor, err := r.groups.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := []domain.BoxGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, 0, err
+	}
+
+	return groups, total, nil
+}
+
 func (r *ZoneRepository) GetGroup(ctx context.Context, id string) (*domain.BoxGroup, error) {
 	var group domain.BoxGroup
 	err := r.groups.FindOne(ctx, bson.M{"_id": id, "dtime": bson.M{"$exists": false}}).Decode(&group)
@@ -141,6 +382,89 @@ func (r *ZoneRepository) GetGroup(ctx context.Context, id string) (*domain.BoxGr
 	return &group, nil
 }
 
+// GroupModifiedAt returns when the view of a group last changed (milliseconds): the latest
+// creation, change or deletion of the group or any of its boxes, or check of its cameras
+func (r *ZoneRepository) GroupModifiedAt(ctx context.Context, id string) (int64, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": id, "dtime": bson.M{"$exists": false}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": r.boxes.Name(),
+			"let":  bson.M{"group": "$_id"},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$eq": []interface{}{"$group_id", "$$group"}}}},
+				{"$project": bson.M{"t": bson.M{"$max": []interface{}{"$ctime", "$mtime", "$dtime"}}}},
+			},
+			"as": "boxes",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "camera_checks", // see CameraRepository
+			"localField":   "_id",
+			"foreignField": "group_id",
+			"as":           "cameras",
+		}}},
+		{{Key: "$project", Value: bson.M{"t": bson.M{"$max": []interface{}{
+			"$ctime", "$mtime",
+			bson.M{"$max": "$boxes.t"},
+			bson.M{"$multiply": []interface{}{bson.M{"$max": "$cameras.checked_at"}, 1000}},
+		}}}}},
+	}
+
+	cursor, err := r.groups.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		T int64 `bson:"t"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, domain.ErrBoxGroupNotFound
+	}
+	return result[0].T, nil
+}
+
+// TouchGroup sets the mtime of a group to now, for changes to its view made on other documents
+func (r *ZoneRepository) TouchGroup(ctx context.Context, id string) error {
+	_, err := r.groups.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"mtime": time.Now().UnixMilli()}})
+	return err
+}
+
+// SetGroupArchived archives a group, or unarchives it
+func (r *ZoneRepository) SetGroupArchived(ctx context.Context, id string, archived bool) error {
+	update := bson.M{
+		"$set":   bson.M{"mtime": time.Now().UnixMilli()},
+		"$unset": bson.M{"archived": ""},
+	}
+	if archived {
+		update = bson.M{"$set": bson.M{"archived": true, "mtime": time.Now().UnixMilli()}}
+	}
+
+	result, err := r.groups.UpdateOne(ctx, bson.M{"_id": id, "dtime": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxGroupNotFound
+	}
+	return nil
+}
+
+func (r *ZoneRepository) GetGroupBySubdomain(ctx context.Context, subdomain string) (*domain.BoxGroup, error) {
+	var group domain.BoxGroup
+	err := r.groups.FindOne(ctx, bson.M{"subdomain": subdomain, "dtime": bson.M{"$exists": false}}).Decode(&group)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, domain.ErrBoxGroupNotFound
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
 func (r *ZoneRepository) CreateGroup(ctx context.Context, group *domain.BoxGroup) error {
 	_, err := r.groups.InsertOne(ctx, group)
 	return err
@@ -148,31 +472,143 @@ func (r *ZoneRepository) CreateGroup(ctx context.Context, group *domain.BoxGroup
 
 func (r *ZoneRepository) UpdateGroup(ctx context.Context, group *domain.BoxGroup) error {
 	group.MTime = time.Now().UnixMilli()
-	_, err := r.groups.UpdateOne(
+	update := bson.M{"$set": group}
+	// A cleared primary box is left out of $set and has to be removed
+	if group.PrimaryBoxID == nil {
+		update["$unset"] = bson.M{"primary_box_id": ""}
+	}
+	result, err := r.groups.UpdateOne(
 		ctx,
-		bson.M{"_id": group.ID},
-		bson.M{"$set": group},
+		bson.M{"_id": group.ID, "dtime": bson.M{"$exists": false}},
+		update,
 	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxGroupNotFound
+	}
+	return nil
+}
+
+// ListGroupsWithTextElevation returns the groups, deleted ones included, whose note has an
+// elevation entered as text but no crest elevation
+func (r *ZoneRepository) ListGroupsWithTextElevation(ctx context.Context) ([]domain.BoxGroup, error) {
+	filter := bson.M{
+		"note.elevation":       bson.M{"$exists": true, "$ne": ""},
+		"note.crest_elevation": bson.M{"$exists": false},
+	}
+	opts := options.Find().SetProjection(bson.M{"note.elevation": 1})
+	cursor, err := r.groups.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := []domain.BoxGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// ListGroupsWithCameras returns the live groups with at least one camera, with their zone and cameras only
+func (r *ZoneRepository) ListGroupsWithCameras(ctx context.Context) ([]domain.BoxGroup, error) {
+	filter := bson.M{
+		"dtime":     bson.M{"$exists": false},
+		"cameras.0": bson.M{"$exists": true},
+	}
+	opts := options.Find().SetProjection(bson.M{"zone_id": 1, "name": 1, "cameras": 1})
+	cursor, err := r.groups.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groups := []domain.BoxGroup{}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// SetCrestElevation sets the crest elevation of the group's note, leaving its mtime alone
+func (r *ZoneRepository) SetCrestElevation(ctx context.Context, id string, elevation float64) error {
+	_, err := r.groups.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"note.crest_elevation": elevation}})
 	return err
 }
 
+// UpdateGroupZone saves a group whose zone changed and moves all of its boxes to that zone,
+// in one transaction when the deployment supports it
+func (r *ZoneRepository) UpdateGroupZone(ctx context.Context, group *domain.BoxGroup) error {
+	return withTransaction(ctx, r.db.Client(), func(ctx context.Context) error {
+		if err := r.UpdateGroup(ctx, group); err != nil {
+			return err
+		}
+
+		// Deleted boxes move too so they stay consistent with their group
+		_, err := r.boxes.UpdateMany(ctx,
+			bson.M{"group_id": group.ID},
+			bson.M{"$set": bson.M{"zone_id": group.ZoneID, "mtime": group.MTime}},
+		)
+		return err
+	})
+}
+
+// CreateGroupWithBoxes inserts a group and its boxes, then runs also with the same context, all in one
+// transaction when the deployment supports it
+func (r *ZoneRepository) CreateGroupWithBoxes(ctx context.Context, group *domain.BoxGroup, boxes []domain.Box, also func(ctx context.Context) error) error {
+	return withTransaction(ctx, r.db.Client(), func(ctx context.Context) error {
+		if err := r.CreateGroup(ctx, group); err != nil {
+			return err
+		}
+		for i := range boxes {
+			if err := r.CreateBox(ctx, &boxes[i]); err != nil {
+				return err
+			}
+		}
+		if also != nil {
+			return also(ctx)
+		}
+		return nil
+	})
+}
+
 func (r *ZoneRepository) DeleteGroup(ctx context.Context, id string) error {
 	now := time.Now().UnixMilli()
-	_, err := r.groups.UpdateOne(
+	result, err := r.groups.UpdateOne(
 		ctx,
-		bson.M{"_id": id},
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
 		bson.M{"$set": bson.M{"dtime": now}},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxGroupNotFound
+	}
+	return nil
 }
 
 // Box operations
 
 func (r *ZoneRepository) ListBoxes(ctx context.Context, filter domain.FilterBoxParams) ([]domain.Box, error) {
 	query := bson.M{"dtime": bson.M{"$exists": false}}
+	if filter.IncludeDeleted {
+		delete(query, "dtime")
+		if filter.DeletedSince > 0 {
+			query["$or"] = bson.A{
+				bson.M{"dtime": bson.M{"$exists": false}},
+				bson.M{"dtime": bson.M{"$gte": filter.DeletedSince}},
+			}
+		}
+	}
 	if filter.GroupID != nil && *filter.GroupID != "" {
 		query["group_id"] = *filter.GroupID
 	}
+	if filter.GroupIDs != nil {
+		query["group_id"] = filterGroupIDs(query["group_id"], filter.GroupIDs)
+	}
 
 	cursor, err := r.boxes.Find(ctx, query)
 	if err != nil {
@@ -180,18 +616,61 @@ func (r *ZoneRepository) ListBoxes(ctx context.Context, filter domain.FilterBoxP
 	}
 	defer cursor.Close(ctx)
 
-	var boxes []domain.Box
+	boxes := []domain.Box{}
 	if err := cursor.All(ctx, &boxes); err != nil {
 		return nil, err
 	}
 	return boxes, nil
 }
 
+// CountBoxesUsingMetric counts the live boxes whose metrics report or refer to the metric code
+func (r *ZoneRepository) CountBoxesUsingMetric(ctx context.Context, code string) (int64, error) {
+	return r.boxes.CountDocuments(ctx, bson.M{
+		"dtime": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"metrics.code": code},
+			bson.M{"metrics.metric": code},
+		},
+	})
+}
+
+// ListBoxesByIDs returns the live boxes among ids, in no particular order
+func (r *ZoneRepository) ListBoxesByIDs(ctx context.Context, ids []string) ([]domain.Box, error) {
+	cursor, err := r.boxes.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "dtime": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	boxes := []domain.Box{}
+	if err := cursor.All(ctx, &boxes); err != nil {
+		return nil, err
+	}
+	return boxes, nil
+}
+
+// filterGroupIDs narrows a group_id condition to groupIDs. A group outside them matches no box.
+func filterGroupIDs(groupID interface{}, groupIDs []string) interface{} {
+	id, ok := groupID.(string)
+	if !ok {
+		return bson.M{"$in": groupIDs}
+	}
+	for _, g := range groupIDs {
+		if g == id {
+			return id
+		}
+	}
+	return bson.M{"$in": bson.A{}}
+}
+
 func (r *ZoneRepository) ListBoxesWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterBoxParams) ([]domain.Box, int64, error) {
 	query := bson.M{"dtime": bson.M{"$exists": false}}
 	if filter.GroupID != nil && *filter.GroupID != "" {
 		query["group_id"] = *filter.GroupID
 	}
+	if filter.GroupIDs != nil {
+		query["group_id"] = filterGroupIDs(query["group_id"], filter.GroupIDs)
+	}
 
 	// Get total count
 	total, err := r.boxes.CountDocuments(ctx, query)
@@ -211,7 +690,7 @@ func (r *ZoneRepository) ListBoxesWithPagination(ctx context.Context, pagination
 	}
 	defer cursor.Close(ctx)
 
-	var boxes []domain.Box
+	boxes := []domain.Box{}
 	if err := cursor.All(ctx, &boxes); err != nil {
 		return nil, 0, err
 	}
@@ -240,105 +719,216 @@ func (r *ZoneRepository) CreateBox(ctx context.Context, box *domain.Box) error {
 	}
 
 	_, err = r.boxes.InsertOne(ctx, box)
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrBoxDeviceExisted
+	}
 	return err
 }
 
+// SetBoxZone moves a live box to a zone, leaving its other fields alone
+func (r *ZoneRepository) SetBoxZone(ctx context.Context, id, zoneID string) error {
+	result, err := r.boxes.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"zone_id": zoneID, "mtime": time.Now().UnixMilli()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxNotFound
+	}
+	return nil
+}
+
 func (r *ZoneRepository) UpdateBox(ctx context.Context, box *domain.Box) error {
 	box.MTime = time.Now().UnixMilli()
-	_, err := r.boxes.UpdateOne(
+	update := bson.M{"$set": box}
+	// Cleared optional settings are left out of $set and have to be removed
+	unset := bson.M{}
+	if box.ExpectedIntervalSeconds == nil {
+		unset["expected_interval_seconds"] = ""
+	}
+	if len(box.Schedule) == 0 {
+		unset["reporting_schedule"] = ""
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	result, err := r.boxes.UpdateOne(
 		ctx,
-		bson.M{"_id": box.ID},
-		bson.M{"$set": box},
+		bson.M{"_id": box.ID, "dtime": bson.M{"$exists": false}},
+		update,
 	)
-	return err
+	if mongo.IsDuplicateKeyError(err) {
+		return domain.ErrBoxDeviceExisted
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxNotFound
+	}
+	return nil
+}
+
+// SetBoxDecommission marks a box decommissioned as of at (seconds), or clears it when at is nil
+func (r *ZoneRepository) SetBoxDecommission(ctx context.Context, id string, at *int64) error {
+	update := bson.M{
+		"$set":   bson.M{"mtime": time.Now().UnixMilli()},
+		"$unset": bson.M{"decommissioned": "", "decommissioned_at": ""},
+	}
+	if at != nil {
+		update = bson.M{"$set": bson.M{"decommissioned": true, "decommissioned_at": *at, "mtime": time.Now().UnixMilli()}}
+	}
+
+	result, err := r.boxes.UpdateOne(ctx, bson.M{"_id": id, "dtime": bson.M{"$exists": false}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxNotFound
+	}
+	return nil
 }
 
 func (r *ZoneRepository) DeleteBox(ctx context.Context, id string) error {
 	now := time.Now().UnixMilli()
-	_, err := r.boxes.UpdateOne(
+	result, err := r.boxes.UpdateOne(
 		ctx,
-		bson.M{"_id": id},
+		bson.M{"_id": id, "dtime": bson.M{"$exists": false}},
 		bson.M{"$set": bson.M{"dtime": now}},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return domain.ErrBoxNotFound
+	}
+	return nil
 }
 
-// ReportByMetric generates monthly reports for given metrics across multiple data sources
-func (r *ZoneRepository) ReportByMetric(ctx context.Context, sources []string, metrics []string) ([]domain.Report, error) {
-	var allReports []domain.Report
-
-	for _, source := range sources {
-		collectionName := "sensor_data_" + source
-		collection := r.db.Collection(collectionName)
-
-		pipeline := mongo.Pipeline{
-			{{Key: "$match", Value: bson.M{
-				"t": bson.M{"$exists": true},
-			}}},
-			{{Key: "$project", Value: bson.M{
-				"year":    bson.M{"$year": bson.M{"$toDate": bson.M{"$multiply": []interface{}{"$t", 1000}}}},
-				"month":   bson.M{"$month": bson.M{"$toDate": bson.M{"$multiply": []interface{}{"$t", 1000}}}},
-				"metrics": "$$ROOT",
-			}}},
-			{{Key: "$group", Value: bson.M{
-				"_id": bson.M{
-					"year":  "$year",
-					"month": "$month",
-				},
-				"count": bson.M{"$sum": 1},
-				"data":  bson.M{"$push": "$metrics"},
-			}}},
-		}
+// BoxesWithRecords returns which of the boxes have a collection of records. Boxes that never
+// received a record have none.
+func (r *ZoneRepository) BoxesWithRecords(ctx context.Context, boxIDs []string) (map[string]bool, error) {
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
 
-		cursor, err := collection.Aggregate(ctx, pipeline)
-		if err != nil {
-			continue
-		}
+	names := make([]string, len(boxIDs))
+	for i, id := range boxIDs {
+		names[i] = "sensor_data_" + id
+	}
+	existing, err := r.db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$in": names}})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		found[strings.TrimPrefix(name, "sensor_data_")] = true
+	}
+	return found, nil
+}
+
+// MonthlyTotals sums every numeric field of a box's records per calendar month (UTC).
+// Only records with t at or after since (seconds) are read; 0 reads them all.
+func (r *ZoneRepository) MonthlyTotals(ctx context.Context, source string, since int64) ([]domain.MonthlyTotals, error) {
+	ctx, cancel := boundQuery(ctx, r.queryTimeout)
+	defer cancel()
+
+	collection := r.db.Collection("sensor_data_" + source)
+
+	match := bson.M{"t": bson.M{"$exists": true}}
+	if since > 0 {
+		match["t"] = bson.M{"$gte": since}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{
+			"year":    bson.M{"$year": bson.M{"$toDate": bson.M{"$multiply": []interface{}{"$t", 1000}}}},
+			"month":   bson.M{"$month": bson.M{"$toDate": bson.M{"$multiply": []interface{}{"$t", 1000}}}},
+			"metrics": "$$ROOT",
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"year":  "$year",
+				"month": "$month",
+			},
+			"count": bson.M{"$sum": 1},
+			"data":  bson.M{"$push": "$metrics"},
+		}}},
+	}
+
+	opts := options.Aggregate()
+	if maxTime := queryMaxTime(ctx); maxTime > 0 {
+		opts.SetMaxTime(maxTime)
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []bson.M
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
 
-		var results []bson.M
-		if err := cursor.All(ctx, &results); err != nil {
-			cursor.Close(ctx)
+	months := []domain.MonthlyTotals{}
+	for _, result := range results {
+		id, ok := result["_id"].(bson.M)
+		if !ok {
 			continue
 		}
-		cursor.Close(ctx)
 
-		// Process results for each metric
-		for _, result := range results {
-			if id, ok := result["_id"].(bson.M); ok {
-				year := int(id["year"].(int32))
-				month := int(id["month"].(int32))
-				count := int(result["count"].(int32))
-				data := result["data"].([]interface{})
-
-				for _, metric := range metrics {
-					var total float64
-					validCount := 0
-
-					for _, item := range data {
-						if record, ok := item.(bson.M); ok {
-							if val, exists := record[metric]; exists {
-								if floatVal, ok := val.(float64); ok {
-									total += floatVal
-									validCount++
-								}
-							}
-						}
-					}
-
-					if validCount > 0 {
-						report := domain.Report{
-							Count: count,
-							Total: domain.RoundValue(total),
-						}
-						report.Info.Year = year
-						report.Info.Month = month
-						report.Info.Metric = metric
-						allReports = append(allReports, report)
-					}
+		month := domain.MonthlyTotals{
+			Year:   int(id["year"].(int32)),
+			Month:  int(id["month"].(int32)),
+			Count:  int(result["count"].(int32)),
+			Totals: make(map[string]float64),
+		}
+		for _, item := range result["data"].([]interface{}) {
+			record, ok := item.(bson.M)
+			if !ok {
+				continue
+			}
+			for key, value := range record {
+				if key == "_id" || key == "c" || key == "t" {
+					continue
+				}
+				if floatVal, ok := value.(float64); ok {
+					month.Totals[key] += floatVal
 				}
 			}
 		}
+		months = append(months, month)
+	}
+	return months, nil
+}
+
+// GetReportCache returns the cached closed-month totals of a box, or nil when none are cached
+func (r *ZoneRepository) GetReportCache(ctx context.Context, boxID string) (*domain.ReportCache, error) {
+	var cache domain.ReportCache
+	err := r.reports.FindOne(ctx, bson.M{"_id": boxID}).Decode(&cache)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
 	}
+	return &cache, nil
+}
 
-	return allReports, nil
+func (r *ZoneRepository) SaveReportCache(ctx context.Context, cache *domain.ReportCache) error {
+	_, err := r.reports.ReplaceOne(ctx, bson.M{"_id": cache.BoxID}, cache, options.Replace().SetUpsert(true))
+	return err
+}
+
+// InvalidateReportCache drops the cached totals of a box after one of its closed months changed
+func (r *ZoneRepository) InvalidateReportCache(ctx context.Context, boxID string) error {
+	_, err := r.reports.DeleteOne(ctx, bson.M{"_id": boxID})
+	return err
 }
@@ -1,7 +1,11 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 	"tp25-api/internal/config"
 	"tp25-api/internal/domain"
@@ -9,27 +13,123 @@ import (
 	"tp25-api/internal/middleware"
 	"tp25-api/internal/repository/mongodb"
 	"tp25-api/internal/service"
+	"tp25-api/internal/version"
 	"tp25-api/lib/database"
+	"tp25-api/lib/notify"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
-func New(cfg *config.Config, db *database.MongoDB) *gin.Engine {
+// New builds the router. The returned shutdown function stops the camera checks and job heartbeats
+// and flushes buffered work, and must be called after the HTTP server has stopped accepting requests.
+func New(cfg *config.Config, db *database.MongoDB) (*gin.Engine, func(context.Context) error) {
 	userRepo := mongodb.NewUserRepository(db.Database)
 	zoneRepo := mongodb.NewZoneRepository(db.Database)
 	sensorRepo := mongodb.NewSensorRepository(db.Database)
+	zoneRepo.SetQueryTimeout(cfg.Database.QueryTimeout)
+	sensorRepo.SetQueryTimeout(cfg.Database.QueryTimeout)
 	settingRepo := mongodb.NewSettingRepository(db.Database)
+	templateRepo := mongodb.NewExportTemplateRepository(db.Database)
+	jobRepo := mongodb.NewJobRepository(db.Database)
+	maintenanceRepo := mongodb.NewMaintenanceRepository(db.Database)
+	boxLogRepo := mongodb.NewBoxLogRepository(db.Database)
+	rollupRepo := mongodb.NewRollupRepository(db.Database)
+	securityEventRepo := mongodb.NewSecurityEventRepository(db.Database)
+	alertRepo := mongodb.NewAlertRepository(db.Database)
+	calibrationRepo := mongodb.NewCalibrationRepository(db.Database)
+	observationRepo := mongodb.NewObservationRepository(db.Database)
+	anomalyRepo := mongodb.NewAnomalyRepository(db.Database)
+	cameraRepo := mongodb.NewCameraRepository(db.Database)
+	apiKeyRepo := mongodb.NewAPIKeyRepository(db.Database)
+	exportFileRepo := mongodb.NewExportFileRepository(db.Database)
+	deadLetterRepo := mongodb.NewIngestDeadLetterRepository(db.Database)
 
-	userService := service.NewUserService(userRepo, cfg.Auth.JWTSecret)
-	zoneService := service.NewZoneService(zoneRepo)
-	sensorService := service.NewSensorService(sensorRepo, zoneRepo)
+	indexed := []service.IndexedRepository{
+		zoneRepo, sensorRepo, settingRepo, maintenanceRepo, boxLogRepo, rollupRepo, securityEventRepo,
+		alertRepo, calibrationRepo, observationRepo, anomalyRepo, cameraRepo, apiKeyRepo, deadLetterRepo,
+	}
+	ensureIndexes(indexed)
+	migrateBrandingSettings(zoneRepo, settingRepo)
+	migrateCrestElevations(zoneRepo)
+
+	userService := service.NewUserService(userRepo, zoneRepo, cfg.Auth.JWTSecrets)
+	// Without a webhook, messages only reach the log: reset codes cannot be delivered then
+	sender := notify.New(cfg.Notify.WebhookURL)
+	if cfg.Notify.WebhookURL == "" {
+		log.Printf("NOTIFY_WEBHOOK_URL is not set; password reset codes and job notifications are only logged, with their secrets masked")
+	}
+	userService.SetPasswordReset(sender, cfg.Auth.PasswordResetTTL, cfg.Auth.PasswordResetMaxPerHour)
+	if err := userService.SetTwoFactorKey(cfg.Auth.TOTPEncryptionKey); err != nil {
+		log.Fatalf("Failed to initialize 2FA encryption: %v", err)
+	}
+	userService.SetSessionLimits(map[domain.Role]int{
+		domain.RoleAdmin:   cfg.Auth.SessionLimitAdmin,
+		domain.RoleMonitor: cfg.Auth.SessionLimitMonitor,
+	}, cfg.Auth.SessionLimitEvict)
+	userService.SetSecurityEvents(securityEventRepo, cfg.Auth.SecurityEventRetention)
+	zoneService := service.NewZoneService(zoneRepo, boxLogRepo, settingRepo)
+	if cfg.Sites.VietnamOnly {
+		zoneService.SetLocationBounds(&domain.VietnamBounds)
+	}
+	zoneService.SetMetricCatalog(sensorRepo)
+	zoneService.SetCameraChecks(cameraRepo)
+	// Access tokens list the groups of the user's zones
+	zoneService.OnZoneGroupsChange(userService.RevokeZoneTokens)
+	featureFlags := service.NewFeatureFlagService(settingRepo, cfg.Features)
+	sensorService := service.NewSensorService(sensorRepo, zoneRepo, templateRepo, jobRepo, maintenanceRepo, boxLogRepo, rollupRepo, settingRepo, calibrationRepo, anomalyRepo)
+	sensorService.StartIngest(cfg.Ingest.QueueSize, cfg.Ingest.Workers, cfg.Ingest.BatchSize)
+	sensorService.SetIngestDeadLetters(deadLetterRepo, cfg.Ingest.ReplayInterval)
+	sensorService.SetExportLimit(cfg.Export.MaxRows)
+	sensorService.SetPollLimit(cfg.Server.PollMaxHeld)
+	sensorService.SetRateHorizon(cfg.Ingest.RateHorizon)
+	sensorService.SetJobNotifier(sender, userRepo)
+	sensorService.SetExportJobs(exportFileRepo, exportDownloadKey(cfg), cfg.Export.DownloadTTL, cfg.Server.PublicURL)
+	sensorService.SetFeatureFlags(featureFlags)
+	sensorService.StartJobHeartbeats()
+	zoneService.OnBoxChange(sensorService.ForgetBox)
+	sensorService.SetMaintenance(service.MaintenanceSettings{Workers: cfg.Jobs.MaintenanceWorkers, Indexed: indexed})
 	settingService := service.NewSettingService(settingRepo)
+	maintenanceService := service.NewMaintenanceService(maintenanceRepo, zoneRepo)
+	boxLogService := service.NewBoxLogService(boxLogRepo, zoneRepo)
+	observationService := service.NewObservationService(observationRepo, zoneRepo)
+	syncService := service.NewSyncService(zoneRepo, sensorRepo, settingRepo)
+	resolveService := service.NewResolveService(zoneRepo, userRepo)
+	alertService := service.NewAlertService(alertRepo)
+	calibrationService := service.NewCalibrationService(calibrationRepo, zoneRepo)
+	apiKeyService := service.NewAPIKeyService(apiKeyRepo, zoneRepo)
+	cameraChecker := service.NewCameraChecker(zoneRepo, cameraRepo, cfg.Sites.CameraCheckTimeout)
+	if cfg.Sites.CameraAlerts {
+		cameraChecker.SetAlerts(alertRepo)
+	}
+	cameraChecker.Start(cfg.Sites.CameraCheckInterval)
+	readOnlyService := service.NewReadOnlyService(settingRepo)
+	readOnlyService.OnChange(func(mode domain.ReadOnlyMode) {
+		sensorService.SetIngestPaused(mode.BuffersIngest())
+	})
+	// Resume holding ingestion when the server restarts in a buffering read-only mode
+	readOnlyService.Mode(context.Background())
 
 	authHandler := handler.NewAuthHandler(userService, cfg)
 	userHandler := handler.NewUserHandler(userService)
 	zoneHandler := handler.NewZoneHandler(zoneService)
+	zoneHandler.SetLegacyBoxes(cfg.Server.LegacyBoxs)
 	sensorHandler := handler.NewSensorHandler(sensorService)
+	sensorHandler.SetHistoryCaching(cfg.Server.HistoryClosedAfter, cfg.Server.HistoryCacheMaxAge)
+	sensorHandler.SetExportAudit(userService)
+	sensorHandler.SetRecordPageSize(cfg.Server.RecordPageSize)
 	settingHandler := handler.NewSettingHandler(settingService)
+	maintenanceHandler := handler.NewMaintenanceHandler(maintenanceService)
+	boxLogHandler := handler.NewBoxLogHandler(boxLogService)
+	observationHandler := handler.NewObservationHandler(observationService)
+	syncHandler := handler.NewSyncHandler(syncService)
+	resolveHandler := handler.NewResolveHandler(resolveService)
+	alertHandler := handler.NewAlertHandler(alertService)
+	calibrationHandler := handler.NewCalibrationHandler(calibrationService)
+	readOnlyHandler := handler.NewReadOnlyHandler(readOnlyService)
+	featureHandler := handler.NewFeatureHandler(featureFlags)
+	apiKeyHandler := handler.NewAPIKeyHandler(apiKeyService)
+	debugHandler := handler.NewDebugHandler(db, sensorService, userService)
 
 	authMiddleware := middleware.NewAuthMiddleware(cfg, userService)
 
@@ -37,12 +137,32 @@ func New(cfg *config.Config, db *database.MongoDB) *gin.Engine {
 	router := gin.Default()
 
 	router.Use(middleware.CORS())
+	router.Use(middleware.Version())
+	router.Use(middleware.Locale())
+	router.Use(middleware.ReadOnly(readOnlyService))
+	router.Use(middleware.APIKey(apiKeyService))
+	if cfg.Tracing.Enabled() {
+		router.Use(otelgin.Middleware(cfg.Tracing.ServiceName))
+	}
 
 	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status": "ok",
-			"time":   time.Now().Unix(),
-		})
+		readOnly := readOnlyService.Mode(c.Request.Context())
+		body := gin.H{
+			"status":    "ok",
+			"time":      time.Now().Unix(),
+			"version":   version.Version,
+			"commit":    version.Commit,
+			"read_only": readOnly.Enabled,
+			"features":  featureFlags.Flags(c.Request.Context()),
+		}
+		if readOnly.Enabled {
+			body["read_only_mode"] = readOnly
+		}
+		c.JSON(http.StatusOK, body)
+	})
+
+	router.GET("/version", func(c *gin.Context) {
+		c.JSON(http.StatusOK, version.Get())
 	})
 
 	router.Static("/docs", "./docs")
@@ -51,85 +171,370 @@ func New(cfg *config.Config, db *database.MongoDB) *gin.Engine {
 		c.File("docs/swagger.html")
 	})
 
-	api := router.Group("/api")
-	{
+	if cfg.Server.DebugEndpoints {
+		debug := router.Group("/debug")
+		debug.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapDebug))
+		{
+			debug.GET("/stats", debugHandler.Stats)
+			debug.GET("/pprof/*profile", debugHandler.Pprof)
+			debug.POST("/pprof/*profile", debugHandler.Pprof)
+		}
+	}
+
+	if cfg.Server.MetricsToken != "" {
+		router.GET("/metrics", middleware.StaticToken(cfg.Server.MetricsToken), debugHandler.Metrics)
+	}
+
+	// /api is the original, unversioned API. /api/v2 serves the same routes without the fields
+	// deprecated on /api, such as the "boxs" key of groups.
+	for _, api := range []*gin.RouterGroup{router.Group("/api"), router.Group("/api/v2", middleware.APIVersion(2))} {
 		auth := api.Group("/auth")
 		{
 			auth.POST("/login", authHandler.Login)
 			auth.POST("/refresh", authHandler.RefreshToken)
+			auth.POST("/forgot", authHandler.ForgotPassword)
+			auth.POST("/reset", authHandler.ResetPassword)
+			auth.POST("/2fa/setup", authMiddleware.Auth(), authMiddleware.LoadUser(), authHandler.SetupTwoFactor)
+			auth.POST("/2fa/verify", authMiddleware.Auth(), authHandler.VerifyTwoFactor)
+			auth.POST("/2fa/login", authHandler.TwoFactorLogin)
 			auth.POST("/logout", authMiddleware.Auth(), authHandler.Logout)
-			auth.GET("/profile", authMiddleware.Auth(), authHandler.GetProfile)
+			auth.GET("/profile", authMiddleware.Auth(), authMiddleware.LoadUser(), authHandler.GetProfile)
+			auth.PUT("/profile", authMiddleware.Auth(), authHandler.UpdateProfile)
 			auth.PUT("/password", authMiddleware.Auth(), authHandler.SetPassword)
+			auth.GET("/permissions", authMiddleware.Auth(), authHandler.GetPermissions)
+			auth.GET("/sessions", authMiddleware.Auth(), authHandler.ListSessions)
+		}
+
+		public := api.Group("/public")
+		{
+			public.GET("/groups/:subdomain", zoneHandler.GetPublicGroup)
 		}
 
 		users := api.Group("/users")
-		users.Use(authMiddleware.Auth(), authMiddleware.RequireRole(domain.RoleAdmin))
+		users.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapManageUsers))
 		{
 			users.GET("", userHandler.ListUsers)
 			users.GET("/:id", userHandler.GetUser)
 			users.POST("", userHandler.CreateUser)
+			users.POST("/import", userHandler.ImportUsers)
 			users.PUT("/:id", userHandler.UpdateUser)
 			users.PUT("/:id/password", userHandler.SetUserPassword)
 			users.DELETE("/:id", userHandler.DeleteUser)
+			users.DELETE("/:id/2fa", userHandler.ResetTwoFactor)
+		}
+
+		admin := api.Group("/admin")
+		admin.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapManageUsers))
+		{
+			admin.GET("/security-events", userHandler.ListSecurityEvents)
+			admin.GET("/exports", userHandler.ListExports)
+			admin.GET("/read-only", readOnlyHandler.GetReadOnly)
+			admin.PUT("/read-only", readOnlyHandler.SetReadOnly)
+			admin.GET("/features", featureHandler.ListFeatures)
+			admin.PUT("/features/:name", featureHandler.SetFeature)
+			admin.GET("/api-keys", apiKeyHandler.ListAPIKeys)
+			admin.POST("/api-keys", apiKeyHandler.CreateAPIKey)
+			admin.DELETE("/api-keys/:id", apiKeyHandler.RevokeAPIKey)
+			admin.GET("/hydraulics/unconfigured", sensorHandler.UnconfiguredHydraulics)
+			admin.POST("/maintenance/reindex", sensorHandler.Reindex)
+			admin.POST("/maintenance/rebuild-rollups", sensorHandler.RebuildRollups)
 		}
 
 		zones := api.Group("/zones")
-		zones.Use(authMiddleware.Auth())
+		zones.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewSites))
 		{
 			zones.GET("", zoneHandler.ListZones)
-			zones.POST("", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.CreateZone)
-			zones.GET("/reports", zoneHandler.ReportByMetric)
+			zones.POST("", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.CreateZone)
+			zones.GET("/reports", authMiddleware.RequireCapability(domain.CapViewRecords), zoneHandler.ReportByMetric)
+			zones.GET("/oversized-details", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.OversizedZoneDetails)
+			zones.GET("/invalid-locations", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.InvalidLocations)
+			zones.GET("/invalid-group-maps", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.InvalidGroupMaps)
+			zones.GET("/box-zone-mismatches", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.BoxZoneMismatches)
+			zones.POST("/box-zone-mismatches/fix", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.FixBoxZoneMismatches)
 			zones.GET("/:id", zoneHandler.GetZone)
-			zones.PUT("/:id", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.UpdateZone)
+			zones.PUT("/:id", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.UpdateZone)
 			zones.GET("/:id/groups", zoneHandler.ListGroups)
-			zones.POST("/:id/groups", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.CreateGroup)
+			zones.GET("/:id/metrics-matrix", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.MetricsMatrix)
+			zones.POST("/:id/groups", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.CreateGroup)
 		}
 
 		groups := api.Group("/groups")
-		groups.Use(authMiddleware.Auth())
+		groups.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewSites))
 		{
-			groups.GET("/:id", zoneHandler.GetGroup)
-			groups.PUT("/:id", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.UpdateGroup)
-			groups.DELETE("/:id", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.DeleteGroup)
-			groups.GET("/:id/boxes", zoneHandler.ListBoxes)
-			groups.POST("/:id/boxes", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.CreateBox)
-			groups.GET("/:id/records", sensorHandler.ListRecordsByGroup)
-			groups.GET("/:id/records/latest", sensorHandler.ListRecordsLatestByGroup)
+			groups.GET("/:id", sensorHandler.RequireGroupAccess, zoneHandler.GetGroup)
+			groups.PUT("/:id", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.UpdateGroup)
+			groups.DELETE("/:id", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.DeleteGroup)
+			groups.PUT("/:id/archive", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.ArchiveGroup)
+			groups.PUT("/:id/unarchive", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.UnarchiveGroup)
+			groups.POST("/:id/clone", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.CloneGroup)
+			groups.GET("/:id/boxes", sensorHandler.RequireGroupAccess, zoneHandler.ListBoxes)
+			groups.POST("/:id/boxes", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.CreateBox)
+			groups.GET("/:id/records", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireGroupAccess, sensorHandler.ListRecordsByGroup)
+			groups.GET("/:id/records/latest", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireGroupAccess, sensorHandler.ListRecordsLatestByGroup)
+			groups.GET("/:id/records/export", authMiddleware.RequireCapability(domain.CapExportRecords), sensorHandler.RequireGroupAccess, sensorHandler.ExportGroupRecords)
+			groups.POST("/:id/records/export-jobs", authMiddleware.RequireCapability(domain.CapExportRecords), sensorHandler.RequireGroupAccess, sensorHandler.StartGroupExport)
+			groups.GET("/:id/ingest-stats", sensorHandler.RequireGroupAccess, sensorHandler.GroupIngestStats)
+			groups.GET("/:id/export-template", sensorHandler.RequireGroupAccess, sensorHandler.GetExportTemplate)
+			groups.PUT("/:id/export-template", authMiddleware.RequireCapability(domain.CapManageExportTemplates), sensorHandler.UploadExportTemplate)
+			groups.DELETE("/:id/export-template", authMiddleware.RequireCapability(domain.CapManageExportTemplates), sensorHandler.DeleteExportTemplate)
+			groups.GET("/:id/inflow", sensorHandler.RequireGroupAccess, sensorHandler.GroupInflow)
+			groups.GET("/:id/status", sensorHandler.RequireGroupAccess, sensorHandler.GroupStatus)
+			groups.GET("/:id/cameras/status", sensorHandler.RequireGroupAccess, zoneHandler.CameraStatus)
+			groups.GET("/:id/quality", authMiddleware.RequireCapability(domain.CapViewQuality), sensorHandler.RequireGroupAccess, sensorHandler.GroupQualityReport)
+			groups.GET("/:id/hydraulics/export", authMiddleware.RequireCapability(domain.CapManageSites), sensorHandler.ExportHydraulics)
+			groups.POST("/:id/hydraulics/import", authMiddleware.RequireCapability(domain.CapManageSites), sensorHandler.ImportHydraulics)
 		}
 
 		boxes := api.Group("/boxes")
-		boxes.Use(authMiddleware.Auth())
+		boxes.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewSites))
 		{
 			boxes.GET("", zoneHandler.ListAllBoxes)
-			boxes.GET("/:id", zoneHandler.GetBox)
-			boxes.PUT("/:id", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.UpdateBox)
-			boxes.DELETE("/:id", authMiddleware.RequireRole(domain.RoleAdmin), zoneHandler.DeleteBox)
-			boxes.GET("/:id/records", sensorHandler.ListRecords)
-			boxes.GET("/:id/records/export", sensorHandler.ExportRecords)
-			boxes.POST("/:id/records", sensorHandler.AddRecord)
-			boxes.GET("/:id/reports", sensorHandler.ReportRecords)
+			boxes.GET("/:id", sensorHandler.RequireBoxAccess, zoneHandler.GetBox)
+			boxes.PUT("/:id", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.UpdateBox)
+			boxes.DELETE("/:id", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.DeleteBox)
+			boxes.PUT("/:id/decommission", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.DecommissionBox)
+			boxes.DELETE("/:id/decommission", authMiddleware.RequireCapability(domain.CapManageSites), zoneHandler.RecommissionBox)
+			boxes.GET("/:id/locations", sensorHandler.RequireBoxAccess, zoneHandler.ListBoxLocations)
+			boxes.GET("/:id/maintenance", sensorHandler.RequireBoxAccess, maintenanceHandler.BoxMaintenanceStatus)
+			boxes.GET("/:id/logs", boxLogHandler.ListBoxLogs)
+			boxes.POST("/:id/logs", authMiddleware.RequireCapability(domain.CapWriteBoxLogs), authMiddleware.LoadUser(), boxLogHandler.CreateBoxLog)
+			boxes.PUT("/:id/logs/:log_id", authMiddleware.RequireCapability(domain.CapEditBoxLogs), boxLogHandler.UpdateBoxLog)
+			boxes.DELETE("/:id/logs/:log_id", authMiddleware.RequireCapability(domain.CapEditBoxLogs), boxLogHandler.DeleteBoxLog)
+			boxes.GET("/:id/observations", observationHandler.ListObservations)
+			boxes.POST("/:id/observations", observationHandler.CreateObservation)
+			boxes.GET("/:id/observations/:observation_id", observationHandler.GetObservation)
+			boxes.GET("/:id/observations/:observation_id/history", observationHandler.ListObservationHistory)
+			boxes.PUT("/:id/observations/:observation_id", authMiddleware.RequireCapability(domain.CapEditObservations), observationHandler.UpdateObservation)
+			boxes.DELETE("/:id/observations/:observation_id", authMiddleware.RequireCapability(domain.CapEditObservations), observationHandler.DeleteObservation)
+			boxes.GET("/:id/calibrations", calibrationHandler.ListCalibrations)
+			boxes.POST("/:id/calibrations", authMiddleware.RequireCapability(domain.CapManageCalibrations), calibrationHandler.CreateCalibration)
+			boxes.PUT("/:id/calibrations/:calibration_id", authMiddleware.RequireCapability(domain.CapManageCalibrations), calibrationHandler.UpdateCalibration)
+			boxes.DELETE("/:id/calibrations/:calibration_id", authMiddleware.RequireCapability(domain.CapManageCalibrations), calibrationHandler.DeleteCalibration)
+			boxes.POST("/:id/metrics/:code/recompute", authMiddleware.RequireCapability(domain.CapRecomputeRecords), sensorHandler.RecomputeConversion)
+			boxes.GET("/:id/records", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.ListRecords)
+			boxes.GET("/:id/records/export", authMiddleware.RequireCapability(domain.CapExportRecords), sensorHandler.RequireBoxAccess, sensorHandler.ExportRecords)
+			boxes.GET("/:id/records/count", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.CountRecords)
+			boxes.GET("/:id/records/poll", middleware.RequireFeature(featureFlags, domain.FeatureRecordPoll), authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.PollRecords)
+			boxes.GET("/:id/records/stats", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.RecordStats)
+			boxes.GET("/:id/records/schema", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.RecordSchema)
+			boxes.GET("/:id/records/histogram", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.MetricHistogram)
+			boxes.POST("/:id/records/:timestamp/flags/:code/clear", middleware.RequireFeature(featureFlags, domain.FeatureAnomalyDetection), authMiddleware.RequireCapability(domain.CapCorrectRecords), sensorHandler.RequireBoxAccess, sensorHandler.ClearRecordFlag)
+			boxes.POST("/:id/records", authMiddleware.RequireCapability(domain.CapAddRecords), sensorHandler.AddRecord)
+			boxes.GET("/:id/corrections", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.ListRecordCorrections)
+			boxes.GET("/:id/ingest-schema", sensorHandler.RequireBoxAccess, sensorHandler.IngestSchema)
+			boxes.GET("/:id/ingest-stats", sensorHandler.RequireBoxAccess, sensorHandler.BoxIngestStats)
+			boxes.GET("/:id/reports", authMiddleware.RequireCapability(domain.CapViewRecords), sensorHandler.RequireBoxAccess, sensorHandler.ReportRecords)
+			boxes.GET("/:id/quality", authMiddleware.RequireCapability(domain.CapViewQuality), sensorHandler.RequireBoxAccess, sensorHandler.QualityReport)
+		}
+
+		records := api.Group("/records")
+		records.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewRecords))
+		{
+			records.GET("/compare", sensorHandler.CompareRecords)
 		}
 
 		metrics := api.Group("/metrics")
 		metrics.Use(authMiddleware.Auth())
 		{
 			metrics.GET("", sensorHandler.ListMetrics)
+			metrics.GET("/unit-report", authMiddleware.RequireCapability(domain.CapManageMetrics), sensorHandler.UnitReport)
 			metrics.GET("/:id", sensorHandler.GetMetric)
-			metrics.POST("", authMiddleware.RequireRole(domain.RoleAdmin), sensorHandler.CreateMetric)
-			metrics.PUT("/:id", authMiddleware.RequireRole(domain.RoleAdmin), sensorHandler.UpdateMetric)
-			metrics.DELETE("/:id", authMiddleware.RequireRole(domain.RoleAdmin), sensorHandler.DeleteMetric)
+			metrics.POST("", authMiddleware.RequireCapability(domain.CapManageMetrics), sensorHandler.CreateMetric)
+			metrics.PUT("/order", authMiddleware.RequireCapability(domain.CapManageMetrics), sensorHandler.ReorderMetrics)
+			metrics.PUT("/:id", authMiddleware.RequireCapability(domain.CapManageMetrics), sensorHandler.UpdateMetric)
+			metrics.DELETE("/:id", authMiddleware.RequireCapability(domain.CapManageMetrics), sensorHandler.DeleteMetric)
+		}
+
+		api.GET("/units", authMiddleware.Auth(), sensorHandler.ListUnits)
+
+		maintenance := api.Group("/maintenance")
+		maintenance.Use(authMiddleware.Auth())
+		{
+			maintenance.GET("", maintenanceHandler.ListMaintenance)
+			maintenance.GET("/:id", maintenanceHandler.GetMaintenance)
+			maintenance.POST("", authMiddleware.RequireCapability(domain.CapManageMaintenance), maintenanceHandler.CreateMaintenance)
+			maintenance.PUT("/:id", authMiddleware.RequireCapability(domain.CapManageMaintenance), maintenanceHandler.UpdateMaintenance)
+			maintenance.DELETE("/:id", authMiddleware.RequireCapability(domain.CapManageMaintenance), maintenanceHandler.DeleteMaintenance)
+		}
+
+		alerts := api.Group("/alerts")
+		alerts.Use(authMiddleware.Auth())
+		{
+			alerts.GET("", alertHandler.ListAlerts)
+			alerts.GET("/export", alertHandler.ExportAlerts)
+		}
+
+		api.POST("/resolve", authMiddleware.Auth(), resolveHandler.Resolve)
+		api.GET("/tree", authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewSites), zoneHandler.Tree)
+
+		// The download link carries its own signed token, so it is served without a session
+		api.GET("/export-jobs/:id/download", sensorHandler.DownloadExport)
+		api.GET("/export-jobs/:id", authMiddleware.Auth(), sensorHandler.GetExportJob)
+
+		jobs := api.Group("/jobs")
+		jobs.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapRecomputeRecords))
+		{
+			jobs.GET("/:id", sensorHandler.GetJob)
+		}
+
+		api.POST("/rollups/backfill", authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapRecomputeRecords), sensorHandler.BackfillRollups)
+
+		// Legacy path documented before the count route moved under /boxes
+		data := api.Group("/data")
+		data.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapViewRecords))
+		{
+			data.GET("/box/:box_id/count", sensorHandler.RequireBoxAccess, sensorHandler.CountRecords)
 		}
 
+		api.GET("/sync", authMiddleware.Auth(), authMiddleware.LoadUser(), syncHandler.Sync)
+
 		settings := api.Group("/settings")
-		settings.Use(authMiddleware.Auth(), authMiddleware.RequireRole(domain.RoleAdmin))
+		settings.Use(authMiddleware.Auth(), authMiddleware.RequireCapability(domain.CapManageSettings))
 		{
 			settings.GET("", settingHandler.ListSettings)
+			settings.GET("/values", settingHandler.SettingValues)
+			settings.GET("/key-report", settingHandler.SettingKeyReport)
 			settings.GET("/:id", settingHandler.GetSetting)
 			settings.POST("", settingHandler.CreateSetting)
 			settings.PUT("/:id", settingHandler.UpdateSetting)
 			settings.DELETE("/:id", settingHandler.DeleteSetting)
+			settings.GET("/:id/history", settingHandler.ListSettingHistory)
+			settings.POST("/:id/history/:version_id/restore", settingHandler.RestoreSetting)
+		}
+	}
+
+	return router, func(ctx context.Context) error {
+		if err := cameraChecker.Close(ctx); err != nil {
+			return err
+		}
+		return sensorService.Close(ctx)
+	}
+}
+
+// ensureIndexes creates the indexes the repositories declare, logging failures so existing duplicates do not prevent startup
+func ensureIndexes(repos []service.IndexedRepository) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, repo := range repos {
+		if err := repo.EnsureIndexes(ctx); err != nil {
+			names := []string{}
+			for _, collection := range repo.IndexedCollections() {
+				names = append(names, collection.Name())
+			}
+			log.Printf("Failed to create the indexes of %s: %v", strings.Join(names, ", "), err)
+		}
+	}
+}
+
+// exportDownloadKey returns the key export download links are signed with. Without a configured
+// one, a random key keeps links unforgeable but invalidates them on restart.
+func exportDownloadKey(cfg *config.Config) []byte {
+	if cfg.Export.DownloadKey != "" {
+		return []byte(cfg.Export.DownloadKey)
+	}
+	log.Printf("EXPORT_DOWNLOAD_KEY is not set; export download links stop working on restart")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate the export download key: %v", err)
+	}
+	return key
+}
+
+// migrateCrestElevations sets the crest elevation of the groups whose note only has the elevation
+// entered as text, read with domain.ParseElevation. Groups migrated are skipped on the next run; a
+// text that is not a number is logged and left for an admin to set crest_elevation by hand.
+func migrateCrestElevations(zoneRepo *mongodb.ZoneRepository) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	groups, err := zoneRepo.ListGroupsWithTextElevation(ctx)
+	if err != nil {
+		log.Printf("Crest elevation migration: list groups: %v", err)
+		return
+	}
+
+	migrated := 0
+	for _, group := range groups {
+		elevation, ok := domain.ParseElevation(group.Note.Elevation)
+		if !ok {
+			log.Printf("Crest elevation migration: group %s: elevation %q is not a number, skipped", group.ID, group.Note.Elevation)
+			continue
+		}
+		if err := zoneRepo.SetCrestElevation(ctx, group.ID, elevation); err != nil {
+			log.Printf("Crest elevation migration: group %s: %v", group.ID, err)
+			continue
 		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Printf("Crest elevation migration: set the crest elevation of %d groups", migrated)
+	}
+}
+
+// migrateBrandingSettings moves the legacy branding_<subdomain or group ID>_<field> settings onto the
+// branding of their group. Fields the group already has win; settings are deleted once moved, so the
+// migration is a no-op after the first successful run. Failures are logged and leave the settings in place.
+func migrateBrandingSettings(zoneRepo *mongodb.ZoneRepository, settingRepo *mongodb.SettingRepository) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	settings, err := settingRepo.List(ctx)
+	if err != nil {
+		log.Printf("Branding migration: list settings: %v", err)
+		return
+	}
+
+	brandings := make(map[string]*domain.Branding)
+	settingIDs := make(map[string][]string)
+	for _, setting := range settings {
+		ref, field, ok := domain.ParseBrandingSettingKey(setting.Key)
+		if !ok {
+			continue
+		}
+		value, ok := setting.Value.(string)
+		if !ok {
+			log.Printf("Branding migration: setting %s is not a string, skipped", setting.Key)
+			continue
+		}
+
+		if brandings[ref] == nil {
+			brandings[ref] = &domain.Branding{}
+		}
+		brandings[ref].SetField(field, value)
+		settingIDs[ref] = append(settingIDs[ref], setting.ID)
 	}
 
-	return router
+	for ref, branding := range brandings {
+		group, err := zoneRepo.GetGroupBySubdomain(ctx, ref)
+		if err == domain.ErrBoxGroupNotFound {
+			group, err = zoneRepo.GetGroup(ctx, ref)
+		}
+		if err != nil {
+			log.Printf("Branding migration: group %s: %v", ref, err)
+			continue
+		}
+
+		if group.Branding != nil {
+			group.Branding.MergeMissing(branding)
+			branding = group.Branding
+		}
+		if err := branding.Validate(); err != nil {
+			log.Printf("Branding migration: group %s: %v", ref, err)
+			continue
+		}
+
+		group.Branding = branding
+		if err := zoneRepo.UpdateGroup(ctx, group); err != nil {
+			log.Printf("Branding migration: group %s: %v", ref, err)
+			continue
+		}
+
+		for _, id := range settingIDs[ref] {
+			if err := settingRepo.Delete(ctx, id, ""); err != nil {
+				log.Printf("Branding migration: delete setting %s: %v", id, err)
+			}
+		}
+		log.Printf("Branding migration: moved %d settings onto group %s", len(settingIDs[ref]), group.ID)
+	}
 }
@@ -0,0 +1,2388 @@
+//go:build integration
+
+// The integration tests serve the real router in-process against the MongoDB of MONGO_URI, in a
+// throwaway database that is dropped before seeding (TEST_MONGO_DB, tp25_routetest by default). They
+// sign in an admin and a monitor through /auth/login, issue an API key reading the monitor's group,
+// and send each case of a table across the zone, group, box, record, metric and setting routes,
+// checking the status code and the shape of the response. They only build with the integration tag
+// and are skipped without MONGO_URI; see the routetest make target, which starts MongoDB in Docker.
+//
+// They catch what type checking does not: a route guarded by the wrong capability, a path parameter
+// the handler does not read, or a response losing a key clients rely on.
+
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"tp25-api/internal/config"
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/internal/server"
+	"tp25-api/lib/database"
+
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedInterval is the spacing of seeded records, the usual logger period
+const seedInterval = 10 * 60
+
+// seedRecords is how many records each seeded box holds
+const seedRecords = 144
+
+// password is the password of the seeded users
+const password = "routetest-password"
+
+// Who a case signs its request as
+const (
+	anonymous   = ""
+	admin       = "admin"
+	monitor     = "monitor"
+	integration = "integration" // the API key, sent as X-Api-Key
+)
+
+// shape is what a JSON response holds: an array, or an object with at least the keys
+type shape struct {
+	array    bool
+	keys     []string
+	fullPage bool // data holds exactly meta.page_size items
+	plain    bool // data holds records whose fields, but flags, are numbers, strings, booleans or null
+	empty    bool // the array, or the value of the first key, is [] rather than null
+}
+
+var (
+	paginated = shape{keys: []string{"data", "meta"}}
+	fullPage  = shape{keys: []string{"data", "meta"}, fullPage: true}
+	plain     = shape{keys: []string{"data", "meta"}, plain: true}
+	anArray   = shape{array: true}
+
+	emptyPage  = shape{keys: []string{"data", "meta"}, empty: true}
+	emptyItems = shape{keys: []string{"items"}, empty: true}
+	emptyArray = shape{array: true, empty: true}
+)
+
+func object(keys ...string) shape {
+	return shape{keys: keys}
+}
+
+// testCase is one request and the response it must get. A case without a shape only checks the
+// status; contentType, when set, is a prefix of the Content-Type of a non-JSON response.
+type testCase struct {
+	name        string
+	as          string
+	method      string
+	path        string
+	body        interface{}
+	status      int
+	shape       *shape
+	contentType string
+}
+
+type seeded struct {
+	zone        *domain.Zone
+	group       *domain.BoxGroup
+	box         *domain.Box
+	otherGroup  *domain.BoxGroup
+	otherBox    *domain.Box
+	metric      *domain.Metric
+	setting     *domain.Setting
+	latest      int64
+	monitorUser *domain.User
+}
+
+func TestRoutes(t *testing.T) {
+	if os.Getenv("MONGO_URI") == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+
+	if os.Getenv("TOTP_ENCRYPTION_KEY") == "" {
+		t.Setenv("TOTP_ENCRYPTION_KEY", "routetest")
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal("Failed to load configuration:", err)
+	}
+	cfg.Database.Name = os.Getenv("TEST_MONGO_DB")
+	if cfg.Database.Name == "" {
+		cfg.Database.Name = "tp25_routetest"
+	}
+	if cfg.Auth.JWTSecret == "" {
+		cfg.Auth.JWTSecret = "routetest"
+		cfg.Auth.JWTSecrets = []string{cfg.Auth.JWTSecret}
+	}
+	cfg.Server.DebugEndpoints = true
+
+	db, err := database.NewMongoDB(cfg)
+	if err != nil {
+		t.Fatal("Failed to connect to MongoDB:", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if err := db.Database.Drop(ctx); err != nil {
+		t.Fatal("Failed to drop the test database:", err)
+	}
+	seed, err := seedData(ctx, db)
+	if err != nil {
+		t.Fatal("Failed to seed:", err)
+	}
+
+	router, shutdown := server.New(cfg, db)
+	defer shutdown(ctx)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	tokens := map[string]string{}
+	for role, username := range map[string]string{admin: "routetest-admin", monitor: "routetest-monitor"} {
+		token, err := login(srv.URL, username)
+		if err != nil {
+			t.Fatalf("Failed to sign in %s: %v", username, err)
+		}
+		tokens[role] = token
+	}
+	key, err := issueAPIKey(srv.URL, tokens[admin], seed.group.ID)
+	if err != nil {
+		t.Fatalf("Failed to issue an API key: %v", err)
+	}
+	tokens[integration] = key
+
+	for _, tc := range cases(seed) {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := check(srv.URL, tokens[tc.as], tc); err != nil {
+				t.Errorf("%s %s: %v", tc.method, tc.path, err)
+			}
+		})
+	}
+	t.Run("export download link", func(t *testing.T) {
+		testExportDownloadLink(t, srv.URL, tokens[monitor], seed)
+	})
+	t.Run("profile keeps role and groups", func(t *testing.T) {
+		testProfileKeepsAccess(t, srv.URL, tokens[monitor], seed)
+	})
+	t.Run("zone access", func(t *testing.T) {
+		testZoneAccess(t, srv.URL, tokens[admin], db)
+	})
+	t.Run("record stats first and last", func(t *testing.T) {
+		testRecordStatsFirstLast(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("debug endpoints disabled", func(t *testing.T) {
+		testDebugDisabled(t, cfg, db, tokens[admin])
+	})
+	t.Run("merge policies", func(t *testing.T) {
+		testMergePolicies(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("interrupted jobs", func(t *testing.T) {
+		testInterruptedJobs(t, db)
+	})
+	t.Run("quality report", func(t *testing.T) {
+		testQualityReport(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("session limits", func(t *testing.T) {
+		testSessionLimits(t, cfg, db)
+	})
+	t.Run("recreate deleted codes", func(t *testing.T) {
+		testRecreateDeleted(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("monitor redaction", func(t *testing.T) {
+		testMonitorRedaction(t, srv.URL, tokens[admin], tokens[monitor], db, seed)
+	})
+	t.Run("export cap", func(t *testing.T) {
+		testExportCap(t, cfg, db, seed, tokens[admin])
+	})
+	t.Run("resolve mixed ids", func(t *testing.T) {
+		testResolveMixedIDs(t, srv.URL, tokens, seed)
+	})
+	t.Run("cached report", func(t *testing.T) {
+		testCachedReport(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("rollup reports", func(t *testing.T) {
+		testRollupReports(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("mutations of unknown ids", func(t *testing.T) {
+		testUnknownIDs(t, srv.URL, tokens[admin], seed)
+	})
+	t.Run("empty database", func(t *testing.T) {
+		testEmptyDatabase(t, cfg)
+	})
+	t.Run("oversized zone detail", func(t *testing.T) {
+		testOversizedZoneDetail(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("metric code rename", func(t *testing.T) {
+		testMetricRename(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("move group between zones", func(t *testing.T) {
+		testMoveGroup(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("history caching", func(t *testing.T) {
+		testHistoryCaching(t, srv.URL, tokens[monitor], cfg, seed)
+	})
+	t.Run("deleted boxes in group history", func(t *testing.T) {
+		testDeletedBoxHistory(t, srv.URL, tokens[admin], db, seed)
+	})
+	t.Run("maintenance jobs", func(t *testing.T) {
+		testMaintenanceJobs(t, srv.URL, tokens[admin], seed)
+	})
+	t.Run("password reset", func(t *testing.T) {
+		testPasswordReset(t, srv.URL, db, seed)
+	})
+}
+
+// testPasswordReset sets the password of a user without one through a reset token. A token is only
+// consumed once its password is saved, then it cannot be used again.
+func testPasswordReset(t *testing.T, baseURL string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	userRepo := mongodb.NewUserRepository(db.Database)
+	user := domain.NewUser(domain.CreateUserParams{Username: "routetest-reset", FullName: "Route test reset", Role: domain.RoleMonitor})
+	if err := userRepo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login(baseURL, user.Username); err == nil {
+		t.Fatal("a user without a password logged in")
+	}
+
+	const token = "routetest-reset-token"
+	sum := sha256.Sum256([]byte(token))
+	id := hex.EncodeToString(sum[:])
+	now := time.Now()
+	resetToken := &domain.PasswordResetToken{ID: id, UserID: user.ID, ExpiresAt: now.Add(15 * time.Minute).UnixMilli(), CTime: now.UnixMilli()}
+	if err := userRepo.SavePasswordResetToken(ctx, resetToken, now.Add(-time.Hour).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A password that is not saved along with the token leaves the token usable
+	other := &domain.UserSecret{UserID: seed.monitorUser.ID, Name: "password", Value: "unused", Encode: "bcrypt"}
+	if err := userRepo.ResetPassword(ctx, id, other); err != domain.ErrInvalidResetToken {
+		t.Fatalf("reset with the password of another user: %v, want %v", err, domain.ErrInvalidResetToken)
+	}
+	if _, err := userRepo.GetPasswordResetToken(ctx, id); err != nil {
+		t.Fatal("the token was consumed without its password:", err)
+	}
+
+	reset := domain.ResetPasswordRequest{Token: token, NewPassword: password}
+	if err := call(http.MethodPost, baseURL+"/api/auth/reset", "", reset, http.StatusOK, nil); err != nil {
+		t.Fatal("reset:", err)
+	}
+	if _, err := login(baseURL, user.Username); err != nil {
+		t.Fatal("login with the new password:", err)
+	}
+	if err := call(http.MethodPost, baseURL+"/api/auth/reset", "", reset, http.StatusBadRequest, nil); err != nil {
+		t.Fatal("reset reusing the token:", err)
+	}
+}
+
+// testMaintenanceJobs runs the reindex and rollup rebuild jobs to completion. The indexes created
+// at startup are dropped and recreated, so every collection ends with as many as it started with.
+func testMaintenanceJobs(t *testing.T, baseURL, token string, seed *seeded) {
+	reindex := runMaintenanceJob(t, baseURL, token, "reindex")
+	if len(reindex.Collections) == 0 {
+		t.Fatal("reindex worked on no collection")
+	}
+	for _, collection := range reindex.Collections {
+		if collection.Status != domain.JobDone {
+			t.Errorf("%s ended %s", collection.Name, collection.Status)
+		}
+		if collection.Processed == 0 || collection.Updated != collection.Processed {
+			t.Errorf("%s had %d indexes and has %d after the rebuild", collection.Name, collection.Processed, collection.Updated)
+		}
+	}
+
+	rebuild := runMaintenanceJob(t, baseURL, token, "rebuild-rollups")
+	found := false
+	for _, collection := range rebuild.Collections {
+		if collection.Status != domain.JobDone {
+			t.Errorf("%s ended %s", collection.Name, collection.Status)
+		}
+		if collection.Name == "sensor_data_"+seed.box.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("rollup rebuild left out the records of box %s", seed.box.ID)
+	}
+}
+
+// runMaintenanceJob starts an admin maintenance job and waits for it to succeed
+func runMaintenanceJob(t *testing.T, baseURL, token, name string) domain.Job {
+	t.Helper()
+	var job domain.Job
+	if err := call(http.MethodPost, baseURL+"/api/admin/maintenance/"+name, token, nil, http.StatusAccepted, &job); err != nil {
+		t.Fatal(name+":", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Status == domain.JobRunning && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if err := call(http.MethodGet, baseURL+"/api/jobs/"+job.ID, token, nil, http.StatusOK, &job); err != nil {
+			t.Fatal("poll:", err)
+		}
+	}
+	if job.Status != domain.JobDone {
+		t.Fatalf("%s ended %s: %s", name, job.Status, job.Error)
+	}
+	return job
+}
+
+// testDeletedBoxHistory reads the last three months of a group one of whose two boxes was deleted
+// halfway through: its records and report entries are left out by default, and included and
+// flagged with include_deleted_boxes
+func testDeletedBoxHistory(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test deleted box", ZoneID: seed.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	monthStart := time.Unix(domain.MonthStart(time.Now()), 0).UTC()
+	months := []int64{monthStart.AddDate(0, -3, 0).Unix(), monthStart.AddDate(0, -2, 0).Unix(), monthStart.AddDate(0, -1, 0).Unix()}
+
+	boxes := map[string]*domain.Box{}
+	for _, name := range []string{"live", "deleted"} {
+		box := domain.NewBox(domain.CreateBoxParams{
+			Name:     "Box routetest-" + name,
+			GroupID:  group.ID,
+			ZoneID:   group.ZoneID,
+			Location: domain.Location{Lat: 16, Lng: 107},
+			DeviceID: "routetest-history-" + name,
+			Metrics:  []domain.BoxMetric{{Code: "WAU"}},
+		})
+		if err := zoneRepo.CreateBox(ctx, box); err != nil {
+			t.Fatal(err)
+		}
+		boxes[name] = box
+
+		var records []domain.Record
+		for i, start := range months {
+			if name == "deleted" && i == 2 {
+				break // deleted before the last month
+			}
+			for _, day := range []int64{0, 9} {
+				timestamp := start + day*86400
+				records = append(records, domain.Record{"_id": timestamp, "c": timestamp * 1000, "WAU": 20.0})
+			}
+		}
+		if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := boxes["deleted"]
+	if err := call(http.MethodDelete, baseURL+"/api/boxes/"+deleted.ID, token, nil, http.StatusOK, nil); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, err := db.Database.Collection("box").UpdateOne(ctx, bson.M{"_id": deleted.ID}, bson.M{"$set": bson.M{"dtime": months[2] * 1000}}); err != nil {
+		t.Fatal(err)
+	}
+
+	window := fmt.Sprintf("time_min=%d&time_max=%d&page_size=100", months[0], monthStart.Unix()-1)
+	for _, include := range []bool{false, true} {
+		query := window
+		if include {
+			query += "&include_deleted_boxes=true"
+		}
+		t.Run(fmt.Sprintf("include_deleted_boxes=%v", include), func(t *testing.T) {
+			var page struct {
+				Data []domain.Record `json:"data"`
+			}
+			if err := call(http.MethodGet, baseURL+"/api/groups/"+group.ID+"/records?"+query, token, nil, http.StatusOK, &page); err != nil {
+				t.Fatal("records:", err)
+			}
+			counts := map[string]int{}
+			for _, record := range page.Data {
+				boxID, _ := record["box_id"].(string)
+				counts[boxID]++
+				if flagged, _ := record["box_deleted"].(bool); flagged != (boxID == deleted.ID) {
+					t.Errorf("record of box %s flagged deleted: %v", boxID, flagged)
+				}
+			}
+			want := map[string]int{boxes["live"].ID: 6}
+			if include {
+				want[deleted.ID] = 4
+			}
+			if !reflect.DeepEqual(counts, want) {
+				t.Errorf("records per box %v, want %v", counts, want)
+			}
+
+			var nested struct {
+				Data []domain.BoxRecords `json:"data"`
+			}
+			if err := call(http.MethodGet, baseURL+"/api/groups/"+group.ID+"/records?group_by=box&"+query, token, nil, http.StatusOK, &nested); err != nil {
+				t.Fatal("records per box:", err)
+			}
+			for _, entry := range nested.Data {
+				if entry.Deleted != (entry.BoxID == deleted.ID) {
+					t.Errorf("box %s nested with deleted %v", entry.BoxID, entry.Deleted)
+				}
+			}
+			if len(nested.Data) != len(want) {
+				t.Errorf("%d boxes nested, want %d", len(nested.Data), len(want))
+			}
+
+			reportQuery := ""
+			if include {
+				reportQuery = "&include_deleted_boxes=true"
+			}
+			var reports []domain.Report
+			if err := call(http.MethodGet, baseURL+"/api/zones/reports?group="+group.ID+"&metrics=WAU"+reportQuery, token, nil, http.StatusOK, &reports); err != nil {
+				t.Fatal("report:", err)
+			}
+			entries := map[string]int{}
+			for _, report := range reports {
+				entries[report.BoxID]++
+				if report.BoxDeleted != (report.BoxID == deleted.ID) {
+					t.Errorf("report of box %s flagged deleted: %v", report.BoxID, report.BoxDeleted)
+				}
+			}
+			want = map[string]int{boxes["live"].ID: 3}
+			if include {
+				want[deleted.ID] = 2
+			}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("monthly reports per box %v, want %v", entries, want)
+			}
+		})
+	}
+}
+
+// testHistoryCaching reads the records and reports of the last day, which are sent no-cache, and of
+// a closed period, which the signed in monitor may cache privately
+func testHistoryCaching(t *testing.T, baseURL, token string, cfg *config.Config, seed *seeded) {
+	if cfg.Server.HistoryCacheMaxAge <= 0 {
+		t.Skip("HISTORY_CACHE_MAX_AGE disables caching")
+	}
+	closed := seed.latest - int64(cfg.Server.HistoryClosedAfter.Seconds()) - 3600
+	ranges := map[string]string{
+		"no-cache": fmt.Sprintf("time_min=%d&time_max=%d", seed.latest-24*3600, seed.latest),
+		fmt.Sprintf("private, max-age=%d", int64(cfg.Server.HistoryCacheMaxAge.Seconds())): fmt.Sprintf("time_min=%d&time_max=%d", closed-24*3600, closed),
+	}
+	for want, query := range ranges {
+		for _, path := range []string{"/api/boxes/" + seed.box.ID + "/records", "/api/groups/" + seed.group.ID + "/records", "/api/boxes/" + seed.box.ID + "/reports"} {
+			req, err := http.NewRequest(http.MethodGet, baseURL+path+"?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET %s?%s answered %d", path, query, resp.StatusCode)
+				continue
+			}
+			if got := resp.Header.Get("Cache-Control"); got != want {
+				t.Errorf("GET %s?%s: Cache-Control %q, want %q", path, query, got, want)
+			}
+		}
+	}
+}
+
+// testMoveGroup moves a group to another zone: its boxes follow, and a monitor reading the group
+// keeps reading it, its boxes and their records, now under the new zone
+func testMoveGroup(t *testing.T, baseURL, adminToken string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+	userRepo := mongodb.NewUserRepository(db.Database)
+
+	target := domain.NewZone(domain.CreateZoneParams{Name: "Route test move target", Code: "ROUTETEST-MOVE"})
+	if err := zoneRepo.CreateZone(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test moved", ZoneID: seed.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	box, err := seedBox(ctx, zoneRepo, sensorRepo, group, "routetest-moved", seed.latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := domain.NewUser(domain.CreateUserParams{Username: "routetest-mover", FullName: "Route test mover", Role: domain.RoleMonitor, Groups: []string{group.ID}})
+	if err := userRepo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePassword(ctx, userRepo, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	monitorToken, err := login(baseURL, "routetest-mover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reads := func(t *testing.T) {
+		t.Helper()
+		day := fmt.Sprintf("time_min=%d&time_max=%d", seed.latest-24*3600, seed.latest)
+		for _, path := range []string{"/api/groups/" + group.ID, "/api/boxes/" + box.ID, "/api/boxes/" + box.ID + "/records?" + day, "/api/groups/" + group.ID + "/records?" + day} {
+			if err := call(http.MethodGet, baseURL+path, monitorToken, nil, http.StatusOK, nil); err != nil {
+				t.Errorf("GET %s: %v", path, err)
+			}
+		}
+	}
+	reads(t)
+
+	if err := call(http.MethodPut, baseURL+"/api/groups/"+group.ID, adminToken, map[string]string{"zone_id": "routetest-unknown"}, http.StatusBadRequest, nil); err != nil {
+		t.Error("move to an unknown zone:", err)
+	}
+	if err := call(http.MethodPut, baseURL+"/api/groups/"+group.ID, adminToken, map[string]string{"zone_id": target.ID}, http.StatusOK, nil); err != nil {
+		t.Fatal("move:", err)
+	}
+
+	moved, err := zoneRepo.GetGroup(ctx, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ZoneID != target.ID {
+		t.Errorf("group in zone %s, want %s", moved.ZoneID, target.ID)
+	}
+	stored, err := zoneRepo.GetBox(ctx, box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ZoneID != target.ID {
+		t.Errorf("box in zone %s, want %s", stored.ZoneID, target.ID)
+	}
+
+	reads(t)
+	var tree []domain.TreeZone
+	if err := call(http.MethodGet, baseURL+"/api/tree", monitorToken, nil, http.StatusOK, &tree); err != nil {
+		t.Fatal("tree:", err)
+	}
+	if len(tree) != 1 || tree[0].ID != target.ID || len(tree[0].Groups) != 1 || tree[0].Groups[0].ID != group.ID {
+		t.Errorf("monitor tree %+v, want the group under %s only", tree, target.ID)
+	}
+}
+
+// testMetricRename renames the code of metrics boxes report or refer to, which is refused and
+// leaves the metric and the boxes as they were, and of a metric no box uses, which goes through
+func testMetricRename(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	metrics := map[string]*domain.Metric{}
+	for _, code := range []string{"RENAME-REPORTED", "RENAME-REFERRED", "RENAME-UNUSED"} {
+		metrics[code] = domain.NewMetric(domain.CreateMetricParams{Code: code, Name: code, Unit: "m"})
+		if err := sensorRepo.CreateMetric(ctx, metrics[code]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	referred := "RENAME-REFERRED"
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box routetest-rename",
+		GroupID:  seed.group.ID,
+		ZoneID:   seed.group.ZoneID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: "routetest-rename",
+		Metrics:  []domain.BoxMetric{{Code: "RENAME-REPORTED"}, {Code: "LEVEL", Metric: &referred}},
+	})
+	if err := zoneRepo.CreateBox(ctx, box); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code   string
+		status int
+	}{
+		{code: "RENAME-REPORTED", status: http.StatusConflict},
+		{code: "RENAME-REFERRED", status: http.StatusConflict},
+		{code: "RENAME-UNUSED", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			rename := map[string]string{"code": tt.code + "-NEW"}
+			if err := call(http.MethodPut, baseURL+"/api/metrics/"+metrics[tt.code].ID, token, rename, tt.status, nil); err != nil {
+				t.Fatal(err)
+			}
+			var metric domain.Metric
+			if err := call(http.MethodGet, baseURL+"/api/metrics/"+metrics[tt.code].ID, token, nil, http.StatusOK, &metric); err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.code; tt.status != http.StatusOK && metric.Code != want {
+				t.Errorf("metric code %s after a refused rename, want %s", metric.Code, want)
+			}
+			if want := tt.code + "-NEW"; tt.status == http.StatusOK && metric.Code != want {
+				t.Errorf("metric code %s, want %s", metric.Code, want)
+			}
+		})
+	}
+
+	stored, err := zoneRepo.GetBox(ctx, box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Metrics, box.Metrics) {
+		t.Errorf("box metrics %+v, want %+v", stored.Metrics, box.Metrics)
+	}
+	for _, bm := range stored.Metrics {
+		code := bm.Code
+		if bm.Metric != nil {
+			code = *bm.Metric
+		}
+		if _, err := sensorRepo.GetMetric(ctx, bson.M{"code": code}); err != nil {
+			t.Errorf("box metric %s refers to no metric: %v", code, err)
+		}
+	}
+}
+
+// testOversizedZoneDetail saves a zone detail over the limit, which is refused, and lists a zone
+// stored with one before the limit: the list drops its detail unless asked for it, and the
+// oversized report counts the zone
+func testOversizedZoneDetail(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	detail := strings.Repeat("x", domain.MaxZoneDetailSize)
+	create := domain.CreateZoneParams{Name: "Route test oversized", Code: "ROUTETEST-OVERSIZED", Detail: detail}
+	if err := call(http.MethodPost, baseURL+"/api/zones", token, create, http.StatusRequestEntityTooLarge, nil); err != nil {
+		t.Error("create:", err)
+	}
+	if err := call(http.MethodPut, baseURL+"/api/zones/"+seed.zone.ID, token, map[string]string{"detail": detail}, http.StatusRequestEntityTooLarge, nil); err != nil {
+		t.Error("update:", err)
+	}
+
+	legacy := domain.NewZone(domain.CreateZoneParams{Name: "Route test legacy detail", Code: "ROUTETEST-LEGACY", Detail: detail})
+	if err := mongodb.NewZoneRepository(db.Database).CreateZone(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(query string) (map[string]interface{}, int) {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/api/zones?page_size=100"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			t.Fatalf("%s: %s", err, truncate(data))
+		}
+		for _, zone := range page.Data {
+			if zone["id"] == legacy.ID {
+				return zone, len(data)
+			}
+		}
+		t.Fatalf("zone %s not listed", legacy.ID)
+		return nil, 0
+	}
+	zone, size := list("")
+	if _, ok := zone["detail"]; ok || size > domain.MaxZoneDetailSize {
+		t.Errorf("list answered %d bytes, detail listed: %v", size, ok)
+	}
+	zone, size = list("&fields=detail")
+	if zone["detail"] != detail || size <= domain.MaxZoneDetailSize {
+		t.Errorf("list with fields=detail answered %d bytes without the detail", size)
+	}
+
+	var report struct {
+		Limit int                          `json:"limit"`
+		Zones []domain.OversizedZoneDetail `json:"zones"`
+	}
+	if err := call(http.MethodGet, baseURL+"/api/zones/oversized-details", token, nil, http.StatusOK, &report); err != nil {
+		t.Fatal("report:", err)
+	}
+	want := []domain.OversizedZoneDetail{{ID: legacy.ID, Code: legacy.Code, Name: legacy.Name, DetailSize: domain.MaxZoneDetailSize + 2}}
+	if report.Limit != domain.MaxZoneDetailSize || !reflect.DeepEqual(report.Zones, want) {
+		t.Errorf("report %+v, want %+v", report, want)
+	}
+}
+
+// testEmptyDatabase serves the API from a database holding only an admin: every list answers []
+// rather than null, and so do the records, logs and reports of a box without any
+func testEmptyDatabase(t *testing.T, cfg *config.Config) {
+	empty := *cfg
+	empty.Database.Name = cfg.Database.Name + "_empty"
+	db, err := database.NewMongoDB(&empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if err := db.Database.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	userRepo := mongodb.NewUserRepository(db.Database)
+	user := domain.NewUser(domain.CreateUserParams{Username: "routetest-admin", FullName: "Route test admin", Role: domain.RoleAdmin})
+	if err := userRepo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePassword(ctx, userRepo, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	router, shutdown := server.New(&empty, db)
+	defer shutdown(ctx)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	token, err := login(srv.URL, "routetest-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lists := []testCase{
+		{name: "zones", path: "/api/zones", shape: &emptyPage},
+		{name: "boxes", path: "/api/boxes", shape: &emptyPage},
+		{name: "metrics", path: "/api/metrics", shape: &emptyPage},
+		{name: "settings", path: "/api/settings", shape: &emptyPage},
+		{name: "maintenance windows", path: "/api/maintenance", shape: &emptyPage},
+		{name: "alerts", path: "/api/alerts", shape: &emptyPage},
+		{name: "exports", path: "/api/admin/exports", shape: &emptyPage},
+		{name: "api keys", path: "/api/admin/api-keys", shape: &emptyItems},
+		{name: "navigation tree", path: "/api/tree", shape: &emptyArray},
+		{name: "invalid locations", path: "/api/zones/invalid-locations", shape: &emptyItems},
+		{name: "invalid group maps", path: "/api/zones/invalid-group-maps", shape: &emptyItems},
+		{name: "boxes outside their group's zone", path: "/api/zones/box-zone-mismatches", shape: &emptyItems},
+	}
+	for _, tc := range lists {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.as, tc.method, tc.status = admin, http.MethodGet, http.StatusOK
+			if err := check(srv.URL, token, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	zone := domain.NewZone(domain.CreateZoneParams{Name: "Route test empty", Code: "ROUTETEST-EMPTY"})
+	if err := zoneRepo.CreateZone(ctx, zone); err != nil {
+		t.Fatal(err)
+	}
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test empty", ZoneID: zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box routetest-empty",
+		GroupID:  group.ID,
+		ZoneID:   zone.ID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: "routetest-empty",
+		Metrics:  []domain.BoxMetric{{Code: "WAU"}},
+	})
+	if err := zoneRepo.CreateBox(ctx, box); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	day := fmt.Sprintf("time_min=%d&time_max=%d", now-24*3600, now)
+	records := []testCase{
+		{name: "box records", path: "/api/boxes/" + box.ID + "/records?" + day, shape: &emptyPage},
+		{name: "group records", path: "/api/groups/" + group.ID + "/records?" + day, shape: &emptyPage},
+		{name: "group records nested per box", path: "/api/groups/" + group.ID + "/records?group_by=box&" + day, shape: &emptyPage},
+		{name: "latest group records", path: "/api/groups/" + group.ID + "/records/latest", shape: &emptyPage},
+		{name: "box logs", path: "/api/boxes/" + box.ID + "/logs", shape: &emptyPage},
+		{name: "box observations", path: "/api/boxes/" + box.ID + "/observations", shape: &emptyPage},
+		{name: "box calibrations", path: "/api/boxes/" + box.ID + "/calibrations", shape: &emptyItems},
+		{name: "record corrections", path: "/api/boxes/" + box.ID + "/corrections", shape: &emptyArray},
+		{name: "box report", path: "/api/boxes/" + box.ID + "/reports?" + day, shape: &emptyArray},
+	}
+	for _, tc := range records {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.as, tc.method, tc.status = admin, http.MethodGet, http.StatusOK
+			if err := check(srv.URL, token, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// testUnknownIDs sends every update and delete to an ID that does not exist: each answers 404
+// rather than succeeding without a match or failing with 500
+func testUnknownIDs(t *testing.T, baseURL, token string, seed *seeded) {
+	const unknown = "routetest-unknown"
+	box := "/api/boxes/" + seed.box.ID
+	rename := map[string]string{"name": "Renamed"}
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{method: http.MethodPut, path: "/api/zones/" + unknown, body: rename},
+		{method: http.MethodPut, path: "/api/groups/" + unknown, body: rename},
+		{method: http.MethodDelete, path: "/api/groups/" + unknown},
+		{method: http.MethodPut, path: "/api/groups/" + unknown + "/archive"},
+		{method: http.MethodPut, path: "/api/groups/" + unknown + "/unarchive"},
+		{method: http.MethodDelete, path: "/api/groups/" + unknown + "/export-template"},
+		{method: http.MethodPut, path: "/api/boxes/" + unknown, body: rename},
+		{method: http.MethodDelete, path: "/api/boxes/" + unknown},
+		{method: http.MethodPut, path: "/api/boxes/" + unknown + "/decommission"},
+		{method: http.MethodDelete, path: "/api/boxes/" + unknown + "/decommission"},
+		{method: http.MethodPut, path: box + "/logs/" + unknown, body: map[string]string{"text": "Renamed"}},
+		{method: http.MethodDelete, path: box + "/logs/" + unknown},
+		{method: http.MethodPut, path: box + "/observations/" + unknown, body: map[string]string{"note": "Renamed"}},
+		{method: http.MethodDelete, path: box + "/observations/" + unknown},
+		{method: http.MethodPut, path: box + "/calibrations/" + unknown, body: map[string]string{"note": "Renamed"}},
+		{method: http.MethodDelete, path: box + "/calibrations/" + unknown},
+		{method: http.MethodPut, path: "/api/metrics/" + unknown, body: rename},
+		{method: http.MethodDelete, path: "/api/metrics/" + unknown},
+		{method: http.MethodPut, path: "/api/maintenance/" + unknown, body: map[string]string{"reason": "Renamed"}},
+		{method: http.MethodDelete, path: "/api/maintenance/" + unknown},
+		{method: http.MethodPut, path: "/api/settings/" + unknown, body: map[string]int{"value": 1}},
+		{method: http.MethodDelete, path: "/api/settings/" + unknown},
+		{method: http.MethodPut, path: "/api/users/" + unknown, body: map[string]string{"full_name": "Renamed"}},
+		{method: http.MethodPut, path: "/api/users/" + unknown + "/password", body: map[string]string{"password": "Routetest-Passw0rd!"}},
+		{method: http.MethodDelete, path: "/api/users/" + unknown},
+		{method: http.MethodDelete, path: "/api/users/" + unknown + "/2fa"},
+		{method: http.MethodDelete, path: "/api/admin/api-keys/" + unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if err := call(tt.method, baseURL+tt.path, token, tt.body, http.StatusNotFound, nil); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// testRollupReports reads the daily reports of a box from its raw records, backfills its rollups,
+// and reads them again: the days served from the rollups match the raw ones, partial days
+// at the ends of the range included
+func testRollupReports(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+	rollupRepo := mongodb.NewRollupRepository(db.Database)
+
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test rollups", ZoneID: seed.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	box, err := seedBox(ctx, zoneRepo, sensorRepo, group, "routetest-rollups", seed.latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := domain.RollupDayStart(seed.latest)
+	var records []domain.Record
+	for day := int64(2); day <= 6; day++ {
+		start := today - day*domain.RollupDaySeconds
+		for i := int64(0); i < 24*6; i++ {
+			timestamp := start + i*seedInterval
+			records = append(records, domain.Record{
+				"_id": timestamp,
+				"c":   timestamp * 1000,
+				"WAU": 18 + float64((i*7+day)%23)/3,
+				"DR":  float64((i*5)%11) / 7,
+			})
+		}
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/api/boxes/%s/reports?time_min=%d&time_max=%d", baseURL, box.ID, today-6*domain.RollupDaySeconds+3*3600, seed.latest)
+	var raw []domain.DailyReport
+	if err := call(http.MethodGet, url, token, nil, http.StatusOK, &raw); err != nil {
+		t.Fatal("raw:", err)
+	}
+
+	var job domain.Job
+	if err := call(http.MethodPost, baseURL+"/api/rollups/backfill", token, domain.RollupBackfillParams{BoxID: box.ID}, http.StatusAccepted, &job); err != nil {
+		t.Fatal("backfill:", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Status == domain.JobRunning && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if err := call(http.MethodGet, baseURL+"/api/jobs/"+job.ID, token, nil, http.StatusOK, &job); err != nil {
+			t.Fatal("poll:", err)
+		}
+	}
+	if job.Status != domain.JobDone {
+		t.Fatalf("backfill ended %s: %s", job.Status, job.Error)
+	}
+	rollups, err := rollupRepo.List(ctx, box.ID, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rollups) < 5 {
+		t.Fatalf("backfill wrote %d rollups, want one per past day", len(rollups))
+	}
+
+	var rolled []domain.DailyReport
+	if err := call(http.MethodGet, url, token, nil, http.StatusOK, &rolled); err != nil {
+		t.Fatal("rolled up:", err)
+	}
+	if len(rolled) != len(raw) {
+		t.Fatalf("%d days from rollups, %d from the records", len(rolled), len(raw))
+	}
+	// Both round to hundredths, so summing in another order may move a value by one step
+	const tolerance = 0.01 + 1e-9
+	for i, want := range raw {
+		got := rolled[i]
+		if got.Date != want.Date || got.Count != want.Count {
+			t.Errorf("day %d is %s with %d records, want %s with %d", i, got.Date, got.Count, want.Date, want.Count)
+			continue
+		}
+		for name, values := range map[string][2]map[string]float64{"avg": {got.Avg, want.Avg}, "min": {got.Min, want.Min}, "max": {got.Max, want.Max}} {
+			if len(values[0]) != len(values[1]) {
+				t.Errorf("%s %s %v, want %v", want.Date, name, values[0], values[1])
+				continue
+			}
+			for metric, value := range values[1] {
+				if math.Abs(values[0][metric]-value) > tolerance {
+					t.Errorf("%s %s of %s = %v, want %v", want.Date, name, metric, values[0][metric], value)
+				}
+			}
+		}
+	}
+}
+
+// testCachedReport reads the monthly report of a group with records in closed months twice: the
+// one served from the cache is the same as the one computed from the records
+func testCachedReport(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test report cache", ZoneID: seed.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	box, err := seedBox(ctx, zoneRepo, sensorRepo, group, "routetest-report-cache", seed.latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monthStart := time.Unix(domain.MonthStart(time.Now()), 0).UTC()
+	var records []domain.Record
+	for months := 1; months <= 3; months++ {
+		start := monthStart.AddDate(0, -months, 0).Unix()
+		for day := int64(0); day < 5; day++ {
+			timestamp := start + day*86400
+			records = append(records, domain.Record{"_id": timestamp, "c": timestamp * 1000, "WAU": 10.0 + float64(months), "DR": 0.25 * float64(day)})
+		}
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("%s/api/zones/reports?group=%s&metrics=WAU,DR", baseURL, group.ID)
+	fresh, status, err := readReport(url+"&refresh=true", token)
+	if err != nil {
+		t.Fatal("fresh:", err)
+	}
+	if status != domain.ReportCacheMiss {
+		t.Errorf("fresh report answered cache %q, want %q", status, domain.ReportCacheMiss)
+	}
+	if len(fresh) != 8 {
+		t.Errorf("fresh report has %d entries, want WAU and DR of 4 months", len(fresh))
+	}
+
+	cached, status, err := readReport(url, token)
+	if err != nil {
+		t.Fatal("cached:", err)
+	}
+	if status != domain.ReportCacheHit {
+		t.Errorf("second report answered cache %q, want %q", status, domain.ReportCacheHit)
+	}
+	if !reflect.DeepEqual(cached, fresh) {
+		t.Errorf("cached report %+v, want %+v", cached, fresh)
+	}
+}
+
+// readReport reads a group report with the cache status it was served with
+func readReport(url, token string) ([]domain.Report, domain.ReportCacheStatus, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("answered %d: %s", resp.StatusCode, truncate(data))
+	}
+	var reports []domain.Report
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, "", err
+	}
+	return reports, domain.ReportCacheStatus(resp.Header.Get("X-Report-Cache")), nil
+}
+
+// testResolveMixedIDs resolves known, unknown and restricted IDs of every kind in one request:
+// only the known ones the caller may read come back, the rest are left out without failing
+func testResolveMixedIDs(t *testing.T, baseURL string, tokens map[string]string, seed *seeded) {
+	params := domain.ResolveParams{
+		Boxes:  []string{seed.box.ID, "routetest-unknown-box", seed.otherBox.ID},
+		Groups: []string{seed.group.ID, "routetest-unknown-group", seed.otherGroup.ID},
+		Zones:  []string{seed.zone.ID, "routetest-unknown-zone"},
+		Users:  []string{seed.monitorUser.ID, "routetest-unknown-user"},
+	}
+	tests := []struct {
+		as     string
+		boxes  []string
+		groups []string
+	}{
+		{as: admin, boxes: []string{seed.box.ID, seed.otherBox.ID}, groups: []string{seed.group.ID, seed.otherGroup.ID}},
+		{as: monitor, boxes: []string{seed.box.ID}, groups: []string{seed.group.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.as, func(t *testing.T) {
+			var result domain.ResolveResult
+			if err := call(http.MethodPost, baseURL+"/api/resolve", tokens[tt.as], params, http.StatusOK, &result); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string][]string{
+				"boxes":  tt.boxes,
+				"groups": tt.groups,
+				"zones":  {seed.zone.ID},
+				"users":  {seed.monitorUser.ID},
+			}
+			got := map[string][]string{"boxes": nil, "groups": nil, "zones": nil, "users": nil}
+			for id := range result.Boxes {
+				got["boxes"] = append(got["boxes"], id)
+			}
+			for id := range result.Groups {
+				got["groups"] = append(got["groups"], id)
+			}
+			for id := range result.Zones {
+				got["zones"] = append(got["zones"], id)
+			}
+			for id := range result.Users {
+				got["users"] = append(got["users"], id)
+			}
+			for kind, ids := range want {
+				sort.Strings(ids)
+				sort.Strings(got[kind])
+				if !reflect.DeepEqual(got[kind], ids) {
+					t.Errorf("%s resolved %v, want %v", kind, got[kind], ids)
+				}
+			}
+			if box := result.Boxes[seed.box.ID]; box.Name != seed.box.Name || box.GroupID != seed.group.ID {
+				t.Errorf("box resolved to %+v", box)
+			}
+			if zone := result.Zones[seed.zone.ID]; zone.Code != seed.zone.Code {
+				t.Errorf("zone resolved to %+v", zone)
+			}
+		})
+	}
+
+	tooMany := domain.ResolveParams{Boxes: make([]string, domain.MaxResolveIDs+1)}
+	for i := range tooMany.Boxes {
+		tooMany.Boxes[i] = fmt.Sprintf("routetest-box-%d", i)
+	}
+	if err := call(http.MethodPost, baseURL+"/api/resolve", tokens[admin], tooMany, http.StatusBadRequest, nil); err != nil {
+		t.Error("over the cap:", err)
+	}
+}
+
+// testExportCap seeds a box with 20000 records and serves the API with a cap of 10000 exported
+// rows: exporting all of them answers 413 with the estimated size, a narrower range the file
+func testExportCap(t *testing.T, cfg *config.Config, db *database.MongoDB, seed *seeded, adminToken string) {
+	const records, maxRows = 20000, 10000
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test export cap", Code: "RT-EXPORT", ZoneID: seed.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	box, err := seedBox(ctx, zoneRepo, sensorRepo, group, "routetest-export-cap", seed.latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := seed.latest - (records-1)*seedInterval
+	batch := make([]domain.Record, 0, records-seedRecords)
+	for timestamp := first; timestamp <= seed.latest-seedRecords*seedInterval; timestamp += seedInterval {
+		batch = append(batch, domain.Record{"_id": timestamp, "c": timestamp * 1000, "WAU": 20.0, "DR": 0.5})
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	capped := *cfg
+	capped.Export.MaxRows = maxRows
+	router, shutdown := server.New(&capped, db)
+	defer shutdown(ctx)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	all := fmt.Sprintf("time_min=%d&time_max=%d", first, seed.latest)
+	day := fmt.Sprintf("time_min=%d&time_max=%d", seed.latest-24*3600, seed.latest)
+	tests := []struct {
+		name   string
+		path   string
+		rows   int64 // estimated, 0 when the export is served
+		bytes  int64
+		status int
+		file   string // start of the served file's name
+	}{
+		{"box over the cap", "/api/boxes/" + box.ID + "/records/export?" + all, records, records * domain.ExportXLSXRowBytes, http.StatusRequestEntityTooLarge, ""},
+		{"box within the cap", "/api/boxes/" + box.ID + "/records/export?" + day, 0, 0, http.StatusOK, "records_" + box.ID + "_"},
+		// One row per record and metric
+		{"group over the cap", "/api/groups/" + group.ID + "/records/export?format=csv_long&" + all, 2 * records, 2 * records * domain.ExportCSVRowBytes, http.StatusRequestEntityTooLarge, ""},
+		{"group within the cap", "/api/groups/" + group.ID + "/records/export?format=csv_long&" + day, 0, 0, http.StatusOK, "records_" + group.Code + "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("answered %d, want %d: %s", resp.StatusCode, tt.status, truncate(data))
+			}
+			if tt.status != http.StatusRequestEntityTooLarge {
+				if disposition := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment; filename="+tt.file) {
+					t.Errorf("served as %q, want a file named %s...", disposition, tt.file)
+				}
+				return
+			}
+
+			var body struct {
+				EstimatedRows  int64 `json:"estimated_rows"`
+				EstimatedBytes int64 `json:"estimated_bytes"`
+				MaxRows        int64 `json:"max_rows"`
+			}
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.EstimatedRows != tt.rows || body.EstimatedBytes != tt.bytes || body.MaxRows != maxRows {
+				t.Errorf("got %+v, want %d rows, %d bytes, max %d", body, tt.rows, tt.bytes, maxRows)
+			}
+		})
+	}
+}
+
+// testMonitorRedaction gives the monitor's group a subdomain and an engineering note, then reads
+// every endpoint returning groups, boxes or their records as the monitor: device_id, subdomain
+// and the engineering fields of the note never appear, while the admin reads them
+func testMonitorRedaction(t *testing.T, baseURL, adminToken, monitorToken string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	note := bson.M{"level": "II", "area": "12.5", "water_rise_normal": "40"}
+	if _, err := db.Database.Collection("groups").UpdateOne(ctx, bson.M{"_id": seed.group.ID}, bson.M{"$set": bson.M{"subdomain": "routetest-redacted", "note": note}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The note keeps its general description only
+	engineering := map[string]bool{}
+	noteType := reflect.TypeOf(domain.NoteGroup{})
+	for i := 0; i < noteType.NumField(); i++ {
+		name := strings.Split(noteType.Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "mission", "region", "city", "level":
+		default:
+			engineering[name] = true
+		}
+	}
+
+	records := fmt.Sprintf("time_min=%d&time_max=%d", seed.latest-seedRecords*seedInterval, seed.latest)
+	endpoints := []struct {
+		path string
+		// hidden lists the hidden fields an admin reads there, so the check cannot pass on data
+		// that never held them
+		hidden []string
+	}{
+		{"/api/zones/" + seed.zone.ID + "/groups", []string{"device_id", "subdomain", "area"}},
+		{"/api/zones/" + seed.zone.ID + "/groups?include_boxes=true", []string{"device_id", "subdomain", "area"}},
+		{"/api/zones/" + seed.zone.ID + "/groups?include_boxes=false&page=1", []string{"subdomain", "area"}},
+		{"/api/groups/" + seed.group.ID, []string{"device_id", "subdomain", "area"}},
+		{"/api/groups/" + seed.group.ID + "/boxes", []string{"device_id"}},
+		{"/api/groups/" + seed.group.ID + "/records?" + records, []string{"device_id"}},
+		{"/api/groups/" + seed.group.ID + "/records?group_by=box&" + records, nil},
+		{"/api/groups/" + seed.group.ID + "/records/latest", []string{"device_id"}},
+		{"/api/boxes", []string{"device_id"}},
+		{"/api/boxes/" + seed.box.ID, []string{"device_id"}},
+		{"/api/sync", []string{"device_id", "subdomain", "area"}},
+		{"/api/tree", nil},
+	}
+	for _, endpoint := range endpoints {
+		var asAdmin, asMonitor interface{}
+		if err := call(http.MethodGet, baseURL+endpoint.path, adminToken, nil, http.StatusOK, &asAdmin); err != nil {
+			t.Errorf("%s as admin: %v", endpoint.path, err)
+			continue
+		}
+		if err := call(http.MethodGet, baseURL+endpoint.path, monitorToken, nil, http.StatusOK, &asMonitor); err != nil {
+			t.Errorf("%s as monitor: %v", endpoint.path, err)
+			continue
+		}
+
+		found := redactedFields(asAdmin, engineering, false)
+		for _, field := range endpoint.hidden {
+			if !found[field] {
+				t.Errorf("%s as admin has no %s", endpoint.path, field)
+			}
+		}
+		for field := range redactedFields(asMonitor, engineering, false) {
+			t.Errorf("%s as monitor has %s", endpoint.path, field)
+		}
+	}
+
+	testTemplateRedaction(t, baseURL, adminToken, monitorToken, seed, records)
+}
+
+// redactedFields returns the hidden fields found in a decoded JSON value: device_id and subdomain
+// anywhere, and the engineering fields of a note
+func redactedFields(value interface{}, engineering map[string]bool, inNote bool) map[string]bool {
+	found := map[string]bool{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if key == "device_id" || key == "subdomain" || inNote && engineering[key] {
+				if child != nil && child != "" {
+					found[key] = true
+				}
+			}
+			for field := range redactedFields(child, engineering, key == "note") {
+				found[field] = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			for field := range redactedFields(child, engineering, false) {
+				found[field] = true
+			}
+		}
+	}
+	return found
+}
+
+// testTemplateRedaction exports the group through a template with a device_id column: its cells are
+// filled for the admin and left empty for the monitor
+func testTemplateRedaction(t *testing.T, baseURL, adminToken, monitorToken string, seed *seeded, records string) {
+	f := excelize.NewFile()
+	for i, key := range []string{"timestamp", "device_id", "box_name"} {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue("Sheet1", cell, key)
+	}
+	if err := f.SetDefinedName(&excelize.DefinedName{Name: domain.TemplateRecordsName, RefersTo: "Sheet1!$A$1:$C$1"}); err != nil {
+		t.Fatal(err)
+	}
+	var template bytes.Buffer
+	if err := f.Write(&template); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "redaction.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(template.Bytes())
+	form.Close()
+	req, err := http.NewRequest(http.MethodPut, baseURL+"/api/groups/"+seed.group.ID+"/export-template", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("template upload answered %d", resp.StatusCode)
+	}
+	defer call(http.MethodDelete, baseURL+"/api/groups/"+seed.group.ID+"/export-template", adminToken, nil, http.StatusOK, nil)
+
+	for _, tc := range []struct {
+		as     string
+		token  string
+		filled bool
+	}{{admin, adminToken, true}, {monitor, monitorToken, false}} {
+		req, err := http.NewRequest(http.MethodGet, baseURL+"/api/groups/"+seed.group.ID+"/records/export?format=template&"+records, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("template export as %s answered %d: %s", tc.as, resp.StatusCode, truncate(data))
+			continue
+		}
+
+		exported, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := exported.GetRows("Sheet1")
+		exported.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) == 0 {
+			t.Errorf("template export as %s has no rows", tc.as)
+			continue
+		}
+		for i, row := range rows {
+			deviceID := ""
+			if len(row) > 1 {
+				deviceID = row[1]
+			}
+			if filled := deviceID != ""; filled != tc.filled {
+				t.Errorf("template export as %s: row %d has device_id %q", tc.as, i+1, deviceID)
+				break
+			}
+		}
+	}
+}
+
+// testRecreateDeleted creates a zone, a box and a metric again with the code or device ID of a
+// deleted one, twice, while a live duplicate is still refused, by the handlers and by the
+// {code, dtime} and {device_id, dtime} unique indexes themselves
+func testRecreateDeleted(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+
+	type created struct {
+		ID string `json:"id"`
+	}
+	kinds := []struct {
+		name       string
+		collection string
+		create     string
+		body       interface{}
+		// remove soft-deletes the document; zones have no route deleting them
+		remove func(id string) error
+		key    string
+		value  string
+	}{
+		{
+			name:       "zone",
+			collection: "zone",
+			create:     "/api/zones",
+			body:       map[string]string{"name": "Recreated", "code": "ROUTETEST-RECREATE"},
+			remove: func(id string) error {
+				_, err := db.Database.Collection("zone").UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"dtime": time.Now().UnixMilli()}})
+				return err
+			},
+			key:   "code",
+			value: "ROUTETEST-RECREATE",
+		},
+		{
+			name:       "box",
+			collection: "box",
+			create:     "/api/groups/" + seed.group.ID + "/boxes",
+			body:       map[string]interface{}{"name": "Recreated", "location": map[string]float64{"lat": 16, "lng": 107}, "device_id": "routetest-recreate", "metrics": []map[string]string{{"code": seed.metric.Code}}},
+			remove: func(id string) error {
+				return call(http.MethodDelete, baseURL+"/api/boxes/"+id, token, nil, http.StatusOK, nil)
+			},
+			key:   "device_id",
+			value: "routetest-recreate",
+		},
+		{
+			name:       "metric",
+			collection: "metric",
+			create:     "/api/metrics",
+			body:       map[string]string{"code": "ROUTETEST-RECREATE", "name": "Recreated", "unit": "m"},
+			remove: func(id string) error {
+				return call(http.MethodDelete, baseURL+"/api/metrics/"+id, token, nil, http.StatusOK, nil)
+			},
+			key:   "code",
+			value: "ROUTETEST-RECREATE",
+		},
+	}
+
+	for _, kind := range kinds {
+		t.Run(kind.name, func(t *testing.T) {
+			for round := 0; round < 2; round++ {
+				var doc created
+				if err := call(http.MethodPost, baseURL+kind.create, token, kind.body, http.StatusCreated, &doc); err != nil {
+					t.Fatalf("create, round %d: %v", round, err)
+				}
+				if err := call(http.MethodPost, baseURL+kind.create, token, kind.body, http.StatusConflict, nil); err != nil {
+					t.Errorf("live duplicate, round %d: %v", round, err)
+				}
+				duplicate := bson.M{"_id": primitive.NewObjectID().Hex(), kind.key: kind.value}
+				if _, err := db.Database.Collection(kind.collection).InsertOne(ctx, duplicate); !mongo.IsDuplicateKeyError(err) {
+					t.Errorf("live duplicate inserted past the handlers, round %d: got %v, want a duplicate key error", round, err)
+				}
+				if err := kind.remove(doc.ID); err != nil {
+					t.Fatalf("delete, round %d: %v", round, err)
+				}
+				// Deletions are stamped in milliseconds; two of them sharing one would collide
+				time.Sleep(2 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// testSessionLimits signs a monitor in over a limit of two sessions: the third login answers 409,
+// or ends the oldest session when evicting, and refreshing a session does not count as one more.
+// Concurrent logins cannot overrun the limit either.
+func testSessionLimits(t *testing.T, cfg *config.Config, db *database.MongoDB) {
+	ctx := context.Background()
+	userRepo := mongodb.NewUserRepository(db.Database)
+
+	serve := func(evict bool) (string, func()) {
+		limited := *cfg
+		limited.Auth.SessionLimitMonitor = 2
+		limited.Auth.SessionLimitEvict = evict
+		router, shutdown := server.New(&limited, db)
+		srv := httptest.NewServer(router)
+		return srv.URL, func() {
+			srv.Close()
+			shutdown(ctx)
+		}
+	}
+	newUser := func(username string) *domain.User {
+		user := domain.NewUser(domain.CreateUserParams{Username: username, FullName: "Route test sessions", Role: domain.RoleMonitor})
+		if err := userRepo.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if err := savePassword(ctx, userRepo, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	type tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	signIn := func(baseURL, username string, status int) tokens {
+		t.Helper()
+		var out tokens
+		if err := call(http.MethodPost, baseURL+"/api/auth/login", "", domain.LoginRequest{Username: username, Password: password}, status, &out); err != nil {
+			t.Fatal("login:", err)
+		}
+		return out
+	}
+	sessionCount := func(userID string) int {
+		t.Helper()
+		sessions, err := userRepo.ListActiveSessions(ctx, userID, time.Now().UnixMilli())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(sessions)
+	}
+
+	baseURL, stop := serve(false)
+	defer stop()
+	user := newUser("routetest-sessions")
+	first := signIn(baseURL, user.Username, http.StatusOK)
+	signIn(baseURL, user.Username, http.StatusOK)
+	signIn(baseURL, user.Username, http.StatusConflict)
+	if n := sessionCount(user.ID); n != 2 {
+		t.Errorf("%d sessions after a refused login, want 2", n)
+	}
+	var refreshed tokens
+	if err := call(http.MethodPost, baseURL+"/api/auth/refresh", "", map[string]string{"refresh_token": first.RefreshToken}, http.StatusOK, &refreshed); err != nil {
+		t.Fatal("refresh at the limit:", err)
+	}
+	if n := sessionCount(user.ID); n != 2 {
+		t.Errorf("%d sessions after a refresh, want 2", n)
+	}
+
+	racing := newUser("routetest-sessions-race")
+	statuses := make(chan int, 6)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			body, _ := json.Marshal(domain.LoginRequest{Username: racing.Username, Password: password})
+			resp, err := http.Post(baseURL+"/api/auth/login", "application/json", bytes.NewReader(body))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	accepted := 0
+	for i := 0; i < cap(statuses); i++ {
+		switch status := <-statuses; status {
+		case http.StatusOK:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("concurrent login answered %d", status)
+		}
+	}
+	if n := sessionCount(racing.ID); accepted != 2 || n != 2 {
+		t.Errorf("%d concurrent logins accepted and %d sessions, want 2 and 2", accepted, n)
+	}
+
+	evictURL, stopEvict := serve(true)
+	defer stopEvict()
+	evicted := newUser("routetest-sessions-evict")
+	oldest := signIn(evictURL, evicted.Username, http.StatusOK)
+	signIn(evictURL, evicted.Username, http.StatusOK)
+	signIn(evictURL, evicted.Username, http.StatusOK)
+	if n := sessionCount(evicted.ID); n != 2 {
+		t.Errorf("%d sessions after evicting, want 2", n)
+	}
+	if err := call(http.MethodPost, evictURL+"/api/auth/refresh", "", map[string]string{"refresh_token": oldest.RefreshToken}, http.StatusUnauthorized, nil); err != nil {
+		t.Error("refresh of the evicted session:", err)
+	}
+}
+
+// testQualityReport reads the quality of a box with a missing sample and values on, outside and
+// inside the bounds of its metric
+func testQualityReport(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	metric := domain.NewMetric(domain.CreateMetricParams{Code: "QTEST", Name: "QTEST", Unit: "m", Range: []domain.Range{{Min: 0, Max: 10}}})
+	if err := sensorRepo.CreateMetric(ctx, metric); err != nil {
+		t.Fatal(err)
+	}
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box routetest-quality",
+		GroupID:  seed.group.ID,
+		ZoneID:   seed.group.ZoneID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: "routetest-quality",
+		Metrics:  []domain.BoxMetric{{Code: "QTEST", Metric: &metric.ID}},
+	})
+	if err := zoneRepo.CreateBox(ctx, box); err != nil {
+		t.Fatal(err)
+	}
+	from := seed.latest - 6*seedInterval
+	values := map[int64]interface{}{0: 5.0, 1: 11.0, 2: -1.0, 3: 10.0, 5: "err", 6: int32(0)} // none at 4
+	var records []domain.Record
+	for i, value := range values {
+		records = append(records, domain.Record{"_id": from + i*seedInterval, "QTEST": value})
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var report domain.QualityReport
+	url := fmt.Sprintf("%s/api/boxes/%s/quality?time_min=%d&time_max=%d&expected_interval=%d", baseURL, box.ID, from, seed.latest, seedInterval)
+	if err := call(http.MethodGet, url, token, nil, http.StatusOK, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.ActualSamples != 6 || report.ExpectedSamples != 7 || report.DuplicateTimestamps != 0 {
+		t.Errorf("got %d of %d samples, %d duplicates; want 6 of 7 and none", report.ActualSamples, report.ExpectedSamples, report.DuplicateTimestamps)
+	}
+	if want := (domain.Gap{From: from + 3*seedInterval, To: from + 5*seedInterval, Duration: 2 * seedInterval}); report.LongestGap == nil || *report.LongestGap != want {
+		t.Errorf("longest gap %+v, want %+v", report.LongestGap, want)
+	}
+	if len(report.OutOfRange) != 1 || report.OutOfRange[0].OutOfRange != 2 {
+		t.Errorf("out of range %+v, want 11 and -1 of QTEST", report.OutOfRange)
+	}
+}
+
+// testInterruptedJobs fails the running jobs whose heartbeat stopped, and leaves those another
+// instance still runs
+func testInterruptedJobs(t *testing.T, db *database.MongoDB) {
+	ctx := context.Background()
+	jobRepo := mongodb.NewJobRepository(db.Database)
+	now := time.Now()
+
+	alive := domain.NewJob(domain.JobRebuildRollups, "routetest", nil)
+	stopped := domain.NewJob(domain.JobRebuildRollups, "routetest", nil)
+	stopped.Heartbeat = now.Add(-10 * time.Minute).UnixMilli()
+	finished := domain.NewJob(domain.JobRebuildRollups, "routetest", nil)
+	finished.Status = domain.JobDone
+	finished.Heartbeat = stopped.Heartbeat
+	for _, job := range []*domain.Job{alive, stopped, finished} {
+		if err := jobRepo.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := jobRepo.FailInterrupted(ctx, now.Add(-3*time.Minute).UnixMilli()); err != nil {
+		t.Fatal(err)
+	}
+	for job, want := range map[*domain.Job]domain.JobStatus{alive: domain.JobRunning, stopped: domain.JobFailed, finished: domain.JobDone} {
+		stored, err := jobRepo.Get(ctx, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Status != want {
+			t.Errorf("job with heartbeat %d is %s, want %s", job.Heartbeat, stored.Status, want)
+		}
+	}
+}
+
+// testMergePolicies changes the merge policy of a box between records sent seconds apart: the
+// policy applies from the next record, and to the records still queued as to the stored ones
+func testMergePolicies(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box routetest-merge",
+		GroupID:  seed.group.ID,
+		ZoneID:   seed.group.ZoneID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: "routetest-merge",
+		Metrics:  []domain.BoxMetric{{Code: "WAU"}, {Code: "DR", Manual: true}},
+	})
+	if err := mongodb.NewZoneRepository(db.Database).CreateBox(context.Background(), box); err != nil {
+		t.Fatal(err)
+	}
+	boxURL := baseURL + "/api/boxes/" + box.ID
+	at := seed.latest - 3600
+	send := func(path string, timestamp int64, metrics map[string]interface{}, status int) error {
+		return call(http.MethodPost, boxURL+path, token, domain.IngestRecord{Timestamp: &timestamp, Metrics: metrics}, status, nil)
+	}
+	policy := func(mode domain.MergeMode) error {
+		body := map[string]interface{}{"merge_policy": domain.MergePolicy{Mode: mode, Window: 60}}
+		return call(http.MethodPut, boxURL, token, body, http.StatusOK, nil)
+	}
+
+	if err := send("/records", at, map[string]interface{}{"WAU": 1.0}, http.StatusAccepted); err != nil {
+		t.Fatal("first record:", err)
+	}
+	if err := policy(domain.MergeReject); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("/records", at+30, map[string]interface{}{"WAU": 2.0}, http.StatusConflict); err != nil {
+		t.Error("record near the first, rejected:", err)
+	}
+	if err := policy(domain.MergeFields); err != nil {
+		t.Fatal(err)
+	}
+	if err := send("/records?source=manual", at+20, map[string]interface{}{"DR": 0.5}, http.StatusOK); err != nil {
+		t.Error("manual reading near the first, merged:", err)
+	}
+	if err := send("/records", at+120, map[string]interface{}{"WAU": 3.0}, http.StatusAccepted); err != nil {
+		t.Error("record outside the window:", err)
+	}
+
+	// Records are written by the queue after they were accepted
+	var page struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	url := fmt.Sprintf("%s/records?time_min=%d&time_max=%d", boxURL, at-60, at+180)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		if err := call(http.MethodGet, url, token, nil, http.StatusOK, &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Data) >= 2 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(page.Data) != 2 {
+		t.Fatalf("got %d records, want the first, merged, and the one outside the window: %v", len(page.Data), page.Data)
+	}
+	for _, record := range page.Data {
+		if record["WAU"] == 1.0 && record["DR"] != 0.5 {
+			t.Errorf("first record %v, want the manual DR merged into it", record)
+		}
+	}
+}
+
+// testDebugDisabled serves the API with the debug endpoints off: they are not mounted, even for admins
+func testDebugDisabled(t *testing.T, cfg *config.Config, db *database.MongoDB, adminToken string) {
+	disabled := *cfg
+	disabled.Server.DebugEndpoints = false
+	router, shutdown := server.New(&disabled, db)
+	defer shutdown(context.Background())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	for _, path := range []string{"/debug/stats", "/debug/pprof/heap"} {
+		if err := call(http.MethodGet, srv.URL+path, adminToken, nil, http.StatusNotFound, nil); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+// testRecordStatsFirstLast reads the stats of a box whose first value is neither its min nor its
+// max, and whose last is neither either: first and last are the earliest and latest samples
+func testRecordStatsFirstLast(t *testing.T, baseURL, token string, db *database.MongoDB, seed *seeded) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box routetest-stats",
+		GroupID:  seed.group.ID,
+		ZoneID:   seed.group.ZoneID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: "routetest-stats",
+		Metrics:  []domain.BoxMetric{{Code: "WAU"}, {Code: "DR"}},
+	})
+	if err := zoneRepo.CreateBox(ctx, box); err != nil {
+		t.Fatal(err)
+	}
+	start := seed.latest - 4*seedInterval
+	wau := []float64{5, 1, 9, 3}
+	dr := []float64{0.5, 2, 0.1, 1}
+	records := make([]domain.Record, len(wau))
+	for i := range records {
+		records[i] = domain.Record{"_id": start + int64(i)*seedInterval, "WAU": wau[i], "DR": dr[i]}
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats domain.RecordStats
+	url := fmt.Sprintf("%s/api/boxes/%s/records/stats?time_min=%d&time_max=%d&metrics=WAU,DR", baseURL, box.ID, start, seed.latest)
+	if err := call(http.MethodGet, url, token, nil, http.StatusOK, &stats); err != nil {
+		t.Fatal(err)
+	}
+	last := start + 3*seedInterval
+	want := map[string][2]domain.RecordValueAt{
+		"WAU": {{Time: start, Value: 5}, {Time: last, Value: 3}},
+		"DR":  {{Time: start, Value: 0.5}, {Time: last, Value: 1}},
+	}
+	if len(stats.Metrics) != len(want) {
+		t.Fatalf("got %d metrics, want %d", len(stats.Metrics), len(want))
+	}
+	for _, m := range stats.Metrics {
+		if m.First == nil || *m.First != want[m.Metric][0] {
+			t.Errorf("%s first = %v, want %v", m.Metric, m.First, want[m.Metric][0])
+		}
+		if m.Last == nil || *m.Last != want[m.Metric][1] {
+			t.Errorf("%s last = %v, want %v", m.Metric, m.Last, want[m.Metric][1])
+		}
+	}
+}
+
+// testZoneAccess gives a user two of three zones: the groups of both are readable and those of the
+// third are not. Clearing the zones revokes the user's tokens, and new ones read none of them.
+func testZoneAccess(t *testing.T, baseURL, adminToken string, db *database.MongoDB) {
+	ctx := context.Background()
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	userRepo := mongodb.NewUserRepository(db.Database)
+
+	groups := make([]*domain.BoxGroup, 3)
+	zoneIDs := make([]string, 3)
+	for i := range groups {
+		zone := domain.NewZone(domain.CreateZoneParams{Name: fmt.Sprintf("Zone access %d", i), Code: fmt.Sprintf("ZONEACCESS%d", i)})
+		if err := zoneRepo.CreateZone(ctx, zone); err != nil {
+			t.Fatal(err)
+		}
+		groups[i] = domain.NewBoxGroup(domain.CreateGroupParams{Name: fmt.Sprintf("Zone access %d", i), ZoneID: zone.ID})
+		if err := zoneRepo.CreateGroup(ctx, groups[i]); err != nil {
+			t.Fatal(err)
+		}
+		zoneIDs[i] = zone.ID
+	}
+	user := domain.NewUser(domain.CreateUserParams{Username: "routetest-zones", FullName: "Route test zones", Role: domain.RoleMonitor, ZoneIDs: zoneIDs[:2]})
+	if err := userRepo.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := savePassword(ctx, userRepo, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := login(baseURL, user.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusForbidden} {
+		if err := call(http.MethodGet, baseURL+"/api/groups/"+groups[i].ID, token, nil, want, nil); err != nil {
+			t.Errorf("group of zone %d: %v", i, err)
+		}
+	}
+
+	if err := call(http.MethodPut, baseURL+"/api/users/"+user.ID, adminToken, map[string]interface{}{"zone_ids": []string{}}, http.StatusOK, nil); err != nil {
+		t.Fatal("clear zones:", err)
+	}
+	stored, err := userRepo.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.ZoneIDs) != 0 {
+		t.Errorf("stored zones %v after clearing them", stored.ZoneIDs)
+	}
+	if err := call(http.MethodGet, baseURL+"/api/groups/"+groups[0].ID, token, nil, http.StatusUnauthorized, nil); err != nil {
+		t.Error("token issued before the change:", err)
+	}
+
+	if token, err = login(baseURL, user.Username); err != nil {
+		t.Fatal(err)
+	}
+	for i := range groups {
+		if err := call(http.MethodGet, baseURL+"/api/groups/"+groups[i].ID, token, nil, http.StatusForbidden, nil); err != nil {
+			t.Errorf("group of zone %d after clearing: %v", i, err)
+		}
+	}
+}
+
+// testProfileKeepsAccess has the monitor update their own profile with an admin role and the
+// restricted group: only the name changes, and the restricted group stays out of reach
+func testProfileKeepsAccess(t *testing.T, baseURL, token string, seed *seeded) {
+	body := map[string]interface{}{
+		"full_name": "Route test monitor renamed",
+		"role":      domain.RoleAdmin,
+		"groups":    []string{seed.group.ID, seed.otherGroup.ID},
+		"zone_ids":  []string{seed.zone.ID},
+	}
+	var user domain.User
+	if err := call(http.MethodPut, baseURL+"/api/auth/profile", token, body, http.StatusOK, &user); err != nil {
+		t.Fatal("update:", err)
+	}
+	if user.FullName != "Route test monitor renamed" {
+		t.Errorf("full_name %q, want it updated", user.FullName)
+	}
+
+	// The stored user, read back, not only the response
+	if err := call(http.MethodGet, baseURL+"/api/auth/profile", token, nil, http.StatusOK, &user); err != nil {
+		t.Fatal("profile:", err)
+	}
+	if user.Role != domain.RoleMonitor {
+		t.Errorf("role %q, want %q", user.Role, domain.RoleMonitor)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{seed.group.ID}) || len(user.ZoneIDs) != 0 {
+		t.Errorf("groups %v and zones %v, want only %s", user.Groups, user.ZoneIDs, seed.group.ID)
+	}
+	if err := call(http.MethodGet, baseURL+"/api/groups/"+seed.otherGroup.ID, token, nil, http.StatusForbidden, nil); err != nil {
+		t.Error("restricted group:", err)
+	}
+	if err := call(http.MethodGet, baseURL+"/api/users", token, nil, http.StatusForbidden, nil); err != nil {
+		t.Error("admin route:", err)
+	}
+}
+
+// testExportDownloadLink runs a group export job to the end and fetches its file through the
+// download link, without a session, then with a token signed for another job
+func testExportDownloadLink(t *testing.T, baseURL, token string, seed *seeded) {
+	day := fmt.Sprintf("time_min=%d&time_max=%d", seed.latest-24*3600, seed.latest)
+	var job domain.Job
+	if err := call(http.MethodPost, baseURL+"/api/groups/"+seed.group.ID+"/records/export-jobs?format=csv_long&"+day, token, nil, http.StatusAccepted, &job); err != nil {
+		t.Fatal("start:", err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for job.Status == domain.JobRunning && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		if err := call(http.MethodGet, baseURL+"/api/export-jobs/"+job.ID, token, nil, http.StatusOK, &job); err != nil {
+			t.Fatal("poll:", err)
+		}
+	}
+	if job.Status != domain.JobDone || job.DownloadURL == "" {
+		t.Fatalf("job ended %s with download_url %q: %s", job.Status, job.DownloadURL, job.Error)
+	}
+
+	link := job.DownloadURL
+	if !strings.HasPrefix(link, "http") {
+		link = baseURL + link
+	}
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal("download:", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(data), "timestamp,time,box_id") {
+		t.Fatalf("download answered %d: %s", resp.StatusCode, truncate(data))
+	}
+
+	// The token is bound to the job it was signed for
+	other := strings.Replace(link, "/export-jobs/"+job.ID+"/", "/export-jobs/other/", 1)
+	if err := call(http.MethodGet, other, "", nil, http.StatusUnauthorized, nil); err != nil {
+		t.Error("download another job:", err)
+	}
+}
+
+// call sends a request with body as JSON unless it is nil, and decodes the JSON response into out
+// unless it is nil
+func call(method, url, token string, body interface{}, status int, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("answered %d, want %d: %s", resp.StatusCode, status, truncate(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// seedData creates an admin and a monitor reading one group of a zone, a second group the monitor
+// may not read, a box with records in each, a metric and a setting
+func seedData(ctx context.Context, db *database.MongoDB) (*seeded, error) {
+	userRepo := mongodb.NewUserRepository(db.Database)
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+	settingRepo := mongodb.NewSettingRepository(db.Database)
+
+	s := &seeded{latest: time.Now().Unix() / seedInterval * seedInterval}
+
+	s.zone = domain.NewZone(domain.CreateZoneParams{Name: "Route test", Code: "ROUTETEST"})
+	if err := zoneRepo.CreateZone(ctx, s.zone); err != nil {
+		return nil, err
+	}
+	s.group = domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test", ZoneID: s.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, s.group); err != nil {
+		return nil, err
+	}
+	s.otherGroup = domain.NewBoxGroup(domain.CreateGroupParams{Name: "Route test restricted", ZoneID: s.zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, s.otherGroup); err != nil {
+		return nil, err
+	}
+
+	for _, code := range []string{"WAU", "DR"} {
+		metric := domain.NewMetric(domain.CreateMetricParams{Code: code, Name: code, Unit: "m"})
+		if err := sensorRepo.CreateMetric(ctx, metric); err != nil {
+			return nil, err
+		}
+		if s.metric == nil {
+			s.metric = metric
+		}
+	}
+
+	var err error
+	if s.box, err = seedBox(ctx, zoneRepo, sensorRepo, s.group, "routetest-1", s.latest); err != nil {
+		return nil, err
+	}
+	if s.otherBox, err = seedBox(ctx, zoneRepo, sensorRepo, s.otherGroup, "routetest-2", s.latest); err != nil {
+		return nil, err
+	}
+	if err := seedStrayRecord(ctx, sensorRepo, s.otherBox, s.latest-seedInterval/2); err != nil {
+		return nil, err
+	}
+
+	s.setting, err = settingRepo.Create(ctx, domain.CreateSettingParams{Key: "routetest.map.zoom", Value: 12.0})
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]domain.CreateUserParams{
+		admin:   {Username: "routetest-admin", FullName: "Route test admin", Role: domain.RoleAdmin},
+		monitor: {Username: "routetest-monitor", FullName: "Route test monitor", Role: domain.RoleMonitor, Groups: []string{s.group.ID}},
+	}
+	for role, params := range users {
+		user := domain.NewUser(params)
+		if err := userRepo.CreateUser(ctx, user); err != nil {
+			return nil, err
+		}
+		if err := savePassword(ctx, userRepo, user.ID); err != nil {
+			return nil, err
+		}
+		if role == monitor {
+			s.monitorUser = user
+		}
+	}
+	return s, nil
+}
+
+// seedBox creates a box of the group reporting WAU and DR, with seedRecords records up to latest
+func seedBox(ctx context.Context, zoneRepo *mongodb.ZoneRepository, sensorRepo *mongodb.SensorRepository, group *domain.BoxGroup, deviceID string, latest int64) (*domain.Box, error) {
+	box := domain.NewBox(domain.CreateBoxParams{
+		Name:     "Box " + deviceID,
+		GroupID:  group.ID,
+		ZoneID:   group.ZoneID,
+		Location: domain.Location{Lat: 16, Lng: 107},
+		DeviceID: deviceID,
+		Metrics:  []domain.BoxMetric{{Code: "WAU"}, {Code: "DR"}},
+	})
+	if err := zoneRepo.CreateBox(ctx, box); err != nil {
+		return nil, err
+	}
+
+	records := make([]domain.Record, 0, seedRecords)
+	for i := 0; i < seedRecords; i++ {
+		timestamp := latest - int64(seedRecords-1-i)*seedInterval
+		records = append(records, domain.Record{
+			"_id": timestamp,
+			"c":   timestamp * 1000,
+			"WAU": domain.RoundValue(20 + float64(i%12)*0.1),
+			"DR":  domain.RoundValue(float64(i%4) * 0.5),
+		})
+	}
+	if _, err := sensorRepo.InsertRecords(ctx, box.ID, records); err != nil {
+		return nil, err
+	}
+	return box, nil
+}
+
+// seedStrayRecord adds to the box a record holding fields of BSON types clients cannot read as
+// such, as written by old tools straight into the database
+func seedStrayRecord(ctx context.Context, sensorRepo *mongodb.SensorRepository, box *domain.Box, timestamp int64) error {
+	decimal, err := primitive.ParseDecimal128("20.25")
+	if err != nil {
+		return err
+	}
+	record := domain.Record{
+		"_id":  timestamp,
+		"c":    primitive.NewDateTimeFromTime(time.Unix(timestamp, 0)),
+		"WAU":  decimal,
+		"DR":   int32(1),
+		"ref":  primitive.NewObjectID(),
+		"blob": primitive.Binary{Data: []byte{1, 2}},
+		"op":   primitive.Timestamp{T: uint32(timestamp)},
+	}
+	_, err = sensorRepo.InsertRecords(ctx, box.ID, []domain.Record{record})
+	return err
+}
+
+// savePassword stores password as the user's password the way UserService.SetPassword does
+func savePassword(ctx context.Context, repo *mongodb.UserRepository, userID string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+	return repo.SaveUserSecret(ctx, &domain.UserSecret{UserID: userID, Name: "password", Value: string(hashed), Encode: "bcrypt"})
+}
+
+// login signs the user in through /auth/login and returns the access token
+func login(baseURL, username string) (string, error) {
+	body, err := json.Marshal(domain.LoginRequest{Username: username, Password: password})
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(baseURL+"/api/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login answered %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.AccessToken == "" {
+		return "", fmt.Errorf("login answered no access token")
+	}
+	return tokens.AccessToken, nil
+}
+
+// issueAPIKey creates an API key reading the group through /admin/api-keys and returns the key
+func issueAPIKey(baseURL, adminToken, groupID string) (string, error) {
+	body, err := json.Marshal(domain.CreateAPIKeyParams{Name: "routetest", Groups: []string{groupID}})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/api/admin/api-keys", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("creating the key answered %d", resp.StatusCode)
+	}
+
+	var created domain.CreatedAPIKey
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", err
+	}
+	if created.Key == "" {
+		return "", fmt.Errorf("creating the key answered no key")
+	}
+	return created.Key, nil
+}
+
+// cases lists the requests to check, reading the seeded data over the last day
+func cases(s *seeded) []testCase {
+	day := fmt.Sprintf("time_min=%d&time_max=%d", s.latest-24*3600, s.latest)
+	return []testCase{
+		// Authentication
+		{name: "zones without token", as: anonymous, method: http.MethodGet, path: "/api/zones", status: http.StatusUnauthorized},
+		{name: "profile", as: monitor, method: http.MethodGet, path: "/api/auth/profile", status: http.StatusOK, shape: ptr(object("id", "username", "role"))},
+		{name: "permissions", as: monitor, method: http.MethodGet, path: "/api/auth/permissions", status: http.StatusOK, shape: ptr(object("role", "groups", "capabilities"))},
+		{name: "debug stats", as: admin, method: http.MethodGet, path: "/debug/stats", status: http.StatusOK, shape: ptr(object("goroutines", "heap", "mongo_pool", "ingest", "sessions"))},
+		{name: "debug stats as monitor", as: monitor, method: http.MethodGet, path: "/debug/stats", status: http.StatusForbidden},
+		{name: "pprof as monitor", as: monitor, method: http.MethodGet, path: "/debug/pprof/heap", status: http.StatusForbidden},
+		{name: "debug stats without token", as: anonymous, method: http.MethodGet, path: "/debug/stats", status: http.StatusUnauthorized},
+		{name: "wrong password", as: anonymous, method: http.MethodPost, path: "/api/auth/login", body: domain.LoginRequest{Username: "routetest-admin", Password: "wrong"}, status: http.StatusUnauthorized},
+
+		// Zones and groups
+		{name: "list zones", as: admin, method: http.MethodGet, path: "/api/zones", status: http.StatusOK, shape: &paginated},
+		{name: "get zone", as: admin, method: http.MethodGet, path: "/api/zones/" + s.zone.ID, status: http.StatusOK, shape: ptr(object("id", "name", "code"))},
+		{name: "get unknown zone", as: admin, method: http.MethodGet, path: "/api/zones/unknown", status: http.StatusNotFound},
+		{name: "list zone groups", as: admin, method: http.MethodGet, path: "/api/zones/" + s.zone.ID + "/groups", status: http.StatusOK},
+		{name: "zone metrics matrix", as: monitor, method: http.MethodGet, path: "/api/zones/" + s.zone.ID + "/metrics-matrix", status: http.StatusOK, shape: ptr(object("zone_id", "metrics", "groups"))},
+		{name: "zone metrics matrix as xlsx", as: admin, method: http.MethodGet, path: "/api/zones/" + s.zone.ID + "/metrics-matrix?format=xlsx", status: http.StatusOK, contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{name: "navigation tree", as: monitor, method: http.MethodGet, path: "/api/tree", status: http.StatusOK, shape: &anArray},
+		{name: "navigation subtree of a zone", as: admin, method: http.MethodGet, path: "/api/tree?zone_id=" + s.zone.ID, status: http.StatusOK, shape: &anArray},
+		{name: "navigation subtree of an unknown zone", as: admin, method: http.MethodGet, path: "/api/tree?zone_id=unknown", status: http.StatusNotFound},
+		{name: "create zone as monitor", as: monitor, method: http.MethodPost, path: "/api/zones", body: map[string]string{"name": "Denied", "code": "DENIED"}, status: http.StatusForbidden},
+		{name: "get group", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID, status: http.StatusOK, shape: ptr(object("id", "name", "boxes"))},
+		{name: "get group without note and metrics", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "?exclude=note,metrics", status: http.StatusOK, shape: ptr(object("id", "name", "boxes"))},
+		{name: "get group excluding an unknown field", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "?exclude=boxes", status: http.StatusBadRequest},
+		{name: "get group unchanged since", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "?modified_since=4102444800", status: http.StatusNotModified},
+		{name: "get group changed since", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "?modified_since=0", status: http.StatusOK, shape: ptr(object("id", "boxes"))},
+		{name: "get group with an invalid modified_since", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "?modified_since=yesterday", status: http.StatusBadRequest},
+		{name: "list group boxes", as: admin, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/boxes", status: http.StatusOK, shape: &paginated},
+		{name: "group camera status", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/cameras/status", status: http.StatusOK, shape: &anArray},
+		{name: "get a restricted group", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID, status: http.StatusForbidden},
+		{name: "list boxes of a restricted group", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/boxes", status: http.StatusForbidden},
+		{name: "report a restricted group", as: monitor, method: http.MethodGet, path: "/api/zones/reports?group=" + s.otherGroup.ID + "&metrics=WAU", status: http.StatusForbidden},
+		{name: "camera status of a restricted group", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/cameras/status", status: http.StatusForbidden},
+		{name: "group status", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/status", status: http.StatusOK, shape: ptr(object("group_id", "freeboard"))},
+		{name: "zone report", as: admin, method: http.MethodGet, path: "/api/zones/reports?group=" + s.group.ID + "&metrics=WAU", status: http.StatusOK, shape: &anArray},
+		{name: "zone report of every group", as: monitor, method: http.MethodGet, path: "/api/zones/reports?zone=" + s.zone.ID + "&metrics=WAU", status: http.StatusOK, shape: ptr(object("zone_id", "groups"))},
+		{name: "zone report of a metric missing from the catalog", as: admin, method: http.MethodGet, path: "/api/zones/reports?group=" + s.group.ID + "&metrics=ROUTETEST-UNKNOWN", status: http.StatusBadRequest, shape: ptr(object("problems"))},
+		{name: "zone report of every group with a metric missing from the catalog", as: monitor, method: http.MethodGet, path: "/api/zones/reports?zone=" + s.zone.ID + "&metrics=WAU,ROUTETEST-UNKNOWN", status: http.StatusBadRequest, shape: ptr(object("problems"))},
+		{name: "zone report of a group and a zone", as: admin, method: http.MethodGet, path: "/api/zones/reports?zone=" + s.zone.ID + "&group=" + s.group.ID + "&metrics=WAU", status: http.StatusBadRequest},
+
+		// Boxes
+		{name: "get box", as: admin, method: http.MethodGet, path: "/api/boxes/" + s.box.ID, status: http.StatusOK, shape: ptr(object("id", "name", "group_id", "metrics"))},
+		{name: "list boxes", as: admin, method: http.MethodGet, path: "/api/boxes", status: http.StatusOK},
+		{name: "get a restricted box", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID, status: http.StatusForbidden},
+		{name: "locations of a restricted box", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID + "/locations", status: http.StatusForbidden},
+		{name: "delete box as monitor", as: monitor, method: http.MethodDelete, path: "/api/boxes/" + s.box.ID, status: http.StatusForbidden},
+		{name: "create box in another zone than its group", as: admin, method: http.MethodPost, path: "/api/groups/" + s.group.ID + "/boxes", body: map[string]interface{}{"name": "Misplaced", "zone_id": "routetest-elsewhere", "location": map[string]float64{"lat": 21, "lng": 105.8}, "device_id": "routetest-misplaced", "metrics": []map[string]string{{"code": s.metric.Code}}}, status: http.StatusUnprocessableEntity},
+		{name: "list boxes outside their group's zone", as: admin, method: http.MethodGet, path: "/api/zones/box-zone-mismatches", status: http.StatusOK, shape: ptr(object("items"))},
+		{name: "list boxes outside their group's zone as monitor", as: monitor, method: http.MethodGet, path: "/api/zones/box-zone-mismatches", status: http.StatusForbidden},
+		{name: "update box with a metric missing from the catalog", as: admin, method: http.MethodPut, path: "/api/boxes/" + s.box.ID, body: map[string]interface{}{"metrics": []map[string]string{{"code": "ROUTETEST-UNKNOWN"}}}, status: http.StatusBadRequest, shape: ptr(object("problems"))},
+
+		// Records
+		{name: "list records", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records?" + day, status: http.StatusOK, shape: &paginated},
+		{name: "list records fills the default page", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records", status: http.StatusOK, shape: &fullPage},
+		{name: "list records fills a large page", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records?page_size=50", status: http.StatusOK, shape: &fullPage},
+		{name: "list group records fills the default page", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/records", status: http.StatusOK, shape: &fullPage},
+		{name: "list records holding stray BSON values", as: admin, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID + "/records?" + day, status: http.StatusOK, shape: &plain},
+		{name: "list records of a restricted box", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID + "/records?" + day, status: http.StatusForbidden},
+		{name: "list records of an unknown box", as: admin, method: http.MethodGet, path: "/api/boxes/unknown/records?" + day, status: http.StatusNotFound},
+		{name: "count records", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records/count", status: http.StatusOK, shape: ptr(object("count"))},
+		{name: "record schema", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records/schema?sample=100", status: http.StatusOK, shape: ptr(object("box_id", "sampled", "fields", "missing"))},
+		{name: "count records on the legacy path", as: monitor, method: http.MethodGet, path: "/api/data/box/" + s.box.ID + "/count", status: http.StatusOK, shape: ptr(object("count"))},
+		{name: "count records of a restricted box on the legacy path", as: monitor, method: http.MethodGet, path: "/api/data/box/" + s.otherBox.ID + "/count", status: http.StatusForbidden},
+		{name: "poll records with newer ones", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records/poll?since=0", status: http.StatusOK, shape: &paginated},
+		{name: "poll records until the timeout", as: monitor, method: http.MethodGet, path: fmt.Sprintf("/api/boxes/%s/records/poll?since=%d&timeout=1", s.box.ID, s.latest), status: http.StatusNoContent},
+		{name: "list record corrections", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/corrections", status: http.StatusOK, shape: &anArray},
+		{name: "clear a flag the record lacks", as: admin, method: http.MethodPost, path: fmt.Sprintf("/api/boxes/%s/records/%d/flags/WAU/clear", s.box.ID, s.latest), status: http.StatusNotFound},
+		{name: "clear a flag as monitor", as: monitor, method: http.MethodPost, path: fmt.Sprintf("/api/boxes/%s/records/%d/flags/WAU/clear", s.box.ID, s.latest), status: http.StatusForbidden},
+		{name: "record stats", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records/stats?metrics=WAU&" + day, status: http.StatusOK},
+		{name: "box report", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/reports?" + day, status: http.StatusOK, shape: &anArray},
+		{name: "export records", as: monitor, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records/export?" + day, status: http.StatusOK, contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{name: "list group records", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/records?" + day, status: http.StatusOK, shape: &paginated},
+		{name: "list group records nested per box", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/records?group_by=box&" + day, status: http.StatusOK, shape: &paginated},
+		{name: "list records of a restricted group", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/records?" + day, status: http.StatusForbidden},
+		{name: "latest group records", as: monitor, method: http.MethodGet, path: "/api/groups/" + s.group.ID + "/records/latest", status: http.StatusOK},
+
+		// Export jobs; their download links need no session but a valid token
+		{name: "start a group export job", as: monitor, method: http.MethodPost, path: "/api/groups/" + s.group.ID + "/records/export-jobs?format=csv_long&" + day, status: http.StatusAccepted, shape: ptr(object("id", "type", "status"))},
+		{name: "start an export job without a format", as: monitor, method: http.MethodPost, path: "/api/groups/" + s.group.ID + "/records/export-jobs?" + day, status: http.StatusBadRequest},
+		{name: "start an export job of a restricted group", as: monitor, method: http.MethodPost, path: "/api/groups/" + s.otherGroup.ID + "/records/export-jobs?format=csv_long&" + day, status: http.StatusForbidden},
+		{name: "get an unknown export job", as: monitor, method: http.MethodGet, path: "/api/export-jobs/unknown", status: http.StatusNotFound},
+		{name: "get an export job without token", as: anonymous, method: http.MethodGet, path: "/api/export-jobs/unknown", status: http.StatusUnauthorized},
+		{name: "download an export without token", as: anonymous, method: http.MethodGet, path: "/api/export-jobs/unknown/download", status: http.StatusUnauthorized},
+		{name: "download an export with a forged token", as: anonymous, method: http.MethodGet, path: "/api/export-jobs/unknown/download?token=9999999999.AAAA", status: http.StatusUnauthorized},
+
+		// Metrics
+		{name: "list metrics", as: monitor, method: http.MethodGet, path: "/api/metrics", status: http.StatusOK, shape: &paginated},
+		{name: "get metric", as: monitor, method: http.MethodGet, path: "/api/metrics/" + s.metric.ID, status: http.StatusOK, shape: ptr(object("id", "code", "unit"))},
+		{name: "create metric as monitor", as: monitor, method: http.MethodPost, path: "/api/metrics", body: map[string]string{"code": "Q", "name": "Q"}, status: http.StatusForbidden},
+		{name: "list units", as: monitor, method: http.MethodGet, path: "/api/units", status: http.StatusOK},
+
+		// Settings
+		{name: "list settings", as: admin, method: http.MethodGet, path: "/api/settings", status: http.StatusOK, shape: &paginated},
+		{name: "list settings by prefix", as: admin, method: http.MethodGet, path: "/api/settings?prefix=routetest.", status: http.StatusOK, shape: &paginated},
+		{name: "setting values", as: admin, method: http.MethodGet, path: "/api/settings/values?prefix=routetest", status: http.StatusOK, shape: ptr(object("map"))},
+		{name: "setting key report", as: admin, method: http.MethodGet, path: "/api/settings/key-report", status: http.StatusOK, shape: &anArray},
+		{name: "get setting", as: admin, method: http.MethodGet, path: "/api/settings/" + s.setting.ID, status: http.StatusOK, shape: ptr(object("id", "key", "value"))},
+		{name: "create setting with a bad key", as: admin, method: http.MethodPost, path: "/api/settings", body: domain.CreateSettingParams{Key: "mapZoom", Value: 1}, status: http.StatusBadRequest},
+		{name: "list settings as monitor", as: monitor, method: http.MethodGet, path: "/api/settings", status: http.StatusForbidden},
+
+		// Users
+		{name: "list users", as: admin, method: http.MethodGet, path: "/api/users", status: http.StatusOK},
+		{name: "get user as monitor", as: monitor, method: http.MethodGet, path: "/api/users/" + s.monitorUser.ID, status: http.StatusForbidden},
+
+		// Feature flags
+		{name: "list features", as: admin, method: http.MethodGet, path: "/api/admin/features", status: http.StatusOK, shape: &anArray},
+		{name: "list features as monitor", as: monitor, method: http.MethodGet, path: "/api/admin/features", status: http.StatusForbidden},
+		{name: "set an unknown feature", as: admin, method: http.MethodPut, path: "/api/admin/features/routetest", body: map[string]bool{"enabled": true}, status: http.StatusNotFound},
+
+		// API keys read their groups only, and never write
+		{name: "list api keys", as: admin, method: http.MethodGet, path: "/api/admin/api-keys", status: http.StatusOK, shape: ptr(object("items"))},
+		{name: "list api keys as monitor", as: monitor, method: http.MethodGet, path: "/api/admin/api-keys", status: http.StatusForbidden},
+		{name: "create an api key for an unknown group", as: admin, method: http.MethodPost, path: "/api/admin/api-keys", body: domain.CreateAPIKeyParams{Name: "unknown", Groups: []string{"unknown"}}, status: http.StatusBadRequest},
+		{name: "revoke an unknown api key", as: admin, method: http.MethodDelete, path: "/api/admin/api-keys/unknown", status: http.StatusNotFound},
+		{name: "get group with an api key", as: integration, method: http.MethodGet, path: "/api/groups/" + s.group.ID, status: http.StatusOK, shape: ptr(object("id", "boxes"))},
+		{name: "list records with an api key", as: integration, method: http.MethodGet, path: "/api/boxes/" + s.box.ID + "/records?" + day, status: http.StatusOK, shape: &paginated},
+		{name: "get another group with an api key", as: integration, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID, status: http.StatusForbidden},
+		{name: "list records of another group with an api key", as: integration, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID + "/records?" + day, status: http.StatusForbidden},
+		{name: "list boxes of another group with an api key", as: integration, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/boxes", status: http.StatusForbidden},
+		{name: "ingest stats of another group with an api key", as: integration, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/ingest-stats", status: http.StatusForbidden},
+		{name: "export template of another group with an api key", as: integration, method: http.MethodGet, path: "/api/groups/" + s.otherGroup.ID + "/export-template", status: http.StatusForbidden},
+		{name: "get a box of another group with an api key", as: integration, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID, status: http.StatusForbidden},
+		{name: "ingest stats of a box of another group with an api key", as: integration, method: http.MethodGet, path: "/api/boxes/" + s.otherBox.ID + "/ingest-stats", status: http.StatusForbidden},
+		{name: "list boxes with an api key", as: integration, method: http.MethodGet, path: "/api/boxes", status: http.StatusOK, shape: &paginated},
+		{name: "report another group with an api key", as: integration, method: http.MethodGet, path: "/api/zones/reports?group=" + s.otherGroup.ID + "&metrics=WAU", status: http.StatusForbidden},
+		{name: "post a record with an api key", as: integration, method: http.MethodPost, path: "/api/boxes/" + s.box.ID + "/records", body: map[string]interface{}{"WAU": 1}, status: http.StatusForbidden},
+		{name: "update group with an api key", as: integration, method: http.MethodPut, path: "/api/groups/" + s.group.ID, body: map[string]string{"name": "Renamed"}, status: http.StatusForbidden},
+		{name: "delete box with an api key", as: integration, method: http.MethodDelete, path: "/api/boxes/" + s.box.ID, status: http.StatusForbidden},
+		{name: "list users with an api key", as: integration, method: http.MethodGet, path: "/api/users", status: http.StatusForbidden},
+		{name: "profile with an api key", as: integration, method: http.MethodGet, path: "/api/auth/profile", status: http.StatusForbidden},
+
+		// The versioned API serves the same routes
+		{name: "get group on v2", as: monitor, method: http.MethodGet, path: "/api/v2/groups/" + s.group.ID, status: http.StatusOK, shape: ptr(object("id", "boxes"))},
+	}
+}
+
+func ptr(s shape) *shape {
+	return &s
+}
+
+// check sends the request of the case and compares the response with what it expects
+func check(baseURL, token string, tc testCase) error {
+	var body io.Reader
+	if tc.body != nil {
+		data, err := json.Marshal(tc.body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(tc.method, baseURL+tc.path, body)
+	if err != nil {
+		return err
+	}
+	if tc.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case token == "":
+	case tc.as == integration:
+		req.Header.Set(domain.APIKeyHeader, token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != tc.status {
+		return fmt.Errorf("answered %d, want %d: %s", resp.StatusCode, tc.status, truncate(data))
+	}
+	if tc.contentType != "" && !strings.HasPrefix(resp.Header.Get("Content-Type"), tc.contentType) {
+		return fmt.Errorf("answered Content-Type %q, want %q", resp.Header.Get("Content-Type"), tc.contentType)
+	}
+	if tc.shape == nil {
+		return nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return fmt.Errorf("answered invalid JSON: %v", err)
+	}
+	if tc.shape.array {
+		items, ok := decoded.([]interface{})
+		if !ok {
+			return fmt.Errorf("answered %s, want an array", truncate(data))
+		}
+		if tc.shape.empty && len(items) > 0 {
+			return fmt.Errorf("answered %s, want []", truncate(data))
+		}
+		return nil
+	}
+	fields, ok := decoded.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("answered %s, want an object", truncate(data))
+	}
+	for _, key := range tc.shape.keys {
+		if _, ok := fields[key]; !ok {
+			return fmt.Errorf("answered no %q: %s", key, truncate(data))
+		}
+	}
+	if tc.shape.empty {
+		if items, ok := fields[tc.shape.keys[0]].([]interface{}); !ok || len(items) > 0 {
+			return fmt.Errorf("answered %q %v, want []", tc.shape.keys[0], fields[tc.shape.keys[0]])
+		}
+	}
+	if tc.shape.plain {
+		items, _ := fields["data"].([]interface{})
+		for _, item := range items {
+			record, _ := item.(map[string]interface{})
+			for key, value := range record {
+				switch value.(type) {
+				case nil, float64, string, bool:
+				default:
+					if key != "flags" {
+						return fmt.Errorf("answered %s %v in a record: %s", key, value, truncate(data))
+					}
+				}
+			}
+		}
+	}
+	if tc.shape.fullPage {
+		items, _ := fields["data"].([]interface{})
+		meta, _ := fields["meta"].(map[string]interface{})
+		pageSize, _ := meta["page_size"].(float64)
+		if pageSize == 0 || len(items) != int(pageSize) {
+			return fmt.Errorf("answered %d items with page_size %v: %s", len(items), meta["page_size"], truncate(data))
+		}
+	}
+	return nil
+}
+
+// truncate shortens a response body for a failure message
+func truncate(data []byte) string {
+	const max = 300
+	if len(data) > max {
+		return string(data[:max]) + "..."
+	}
+	return string(data)
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+type AlertService struct {
+	repo *mongodb.AlertRepository
+}
+
+func NewAlertService(repo *mongodb.AlertRepository) *AlertService {
+	return &AlertService{repo: repo}
+}
+
+// scopeAlerts restricts the filter to the groups the user may read. Asking for another group by ID is
+// denied; other filters simply match nothing outside the user's groups.
+func scopeAlerts(user *domain.User, filter *domain.FilterAlertParams) error {
+	if filter.GroupID != "" {
+		if !user.CanAccessGroup(filter.GroupID) {
+			return domain.ErrBoxAccessDenied
+		}
+		return nil
+	}
+	if user.Role != domain.RoleAdmin {
+		filter.Groups = user.ReadableGroups()
+	}
+	return nil
+}
+
+// ListWithPagination lists the alerts the user may read, newest first
+func (s *AlertService) ListWithPagination(ctx context.Context, user *domain.User, pagination *domain.Pagination, filter domain.FilterAlertParams) ([]domain.Alert, int64, error) {
+	if err := scopeAlerts(user, &filter); err != nil {
+		return nil, 0, err
+	}
+	return s.repo.ListWithPagination(ctx, pagination, filter)
+}
+
+// Stream calls fn for every alert the user may read, newest first
+func (s *AlertService) Stream(ctx context.Context, user *domain.User, filter domain.FilterAlertParams, fn func(domain.Alert) error) error {
+	if err := scopeAlerts(user, &filter); err != nil {
+		return err
+	}
+	return s.repo.Stream(ctx, filter, fn)
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"tp25-api/internal/domain"
+)
+
+// flagAnomalies scores the values of a record about to be stored against the rolling statistics
+// of the box's metrics, when the box has an anomaly policy, and flags in _flags those lying beyond
+// its z-score. Flagged values are stored all the same. The statistics are cached per box and saved
+// with every record, so they survive restarts.
+func (s *SensorService) flagAnomalies(ctx context.Context, box *domain.Box, record domain.Record) {
+	policy := box.Anomaly
+	if !policy.Enabled() || (s.features != nil && !s.features.Enabled(ctx, domain.FeatureAnomalyDetection)) {
+		return
+	}
+
+	s.anomalyMu.Lock()
+	_, cached := s.anomalyStats[box.ID]
+	s.anomalyMu.Unlock()
+	if !cached {
+		state, err := s.anomalyRepo.State(ctx, box.ID)
+		if err != nil {
+			log.Printf("Anomalies: read state of box %s: %v", box.ID, err)
+			return
+		}
+		seed := make(map[string]domain.RollingStats)
+		if state != nil {
+			for code, stats := range state.Metrics {
+				seed[code] = stats
+			}
+		}
+		s.anomalyMu.Lock()
+		if _, ok := s.anomalyStats[box.ID]; !ok {
+			s.anomalyStats[box.ID] = seed
+		}
+		s.anomalyMu.Unlock()
+	}
+
+	changed := make(map[string]domain.RollingStats)
+	flags := make(map[string]string)
+	s.anomalyMu.Lock()
+	stats := s.anomalyStats[box.ID]
+	for _, code := range record.MetricCodes() {
+		if !policy.Watches(code) {
+			continue
+		}
+		metric := stats[code]
+		if metric.Observe(record.GetFloat(code), policy.ZScore, policy.WindowSize()) {
+			flags[code] = domain.RecordFlagAnomaly
+		}
+		stats[code] = metric
+		changed[code] = metric
+	}
+	s.anomalyMu.Unlock()
+
+	if len(flags) > 0 {
+		record[domain.RecordFlagsKey] = flags
+	}
+	if err := s.anomalyRepo.SaveStats(ctx, box.ID, changed); err != nil {
+		log.Printf("Anomalies: save state of box %s: %v", box.ID, err)
+	}
+}
+
+// dropAnomalies leaves out of records read for a query asking so the values flagged as anomalies
+func dropAnomalies(query *domain.QueryRecord, records []domain.Record) {
+	if query == nil || !query.ExcludeAnomalies {
+		return
+	}
+	for _, record := range records {
+		record.DropAnomalies()
+	}
+}
+
+// ClearRecordFlag removes the flag a metric value of a stored record carries, e.g. an anomaly found
+// to be a real change, and records the correction
+func (s *SensorService) ClearRecordFlag(ctx context.Context, boxID string, timestamp int64, code string, params domain.ClearFlagParams, actorID string) (*domain.RecordCorrection, error) {
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+
+	previous, err := s.repo.ClearRecordFlag(ctx, boxID, timestamp, code)
+	if err != nil {
+		return nil, err
+	}
+
+	correction := domain.NewRecordCorrection(boxID, timestamp, code, domain.RecordCorrectionAnomalyCleared, actorID)
+	correction.Previous = previous
+	correction.Note = params.Note
+	if err := s.anomalyRepo.AddCorrection(ctx, correction); err != nil {
+		return nil, err
+	}
+	return correction, nil
+}
+
+// RecordCorrections returns the corrections made to the stored records of a box, newest first
+func (s *SensorService) RecordCorrections(ctx context.Context, boxID string) ([]domain.RecordCorrection, error) {
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+	return s.anomalyRepo.ListCorrections(ctx, boxID)
+}
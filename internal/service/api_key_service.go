@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib"
+)
+
+// apiKeyUseResolution is how stale the last use of a key may get, so a busy integration does not
+// write on every request
+const apiKeyUseResolution = time.Minute
+
+type APIKeyService struct {
+	repo     *mongodb.APIKeyRepository
+	zoneRepo *mongodb.ZoneRepository
+}
+
+func NewAPIKeyService(repo *mongodb.APIKeyRepository, zoneRepo *mongodb.ZoneRepository) *APIKeyService {
+	return &APIKeyService{repo: repo, zoneRepo: zoneRepo}
+}
+
+// List returns every key, revoked ones included, newest first
+func (s *APIKeyService) List(ctx context.Context) ([]domain.APIKey, error) {
+	return s.repo.List(ctx)
+}
+
+// Create issues a key reading the given groups. The key itself is only returned here.
+func (s *APIKeyService) Create(ctx context.Context, params domain.CreateAPIKeyParams, createdBy string) (*domain.CreatedAPIKey, error) {
+	groups, err := s.zoneRepo.ListGroupsByIDs(ctx, params.Groups)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		found[group.ID] = true
+	}
+	var missing []string
+	for _, id := range params.Groups {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	if problems := domain.APIKeyProblems(params, missing); len(problems) > 0 {
+		return nil, &domain.ValidationError{Problems: problems}
+	}
+
+	secret, err := lib.SecureChar(40)
+	if err != nil {
+		return nil, err
+	}
+	key := domain.APIKeyPrefix + secret
+
+	apiKey := domain.NewAPIKey(params, key, hashToken(key), createdBy)
+	if err := s.repo.Create(ctx, apiKey); err != nil {
+		return nil, err
+	}
+	return &domain.CreatedAPIKey{APIKey: *apiKey, Key: key}, nil
+}
+
+// Revoke stops a key from being accepted
+func (s *APIKeyService) Revoke(ctx context.Context, id string) error {
+	return s.repo.Revoke(ctx, id)
+}
+
+// Authenticate returns the unrevoked, unexpired key, recording that it was used
+func (s *APIKeyService) Authenticate(ctx context.Context, key string) (*domain.APIKey, error) {
+	apiKey, err := s.repo.GetByHash(ctx, hashToken(key))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if apiKey.Expired(now) {
+		return nil, domain.ErrAPIKeyExpired
+	}
+
+	if apiKey.LastUsedAt == nil || now.Unix()-*apiKey.LastUsedAt >= int64(apiKeyUseResolution.Seconds()) {
+		if err := s.repo.SetLastUsed(ctx, apiKey.ID, now.Unix()); err != nil {
+			log.Printf("Failed to record the use of API key %s: %v", apiKey.ID, err)
+		}
+	}
+	return apiKey, nil
+}
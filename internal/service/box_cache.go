@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// boxCacheTTL is how long the box a record is admitted against is reused before it is read again,
+// which bounds how long a change made on another instance, e.g. of the merge policy, takes to apply
+const boxCacheTTL = time.Minute
+
+type cachedBox struct {
+	box      *domain.Box // nil for boxes that do not exist
+	loadedAt time.Time
+}
+
+// boxCache holds the boxes records were admitted against, shared read-only between requests
+type boxCache struct {
+	mu    sync.Mutex
+	boxes map[string]cachedBox
+}
+
+// admissionBox returns the box with its unit conversions and ingestion policies, nil when it does
+// not exist. Every record sent reads it, so it comes from memory for boxCacheTTL.
+func (s *SensorService) admissionBox(ctx context.Context, boxID string) (*domain.Box, error) {
+	s.boxes.mu.Lock()
+	cached, ok := s.boxes.boxes[boxID]
+	s.boxes.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < boxCacheTTL {
+		return cached.box, nil
+	}
+
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil && err != domain.ErrBoxNotFound {
+		return nil, err
+	}
+
+	s.boxes.mu.Lock()
+	defer s.boxes.mu.Unlock()
+	// Drop expired entries now and then so boxes no longer reporting do not pile up
+	for id, entry := range s.boxes.boxes {
+		if time.Since(entry.loadedAt) >= boxCacheTTL {
+			delete(s.boxes.boxes, id)
+		}
+	}
+	s.boxes.boxes[boxID] = cachedBox{box: box, loadedAt: time.Now()}
+	return box, nil
+}
+
+// ForgetBox makes the next record of the box read it again, once it was created, changed or deleted
+func (s *SensorService) ForgetBox(ctx context.Context, boxID string) {
+	s.boxes.mu.Lock()
+	defer s.boxes.mu.Unlock()
+	delete(s.boxes.boxes, boxID)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+type BoxLogService struct {
+	repo     *mongodb.BoxLogRepository
+	zoneRepo *mongodb.ZoneRepository
+}
+
+func NewBoxLogService(repo *mongodb.BoxLogRepository, zoneRepo *mongodb.ZoneRepository) *BoxLogService {
+	return &BoxLogService{repo: repo, zoneRepo: zoneRepo}
+}
+
+// authorizeBox makes sure the box exists and belongs to a group the user may read
+func (s *BoxLogService) authorizeBox(ctx context.Context, user *domain.User, boxID string) error {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return err
+	}
+	if !user.CanAccessGroup(box.GroupID) {
+		return domain.ErrBoxAccessDenied
+	}
+	return nil
+}
+
+// ListWithPagination lists the logs of a box, newest first
+func (s *BoxLogService) ListWithPagination(ctx context.Context, user *domain.User, pagination *domain.Pagination, filter domain.FilterBoxLogParams) ([]domain.BoxLog, int64, error) {
+	if err := s.authorizeBox(ctx, user, filter.BoxID); err != nil {
+		return nil, 0, err
+	}
+	return s.repo.ListWithPagination(ctx, pagination, filter)
+}
+
+// Create records a note against a box, authored by user
+func (s *BoxLogService) Create(ctx context.Context, user *domain.User, boxID string, params domain.CreateBoxLogParams) (*domain.BoxLog, error) {
+	if err := domain.ValidateBoxLogText(params.Text); err != nil {
+		return nil, err
+	}
+	if err := s.authorizeBox(ctx, user, boxID); err != nil {
+		return nil, err
+	}
+
+	log := domain.NewBoxLog(boxID, params, user)
+	if err := s.repo.Create(ctx, log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// Update corrects a log; the author is kept
+func (s *BoxLogService) Update(ctx context.Context, boxID, id string, params domain.UpdateBoxLogParams) (*domain.BoxLog, error) {
+	log, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Text != nil {
+		if err := domain.ValidateBoxLogText(*params.Text); err != nil {
+			return nil, err
+		}
+		log.Text = *params.Text
+	}
+	if params.Category != nil {
+		log.Category = *params.Category
+	}
+	if params.Timestamp != nil {
+		log.Timestamp = *params.Timestamp
+	}
+
+	if err := s.repo.Update(ctx, log); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (s *BoxLogService) Delete(ctx context.Context, boxID, id string) (*domain.BoxLog, error) {
+	log, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+type CalibrationService struct {
+	repo     *mongodb.CalibrationRepository
+	zoneRepo *mongodb.ZoneRepository
+}
+
+func NewCalibrationService(repo *mongodb.CalibrationRepository, zoneRepo *mongodb.ZoneRepository) *CalibrationService {
+	return &CalibrationService{repo: repo, zoneRepo: zoneRepo}
+}
+
+// authorizeBox returns the box when it exists and belongs to a group the user may read
+func (s *CalibrationService) authorizeBox(ctx context.Context, user *domain.User, boxID string) (*domain.Box, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.CanAccessGroup(box.GroupID) {
+		return nil, domain.ErrBoxAccessDenied
+	}
+	return box, nil
+}
+
+// List returns the calibrations of a box, by metric and effect time
+func (s *CalibrationService) List(ctx context.Context, user *domain.User, boxID string) ([]domain.Calibration, error) {
+	if _, err := s.authorizeBox(ctx, user, boxID); err != nil {
+		return nil, err
+	}
+	return s.repo.List(ctx, boxID)
+}
+
+// Create adds a calibration for a metric the box reports
+func (s *CalibrationService) Create(ctx context.Context, user *domain.User, boxID string, params domain.CreateCalibrationParams) (*domain.Calibration, error) {
+	box, err := s.authorizeBox(ctx, user, boxID)
+	if err != nil {
+		return nil, err
+	}
+	if !boxHasMetric(box, params.Metric) {
+		return nil, domain.ErrCalibrationMetric
+	}
+
+	calibration := domain.NewCalibration(boxID, params, user.ID)
+	if err := calibration.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.checkUnique(ctx, calibration); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Create(ctx, calibration); err != nil {
+		return nil, err
+	}
+	return calibration, nil
+}
+
+func (s *CalibrationService) Update(ctx context.Context, boxID, id string, params domain.UpdateCalibrationParams) (*domain.Calibration, error) {
+	calibration, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Scale != nil {
+		calibration.Scale = *params.Scale
+	}
+	if params.Offset != nil {
+		calibration.Offset = *params.Offset
+	}
+	if params.EffectiveFrom != nil {
+		calibration.EffectiveFrom = *params.EffectiveFrom
+	}
+	if params.Note != nil {
+		calibration.Note = *params.Note
+	}
+
+	if err := calibration.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.checkUnique(ctx, calibration); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Update(ctx, calibration); err != nil {
+		return nil, err
+	}
+	return calibration, nil
+}
+
+func (s *CalibrationService) Delete(ctx context.Context, boxID, id string) (*domain.Calibration, error) {
+	calibration, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	return calibration, nil
+}
+
+// checkUnique rejects a calibration taking effect at the same time as another of the same metric,
+// which would leave the correction in force ambiguous
+func (s *CalibrationService) checkUnique(ctx context.Context, calibration *domain.Calibration) error {
+	existing, err := s.repo.List(ctx, calibration.BoxID)
+	if err != nil {
+		return err
+	}
+	for _, other := range existing {
+		if other.ID != calibration.ID && other.Metric == calibration.Metric && other.EffectiveFrom == calibration.EffectiveFrom {
+			return domain.ErrCalibrationExists
+		}
+	}
+	return nil
+}
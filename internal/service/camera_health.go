@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib"
+)
+
+// cameraCheckWorkers bounds how many groups have their cameras probed at once
+const cameraCheckWorkers = 8
+
+// CameraChecker periodically probes the cameras configured on groups and stores when each last
+// answered, so stale camera URLs show up before an incident does
+type CameraChecker struct {
+	groups  *mongodb.ZoneRepository
+	checks  *mongodb.CameraRepository
+	alerts  *mongodb.AlertRepository // raises an alert when a camera starts failing, see SetAlerts
+	timeout time.Duration
+	client  *http.Client
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCameraChecker creates a checker giving each camera up to timeout to answer
+func NewCameraChecker(groups *mongodb.ZoneRepository, checks *mongodb.CameraRepository, timeout time.Duration) *CameraChecker {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &CameraChecker{
+		groups:  groups,
+		checks:  checks,
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// SetAlerts raises an info alert on the group whenever one of its cameras starts failing
+func (c *CameraChecker) SetAlerts(alerts *mongodb.AlertRepository) {
+	c.alerts = alerts
+}
+
+// Start checks every camera each interval, the first time one interval from now; a non-positive
+// interval leaves the checker stopped
+func (c *CameraChecker) Start(interval time.Duration) {
+	if interval <= 0 || c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if err := c.CheckAll(ctx); err != nil {
+					log.Printf("Cameras: check failed: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// Close stops the periodic checks and waits for a running one to end or ctx to
+func (c *CameraChecker) Close(ctx context.Context) error {
+	if c.stop == nil {
+		return nil
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckAll probes the cameras of every live group
+func (c *CameraChecker) CheckAll(ctx context.Context) error {
+	groups, err := c.groups.ListGroupsWithCameras(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, cameraCheckWorkers)
+	for i := range groups {
+		group := &groups[i]
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := c.checkGroup(ctx, group); err != nil {
+				log.Printf("Cameras: checking group %s failed: %v", group.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// checkGroup probes the cameras of a group one after the other and drops the checks of cameras
+// removed from it since
+func (c *CameraChecker) checkGroup(ctx context.Context, group *domain.BoxGroup) error {
+	previous, err := c.checks.Checks(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	byURL := make(map[string]domain.CameraCheck, len(previous))
+	for _, check := range previous {
+		byURL[check.URL] = check
+	}
+
+	for i, camera := range group.Cameras {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !domain.ProbeableCamera(camera) {
+			continue
+		}
+
+		check, found := byURL[camera]
+		if !found {
+			check = domain.CameraCheck{ID: lib.Rand.Char(12), GroupID: group.ID, URL: camera}
+		}
+		wasFailing := check.State() == domain.CameraFailing
+
+		now := time.Now().Unix()
+		check.CheckedAt = now
+		probeErr := c.probe(ctx, camera)
+		if probeErr == nil {
+			check.LastSuccess = &now
+			check.Error = ""
+		} else {
+			check.LastFailure = &now
+			check.Error = probeErr.Error()
+		}
+		if err := c.checks.SaveCheck(ctx, &check); err != nil {
+			return err
+		}
+
+		if probeErr != nil && !wasFailing && c.alerts != nil {
+			message := fmt.Sprintf("Camera %d của %s không phản hồi: %v", i+1, group.Name, probeErr)
+			if err := c.alerts.Create(ctx, domain.NewGroupAlert(group, domain.AlertInfo, message)); err != nil {
+				log.Printf("Cameras: raising the alert of group %s failed: %v", group.ID, err)
+			}
+		}
+	}
+
+	return c.checks.PruneChecks(ctx, group.ID, group.Cameras)
+}
+
+// probe reports whether the camera answers: an http(s) URL to HEAD, or to OPTIONS when the server
+// does not allow HEAD, and an rtsp URL to DESCRIBE. Asking for credentials counts as an answer.
+func (c *CameraChecker) probe(ctx context.Context, camera string) error {
+	u, err := url.Parse(strings.TrimSpace(camera))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	if strings.EqualFold(u.Scheme, "rtsp") {
+		return probeRTSP(ctx, u)
+	}
+
+	status, err := c.probeHTTP(ctx, http.MethodHead, u)
+	if err == nil && (status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented) {
+		status, err = c.probeHTTP(ctx, http.MethodOptions, u)
+	}
+	if err != nil {
+		return err
+	}
+	if status >= 400 && status != http.StatusUnauthorized {
+		return fmt.Errorf("answered %d %s", status, http.StatusText(status))
+	}
+	return nil
+}
+
+func (c *CameraChecker) probeHTTP(ctx context.Context, method string, u *url.URL) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// probeRTSP sends a DESCRIBE request and reads the status line of the answer
+func probeRTSP(ctx context.Context, u *url.URL) error {
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Credentials are not sent in the request line
+	target := *u
+	target.User = nil
+	request := "DESCRIBE " + target.String() + " RTSP/1.0\r\nCSeq: 1\r\nAccept: application/sdp\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return fmt.Errorf("not an RTSP answer: %q", strings.TrimSpace(line))
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("not an RTSP answer: %q", strings.TrimSpace(line))
+	}
+	if status >= 400 && status != http.StatusUnauthorized {
+		return fmt.Errorf("answered %s", strings.Join(fields[1:], " "))
+	}
+	return nil
+}
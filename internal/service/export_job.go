@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib/downloadtoken"
+)
+
+// exportProgressEvery is how many rows an export job writes between progress updates
+const exportProgressEvery = 10000
+
+// exportJobs is where export jobs leave their files and how the links to them are signed
+type exportJobs struct {
+	files   *mongodb.ExportFileRepository
+	signer  *downloadtoken.Signer
+	ttl     time.Duration
+	baseURL string
+}
+
+// SetExportJobs lets group exports run as jobs whose files are kept in files for ttl. Download links
+// are signed with key, so they work without signing in, and prefixed with baseURL, the address the
+// API is reached at.
+func (s *SensorService) SetExportJobs(files *mongodb.ExportFileRepository, key []byte, ttl time.Duration, baseURL string) {
+	s.exports = &exportJobs{
+		files:   files,
+		signer:  downloadtoken.New(key),
+		ttl:     ttl,
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+// StartGroupExport starts a job writing a csv_long or template export of a group to a file named
+// filename. The export is refused up front on the same checks as a direct one.
+func (s *SensorService) StartGroupExport(ctx context.Context, groupID, format, filename string, query *domain.QueryRecord, redacted bool, actorID string) (*domain.Job, error) {
+	if format == domain.ExportFormatTemplate && (query.TimeMin == nil || query.TimeMax == nil) {
+		return nil, domain.ErrTimeRangeRequired
+	}
+
+	export, err := s.PrepareGroupExport(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if format == domain.ExportFormatTemplate {
+		if err := s.checkTemplateExport(ctx, export, query); err != nil {
+			return nil, err
+		}
+		if _, err := s.templateRepo.GetInfo(ctx, groupID); err != nil {
+			return nil, err
+		}
+	} else if err := s.CheckGroupExport(ctx, export, query); err != nil {
+		return nil, err
+	}
+
+	params := map[string]interface{}{"group_id": groupID, "format": format}
+	if query.TimeMin != nil {
+		params["time_min"] = *query.TimeMin
+	}
+	if query.TimeMax != nil {
+		params["time_max"] = *query.TimeMax
+	}
+
+	job := domain.NewJob(domain.JobExportRecords, actorID, params)
+	if err := s.createJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	go s.runGroupExport(job.ID, export, format, filename, query, redacted)
+
+	return job, nil
+}
+
+func (s *SensorService) runGroupExport(jobID string, export *domain.GroupExport, format, filename string, query *domain.QueryRecord, redacted bool) {
+	ctx := context.Background()
+
+	if deleted, err := s.exports.files.DeleteExpired(ctx); err != nil {
+		log.Printf("Job %s: delete expired exports: %v", jobID, err)
+	} else if deleted > 0 {
+		log.Printf("Job %s: deleted %d expired exports", jobID, deleted)
+	}
+
+	expiresAt := time.Now().Add(s.exports.ttl)
+	stream, err := s.exports.files.Create(jobID, filename, expiresAt)
+	if err != nil {
+		s.finishJob(ctx, jobID, 0, 0, err)
+		return
+	}
+
+	file := &domain.JobFile{Filename: filename, ExpiresAt: expiresAt.Unix()}
+	out := &countingWriter{w: stream}
+	var rows int64
+	if format == domain.ExportFormatTemplate {
+		file.ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		var data []byte
+		if data, rows, err = s.ExportWithTemplate(ctx, export.Group.ID, query, redacted); err == nil {
+			_, err = out.Write(data)
+		}
+	} else {
+		file.ContentType = "text/csv; charset=utf-8"
+		rows, err = s.writeGroupCSV(ctx, jobID, export, query, out)
+	}
+
+	if err != nil {
+		stream.Abort()
+	} else if err = stream.Close(); err == nil {
+		file.Size = out.n
+		err = s.jobRepo.SetFile(ctx, jobID, file)
+	}
+	s.finishJob(ctx, jobID, rows, 0, err)
+}
+
+// writeGroupCSV writes a csv_long export to out and returns the rows it wrote
+func (s *SensorService) writeGroupCSV(ctx context.Context, jobID string, export *domain.GroupExport, query *domain.QueryRecord, out io.Writer) (int64, error) {
+	w := csv.NewWriter(out)
+	w.Write(domain.LongRecordCSVHeader)
+
+	var rows int64
+	err := s.StreamGroupExport(ctx, export, query, func(row domain.LongRecordRow) error {
+		rows++
+		if rows%exportProgressEvery == 0 {
+			if err := s.jobRepo.UpdateProgress(ctx, jobID, rows, 0); err != nil {
+				log.Printf("Job %s: update progress: %v", jobID, err)
+			}
+		}
+		return w.Write(row.CSV())
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	return rows, err
+}
+
+// GetExportJob returns an export job to its owner, or to an admin, with a fresh download link
+func (s *SensorService) GetExportJob(ctx context.Context, id string, user *domain.User) (*domain.Job, error) {
+	job, err := s.jobRepo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Type != domain.JobExportRecords || (user.Role != domain.RoleAdmin && job.CreatedBy != user.ID) {
+		return nil, domain.ErrJobNotFound
+	}
+	s.signDownload(job)
+	return job, nil
+}
+
+// signDownload sets the download link of a job whose file has not expired yet
+func (s *SensorService) signDownload(job *domain.Job) {
+	if s.exports == nil || job.File == nil || time.Now().Unix() >= job.File.ExpiresAt {
+		return
+	}
+	token := s.exports.signer.Sign(job.ID, time.Unix(job.File.ExpiresAt, 0))
+	job.DownloadURL = fmt.Sprintf("%s/api/export-jobs/%s/download?token=%s", s.exports.baseURL, job.ID, token)
+}
+
+// OpenExportDownload opens the file of an export job for whoever holds a download token of it.
+// The token is checked before anything is read, so forged links cost no query.
+func (s *SensorService) OpenExportDownload(ctx context.Context, id, token string) (*domain.Job, io.ReadCloser, error) {
+	switch err := s.exports.signer.Verify(id, token, time.Now()); err {
+	case nil:
+	case downloadtoken.ErrExpired:
+		return nil, nil, domain.ErrExportFileExpired
+	default:
+		return nil, nil, domain.ErrInvalidDownloadToken
+	}
+
+	job, err := s.jobRepo.Get(ctx, id)
+	if err != nil {
+		if err == domain.ErrJobNotFound {
+			return nil, nil, domain.ErrExportFileNotFound
+		}
+		return nil, nil, err
+	}
+	if job.File == nil {
+		return nil, nil, domain.ErrExportFileNotFound
+	}
+
+	file, err := s.exports.files.Open(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return job, file, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// The download link checks its token before reading the job, so these run without a database
+func TestExportDownloadLink(t *testing.T) {
+	s := &SensorService{}
+	s.SetExportJobs(nil, []byte("key"), time.Hour, "https://tp25.example/")
+
+	job := &domain.Job{ID: "job1", File: &domain.JobFile{ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+	s.signDownload(job)
+	if !strings.HasPrefix(job.DownloadURL, "https://tp25.example/api/export-jobs/job1/download?token=") {
+		t.Fatalf("download_url %q", job.DownloadURL)
+	}
+	link, err := url.Parse(job.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := link.Query().Get("token")
+
+	if _, _, err := s.OpenExportDownload(context.Background(), "job2", token); err != domain.ErrInvalidDownloadToken {
+		t.Errorf("token of another job: got %v, want ErrInvalidDownloadToken", err)
+	}
+	if _, _, err := s.OpenExportDownload(context.Background(), "job1", ""); err != domain.ErrInvalidDownloadToken {
+		t.Errorf("no token: got %v, want ErrInvalidDownloadToken", err)
+	}
+
+	expired := s.exports.signer.Sign("job1", time.Now().Add(-time.Minute))
+	if _, _, err := s.OpenExportDownload(context.Background(), "job1", expired); err != domain.ErrExportFileExpired {
+		t.Errorf("expired token: got %v, want ErrExportFileExpired", err)
+	}
+}
+
+func TestSignDownloadSkipsExpiredFiles(t *testing.T) {
+	s := &SensorService{}
+	s.SetExportJobs(nil, []byte("key"), time.Hour, "")
+
+	job := &domain.Job{ID: "job1", File: &domain.JobFile{ExpiresAt: time.Now().Add(-time.Minute).Unix()}}
+	s.signDownload(job)
+	if job.DownloadURL != "" {
+		t.Errorf("expired file got download_url %q", job.DownloadURL)
+	}
+
+	running := &domain.Job{ID: "job2"}
+	s.signDownload(running)
+	if running.DownloadURL != "" {
+		t.Errorf("job without file got download_url %q", running.DownloadURL)
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/lib/xlsxtemplate"
+)
+
+// templateStatsKeys are the column keys accepted in the statistics row of an export template
+var templateStatsKeys = map[string]bool{
+	"index": true, "box_id": true, "box_name": true, "metric": true, "metric_name": true, "unit": true,
+	"count": true, "min": true, "max": true, "avg": true, "stddev": true,
+}
+
+// templateCellNames are the single-cell names of an export template
+var templateCellNames = []string{
+	domain.TemplateGroupName, domain.TemplateFromName, domain.TemplateToName, domain.TemplateGeneratedName,
+}
+
+// GetExportTemplate returns the export template of a group without its file
+func (s *SensorService) GetExportTemplate(ctx context.Context, groupID string) (*domain.ExportTemplate, error) {
+	return s.templateRepo.GetInfo(ctx, groupID)
+}
+
+// SaveExportTemplate validates an xlsx template and stores it as the group's export template,
+// replacing the previous one. An unusable template fails with a *domain.TemplateValidationError.
+func (s *SensorService) SaveExportTemplate(ctx context.Context, groupID, filename string, data []byte, actorID string) (*domain.ExportTemplate, error) {
+	if len(data) > domain.MaxExportTemplateSize {
+		return nil, domain.ErrExportTemplateTooLarge
+	}
+
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	tmpl, err := openExportTemplate(data)
+	if err != nil {
+		return nil, err
+	}
+	names := tmpl.Names()
+	tmpl.Close()
+
+	template := &domain.ExportTemplate{
+		GroupID:    groupID,
+		Filename:   filename,
+		Size:       int64(len(data)),
+		Names:      names,
+		Data:       data,
+		UploadedBy: actorID,
+	}
+	if err := s.templateRepo.Save(ctx, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func (s *SensorService) DeleteExportTemplate(ctx context.Context, groupID string) error {
+	return s.templateRepo.Delete(ctx, groupID)
+}
+
+// ExportWithTemplate fills the group's export template with the records and statistics of its boxes
+// over the time range and returns the resulting xlsx file with the number of record rows it holds.
+// Admin-only box fields are left empty when redacted.
+func (s *SensorService) ExportWithTemplate(ctx context.Context, groupID string, query *domain.QueryRecord, redacted bool) ([]byte, int64, error) {
+	// Statistics need a bounded range, and so does a report
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, 0, domain.ErrTimeRangeRequired
+	}
+
+	export, err := s.PrepareGroupExport(ctx, groupID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if redacted {
+		export.Boxes = domain.RedactBoxes(export.Boxes)
+	}
+
+	// Refuse up front rather than after filling most of the rows
+	if err := s.checkTemplateExport(ctx, export, query); err != nil {
+		return nil, 0, err
+	}
+
+	stored, err := s.templateRepo.Get(ctx, groupID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Templates are validated on upload, but re-check in case the rules changed since
+	tmpl, err := openExportTemplate(stored.Data)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tmpl.Close()
+
+	tmpl.SetValue(domain.TemplateGroupName, export.Group.Name)
+	tmpl.SetValue(domain.TemplateFromName, time.Unix(*query.TimeMin, 0))
+	tmpl.SetValue(domain.TemplateToName, time.Unix(*query.TimeMax, 0))
+	tmpl.SetValue(domain.TemplateGeneratedName, time.Now())
+
+	keys, _ := tmpl.Keys(domain.TemplateRecordsName)
+	rows, err := s.templateRecordRows(ctx, export, query, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	tmpl.SetRows(domain.TemplateRecordsName, rows)
+
+	if keys, err := tmpl.Keys(domain.TemplateStatsName); err == nil {
+		rows, err := s.templateStatsRows(ctx, export, query, keys)
+		if err != nil {
+			return nil, 0, err
+		}
+		tmpl.SetRows(domain.TemplateStatsName, rows)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Write(&buf); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), int64(len(rows)), nil
+}
+
+// checkTemplateExport refuses a template export of more record rows than a workbook takes or the export limit allows
+func (s *SensorService) checkTemplateExport(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord) error {
+	maxRows := int64(domain.MaxTemplateExportRows)
+	if s.exportMaxRows > 0 && s.exportMaxRows < maxRows {
+		maxRows = s.exportMaxRows
+	}
+	count, err := s.countGroupExportRows(ctx, export, query, false)
+	if err != nil {
+		return err
+	}
+	return checkExportRows(count, maxRows, domain.ExportXLSXRowBytes)
+}
+
+// templateRecordRows builds one row per record, box by box in time order
+func (s *SensorService) templateRecordRows(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord, keys []string) ([][]interface{}, error) {
+	var rows [][]interface{}
+	for i := range export.Boxes {
+		box := &export.Boxes[i]
+
+		err := s.repo.StreamRecords(ctx, box.ID, query, func(record domain.Record) error {
+			if len(rows) >= domain.MaxTemplateExportRows {
+				return domain.ErrTooManyTemplateRows
+			}
+
+			timestamp := record.GetTimestamp()
+			if timestamp > 1e12 {
+				timestamp = timestamp / 1000
+			}
+
+			row := make([]interface{}, len(keys))
+			for col, key := range keys {
+				switch key {
+				case "index":
+					row[col] = len(rows) + 1
+				case "time":
+					row[col] = time.Unix(timestamp, 0)
+				case "timestamp":
+					row[col] = timestamp
+				case "box_id":
+					row[col] = box.ID
+				case "box_name":
+					row[col] = box.Name
+				case "device_id":
+					row[col] = box.DeviceID
+				default:
+					if _, ok := record[key]; ok {
+						row[col] = record.GetFloat(key)
+					}
+				}
+			}
+			rows = append(rows, row)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// templateStatsRows builds one row per box and metric, in each box's metric display order
+func (s *SensorService) templateStatsRows(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord, keys []string) ([][]interface{}, error) {
+	var rows [][]interface{}
+	for i := range export.Boxes {
+		box := &export.Boxes[i]
+
+		var layout []domain.MetricLayout
+		var codes []string
+		for _, m := range export.Layouts[box.ID] {
+			if validateMetricCodes([]string{m.Code}) == nil {
+				layout = append(layout, m)
+				codes = append(codes, m.Code)
+			}
+		}
+		if len(codes) == 0 {
+			continue
+		}
+
+		stats, err := s.repo.RecordStats(ctx, box.ID, query, codes)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, stat := range stats {
+			row := make([]interface{}, len(keys))
+			for col, key := range keys {
+				switch key {
+				case "index":
+					row[col] = len(rows) + 1
+				case "box_id":
+					row[col] = box.ID
+				case "box_name":
+					row[col] = box.Name
+				case "metric":
+					row[col] = stat.Metric
+				case "metric_name":
+					row[col] = layout[j].Name
+				case "unit":
+					row[col] = layout[j].Unit
+				case "count":
+					row[col] = stat.Count
+				case "min":
+					row[col] = optionalFloat(stat.Min)
+				case "max":
+					row[col] = optionalFloat(stat.Max)
+				case "avg":
+					row[col] = optionalFloat(stat.Avg)
+				case "stddev":
+					row[col] = optionalFloat(stat.StdDev)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// optionalFloat leaves the cell empty for missing statistics
+func optionalFloat(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// openExportTemplate opens an xlsx template and checks its defined names. An unusable template
+// fails with a *domain.TemplateValidationError listing every problem found.
+func openExportTemplate(data []byte) (*xlsxtemplate.Template, error) {
+	tmpl, err := xlsxtemplate.Open(bytes.NewReader(data))
+	if err != nil {
+		return nil, &domain.TemplateValidationError{Problems: []string{"not a readable xlsx file: " + err.Error()}}
+	}
+
+	var problems []string
+	if _, ok := tmpl.Range(domain.TemplateRecordsName); !ok {
+		problems = append(problems, fmt.Sprintf("required defined name %s is missing", domain.TemplateRecordsName))
+	} else if keys, err := tmpl.Keys(domain.TemplateRecordsName); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = append(problems, emptyTemplateKeys(domain.TemplateRecordsName, keys)...)
+	}
+
+	if _, ok := tmpl.Range(domain.TemplateStatsName); ok {
+		if keys, err := tmpl.Keys(domain.TemplateStatsName); err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			problems = append(problems, emptyTemplateKeys(domain.TemplateStatsName, keys)...)
+			for _, key := range keys {
+				if key != "" && !templateStatsKeys[key] {
+					problems = append(problems, fmt.Sprintf("%s: unknown column key %q", domain.TemplateStatsName, key))
+				}
+			}
+		}
+	}
+
+	for _, name := range templateCellNames {
+		if rng, ok := tmpl.Range(name); ok && !rng.IsCell() {
+			problems = append(problems, fmt.Sprintf("defined name %s must refer to a single cell, refers to %s", name, rng.RefersTo))
+		}
+	}
+
+	if len(problems) > 0 {
+		tmpl.Close()
+		return nil, &domain.TemplateValidationError{Problems: problems}
+	}
+	return tmpl, nil
+}
+
+// emptyTemplateKeys reports the cells of a row name that hold no column key
+func emptyTemplateKeys(name string, keys []string) []string {
+	var problems []string
+	for i, key := range keys {
+		if key == "" {
+			problems = append(problems, fmt.Sprintf("%s: column %d has no column key", name, i+1))
+		}
+	}
+	return problems
+}
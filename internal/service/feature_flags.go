@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// featureFlagsCacheTTL is how long feature flags are served from memory before their setting is
+// read again, which bounds how long a change made by another instance takes to apply
+const featureFlagsCacheTTL = 10 * time.Second
+
+// FeatureFlagService resolves which features are on: their defaults in code, overridden by the
+// environment, overridden by admins at runtime through the setting domain.FeatureFlagsSettingKey
+type FeatureFlagService struct {
+	repo *mongodb.SettingRepository
+	env  map[string]bool
+
+	mu       sync.Mutex
+	states   []domain.FeatureState
+	loadedAt time.Time
+}
+
+func NewFeatureFlagService(repo *mongodb.SettingRepository, env map[string]bool) *FeatureFlagService {
+	for name := range env {
+		if !domain.KnownFeature(name) {
+			log.Printf("Feature flags: unknown feature %q in the environment, ignored", name)
+		}
+	}
+	return &FeatureFlagService{repo: repo, env: env, states: domain.ResolveFeatures(env, nil)}
+}
+
+// States returns the state of every feature with where it comes from. When their setting cannot
+// be read, the last known states are kept.
+func (s *FeatureFlagService) States(ctx context.Context) []domain.FeatureState {
+	s.mu.Lock()
+	states, fresh := s.states, time.Since(s.loadedAt) < featureFlagsCacheTTL
+	s.mu.Unlock()
+	if fresh {
+		return states
+	}
+
+	runtime, err := s.load(ctx)
+	if err != nil {
+		log.Printf("Feature flags: read setting: %v", err)
+		s.mu.Lock()
+		s.loadedAt = time.Now()
+		s.mu.Unlock()
+		return states
+	}
+	return s.apply(runtime)
+}
+
+// Flags returns which features are on
+func (s *FeatureFlagService) Flags(ctx context.Context) domain.FeatureFlags {
+	states := s.States(ctx)
+	flags := make(domain.FeatureFlags, len(states))
+	for _, state := range states {
+		flags[state.Name] = state.Enabled
+	}
+	return flags
+}
+
+// Enabled reports whether the feature is on
+func (s *FeatureFlagService) Enabled(ctx context.Context, feature domain.Feature) bool {
+	return s.Flags(ctx).Enabled(feature)
+}
+
+// Set turns a feature on or off at runtime, or drops its runtime override when params.Enabled is
+// nil, and persists the overrides
+func (s *FeatureFlagService) Set(ctx context.Context, name string, params domain.SetFeatureParams, actorID string) (*domain.FeatureState, error) {
+	if !domain.KnownFeature(name) {
+		return nil, domain.ErrFeatureNotFound
+	}
+
+	runtime, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if params.Enabled == nil {
+		delete(runtime, name)
+	} else {
+		runtime[name] = *params.Enabled
+	}
+
+	key := domain.FeatureFlagsSettingKey
+	_, err = s.repo.UpdateByKey(ctx, key, domain.UpdateSettingParams{Value: runtime}, actorID)
+	if err == domain.ErrSettingNotFound {
+		_, err = s.repo.Create(ctx, domain.CreateSettingParams{Key: key, Value: runtime})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, state := range s.apply(runtime) {
+		if string(state.Name) == name {
+			log.Printf("Feature %s set to %t (%s) by %s", name, state.Enabled, state.Source, actorID)
+			return &state, nil
+		}
+	}
+	return nil, domain.ErrFeatureNotFound
+}
+
+// load reads the runtime overrides from their setting; entries that are not booleans are ignored
+func (s *FeatureFlagService) load(ctx context.Context) (map[string]bool, error) {
+	runtime := map[string]bool{}
+	setting, err := s.repo.GetByKey(ctx, domain.FeatureFlagsSettingKey)
+	if err == domain.ErrSettingNotFound {
+		return runtime, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Setting values come back as generic documents
+	data, err := bson.Marshal(setting.Value)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := bson.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for name, value := range values {
+		if enabled, ok := value.(bool); ok {
+			runtime[name] = enabled
+		}
+	}
+	return runtime, nil
+}
+
+func (s *FeatureFlagService) apply(runtime map[string]bool) []domain.FeatureState {
+	states := domain.ResolveFeatures(s.env, runtime)
+	s.mu.Lock()
+	s.states = states
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return states
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+)
+
+// GroupStatus computes the indicators of a group: the freeboard of its dam from the crest elevation
+// of its note and the latest water level (WAU) of its primary box. A missing setting or reading is
+// listed in the freeboard's problems rather than computed as zero.
+func (s *SensorService) GroupStatus(ctx context.Context, groupID string) (*domain.GroupStatus, error) {
+	group, err := s.zoneRepo.GetGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &domain.GroupStatus{GroupID: group.ID}
+	freeboard := &status.Freeboard
+	if group.Note != nil {
+		freeboard.CrestElevation = group.Note.CrestElevation
+	}
+	if freeboard.CrestElevation == nil {
+		freeboard.Problems = append(freeboard.Problems, domain.FreeboardNoCrestElevation)
+	}
+
+	if group.PrimaryBoxID == nil {
+		freeboard.Problems = append(freeboard.Problems, domain.FreeboardNoPrimaryBox)
+		return status, nil
+	}
+	box, err := s.zoneRepo.GetBox(ctx, *group.PrimaryBoxID)
+	if err != nil && err != domain.ErrBoxNotFound {
+		return nil, err
+	}
+	if err == domain.ErrBoxNotFound || box.GroupID != group.ID {
+		freeboard.Problems = append(freeboard.Problems, domain.FreeboardPrimaryBoxNotFound)
+		return status, nil
+	}
+	freeboard.BoxID = box.ID
+
+	level, err := s.repo.LatestValue(ctx, box.ID, "WAU")
+	if err != nil {
+		return nil, err
+	}
+	if level == nil {
+		freeboard.Problems = append(freeboard.Problems, domain.FreeboardNoWaterLevel)
+		return status, nil
+	}
+	freeboard.WaterLevel = &level.Value
+	freeboard.Time = &level.Time
+
+	freeboard.Classify()
+	return status, nil
+}
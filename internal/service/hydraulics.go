@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/lib/interpolation"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// hydraulicsCacheTTL is how long a group's calculator is reused before its setting is read again,
+// which also bounds how long a restore through the settings API takes to reach ingestion
+const hydraulicsCacheTTL = time.Minute
+
+type cachedCalculator struct {
+	calculator *interpolation.HydraulicCalculator
+	loadedAt   time.Time
+}
+
+// hydraulicsCache holds the calculators of the groups with their own configuration
+type hydraulicsCache struct {
+	mu     sync.Mutex
+	groups map[string]cachedCalculator
+}
+
+// ExportHydraulics returns the hydraulic configuration applied to the boxes of a group,
+// the built-in one when the group has none
+func (s *SensorService) ExportHydraulics(ctx context.Context, groupID string) (*domain.HydraulicsExport, error) {
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	config, setting, err := s.groupHydraulics(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &domain.HydraulicsExport{GroupID: groupID}
+	if config == nil {
+		export.Default = true
+		export.Hydraulics = calculatorConfig(s.calculator)
+	} else {
+		export.SettingID = setting.ID
+		export.Hydraulics = *config
+	}
+
+	if export.Warnings, err = s.coverageWarnings(ctx, groupID, export.Hydraulics); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// ImportHydraulics validates a hydraulic configuration and makes it the group's. It is stored as
+// a new version of the group's setting, so a bad import is rolled back by restoring the previous version.
+func (s *SensorService) ImportHydraulics(ctx context.Context, groupID string, config domain.HydraulicsConfig, actorID string) (*domain.HydraulicsExport, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	key := domain.HydraulicsSettingKey(groupID)
+	setting, err := s.settingRepo.UpdateByKey(ctx, key, domain.UpdateSettingParams{Value: config}, actorID)
+	if err == domain.ErrSettingNotFound {
+		setting, err = s.settingRepo.Create(ctx, domain.CreateSettingParams{Key: key, Value: config})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.hydraulics.mu.Lock()
+	delete(s.hydraulics.groups, groupID)
+	s.hydraulics.mu.Unlock()
+
+	export := &domain.HydraulicsExport{GroupID: groupID, SettingID: setting.ID, Hydraulics: config}
+	if export.Warnings, err = s.coverageWarnings(ctx, groupID, config); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// CopyHydraulics imports the configuration of another group
+func (s *SensorService) CopyHydraulics(ctx context.Context, groupID, fromGroupID string, actorID string) (*domain.HydraulicsExport, error) {
+	if _, err := s.zoneRepo.GetGroup(ctx, fromGroupID); err != nil {
+		return nil, err
+	}
+
+	config, _, err := s.groupHydraulics(ctx, fromGroupID)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, domain.ErrHydraulicsNotConfigured
+	}
+
+	return s.ImportHydraulics(ctx, groupID, *config, actorID)
+}
+
+// groupHydraulics reads the configuration stored for a group, nil when it has none
+func (s *SensorService) groupHydraulics(ctx context.Context, groupID string) (*domain.HydraulicsConfig, *domain.Setting, error) {
+	setting, err := s.settingRepo.GetByKey(ctx, domain.HydraulicsSettingKey(groupID))
+	if err == domain.ErrSettingNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Setting values come back as generic documents
+	data, err := bson.Marshal(setting.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config domain.HydraulicsConfig
+	if err := bson.Unmarshal(data, &config); err != nil {
+		return nil, nil, err
+	}
+	return &config, setting, nil
+}
+
+// calculatorFor returns the calculator for the boxes of a group: one built from the group's
+// configuration when it has one, the built-in one otherwise
+func (s *SensorService) calculatorFor(ctx context.Context, groupID string) (*interpolation.HydraulicCalculator, error) {
+	s.hydraulics.mu.Lock()
+	cached, ok := s.hydraulics.groups[groupID]
+	s.hydraulics.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < hydraulicsCacheTTL {
+		return cached.calculator, nil
+	}
+
+	config, _, err := s.groupHydraulics(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	// A stored configuration that no longer validates (e.g. restored from an old version)
+	// falls back to the built-in curves rather than failing ingestion
+	calculator := s.calculator
+	if config != nil && config.Validate() == nil {
+		if custom, err := newCalculator(config); err == nil {
+			calculator = custom
+		}
+	}
+
+	s.hydraulics.mu.Lock()
+	s.hydraulics.groups[groupID] = cachedCalculator{calculator: calculator, loadedAt: time.Now()}
+	s.hydraulics.mu.Unlock()
+	return calculator, nil
+}
+
+func newCalculator(config *domain.HydraulicsConfig) (*interpolation.HydraulicCalculator, error) {
+	calculator := interpolation.NewHydraulicCalculator()
+	if err := calculator.SetVolumeCurve(domain.InterpolationPoints(config.VolumeCurve)); err != nil {
+		return nil, err
+	}
+	if len(config.FlowCurve) > 0 {
+		if err := calculator.SetFlowCurve(domain.InterpolationPoints(config.FlowCurve)); err != nil {
+			return nil, err
+		}
+	}
+	calculator.SetOverflowParams(config.OverflowM, config.OverflowB)
+	return calculator, nil
+}
+
+// coverageWarnings reports the boxes of a group whose historical water level (WAU) falls outside
+// the level range of the curves; V and Q are then extrapolated for those records
+func (s *SensorService) coverageWarnings(ctx context.Context, groupID string, config domain.HydraulicsConfig) ([]string, error) {
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	for _, box := range boxes {
+		min, max, err := s.repo.MetricRange(ctx, box.ID, "WAU", nil)
+		if err != nil {
+			return nil, err
+		}
+		if min == nil || max == nil {
+			continue
+		}
+		warnings = append(warnings, curveCoverage("volume_curve", config.VolumeCurve, box.ID, *min, *max)...)
+		if len(config.FlowCurve) > 0 {
+			warnings = append(warnings, curveCoverage("flow_curve", config.FlowCurve, box.ID, *min, *max)...)
+		}
+	}
+	return warnings, nil
+}
+
+func curveCoverage(field string, points []domain.CurvePoint, boxID string, min, max float64) []string {
+	if len(points) == 0 {
+		return nil
+	}
+	low, high := points[0].X, points[len(points)-1].X
+	if min >= low && max <= high {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s covers WAU %g to %g but box %s recorded %g to %g", field, low, high, boxID, min, max)}
+}
+
+// calculatorConfig describes the curves of a calculator
+func calculatorConfig(calculator *interpolation.HydraulicCalculator) domain.HydraulicsConfig {
+	config := domain.HydraulicsConfig{OverflowM: calculator.OverflowM, OverflowB: calculator.OverflowB}
+	if calculator.VolumeCurve != nil {
+		for _, p := range calculator.VolumeCurve.Points {
+			config.VolumeCurve = append(config.VolumeCurve, domain.CurvePoint{X: p.X, Y: p.Y})
+		}
+	}
+	if calculator.FlowCurve != nil {
+		for _, p := range calculator.FlowCurve.Points {
+			config.FlowCurve = append(config.FlowCurve, domain.CurvePoint{X: p.X, Y: p.Y})
+		}
+	}
+	return config
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+)
+
+// GroupInflow estimates the inflow of a group's reservoir over query's time range from the records of
+// the box measuring its level: boxID when given, else the first box of the group reporting WAU.
+// Volumes come from the group's volume curve, outflows from the Q and Q_of stored with the records.
+func (s *SensorService) GroupInflow(ctx context.Context, groupID, boxID string, query *domain.QueryRecord, interval int64) (*domain.InflowSeries, error) {
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, domain.ErrTimeRangeRequired
+	}
+	from, to := *query.TimeMin, *query.TimeMax
+	if from > to {
+		return nil, domain.ErrInvalidTimeRange
+	}
+	if (to-from)/interval+1 > domain.MaxInflowIntervals {
+		return nil, domain.ErrInflowRangeTooLong
+	}
+
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+	box, err := s.levelBox(ctx, groupID, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	calculator, err := s.calculatorFor(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	// One interval earlier, for the level the first interval starts from
+	since := from - interval
+	var samples []domain.InflowSample
+	err = s.repo.StreamRecords(ctx, box.ID, &domain.QueryRecord{TimeMin: &since, TimeMax: query.TimeMax}, func(record domain.Record) error {
+		if !record.HasNumber("WAU") {
+			return nil
+		}
+		wau := record.GetFloat("WAU")
+		sample := domain.InflowSample{Time: record.GetTimestamp(), WAU: wau, Volume: calculator.CalculateWaterIndex(wau)}
+		if record.HasNumber("Q") {
+			q := record.GetFloat("Q")
+			sample.Q = &q
+		}
+		if record.HasNumber("Q_of") {
+			qOf := record.GetFloat("Q_of")
+			sample.QOf = &qOf
+		}
+		sample.HasFlow = sample.Q != nil || sample.QOf != nil
+		samples = append(samples, sample)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.InflowSeries{
+		GroupID:          groupID,
+		BoxID:            box.ID,
+		TimeMin:          from,
+		TimeMax:          to,
+		Interval:         interval,
+		ExpectedInterval: box.ExpectedIntervalAt(from),
+		DefaultCurve:     calculator == s.calculator,
+		Points:           domain.EstimateInflow(samples, from, to, interval, box.ExpectedSamplesIn),
+	}, nil
+}
+
+// levelBox returns the box of the group measuring the reservoir level
+func (s *SensorService) levelBox(ctx context.Context, groupID, boxID string) (*domain.Box, error) {
+	if boxID != "" {
+		box, err := s.zoneRepo.GetBox(ctx, boxID)
+		if err != nil {
+			return nil, err
+		}
+		if box.GroupID != groupID {
+			return nil, domain.ErrBoxNotFound
+		}
+		return box, nil
+	}
+
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+	if err != nil {
+		return nil, err
+	}
+	domain.SortBoxes(boxes)
+	for i := range boxes {
+		if boxHasMetric(&boxes[i], "WAU") {
+			return &boxes[i], nil
+		}
+	}
+	return nil, domain.ErrNoLevelBox
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/lib/metrics"
+)
+
+// Reasons records are refused for, as counted by tp25_ingest_rejections_total besides the
+// validation reasons of domain.IngestRecord.Validate
+const (
+	rejectDecommissioned = "box decommissioned"
+	rejectConflict       = "merge conflict"
+	rejectDuplicate      = "duplicate"
+	rejectQueueFull      = "queue full"
+	rejectReadOnly       = "read-only"
+)
+
+// ingestMetrics counts ingestion outcomes for scraping by Prometheus
+type ingestMetrics struct {
+	registry   *metrics.Registry
+	ingested   *metrics.CounterVec
+	derived    *metrics.CounterVec
+	defaults   *metrics.CounterVec
+	rejections *metrics.CounterVec
+
+	fallbacks defaultHydraulicsTracker
+}
+
+func newIngestMetrics(s *SensorService) *ingestMetrics {
+	registry := metrics.NewRegistry()
+	m := &ingestMetrics{
+		registry: registry,
+		ingested: registry.NewCounterVec("tp25_records_ingested_total",
+			"Records accepted for storage, by box.", "box_id"),
+		derived: registry.NewCounterVec("tp25_derived_values_total",
+			"Records by whether V, Q and Q_of were derived (computed) or the record had no WAU (skipped).", "box_id", "outcome"),
+		defaults: registry.NewCounterVec("tp25_hydraulics_default_total",
+			"Records whose derived values used the built-in curves and weir parameters, the group having no hydraulic configuration.", "group_id", "box_id"),
+		rejections: registry.NewCounterVec("tp25_ingest_rejections_total",
+			"Records refused, by reason.", "reason"),
+		fallbacks: defaultHydraulicsTracker{boxes: make(map[string]*defaultHydraulicsUse)},
+	}
+
+	registry.NewGaugeFunc("tp25_ingest_queue_depth", "Records waiting in the ingestion queue.", nil, func() []metrics.Sample {
+		if s.ingest == nil {
+			return nil
+		}
+		return []metrics.Sample{{Value: float64(s.ingest.Stats().Depth)}}
+	})
+	registry.NewGaugeFunc("tp25_ingest_write_failures",
+		"Acknowledged records the queue failed to write since the server started, by what became of them: kept to write later (dead_lettered), written from there (replayed) or only logged (lost).",
+		[]string{"outcome"}, func() []metrics.Sample {
+			if s.ingest == nil {
+				return nil
+			}
+			stats := s.ingest.Stats()
+			return []metrics.Sample{
+				{Labels: []string{"dead_lettered"}, Value: float64(stats.DeadLettered)},
+				{Labels: []string{"lost"}, Value: float64(stats.Lost)},
+				{Labels: []string{"replayed"}, Value: float64(stats.Replayed)},
+			}
+		})
+	registry.NewGaugeFunc("tp25_hydraulics_unconfigured_boxes",
+		"Boxes whose records used the built-in hydraulics over the last 24 hours.", nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(m.fallbacks.count(time.Now()))}}
+		})
+	return m
+}
+
+// WriteMetrics writes the ingestion metrics in the Prometheus text format
+func (s *SensorService) WriteMetrics(w io.Writer) error {
+	return s.metrics.registry.WriteText(w)
+}
+
+// CountRejection counts a record refused before reaching the service, e.g. by body validation
+func (s *SensorService) CountRejection(reason string) {
+	s.metrics.rejections.Inc(reason)
+}
+
+// countRejection counts the service errors that refuse a record
+func (s *SensorService) countRejection(err error) {
+	switch err {
+	case domain.ErrBoxDecommissioned:
+		s.CountRejection(rejectDecommissioned)
+	case domain.ErrRecordConflict:
+		s.CountRejection(rejectConflict)
+	case domain.ErrDuplicateRecord:
+		s.CountRejection(rejectDuplicate)
+	case domain.ErrIngestQueueFull:
+		s.CountRejection(rejectQueueFull)
+	case domain.ErrReadOnly:
+		s.CountRejection(rejectReadOnly)
+	}
+}
+
+// countDerivation counts whether the hydraulic values of a record were derived, and with the
+// built-in configuration when defaulted
+func (s *SensorService) countDerivation(box *domain.Box, boxID string, computed, defaulted bool) {
+	if !computed {
+		s.metrics.derived.Inc(boxID, "skipped")
+		return
+	}
+	s.metrics.derived.Inc(boxID, "computed")
+	if defaulted && box != nil {
+		s.metrics.defaults.Inc(box.GroupID, box.ID)
+		s.metrics.fallbacks.record(box.GroupID, box.ID, time.Now())
+	}
+}
+
+// UnconfiguredHydraulics lists the groups whose boxes had records derived with the built-in
+// hydraulics over the last 24 hours, as seen by this server since it started
+func (s *SensorService) UnconfiguredHydraulics(ctx context.Context) ([]domain.UnconfiguredGroup, error) {
+	uses := s.metrics.fallbacks.recent(time.Now())
+
+	groups := []domain.UnconfiguredGroup{}
+	index := map[string]int{}
+	for _, use := range uses {
+		i, ok := index[use.groupID]
+		if !ok {
+			group := domain.UnconfiguredGroup{GroupID: use.groupID}
+			if g, err := s.zoneRepo.GetGroup(ctx, use.groupID); err == nil {
+				group.Name = g.Name
+			} else if err != domain.ErrBoxGroupNotFound {
+				return nil, err
+			}
+			i = len(groups)
+			index[use.groupID] = i
+			groups = append(groups, group)
+		}
+
+		box := domain.UnconfiguredBox{BoxID: use.boxID, Records: use.records, LastAt: use.lastAt}
+		if b, err := s.zoneRepo.GetBox(ctx, use.boxID); err == nil {
+			box.Name = b.Name
+		} else if err != domain.ErrBoxNotFound {
+			return nil, err
+		}
+		groups[i].Boxes = append(groups[i].Boxes, box)
+	}
+	return groups, nil
+}
+
+// defaultHydraulicsTracker counts, by box and hour, the records derived with the built-in hydraulics
+type defaultHydraulicsTracker struct {
+	mu    sync.Mutex
+	boxes map[string]*defaultHydraulicsUse
+}
+
+const trackerHours = domain.UnconfiguredHydraulicsWindow / 3600
+
+type defaultHydraulicsUse struct {
+	groupID string
+	hours   [trackerHours]int64 // hour (seconds / 3600) each count is for
+	counts  [trackerHours]int64
+	lastAt  int64
+}
+
+type defaultHydraulicsSummary struct {
+	groupID, boxID string
+	records        int64
+	lastAt         int64
+}
+
+func (t *defaultHydraulicsTracker) record(groupID, boxID string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	use, ok := t.boxes[boxID]
+	if !ok {
+		use = &defaultHydraulicsUse{}
+		t.boxes[boxID] = use
+	}
+	use.groupID = groupID
+	use.lastAt = now.Unix()
+
+	hour := now.Unix() / 3600
+	slot := hour % trackerHours
+	if use.hours[slot] != hour {
+		use.hours[slot] = hour
+		use.counts[slot] = 0
+	}
+	use.counts[slot]++
+}
+
+// recent summarizes the boxes with a record in the window, by group then box, and forgets the others
+func (t *defaultHydraulicsTracker) recent(now time.Time) []defaultHydraulicsSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	oldest := now.Unix()/3600 - trackerHours + 1
+	var summaries []defaultHydraulicsSummary
+	for boxID, use := range t.boxes {
+		if use.lastAt < now.Unix()-domain.UnconfiguredHydraulicsWindow {
+			delete(t.boxes, boxID)
+			continue
+		}
+		summary := defaultHydraulicsSummary{groupID: use.groupID, boxID: boxID, lastAt: use.lastAt}
+		for slot, hour := range use.hours {
+			if hour >= oldest {
+				summary.records += use.counts[slot]
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].groupID != summaries[j].groupID {
+			return summaries[i].groupID < summaries[j].groupID
+		}
+		return summaries[i].boxID < summaries[j].boxID
+	})
+	return summaries
+}
+
+func (t *defaultHydraulicsTracker) count(now time.Time) int {
+	return len(t.recent(now))
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"sync"
+
+	"tp25-api/internal/domain"
+)
+
+// pendingRecords indexes the records of the ingest queue not written yet by box, so the merge
+// policies see them besides the stored records
+type pendingRecords struct {
+	mu    sync.Mutex
+	boxes map[string]map[string]*pendingRecord // box ID -> receipt -> record
+}
+
+type pendingRecord struct {
+	record  domain.Record
+	writing bool          // taken by a worker, which reads record without the lock
+	late    domain.Record // fields merged while writing, set once the record is stored
+}
+
+func (p *pendingRecords) add(boxID, receipt string, record domain.Record) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.boxes == nil {
+		p.boxes = make(map[string]map[string]*pendingRecord)
+	}
+	if p.boxes[boxID] == nil {
+		p.boxes[boxID] = make(map[string]*pendingRecord)
+	}
+	p.boxes[boxID][receipt] = &pendingRecord{record: record}
+}
+
+// claim marks the items as being written: fields merged into them from now on are kept apart
+func (p *pendingRecords) claim(items []ingestItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, item := range items {
+		if pending := p.boxes[item.boxID][item.receipt]; pending != nil {
+			pending.writing = true
+		}
+	}
+}
+
+// done removes the items of a box once written or dead-lettered, and returns the fields merged
+// into them while they were written, by receipt
+func (p *pendingRecords) done(boxID string, items []ingestItem) map[string]domain.Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var late map[string]domain.Record
+	for _, item := range items {
+		pending := p.boxes[boxID][item.receipt]
+		if pending == nil {
+			continue
+		}
+		if len(pending.late) > 0 {
+			if late == nil {
+				late = make(map[string]domain.Record)
+			}
+			late[item.receipt] = pending.late
+		}
+		delete(p.boxes[boxID], item.receipt)
+	}
+	if len(p.boxes[boxID]) == 0 {
+		delete(p.boxes, boxID)
+	}
+	return late
+}
+
+// merge finds the pending record of the box nearest to timestamp within window seconds and passes
+// it to fn, which returns the fields to set on it. It reports false when there is none.
+func (p *pendingRecords) merge(boxID string, timestamp, window int64, fn func(existing domain.Record) (domain.Record, error)) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var nearest *pendingRecord
+	var distance int64
+	for _, pending := range p.boxes[boxID] {
+		d := pending.record.GetTimestamp() - timestamp
+		if d < 0 {
+			d = -d
+		}
+		if d <= window && (nearest == nil || d < distance) {
+			nearest, distance = pending, d
+		}
+	}
+	if nearest == nil {
+		return false, nil
+	}
+
+	existing := nearest.record
+	if len(nearest.late) > 0 {
+		existing = make(domain.Record, len(nearest.record)+len(nearest.late))
+		for key, value := range nearest.record {
+			existing[key] = value
+		}
+		for key, value := range nearest.late {
+			existing[key] = value
+		}
+	}
+	fields, err := fn(existing)
+	if err != nil {
+		return false, err
+	}
+	target := nearest.record
+	if nearest.writing {
+		if nearest.late == nil {
+			nearest.late = domain.Record{}
+		}
+		target = nearest.late
+	}
+	for key, value := range fields {
+		target[key] = value
+	}
+	return true, nil
+}
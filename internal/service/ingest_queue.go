@@ -0,0 +1,459 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib"
+)
+
+// ingestWriteAttempts bounds retries of a batch that failed for reasons other than duplicates.
+// Records still failing are kept as dead letters and replayed later.
+const ingestWriteAttempts = 3
+
+type ingestItem struct {
+	receipt string
+	boxID   string
+	record  domain.Record
+}
+
+// IngestQueue buffers incoming records in memory and writes them with one InsertMany per box,
+// so a burst of reports becomes a few large writes and Mongo latency no longer reaches devices.
+// When the buffer is full, Enqueue fails fast with ErrIngestQueueFull instead of blocking.
+type IngestQueue struct {
+	repo      *mongodb.SensorRepository
+	rollups   *mongodb.RollupRepository
+	items     chan ingestItem
+	batchSize int
+	wg        sync.WaitGroup
+	onWritten func(boxID string) // called once records of the box were inserted
+
+	deadLetters *mongodb.IngestDeadLetterRepository // where failed records wait to be replayed, lost when nil
+	stop        chan struct{}                       // closed by Close, ending the replays
+
+	pending pendingRecords // records enqueued and not written yet, for the merge policies
+
+	mu     sync.RWMutex // guards closed against concurrent Enqueue
+	closed bool
+
+	pauseMu sync.Mutex
+	resumed chan struct{} // open while writes are paused, closed when they resume
+
+	enqueued       atomic.Int64
+	rejected       atomic.Int64
+	inserted       atomic.Int64
+	duplicates     atomic.Int64
+	failed         atomic.Int64
+	deadLettered   atomic.Int64
+	replayed       atomic.Int64
+	lost           atomic.Int64
+	batches        atomic.Int64
+	batchLatencyMs atomic.Int64 // sum over all batches
+	lastBatchMs    atomic.Int64
+}
+
+// NewIngestQueue starts workers writing records from a buffer of size records. onWritten, when not
+// nil, is called from a worker after records of a box were inserted.
+func NewIngestQueue(repo *mongodb.SensorRepository, rollups *mongodb.RollupRepository, size, workers, batchSize int, onWritten func(boxID string)) *IngestQueue {
+	q := &IngestQueue{
+		repo:      repo,
+		rollups:   rollups,
+		items:     make(chan ingestItem, size),
+		batchSize: batchSize,
+		onWritten: onWritten,
+		stop:      make(chan struct{}),
+	}
+
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Enqueue buffers a record for writing and returns its receipt
+func (q *IngestQueue) Enqueue(boxID string, record domain.Record) (*domain.IngestReceipt, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return nil, domain.ErrIngestQueueClosed
+	}
+
+	receipt := &domain.IngestReceipt{
+		ID:        lib.Rand.Char(16),
+		BoxID:     boxID,
+		Timestamp: record.GetTimestamp(),
+		QueuedAt:  time.Now().UnixMilli(),
+	}
+
+	item := ingestItem{receipt: receipt.ID, boxID: boxID, record: record}
+	// Indexed before a worker can take it, so it is never written without being indexed
+	q.pending.add(boxID, item.receipt, record)
+	select {
+	case q.items <- item:
+		q.enqueued.Add(1)
+		return receipt, nil
+	default:
+		q.pending.done(boxID, []ingestItem{item})
+		q.rejected.Add(1)
+		return nil, domain.ErrIngestQueueFull
+	}
+}
+
+// SetPaused holds records in the buffer instead of writing them, or writes the held records again.
+// Records keep being accepted while paused, until the buffer is full.
+func (q *IngestQueue) SetPaused(paused bool) {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+
+	if paused && q.resumed == nil {
+		q.resumed = make(chan struct{})
+	}
+	if !paused && q.resumed != nil {
+		close(q.resumed)
+		q.resumed = nil
+	}
+}
+
+// Paused reports whether writes are held
+func (q *IngestQueue) Paused() bool {
+	q.pauseMu.Lock()
+	defer q.pauseMu.Unlock()
+	return q.resumed != nil
+}
+
+// waitResumed blocks while writes are paused
+func (q *IngestQueue) waitResumed() {
+	q.pauseMu.Lock()
+	resumed := q.resumed
+	q.pauseMu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// Close stops accepting records and waits until every buffered record is written or ctx ends.
+// Held records are written even when writes are paused, rather than lost with the process.
+func (q *IngestQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	if q.Paused() {
+		log.Printf("Ingest: writing %d held records before shutdown", len(q.items))
+		q.SetPaused(false)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the queue depth and write counters
+func (q *IngestQueue) Stats() domain.IngestStats {
+	stats := domain.IngestStats{
+		Depth:       len(q.items),
+		Capacity:    cap(q.items),
+		Enqueued:    q.enqueued.Load(),
+		Rejected:    q.rejected.Load(),
+		Inserted:    q.inserted.Load(),
+		Duplicates:  q.duplicates.Load(),
+		Failed:      q.failed.Load(),
+		Batches:     q.batches.Load(),
+		LastBatchMs: q.lastBatchMs.Load(),
+		Paused:      q.Paused(),
+
+		DeadLettered: q.deadLettered.Load(),
+		Replayed:     q.replayed.Load(),
+		Lost:         q.lost.Load(),
+	}
+	if stats.Batches > 0 {
+		stats.AvgBatchMs = float64(q.batchLatencyMs.Load()) / float64(stats.Batches)
+	}
+	return stats
+}
+
+// worker takes whatever is buffered, up to batchSize records, and writes it. Batches grow
+// with the load without adding latency when traffic is light.
+func (q *IngestQueue) worker() {
+	defer q.wg.Done()
+
+	batch := make([]ingestItem, 0, q.batchSize)
+	for item := range q.items {
+		batch = append(batch[:0], item)
+	drain:
+		for len(batch) < q.batchSize {
+			select {
+			case next, ok := <-q.items:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		q.waitResumed()
+		q.pending.claim(batch)
+		q.write(batch)
+	}
+}
+
+func (q *IngestQueue) write(batch []ingestItem) {
+	start := time.Now()
+
+	byBox := make(map[string][]ingestItem)
+	for _, item := range batch {
+		byBox[item.boxID] = append(byBox[item.boxID], item)
+	}
+
+	for boxID, items := range byBox {
+		records := make([]domain.Record, len(items))
+		for i, item := range items {
+			records[i] = item.record
+		}
+
+		var duplicates []int
+		var err error
+		attempt := 1
+		for ; attempt <= ingestWriteAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			duplicates, err = q.repo.InsertRecords(ctx, boxID, records)
+			cancel()
+			if err == nil || attempt == ingestWriteAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+		}
+
+		late := q.pending.done(boxID, items)
+		if err != nil {
+			// Kept records are replayed with the fields merged into them meanwhile
+			for _, item := range items {
+				for key, value := range late[item.receipt] {
+					item.record[key] = value
+				}
+			}
+			q.failed.Add(int64(len(items)))
+			q.deadLetter(boxID, items, err)
+			continue
+		}
+		q.duplicates.Add(int64(len(duplicates)))
+		q.inserted.Add(int64(len(items) - len(duplicates)))
+		if q.onWritten != nil && len(duplicates) < len(items) {
+			q.onWritten(boxID)
+		}
+
+		// After a retry some records reported as duplicates may have been inserted by the failed
+		// attempt, so which ones this batch added is unknown: leave their days to the raw reports
+		q.rollup(boxID, records, duplicates, attempt > 1)
+		q.mergeLate(boxID, items, late)
+	}
+
+	elapsed := time.Since(start).Milliseconds()
+	q.batches.Add(1)
+	q.batchLatencyMs.Add(elapsed)
+	q.lastBatchMs.Store(elapsed)
+}
+
+// deadLetter keeps records that failed to write for the replays. Records that cannot be kept either
+// are logged in full, the last place they exist.
+func (q *IngestQueue) deadLetter(boxID string, items []ingestItem, writeErr error) {
+	if q.deadLetters != nil {
+		now := time.Now().UnixMilli()
+		letters := make([]domain.IngestDeadLetter, len(items))
+		for i, item := range items {
+			letters[i] = domain.IngestDeadLetter{
+				ID:       item.receipt,
+				BoxID:    boxID,
+				Record:   item.record,
+				Error:    writeErr.Error(),
+				Attempts: ingestWriteAttempts,
+				CTime:    now,
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := q.deadLetters.Save(ctx, letters)
+		cancel()
+		if err == nil {
+			q.deadLettered.Add(int64(len(items)))
+			log.Printf("Ingest: kept %d records of box %s to write later: %v", len(items), boxID, writeErr)
+			return
+		}
+		log.Printf("Ingest: keep records of box %s to write later: %v", boxID, err)
+	}
+
+	q.lost.Add(int64(len(items)))
+	for _, item := range items {
+		data, _ := json.Marshal(item.record)
+		log.Printf("Ingest: dropped record %s of box %s: %v: %s", item.receipt, boxID, writeErr, data)
+	}
+}
+
+// SetDeadLetters keeps the records that fail to write in deadLetters instead of dropping them,
+// and tries to write them again every interval
+func (q *IngestQueue) SetDeadLetters(deadLetters *mongodb.IngestDeadLetterRepository, interval time.Duration) {
+	q.deadLetters = deadLetters
+	if interval > 0 {
+		go q.replayLoop(interval)
+	}
+}
+
+func (q *IngestQueue) replayLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+		if q.Paused() {
+			continue
+		}
+		for q.replay() {
+		}
+	}
+}
+
+// replay writes the oldest dead letters again, box by box, and forgets the ones written. It
+// reports whether a full batch was written, so more may be waiting.
+func (q *IngestQueue) replay() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	letters, err := q.deadLetters.Oldest(ctx, q.batchSize)
+	if err != nil {
+		log.Printf("Ingest: read dead letters: %v", err)
+		return false
+	}
+
+	byBox := make(map[string][]domain.IngestDeadLetter)
+	for _, letter := range letters {
+		byBox[letter.BoxID] = append(byBox[letter.BoxID], letter)
+	}
+
+	written := 0
+	for boxID, letters := range byBox {
+		records := make([]domain.Record, len(letters))
+		ids := make([]string, len(letters))
+		for i, letter := range letters {
+			records[i] = letter.Record
+			ids[i] = letter.ID
+		}
+
+		duplicates, err := q.repo.InsertRecords(ctx, boxID, records)
+		if err != nil {
+			log.Printf("Ingest: replay %d records of box %s: %v", len(records), boxID, err)
+			if err := q.deadLetters.Failed(ctx, ids, err); err != nil {
+				log.Printf("Ingest: count the replay of box %s: %v", boxID, err)
+			}
+			continue
+		}
+		// A record written but not forgotten is replayed again and then skipped as a duplicate
+		if err := q.deadLetters.Delete(ctx, ids); err != nil {
+			log.Printf("Ingest: forget the replayed records of box %s: %v", boxID, err)
+		}
+
+		written += len(records)
+		q.replayed.Add(int64(len(records)))
+		q.duplicates.Add(int64(len(duplicates)))
+		q.inserted.Add(int64(len(records) - len(duplicates)))
+		if q.onWritten != nil && len(duplicates) < len(records) {
+			q.onWritten(boxID)
+		}
+		// Earlier attempts may have written some of them, so their days are left to the raw reports
+		q.rollup(boxID, records, duplicates, true)
+	}
+	if written > 0 {
+		log.Printf("Ingest: replayed %d kept records", written)
+	}
+	return len(letters) == q.batchSize && written == len(letters)
+}
+
+// mergeLate sets on the stored records the fields merged into them while they were written, and
+// marks their days stale as the rollups were taken without them
+func (q *IngestQueue) mergeLate(boxID string, items []ingestItem, late map[string]domain.Record) {
+	if len(late) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var dates []string
+	for _, item := range items {
+		fields := late[item.receipt]
+		if len(fields) == 0 {
+			continue
+		}
+		if err := q.repo.UpdateRecordFields(ctx, boxID, item.record["_id"], fields); err != nil {
+			log.Printf("Ingest: merge fields %v into record %v of box %s: %v", fields, item.record["_id"], boxID, err)
+			continue
+		}
+		dates = append(dates, domain.RollupDate(item.record.GetTimestamp()))
+	}
+	if err := q.rollups.MarkStale(ctx, boxID, dates); err != nil {
+		log.Printf("Ingest: mark daily rollups of box %s stale: %v", boxID, err)
+	}
+}
+
+// rollup adds the inserted records to the daily rollups of the box, or marks their days stale
+func (q *IngestQueue) rollup(boxID string, records []domain.Record, duplicates []int, retried bool) {
+	skip := make(map[int]bool, len(duplicates))
+	for _, i := range duplicates {
+		skip[i] = true
+	}
+	inserted := make([]domain.Record, 0, len(records)-len(duplicates))
+	for i, record := range records {
+		if !skip[i] {
+			inserted = append(inserted, record)
+		}
+	}
+
+	rollups, unsafe := domain.RollupRecords(boxID, inserted)
+	if retried {
+		for _, rollup := range rollups {
+			unsafe = append(unsafe, rollup.Date)
+		}
+		rollups = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := q.rollups.Apply(ctx, boxID, rollups); err != nil {
+		log.Printf("Ingest: update daily rollups of box %s: %v", boxID, err)
+		unsafe = append(unsafe, rollupDates(rollups)...)
+	}
+	if err := q.rollups.MarkStale(ctx, boxID, unsafe); err != nil {
+		log.Printf("Ingest: mark daily rollups of box %s stale: %v", boxID, err)
+	}
+}
+
+func rollupDates(rollups []*domain.DailyRollup) []string {
+	dates := make([]string, len(rollups))
+	for i, rollup := range rollups {
+		dates[i] = rollup.Date
+	}
+	return dates
+}
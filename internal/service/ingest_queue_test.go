@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"tp25-api/internal/domain"
+)
+
+// Without a dead-letter store, failed records are counted as lost rather than silently dropped
+func TestDeadLetterWithoutStore(t *testing.T) {
+	q := &IngestQueue{}
+	items := []ingestItem{
+		{receipt: "r1", boxID: "box", record: domain.Record{"t": int64(1), "WAU": 1.5}},
+		{receipt: "r2", boxID: "box", record: domain.Record{"t": int64(2), "WAU": 1.6}},
+	}
+	q.deadLetter("box", items, errors.New("write failed"))
+
+	stats := q.Stats()
+	if stats.Lost != 2 || stats.DeadLettered != 0 {
+		t.Errorf("lost %d, dead lettered %d; want 2 and 0", stats.Lost, stats.DeadLettered)
+	}
+}
+
+// A record refused after its rates were derived must not become the base of the next rate
+func TestRatesCommittedOnlyOnceStored(t *testing.T) {
+	s := &SensorService{lastSamples: map[string]map[string]domain.RecordValueAt{}, rateHorizon: domain.DefaultRateHorizon}
+	box := &domain.Box{ID: "box", Metrics: []domain.BoxMetric{{Code: "WAU", Rate: true}}}
+	s.lastSamples[box.ID] = map[string]domain.RecordValueAt{"WAU": {Time: 0, Value: 10}}
+	ctx := context.Background()
+
+	refused := domain.Record{"WAU": 100.0}
+	s.applyRates(ctx, box, refused, 1800)
+	if _, ok := refused["WAU"+domain.RateSuffix]; !ok {
+		t.Fatal("no rate derived from the cached sample")
+	}
+
+	stored := domain.Record{"WAU": 12.0}
+	rates := s.applyRates(ctx, box, stored, 3600)
+	if got := stored.GetFloat("WAU" + domain.RateSuffix); got != 2 {
+		t.Errorf("rate %v after a refused record, want 2 per hour from the stored sample", got)
+	}
+	s.commitRates(rates)
+
+	next := domain.Record{"WAU": 13.0}
+	s.applyRates(ctx, box, next, 7200)
+	if got := next.GetFloat("WAU" + domain.RateSuffix); got != 1 {
+		t.Errorf("rate %v after a stored record, want 1 per hour", got)
+	}
+}
+
+// A slower request committing an older sample does not replace a newer one
+func TestCommitRatesKeepsNewerSample(t *testing.T) {
+	s := &SensorService{lastSamples: map[string]map[string]domain.RecordValueAt{}}
+	s.commitRates(&rateSamples{boxID: "box", samples: map[string]domain.RecordValueAt{"WAU": {Time: 200, Value: 2}}})
+	s.commitRates(&rateSamples{boxID: "box", samples: map[string]domain.RecordValueAt{"WAU": {Time: 100, Value: 1}}})
+
+	if got := s.lastSamples["box"]["WAU"]; got.Time != 200 {
+		t.Errorf("cached sample at %d, want 200", got.Time)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// ingestStatsCacheTTL is how long ingest stats are served from memory; dashboards poll them
+const ingestStatsCacheTTL = 30 * time.Second
+
+type cachedIngestStats struct {
+	box   *domain.BoxIngestStats
+	group *domain.GroupIngestStats
+	at    time.Time
+}
+
+// ingestStatsCache holds recent ingest stats by box ID and by group ID
+type ingestStatsCache struct {
+	mu     sync.Mutex
+	boxes  map[string]cachedIngestStats
+	groups map[string]cachedIngestStats
+}
+
+func (c *ingestStatsCache) get(entries map[string]cachedIngestStats, id string) (cachedIngestStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := entries[id]
+	if !ok || time.Since(cached.at) >= ingestStatsCacheTTL {
+		return cachedIngestStats{}, false
+	}
+	return cached, true
+}
+
+func (c *ingestStatsCache) put(entries map[string]cachedIngestStats, id string, entry cachedIngestStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop expired entries now and then so boxes no longer polled do not pile up
+	for key, cached := range entries {
+		if time.Since(cached.at) >= ingestStatsCacheTTL {
+			delete(entries, key)
+		}
+	}
+	entries[id] = entry
+}
+
+// BoxIngestStats counts the records a box sent over the last hour, day and week
+func (s *SensorService) BoxIngestStats(ctx context.Context, boxID string) (*domain.BoxIngestStats, error) {
+	if cached, ok := s.ingestStats.get(s.ingestStats.boxes, boxID); ok {
+		return cached.box, nil
+	}
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+
+	stats, err := s.repo.BoxIngestStats(ctx, boxID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	s.ingestStats.put(s.ingestStats.boxes, boxID, cachedIngestStats{box: &stats, at: time.Now()})
+	return &stats, nil
+}
+
+// GroupIngestStats totals the ingest stats of a group's boxes, taken concurrently
+func (s *SensorService) GroupIngestStats(ctx context.Context, groupID string) (*domain.GroupIngestStats, error) {
+	if cached, ok := s.ingestStats.get(s.ingestStats.groups, groupID); ok {
+		return cached.group, nil
+	}
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+	if err != nil {
+		return nil, err
+	}
+	boxIDs := make([]string, len(boxes))
+	for i, box := range boxes {
+		boxIDs[i] = box.ID
+	}
+
+	now := time.Now().Unix()
+	perBox, err := s.repo.GroupIngestStats(ctx, boxIDs, now)
+	if err != nil {
+		return nil, err
+	}
+	stats := domain.NewGroupIngestStats(groupID, perBox, now)
+	s.ingestStats.put(s.ingestStats.groups, groupID, cachedIngestStats{group: stats, at: time.Now()})
+	return stats, nil
+}
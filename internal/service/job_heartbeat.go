@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// jobHeartbeatInterval is how often the jobs running in this process are marked alive
+const jobHeartbeatInterval = 30 * time.Second
+
+// jobLeaseTimeout is how long a running job goes without a heartbeat before it is taken for
+// interrupted, its process having stopped. Several heartbeats fit in it, so one slow write does
+// not fail a job still running.
+const jobLeaseTimeout = 3 * time.Minute
+
+// jobHeartbeats tracks the jobs running in this process, which other instances leave alone
+type jobHeartbeats struct {
+	mu      sync.Mutex
+	running map[string]bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// createJob stores a job about to run in this process and keeps it alive until finishJob
+func (s *SensorService) createJob(ctx context.Context, job *domain.Job) error {
+	if err := s.jobRepo.Create(ctx, job); err != nil {
+		return err
+	}
+	s.jobs.mu.Lock()
+	s.jobs.running[job.ID] = true
+	s.jobs.mu.Unlock()
+	return nil
+}
+
+// StartJobHeartbeats marks the jobs running in this process alive every jobHeartbeatInterval, and
+// fails the running jobs of any instance, this one before a restart included, whose heartbeats stopped
+func (s *SensorService) StartJobHeartbeats() {
+	if s.jobs.stop != nil {
+		return
+	}
+	s.jobs.stop = make(chan struct{})
+	s.jobs.done = make(chan struct{})
+
+	go func() {
+		defer close(s.jobs.done)
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			s.beatJobs()
+			select {
+			case <-s.jobs.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (s *SensorService) beatJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), jobHeartbeatInterval)
+	defer cancel()
+
+	s.jobs.mu.Lock()
+	ids := make([]string, 0, len(s.jobs.running))
+	for id := range s.jobs.running {
+		ids = append(ids, id)
+	}
+	s.jobs.mu.Unlock()
+	if len(ids) > 0 {
+		if err := s.jobRepo.Heartbeat(ctx, ids); err != nil {
+			log.Printf("Jobs: heartbeat: %v", err)
+		}
+	}
+
+	count, err := s.jobRepo.FailInterrupted(ctx, time.Now().Add(-jobLeaseTimeout).UnixMilli())
+	if err != nil {
+		log.Printf("Jobs: mark interrupted jobs: %v", err)
+		return
+	}
+	if count > 0 {
+		log.Printf("Jobs: marked %d interrupted jobs as failed", count)
+	}
+}
+
+// stopJobHeartbeats ends the heartbeats started by StartJobHeartbeats, or waits until ctx ends
+func (s *SensorService) stopJobHeartbeats(ctx context.Context) error {
+	if s.jobs.stop == nil {
+		return nil
+	}
+	s.jobs.stopOnce.Do(func() { close(s.jobs.stop) })
+
+	select {
+	case <-s.jobs.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib/notify"
+)
+
+// SetJobNotifier tells the owners of background jobs over Zalo or SMS once their job is done or failed
+func (s *SensorService) SetJobNotifier(sender notify.Sender, users *mongodb.UserRepository) {
+	s.jobSender = sender
+	s.jobUsers = users
+}
+
+// finishJob marks a job done, or failed with jobErr, and notifies its owner
+func (s *SensorService) finishJob(ctx context.Context, jobID string, processed, updated int64, jobErr error) {
+	s.jobs.mu.Lock()
+	delete(s.jobs.running, jobID)
+	s.jobs.mu.Unlock()
+
+	if err := s.jobRepo.Finish(ctx, jobID, processed, updated, jobErr); err != nil {
+		log.Printf("Job %s: finish: %v", jobID, err)
+		return
+	}
+	s.notifyJobOwner(ctx, jobID)
+}
+
+// notifyJobOwner tells the owner of a finished job how it ended. A failed notification is only
+// logged: the job's outcome stays readable through GET /jobs/{id}.
+func (s *SensorService) notifyJobOwner(ctx context.Context, jobID string) {
+	if s.jobSender == nil || s.jobUsers == nil {
+		return
+	}
+	job, err := s.jobRepo.Get(ctx, jobID)
+	if err != nil {
+		log.Printf("Job %s: notify owner: %v", jobID, err)
+		return
+	}
+	user, err := s.jobUsers.GetUser(ctx, job.CreatedBy)
+	if err != nil {
+		log.Printf("Job %s: notify owner: %v", jobID, err)
+		return
+	}
+	msg, ok := userMessage(user)
+	if !ok {
+		return
+	}
+	s.signDownload(job)
+	msg.Text = jobNotificationText(job)
+	if job.DownloadURL != "" {
+		msg.Secrets = []string{job.DownloadURL}
+	}
+	if err := s.jobSender.Send(ctx, msg); err != nil {
+		log.Printf("Job %s: notify owner: %v", jobID, err)
+	}
+}
+
+func jobNotificationText(job *domain.Job) string {
+	if job.Status == domain.JobFailed {
+		return fmt.Sprintf("Tác vụ TP25 %s (%s) thất bại: %s", job.Type, job.ID, job.Error)
+	}
+	if job.DownloadURL != "" {
+		expires := time.Unix(job.File.ExpiresAt, 0).Format("15:04 02/01/2006")
+		return fmt.Sprintf("Tệp xuất dữ liệu TP25 (%s) đã sẵn sàng: %d dòng. Tải về trước %s tại %s", job.ID, job.Processed, expires, job.DownloadURL)
+	}
+	return fmt.Sprintf("Tác vụ TP25 %s (%s) đã hoàn tất: %d bản ghi đã xử lý, %d bản ghi đã cập nhật.", job.Type, job.ID, job.Processed, job.Updated)
+}
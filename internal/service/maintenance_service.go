@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+type MaintenanceService struct {
+	repo     *mongodb.MaintenanceRepository
+	zoneRepo *mongodb.ZoneRepository
+}
+
+func NewMaintenanceService(repo *mongodb.MaintenanceRepository, zoneRepo *mongodb.ZoneRepository) *MaintenanceService {
+	return &MaintenanceService{repo: repo, zoneRepo: zoneRepo}
+}
+
+// ListWithPagination lists windows newest first. Filtering by box also returns the windows of its group.
+func (s *MaintenanceService) ListWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterMaintenanceParams) ([]domain.MaintenanceWindow, int64, error) {
+	if filter.BoxID != nil && filter.GroupID == nil {
+		box, err := s.zoneRepo.GetBox(ctx, *filter.BoxID)
+		if err != nil {
+			return nil, 0, err
+		}
+		filter.GroupID = &box.GroupID
+	}
+	return s.repo.ListWithPagination(ctx, pagination, filter)
+}
+
+func (s *MaintenanceService) Get(ctx context.Context, id string) (*domain.MaintenanceWindow, error) {
+	return s.repo.Get(ctx, id)
+}
+
+func (s *MaintenanceService) Create(ctx context.Context, params domain.CreateMaintenanceParams, actorID string) (*domain.MaintenanceWindow, error) {
+	if (params.BoxID == "") == (params.GroupID == "") {
+		return nil, domain.ErrInvalidMaintenanceScope
+	}
+	if params.End <= params.Start {
+		return nil, domain.ErrInvalidMaintenanceRange
+	}
+
+	if params.BoxID != "" {
+		if _, err := s.zoneRepo.GetBox(ctx, params.BoxID); err != nil {
+			return nil, err
+		}
+	} else if _, err := s.zoneRepo.GetGroup(ctx, params.GroupID); err != nil {
+		return nil, err
+	}
+
+	window := domain.NewMaintenanceWindow(params, actorID)
+	if err := s.repo.Create(ctx, window); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// Update changes a window. Once a window has started only its end and reason may change, and the end
+// cannot move into the past, so the audit trail keeps what was in force.
+func (s *MaintenanceService) Update(ctx context.Context, id string, params domain.UpdateMaintenanceParams) (*domain.MaintenanceWindow, error) {
+	window, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	if window.End <= now {
+		return nil, domain.ErrMaintenanceEnded
+	}
+	started := window.Start <= now
+	if started && (params.Start != nil || (params.End != nil && *params.End < now)) {
+		return nil, domain.ErrMaintenanceStarted
+	}
+
+	if params.Start != nil {
+		window.Start = *params.Start
+	}
+	if params.End != nil {
+		window.End = *params.End
+	}
+	if params.Reason != nil {
+		window.Reason = *params.Reason
+	}
+	if window.End <= window.Start {
+		return nil, domain.ErrInvalidMaintenanceRange
+	}
+
+	if err := s.repo.Update(ctx, window); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// Delete removes a window that has not started yet
+func (s *MaintenanceService) Delete(ctx context.Context, id string) (*domain.MaintenanceWindow, error) {
+	window, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if window.Start <= time.Now().Unix() {
+		return nil, domain.ErrMaintenanceStarted
+	}
+
+	if err := s.repo.Delete(ctx, id); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// BoxStatus returns the current maintenance state of a box
+func (s *MaintenanceService) BoxStatus(ctx context.Context, boxID string) (*domain.MaintenanceStatus, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	windows, err := s.repo.ListActive(ctx, []string{box.ID}, []string{box.GroupID}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	status := domain.MaintenanceStatusAt(windows, now)
+	return &status, nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// MetricsMatrix lists, for every box of the zone's groups the user may read, the metrics configured
+// on it and whether any has records from the last days
+func (s *SensorService) MetricsMatrix(ctx context.Context, zoneID string, days int, user *domain.User) (*domain.MetricsMatrix, error) {
+	if _, err := s.zoneRepo.GetZone(ctx, zoneID); err != nil {
+		return nil, err
+	}
+
+	groups, err := s.zoneRepo.ListGroups(ctx, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].SortOrder != groups[j].SortOrder {
+			return groups[i].SortOrder < groups[j].SortOrder
+		}
+		return groups[i].ID < groups[j].ID
+	})
+
+	matrix := &domain.MetricsMatrix{
+		ZoneID:  zoneID,
+		Days:    days,
+		Since:   time.Now().AddDate(0, 0, -days).Unix(),
+		Metrics: []string{},
+		Groups:  []domain.MetricsMatrixGroup{},
+	}
+
+	var boxIDs []string
+	var codes [][]string
+	var cells []*domain.MetricsMatrixBox
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if group.Archived || !user.CanAccessGroup(group.ID) {
+			continue
+		}
+		groupID := group.ID
+		boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(boxes, func(i, j int) bool {
+			if boxes[i].SortOrder != boxes[j].SortOrder {
+				return boxes[i].SortOrder < boxes[j].SortOrder
+			}
+			return boxes[i].ID < boxes[j].ID
+		})
+
+		entry := domain.MetricsMatrixGroup{ID: group.ID, Name: group.Name, Boxes: make([]domain.MetricsMatrixBox, len(boxes))}
+		for i, box := range boxes {
+			entry.Boxes[i] = domain.MetricsMatrixBox{ID: box.ID, Name: box.Name, Metrics: make([]domain.MetricAvailability, len(box.Metrics))}
+			boxCodes := make([]string, len(box.Metrics))
+			for j, metric := range box.Metrics {
+				entry.Boxes[i].Metrics[j].Code = metric.Code
+				boxCodes[j] = metric.Code
+				if !seen[metric.Code] {
+					seen[metric.Code] = true
+					matrix.Metrics = append(matrix.Metrics, metric.Code)
+				}
+			}
+			boxIDs = append(boxIDs, box.ID)
+			codes = append(codes, boxCodes)
+		}
+		matrix.Groups = append(matrix.Groups, entry)
+	}
+	sort.Strings(matrix.Metrics)
+
+	// Boxes are pointed at once every group is appended, as appending moves the groups
+	for g := range matrix.Groups {
+		for b := range matrix.Groups[g].Boxes {
+			cells = append(cells, &matrix.Groups[g].Boxes[b])
+		}
+	}
+
+	found, err := s.repo.MetricsWithData(ctx, boxIDs, codes, matrix.Since)
+	if err != nil {
+		return nil, err
+	}
+	for i, box := range cells {
+		for j := range box.Metrics {
+			box.Metrics[j].HasData = found[i][j]
+		}
+	}
+	return matrix, nil
+}
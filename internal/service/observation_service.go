@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+type ObservationService struct {
+	repo     *mongodb.ObservationRepository
+	zoneRepo *mongodb.ZoneRepository
+}
+
+func NewObservationService(repo *mongodb.ObservationRepository, zoneRepo *mongodb.ZoneRepository) *ObservationService {
+	return &ObservationService{repo: repo, zoneRepo: zoneRepo}
+}
+
+// authorizeBox makes sure the box exists and belongs to a group the user may read
+func (s *ObservationService) authorizeBox(ctx context.Context, user *domain.User, boxID string) error {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return err
+	}
+	if !user.CanAccessGroup(box.GroupID) {
+		return domain.ErrBoxAccessDenied
+	}
+	return nil
+}
+
+// ListWithPagination lists the observations of a box, newest first
+func (s *ObservationService) ListWithPagination(ctx context.Context, user *domain.User, pagination *domain.Pagination, filter domain.FilterObservationParams) ([]domain.Observation, int64, error) {
+	if err := s.authorizeBox(ctx, user, filter.BoxID); err != nil {
+		return nil, 0, err
+	}
+	return s.repo.ListWithPagination(ctx, pagination, filter)
+}
+
+// Get returns an observation of a box the user may read
+func (s *ObservationService) Get(ctx context.Context, user *domain.User, boxID, id string) (*domain.Observation, error) {
+	if err := s.authorizeBox(ctx, user, boxID); err != nil {
+		return nil, err
+	}
+	return s.repo.Get(ctx, boxID, id)
+}
+
+// Create records an observation of a box, entered by user
+func (s *ObservationService) Create(ctx context.Context, user *domain.User, boxID string, params domain.CreateObservationParams) (*domain.Observation, error) {
+	observation := domain.NewObservation(boxID, params, user)
+	if err := observation.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.authorizeBox(ctx, user, boxID); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Create(ctx, observation); err != nil {
+		return nil, err
+	}
+	return observation, nil
+}
+
+// Update corrects an observation, keeping the previous version in its history; the author is kept
+func (s *ObservationService) Update(ctx context.Context, actorID, boxID, id string, params domain.UpdateObservationParams) (*domain.Observation, error) {
+	observation, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	observation.Apply(params)
+	if err := observation.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Update(ctx, observation, actorID); err != nil {
+		return nil, err
+	}
+	return observation, nil
+}
+
+// Delete removes an observation from listings and reports, keeping it in its history
+func (s *ObservationService) Delete(ctx context.Context, actorID, boxID, id string) (*domain.Observation, error) {
+	observation, err := s.repo.Get(ctx, boxID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.Delete(ctx, id, actorID); err != nil {
+		return nil, err
+	}
+	return observation, nil
+}
+
+// ListHistory returns the previous versions of an observation, newest first. The history of a
+// deleted observation stays readable, its last version being the one deleted.
+func (s *ObservationService) ListHistory(ctx context.Context, user *domain.User, boxID, id string, pagination *domain.Pagination) ([]domain.ObservationVersion, int64, error) {
+	if err := s.authorizeBox(ctx, user, boxID); err != nil {
+		return nil, 0, err
+	}
+	return s.repo.ListHistory(ctx, boxID, id, pagination)
+}
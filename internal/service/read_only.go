@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// readOnlyCacheTTL is how long the read-only mode is served from memory before its setting is read
+// again, which bounds how long a change made through the settings API or by another instance takes to apply
+const readOnlyCacheTTL = 10 * time.Second
+
+// ReadOnlyService holds the read-only mode, persisted as the setting domain.ReadOnlySettingKey
+type ReadOnlyService struct {
+	repo *mongodb.SettingRepository
+
+	mu       sync.Mutex
+	mode     domain.ReadOnlyMode
+	loadedAt time.Time
+	onChange []func(domain.ReadOnlyMode)
+}
+
+func NewReadOnlyService(repo *mongodb.SettingRepository) *ReadOnlyService {
+	return &ReadOnlyService{repo: repo}
+}
+
+// OnChange registers fn to be called with the mode whenever it changes, including when it is first loaded
+func (s *ReadOnlyService) OnChange(fn func(domain.ReadOnlyMode)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, fn)
+}
+
+// Mode returns the current read-only mode. When its setting cannot be read, the last known mode is kept.
+func (s *ReadOnlyService) Mode(ctx context.Context) domain.ReadOnlyMode {
+	s.mu.Lock()
+	mode, fresh := s.mode, time.Since(s.loadedAt) < readOnlyCacheTTL
+	s.mu.Unlock()
+	if fresh {
+		return mode
+	}
+
+	loaded, err := s.load(ctx)
+	if err != nil {
+		log.Printf("Read-only mode: read setting: %v", err)
+		s.mu.Lock()
+		s.loadedAt = time.Now()
+		s.mu.Unlock()
+		return mode
+	}
+	s.apply(loaded)
+	return loaded
+}
+
+// Set turns the read-only mode on or off and persists it
+func (s *ReadOnlyService) Set(ctx context.Context, params domain.SetReadOnlyParams, actorID string) (domain.ReadOnlyMode, error) {
+	mode := domain.ReadOnlyMode{}
+	if *params.Enabled {
+		mode = domain.ReadOnlyMode{
+			Enabled:      true,
+			BufferIngest: params.BufferIngest,
+			Reason:       params.Reason,
+			RetryAfter:   params.RetryAfter,
+			Since:        time.Now().Unix(),
+			ActorID:      actorID,
+		}
+		if mode.RetryAfter == 0 {
+			mode.RetryAfter = domain.DefaultReadOnlyRetryAfter
+		}
+	}
+
+	key := domain.ReadOnlySettingKey
+	_, err := s.repo.UpdateByKey(ctx, key, domain.UpdateSettingParams{Value: mode}, actorID)
+	if err == domain.ErrSettingNotFound {
+		_, err = s.repo.Create(ctx, domain.CreateSettingParams{Key: key, Value: mode})
+	}
+	if err != nil {
+		return domain.ReadOnlyMode{}, err
+	}
+
+	s.apply(mode)
+	return mode, nil
+}
+
+// load reads the mode from its setting. The setting may also be a bare boolean set through the settings API.
+func (s *ReadOnlyService) load(ctx context.Context) (domain.ReadOnlyMode, error) {
+	setting, err := s.repo.GetByKey(ctx, domain.ReadOnlySettingKey)
+	if err == domain.ErrSettingNotFound {
+		return domain.ReadOnlyMode{}, nil
+	}
+	if err != nil {
+		return domain.ReadOnlyMode{}, err
+	}
+
+	var mode domain.ReadOnlyMode
+	if enabled, ok := setting.Value.(bool); ok {
+		mode.Enabled = enabled
+	} else {
+		// Setting values come back as generic documents
+		data, err := bson.Marshal(setting.Value)
+		if err != nil {
+			return domain.ReadOnlyMode{}, err
+		}
+		if err := bson.Unmarshal(data, &mode); err != nil {
+			return domain.ReadOnlyMode{}, err
+		}
+	}
+	if mode.Enabled && mode.Since == 0 {
+		mode.Since = setting.MTime
+	}
+	if mode.RetryAfter <= 0 {
+		mode.RetryAfter = domain.DefaultReadOnlyRetryAfter
+	}
+	return mode, nil
+}
+
+// apply makes mode current and notifies the OnChange callbacks when it differs from the previous one
+func (s *ReadOnlyService) apply(mode domain.ReadOnlyMode) {
+	s.mu.Lock()
+	changed := mode != s.mode || s.loadedAt.IsZero()
+	wasEnabled := s.mode.Enabled
+	s.mode = mode
+	s.loadedAt = time.Now()
+	callbacks := s.onChange
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if mode.Enabled {
+		log.Printf("Read-only mode on (buffer ingest: %t): %s", mode.BufferIngest, mode.Reason)
+	} else if wasEnabled {
+		log.Printf("Read-only mode off")
+	}
+	for _, fn := range callbacks {
+		fn(mode)
+	}
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// IndexedRepository is a repository declaring indexes at startup, which Reindex drops and recreates
+type IndexedRepository interface {
+	IndexedCollections() []*mongo.Collection
+	EnsureIndexes(ctx context.Context) error
+}
+
+// maintenanceGuard lets one maintenance job run at a time in this process
+type maintenanceGuard struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// MaintenanceSettings configures the maintenance jobs
+type MaintenanceSettings struct {
+	Workers int                 // collections worked on at once, 1 when below
+	Indexed []IndexedRepository // the repositories Reindex rebuilds the indexes of
+}
+
+// SetMaintenance configures the maintenance jobs
+func (s *SensorService) SetMaintenance(settings MaintenanceSettings) {
+	s.maintenanceWorkers = settings.Workers
+	if s.maintenanceWorkers < 1 {
+		s.maintenanceWorkers = 1
+	}
+	s.indexed = settings.Indexed
+}
+
+// beginMaintenance claims the maintenance slot, failing with ErrMaintenanceJobRunning when a
+// maintenance job runs here or, as its job record shows, in another API process
+func (s *SensorService) beginMaintenance(ctx context.Context) error {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	if s.maintenance.running {
+		return domain.ErrMaintenanceJobRunning
+	}
+	count, err := s.jobRepo.CountRunning(ctx, domain.MaintenanceJobs)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return domain.ErrMaintenanceJobRunning
+	}
+	s.maintenance.running = true
+	return nil
+}
+
+func (s *SensorService) endMaintenance() {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	s.maintenance.running = false
+}
+
+// Reindex starts a job dropping and recreating the declared indexes of every collection. Queries
+// relying on an index run unindexed while it is rebuilt, and unique indexes fail to rebuild if
+// duplicates are written in between, so it is best run during read-only mode.
+func (s *SensorService) Reindex(ctx context.Context, actorID string) (*domain.Job, error) {
+	if err := s.beginMaintenance(ctx); err != nil {
+		return nil, err
+	}
+
+	collections := []domain.JobCollection{}
+	for _, repo := range s.indexed {
+		for _, collection := range repo.IndexedCollections() {
+			collections = append(collections, domain.JobCollection{Name: collection.Name(), Status: domain.JobPending})
+		}
+	}
+
+	job := domain.NewJob(domain.JobReindex, actorID, nil)
+	job.Collections = collections
+	if err := s.createJob(ctx, job); err != nil {
+		s.endMaintenance()
+		return nil, err
+	}
+
+	go s.runReindex(job.ID, collections)
+
+	return job, nil
+}
+
+// runReindex rebuilds the indexes one repository at a time per worker, since EnsureIndexes
+// declares those of all its collections at once. A collection's processed count is the indexes
+// it had besides _id, and its updated count the ones it has after the rebuild.
+func (s *SensorService) runReindex(jobID string, collections []domain.JobCollection) {
+	defer s.endMaintenance()
+	ctx := context.Background()
+	progress := newCollectionProgress(s, jobID, collections)
+
+	first := make([]int, len(s.indexed)) // index of each repository's first collection
+	next := 0
+	for i, repo := range s.indexed {
+		first[i] = next
+		next += len(repo.IndexedCollections())
+	}
+
+	runWorkers(s.maintenanceWorkers, len(s.indexed), func(i int) {
+		repo := s.indexed[i]
+		indexed := repo.IndexedCollections()
+		for j, collection := range indexed {
+			progress.start(first[i] + j)
+			count, err := countIndexes(ctx, collection)
+			if err == nil {
+				_, err = collection.Indexes().DropAll(ctx)
+			}
+			progress.add(first[i]+j, count, 0)
+			if err != nil {
+				for k := j; k < len(indexed); k++ {
+					progress.finish(first[i]+k, err)
+				}
+				return
+			}
+		}
+
+		err := repo.EnsureIndexes(ctx)
+		for j, collection := range indexed {
+			if err == nil {
+				count, countErr := countIndexes(ctx, collection)
+				progress.add(first[i]+j, 0, count)
+				progress.finish(first[i]+j, countErr)
+			} else {
+				progress.finish(first[i]+j, err)
+			}
+		}
+	})
+
+	progress.done()
+}
+
+// countIndexes counts the indexes of a collection besides the one on _id
+func countIndexes(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, spec := range specs {
+		if spec.Name != "_id_" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RebuildRollups starts a job regenerating, for every box, the daily rollups of past days from
+// its raw records and dropping its cached report totals so they are recomputed on next read.
+// Like BackfillRollups it should not run alongside imports of historical data.
+func (s *SensorService) RebuildRollups(ctx context.Context, actorID string) (*domain.Job, error) {
+	if err := s.beginMaintenance(ctx); err != nil {
+		return nil, err
+	}
+
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{})
+	if err != nil {
+		s.endMaintenance()
+		return nil, err
+	}
+	boxIDs := make([]string, len(boxes))
+	collections := make([]domain.JobCollection, len(boxes))
+	for i, box := range boxes {
+		boxIDs[i] = box.ID
+		collections[i] = domain.JobCollection{Name: s.repo.RecordCollectionName(box.ID), Status: domain.JobPending}
+	}
+
+	through := domain.RollupDayStart(time.Now().Unix())
+	job := domain.NewJob(domain.JobRebuildRollups, actorID, map[string]interface{}{"through": through})
+	job.Collections = collections
+	if err := s.createJob(ctx, job); err != nil {
+		s.endMaintenance()
+		return nil, err
+	}
+
+	go s.runRebuildRollups(job.ID, boxIDs, collections, through)
+
+	return job, nil
+}
+
+// runRebuildRollups rebuilds the boxes in parallel. A collection's processed count is the records
+// read and its updated count the rollups written.
+func (s *SensorService) runRebuildRollups(jobID string, boxIDs []string, collections []domain.JobCollection, through int64) {
+	defer s.endMaintenance()
+	ctx := context.Background()
+	progress := newCollectionProgress(s, jobID, collections)
+
+	runWorkers(s.maintenanceWorkers, len(boxIDs), func(i int) {
+		progress.start(i)
+		updated, err := s.rebuildRollups(ctx, boxIDs[i], through, func() {
+			progress.add(i, 1, 0)
+		})
+		progress.add(i, 0, updated)
+		if err == nil {
+			err = s.zoneRepo.InvalidateReportCache(ctx, boxIDs[i])
+		}
+		progress.finish(i, err)
+	})
+
+	progress.done()
+}
+
+// runWorkers calls work for 0..count-1 from at most workers goroutines and waits for them
+func runWorkers(workers, count int, work func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				work(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// collectionProgress tracks a maintenance job over its collections, saving it when a collection
+// starts or finishes and every recomputeProgressEvery records in between. The job fails when any
+// collection does, after the others have been worked through.
+type collectionProgress struct {
+	s     *SensorService
+	jobID string
+
+	mu                 sync.Mutex
+	collections        []domain.JobCollection
+	processed, updated int64
+	unsaved            int64
+	err                error
+}
+
+func newCollectionProgress(s *SensorService, jobID string, collections []domain.JobCollection) *collectionProgress {
+	return &collectionProgress{s: s, jobID: jobID, collections: collections}
+}
+
+func (p *collectionProgress) start(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.collections[i].Status = domain.JobRunning
+	p.save()
+}
+
+func (p *collectionProgress) add(i int, processed, updated int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.collections[i].Processed += processed
+	p.collections[i].Updated += updated
+	p.processed += processed
+	p.updated += updated
+	p.unsaved += processed
+	if p.unsaved >= recomputeProgressEvery {
+		p.save()
+	}
+}
+
+func (p *collectionProgress) finish(i int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.collections[i].Status = domain.JobDone
+	if err != nil {
+		p.collections[i].Status = domain.JobFailed
+		p.collections[i].Error = err.Error()
+		log.Printf("Job %s: %s: %v", p.jobID, p.collections[i].Name, err)
+		if p.err == nil {
+			p.err = err
+		}
+	}
+	p.save()
+}
+
+// save writes the progress; the caller holds p.mu
+func (p *collectionProgress) save() {
+	p.unsaved = 0
+	if err := p.s.jobRepo.UpdateCollections(context.Background(), p.jobID, p.processed, p.updated, p.collections); err != nil {
+		log.Printf("Job %s: update progress: %v", p.jobID, err)
+	}
+}
+
+// done marks the job finished
+func (p *collectionProgress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.s.finishJob(context.Background(), p.jobID, p.processed, p.updated, p.err)
+}
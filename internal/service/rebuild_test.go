@@ -0,0 +1,97 @@
+package service
+
+import (
+	"sync"
+	"testing"
+
+	"tp25-api/internal/repository/mongodb"
+)
+
+func TestSetMaintenance(t *testing.T) {
+	db := unreachableDB(t)
+	indexed := []IndexedRepository{mongodb.NewZoneRepository(db), mongodb.NewRollupRepository(db)}
+
+	tests := []struct {
+		name    string
+		workers int
+		want    int
+	}{
+		{"unset workers", 0, 1},
+		{"negative workers", -2, 1},
+		{"several workers", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SensorService{}
+			s.SetMaintenance(MaintenanceSettings{Workers: tt.workers, Indexed: indexed})
+			if s.maintenanceWorkers != tt.want {
+				t.Errorf("workers = %d, want %d", s.maintenanceWorkers, tt.want)
+			}
+			if len(s.indexed) != len(indexed) {
+				t.Errorf("indexed %d repositories, want %d", len(s.indexed), len(indexed))
+			}
+		})
+	}
+}
+
+// Every item is worked on once, by no more goroutines at a time than asked for
+func TestRunWorkers(t *testing.T) {
+	tests := []struct {
+		name           string
+		workers, count int
+		want           int // most items worked on at once
+	}{
+		{"no items", 2, 0, 0},
+		{"no workers", 0, 5, 1},
+		{"fewer items than workers", 4, 2, 2},
+		{"more items than workers", 3, 12, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			seen := make([]int, tt.count)
+			running, most := 0, 0
+			release := make(chan struct{})
+			started := make(chan struct{}, tt.count)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runWorkers(tt.workers, tt.count, func(i int) {
+					mu.Lock()
+					seen[i]++
+					running++
+					if running > most {
+						most = running
+					}
+					mu.Unlock()
+					started <- struct{}{}
+					<-release
+					mu.Lock()
+					running--
+					mu.Unlock()
+				})
+			}()
+			// Let the items through one at a time once as many as can run have started
+			for i := 0; i < tt.count; i++ {
+				<-started
+				if i+1 >= tt.want {
+					release <- struct{}{}
+				}
+			}
+			for i := tt.want - 1; i > 0; i-- {
+				release <- struct{}{}
+			}
+			<-done
+
+			if most != tt.want {
+				t.Errorf("%d items worked on at once, want %d", most, tt.want)
+			}
+			for i, n := range seen {
+				if n != 1 {
+					t.Errorf("item %d worked on %d times, want once", i, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tp25-api/internal/domain"
+)
+
+// pollRecordLimit bounds the records a poll returns, newest first; a client further behind
+// should page through the records instead
+const pollRecordLimit = 500
+
+// recordPolls holds the long polls waiting for new records and wakes those of a box once the
+// ingestion queue wrote records of it
+type recordPolls struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{} // box ID -> waiting polls
+	held    int
+	max     int // 0 means unlimited
+	stopped chan struct{}
+}
+
+func newRecordPolls() *recordPolls {
+	return &recordPolls{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// subscribe registers a poll of the box. It fails with ErrTooManyPolls when max polls are held
+// already, and with ErrPollsStopped once the server is shutting down.
+func (p *recordPolls) subscribe(boxID string) (chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.stopped:
+		return nil, domain.ErrPollsStopped
+	default:
+	}
+	if p.max > 0 && p.held >= p.max {
+		return nil, domain.ErrTooManyPolls
+	}
+
+	// Buffered so a notification between two reads of the poll is not lost
+	ch := make(chan struct{}, 1)
+	if p.waiters[boxID] == nil {
+		p.waiters[boxID] = make(map[chan struct{}]struct{})
+	}
+	p.waiters[boxID][ch] = struct{}{}
+	p.held++
+	return ch, nil
+}
+
+func (p *recordPolls) unsubscribe(boxID string, ch chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.waiters[boxID], ch)
+	if len(p.waiters[boxID]) == 0 {
+		delete(p.waiters, boxID)
+	}
+	p.held--
+}
+
+// notify wakes the polls of the box
+func (p *recordPolls) notify(boxID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for ch := range p.waiters[boxID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetPollLimit bounds how many long polls may wait for records at once; 0 means unlimited
+func (s *SensorService) SetPollLimit(max int) {
+	s.polls.mu.Lock()
+	defer s.polls.mu.Unlock()
+	s.polls.max = max
+}
+
+// StopPolls ends the held long polls and refuses new ones, so a shutting down server does not
+// wait for them
+func (s *SensorService) StopPolls() {
+	s.polls.mu.Lock()
+	defer s.polls.mu.Unlock()
+
+	select {
+	case <-s.polls.stopped:
+	default:
+		close(s.polls.stopped)
+	}
+}
+
+// PollRecords returns the records of the box newer than since (seconds), newest first and at most
+// pollRecordLimit. Without any, it waits up to timeout for the ingestion queue to write some and
+// returns an empty result when none came, or when ctx ends or the server shuts down meanwhile.
+func (s *SensorService) PollRecords(ctx context.Context, boxID string, since int64, timeout time.Duration) (*domain.RecordsResult, error) {
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+
+	// Subscribed before the first read, so records written in between still wake the poll
+	wake, err := s.polls.subscribe(boxID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.polls.unsubscribe(boxID, wake)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	newer := since + 1
+	limit, skip := pollRecordLimit, 0
+	query := &domain.QueryRecord{TimeMin: &newer, Limit: &limit, Skip: &skip}
+	for {
+		result, err := s.repo.ListRecords(ctx, boxID, query)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Records) > 0 {
+			normalizeRecords(result.Records)
+			return result, nil
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			return result, nil
+		case <-s.polls.stopped:
+			return result, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
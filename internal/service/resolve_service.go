@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+)
+
+// ResolveService turns IDs referenced by other payloads into names in one round trip
+type ResolveService struct {
+	zoneRepo *mongodb.ZoneRepository
+	userRepo *mongodb.UserRepository
+}
+
+func NewResolveService(zoneRepo *mongodb.ZoneRepository, userRepo *mongodb.UserRepository) *ResolveService {
+	return &ResolveService{zoneRepo: zoneRepo, userRepo: userRepo}
+}
+
+// Resolve looks up each kind of ID with a single query. Non-admins only get the boxes and groups
+// they may read, the zones of those groups, and themselves and the users sharing one of their groups.
+func (s *ResolveService) Resolve(ctx context.Context, user *domain.User, params domain.ResolveParams) (*domain.ResolveResult, error) {
+	if params.Count() > domain.MaxResolveIDs {
+		return nil, domain.ErrTooManyResolveIDs
+	}
+
+	result := &domain.ResolveResult{
+		Boxes:  map[string]domain.ResolvedBox{},
+		Groups: map[string]domain.ResolvedGroup{},
+		Zones:  map[string]domain.ResolvedZone{},
+		Users:  map[string]domain.ResolvedUser{},
+	}
+
+	if len(params.Boxes) > 0 {
+		boxes, err := s.zoneRepo.ListBoxesByIDs(ctx, params.Boxes)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range boxes {
+			if user.CanAccessGroup(b.GroupID) {
+				result.Boxes[b.ID] = domain.ResolvedBox{Name: b.Name, GroupID: b.GroupID, ZoneID: b.ZoneID}
+			}
+		}
+	}
+
+	if len(params.Groups) > 0 {
+		groups, err := s.zoneRepo.ListGroupsByIDs(ctx, params.Groups)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			if user.CanAccessGroup(g.ID) {
+				result.Groups[g.ID] = domain.ResolvedGroup{Name: g.Name, ZoneID: g.ZoneID}
+			}
+		}
+	}
+
+	if len(params.Zones) > 0 {
+		allowed, err := s.readableZones(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		zones, err := s.zoneRepo.ListZonesByIDs(ctx, params.Zones)
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range zones {
+			if allowed == nil || allowed[z.ID] {
+				result.Zones[z.ID] = domain.ResolvedZone{Name: z.Name, Code: z.Code}
+			}
+		}
+	}
+
+	if len(params.Users) > 0 {
+		users, err := s.userRepo.ListUsersByIDs(ctx, params.Users)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			if canResolveUser(user, &u) {
+				result.Users[u.ID] = domain.ResolvedUser{Name: u.FullName, Username: u.Username}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// readableZones returns the zones of the user's groups and own zones, or nil when every zone is readable
+func (s *ResolveService) readableZones(ctx context.Context, user *domain.User) (map[string]bool, error) {
+	if user.Role == domain.RoleAdmin {
+		return nil, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, zoneID := range user.ZoneIDs {
+		allowed[zoneID] = true
+	}
+	if len(user.Groups) > 0 {
+		groups, err := s.zoneRepo.ListGroupsByIDs(ctx, user.Groups)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			allowed[g.ZoneID] = true
+		}
+	}
+	return allowed, nil
+}
+
+// canResolveUser reports whether the caller may see the other user's name
+func canResolveUser(caller, other *domain.User) bool {
+	if caller.Role == domain.RoleAdmin || caller.ID == other.ID {
+		return true
+	}
+	for _, g := range other.Groups {
+		if caller.CanAccessGroup(g) {
+			return true
+		}
+	}
+	for _, z := range other.ZoneIDs {
+		if caller.CanAccessZone(z) {
+			return true
+		}
+	}
+	return false
+}
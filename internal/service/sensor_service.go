@@ -2,26 +2,117 @@ package service
 
 import (
 	"context"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"tp25-api/internal/domain"
 	"tp25-api/internal/repository/mongodb"
 	"tp25-api/lib/interpolation"
+	"tp25-api/lib/notify"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 type SensorService struct {
-	repo       *mongodb.SensorRepository
-	zoneRepo   *mongodb.ZoneRepository
-	calculator *interpolation.HydraulicCalculator
+	repo         *mongodb.SensorRepository
+	zoneRepo     *mongodb.ZoneRepository
+	templateRepo *mongodb.ExportTemplateRepository
+	jobRepo      *mongodb.JobRepository
+	maintRepo    *mongodb.MaintenanceRepository
+	logRepo      *mongodb.BoxLogRepository
+	rollups      *mongodb.RollupRepository
+	settingRepo  *mongodb.SettingRepository
+	calibRepo    *mongodb.CalibrationRepository
+	anomalyRepo  *mongodb.AnomalyRepository
+	calculator   *interpolation.HydraulicCalculator // built-in curves, for groups without their own
+	hydraulics   hydraulicsCache
+	boxes        boxCache
+	ingest       *IngestQueue
+	ingestStats  ingestStatsCache
+	polls        *recordPolls
+	metrics      *ingestMetrics
+
+	rateMu      sync.Mutex
+	lastSamples map[string]map[string]domain.RecordValueAt // box ID -> metric -> latest sample, for rates of change
+	rateHorizon int64                                      // seconds
+
+	anomalyMu    sync.Mutex
+	anomalyStats map[string]map[string]domain.RollingStats // box ID -> metric -> rolling statistics
+
+	jobs jobHeartbeats
+
+	exportMaxRows int64       // 0 means unlimited
+	exports       *exportJobs // group exports run as jobs, see SetExportJobs
+
+	jobSender notify.Sender           // tells job owners their job finished, nobody when nil
+	jobUsers  *mongodb.UserRepository // the owners of jobs
+
+	features *FeatureFlagService // every feature is on when nil
+
+	indexed            []IndexedRepository
+	maintenanceWorkers int
+	maintenance        maintenanceGuard
+}
+
+func NewSensorService(repo *mongodb.SensorRepository, zoneRepo *mongodb.ZoneRepository, templateRepo *mongodb.ExportTemplateRepository, jobRepo *mongodb.JobRepository, maintRepo *mongodb.MaintenanceRepository, logRepo *mongodb.BoxLogRepository, rollups *mongodb.RollupRepository, settingRepo *mongodb.SettingRepository, calibRepo *mongodb.CalibrationRepository, anomalyRepo *mongodb.AnomalyRepository) *SensorService {
+	s := &SensorService{
+		repo:         repo,
+		zoneRepo:     zoneRepo,
+		templateRepo: templateRepo,
+		jobRepo:      jobRepo,
+		maintRepo:    maintRepo,
+		logRepo:      logRepo,
+		rollups:      rollups,
+		settingRepo:  settingRepo,
+		calibRepo:    calibRepo,
+		anomalyRepo:  anomalyRepo,
+		calculator:   interpolation.NewHydraulicCalculator(),
+		hydraulics:   hydraulicsCache{groups: make(map[string]cachedCalculator)},
+		boxes:        boxCache{boxes: make(map[string]cachedBox)},
+		ingestStats:  ingestStatsCache{boxes: make(map[string]cachedIngestStats), groups: make(map[string]cachedIngestStats)},
+		polls:        newRecordPolls(),
+		lastSamples:  make(map[string]map[string]domain.RecordValueAt),
+		rateHorizon:  domain.DefaultRateHorizon,
+		anomalyStats: make(map[string]map[string]domain.RollingStats),
+		jobs:         jobHeartbeats{running: make(map[string]bool)},
+
+		maintenanceWorkers: 1,
+	}
+	s.metrics = newIngestMetrics(s)
+	return s
+}
+
+// StartIngest starts the queue AddRecord writes through, which wakes the long polls of the boxes it wrote
+func (s *SensorService) StartIngest(queueSize, workers, batchSize int) {
+	s.ingest = NewIngestQueue(s.repo, s.rollups, queueSize, workers, batchSize, s.polls.notify)
+}
+
+// SetIngestDeadLetters keeps the records the queue fails to write in deadLetters, writing them again
+// every interval, instead of dropping them after they were acknowledged
+func (s *SensorService) SetIngestDeadLetters(deadLetters *mongodb.IngestDeadLetterRepository, interval time.Duration) {
+	s.ingest.SetDeadLetters(deadLetters, interval)
+}
+
+// IngestStats returns the ingestion queue depth and write counters
+func (s *SensorService) IngestStats() domain.IngestStats {
+	return s.ingest.Stats()
+}
+
+// SetIngestPaused holds queued records instead of writing them, for read-only mode
+func (s *SensorService) SetIngestPaused(paused bool) {
+	s.ingest.SetPaused(paused)
 }
 
-func NewSensorService(repo *mongodb.SensorRepository, zoneRepo *mongodb.ZoneRepository) *SensorService {
-	return &SensorService{
-		repo:       repo,
-		zoneRepo:   zoneRepo,
-		calculator: interpolation.NewHydraulicCalculator(),
+// Close stops the job heartbeats and flushes records still waiting in the ingestion queue
+func (s *SensorService) Close(ctx context.Context) error {
+	if err := s.stopJobHeartbeats(ctx); err != nil {
+		return err
 	}
+	return s.ingest.Close(ctx)
 }
 
 // Metric operations
@@ -42,6 +133,9 @@ func (s *SensorService) CreateMetric(ctx context.Context, params domain.CreateMe
 	if params.Code == "" {
 		return nil, domain.ErrMetricMustHaveCode
 	}
+	if err := domain.ValidateUnit("unit", params.Unit); err != nil {
+		return nil, err
+	}
 
 	metric := domain.NewMetric(params)
 	if err := s.repo.CreateMetric(ctx, metric); err != nil {
@@ -50,6 +144,27 @@ func (s *SensorService) CreateMetric(ctx context.Context, params domain.CreateMe
 	return metric, nil
 }
 
+// UnitMismatches lists the metrics whose unit is not a catalog code, with the code it most likely means
+func (s *SensorService) UnitMismatches(ctx context.Context) ([]domain.UnitMismatch, error) {
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := []domain.UnitMismatch{}
+	for _, metric := range metrics {
+		if _, ok := domain.LookupUnit(metric.Unit); ok {
+			continue
+		}
+		mismatch := domain.UnitMismatch{ID: metric.ID, Code: metric.Code, Name: metric.Name, Unit: metric.Unit}
+		if suggestion, ok := domain.SuggestUnit(metric.Unit); ok {
+			mismatch.Suggestion = suggestion.Code
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+	return mismatches, nil
+}
+
 func (s *SensorService) UpdateMetric(ctx context.Context, id string, params domain.UpdateMetricParams) (*domain.Metric, error) {
 	metric, err := s.repo.GetMetric(ctx, bson.M{"_id": id})
 	if err != nil {
@@ -57,9 +172,24 @@ func (s *SensorService) UpdateMetric(ctx context.Context, id string, params doma
 	}
 
 	if params.Unit != nil {
+		if err := domain.ValidateUnit("unit", *params.Unit); err != nil {
+			return nil, err
+		}
 		metric.Unit = *params.Unit
 	}
-	if params.Code != nil {
+	if params.Code != nil && *params.Code != metric.Code {
+		// Codes only need to be unique among live metrics
+		if _, err := s.repo.GetMetric(ctx, bson.M{"code": *params.Code}); err == nil {
+			return nil, domain.ErrMetricCodeExisted
+		}
+		// Records are stored under the code and boxes list it, so renaming a used code would orphan its history
+		used, err := s.zoneRepo.CountBoxesUsingMetric(ctx, metric.Code)
+		if err != nil {
+			return nil, err
+		}
+		if used > 0 {
+			return nil, domain.ErrMetricInUse
+		}
 		metric.Code = *params.Code
 	}
 	if params.Name != nil {
@@ -68,6 +198,15 @@ func (s *SensorService) UpdateMetric(ctx context.Context, id string, params doma
 	if params.Range != nil {
 		metric.Range = params.Range
 	}
+	if params.SortOrder != nil {
+		metric.SortOrder = *params.SortOrder
+	}
+	if params.Category != nil {
+		metric.Category = *params.Category
+	}
+	if params.Precision != nil {
+		metric.Precision = params.Precision
+	}
 
 	if err := s.repo.UpdateMetric(ctx, metric); err != nil {
 		return nil, err
@@ -76,6 +215,31 @@ func (s *SensorService) UpdateMetric(ctx context.Context, id string, params doma
 	return metric, nil
 }
 
+// ReorderMetrics sets the display order of metrics to the order of ids and returns all metrics in display order.
+// Metrics not listed keep their sort_order.
+func (s *SensorService) ReorderMetrics(ctx context.Context, ids []string) ([]domain.Metric, error) {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return nil, domain.ErrDuplicateMetricID
+		}
+		seen[id] = true
+	}
+
+	count, err := s.repo.CountMetrics(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if count != int64(len(ids)) {
+		return nil, domain.ErrMetricNotFound
+	}
+
+	if err := s.repo.SetMetricOrder(ctx, ids); err != nil {
+		return nil, err
+	}
+	return s.repo.ListMetrics(ctx)
+}
+
 func (s *SensorService) DeleteMetric(ctx context.Context, id string) (*domain.Metric, error) {
 	metric, err := s.repo.GetMetric(ctx, bson.M{"_id": id})
 	if err != nil {
@@ -89,97 +253,1595 @@ func (s *SensorService) DeleteMetric(ctx context.Context, id string) (*domain.Me
 	return metric, nil
 }
 
+// SetExportLimit sets the estimated row count above which exports are refused; 0 disables the check
+func (s *SensorService) SetExportLimit(maxRows int) {
+	s.exportMaxRows = int64(maxRows)
+}
+
+// SetRateHorizon sets the longest gap between samples a rate of change is derived over
+func (s *SensorService) SetRateHorizon(seconds int) {
+	if seconds > 0 {
+		s.rateHorizon = int64(seconds)
+	}
+}
+
 // Record operations
 
+// requireBox makes sure the box exists so "no data yet" can be told apart from "no such box"
+func (s *SensorService) requireBox(ctx context.Context, boxID string) error {
+	_, err := s.zoneRepo.GetBox(ctx, boxID)
+	return err
+}
+
+// BoxGroupID returns the group of a box
+func (s *SensorService) BoxGroupID(ctx context.Context, boxID string) (string, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return "", err
+	}
+	return box.GroupID, nil
+}
+
+// AuthorizeBox fails with ErrBoxAccessDenied unless the user may read the group of the box
+func (s *SensorService) AuthorizeBox(ctx context.Context, user *domain.User, boxID string) error {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return err
+	}
+	if !user.CanAccessGroup(box.GroupID) {
+		return domain.ErrBoxAccessDenied
+	}
+	return nil
+}
+
 func (s *SensorService) ListRecords(ctx context.Context, boxID string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
-	return s.repo.ListRecords(ctx, boxID, query)
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+	result, err := s.repo.ListRecords(ctx, boxID, query)
+	if err != nil {
+		return nil, err
+	}
+	dropAnomalies(query, result.Records)
+	if err := s.calibrate(ctx, query, result.Records, boxID); err != nil {
+		return nil, err
+	}
+	normalizeRecords(result.Records)
+	return result, nil
+}
+
+// calibrate applies the calibrations of the boxes to records read for a query asking for them.
+// Records of several boxes are told apart by their box_id, a single box's records by boxIDs.
+func (s *SensorService) calibrate(ctx context.Context, query *domain.QueryRecord, records []domain.Record, boxIDs ...string) error {
+	if query == nil || !query.Calibrate || len(records) == 0 {
+		return nil
+	}
+	sets, err := s.calibrationSets(ctx, boxIDs...)
+	if err != nil || len(sets) == 0 {
+		return err
+	}
+
+	for _, record := range records {
+		boxID, ok := record["box_id"].(string)
+		if !ok && len(boxIDs) == 1 {
+			boxID = boxIDs[0]
+		}
+		sets[boxID].Apply(record)
+	}
+	return nil
+}
+
+// calibrationSets returns the calibrations of the boxes by box ID; boxes without any are left out
+func (s *SensorService) calibrationSets(ctx context.Context, boxIDs ...string) (map[string]domain.CalibrationSet, error) {
+	calibrations, err := s.calibRepo.List(ctx, boxIDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	byBox := make(map[string][]domain.Calibration)
+	for _, c := range calibrations {
+		byBox[c.BoxID] = append(byBox[c.BoxID], c)
+	}
+	sets := make(map[string]domain.CalibrationSet, len(byBox))
+	for boxID, list := range byBox {
+		sets[boxID] = domain.NewCalibrationSet(list)
+	}
+	return sets, nil
+}
+
+// BoxCalibrations returns the calibrations of a box, for exports listing the corrections applied
+func (s *SensorService) BoxCalibrations(ctx context.Context, boxID string) ([]domain.Calibration, error) {
+	return s.calibRepo.List(ctx, boxID)
 }
 
 func (s *SensorService) CountRecords(ctx context.Context, boxID string, query *domain.QueryRecord) (int64, error) {
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return 0, err
+	}
 	return s.repo.CountRecords(ctx, boxID, query)
 }
 
-func (s *SensorService) AddRecord(ctx context.Context, boxID string, record domain.Record) error {
-	// Apply interpolation calculations if needed
-	record = s.applyInterpolation(record)
-	return s.repo.AddRecord(ctx, boxID, record)
+// AddRecord queues a record for writing and returns its receipt, or ErrIngestQueueFull under overload.
+// A record merged into a stored one per the box's merge policy is not queued and has no receipt.
+func (s *SensorService) AddRecord(ctx context.Context, boxID string, record domain.Record) (*domain.IngestReceipt, error) {
+	// Stamp the receive time now rather than when the batch is written
+	if _, exists := record["c"]; !exists {
+		record["c"] = time.Now().UnixMilli()
+	}
+
+	merged, rates, err := s.admitRecord(ctx, boxID, record)
+	if err != nil {
+		s.countRejection(err)
+		return nil, err
+	}
+	if merged {
+		s.metrics.ingested.Inc(boxID)
+		return nil, nil
+	}
+
+	receipt, err := s.ingest.Enqueue(boxID, record)
+	if err != nil {
+		s.countRejection(err)
+		return nil, err
+	}
+	s.commitRates(rates)
+	s.metrics.ingested.Inc(boxID)
+	return receipt, nil
 }
 
 func (s *SensorService) ImportRecord(ctx context.Context, boxID string, record domain.Record) error {
-	// Apply interpolation calculations if needed
-	record = s.applyInterpolation(record)
-	return s.repo.ImportRecord(ctx, boxID, record)
+	merged, rates, err := s.admitRecord(ctx, boxID, record)
+	s.countRejection(err)
+	if err == domain.ErrDuplicateRecord {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if merged {
+		s.metrics.ingested.Inc(boxID)
+		return nil
+	}
+
+	if err := s.repo.ImportRecord(ctx, boxID, record); err != nil {
+		return err
+	}
+	s.commitRates(rates)
+	s.metrics.ingested.Inc(boxID)
+
+	rollups, unsafe := domain.RollupRecords(boxID, []domain.Record{record})
+	if err := s.rollups.Apply(ctx, boxID, rollups); err != nil {
+		log.Printf("Import: update daily rollups of box %s: %v", boxID, err)
+		unsafe = append(unsafe, rollupDates(rollups)...)
+	}
+	if err := s.rollups.MarkStale(ctx, boxID, unsafe); err != nil {
+		log.Printf("Import: mark daily rollups of box %s stale: %v", boxID, err)
+	}
+	return nil
 }
 
-func (s *SensorService) ReportRecords(ctx context.Context, boxID string, query *domain.QueryRecord) ([]domain.DailyReport, error) {
-	return s.repo.ReportRecords(ctx, boxID, query)
+// SetFeatureFlags makes the service consult the feature flags, e.g. before flagging anomalies
+func (s *SensorService) SetFeatureFlags(features *FeatureFlagService) {
+	s.features = features
 }
 
-func (s *SensorService) ListRecordsByGroup(ctx context.Context, groupID string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
-	filter := domain.FilterBoxParams{GroupID: &groupID}
-	boxes, err := s.zoneRepo.ListBoxes(ctx, filter)
+// GetJob returns a background job
+func (s *SensorService) GetJob(ctx context.Context, id string) (*domain.Job, error) {
+	return s.jobRepo.Get(ctx, id)
+}
+
+// RecomputeConversion starts a job re-deriving the stored values of a box metric with its current
+// unit conversion, including the hydraulic values derived from them
+func (s *SensorService) RecomputeConversion(ctx context.Context, boxID, code string, params domain.RecomputeConversionParams, actorID string) (*domain.Job, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	var metric *domain.BoxMetric
+	for i := range box.Metrics {
+		if box.Metrics[i].Code == code {
+			metric = &box.Metrics[i]
+		}
+	}
+	if metric == nil {
+		return nil, domain.ErrBoxMetricNotFound
+	}
+	if params.Previous != nil {
+		if err := params.Previous.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if params.TimeMin != nil && params.TimeMax != nil && *params.TimeMin > *params.TimeMax {
+		return nil, domain.ErrInvalidTimeRange
+	}
+
+	jobParams := map[string]interface{}{"box_id": boxID, "metric": code, "previous": params.Previous, "current": metric.Conversion}
+	if params.TimeMin != nil {
+		jobParams["time_min"] = *params.TimeMin
+	}
+	if params.TimeMax != nil {
+		jobParams["time_max"] = *params.TimeMax
+	}
+
+	calculator, err := s.calculatorFor(ctx, box.GroupID)
 	if err != nil {
 		return nil, err
 	}
 
+	job := domain.NewJob(domain.JobRecomputeConversion, actorID, jobParams)
+	if err := s.createJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	query := &domain.QueryRecord{TimeMin: params.TimeMin, TimeMax: params.TimeMax}
+	go s.runRecomputeConversion(job.ID, boxID, code, metric.Conversion, params.Previous, query, calculator)
+
+	return job, nil
+}
+
+// recomputeProgressEvery is how many records a recompute job processes between progress updates
+const recomputeProgressEvery = 500
+
+func (s *SensorService) runRecomputeConversion(jobID, boxID, code string, current, previous *domain.UnitConversion, query *domain.QueryRecord, calculator *interpolation.HydraulicCalculator) {
+	ctx := context.Background()
+
+	var processed, updated int64
+	staleDates := map[string]bool{}
+	err := s.repo.StreamRecords(ctx, boxID, query, func(record domain.Record) error {
+		processed++
+		if processed%recomputeProgressEvery == 0 {
+			if err := s.jobRepo.UpdateProgress(ctx, jobID, processed, updated); err != nil {
+				log.Printf("Job %s: update progress: %v", jobID, err)
+			}
+		}
+
+		if !record.HasNumber(code) {
+			return nil
+		}
+
+		reported := record.GetFloat(code)
+		if record.HasNumber(domain.RawValuePrefix + code) {
+			reported = record.GetFloat(domain.RawValuePrefix + code)
+		} else if previous != nil {
+			reported = previous.Invert(reported)
+		}
+
+		fields := domain.Record{code: reported}
+		if current != nil {
+			fields[code] = current.Apply(reported)
+			if current.KeepRaw {
+				fields[domain.RawValuePrefix+code] = reported
+			}
+		}
+
+		// The hydraulic values follow from the corrected value. Stored derived values are left
+		// out so only the ones whose inputs are present get written back.
+		derived := domain.Record{}
+		for key, value := range record {
+			if key == "V" || key == "Q" || key == "Q_of" {
+				continue
+			}
+			derived[key] = value
+		}
+		derived[code] = fields[code]
+		s.applyInterpolation(calculator, derived)
+		for _, key := range []string{"V", "Q", "Q_of"} {
+			if value, ok := derived[key]; ok {
+				fields[key] = value
+			}
+		}
+
+		if err := s.repo.UpdateRecordFields(ctx, boxID, record["_id"], fields); err != nil {
+			return err
+		}
+		staleDates[domain.RollupDate(record.GetTimestamp())] = true
+		updated++
+		return nil
+	})
+
+	if updated > 0 {
+		if err := s.zoneRepo.InvalidateReportCache(ctx, boxID); err != nil {
+			log.Printf("Job %s: invalidate report cache: %v", jobID, err)
+		}
+		dates := make([]string, 0, len(staleDates))
+		for date := range staleDates {
+			dates = append(dates, date)
+		}
+		if err := s.rollups.MarkStale(ctx, boxID, dates); err != nil {
+			log.Printf("Job %s: mark daily rollups stale: %v", jobID, err)
+		}
+	}
+
+	s.finishJob(ctx, jobID, processed, updated, err)
+}
+
+// BackfillRollups starts a job rebuilding the daily rollups of a box, or of every box when
+// params.BoxID is empty, from its raw records up to the start of the current day. Like the other
+// maintenance jobs it is refused with ErrMaintenanceJobRunning while one of them runs.
+func (s *SensorService) BackfillRollups(ctx context.Context, params domain.RollupBackfillParams, actorID string) (*domain.Job, error) {
+	if err := s.beginMaintenance(ctx); err != nil {
+		return nil, err
+	}
+	job, err := s.startBackfillRollups(ctx, params, actorID)
+	if err != nil {
+		s.endMaintenance()
+	}
+	return job, err
+}
+
+func (s *SensorService) startBackfillRollups(ctx context.Context, params domain.RollupBackfillParams, actorID string) (*domain.Job, error) {
 	var boxIDs []string
-	for _, box := range boxes {
-		boxIDs = append(boxIDs, box.ID)
+	if params.BoxID != "" {
+		if err := s.requireBox(ctx, params.BoxID); err != nil {
+			return nil, err
+		}
+		boxIDs = []string{params.BoxID}
+	} else {
+		boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{})
+		if err != nil {
+			return nil, err
+		}
+		for _, box := range boxes {
+			boxIDs = append(boxIDs, box.ID)
+		}
+	}
+
+	through := domain.RollupDayStart(time.Now().Unix())
+	jobParams := map[string]interface{}{"through": through}
+	if params.BoxID != "" {
+		jobParams["box_id"] = params.BoxID
+	}
+
+	job := domain.NewJob(domain.JobRollupBackfill, actorID, jobParams)
+	if err := s.createJob(ctx, job); err != nil {
+		return nil, err
 	}
 
-	return s.repo.ListRecordsByGroup(ctx, boxIDs, query)
+	go s.runBackfillRollups(job.ID, boxIDs, through)
+
+	return job, nil
 }
 
-func (s *SensorService) ListRecordsLatestByGroup(ctx context.Context, groupID string) (*domain.RecordsResult, error) {
-	filter := domain.FilterBoxParams{GroupID: &groupID}
-	boxes, err := s.zoneRepo.ListBoxes(ctx, filter)
+// runBackfillRollups replaces the rollup of each day before through with one computed from the
+// day's records. Records imported into a day while it is being rebuilt may be missed, so the job
+// should not run alongside imports of historical data.
+func (s *SensorService) runBackfillRollups(jobID string, boxIDs []string, through int64) {
+	defer s.endMaintenance()
+	ctx := context.Background()
+
+	var processed, updated int64
+	var err error
+	for _, boxID := range boxIDs {
+		var boxUpdated int64
+		boxUpdated, err = s.rebuildRollups(ctx, boxID, through, func() {
+			processed++
+			if processed%recomputeProgressEvery == 0 {
+				if err := s.jobRepo.UpdateProgress(ctx, jobID, processed, updated); err != nil {
+					log.Printf("Job %s: update progress: %v", jobID, err)
+				}
+			}
+		})
+		updated += boxUpdated
+		if err != nil {
+			break
+		}
+	}
+
+	s.finishJob(ctx, jobID, processed, updated, err)
+}
+
+// rebuildRollups replaces the daily rollups of a box before through with ones computed from its
+// records, calling onRecord for each record read, and returns how many rollups it wrote
+func (s *SensorService) rebuildRollups(ctx context.Context, boxID string, through int64, onRecord func()) (int64, error) {
+	var updated int64
+	var current *domain.DailyRollup
+	unsafe := false
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		current.Stale = unsafe
+		if err := s.rollups.Replace(ctx, current); err != nil {
+			return err
+		}
+		updated++
+		return nil
+	}
+
+	end := through - 1
+	err := s.repo.StreamRecords(ctx, boxID, &domain.QueryRecord{TimeMax: &end}, func(record domain.Record) error {
+		onRecord()
+
+		date := domain.RollupDate(record.GetTimestamp())
+		if current == nil || current.Date != date {
+			if err := flush(); err != nil {
+				return err
+			}
+			current = domain.NewDailyRollup(boxID, date)
+			unsafe = false
+		}
+		if !current.Add(record) {
+			unsafe = true
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = s.rollups.SetBackfilled(ctx, boxID, through)
+	}
+	return updated, err
+}
+
+// admitRecord prepares a record about to be stored against its box: values reported in another unit
+// are converted to the catalog unit before the hydraulic calculations, records timestamped after the
+// box was decommissioned fail with ErrBoxDecommissioned, and the box's dedup and merge policies are applied.
+// It returns true when the record was merged into a stored one and must not be inserted,
+// ErrDuplicateRecord when it repeats a stored one and ErrRecordConflict when the merge policy rejects
+// it. Boxes without a policy keep every record.
+// Records that will be inserted get the rates of change configured on the box; the samples these
+// were derived from are returned for commitRates once the record is stored.
+func (s *SensorService) admitRecord(ctx context.Context, boxID string, record domain.Record) (bool, *rateSamples, error) {
+	box, err := s.admissionBox(ctx, boxID)
+	if err != nil {
+		return false, nil, err
+	}
+	calculator := s.calculator
+	if box != nil {
+		box.ConvertUnits(record)
+		if calculator, err = s.calculatorFor(ctx, box.GroupID); err != nil {
+			return false, nil, err
+		}
+	}
+
+	// Apply interpolation calculations if needed
+	s.applyInterpolation(calculator, record)
+	s.countDerivation(box, boxID, record.HasNumber("WAU"), calculator == s.calculator)
+
+	if box == nil {
+		return false, nil, nil
+	}
+
+	timestamp := record.GetTimestamp()
+	if timestamp > 1e12 {
+		timestamp = timestamp / 1000
+	}
+	if !box.AcceptsRecordAt(timestamp) {
+		return false, nil, domain.ErrBoxDecommissioned
+	}
+
+	if err := s.checkDuplicate(ctx, box, record, timestamp); err != nil {
+		return false, nil, err
+	}
+
+	// While the queue holds writes, records changing stored data on admission cannot be taken
+	paused := s.ingest.Paused()
+	if paused && box.Merge != nil && box.Merge.Mode != domain.MergeKeepBoth {
+		return false, nil, domain.ErrReadOnly
+	}
+
+	// A record written into a closed month changes its cached report totals
+	if timestamp < domain.MonthStart(time.Now()) {
+		if paused {
+			return false, nil, domain.ErrReadOnly
+		}
+		if err := s.zoneRepo.InvalidateReportCache(ctx, boxID); err != nil {
+			return false, nil, err
+		}
+	}
+
+	merged, err := s.mergeRecord(ctx, box, record)
+	if err != nil || merged {
+		return merged, nil, err
+	}
+
+	rates := s.applyRates(ctx, box, record, timestamp)
+	s.flagAnomalies(ctx, box, record)
+	return false, rates, nil
+}
+
+// checkDuplicate returns ErrDuplicateRecord when the box has a dedup policy and a stored record within
+// its window repeats record's values
+func (s *SensorService) checkDuplicate(ctx context.Context, box *domain.Box, record domain.Record, timestamp int64) error {
+	policy := box.Dedup
+	if policy == nil || policy.Window == 0 {
+		return nil
+	}
+
+	stored, err := s.repo.RecordsNear(ctx, box.ID, timestamp, policy.Window)
+	if err != nil {
+		return err
+	}
+	for _, existing := range stored {
+		if record.Repeats(existing, policy.Tolerance()) {
+			return domain.ErrDuplicateRecord
+		}
+	}
+	return nil
+}
+
+// mergeRecord applies the box's merge policy to a record about to be stored. It returns true when
+// the record was merged into a stored or still queued one, and ErrRecordConflict when the policy
+// rejects it.
+func (s *SensorService) mergeRecord(ctx context.Context, box *domain.Box, record domain.Record) (bool, error) {
+	boxID := box.ID
+	policy := box.Merge
+	if policy == nil || policy.Mode == domain.MergeKeepBoth {
+		return false, nil
+	}
+
+	// Records of the same burst are usually still queued, and not found among the stored ones
+	merged, err := s.ingest.pending.merge(boxID, record.GetTimestamp(), policy.Window, func(existing domain.Record) (domain.Record, error) {
+		if policy.Mode == domain.MergeReject {
+			return nil, domain.ErrRecordConflict
+		}
+		return domain.MergeRecords(existing, record, box.ManualMetrics()), nil
+	})
+	if err != nil || merged {
+		return merged, err
+	}
+
+	existing, err := s.repo.NearestRecord(ctx, boxID, record.GetTimestamp(), policy.Window)
+	if err != nil || existing == nil {
+		return false, err
+	}
+
+	if policy.Mode == domain.MergeReject {
+		return false, domain.ErrRecordConflict
+	}
+
+	fields := domain.MergeRecords(existing, record, box.ManualMetrics())
+	if len(fields) > 0 {
+		if err := s.repo.UpdateRecordFields(ctx, boxID, existing["_id"], fields); err != nil {
+			return false, err
+		}
+		if err := s.rollups.MarkStale(ctx, boxID, []string{domain.RollupDate(existing.GetTimestamp())}); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// rateSamples are the samples of a record its rates were derived up to, cached by commitRates
+type rateSamples struct {
+	boxID   string
+	samples map[string]domain.RecordValueAt
+}
+
+// applyRates derives <code>_rate, in units per hour, for the box metrics configured for it, from the
+// previous sample of the same metric. The field is left out for a metric's first sample, for samples
+// not newer than the previous one and across gaps longer than the rate horizon. The latest samples
+// are cached per box and seeded from the newest stored record; the record's own samples are returned
+// rather than cached, so a record that is refused later does not become the base of the next rate.
+func (s *SensorService) applyRates(ctx context.Context, box *domain.Box, record domain.Record, timestamp int64) *rateSamples {
+	codes := box.RateMetrics()
+	if len(codes) == 0 {
+		return nil
+	}
+
+	s.rateMu.Lock()
+	_, cached := s.lastSamples[box.ID]
+	s.rateMu.Unlock()
+	if !cached {
+		latest, err := s.repo.LatestRecord(ctx, box.ID)
+		if err != nil {
+			log.Printf("Rates: read latest record of box %s: %v", box.ID, err)
+			return nil
+		}
+		seed := make(map[string]domain.RecordValueAt)
+		if latest != nil {
+			at := latest.GetTimestamp()
+			if at > 1e12 {
+				at = at / 1000
+			}
+			for _, code := range codes {
+				if latest.HasNumber(code) {
+					seed[code] = domain.RecordValueAt{Time: at, Value: latest.GetFloat(code)}
+				}
+			}
+		}
+		s.rateMu.Lock()
+		if _, ok := s.lastSamples[box.ID]; !ok {
+			s.lastSamples[box.ID] = seed
+		}
+		s.rateMu.Unlock()
+	}
+
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	samples := s.lastSamples[box.ID]
+	next := &rateSamples{boxID: box.ID, samples: make(map[string]domain.RecordValueAt)}
+	for _, code := range codes {
+		if !record.HasNumber(code) {
+			continue
+		}
+		value := record.GetFloat(code)
+
+		previous, ok := samples[code]
+		if ok && timestamp <= previous.Time {
+			// Clock regression or a late record: neither a rate nor a newer sample
+			continue
+		}
+		if ok && timestamp-previous.Time <= s.rateHorizon {
+			hours := float64(timestamp-previous.Time) / 3600
+			record[code+domain.RateSuffix] = (value - previous.Value) / hours
+		}
+		next.samples[code] = domain.RecordValueAt{Time: timestamp, Value: value}
+	}
+	return next
+}
+
+// commitRates caches the samples of a stored record as the latest of its box, unless a newer
+// record was stored in the meantime
+func (s *SensorService) commitRates(rates *rateSamples) {
+	if rates == nil {
+		return
+	}
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	samples, ok := s.lastSamples[rates.boxID]
+	if !ok {
+		samples = make(map[string]domain.RecordValueAt)
+		s.lastSamples[rates.boxID] = samples
+	}
+	for code, sample := range rates.samples {
+		if previous, ok := samples[code]; ok && sample.Time <= previous.Time {
+			continue
+		}
+		samples[code] = sample
+	}
+}
+
+func (s *SensorService) ReportRecords(ctx context.Context, boxID string, query *domain.QueryRecord, opts domain.ReportOptions) ([]domain.DailyReport, error) {
+	switch opts.Avg {
+	case "":
+		opts.Avg = domain.AvgArithmetic
+	case domain.AvgArithmetic, domain.AvgTimeWeighted:
+	default:
+		return nil, domain.ErrInvalidAvgMode
+	}
+	if opts.MaxGap <= 0 {
+		opts.MaxGap = domain.DefaultReportMaxGap
+	}
+
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+	if query != nil && query.ExcludeAnomalies {
+		opts.ExcludeAnomalies = true
+	}
+
+	// Rollups hold the raw values, so corrected reports are aggregated from the records
+	if query != nil && query.Calibrate {
+		sets, err := s.calibrationSets(ctx, boxID)
+		if err != nil {
+			return nil, err
+		}
+		if set, ok := sets[boxID]; ok {
+			opts.Calibration = set
+			return s.repo.ReportRecords(ctx, boxID, query, opts)
+		}
+	}
+
+	// Time-weighted averages need the samples themselves, and rollups hold no observations and
+	// count anomalies in
+	if opts.Avg == domain.AvgArithmetic && !opts.Observations && !opts.ExcludeAnomalies {
+		return s.reportWithRollups(ctx, boxID, query, opts)
+	}
+	return s.repo.ReportRecords(ctx, boxID, query, opts)
+}
+
+// reportWithRollups reads the days fully inside the range from their rollups when these are complete,
+// and aggregates the raw records of the remaining stretches: partial days at the range ends, days
+// before rollups started that were not backfilled, and days whose records changed since.
+func (s *SensorService) reportWithRollups(ctx context.Context, boxID string, query *domain.QueryRecord, opts domain.ReportOptions) ([]domain.DailyReport, error) {
+	state, err := s.rollups.State(ctx, boxID)
 	if err != nil {
 		return nil, err
 	}
+	if state == nil {
+		return s.repo.ReportRecords(ctx, boxID, query, opts)
+	}
 
-	var boxIDs []string
-	for _, box := range boxes {
-		boxIDs = append(boxIDs, box.ID)
+	var timeMin, timeMax *int64
+	if query != nil {
+		timeMin, timeMax = query.TimeMin, query.TimeMax
+	}
+
+	var fromDate, toDate string
+	if timeMin != nil {
+		first := domain.RollupDayStart(*timeMin)
+		if first < *timeMin {
+			first += domain.RollupDaySeconds
+		}
+		fromDate = domain.RollupDate(first)
 	}
+	if timeMax != nil {
+		toDate = domain.RollupDate(domain.RollupDayStart(*timeMax+1) - domain.RollupDaySeconds)
+	}
+	if fromDate != "" && toDate != "" && fromDate > toDate {
+		return s.repo.ReportRecords(ctx, boxID, query, opts)
+	}
+
+	rollups, err := s.rollups.List(ctx, boxID, fromDate, toDate)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []domain.DailyReport{}
+	cursor := timeMin
+	for _, rollup := range rollups {
+		day, err := time.Parse("2006-01-02", rollup.Date)
+		if err != nil {
+			continue
+		}
+		dayStart := day.Unix()
+		if rollup.Stale || !state.Complete(dayStart) {
+			continue
+		}
+
+		if cursor == nil || *cursor < dayStart {
+			end := dayStart - 1
+			raw, err := s.repo.ReportRecords(ctx, boxID, &domain.QueryRecord{TimeMin: cursor, TimeMax: &end}, opts)
+			if err != nil {
+				return nil, err
+			}
+			reports = append(reports, raw...)
+		}
+		reports = append(reports, rollup.Report())
 
-	return s.repo.ListRecordsLatestByGroup(ctx, boxIDs)
+		next := dayStart + domain.RollupDaySeconds
+		cursor = &next
+	}
+
+	if cursor == timeMin {
+		// No usable rollup in the range
+		return s.repo.ReportRecords(ctx, boxID, query, opts)
+	}
+	if timeMax == nil || *cursor <= *timeMax {
+		raw, err := s.repo.ReportRecords(ctx, boxID, &domain.QueryRecord{TimeMin: cursor, TimeMax: timeMax}, opts)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, raw...)
+	}
+
+	return reports, nil
 }
 
-// applyInterpolation applies hydraulic calculations to sensor records
-// Calculates V (volume), Q (flow), Q_of (overflow) from WAU and DR
-func (s *SensorService) applyInterpolation(record domain.Record) domain.Record {
-	// Get WAU (water level) if exists
-	wau := record.GetFloat("WAU")
-	if wau == 0 {
-		return record
+// RecordStats summarizes the requested metrics of a box over a bounded time range
+func (s *SensorService) RecordStats(ctx context.Context, boxID string, query *domain.QueryRecord, metrics []string) (*domain.RecordStats, error) {
+	// Unbounded ranges would scan the whole collection
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, domain.ErrTimeRangeRequired
 	}
+	if err := validateMetricCodes(metrics); err != nil {
+		return nil, err
+	}
+
+	if err := s.requireBox(ctx, boxID); err != nil {
+		return nil, err
+	}
+
+	stats, err := s.repo.RecordStats(ctx, boxID, query, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.RecordStats{
+		BoxID:   boxID,
+		TimeMin: *query.TimeMin,
+		TimeMax: *query.TimeMax,
+		Metrics: stats,
+	}, nil
+}
+
+// RecordSchema lists the fields observed in a random sample of up to sample records of a box in
+// the query's time range, checked against the metrics configured on the box
+func (s *SensorService) RecordSchema(ctx context.Context, boxID string, query *domain.QueryRecord, sample int) (*domain.RecordSchema, error) {
+	if sample < 1 || sample > domain.MaxSchemaSample {
+		return nil, domain.ErrInvalidSchemaSample
+	}
+
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, sampled, err := s.repo.RecordFields(ctx, boxID, query, sample)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := domain.NewRecordSchema(box, fields)
+	schema.TimeMin = query.TimeMin
+	schema.TimeMax = query.TimeMax
+	schema.Sample = sample
+	schema.Sampled = sampled
+	return schema, nil
+}
+
+// MetricHistogram computes the frequency distribution of a box metric over a bounded time range,
+// with the share of samples above each numeric warning level configured on the box for the metric
+func (s *SensorService) MetricHistogram(ctx context.Context, boxID string, query *domain.QueryRecord, params domain.HistogramParams) (*domain.Histogram, error) {
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, domain.ErrTimeRangeRequired
+	}
+	if *query.TimeMin > *query.TimeMax {
+		return nil, domain.ErrInvalidTimeRange
+	}
+	if err := validateMetricCodes([]string{params.Metric}); err != nil {
+		return nil, err
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	edges := params.Edges
+	if params.BinWidth != nil {
+		min, max, err := s.repo.MetricRange(ctx, boxID, params.Metric, query)
+		if err != nil {
+			return nil, err
+		}
+		if edges, err = histogramEdges(min, max, *params.BinWidth); err != nil {
+			return nil, err
+		}
+	}
+
+	thresholds := []domain.ThresholdExceedance{}
+	for _, bm := range box.Metrics {
+		if bm.Code != params.Metric {
+			continue
+		}
+		for i, level := range []*string{bm.Warning1, bm.Warning2, bm.Warning3} {
+			if level == nil {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(*level), 64)
+			if err != nil {
+				continue
+			}
+			thresholds = append(thresholds, domain.ThresholdExceedance{Name: "warning" + strconv.Itoa(i+1), Value: value})
+		}
+	}
+
+	values := make([]float64, len(thresholds))
+	for i, t := range thresholds {
+		values[i] = t.Value
+	}
+	histogram, above, err := s.repo.MetricHistogram(ctx, boxID, params.Metric, query, edges, values)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range thresholds {
+		thresholds[i].Count = above[i]
+		if histogram.Count > 0 {
+			thresholds[i].Percent = domain.RoundValue(float64(above[i]) * 100 / float64(histogram.Count))
+		}
+	}
+
+	histogram.BoxID = boxID
+	histogram.Metric = params.Metric
+	histogram.TimeMin = *query.TimeMin
+	histogram.TimeMax = *query.TimeMax
+	histogram.Thresholds = thresholds
+	if histogram.Thresholds == nil {
+		histogram.Thresholds = []domain.ThresholdExceedance{}
+	}
+	return histogram, nil
+}
+
+// histogramEdges lays bins of the given width over the observed range of a metric, starting at a
+// multiple of the width so bins line up across requests. No values yield a single empty bin.
+func histogramEdges(min, max *float64, width float64) ([]float64, error) {
+	if min == nil || max == nil {
+		return []float64{0, width}, nil
+	}
+
+	start := math.Floor(*min/width) * width
+	span := math.Floor((*max-start)/width) + 1
+	if span > domain.MaxHistogramBins || span < 1 {
+		return nil, domain.ErrTooManyHistogramBins
+	}
+	bins := int(span)
+
+	edges := make([]float64, bins+1)
+	rounded := make([]float64, bins+1)
+	usable := true
+	for i := range edges {
+		edges[i] = start + float64(i)*width
+		// Keep edges like 0.1*3 at 0.3 rather than 0.30000000000000004
+		rounded[i] = math.Round(edges[i]*1e9) / 1e9
+		if i > 0 && rounded[i] <= rounded[i-1] {
+			usable = false
+		}
+	}
+	if usable && rounded[0] <= *min && rounded[bins] > *max {
+		return rounded, nil
+	}
+	return edges, nil
+}
+
+// CompareRecords downsamples one metric of several boxes onto common buckets so they can be overlaid
+func (s *SensorService) CompareRecords(ctx context.Context, user *domain.User, boxIDs []string, metric string, query *domain.QueryRecord, buckets int) (*domain.CompareResult, error) {
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, domain.ErrTimeRangeRequired
+	}
+	if *query.TimeMin > *query.TimeMax {
+		return nil, domain.ErrInvalidTimeRange
+	}
+	if err := validateMetricCodes([]string{metric}); err != nil {
+		return nil, err
+	}
+
+	if buckets <= 0 {
+		buckets = domain.DefaultCompareBuckets
+	}
+	if buckets > domain.MaxCompareBuckets {
+		buckets = domain.MaxCompareBuckets
+	}
+
+	span := *query.TimeMax - *query.TimeMin + 1
+	bucketSize := (span + int64(buckets) - 1) / int64(buckets)
+
+	// Resolve and authorize every box before running any aggregation
+	boxes := make([]*domain.Box, 0, len(boxIDs))
+	for _, boxID := range boxIDs {
+		box, err := s.zoneRepo.GetBox(ctx, boxID)
+		if err != nil {
+			return nil, err
+		}
+		if !user.CanAccessGroup(box.GroupID) {
+			return nil, domain.ErrBoxAccessDenied
+		}
+		boxes = append(boxes, box)
+	}
+
+	result := &domain.CompareResult{
+		Metric:     metric,
+		TimeMin:    *query.TimeMin,
+		TimeMax:    *query.TimeMax,
+		BucketSize: bucketSize,
+		Series:     make([]domain.BoxSeries, 0, len(boxes)),
+	}
+
+	for _, box := range boxes {
+		points, err := s.repo.BucketSeries(ctx, box.ID, metric, query, bucketSize)
+		if err != nil {
+			return nil, err
+		}
+
+		series := domain.BoxSeries{
+			BoxID:   box.ID,
+			BoxName: box.Name,
+			Points:  points,
+		}
+		if len(points) == 0 {
+			if boxHasMetric(box, metric) {
+				series.Note = "no values for " + metric + " in the requested range"
+			} else {
+				series.Note = "box does not report " + metric
+			}
+		}
+		result.Series = append(result.Series, series)
+	}
+
+	return result, nil
+}
+
+// QualityReport measures completeness, duplicates, out-of-range values and the longest gap of a box.
+// A zero interval means the box's expected interval and schedule.
+func (s *SensorService) QualityReport(ctx context.Context, boxID string, query *domain.QueryRecord, interval int64) (*domain.QualityReport, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.qualityReport(ctx, box, metrics, query, interval)
+}
+
+// GroupQualityReport builds the quality report of every box in a group and rolls them up. A zero
+// interval means each box's expected interval and schedule.
+func (s *SensorService) GroupQualityReport(ctx context.Context, groupID string, query *domain.QueryRecord, interval int64) (*domain.GroupQualityReport, error) {
+	if _, err := s.zoneRepo.GetGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rollup := &domain.GroupQualityReport{
+		GroupID:          groupID,
+		ExpectedInterval: interval,
+		Boxes:            make([]domain.QualityReport, 0, len(boxes)),
+	}
+	if query != nil && query.TimeMin != nil && query.TimeMax != nil {
+		rollup.TimeMin = *query.TimeMin
+		rollup.TimeMax = *query.TimeMax
+	}
+
+	for i := range boxes {
+		report, err := s.qualityReport(ctx, &boxes[i], metrics, query, interval)
+		if err != nil {
+			return nil, err
+		}
+
+		rollup.ExpectedSamples += report.ExpectedSamples
+		rollup.ActualSamples += report.ActualSamples
+		rollup.DuplicateTimestamps += report.DuplicateTimestamps
+		for _, m := range report.OutOfRange {
+			rollup.OutOfRange += m.OutOfRange
+		}
+		if report.LongestGap != nil && (rollup.LongestGap == nil || report.LongestGap.Duration > rollup.LongestGap.Duration) {
+			rollup.LongestGap = report.LongestGap
+			rollup.LongestGapBoxID = report.BoxID
+		}
+
+		rollup.Boxes = append(rollup.Boxes, *report)
+	}
+	rollup.Completeness = domain.Completeness(rollup.ActualSamples, rollup.ExpectedSamples)
+
+	return rollup, nil
+}
+
+func (s *SensorService) qualityReport(ctx context.Context, box *domain.Box, metrics []domain.Metric, query *domain.QueryRecord, interval int64) (*domain.QualityReport, error) {
+	if query == nil || query.TimeMin == nil || query.TimeMax == nil {
+		return nil, domain.ErrTimeRangeRequired
+	}
+	if *query.TimeMin > *query.TimeMax {
+		return nil, domain.ErrInvalidTimeRange
+	}
+	if interval < 0 {
+		return nil, domain.ErrInvalidExpectedInterval
+	}
+
+	bounds := boxMetricBounds(box, metrics)
+	stats, err := s.repo.QualityStats(ctx, box.ID, query, bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	// No samples are expected once a box is decommissioned
+	from, to := *query.TimeMin, *query.TimeMax
+	if box.DecommissionedAt != nil && *box.DecommissionedAt < to {
+		to = *box.DecommissionedAt
+		if to < from {
+			to = from
+		}
+	}
+	report := &domain.QualityReport{
+		BoxID:               box.ID,
+		BoxName:             box.Name,
+		TimeMin:             from,
+		TimeMax:             to,
+		ExpectedInterval:    interval,
+		ActualSamples:       int64(len(stats.Timestamps)),
+		DuplicateTimestamps: stats.Duplicates,
+		OutOfRange:          make([]domain.MetricQuality, 0, len(bounds)),
+	}
+	if interval > 0 {
+		report.ExpectedSamples = domain.ExpectedSamples(from, to, interval)
+		report.LongestGap = domain.LongestGap(stats.Timestamps, from, to, interval)
+	} else {
+		// Without a requested interval the box's own applies, following its schedule
+		report.ExpectedInterval = box.ExpectedIntervalAt(from)
+		report.ReportingSchedule = box.Schedule
+		report.ExpectedSamples = box.ExpectedSamplesIn(from, to)
+		report.LongestGap = domain.LongestGapBy(stats.Timestamps, from, to, box.ExpectedIntervalAt)
+	}
+	report.Completeness = domain.Completeness(report.ActualSamples, report.ExpectedSamples)
+
+	for _, b := range bounds {
+		report.OutOfRange = append(report.OutOfRange, domain.MetricQuality{
+			Metric:     b.Code,
+			Min:        b.Min,
+			Max:        b.Max,
+			OutOfRange: stats.OutOfRange[b.Code],
+		})
+	}
+
+	return report, nil
+}
+
+// boxMetricBounds resolves the configured bounds of each metric a box reports.
+// BoxMetric.Metric references the metric by ID or code; the record field is BoxMetric.Code.
+func boxMetricBounds(box *domain.Box, metrics []domain.Metric) []domain.MetricBounds {
+	byKey := make(map[string]*domain.Metric)
+	for i := range metrics {
+		byKey[metrics[i].ID] = &metrics[i]
+		byKey[metrics[i].Code] = &metrics[i]
+	}
+
+	var bounds []domain.MetricBounds
+	for _, bm := range box.Metrics {
+		if validateMetricCodes([]string{bm.Code}) != nil {
+			continue
+		}
+
+		metric := byKey[bm.Code]
+		if bm.Metric != nil {
+			if m, ok := byKey[*bm.Metric]; ok {
+				metric = m
+			}
+		}
+		if metric == nil {
+			continue
+		}
+
+		if b, ok := metric.Bounds(); ok {
+			b.Code = bm.Code
+			bounds = append(bounds, b)
+		}
+	}
+	return bounds
+}
+
+// validateMetricCodes rejects codes that cannot be used as record field names in a pipeline
+func validateMetricCodes(metrics []string) error {
+	for _, metric := range metrics {
+		if metric == "" || strings.ContainsAny(metric, ".$") {
+			return domain.ErrInvalidMetricCode
+		}
+	}
+	return nil
+}
+
+func boxHasMetric(box *domain.Box, metric string) bool {
+	for _, m := range box.Metrics {
+		if m.Code == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// ListRecordsByGroup pages through the records of every box in a group, enriched with box_name and device_id.
+// With query.DeletedBoxes, the boxes deleted after the start of the range are read too and their records
+// flagged with box_deleted.
+func (s *SensorService) ListRecordsByGroup(ctx context.Context, groupID string, query *domain.QueryRecord) (*domain.RecordsResult, error) {
+	filter := domain.FilterBoxParams{GroupID: &groupID}
+	if query != nil && query.DeletedBoxes {
+		filter.IncludeDeleted = true
+		if query.TimeMin != nil {
+			filter.DeletedSince = *query.TimeMin * 1000
+		}
+	}
+	boxes, err := s.zoneRepo.ListBoxes(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var boxIDs []string
+	for _, box := range boxes {
+		boxIDs = append(boxIDs, box.ID)
+	}
+
+	result, err := s.repo.ListRecordsByGroup(ctx, boxIDs, query)
+	if err != nil {
+		return nil, err
+	}
+	dropAnomalies(query, result.Records)
+	if err := s.calibrate(ctx, query, result.Records, boxIDs...); err != nil {
+		return nil, err
+	}
+
+	enrichRecords(result.Records, boxes)
+	normalizeRecords(result.Records)
+	result.Layouts, err = s.boxLayouts(ctx, boxes)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SensorService) ListRecordsLatestByGroup(ctx context.Context, groupID string) (*domain.RecordsResult, error) {
+	filter := domain.FilterBoxParams{GroupID: &groupID}
+	boxes, err := s.zoneRepo.ListBoxes(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var boxIDs []string
+	for _, box := range boxes {
+		boxIDs = append(boxIDs, box.ID)
+	}
+
+	result, err := s.repo.ListRecordsLatestByGroup(ctx, boxIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	enrichRecords(result.Records, boxes)
+	if err := s.markMaintenance(ctx, result.Records, boxes, groupID); err != nil {
+		return nil, err
+	}
+	normalizeRecords(result.Records)
+	result.Layouts, err = s.boxLayouts(ctx, boxes)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PrepareGroupExport resolves the group, its boxes and the unit of every metric they report
+func (s *SensorService) PrepareGroupExport(ctx context.Context, groupID string) (*domain.GroupExport, error) {
+	group, err := s.zoneRepo.GetGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes, err := s.zoneRepo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &groupID})
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	units := make(map[string]map[string]string, len(boxes))
+	layouts := make(map[string][]domain.MetricLayout, len(boxes))
+	for i := range boxes {
+		units[boxes[i].ID] = boxMetricUnits(&boxes[i], metrics)
+		layouts[boxes[i].ID] = boxMetricLayout(&boxes[i], metrics)
+	}
+
+	return &domain.GroupExport{Group: group, Boxes: boxes, Units: units, Layouts: layouts}, nil
+}
+
+// CheckBoxExport refuses an Excel export of a box whose record count exceeds the export limit
+func (s *SensorService) CheckBoxExport(ctx context.Context, boxID string, query *domain.QueryRecord) error {
+	if s.exportMaxRows <= 0 {
+		return nil
+	}
+	count, err := s.CountRecords(ctx, boxID, query)
+	if err != nil {
+		return err
+	}
+	return checkExportRows(count, s.exportMaxRows, domain.ExportXLSXRowBytes)
+}
+
+// CheckGroupExport refuses a long export of a group whose row count exceeds the export limit.
+// Each record is counted once per metric of its box, an upper bound since records may skip metrics.
+func (s *SensorService) CheckGroupExport(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord) error {
+	if s.exportMaxRows <= 0 {
+		return nil
+	}
+	rows, err := s.countGroupExportRows(ctx, export, query, true)
+	if err != nil {
+		return err
+	}
+	return checkExportRows(rows, s.exportMaxRows, domain.ExportCSVRowBytes)
+}
+
+// countGroupExportRows counts the records of every box of the export, times the box's metrics when perMetric
+func (s *SensorService) countGroupExportRows(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord, perMetric bool) (int64, error) {
+	var rows int64
+	for i := range export.Boxes {
+		count, err := s.repo.CountRecords(ctx, export.Boxes[i].ID, query)
+		if err != nil {
+			return 0, err
+		}
+		if perMetric && len(export.Layouts[export.Boxes[i].ID]) > 0 {
+			count *= int64(len(export.Layouts[export.Boxes[i].ID]))
+		}
+		rows += count
+	}
+	return rows, nil
+}
+
+func checkExportRows(rows, maxRows int64, rowBytes int64) error {
+	if maxRows > 0 && rows > maxRows {
+		return &domain.ExportTooLargeError{EstimatedRows: rows, EstimatedBytes: rows * rowBytes, MaxRows: maxRows}
+	}
+	return nil
+}
+
+// StreamGroupExport emits one row per (timestamp, box, metric) for every box of the export,
+// box by box, so only one cursor batch is held in memory at a time
+func (s *SensorService) StreamGroupExport(ctx context.Context, export *domain.GroupExport, query *domain.QueryRecord, fn func(domain.LongRecordRow) error) error {
+	var calibrations map[string]domain.CalibrationSet
+	if query != nil && query.Calibrate {
+		boxIDs := make([]string, len(export.Boxes))
+		for i, box := range export.Boxes {
+			boxIDs[i] = box.ID
+		}
+		var err error
+		if calibrations, err = s.calibrationSets(ctx, boxIDs...); err != nil {
+			return err
+		}
+	}
+
+	for i := range export.Boxes {
+		box := &export.Boxes[i]
+		units := export.Units[box.ID]
+		layout := export.Layouts[box.ID]
+		calibration := calibrations[box.ID]
+
+		err := s.repo.StreamRecords(ctx, box.ID, query, func(record domain.Record) error {
+			if query != nil && query.ExcludeAnomalies {
+				record.DropAnomalies()
+			}
+			calibration.Apply(record)
+			timestamp := record.GetTimestamp()
+			if timestamp > 1e12 {
+				timestamp = timestamp / 1000
+			}
+
+			for _, code := range domain.OrderMetricCodes(record.MetricCodes(), layout) {
+				row := domain.LongRecordRow{
+					Timestamp: timestamp,
+					BoxID:     box.ID,
+					BoxName:   box.Name,
+					Metric:    code,
+					Unit:      units[code],
+					Value:     record.GetFloat(code),
+				}
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boxMetricUnits maps each record field a box reports to the unit of its metric, resolved like boxMetricBounds
+func boxMetricUnits(box *domain.Box, metrics []domain.Metric) map[string]string {
+	byKey := make(map[string]*domain.Metric)
+	for i := range metrics {
+		byKey[metrics[i].ID] = &metrics[i]
+		byKey[metrics[i].Code] = &metrics[i]
+	}
+
+	units := make(map[string]string)
+	for i := range metrics {
+		units[metrics[i].Code] = metrics[i].Unit
+	}
+	for _, bm := range box.Metrics {
+		if bm.Metric == nil {
+			continue
+		}
+		if metric, ok := byKey[*bm.Metric]; ok {
+			units[bm.Code] = metric.Unit
+		}
+	}
+	return units
+}
+
+// BoxLogs returns the logs of a box in the query's time range, oldest first, for exports
+func (s *SensorService) BoxLogs(ctx context.Context, boxID string, query *domain.QueryRecord) ([]domain.BoxLog, error) {
+	return s.logRepo.List(ctx, domain.FilterBoxLogParams{BoxID: boxID, From: query.TimeMin, To: query.TimeMax})
+}
+
+// MetricLayout returns the metrics of a box in display order
+func (s *SensorService) MetricLayout(ctx context.Context, boxID string) ([]domain.MetricLayout, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return boxMetricLayout(box, metrics), nil
+}
+
+// boxLayouts resolves the metric layout of each box
+func (s *SensorService) boxLayouts(ctx context.Context, boxes []domain.Box) (map[string][]domain.MetricLayout, error) {
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	layouts := make(map[string][]domain.MetricLayout, len(boxes))
+	for i := range boxes {
+		layouts[boxes[i].ID] = boxMetricLayout(&boxes[i], metrics)
+	}
+	return layouts, nil
+}
+
+// boxMetricLayout lists the metrics a box reports in display order. Name, unit, sort order and
+// category come from the referenced metric, resolved like boxMetricBounds, unless the box overrides them.
+func boxMetricLayout(box *domain.Box, metrics []domain.Metric) []domain.MetricLayout {
+	byKey := make(map[string]*domain.Metric)
+	for i := range metrics {
+		byKey[metrics[i].ID] = &metrics[i]
+		byKey[metrics[i].Code] = &metrics[i]
+	}
+
+	layout := make([]domain.MetricLayout, 0, len(box.Metrics))
+	for _, bm := range box.Metrics {
+		entry := domain.MetricLayout{Code: bm.Code, Name: bm.Code, Precision: domain.DefaultMetricPrecision}
+
+		metric := byKey[bm.Code]
+		if bm.Metric != nil {
+			if m, ok := byKey[*bm.Metric]; ok {
+				metric = m
+			}
+		}
+		if metric != nil {
+			entry.Name = metric.Name
+			entry.Unit = metric.Unit
+			entry.SortOrder = metric.SortOrder
+			entry.Category = metric.Category
+			entry.Precision = metric.Decimals()
+		}
+
+		if bm.Name != nil {
+			entry.Name = *bm.Name
+		}
+		if bm.SortOrder != nil {
+			entry.SortOrder = *bm.SortOrder
+		}
+		if bm.Category != nil {
+			entry.Category = *bm.Category
+		}
+		layout = append(layout, entry)
+	}
+
+	domain.SortMetricLayout(layout)
+	return layout
+}
+
+// IngestSchema describes the reading a box's logger is expected to post, from the box's metrics
+func (s *SensorService) IngestSchema(ctx context.Context, boxID string) (*domain.IngestSchema, error) {
+	box, err := s.zoneRepo.GetBox(ctx, boxID)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	inputUnits := make(map[string]string)
+	manual := box.ManualMetrics()
+	for _, bm := range box.Metrics {
+		if bm.Conversion != nil {
+			inputUnits[bm.Code] = bm.Conversion.InputUnit
+		}
+	}
+
+	timestamp := time.Now().Unix()
+	schema := &domain.IngestSchema{
+		BoxID:         box.ID,
+		TimestampUnit: "s",
+		Metrics:       []domain.IngestSchemaMetric{},
+		Derived:       []string{"V", "Q", "Q_of"},
+		Example:       domain.IngestRecord{Timestamp: &timestamp, Metrics: map[string]interface{}{}},
+	}
+	for _, entry := range boxMetricLayout(box, metrics) {
+		metric := domain.IngestSchemaMetric{Code: entry.Code, Name: entry.Name, Unit: entry.Unit, Manual: manual[entry.Code]}
+		if unit, ok := inputUnits[entry.Code]; ok {
+			metric.Unit = unit
+		}
+		schema.Metrics = append(schema.Metrics, metric)
+		if !metric.Manual {
+			schema.Example.Metrics[entry.Code] = 0.0
+		}
+	}
+	for _, code := range box.RateMetrics() {
+		schema.Derived = append(schema.Derived, code+domain.RateSuffix)
+	}
+	return schema, nil
+}
+
+// markMaintenance flags the latest records of boxes under an active maintenance window with
+// maintenance and maintenance_until, so dashboards show them as in maintenance rather than offline
+func (s *SensorService) markMaintenance(ctx context.Context, records []domain.Record, boxes []domain.Box, groupID string) error {
+	boxIDs := make([]string, len(boxes))
+	for i := range boxes {
+		boxIDs[i] = boxes[i].ID
+	}
+
+	now := time.Now().Unix()
+	windows, err := s.maintRepo.ListActive(ctx, boxIDs, []string{groupID}, now)
+	if err != nil {
+		return err
+	}
+
+	statuses := domain.BoxMaintenanceStatus(windows, boxes, now)
+	for _, record := range records {
+		boxID, _ := record["box_id"].(string)
+		if status, ok := statuses[boxID]; ok {
+			record["maintenance"] = true
+			record["maintenance_until"] = status.Until
+		}
+	}
+	return nil
+}
+
+// normalizeRecords makes listed records safe to serialize alike from every endpoint, see Record.Normalize
+func normalizeRecords(records []domain.Record) {
+	for _, record := range records {
+		record.Normalize()
+	}
+}
+
+// enrichRecords adds box_name and device_id to records carrying a box_id, using the already loaded boxes
+func enrichRecords(records []domain.Record, boxes []domain.Box) {
+	byID := make(map[string]*domain.Box, len(boxes))
+	for i := range boxes {
+		byID[boxes[i].ID] = &boxes[i]
+	}
+
+	for _, record := range records {
+		boxID, _ := record["box_id"].(string)
+		if box, ok := byID[boxID]; ok {
+			record["box_name"] = box.Name
+			record["device_id"] = box.DeviceID
+			if box.DTime != nil {
+				record["box_deleted"] = true
+			}
+		}
+	}
+}
+
+// applyInterpolation applies hydraulic calculations to sensor records
+// Calculates V (volume), Q (flow), Q_of (overflow) from WAU and DR.
+// A derived value is only written when its inputs are in the record: zero is a valid level or
+// opening, while an absent field means the logger did not report it.
+func (s *SensorService) applyInterpolation(calculator *interpolation.HydraulicCalculator, record domain.Record) domain.Record {
+	if !record.HasNumber("WAU") {
+		return record
+	}
+	wau := record.GetFloat("WAU")
 
 	// Calculate V (volume) from WAU
-	v := s.calculator.CalculateWaterIndex(wau)
+	v := calculator.CalculateWaterIndex(wau)
 	record["V"] = domain.RoundValue(v)
 
 	// Calculate Q (flow) from WAU and DR if DR exists
-	dr := record.GetFloat("DR")
-	if dr > 0 {
-		q := s.calculator.CalculateWaterFlow(wau, dr)
+	if record.HasNumber("DR") {
+		q := calculator.CalculateWaterFlow(wau, record.GetFloat("DR"))
 		record["Q"] = domain.RoundValue(q)
 	}
 
 	// Calculate Q_of (overflow) from WAU
-	qOf := s.calculator.CalculateWaterOverFlow(wau)
+	qOf := calculator.CalculateWaterOverFlow(wau)
 	record["Q_of"] = domain.RoundValue(qOf)
 
 	return record
 }
 
-// SetVolumeCurve allows configuring custom volume curve for a specific box/zone
-func (s *SensorService) SetVolumeCurve(points []interpolation.Point) {
-	s.calculator.SetVolumeCurve(points)
+// SetVolumeCurve allows configuring custom volume curve for a specific box/zone.
+// Invalid points fail with an *interpolation.CurveError and leave the curve unchanged.
+func (s *SensorService) SetVolumeCurve(points []interpolation.Point) error {
+	return s.calculator.SetVolumeCurve(points)
 }
 
-// SetFlowCurve allows configuring custom flow curve
-func (s *SensorService) SetFlowCurve(points []interpolation.Point) {
-	s.calculator.SetFlowCurve(points)
+// SetFlowCurve allows configuring custom flow curve.
+// Invalid points fail with an *interpolation.CurveError and leave the curve unchanged.
+func (s *SensorService) SetFlowCurve(points []interpolation.Point) error {
+	return s.calculator.SetFlowCurve(points)
 }
 
 // SetOverflowParams allows configuring overflow parameters
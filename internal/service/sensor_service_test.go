@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"tp25-api/internal/domain"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/lib/interpolation"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestApplyInterpolation(t *testing.T) {
+	// The built-in volume curve runs from WAU 0 (V 0) to WAU 5 (V 4.5)
+	weir := 0.49 * 10 * math.Sqrt(2*9.81)
+
+	tests := []struct {
+		name   string
+		record domain.Record
+		want   map[string]float64 // derived fields expected, every other one absent
+	}{
+		{"absent WAU", domain.Record{"DR": 2.0}, nil},
+		{"WAU that is not a number", domain.Record{"WAU": "n/a", "DR": 2.0}, nil},
+		{"zero WAU", domain.Record{"WAU": 0.0}, map[string]float64{"V": 0, "Q_of": 0}},
+		{"zero WAU and DR", domain.Record{"WAU": 0.0, "DR": 0.0}, map[string]float64{"V": 0, "Q": 0, "Q_of": 0}},
+		{"absent DR", domain.Record{"WAU": 1.0}, map[string]float64{"V": 0.5, "Q_of": domain.RoundValue(weir)}},
+		{"zero DR", domain.Record{"WAU": 1.0, "DR": 0.0}, map[string]float64{"V": 0.5, "Q": 0, "Q_of": domain.RoundValue(weir)}},
+		{"integer WAU and DR", domain.Record{"WAU": int32(2), "DR": int64(1)}, map[string]float64{
+			"V": 1.2, "Q": domain.RoundValue(math.Sqrt(2 * 9.81 * 2)), "Q_of": domain.RoundValue(weir * math.Pow(2, 1.5)),
+		}},
+		{"WAU between curve points", domain.Record{"WAU": 2.5}, map[string]float64{"V": 1.65, "Q_of": domain.RoundValue(weir * math.Pow(2.5, 1.5))}},
+		{"WAU below the curve", domain.Record{"WAU": -1.0, "DR": 1.0}, map[string]float64{"V": 0, "Q": 0, "Q_of": 0}},
+		{"WAU above the curve", domain.Record{"WAU": 8.0}, map[string]float64{"V": 4.5, "Q_of": domain.RoundValue(weir * math.Pow(8, 1.5))}},
+	}
+
+	s := &SensorService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := s.applyInterpolation(interpolation.NewHydraulicCalculator(), tt.record)
+			for _, key := range []string{"V", "Q", "Q_of"} {
+				want, expected := tt.want[key]
+				got, present := record[key]
+				switch {
+				case expected && !present:
+					t.Errorf("%s missing, want %v", key, want)
+				case !expected && present:
+					t.Errorf("%s = %v, want it absent", key, got)
+				case expected && math.Abs(record.GetFloat(key)-want) > 1e-9:
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// A custom flow curve is read by WAU, past its ends as at them
+func TestApplyInterpolationFlowCurve(t *testing.T) {
+	calculator := interpolation.NewHydraulicCalculator()
+	if err := calculator.SetFlowCurve([]interpolation.Point{{X: 1, Y: 10}, {X: 3, Y: 30}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &SensorService{}
+	for wau, want := range map[float64]float64{0: 10, 2: 20, 4: 30} {
+		record := s.applyInterpolation(calculator, domain.Record{"WAU": wau, "DR": 1.0})
+		if got := record.GetFloat("Q"); got != want {
+			t.Errorf("Q at WAU %v = %v, want %v", wau, got, want)
+		}
+	}
+}
+
+// unreachableDB is a database on a port nothing listens on. Queries made with a canceled context
+// return its error at once, showing they were made.
+func unreachableDB(t *testing.T) *mongo.Database {
+	t.Helper()
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client.Database("tp25_test")
+}
+
+// A record near one still queued is merged into it or rejected per the box's policy, without
+// reading the stored records; the queued one is written with the merged fields
+func TestMergeRecordIntoQueued(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	manual := domain.BoxMetric{Code: "GAUGE", Manual: true}
+
+	tests := []struct {
+		name   string
+		policy *domain.MergePolicy
+		record domain.Record
+		merged bool
+		err    error
+		queued domain.Record // the queued record after the merge
+	}{
+		{
+			name:   "merge",
+			policy: &domain.MergePolicy{Mode: domain.MergeFields, Window: 60},
+			record: domain.Record{"_id": int64(1030), "src": domain.RecordSourceManual, "GAUGE": 1.5, "WAU": 9.0},
+			merged: true,
+			queued: domain.Record{"_id": int64(1000), "GAUGE": 1.5, "WAU": 2.0},
+		},
+		{
+			name:   "reject",
+			policy: &domain.MergePolicy{Mode: domain.MergeReject, Window: 60},
+			record: domain.Record{"_id": int64(970), "WAU": 9.0},
+			err:    domain.ErrRecordConflict,
+			queued: domain.Record{"_id": int64(1000), "GAUGE": 1.0, "WAU": 2.0},
+		},
+		{
+			name:   "keep both",
+			policy: &domain.MergePolicy{Mode: domain.MergeKeepBoth, Window: 60},
+			record: domain.Record{"_id": int64(1000), "WAU": 9.0},
+			queued: domain.Record{"_id": int64(1000), "GAUGE": 1.0, "WAU": 2.0},
+		},
+		{
+			name:   "no policy",
+			record: domain.Record{"_id": int64(1000), "WAU": 9.0},
+			queued: domain.Record{"_id": int64(1000), "GAUGE": 1.0, "WAU": 2.0},
+		},
+		{
+			// Only the stored records are left to search, which the canceled context stops
+			name:   "outside the window",
+			policy: &domain.MergePolicy{Mode: domain.MergeReject, Window: 60},
+			record: domain.Record{"_id": int64(1061), "WAU": 9.0},
+			err:    context.Canceled,
+			queued: domain.Record{"_id": int64(1000), "GAUGE": 1.0, "WAU": 2.0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SensorService{repo: mongodb.NewSensorRepository(unreachableDB(t)), ingest: &IngestQueue{}}
+			queued := domain.Record{"_id": int64(1000), "GAUGE": 1.0, "WAU": 2.0}
+			s.ingest.pending.add("box", "r1", queued)
+			box := &domain.Box{ID: "box", Metrics: []domain.BoxMetric{{Code: "WAU"}, manual}, Merge: tt.policy}
+
+			merged, err := s.mergeRecord(canceled, box, tt.record)
+			if merged != tt.merged || !errors.Is(err, tt.err) {
+				t.Errorf("got %v, %v; want %v, %v", merged, err, tt.merged, tt.err)
+			}
+			if !reflect.DeepEqual(queued, tt.queued) {
+				t.Errorf("queued record %v, want %v", queued, tt.queued)
+			}
+		})
+	}
+}
+
+// Fields merged into a record a worker is writing are set once it is stored, not raced into it
+func TestMergeRecordIntoWriting(t *testing.T) {
+	s := &SensorService{ingest: &IngestQueue{}}
+	item := ingestItem{receipt: "r1", boxID: "box", record: domain.Record{"_id": int64(1000), "WAU": 2.0}}
+	s.ingest.pending.add(item.boxID, item.receipt, item.record)
+	s.ingest.pending.claim([]ingestItem{item})
+	box := &domain.Box{ID: "box", Merge: &domain.MergePolicy{Mode: domain.MergeFields, Window: 60}}
+
+	for _, record := range []domain.Record{{"_id": int64(1010), "DR": 1.0}, {"_id": int64(1020), "DR": 5.0, "Q": 3.0}} {
+		if merged, err := s.mergeRecord(context.Background(), box, record); !merged || err != nil {
+			t.Fatalf("got %v, %v; want merged", merged, err)
+		}
+	}
+	if want := (domain.Record{"_id": int64(1000), "WAU": 2.0}); !reflect.DeepEqual(item.record, want) {
+		t.Errorf("record being written changed to %v", item.record)
+	}
+
+	// The second merge saw DR from the first and kept it
+	late := s.ingest.pending.done(item.boxID, []ingestItem{item})
+	if want := (domain.Record{"DR": 1.0, "Q": 3.0}); !reflect.DeepEqual(late["r1"], want) {
+		t.Errorf("late fields %v, want %v", late["r1"], want)
+	}
+	if len(s.ingest.pending.boxes) != 0 {
+		t.Errorf("written records still pending: %v", s.ingest.pending.boxes)
+	}
+}
+
+// Records are admitted against the box held in memory until it changes
+func TestAdmissionBoxCached(t *testing.T) {
+	s := &SensorService{zoneRepo: mongodb.NewZoneRepository(unreachableDB(t)), boxes: boxCache{boxes: make(map[string]cachedBox)}}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cached := &domain.Box{ID: "box", Merge: &domain.MergePolicy{Mode: domain.MergeReject, Window: 60}}
+	s.boxes.boxes["box"] = cachedBox{box: cached, loadedAt: time.Now()}
+	s.boxes.boxes["unknown"] = cachedBox{loadedAt: time.Now()}
+
+	if box, err := s.admissionBox(canceled, "box"); box != cached || err != nil {
+		t.Errorf("got %v, %v; want the cached box", box, err)
+	}
+	if box, err := s.admissionBox(canceled, "unknown"); box != nil || err != nil {
+		t.Errorf("got %v, %v; want the box cached as missing", box, err)
+	}
+
+	s.ForgetBox(context.Background(), "box")
+	if _, err := s.admissionBox(canceled, "box"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v after ForgetBox, want the box read again", err)
+	}
+
+	s.boxes.boxes["box"] = cachedBox{box: cached, loadedAt: time.Now().Add(-boxCacheTTL)}
+	if _, err := s.admissionBox(canceled, "box"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v past the TTL, want the box read again", err)
+	}
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"strings"
 
 	"tp25-api/internal/domain"
 	"tp25-api/internal/repository/mongodb"
@@ -25,6 +26,32 @@ func (s *SettingService) ListWithPagination(ctx context.Context, pagination *dom
 	return s.repo.ListWithPagination(ctx, pagination, filter)
 }
 
+// Values returns the values of the settings in namespace, nested by the segments of their keys;
+// every setting when namespace is empty
+func (s *SettingService) Values(ctx context.Context, namespace string) (map[string]interface{}, error) {
+	namespace = strings.TrimSuffix(namespace, ".")
+	var settings []domain.Setting
+	var err error
+	if namespace == "" {
+		settings, err = s.repo.List(ctx)
+	} else {
+		settings, err = s.repo.ListByPrefix(ctx, namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return domain.SettingTree(settings, namespace), nil
+}
+
+// KeyReport lists the settings whose keys predate the naming convention, with the key to rename them to
+func (s *SettingService) KeyReport(ctx context.Context) ([]domain.SettingKeyReport, error) {
+	settings, err := s.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return domain.NonconformingSettingKeys(settings), nil
+}
+
 func (s *SettingService) GetByID(ctx context.Context, id string) (*domain.Setting, error) {
 	return s.repo.GetByID(ctx, id)
 }
@@ -33,23 +60,38 @@ func (s *SettingService) GetByKey(ctx context.Context, key string) (*domain.Sett
 	return s.repo.GetByKey(ctx, key)
 }
 
+// Create adds a setting, whose key must follow the naming convention of domain.ValidSettingKey
 func (s *SettingService) Create(ctx context.Context, params domain.CreateSettingParams) (*domain.Setting, error) {
-	// Validate key
-	if params.Key == "" {
+	if !domain.ValidSettingKey(params.Key) {
 		return nil, domain.ErrInvalidSettingKey
 	}
 
 	return s.repo.Create(ctx, params)
 }
 
-func (s *SettingService) Update(ctx context.Context, id string, params domain.UpdateSettingParams) (*domain.Setting, error) {
-	return s.repo.Update(ctx, id, params)
+func (s *SettingService) Update(ctx context.Context, id string, params domain.UpdateSettingParams, actorID string) (*domain.Setting, error) {
+	return s.repo.Update(ctx, id, params, actorID)
 }
 
-func (s *SettingService) UpdateByKey(ctx context.Context, key string, params domain.UpdateSettingParams) (*domain.Setting, error) {
-	return s.repo.UpdateByKey(ctx, key, params)
+func (s *SettingService) UpdateByKey(ctx context.Context, key string, params domain.UpdateSettingParams, actorID string) (*domain.Setting, error) {
+	return s.repo.UpdateByKey(ctx, key, params, actorID)
 }
 
-func (s *SettingService) Delete(ctx context.Context, id string) error {
-	return s.repo.Delete(ctx, id)
+func (s *SettingService) Delete(ctx context.Context, id string, actorID string) error {
+	return s.repo.Delete(ctx, id, actorID)
+}
+
+// ListHistory returns the previous versions of a setting, which stay available after it is deleted
+func (s *SettingService) ListHistory(ctx context.Context, id string, pagination *domain.Pagination) ([]domain.SettingVersion, int64, error) {
+	return s.repo.ListHistory(ctx, id, pagination)
+}
+
+// Restore re-applies the value of a previous version; the value being replaced is kept as a new version
+func (s *SettingService) Restore(ctx context.Context, id, versionID string, actorID string) (*domain.Setting, error) {
+	version, err := s.repo.GetVersion(ctx, id, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.Restore(ctx, version, actorID)
 }
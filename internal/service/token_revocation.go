@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenVersionsTTL is how long token versions are served from memory before the users modified
+// since are read again, which bounds how long a revocation made by another instance takes to apply
+const tokenVersionsTTL = 10 * time.Second
+
+// tokenVersionsOverlap is taken off the time of the previous read when reading the users modified
+// since, so a modification stamped before that read but written after it is not missed
+const tokenVersionsOverlap = 5 * time.Second
+
+// tokenVersionDeleted is the version of the tokens of deleted users, none of which is valid
+const tokenVersionDeleted = math.MaxInt64
+
+// tokenVersions caches the token version of the users whose tokens were revoked
+type tokenVersions struct {
+	mu       sync.Mutex
+	versions map[string]int64
+	since    int64 // milliseconds, 0 until read once
+	loadedAt time.Time
+}
+
+// TokenRevoked reports whether an access token of the user carrying version was revoked, by a
+// change of the user's access or the user's deletion since it was issued
+func (s *UserService) TokenRevoked(ctx context.Context, userID string, version int64) bool {
+	s.tokens.mu.Lock()
+	stale := time.Since(s.tokens.loadedAt) >= tokenVersionsTTL
+	s.tokens.mu.Unlock()
+	if stale {
+		s.loadTokenVersions(ctx)
+	}
+
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+	return version < s.tokens.versions[userID]
+}
+
+// RevokeZoneTokens revokes the tokens of the users of the zones, e.g. when a group joins or leaves
+// one of them, since the tokens list the groups of the user's zones. It runs after the change is
+// saved and cannot undo it, so failures are logged.
+func (s *UserService) RevokeZoneTokens(ctx context.Context, zoneIDs ...string) {
+	if err := s.repo.RevokeZoneTokens(ctx, zoneIDs); err != nil {
+		log.Printf("Token revocation: revoke tokens of zones %v: %v", zoneIDs, err)
+		return
+	}
+
+	// The new versions are read on the next check
+	s.tokens.mu.Lock()
+	s.tokens.loadedAt = time.Time{}
+	s.tokens.mu.Unlock()
+}
+
+// loadTokenVersions reads the versions of the users modified since the previous read. When they
+// cannot be read, the versions known are kept until the next try.
+func (s *UserService) loadTokenVersions(ctx context.Context) {
+	s.tokens.mu.Lock()
+	since := s.tokens.since
+	s.tokens.mu.Unlock()
+
+	started := time.Now()
+	users, err := s.repo.ListTokenVersions(ctx, since)
+
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+	s.tokens.loadedAt = time.Now()
+	if err != nil {
+		log.Printf("Token revocation: read token versions: %v", err)
+		return
+	}
+	for _, user := range users {
+		version := user.TokenVersion
+		if user.DTime != nil {
+			version = tokenVersionDeleted
+		}
+		s.setTokenVersionLocked(user.ID, version)
+	}
+	s.tokens.since = started.Add(-tokenVersionsOverlap).UnixMilli()
+}
+
+// setTokenVersion records a version set by this instance, which need not wait for the next read
+func (s *UserService) setTokenVersion(userID string, version int64) {
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+	s.setTokenVersionLocked(userID, version)
+}
+
+// setTokenVersionLocked records version unless a later one is known; versions only go up
+func (s *UserService) setTokenVersionLocked(userID string, version int64) {
+	if s.tokens.versions == nil {
+		s.tokens.versions = map[string]int64{}
+	}
+	if version > s.tokens.versions[userID] {
+		s.tokens.versions[userID] = version
+	}
+}
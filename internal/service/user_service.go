@@ -2,11 +2,20 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
 	"time"
 
 	"tp25-api/internal/domain"
 	"tp25-api/internal/repository/mongodb"
 	"tp25-api/lib"
+	"tp25-api/lib/jwtkeys"
+	"tp25-api/lib/notify"
+	"tp25-api/lib/secretbox"
+	"tp25-api/lib/totp"
 
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
@@ -14,19 +23,81 @@ import (
 )
 
 type UserService struct {
-	repo      *mongodb.UserRepository
-	jwtSecret string
+	repo     *mongodb.UserRepository
+	zoneRepo *mongodb.ZoneRepository
+	jwtKeys  *jwtkeys.Keys
+
+	sender          notify.Sender
+	resetTTL        time.Duration
+	resetMaxPerHour int
+
+	secretBox *secretbox.Box
+
+	sessionLimits map[domain.Role]int
+	sessionEvict  bool
+
+	securityEvents    *mongodb.SecurityEventRepository
+	securityRetention time.Duration
+
+	tokens tokenVersions
 }
 
-func NewUserService(repo *mongodb.UserRepository, jwtSecret string) *UserService {
+// NewUserService signs tokens with the first of jwtSecrets and accepts tokens signed with any of them
+func NewUserService(repo *mongodb.UserRepository, zoneRepo *mongodb.ZoneRepository, jwtSecrets []string) *UserService {
 	return &UserService{
-		repo:      repo,
-		jwtSecret: jwtSecret,
+		repo:     repo,
+		zoneRepo: zoneRepo,
+		jwtKeys:  jwtkeys.New(jwtSecrets),
 	}
 }
 
+// SetPasswordReset configures how password reset tokens are delivered, how long they live
+// and how many a user may request per hour
+func (s *UserService) SetPasswordReset(sender notify.Sender, ttl time.Duration, maxPerHour int) {
+	s.sender = sender
+	s.resetTTL = ttl
+	s.resetMaxPerHour = maxPerHour
+}
+
+// GetUser returns a user with the groups of their zones resolved, so CanAccessGroup covers them
 func (s *UserService) GetUser(ctx context.Context, id string) (*domain.User, error) {
-	return s.repo.GetUser(ctx, id)
+	user, err := s.repo.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.resolveZoneGroups(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// resolveZoneGroups lists the groups of the user's zones, which the user may read
+func (s *UserService) resolveZoneGroups(ctx context.Context, user *domain.User) error {
+	if user.Role == domain.RoleAdmin || len(user.ZoneIDs) == 0 {
+		return nil
+	}
+	var groupIDs []string
+	for _, zoneID := range user.ZoneIDs {
+		groups, err := s.zoneRepo.ListGroups(ctx, zoneID)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			groupIDs = append(groupIDs, g.ID)
+		}
+	}
+	user.SetZoneGroups(groupIDs)
+	return nil
+}
+
+// checkZones fails with ErrZoneNotFound unless every zone exists
+func (s *UserService) checkZones(ctx context.Context, zoneIDs []string) error {
+	for _, zoneID := range zoneIDs {
+		if _, err := s.zoneRepo.GetZone(ctx, zoneID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *UserService) GetUserByUsername(ctx context.Context, username string) (*domain.User, error) {
@@ -46,6 +117,10 @@ func (s *UserService) ListUsersWithPagination(ctx context.Context, pagination *d
 }
 
 func (s *UserService) CreateUser(ctx context.Context, params domain.CreateUserParams) (*domain.User, error) {
+	if err := s.checkZones(ctx, params.ZoneIDs); err != nil {
+		return nil, err
+	}
+
 	user := domain.NewUser(params)
 	if err := s.repo.CreateUser(ctx, user); err != nil {
 		return nil, err
@@ -65,20 +140,51 @@ func (s *UserService) UpdateUser(ctx context.Context, id string, params domain.U
 	if params.Phone != nil {
 		user.Phone = *params.Phone
 	}
+	// Access tokens carry the user's zones and groups, so changing them revokes the tokens
+	revoke := false
+	if params.ZoneIDs != nil {
+		if err := s.checkZones(ctx, params.ZoneIDs); err != nil {
+			return nil, err
+		}
+		revoke = revoke || !sameStrings(user.ZoneIDs, params.ZoneIDs)
+		user.ZoneIDs = params.ZoneIDs
+	}
 	if params.Groups != nil {
+		revoke = revoke || !sameStrings(user.Groups, params.Groups)
 		user.Groups = params.Groups
 	}
 	if params.ZaloID != nil {
 		user.ZaloID = params.ZaloID
 	}
+	if revoke {
+		user.TokenVersion++
+	}
 
 	if err := s.repo.UpdateUser(ctx, user); err != nil {
 		return nil, err
 	}
+	if revoke {
+		s.setTokenVersion(user.ID, user.TokenVersion)
+	}
 
 	return user, nil
 }
 
+// UpdateProfile updates the fields a user is allowed to change on their own account
+func (s *UserService) UpdateProfile(ctx context.Context, id string, params domain.UpdateProfileParams) (*domain.User, error) {
+	if params.Phone != nil && *params.Phone != "" {
+		if err := domain.ValidatePhone(*params.Phone); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.UpdateUser(ctx, id, domain.UpdateUserParams{
+		FullName: params.FullName,
+		Phone:    params.Phone,
+		ZaloID:   params.ZaloID,
+	})
+}
+
 func (s *UserService) DeleteUser(ctx context.Context, id string) (*domain.User, error) {
 	user, err := s.repo.GetUser(ctx, id)
 	if err != nil {
@@ -88,48 +194,440 @@ func (s *UserService) DeleteUser(ctx context.Context, id string) (*domain.User,
 	if err := s.repo.DeleteUser(ctx, id); err != nil {
 		return nil, err
 	}
+	s.setTokenVersion(id, tokenVersionDeleted)
 
 	return user, nil
 }
 
+// ImportUsers validates every row of a user import. Unless it is a dry run and provided no row
+// has errors, all users are then created; a file with any invalid row creates nothing.
+func (s *UserService) ImportUsers(ctx context.Context, rows []domain.ImportUserRow, opts domain.ImportUsersOptions) (*domain.ImportUsersResult, error) {
+	if len(rows) > domain.MaxImportUsers {
+		return nil, domain.ErrTooManyImportRows
+	}
+
+	resolveGroup, err := s.groupResolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &domain.ImportUsersResult{
+		DryRun: opts.DryRun,
+		Valid:  true,
+		Rows:   make([]domain.ImportUserResult, 0, len(rows)),
+	}
+	users := make([]*domain.User, len(rows))
+	firstRow := make(map[string]int)
+
+	for i, row := range rows {
+		var errs []string
+
+		switch {
+		case row.Username == "":
+			errs = append(errs, "username is required")
+		case firstRow[row.Username] != 0:
+			errs = append(errs, fmt.Sprintf("duplicate username, first used on row %d", firstRow[row.Username]))
+		default:
+			firstRow[row.Username] = row.Row
+			_, err := s.repo.GetUserByUsername(ctx, row.Username)
+			if err == nil {
+				errs = append(errs, "username already exists")
+			} else if err != domain.ErrUsernameNotFound {
+				return nil, err
+			}
+		}
+
+		if row.FullName == "" {
+			errs = append(errs, "full_name is required")
+		}
+		if row.Role != domain.RoleAdmin && row.Role != domain.RoleMonitor {
+			errs = append(errs, fmt.Sprintf("invalid role %q", row.Role))
+		}
+		if row.Phone != "" && domain.ValidatePhone(row.Phone) != nil {
+			errs = append(errs, "invalid phone number")
+		}
+
+		groupIDs := []string{}
+		for _, g := range row.Groups {
+			id, err := resolveGroup(g)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			groupIDs = append(groupIDs, id)
+		}
+
+		if len(errs) > 0 {
+			result.Valid = false
+		} else {
+			users[i] = domain.NewUser(domain.CreateUserParams{
+				Username: row.Username,
+				FullName: row.FullName,
+				Role:     row.Role,
+				Phone:    row.Phone,
+				Groups:   groupIDs,
+			})
+		}
+
+		result.Rows = append(result.Rows, domain.ImportUserResult{
+			Row:      row.Row,
+			Username: row.Username,
+			Errors:   errs,
+		})
+	}
+
+	if opts.DryRun || !result.Valid {
+		return result, nil
+	}
+
+	for i, user := range users {
+		if err := s.repo.CreateUser(ctx, user); err != nil {
+			if err == domain.ErrUsernameExisted {
+				// Created concurrently since validation
+				result.Rows[i].Errors = append(result.Rows[i].Errors, "username already exists")
+				result.Valid = false
+				continue
+			}
+			return nil, err
+		}
+		result.Rows[i].UserID = user.ID
+		result.Created++
+
+		if opts.GeneratePasswords {
+			password, err := lib.SecureChar(12)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.SetPassword(ctx, user.ID, password); err != nil {
+				return nil, err
+			}
+			result.Rows[i].TempPassword = password
+		}
+	}
+
+	return result, nil
+}
+
+// Permissions resolves the groups the user may read and the capabilities of their role.
+// Assigned groups that no longer exist are left out.
+func (s *UserService) Permissions(ctx context.Context, user *domain.User) (*domain.Permissions, error) {
+	perms := &domain.Permissions{
+		UserID:       user.ID,
+		Role:         user.Role,
+		AllGroups:    user.Role == domain.RoleAdmin,
+		ZoneIDs:      user.ZoneIDs,
+		Groups:       []domain.GroupRef{},
+		Capabilities: user.Role.Capabilities(),
+	}
+
+	var groups []domain.BoxGroup
+	var err error
+	if perms.AllGroups {
+		groups, err = s.zoneRepo.ListGroups(ctx, "")
+	} else if readable := user.ReadableGroups(); len(readable) > 0 {
+		groups, err = s.zoneRepo.ListGroupsByIDs(ctx, readable)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		perms.Groups = append(perms.Groups, domain.GroupRef{ID: g.ID, Name: g.Name})
+	}
+	sort.Slice(perms.Groups, func(i, j int) bool { return perms.Groups[i].Name < perms.Groups[j].Name })
+	return perms, nil
+}
+
+// groupResolver returns a lookup mapping a group ID or unique group name to the group ID
+func (s *UserService) groupResolver(ctx context.Context) (func(string) (string, error), error) {
+	groups, err := s.zoneRepo.ListGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool, len(groups))
+	byName := make(map[string][]string, len(groups))
+	for _, g := range groups {
+		ids[g.ID] = true
+		byName[g.Name] = append(byName[g.Name], g.ID)
+	}
+
+	return func(ref string) (string, error) {
+		if ids[ref] {
+			return ref, nil
+		}
+		switch matches := byName[ref]; len(matches) {
+		case 0:
+			return "", fmt.Errorf("unknown group %q", ref)
+		case 1:
+			return matches[0], nil
+		default:
+			return "", fmt.Errorf("group name %q is ambiguous, use its ID", ref)
+		}
+	}, nil
+}
+
 // Authentication methods
 
 func (s *UserService) SetPassword(ctx context.Context, userID, password string) error {
+	secret, err := s.passwordSecret(ctx, userID, password)
+	if err != nil {
+		return err
+	}
+	return s.repo.SaveUserSecret(ctx, secret)
+}
+
+// passwordSecret hashes the password of an existing user for storage
+func (s *UserService) passwordSecret(ctx context.Context, userID, password string) (*domain.UserSecret, error) {
+	if _, err := s.repo.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
 	// Hash password with bcrypt
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	secret := &domain.UserSecret{
+	return &domain.UserSecret{
 		UserID: userID,
 		Name:   "password",
 		Value:  string(hashedPassword),
 		Encode: "bcrypt",
+	}, nil
+}
+
+// RequestPasswordReset issues a reset token for the account whose username or phone is login and
+// sends it over Zalo when linked, SMS otherwise. Errors such as an unknown account must not be
+// revealed to the client.
+func (s *UserService) RequestPasswordReset(ctx context.Context, login string) error {
+	user, err := s.repo.GetUserByUsername(ctx, login)
+	if err == domain.ErrUsernameNotFound {
+		user, err = s.repo.GetUserByPhone(ctx, login)
+	}
+	if err != nil {
+		return err
 	}
 
-	return s.repo.SaveUserSecret(ctx, secret)
+	msg, ok := userMessage(user)
+	if !ok {
+		return domain.ErrNoResetChannel
+	}
+
+	now := time.Now()
+	since := now.Add(-time.Hour).UnixMilli()
+	count, err := s.repo.CountPasswordResetTokens(ctx, user.ID, since)
+	if err != nil {
+		return err
+	}
+	if count >= int64(s.resetMaxPerHour) {
+		return domain.ErrTooManyResetRequests
+	}
+
+	token, err := lib.SecureChar(32)
+	if err != nil {
+		return err
+	}
+
+	resetToken := &domain.PasswordResetToken{
+		ID:        hashToken(token),
+		UserID:    user.ID,
+		ExpiresAt: now.Add(s.resetTTL).UnixMilli(),
+		CTime:     now.UnixMilli(),
+	}
+	if err := s.repo.SavePasswordResetToken(ctx, resetToken, since); err != nil {
+		return err
+	}
+
+	msg.Text = fmt.Sprintf("Mã đặt lại mật khẩu TP25 của bạn: %s. Mã có hiệu lực trong %d phút.", token, int(s.resetTTL.Minutes()))
+	msg.Secrets = []string{token}
+	return s.sender.Send(ctx, msg)
+}
+
+// userMessage addresses a message to the user over Zalo when linked, SMS otherwise, and reports
+// false when the user has neither
+func userMessage(user *domain.User) (notify.Message, bool) {
+	switch {
+	case user.ZaloID != nil && *user.ZaloID != "":
+		return notify.Message{Channel: notify.ChannelZalo, To: *user.ZaloID}, true
+	case user.Phone != "":
+		return notify.Message{Channel: notify.ChannelSMS, To: user.Phone}, true
+	}
+	return notify.Message{}, false
 }
 
-func (s *UserService) Login(ctx context.Context, username, password string) (*domain.User, string, error) {
+// ResetPassword consumes a reset token along with setting the new password, so a failure leaves the
+// token usable, and signs the user out everywhere. It returns the ID of the user whose password was reset.
+func (s *UserService) ResetPassword(ctx context.Context, token, newPassword string) (string, error) {
+	resetToken, err := s.repo.GetPasswordResetToken(ctx, hashToken(token))
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := s.passwordSecret(ctx, resetToken.UserID, newPassword)
+	if err != nil {
+		return "", err
+	}
+	if err := s.repo.ResetPassword(ctx, resetToken.ID, secret); err != nil {
+		return "", err
+	}
+
+	if err := s.repo.DeleteRefreshTokensByUserID(ctx, resetToken.UserID); err != nil {
+		return "", err
+	}
+	return resetToken.UserID, nil
+}
+
+// SetSecurityEvents configures where security events are written and how long they are kept (0 keeps them forever)
+func (s *UserService) SetSecurityEvents(repo *mongodb.SecurityEventRepository, retention time.Duration) {
+	s.securityEvents = repo
+	s.securityRetention = retention
+}
+
+// RecordSecurityEvent stores a security event. Failures are logged rather than returned so they
+// never block the action being recorded.
+func (s *UserService) RecordSecurityEvent(ctx context.Context, event *domain.SecurityEvent) {
+	if s.securityEvents == nil {
+		return
+	}
+	if s.securityRetention > 0 {
+		expireAt := time.Unix(event.Timestamp, 0).Add(s.securityRetention)
+		event.ExpireAt = &expireAt
+	}
+	if err := s.securityEvents.Create(ctx, event); err != nil {
+		log.Printf("Failed to record security event %s: %v", event.Type, err)
+	}
+}
+
+// ListSecurityEvents lists security events, newest first
+func (s *UserService) ListSecurityEvents(ctx context.Context, pagination *domain.Pagination, filter domain.FilterSecurityEventParams) ([]domain.SecurityEvent, int64, error) {
+	return s.securityEvents.ListWithPagination(ctx, pagination, filter)
+}
+
+// SetSessionLimits configures how many concurrent sessions each role may hold (0 or absent for
+// no limit) and whether a login over the limit ends the oldest session instead of being rejected
+func (s *UserService) SetSessionLimits(limits map[domain.Role]int, evictOldest bool) {
+	s.sessionLimits = limits
+	s.sessionEvict = evictOldest
+}
+
+// Sessions returns the active sessions of a user
+func (s *UserService) Sessions(ctx context.Context, user *domain.User) (*domain.UserSessions, error) {
+	sessions, err := s.repo.ListActiveSessions(ctx, user.ID, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return &domain.UserSessions{Count: len(sessions), Limit: s.sessionLimits[user.Role], Sessions: sessions}, nil
+}
+
+// SessionStats counts the active sessions of every user
+func (s *UserService) SessionStats(ctx context.Context) (*domain.SessionStats, error) {
+	return s.repo.SessionStats(ctx, time.Now().UnixMilli())
+}
+
+// enforceSessionLimit keeps the sessions of the user within the role's limit once session was
+// saved. The session is saved first, so concurrent logins all see each other and cannot overrun the
+// limit: over it, the oldest sessions are ended, or when sessions are not evicted the new session
+// is deleted again and ErrSessionLimitReached returned.
+func (s *UserService) enforceSessionLimit(ctx context.Context, user *domain.User, session *domain.RefreshToken) error {
+	limit := s.sessionLimits[user.Role]
+	if limit <= 0 {
+		return nil
+	}
+
+	sessions, err := s.repo.ListActiveSessions(ctx, user.ID, session.CTime)
+	if err != nil {
+		return err
+	}
+	drop, refused := sessionsOverLimit(sessions, session.ID, limit, s.sessionEvict)
+	if err := s.repo.DeleteRefreshTokens(ctx, drop); err != nil {
+		return err
+	}
+	if refused {
+		return domain.ErrSessionLimitReached
+	}
+	return nil
+}
+
+// sessionsOverLimit returns the sessions to delete so that the user holds no more than limit,
+// given the active sessions oldest first. With evict the oldest are ended; otherwise the new
+// session is refused when it comes past the limit, and the sessions after it refuse themselves.
+func sessionsOverLimit(sessions []domain.RefreshToken, newID string, limit int, evict bool) (drop []string, refused bool) {
+	if len(sessions) <= limit {
+		return nil, false
+	}
+	if evict {
+		for _, session := range sessions[:len(sessions)-limit] {
+			drop = append(drop, session.ID)
+		}
+		return drop, false
+	}
+	for i, session := range sessions {
+		if session.ID == newID {
+			if i < limit {
+				return nil, false
+			}
+			return []string{newID}, true
+		}
+	}
+	return nil, false
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
+
+// hashToken hashes high-entropy tokens and codes for storage; unlike passwords they need no slow hash
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate checks a username and password. Callers must complete two-factor
+// authentication when it is enabled before issuing tokens.
+func (s *UserService) Authenticate(ctx context.Context, username, password string) (*domain.User, error) {
 	// Get user by username
 	user, err := s.repo.GetUserByUsername(ctx, username)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	// Get user password secret
 	secret, err := s.repo.GetUserSecret(ctx, user.ID, "password")
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 
 	// Compare passwords with bcrypt
 	if err := bcrypt.CompareHashAndPassword([]byte(secret.Value), []byte(password)); err != nil {
-		return nil, "", domain.ErrWrongPassword
+		return nil, domain.ErrWrongPassword
 	}
 
-	// Create refresh token record (7 days)
+	// The access token lists the groups of the user's zones
+	if err := s.resolveZoneGroups(ctx, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// IssueRefreshToken creates a refresh token session (7 days) and returns it as a signed JWT.
+// It fails with ErrSessionLimitReached when the user's role allows no more concurrent sessions.
+func (s *UserService) IssueRefreshToken(ctx context.Context, user *domain.User) (string, error) {
 	now := time.Now().UnixMilli()
 	refreshTokenID := lib.Rand.Char(12)
 	refreshTokenRecord := &domain.RefreshToken{
@@ -140,7 +638,10 @@ func (s *UserService) Login(ctx context.Context, username, password string) (*do
 	}
 
 	if err := s.repo.SaveRefreshToken(ctx, refreshTokenRecord); err != nil {
-		return nil, "", err
+		return "", err
+	}
+	if err := s.enforceSessionLimit(ctx, user, refreshTokenRecord); err != nil {
+		return "", err
 	}
 
 	// Generate JWT refresh token
@@ -150,20 +651,267 @@ func (s *UserService) Login(ctx context.Context, username, password string) (*do
 		ExpiresAt: jwt.NewNumericDate(time.Unix(refreshTokenRecord.ExpiresAt/1000, 0)),
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshTokenClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(s.jwtSecret))
+	return s.jwtKeys.Sign(refreshTokenClaims)
+}
+
+// SignToken signs claims with the current secret of the rotation, as every token of the API is signed
+func (s *UserService) SignToken(claims jwt.Claims) (string, error) {
+	return s.jwtKeys.Sign(claims)
+}
+
+// Two-factor authentication
+
+const (
+	twoFactorIssuer            = "TP25"
+	twoFactorChallengeAudience = "2fa"
+	twoFactorChallengeTTL      = 5 * time.Minute
+	twoFactorBackupCodes       = 10
+)
+
+// SetTwoFactorKey sets the passphrase TOTP secrets are encrypted with
+func (s *UserService) SetTwoFactorKey(passphrase string) error {
+	box, err := secretbox.New(passphrase)
+	if err != nil {
+		return err
+	}
+	s.secretBox = box
+	return nil
+}
+
+// TwoFactorEnabled reports whether the user has an activated TOTP secret
+func (s *UserService) TwoFactorEnabled(ctx context.Context, userID string) (bool, error) {
+	_, err := s.repo.GetUserSecret(ctx, userID, domain.SecretTOTP)
+	if err == domain.ErrUserHasNoLogin {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetupTwoFactor starts TOTP enrollment. The secret only takes effect once ActivateTwoFactor
+// succeeds, so an abandoned enrollment never locks the user out.
+func (s *UserService) SetupTwoFactor(ctx context.Context, user *domain.User) (*domain.TwoFactorSetup, error) {
+	enabled, err := s.TwoFactorEnabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, domain.ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.secretBox.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &domain.UserSecret{
+		UserID: user.ID,
+		Name:   domain.SecretTOTPPending,
+		Value:  sealed,
+		Encode: "aes-gcm",
+	}
+	if err := s.repo.SaveUserSecret(ctx, pending); err != nil {
+		return nil, err
+	}
+
+	return &domain.TwoFactorSetup{
+		Secret: secret,
+		URL:    totp.URL(twoFactorIssuer, user.Username, secret),
+	}, nil
+}
+
+// ActivateTwoFactor checks the first code from the authenticator app, enables two-factor
+// authentication and returns the backup codes, which are only ever shown here
+func (s *UserService) ActivateTwoFactor(ctx context.Context, userID, code string) ([]string, error) {
+	pending, err := s.repo.GetUserSecret(ctx, userID, domain.SecretTOTPPending)
+	if err != nil {
+		if err == domain.ErrUserHasNoLogin {
+			return nil, domain.ErrTwoFactorNotSetup
+		}
+		return nil, err
+	}
+
+	secret, err := s.secretBox.Open(pending.Value)
+	if err != nil {
+		return nil, err
+	}
+	counter, ok := totp.Match(secret, code, time.Now())
+	if !ok {
+		return nil, domain.ErrInvalidTwoFactorCode
+	}
+
+	codes := make([]string, twoFactorBackupCodes)
+	hashes := make([]string, twoFactorBackupCodes)
+	for i := range codes {
+		if codes[i], err = lib.SecureChar(10); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashToken(codes[i])
+	}
+
+	backup := &domain.UserSecret{
+		UserID: userID,
+		Name:   domain.SecretTOTPBackup,
+		Encode: "sha256",
+		Codes:  hashes,
+	}
+	if err := s.repo.SaveUserSecret(ctx, backup); err != nil {
+		return nil, err
+	}
+
+	// The activation code may not sign in again
+	active := &domain.UserSecret{
+		UserID:  userID,
+		Name:    domain.SecretTOTP,
+		Value:   pending.Value,
+		Encode:  pending.Encode,
+		Counter: counter,
+	}
+	if err := s.repo.SaveUserSecret(ctx, active); err != nil {
+		return nil, err
+	}
+
+	if err := s.repo.DeleteUserSecrets(ctx, userID, domain.SecretTOTPPending); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// ResetTwoFactor removes every TOTP secret and backup code of a user, and their login attempts,
+// for admins helping someone who lost their device
+func (s *UserService) ResetTwoFactor(ctx context.Context, userID string) error {
+	if _, err := s.repo.GetUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteTwoFactorAttempts(ctx, userID); err != nil {
+		return err
+	}
+	return s.repo.DeleteUserSecrets(ctx, userID, domain.SecretTOTP, domain.SecretTOTPPending, domain.SecretTOTPBackup)
+}
+
+// NewTwoFactorChallenge returns a short-lived token proving the password step of a login succeeded
+func (s *UserService) NewTwoFactorChallenge(user *domain.User) (string, error) {
+	claims := jwt.RegisteredClaims{
+		Subject:   user.ID,
+		ID:        lib.Rand.Char(12),
+		Audience:  jwt.ClaimStrings{twoFactorChallengeAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(twoFactorChallengeTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}
+	return s.jwtKeys.Sign(claims)
+}
+
+// CompleteTwoFactorLogin checks the challenge from the password step and a TOTP or backup code,
+// then issues a refresh token. Once the challenge is valid the user is returned even when the
+// login fails, so the failure can be attributed.
+//
+// Every code sent counts as an attempt before it is checked. A challenge is invalid after
+// MaxTwoFactorChallengeAttempts, and a user is refused with ErrTwoFactorLocked after
+// MaxTwoFactorUserAttempts within TwoFactorAttemptWindow, whatever the challenge.
+func (s *UserService) CompleteTwoFactorLogin(ctx context.Context, challenge, code string) (*domain.User, string, error) {
+	token, err := jwt.ParseWithClaims(challenge, &jwt.RegisteredClaims{}, s.jwtKeys.Keyfunc, jwt.WithAudience(twoFactorChallengeAudience))
+	if err != nil || !token.Valid {
+		return nil, "", domain.ErrInvalidChallenge
+	}
+
+	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	if !ok || claims.ID == "" {
+		return nil, "", domain.ErrInvalidChallenge
+	}
+
+	user, err := s.GetUser(ctx, claims.Subject)
 	if err != nil {
 		return nil, "", err
 	}
 
-	return user, refreshTokenString, nil
+	if err := s.countTwoFactorAttempt(ctx, user.ID, claims.ID); err != nil {
+		return user, "", err
+	}
+	if err := s.verifyTwoFactorCode(ctx, user.ID, code); err != nil {
+		return user, "", err
+	}
+	if err := s.repo.DeleteTwoFactorAttempts(ctx, user.ID); err != nil {
+		return user, "", err
+	}
+
+	refreshToken, err := s.IssueRefreshToken(ctx, user)
+	if err != nil {
+		return user, "", err
+	}
+	return user, refreshToken, nil
+}
+
+// countTwoFactorAttempt records an attempt of the challenge, failing once the challenge or the user
+// made too many. Recording comes first, so concurrent guesses cannot overrun the limits.
+func (s *UserService) countTwoFactorAttempt(ctx context.Context, userID, challengeID string) error {
+	now := time.Now()
+	since := now.Add(-domain.TwoFactorAttemptWindow).UnixMilli()
+	attempt := &domain.TwoFactorAttempt{
+		ID:          lib.Rand.Char(12),
+		UserID:      userID,
+		ChallengeID: challengeID,
+		CTime:       now.UnixMilli(),
+	}
+	if err := s.repo.SaveTwoFactorAttempt(ctx, attempt, since); err != nil {
+		return err
+	}
+
+	challengeAttempts, userAttempts, err := s.repo.CountTwoFactorAttempts(ctx, userID, challengeID, since)
+	if err != nil {
+		return err
+	}
+	if challengeAttempts > domain.MaxTwoFactorChallengeAttempts {
+		return domain.ErrInvalidChallenge
+	}
+	if userAttempts > domain.MaxTwoFactorUserAttempts {
+		return domain.ErrTwoFactorLocked
+	}
+	return nil
+}
+
+// verifyTwoFactorCode accepts a TOTP code newer than the last one accepted, or consumes an unused
+// backup code
+func (s *UserService) verifyTwoFactorCode(ctx context.Context, userID, code string) error {
+	active, err := s.repo.GetUserSecret(ctx, userID, domain.SecretTOTP)
+	if err != nil {
+		if err == domain.ErrUserHasNoLogin {
+			return domain.ErrTwoFactorNotSetup
+		}
+		return err
+	}
+
+	secret, err := s.secretBox.Open(active.Value)
+	if err != nil {
+		return err
+	}
+	if counter, ok := totp.Match(secret, code, time.Now()); ok {
+		advanced, err := s.repo.AdvanceSecretCounter(ctx, userID, domain.SecretTOTP, counter)
+		if err != nil {
+			return err
+		}
+		if !advanced {
+			return domain.ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	consumed, err := s.repo.ConsumeSecretCode(ctx, userID, domain.SecretTOTPBackup, hashToken(code))
+	if err != nil {
+		return err
+	}
+	if !consumed {
+		return domain.ErrInvalidTwoFactorCode
+	}
+	return nil
 }
 
 func (s *UserService) RefreshToken(ctx context.Context, tokenString string) (*domain.User, string, error) {
 	// Parse and validate JWT refresh token
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.jwtSecret), nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, s.jwtKeys.Keyfunc)
 
 	if err != nil || !token.Valid {
 		return nil, "", domain.ErrInvalidRefreshToken
@@ -191,14 +939,19 @@ func (s *UserService) RefreshToken(ctx context.Context, tokenString string) (*do
 		return nil, "", domain.ErrInvalidRefreshToken
 	}
 
-	// Get user
-	user, err := s.repo.GetUser(ctx, rt.UserID)
+	// Get user, with what the new access token carries resolved
+	user, err := s.GetUser(ctx, rt.UserID)
+	if err == domain.ErrUserNotFound {
+		return nil, "", domain.ErrInvalidRefreshToken
+	}
 	if err != nil {
 		return nil, "", err
 	}
 
-	// Delete old refresh token
-	_ = s.repo.DeleteRefreshToken(ctx, rt.ID)
+	// Delete old refresh token; only one of concurrent refreshes with the same token gets past this
+	if err := s.repo.DeleteRefreshToken(ctx, rt.ID); err != nil {
+		return nil, "", err
+	}
 
 	// Create new refresh token record (7 days)
 	now := time.Now().UnixMilli()
@@ -221,8 +974,7 @@ func (s *UserService) RefreshToken(ctx context.Context, tokenString string) (*do
 		ExpiresAt: jwt.NewNumericDate(time.Unix(newRefreshTokenRecord.ExpiresAt/1000, 0)),
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	}
-	newRefreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newRefreshTokenClaims)
-	newRefreshTokenString, err := newRefreshToken.SignedString([]byte(s.jwtSecret))
+	newRefreshTokenString, err := s.jwtKeys.Sign(newRefreshTokenClaims)
 	if err != nil {
 		return nil, "", err
 	}
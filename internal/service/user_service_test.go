@@ -0,0 +1,52 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"tp25-api/internal/domain"
+)
+
+func TestSessionsOverLimit(t *testing.T) {
+	sessions := func(ids ...string) []domain.RefreshToken {
+		list := make([]domain.RefreshToken, len(ids))
+		for i, id := range ids {
+			list[i] = domain.RefreshToken{ID: id, CTime: int64(i)}
+		}
+		return list
+	}
+
+	tests := []struct {
+		name        string
+		sessions    []domain.RefreshToken
+		newID       string
+		limit       int
+		evict       bool
+		wantDrop    []string
+		wantRefused bool
+	}{
+		{name: "within the limit", sessions: sessions("a", "new"), newID: "new", limit: 2},
+		{name: "over the limit", sessions: sessions("a", "b", "new"), newID: "new", limit: 2, wantDrop: []string{"new"}, wantRefused: true},
+		{name: "over the limit, evicting", sessions: sessions("a", "b", "new"), newID: "new", limit: 2, evict: true, wantDrop: []string{"a"}},
+		{name: "far over a lowered limit, evicting", sessions: sessions("a", "b", "c", "new"), newID: "new", limit: 1, evict: true, wantDrop: []string{"a", "b", "c"}},
+		{
+			// Two logins raced past the limit: the one created first keeps its session
+			name: "concurrent login created first", sessions: sessions("a", "new", "other"), newID: "new", limit: 2,
+		},
+		{
+			name: "concurrent login created last", sessions: sessions("a", "other", "new"), newID: "new", limit: 2, wantDrop: []string{"new"}, wantRefused: true,
+		},
+		{
+			// Ended meanwhile, e.g. evicted by a later login: nothing is left to refuse
+			name: "new session gone", sessions: sessions("a", "b", "c"), newID: "new", limit: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drop, refused := sessionsOverLimit(tt.sessions, tt.newID, tt.limit, tt.evict)
+			if !reflect.DeepEqual(drop, tt.wantDrop) || refused != tt.wantRefused {
+				t.Errorf("got %v, refused %v, want %v, refused %v", drop, refused, tt.wantDrop, tt.wantRefused)
+			}
+		})
+	}
+}
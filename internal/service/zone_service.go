@@ -2,7 +2,10 @@ package service
 
 import (
 	"context"
+	"log"
 	"sort"
+	"sync"
+	"time"
 
 	"tp25-api/internal/domain"
 	"tp25-api/internal/repository/mongodb"
@@ -11,11 +14,107 @@ import (
 )
 
 type ZoneService struct {
-	repo *mongodb.ZoneRepository
+	repo        *mongodb.ZoneRepository
+	logRepo     *mongodb.BoxLogRepository
+	settingRepo *mongodb.SettingRepository
+
+	bounds  *domain.CoordinateBounds  // where locations may lie, anywhere when nil
+	catalog *mongodb.SensorRepository // the metric catalog box metrics are checked against, unchecked when nil
+	cameras *mongodb.CameraRepository // the camera checks groups are shown with, none when nil
+
+	onZoneGroups []func(ctx context.Context, zoneIDs ...string)
+	onBox        []func(ctx context.Context, boxID string)
+}
+
+func NewZoneService(repo *mongodb.ZoneRepository, logRepo *mongodb.BoxLogRepository, settingRepo *mongodb.SettingRepository) *ZoneService {
+	return &ZoneService{repo: repo, logRepo: logRepo, settingRepo: settingRepo}
+}
+
+// OnZoneGroupsChange registers fn to be called with the zones a group was added to or moved out of
+func (s *ZoneService) OnZoneGroupsChange(fn func(ctx context.Context, zoneIDs ...string)) {
+	s.onZoneGroups = append(s.onZoneGroups, fn)
 }
 
-func NewZoneService(repo *mongodb.ZoneRepository) *ZoneService {
-	return &ZoneService{repo: repo}
+func (s *ZoneService) zoneGroupsChanged(ctx context.Context, zoneIDs ...string) {
+	for _, fn := range s.onZoneGroups {
+		fn(ctx, zoneIDs...)
+	}
+}
+
+// OnBoxChange registers fn to be called with the boxes updated, decommissioned, recommissioned or deleted
+func (s *ZoneService) OnBoxChange(fn func(ctx context.Context, boxID string)) {
+	s.onBox = append(s.onBox, fn)
+}
+
+func (s *ZoneService) boxChanged(ctx context.Context, boxID string) {
+	for _, fn := range s.onBox {
+		fn(ctx, boxID)
+	}
+}
+
+// SetLocationBounds restricts the locations of zones, groups and boxes to bounds
+func (s *ZoneService) SetLocationBounds(bounds *domain.CoordinateBounds) {
+	s.bounds = bounds
+}
+
+// SetMetricCatalog checks the metrics of created and updated boxes against the catalog of metrics
+func (s *ZoneService) SetMetricCatalog(metrics *mongodb.SensorRepository) {
+	s.catalog = metrics
+}
+
+// SetCameraChecks shows groups with the health of their cameras, as stored by the CameraChecker
+func (s *ZoneService) SetCameraChecks(cameras *mongodb.CameraRepository) {
+	s.cameras = cameras
+}
+
+// cameraStatuses returns the health of the group's cameras, nil when they are not checked
+func (s *ZoneService) cameraStatuses(ctx context.Context, group *domain.BoxGroup) ([]domain.CameraStatus, error) {
+	if s.cameras == nil || len(group.Cameras) == 0 {
+		return nil, nil
+	}
+	checks, err := s.cameras.Checks(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	return domain.CameraStatuses(group.Cameras, checks), nil
+}
+
+// CameraStatus returns the health of each camera of a group, in the group's order
+func (s *ZoneService) CameraStatus(ctx context.Context, groupID string) ([]domain.CameraStatus, error) {
+	group, err := s.repo.GetGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := s.cameraStatuses(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if statuses == nil {
+		statuses = []domain.CameraStatus{}
+	}
+	return statuses, nil
+}
+
+// checkMetricCatalog rejects box metrics missing from the catalog with a *ValidationError, or
+// returns them as warnings when allowed
+func (s *ZoneService) checkMetricCatalog(ctx context.Context, metrics []domain.BoxMetric, allowUnknown bool) (domain.Warnings, error) {
+	if s.catalog == nil || len(metrics) == 0 {
+		return nil, nil
+	}
+	catalog, err := s.catalog.ListMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	problems := domain.UnknownMetricProblems(metrics, catalog)
+	if len(problems) == 0 {
+		return nil, nil
+	}
+	if !allowUnknown {
+		return nil, &domain.ValidationError{Problems: problems}
+	}
+	var warnings domain.Warnings
+	warnings.Add(problems...)
+	return warnings, nil
 }
 
 // Zone operations
@@ -24,8 +123,152 @@ func (s *ZoneService) ListZones(ctx context.Context) ([]domain.Zone, error) {
 	return s.repo.ListZones(ctx)
 }
 
-func (s *ZoneService) ListZonesWithPagination(ctx context.Context, pagination *domain.Pagination, filter bson.M) ([]domain.Zone, int64, error) {
-	return s.repo.ListZonesWithPagination(ctx, pagination, filter)
+func (s *ZoneService) ListZonesWithPagination(ctx context.Context, pagination *domain.Pagination, filter bson.M, includeDetail bool) ([]domain.Zone, int64, error) {
+	return s.repo.ListZonesWithPagination(ctx, pagination, filter, includeDetail)
+}
+
+// OversizedZoneDetails reports the zones stored before the detail size limit whose Detail exceeds it
+func (s *ZoneService) OversizedZoneDetails(ctx context.Context) ([]domain.OversizedZoneDetail, error) {
+	zones, err := s.repo.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oversized := []domain.OversizedZoneDetail{}
+	for _, zone := range zones {
+		size, err := domain.ZoneDetailSize(zone.Detail)
+		if err != nil {
+			return nil, err
+		}
+		if size > domain.MaxZoneDetailSize {
+			oversized = append(oversized, domain.OversizedZoneDetail{
+				ID:         zone.ID,
+				Code:       zone.Code,
+				Name:       zone.Name,
+				DetailSize: size,
+			})
+		}
+	}
+
+	sort.Slice(oversized, func(i, j int) bool {
+		return oversized[i].DetailSize > oversized[j].DetailSize
+	})
+	return oversized, nil
+}
+
+// InvalidLocations reports the stored zones, groups and boxes whose coordinates fail validation
+func (s *ZoneService) InvalidLocations(ctx context.Context) ([]domain.InvalidLocation, error) {
+	zones, err := s.repo.ListZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.repo.ListGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := s.repo.ListBoxes(ctx, domain.FilterBoxParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := []domain.InvalidLocation{}
+	check := func(kind, id, name, field string, location domain.Location) {
+		if problems := location.Problems(field, s.bounds); len(problems) > 0 {
+			invalid = append(invalid, domain.InvalidLocation{Kind: kind, ID: id, Name: name, Location: location, Problems: problems})
+		}
+	}
+	for _, zone := range zones {
+		check("zone", zone.ID, zone.Name, "center", zone.Center)
+	}
+	for _, group := range groups {
+		if group.Center != nil {
+			check("group", group.ID, group.Name, "center", *group.Center)
+		}
+	}
+	for _, box := range boxes {
+		check("box", box.ID, box.Name, "location", box.Location)
+	}
+	return invalid, nil
+}
+
+// BoxZoneMismatches lists the live boxes whose zone is not their group's. Boxes of deleted groups
+// have no zone to be matched against and are left out.
+func (s *ZoneService) BoxZoneMismatches(ctx context.Context) ([]domain.BoxZoneMismatch, error) {
+	groups, err := s.repo.ListGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := s.repo.ListBoxes(ctx, domain.FilterBoxParams{})
+	if err != nil {
+		return nil, err
+	}
+
+	groupZones := make(map[string]string, len(groups))
+	for _, group := range groups {
+		groupZones[group.ID] = group.ZoneID
+	}
+
+	mismatches := []domain.BoxZoneMismatch{}
+	for _, box := range boxes {
+		zoneID, ok := groupZones[box.GroupID]
+		if !ok || zoneID == box.ZoneID {
+			continue
+		}
+		mismatches = append(mismatches, domain.BoxZoneMismatch{
+			BoxID:       box.ID,
+			Name:        box.Name,
+			GroupID:     box.GroupID,
+			ZoneID:      box.ZoneID,
+			GroupZoneID: zoneID,
+		})
+	}
+	return mismatches, nil
+}
+
+// FixBoxZoneMismatches moves every box whose zone is not its group's to its group's zone, returning
+// the boxes it moved
+func (s *ZoneService) FixBoxZoneMismatches(ctx context.Context) ([]domain.BoxZoneMismatch, error) {
+	mismatches, err := s.BoxZoneMismatches(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := []domain.BoxZoneMismatch{}
+	for _, mismatch := range mismatches {
+		if err := s.repo.SetBoxZone(ctx, mismatch.BoxID, mismatch.GroupZoneID); err != nil {
+			// Deleted since it was listed
+			if err == domain.ErrBoxNotFound {
+				continue
+			}
+			return fixed, err
+		}
+		fixed = append(fixed, mismatch)
+	}
+	return fixed, nil
+}
+
+// InvalidGroupMaps lists the groups saved with a zoom out of range or a blank camera entry, before
+// these were validated
+func (s *ZoneService) InvalidGroupMaps(ctx context.Context) ([]domain.InvalidGroupMap, error) {
+	groups, err := s.repo.ListGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := []domain.InvalidGroupMap{}
+	for _, group := range groups {
+		if problems := domain.GroupMapProblems(nil, group.Zoom, group.Cameras, nil); len(problems) > 0 {
+			invalid = append(invalid, domain.InvalidGroupMap{
+				ID:       group.ID,
+				Name:     group.Name,
+				ZoneID:   group.ZoneID,
+				Zoom:     group.Zoom,
+				Cameras:  group.Cameras,
+				Problems: problems,
+			})
+		}
+	}
+	return invalid, nil
 }
 
 func (s *ZoneService) GetZone(ctx context.Context, id string) (*domain.Zone, error) {
@@ -33,6 +276,15 @@ func (s *ZoneService) GetZone(ctx context.Context, id string) (*domain.Zone, err
 }
 
 func (s *ZoneService) CreateZone(ctx context.Context, params domain.CreateZoneParams) (*domain.Zone, error) {
+	if err := domain.ValidateZoneDetail(params.Detail); err != nil {
+		return nil, err
+	}
+	if params.Center != nil {
+		if err := domain.ValidateLocation("center", *params.Center, s.bounds); err != nil {
+			return nil, err
+		}
+	}
+
 	zone := domain.NewZone(params)
 	if err := s.repo.CreateZone(ctx, zone); err != nil {
 		return nil, err
@@ -49,13 +301,28 @@ func (s *ZoneService) UpdateZone(ctx context.Context, id string, params domain.U
 	if params.Name != nil {
 		zone.Name = *params.Name
 	}
-	if params.Code != nil {
+	if params.Code != nil && *params.Code != zone.Code {
+		// The unique index also rejects this, but checking first gives a clean error
+		// on deployments where the index could not be created
+		exists, err := s.repo.ZoneCodeExists(ctx, *params.Code, zone.ID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, domain.ErrZoneCodeExisted
+		}
 		zone.Code = *params.Code
 	}
 	if params.Detail != nil {
+		if err := domain.ValidateZoneDetail(params.Detail); err != nil {
+			return nil, err
+		}
 		zone.Detail = params.Detail
 	}
 	if params.Center != nil {
+		if err := domain.ValidateLocation("center", *params.Center, s.bounds); err != nil {
+			return nil, err
+		}
 		zone.Center = *params.Center
 	}
 
@@ -68,18 +335,42 @@ func (s *ZoneService) UpdateZone(ctx context.Context, id string, params domain.U
 
 // BoxGroup operations
 
-func (s *ZoneService) ListGroups(ctx context.Context, zoneID string) ([]domain.ViewBox, error) {
+// ListGroups returns the groups of a zone with their boxes, leaving archived groups out unless includeArchived
+func (s *ZoneService) ListGroups(ctx context.Context, zoneID string, includeArchived bool) ([]domain.ViewBox, error) {
 	groups, err := s.repo.ListGroups(ctx, zoneID)
 	if err != nil {
 		return nil, err
 	}
 
+	if !includeArchived {
+		listed := groups[:0]
+		for _, group := range groups {
+			if !group.Archived {
+				listed = append(listed, group)
+			}
+		}
+		groups = listed
+	}
+
 	// Sort groups by sort_order
 	sort.Slice(groups, func(i, j int) bool {
-		return groups[i].SortOrder < groups[j].SortOrder
+		if groups[i].SortOrder != groups[j].SortOrder {
+			return groups[i].SortOrder < groups[j].SortOrder
+		}
+		return groups[i].ID < groups[j].ID
 	})
 
-	var viewBoxes []domain.ViewBox
+	return s.ExpandGroups(ctx, groups), nil
+}
+
+// ListGroupsWithPagination returns one page of groups without their boxes
+func (s *ZoneService) ListGroupsWithPagination(ctx context.Context, pagination *domain.Pagination, filter domain.FilterGroupParams) ([]domain.BoxGroup, int64, error) {
+	return s.repo.ListGroupsWithPagination(ctx, pagination, filter)
+}
+
+// ExpandGroups attaches the boxes of each group, keeping the group order
+func (s *ZoneService) ExpandGroups(ctx context.Context, groups []domain.BoxGroup) []domain.ViewBox {
+	viewBoxes := []domain.ViewBox{}
 	for _, group := range groups {
 		// Get boxes for each group
 		filter := domain.FilterBoxParams{GroupID: &group.ID}
@@ -89,10 +380,7 @@ func (s *ZoneService) ListGroups(ctx context.Context, zoneID string) ([]domain.V
 			boxes = []domain.Box{}
 		}
 
-		// Sort boxes by sort_order
-		sort.Slice(boxes, func(i, j int) bool {
-			return boxes[i].SortOrder < boxes[j].SortOrder
-		})
+		domain.SortBoxes(boxes)
 
 		total := len(boxes)
 		viewBox := domain.ViewBox{
@@ -103,7 +391,7 @@ func (s *ZoneService) ListGroups(ctx context.Context, zoneID string) ([]domain.V
 		viewBoxes = append(viewBoxes, viewBox)
 	}
 
-	return viewBoxes, nil
+	return viewBoxes
 }
 
 func (s *ZoneService) GetGroup(ctx context.Context, id string) (*domain.ViewBox, error) {
@@ -119,24 +407,57 @@ func (s *ZoneService) GetGroup(ctx context.Context, id string) (*domain.ViewBox,
 		boxes = []domain.Box{}
 	}
 
-	// Sort boxes by sort_order
-	sort.Slice(boxes, func(i, j int) bool {
-		return boxes[i].SortOrder < boxes[j].SortOrder
-	})
+	domain.SortBoxes(boxes)
+
+	cameras, err := s.cameraStatuses(ctx, group)
+	if err != nil {
+		return nil, err
+	}
 
 	total := len(boxes)
 	return &domain.ViewBox{
-		BoxGroup: *group,
-		Boxes:    boxes,
-		Total:    &total,
+		BoxGroup:     *group,
+		Boxes:        boxes,
+		Total:        &total,
+		CameraStatus: cameras,
 	}, nil
 }
 
+// GroupModifiedAt returns when the view of a group last changed (milliseconds)
+func (s *ZoneService) GroupModifiedAt(ctx context.Context, id string) (int64, error) {
+	return s.repo.GroupModifiedAt(ctx, id)
+}
+
+// ArchiveGroup hides a group from group listings; its boxes keep accepting records
+func (s *ZoneService) ArchiveGroup(ctx context.Context, id string) (*domain.BoxGroup, error) {
+	if err := s.repo.SetGroupArchived(ctx, id, true); err != nil {
+		return nil, err
+	}
+	return s.repo.GetGroup(ctx, id)
+}
+
+// UnarchiveGroup lists an archived group again
+func (s *ZoneService) UnarchiveGroup(ctx context.Context, id string) (*domain.BoxGroup, error) {
+	if err := s.repo.SetGroupArchived(ctx, id, false); err != nil {
+		return nil, err
+	}
+	return s.repo.GetGroup(ctx, id)
+}
+
 func (s *ZoneService) FindGroup(ctx context.Context, id string) (*domain.BoxGroup, error) {
 	return s.repo.GetGroup(ctx, id)
 }
 
 func (s *ZoneService) CreateGroup(ctx context.Context, params domain.CreateGroupParams) (*domain.BoxGroup, error) {
+	// Binding checks these too, but not for callers building the params themselves
+	if err := domain.ValidateGroupMap(params.Center, params.Zoom, params.Cameras, s.bounds); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.repo.GetZone(ctx, params.ZoneID); err != nil {
+		return nil, err
+	}
+
 	// Get max sort_order for auto-increment
 	groups, err := s.repo.ListGroups(ctx, params.ZoneID)
 	if err != nil {
@@ -156,6 +477,7 @@ func (s *ZoneService) CreateGroup(ctx context.Context, params domain.CreateGroup
 	if err := s.repo.CreateGroup(ctx, group); err != nil {
 		return nil, err
 	}
+	s.zoneGroupsChanged(ctx, group.ZoneID)
 
 	return group, nil
 }
@@ -166,9 +488,16 @@ func (s *ZoneService) UpdateGroup(ctx context.Context, id string, params domain.
 		return nil, err
 	}
 
+	if err := domain.ValidateGroupMap(params.Center, params.Zoom, params.Cameras, s.bounds); err != nil {
+		return nil, err
+	}
+
 	if params.Name != nil {
 		group.Name = *params.Name
 	}
+	if params.Code != nil {
+		group.Code = *params.Code
+	}
 	if params.SortOrder != nil {
 		group.SortOrder = *params.SortOrder
 	}
@@ -184,14 +513,149 @@ func (s *ZoneService) UpdateGroup(ctx context.Context, id string, params domain.
 	if params.Subdomain != nil {
 		group.Subdomain = params.Subdomain
 	}
+	if params.Branding != nil {
+		if err := params.Branding.Validate(); err != nil {
+			return nil, err
+		}
+		group.Branding = params.Branding
+	}
+	if params.PrimaryBoxID != nil {
+		if *params.PrimaryBoxID == "" {
+			group.PrimaryBoxID = nil
+		} else {
+			box, err := s.repo.GetBox(ctx, *params.PrimaryBoxID)
+			if err != nil && err != domain.ErrBoxNotFound {
+				return nil, err
+			}
+			if err == domain.ErrBoxNotFound || box.GroupID != group.ID {
+				return nil, &domain.ValidationError{Problems: []domain.FieldError{{Field: "primary_box_id", Rule: "exists", Code: "field_box_not_in_group"}}}
+			}
+			group.PrimaryBoxID = params.PrimaryBoxID
+		}
+	}
+	if params.CrestElevation != nil {
+		if group.Note == nil {
+			group.Note = &domain.NoteGroup{}
+		}
+		group.Note.CrestElevation = params.CrestElevation
+	}
 
-	if err := s.repo.UpdateGroup(ctx, group); err != nil {
+	// Moving to another zone also moves the group's boxes, whose zone_id would otherwise go stale
+	moved := false
+	previousZoneID := group.ZoneID
+	if params.ZoneID != nil && *params.ZoneID != group.ZoneID {
+		if _, err := s.repo.GetZone(ctx, *params.ZoneID); err != nil {
+			if err == domain.ErrZoneNotFound {
+				return nil, &domain.ValidationError{Problems: []domain.FieldError{{Field: "zone_id", Rule: "exists", Code: "field_zone_not_found"}}}
+			}
+			return nil, err
+		}
+		group.ZoneID = *params.ZoneID
+		moved = true
+	}
+
+	save := s.repo.UpdateGroup
+	if moved {
+		save = s.repo.UpdateGroupZone
+	}
+	if err := save(ctx, group); err != nil {
 		return nil, err
 	}
+	if moved {
+		s.zoneGroupsChanged(ctx, previousZoneID, group.ZoneID)
+	}
 
 	return s.GetGroup(ctx, id)
 }
 
+// GetPublicGroup returns the public view of the group served on a subdomain
+func (s *ZoneService) GetPublicGroup(ctx context.Context, subdomain string) (*domain.PublicGroup, error) {
+	group, err := s.repo.GetGroupBySubdomain(ctx, subdomain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.PublicGroup{
+		ID:        group.ID,
+		Name:      group.Name,
+		Subdomain: subdomain,
+		Center:    group.Center,
+		Zoom:      group.Zoom,
+		Branding:  group.Branding,
+	}, nil
+}
+
+// CloneGroup copies a group with its boxes and hydraulic configuration but none of their records,
+// e.g. to stand up a staging copy of a reservoir. Everything is written in one transaction when the
+// deployment supports it.
+func (s *ZoneService) CloneGroup(ctx context.Context, id string, params domain.CloneGroupParams) (*domain.ViewBox, error) {
+	source, err := s.repo.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	zoneID := source.ZoneID
+	if params.ZoneID != nil && *params.ZoneID != zoneID {
+		if _, err := s.repo.GetZone(ctx, *params.ZoneID); err != nil {
+			if err == domain.ErrZoneNotFound {
+				return nil, &domain.ValidationError{Problems: []domain.FieldError{{Field: "zone_id", Rule: "exists", Code: "field_zone_not_found"}}}
+			}
+			return nil, err
+		}
+		zoneID = *params.ZoneID
+	}
+
+	if params.Subdomain != nil {
+		_, err := s.repo.GetGroupBySubdomain(ctx, *params.Subdomain)
+		if err == nil {
+			return nil, domain.ErrSubdomainTaken
+		}
+		if err != domain.ErrBoxGroupNotFound {
+			return nil, err
+		}
+	}
+
+	boxes, err := s.repo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &id})
+	if err != nil {
+		return nil, err
+	}
+	domain.SortBoxes(boxes)
+
+	hydraulics, err := s.settingRepo.GetByKey(ctx, domain.HydraulicsSettingKey(id))
+	if err != nil && err != domain.ErrSettingNotFound {
+		return nil, err
+	}
+
+	// The copy goes last in its zone
+	groups, err := s.repo.ListGroups(ctx, zoneID)
+	if err != nil {
+		return nil, err
+	}
+	maxSortOrder := 0
+	for _, g := range groups {
+		if g.SortOrder > maxSortOrder {
+			maxSortOrder = g.SortOrder
+		}
+	}
+
+	group, copies := domain.CloneGroup(source, boxes, params)
+	group.SortOrder = maxSortOrder + 1
+
+	err = s.repo.CreateGroupWithBoxes(ctx, group, copies, func(ctx context.Context) error {
+		if hydraulics == nil {
+			return nil
+		}
+		_, err := s.settingRepo.Create(ctx, domain.CreateSettingParams{Key: domain.HydraulicsSettingKey(group.ID), Value: hydraulics.Value})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.zoneGroupsChanged(ctx, group.ZoneID)
+
+	return s.GetGroup(ctx, group.ID)
+}
+
 func (s *ZoneService) DeleteGroup(ctx context.Context, id string) (*domain.BoxGroup, error) {
 	group, err := s.repo.GetGroup(ctx, id)
 	if err != nil {
@@ -213,10 +677,7 @@ func (s *ZoneService) ListBoxes(ctx context.Context, filter domain.FilterBoxPara
 		return nil, err
 	}
 
-	// Sort boxes by sort_order
-	sort.Slice(boxes, func(i, j int) bool {
-		return boxes[i].SortOrder < boxes[j].SortOrder
-	})
+	domain.SortBoxes(boxes)
 
 	return boxes, nil
 }
@@ -225,16 +686,86 @@ func (s *ZoneService) ListBoxesWithPagination(ctx context.Context, pagination *d
 	return s.repo.ListBoxesWithPagination(ctx, pagination, filter)
 }
 
+// GetBox returns a box with its latest log entry
 func (s *ZoneService) GetBox(ctx context.Context, id string) (*domain.Box, error) {
-	return s.repo.GetBox(ctx, id)
+	box, err := s.repo.GetBox(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	box.LatestLog, err = s.logRepo.Latest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return box, nil
+}
+
+// BoxLocations returns the locations of a box, oldest first, ending with the current one
+func (s *ZoneService) BoxLocations(ctx context.Context, id string) ([]domain.LocationPeriod, error) {
+	box, err := s.repo.GetBox(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return box.Locations(), nil
+}
+
+// BoxLocationAt returns the location a box stood at at timestamp (seconds)
+func (s *ZoneService) BoxLocationAt(ctx context.Context, id string, timestamp int64) (*domain.LocationPeriod, error) {
+	box, err := s.repo.GetBox(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	location := box.LocationAt(timestamp)
+	return &location, nil
 }
 
-func (s *ZoneService) CreateBox(ctx context.Context, params domain.CreateBoxParams) (*domain.Box, error) {
+// CreateBox creates a box, returning with it the warnings it was accepted despite
+func (s *ZoneService) CreateBox(ctx context.Context, params domain.CreateBoxParams) (*domain.Box, domain.Warnings, error) {
+	if err := domain.ValidateLocation("location", params.Location, s.bounds); err != nil {
+		return nil, nil, err
+	}
+	if params.Merge != nil {
+		if err := params.Merge.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if params.Dedup != nil {
+		if err := params.Dedup.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if params.Anomaly != nil {
+		if err := params.Anomaly.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := domain.ValidateReportingSchedule(params.ExpectedIntervalSeconds, params.Schedule); err != nil {
+		return nil, nil, err
+	}
+	if err := domain.ValidateBoxMetrics(params.Metrics); err != nil {
+		return nil, nil, err
+	}
+	warnings, err := s.checkMetricCatalog(ctx, params.Metrics, params.AllowUnknownMetrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	group, err := s.repo.GetGroup(ctx, params.GroupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A box listed under another zone than its group's is missing from that zone's listings
+	if params.ZoneID == "" {
+		params.ZoneID = group.ZoneID
+	} else if params.ZoneID != group.ZoneID {
+		return nil, nil, domain.ErrBoxZoneMismatch
+	}
+
 	// Get max sort_order for auto-increment
 	filter := domain.FilterBoxParams{GroupID: &params.GroupID}
 	boxes, err := s.repo.ListBoxes(ctx, filter)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	maxSortOrder := 0
@@ -248,16 +779,17 @@ func (s *ZoneService) CreateBox(ctx context.Context, params domain.CreateBoxPara
 	box.SortOrder = maxSortOrder + 1
 
 	if err := s.repo.CreateBox(ctx, box); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return box, nil
+	return box, warnings, nil
 }
 
-func (s *ZoneService) UpdateBox(ctx context.Context, id string, params domain.UpdateBoxParams) (*domain.Box, error) {
+// UpdateBox changes a box, returning with it the warnings the change was accepted despite
+func (s *ZoneService) UpdateBox(ctx context.Context, id string, params domain.UpdateBoxParams) (*domain.Box, domain.Warnings, error) {
 	box, err := s.repo.GetBox(ctx, id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if params.Name != nil {
@@ -269,27 +801,114 @@ func (s *ZoneService) UpdateBox(ctx context.Context, id string, params domain.Up
 	if params.Type != nil {
 		box.Type = params.Type
 	}
-	if params.GroupID != nil {
-		box.GroupID = *params.GroupID
+	fromGroup := box.GroupID
+	if params.GroupID != nil && *params.GroupID != box.GroupID {
+		group, err := s.repo.GetGroup(ctx, *params.GroupID)
+		if err != nil {
+			return nil, nil, err
+		}
+		box.GroupID = group.ID
+		box.ZoneID = group.ZoneID
 	}
 	if params.SortOrder != nil {
 		box.SortOrder = *params.SortOrder
 	}
 	if params.Location != nil {
-		box.Location = *params.Location
+		if err := domain.ValidateLocation("location", *params.Location, s.bounds); err != nil {
+			return nil, nil, err
+		}
+		now := time.Now().Unix()
+		movedAt := now
+		if params.MovedAt != nil {
+			movedAt = *params.MovedAt
+		}
+		if movedAt > now {
+			return nil, nil, domain.ErrInvalidMoveTime
+		}
+		if err := box.MoveTo(*params.Location, movedAt); err != nil {
+			return nil, nil, err
+		}
 	}
 	if params.DeviceID != nil {
 		box.DeviceID = *params.DeviceID
 	}
+	var warnings domain.Warnings
 	if params.Metrics != nil {
+		if err := domain.ValidateBoxMetrics(params.Metrics); err != nil {
+			return nil, nil, err
+		}
+		if warnings, err = s.checkMetricCatalog(ctx, params.Metrics, params.AllowUnknownMetrics); err != nil {
+			return nil, nil, err
+		}
 		box.Metrics = params.Metrics
 	}
+	if params.Merge != nil {
+		if err := params.Merge.Validate(); err != nil {
+			return nil, nil, err
+		}
+		box.Merge = params.Merge
+	}
+	if params.Dedup != nil {
+		if err := params.Dedup.Validate(); err != nil {
+			return nil, nil, err
+		}
+		box.Dedup = params.Dedup
+	}
+	if params.Anomaly != nil {
+		if err := params.Anomaly.Validate(); err != nil {
+			return nil, nil, err
+		}
+		box.Anomaly = params.Anomaly
+	}
+	if params.ExpectedIntervalSeconds != nil {
+		box.ExpectedIntervalSeconds = params.ExpectedIntervalSeconds
+		if *params.ExpectedIntervalSeconds == 0 {
+			box.ExpectedIntervalSeconds = nil
+		}
+	}
+	if params.Schedule != nil {
+		box.Schedule = params.Schedule
+	}
+	if err := domain.ValidateReportingSchedule(box.ExpectedIntervalSeconds, box.Schedule); err != nil {
+		return nil, nil, err
+	}
 
 	if err := s.repo.UpdateBox(ctx, box); err != nil {
+		return nil, nil, err
+	}
+	s.boxChanged(ctx, box.ID)
+	// The group the box left changed too, though none of its documents did
+	if box.GroupID != fromGroup {
+		if err := s.repo.TouchGroup(ctx, fromGroup); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return box, warnings, nil
+}
+
+// DecommissionBox stops a box from accepting records timestamped after at (seconds, now when nil).
+// Its history stays readable and it stays listed.
+func (s *ZoneService) DecommissionBox(ctx context.Context, id string, at *int64) (*domain.Box, error) {
+	if at == nil {
+		now := time.Now().Unix()
+		at = &now
+	}
+
+	if err := s.repo.SetBoxDecommission(ctx, id, at); err != nil {
 		return nil, err
 	}
+	s.boxChanged(ctx, id)
+	return s.repo.GetBox(ctx, id)
+}
 
-	return box, nil
+// RecommissionBox lets a decommissioned box accept records again
+func (s *ZoneService) RecommissionBox(ctx context.Context, id string) (*domain.Box, error) {
+	if err := s.repo.SetBoxDecommission(ctx, id, nil); err != nil {
+		return nil, err
+	}
+	s.boxChanged(ctx, id)
+	return s.repo.GetBox(ctx, id)
 }
 
 func (s *ZoneService) DeleteBox(ctx context.Context, id string) (*domain.Box, error) {
@@ -301,25 +920,244 @@ func (s *ZoneService) DeleteBox(ctx context.Context, id string) (*domain.Box, er
 	if err := s.repo.DeleteBox(ctx, id); err != nil {
 		return nil, err
 	}
+	s.boxChanged(ctx, id)
 
 	return box, nil
 }
 
 // Report operations
 
-func (s *ZoneService) ReportByMetric(ctx context.Context, boxGroupID string, metrics []string) ([]domain.Report, error) {
-	// Get all boxes in the group
-	filter := domain.FilterBoxParams{GroupID: &boxGroupID}
-	boxes, err := s.repo.ListBoxes(ctx, filter)
+// ReportByMetric reports the monthly totals of the metrics for every box of the group. Closed months
+// come from the report cache and only the current month is aggregated; refresh recomputes everything.
+// With deletedBoxes, the months of the boxes deleted since are reported too, flagged with box_deleted.
+// Metrics missing from the catalog are rejected with a *ValidationError.
+func (s *ZoneService) ReportByMetric(ctx context.Context, boxGroupID string, metrics []string, refresh, deletedBoxes bool) (*domain.ZoneGroupReport, error) {
+	if err := s.checkReportMetrics(ctx, metrics); err != nil {
+		return nil, err
+	}
+	return s.reportGroup(ctx, boxGroupID, metrics, refresh, deletedBoxes)
+}
+
+// checkReportMetrics rejects report metrics missing from the catalog with a *ValidationError
+func (s *ZoneService) checkReportMetrics(ctx context.Context, metrics []string) error {
+	if s.catalog == nil {
+		return nil
+	}
+	catalog, err := s.catalog.ListMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	if problems := domain.UnknownReportMetricProblems(metrics, catalog); len(problems) > 0 {
+		return &domain.ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// reportGroup computes the report of ReportByMetric. Boxes without a collection of records never
+// received one and are skipped; boxes whose records cannot be aggregated are left out and listed
+// in the failed boxes of a partial report.
+func (s *ZoneService) reportGroup(ctx context.Context, boxGroupID string, metrics []string, refresh, deletedBoxes bool) (*domain.ZoneGroupReport, error) {
+	boxes, err := s.repo.ListBoxes(ctx, domain.FilterBoxParams{GroupID: &boxGroupID, IncludeDeleted: deletedBoxes})
+	if err != nil {
+		return nil, err
+	}
+	boxIDs := make([]string, len(boxes))
+	for i, box := range boxes {
+		boxIDs[i] = box.ID
+	}
+	withRecords, err := s.repo.BoxesWithRecords(ctx, boxIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	// Extract box IDs as data sources
-	var sources []string
+	monthStart := domain.MonthStart(time.Now())
+	report := &domain.ZoneGroupReport{Reports: []domain.Report{}}
+	hits, reported := 0, 0
 	for _, box := range boxes {
-		sources = append(sources, box.ID)
+		if !withRecords[box.ID] {
+			continue
+		}
+		reported++
+
+		var cache *domain.ReportCache
+		if !refresh {
+			if cache, err = s.repo.GetReportCache(ctx, box.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		var months []domain.MonthlyTotals
+		var since int64
+		if cache != nil {
+			months = cache.Months
+			since = cache.Through
+			hits++
+		}
+
+		fresh, err := s.repo.MonthlyTotals(ctx, box.ID, since)
+		if err != nil {
+			// Once the client is gone or the query timed out, the remaining boxes would fail alike
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			log.Printf("Report box %s of group %s: %v", box.ID, boxGroupID, err)
+			report.FailedBoxes = append(report.FailedBoxes, domain.ReportBoxFailure{BoxID: box.ID, Error: err.Error()})
+			continue
+		}
+
+		var open []domain.MonthlyTotals
+		for _, m := range fresh {
+			if m.Start() < monthStart {
+				months = append(months, m)
+			} else {
+				open = append(open, m)
+			}
+		}
+
+		if cache == nil || cache.Through < monthStart {
+			closed := &domain.ReportCache{BoxID: box.ID, Through: monthStart, Months: months, CTime: time.Now().UnixMilli()}
+			if err := s.repo.SaveReportCache(ctx, closed); err != nil {
+				log.Printf("Cache report of box %s: %v", box.ID, err)
+			}
+		}
+
+		boxReports := domain.MonthlyReports(append(months, open...), metrics)
+		for i := range boxReports {
+			boxReports[i].BoxID = box.ID
+			boxReports[i].BoxDeleted = box.DTime != nil
+		}
+		report.Reports = append(report.Reports, boxReports...)
+	}
+
+	report.Partial = len(report.FailedBoxes) > 0
+	report.Cache = domain.ReportCachePartial
+	switch hits {
+	case 0:
+		report.Cache = domain.ReportCacheMiss
+	case reported:
+		report.Cache = domain.ReportCacheHit
+	}
+	return report, nil
+}
+
+// zoneReportWorkers bounds the group reports of a zone report computed at once
+const zoneReportWorkers = 4
+
+// ReportByZone computes the monthly reports of every group of a zone the user may read, each as
+// ReportByMetric does, a few groups at a time. A group whose report fails gets an error entry
+// instead of failing the whole report, and one with boxes left out is flagged partial.
+func (s *ZoneService) ReportByZone(ctx context.Context, zoneID string, metrics []string, refresh, deletedBoxes bool, user *domain.User) (*domain.ZoneReport, domain.ReportCacheStatus, error) {
+	if _, err := s.repo.GetZone(ctx, zoneID); err != nil {
+		return nil, "", err
+	}
+	if err := s.checkReportMetrics(ctx, metrics); err != nil {
+		return nil, "", err
+	}
+	groups, err := s.repo.ListGroups(ctx, zoneID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	groupIDs := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if user.CanAccessGroup(group.ID) {
+			groupIDs = append(groupIDs, group.ID)
+		}
+	}
+	if len(groupIDs)*len(metrics) > domain.MaxZoneReportCombinations {
+		return nil, "", domain.ErrTooManyReportGroups
+	}
+
+	results := make([]domain.ZoneGroupReport, len(groupIDs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(zoneReportWorkers, len(groupIDs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				report, err := s.reportGroup(ctx, groupIDs[i], metrics, refresh, deletedBoxes)
+				if err != nil {
+					log.Printf("Report group %s: %v", groupIDs[i], err)
+					results[i] = domain.ZoneGroupReport{Reports: []domain.Report{}, Error: err.Error()}
+					continue
+				}
+				results[i] = *report
+			}
+		}()
+	}
+	for i := range groupIDs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	// Once the client is gone or the query timed out, every group failed alike
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	report := &domain.ZoneReport{ZoneID: zoneID, Groups: make(map[string]domain.ZoneGroupReport, len(groupIDs))}
+	statuses := make([]domain.ReportCacheStatus, 0, len(groupIDs))
+	for i, groupID := range groupIDs {
+		report.Groups[groupID] = results[i]
+		if results[i].Error == "" {
+			statuses = append(statuses, results[i].Cache)
+		}
+	}
+	return report, domain.CombinedCacheStatus(statuses), nil
+}
+
+// Tree returns the zone → group → box hierarchy for navigation, or the subtree of one zone when
+// zoneID is set, with one query per level. Non-admins get the groups they may read and their zones.
+func (s *ZoneService) Tree(ctx context.Context, user *domain.User, zoneID string) ([]domain.TreeZone, error) {
+	var zoneIDs []string
+	if zoneID != "" {
+		zoneIDs = []string{zoneID}
+	}
+
+	var zones []domain.Zone
+	var groups []domain.BoxGroup
+	var err error
+	if user.Role == domain.RoleAdmin {
+		if zones, err = s.repo.ListTreeZones(ctx, zoneIDs); err != nil {
+			return nil, err
+		}
+		if zoneID != "" && len(zones) == 0 {
+			return nil, domain.ErrZoneNotFound
+		}
+		ids := make([]string, len(zones))
+		for i, zone := range zones {
+			ids[i] = zone.ID
+		}
+		if groups, err = s.repo.ListTreeGroups(ctx, ids, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		if groups, err = s.repo.ListTreeGroups(ctx, zoneIDs, user.ReadableGroups()); err != nil {
+			return nil, err
+		}
+		// Not nil, so a user without groups gets no zone rather than every zone
+		ids := []string{}
+		seen := map[string]bool{}
+		for _, group := range groups {
+			if !seen[group.ZoneID] {
+				seen[group.ZoneID] = true
+				ids = append(ids, group.ZoneID)
+			}
+		}
+		if zones, err = s.repo.ListTreeZones(ctx, ids); err != nil {
+			return nil, err
+		}
 	}
 
-	return s.repo.ReportByMetric(ctx, sources, metrics)
+	groupIDs := make([]string, len(groups))
+	for i, group := range groups {
+		groupIDs[i] = group.ID
+	}
+	boxes, err := s.repo.ListTreeBoxes(ctx, groupIDs)
+	if err != nil {
+		return nil, err
+	}
+	return domain.BuildTree(zones, groups, boxes), nil
 }
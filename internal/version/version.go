@@ -0,0 +1,29 @@
+// Package version holds the build metadata of the binary. The values are set at build time, e.g.
+//
+//	go build -ldflags "-X tp25-api/internal/version.Version=v1.2.0 -X tp25-api/internal/version.Commit=$(git rev-parse --short HEAD)"
+//
+// and stay "dev" in builds without the flags.
+package version
+
+var (
+	Version   = "dev"
+	Commit    = "dev"
+	BuildDate = "dev" // RFC 3339, UTC
+)
+
+// Info is the build metadata reported by GET /version
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Get returns the build metadata
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate}
+}
+
+// String describes the build for logs, e.g. "v1.2.0 (commit 1a2b3c4, built 2024-05-01T10:00:00Z)"
+func String() string {
+	return Version + " (commit " + Commit + ", built " + BuildDate + ")"
+}
@@ -0,0 +1,43 @@
+package version
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+// Tests are built without -ldflags, as is any build that does not go through make or docker
+func TestDefaultsToDev(t *testing.T) {
+	if got, want := Get(), (Info{Version: "dev", Commit: "dev", BuildDate: "dev"}); got != want {
+		t.Errorf("Get() = %+v, want %+v", got, want)
+	}
+	if got, want := String(), "dev (commit dev, built dev)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+// A -X flag naming a variable that does not exist is ignored by the linker, leaving "dev" in releases
+func TestBuildFlagsNameTheVariables(t *testing.T) {
+	flag := regexp.MustCompile(`-X ([\w./-]+)\.(\w+)=`)
+	variables := map[string]bool{"Version": true, "Commit": true, "BuildDate": true}
+
+	// deploy.bat builds through the Dockerfile, passing the values as build args
+	for _, path := range []string{"../../Makefile", "../../Dockerfile"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := map[string]bool{}
+		for _, m := range flag.FindAllStringSubmatch(string(data), -1) {
+			if m[1] != "tp25-api/internal/version" || !variables[m[2]] {
+				t.Errorf("%s sets %s.%s, which is not a build variable", path, m[1], m[2])
+			}
+			set[m[2]] = true
+		}
+		for name := range variables {
+			if !set[name] {
+				t.Errorf("%s does not set %s", path, name)
+			}
+		}
+	}
+}
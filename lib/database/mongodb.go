@@ -3,24 +3,109 @@ package database
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tp25-api/internal/config"
 
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
 type MongoDB struct {
 	Client   *mongo.Client
 	Database *mongo.Database
+	pool     *poolStats
+	commands *commandStats
+}
+
+// PoolStats is a snapshot of the driver connection pool counters
+type PoolStats struct {
+	Open             int64 `json:"open"`
+	InUse            int64 `json:"in_use"`
+	Idle             int64 `json:"idle"`
+	CheckedOut       int64 `json:"checked_out_total"`
+	CheckoutFailures int64 `json:"checkout_failures_total"`
+}
+
+// poolStats counts pool events reported by the driver
+type poolStats struct {
+	open             atomic.Int64
+	inUse            atomic.Int64
+	checkedOut       atomic.Int64
+	checkoutFailures atomic.Int64
+}
+
+func (p *poolStats) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{
+		Event: func(evt *event.PoolEvent) {
+			switch evt.Type {
+			case event.ConnectionCreated:
+				p.open.Add(1)
+			case event.ConnectionClosed:
+				p.open.Add(-1)
+			case event.GetSucceeded:
+				p.inUse.Add(1)
+				p.checkedOut.Add(1)
+			case event.ConnectionReturned:
+				p.inUse.Add(-1)
+			case event.GetFailed:
+				p.checkoutFailures.Add(1)
+			}
+		},
+	}
+}
+
+// commandStats counts the commands sent to each collection
+type commandStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// monitor counts commands, then passes their events on to next when set
+func (s *commandStats) monitor(next *event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, evt *event.CommandStartedEvent) {
+			// The collection is the value of the command's first element, e.g. {find: "user"}
+			if collection, ok := evt.Command.Lookup(evt.CommandName).StringValueOK(); ok {
+				s.mu.Lock()
+				s.counts[collection]++
+				s.mu.Unlock()
+			}
+			if next != nil && next.Started != nil {
+				next.Started(ctx, evt)
+			}
+		},
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			if next != nil && next.Succeeded != nil {
+				next.Succeeded(ctx, evt)
+			}
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			if next != nil && next.Failed != nil {
+				next.Failed(ctx, evt)
+			}
+		},
+	}
 }
 
 func NewMongoDB(cfg *config.Config) (*MongoDB, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(cfg.Database.URL)
+	pool := &poolStats{}
+	commands := &commandStats{counts: map[string]int64{}}
+	var tracing *event.CommandMonitor
+	if cfg.Tracing.Enabled() {
+		tracing = otelmongo.NewMonitor()
+	}
+	clientOptions := options.Client().
+		ApplyURI(cfg.Database.URL).
+		SetPoolMonitor(pool.monitor()).
+		SetMonitor(commands.monitor(tracing))
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -37,6 +122,8 @@ func NewMongoDB(cfg *config.Config) (*MongoDB, error) {
 	return &MongoDB{
 		Client:   client,
 		Database: database,
+		pool:     pool,
+		commands: commands,
 	}, nil
 }
 
@@ -46,6 +133,30 @@ func (m *MongoDB) Close() error {
 	return m.Client.Disconnect(ctx)
 }
 
+// PoolStats returns the current connection pool counters
+func (m *MongoDB) PoolStats() PoolStats {
+	open := m.pool.open.Load()
+	inUse := m.pool.inUse.Load()
+	return PoolStats{
+		Open:             open,
+		InUse:            inUse,
+		Idle:             open - inUse,
+		CheckedOut:       m.pool.checkedOut.Load(),
+		CheckoutFailures: m.pool.checkoutFailures.Load(),
+	}
+}
+
+// CommandCounts returns how many commands were sent to each collection so far
+func (m *MongoDB) CommandCounts() map[string]int64 {
+	m.commands.mu.Lock()
+	defer m.commands.mu.Unlock()
+	counts := make(map[string]int64, len(m.commands.counts))
+	for collection, n := range m.commands.counts {
+		counts[collection] = n
+	}
+	return counts
+}
+
 // Collection returns a MongoDB collection
 func (m *MongoDB) Collection(name string) *mongo.Collection {
 	return m.Database.Collection(name)
@@ -0,0 +1,47 @@
+package downloadtoken
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1700000000, 0)
+
+func TestVerify(t *testing.T) {
+	signer := New([]byte("key"))
+	token := signer.Sign("job1", now.Add(time.Hour))
+
+	if err := signer.Verify("job1", token, now); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if err := signer.Verify("job1", token, now.Add(time.Hour)); err != ErrExpired {
+		t.Errorf("at expiry: got %v, want ErrExpired", err)
+	}
+	if err := signer.Verify("job2", token, now); err != ErrInvalid {
+		t.Errorf("other job: got %v, want ErrInvalid", err)
+	}
+	if err := New([]byte("other")).Verify("job1", token, now); err != ErrInvalid {
+		t.Errorf("other key: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestVerifyTamperedExpiry(t *testing.T) {
+	signer := New([]byte("key"))
+	token := signer.Sign("job1", now.Add(-time.Minute))
+
+	_, mac, _ := strings.Cut(token, ".")
+	extended := "9999999999." + mac
+	if err := signer.Verify("job1", extended, now); err != ErrInvalid {
+		t.Errorf("extended expiry: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	signer := New([]byte("key"))
+	for _, token := range []string{"", "abc", "soon.AAAA", "1700003600.!!!"} {
+		if err := signer.Verify("job1", token, now); err != ErrMalformed {
+			t.Errorf("%q: got %v, want ErrMalformed", token, err)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package interpolation
 
 import (
+	"errors"
+	"fmt"
 	"math"
 	"sort"
+	"strings"
 )
 
 // Point represents a data point for interpolation
@@ -16,6 +19,72 @@ type Curve struct {
 	Points []Point
 }
 
+// Curve point problems
+var (
+	ErrTooFewPoints = errors.New("a curve needs at least 2 points")
+	ErrDuplicateX   = errors.New("duplicate x")
+	ErrDecreasingX  = errors.New("x lower than the previous point")
+	ErrNonFinite    = errors.New("not a finite number")
+)
+
+// PointProblem is an offending point of a curve; Index is -1 for problems of the whole curve
+type PointProblem struct {
+	Index int
+	Point Point
+	Err   error
+}
+
+// CurveError lists every problem found in a curve
+type CurveError struct {
+	Problems []PointProblem
+}
+
+func (e *CurveError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		if p.Index < 0 {
+			messages[i] = p.Err.Error()
+		} else {
+			messages[i] = fmt.Sprintf("point %d (%g, %g): %v", p.Index, p.Point.X, p.Point.Y, p.Err)
+		}
+	}
+	return "invalid curve: " + strings.Join(messages, "; ")
+}
+
+// ValidatePoints checks points in the order given: at least 2, finite, with strictly increasing X.
+// It returns a *CurveError listing every offending point.
+func ValidatePoints(points []Point) error {
+	var problems []PointProblem
+	if len(points) < 2 {
+		problems = append(problems, PointProblem{Index: -1, Err: ErrTooFewPoints})
+	}
+	for i, p := range points {
+		if math.IsNaN(p.X) || math.IsInf(p.X, 0) || math.IsNaN(p.Y) || math.IsInf(p.Y, 0) {
+			problems = append(problems, PointProblem{Index: i, Point: p, Err: ErrNonFinite})
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		switch previous := points[i-1].X; {
+		case p.X == previous:
+			problems = append(problems, PointProblem{Index: i, Point: p, Err: ErrDuplicateX})
+		case p.X < previous:
+			problems = append(problems, PointProblem{Index: i, Point: p, Err: ErrDecreasingX})
+		}
+	}
+
+	if len(problems) > 0 {
+		return &CurveError{Problems: problems}
+	}
+	return nil
+}
+
+// Validate checks that the curve interpolates meaningfully, see ValidatePoints
+func (c *Curve) Validate() error {
+	return ValidatePoints(c.Points)
+}
+
 // NewCurve creates a new interpolation curve from points
 func NewCurve(points []Point) *Curve {
 	// Sort points by X value
@@ -140,14 +209,22 @@ func (h *HydraulicCalculator) CalculateWaterOverFlow(wau float64) float64 {
 	return h.OverflowM * h.OverflowB * sqrt2g * wauPower
 }
 
-// SetVolumeCurve sets a custom volume curve
-func (h *HydraulicCalculator) SetVolumeCurve(points []Point) {
+// SetVolumeCurve sets a custom volume curve, keeping the current one when points are invalid
+func (h *HydraulicCalculator) SetVolumeCurve(points []Point) error {
+	if err := ValidatePoints(points); err != nil {
+		return err
+	}
 	h.VolumeCurve = NewCurve(points)
+	return nil
 }
 
-// SetFlowCurve sets a custom flow curve
-func (h *HydraulicCalculator) SetFlowCurve(points []Point) {
+// SetFlowCurve sets a custom flow curve, keeping the current one when points are invalid
+func (h *HydraulicCalculator) SetFlowCurve(points []Point) error {
+	if err := ValidatePoints(points); err != nil {
+		return err
+	}
 	h.FlowCurve = NewCurve(points)
+	return nil
 }
 
 // SetOverflowParams sets overflow calculation parameters
@@ -0,0 +1,71 @@
+package interpolation
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCurveValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []Point
+		want   []PointProblem
+	}{
+		{"valid", []Point{{0, 0}, {1, 0.5}, {2, 1.2}}, nil},
+		{"no points", nil, []PointProblem{{Index: -1, Err: ErrTooFewPoints}}},
+		{"one point", []Point{{1, 1}}, []PointProblem{{Index: -1, Err: ErrTooFewPoints}}},
+		{"unsorted", []Point{{0, 0}, {2, 1}, {1, 0.5}}, []PointProblem{{Index: 2, Point: Point{1, 0.5}, Err: ErrDecreasingX}}},
+		{"duplicate x", []Point{{0, 0}, {1, 0.5}, {1, 0.7}}, []PointProblem{{Index: 2, Point: Point{1, 0.7}, Err: ErrDuplicateX}}},
+		{"every problem listed", []Point{{2, 0}, {1, 0}, {1, 0}}, []PointProblem{
+			{Index: 1, Point: Point{1, 0}, Err: ErrDecreasingX},
+			{Index: 2, Point: Point{1, 0}, Err: ErrDuplicateX},
+		}},
+		{"too few and not finite", []Point{{math.NaN(), 0}}, []PointProblem{
+			{Index: -1, Err: ErrTooFewPoints},
+			{Index: 0, Point: Point{math.NaN(), 0}, Err: ErrNonFinite},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Curve{Points: tt.points}).Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+
+			var curveErr *CurveError
+			if !errors.As(err, &curveErr) {
+				t.Fatalf("got %v, want a *CurveError", err)
+			}
+			if len(curveErr.Problems) != len(tt.want) {
+				t.Fatalf("got %v, want %d problems", err, len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := curveErr.Problems[i]
+				// NaN never equals itself, so compare the points through their bits
+				if got.Index != want.Index || got.Err != want.Err || !samePoint(got.Point, want.Point) {
+					t.Errorf("problem %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// NewCurve sorts its points, so a curve built from unsorted ones validates
+func TestNewCurveSortsPoints(t *testing.T) {
+	curve := NewCurve([]Point{{2, 1.2}, {0, 0}, {1, 0.5}})
+	if err := curve.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Point{{0, 0}, {1, 0.5}, {2, 1.2}}; !reflect.DeepEqual(curve.Points, want) {
+		t.Errorf("points %v, want %v", curve.Points, want)
+	}
+}
+
+func samePoint(a, b Point) bool {
+	return math.Float64bits(a.X) == math.Float64bits(b.X) && math.Float64bits(a.Y) == math.Float64bits(b.Y)
+}
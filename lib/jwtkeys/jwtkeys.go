@@ -0,0 +1,47 @@
+// Package jwtkeys signs tokens with the first of several HMAC secrets and verifies them with any
+// of them, so a secret can be rotated without invalidating the tokens signed with the previous one.
+package jwtkeys
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrNoSecret = errors.New("jwtkeys: no secret")
+
+// Keys holds the secrets, the signing one first
+type Keys struct {
+	secrets [][]byte
+}
+
+// New returns the keys for secrets, skipping empty ones
+func New(secrets []string) *Keys {
+	k := &Keys{}
+	for _, secret := range secrets {
+		if secret != "" {
+			k.secrets = append(k.secrets, []byte(secret))
+		}
+	}
+	return k
+}
+
+// Sign signs claims with HS256 and the first secret
+func (k *Keys) Sign(claims jwt.Claims) (string, error) {
+	if len(k.secrets) == 0 {
+		return "", ErrNoSecret
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secrets[0])
+}
+
+// Keyfunc is a jwt.Keyfunc accepting a token signed with any of the secrets
+func (k *Keys) Keyfunc(*jwt.Token) (interface{}, error) {
+	if len(k.secrets) == 0 {
+		return nil, ErrNoSecret
+	}
+	set := jwt.VerificationKeySet{Keys: make([]jwt.VerificationKey, len(k.secrets))}
+	for i, secret := range k.secrets {
+		set.Keys[i] = secret
+	}
+	return set, nil
+}
@@ -0,0 +1,68 @@
+package jwtkeys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func claims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "user", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+}
+
+func verifies(k *Keys, token string) bool {
+	parsed, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, k.Keyfunc)
+	return err == nil && parsed.Valid
+}
+
+func TestRotation(t *testing.T) {
+	old := New([]string{"old"})
+	rotating := New([]string{"new", "old"})
+	rotated := New([]string{"new"})
+
+	before, err := old.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	during, err := rotating.Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens signed before the rotation stay valid while the old secret is listed second
+	if !verifies(rotating, before) {
+		t.Error("a token signed with the secondary secret does not verify")
+	}
+	// New tokens are signed with the primary secret
+	if !verifies(rotated, during) {
+		t.Error("a token signed during the rotation does not verify with the primary secret alone")
+	}
+	if verifies(old, during) {
+		t.Error("a token signed during the rotation verifies with the old secret")
+	}
+	// Once the old secret is removed, its tokens are refused
+	if verifies(rotated, before) {
+		t.Error("a token signed with a removed secret still verifies")
+	}
+}
+
+func TestNewSkipsBlankSecrets(t *testing.T) {
+	token, err := New([]string{"", "secret"}).Sign(claims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifies(New([]string{"secret"}), token) {
+		t.Error("the first non-blank secret does not sign")
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	k := New(nil)
+	if _, err := k.Sign(claims()); err != ErrNoSecret {
+		t.Errorf("Sign() error = %v, want ErrNoSecret", err)
+	}
+	if _, err := k.Keyfunc(nil); err != ErrNoSecret {
+		t.Errorf("Keyfunc() error = %v, want ErrNoSecret", err)
+	}
+}
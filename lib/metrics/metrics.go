@@ -0,0 +1,192 @@
+// Package metrics keeps counters and gauges in memory and writes them in the Prometheus text
+// exposition format, for scraping without pulling in the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds the metrics written by WriteText, in registration order
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ContentType is the media type of the text format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec registers a counter with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*sample)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter of the label values, given in the order of the label names
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter of the label values
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", c.name, len(c.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), values...)}
+		c.values[key] = s
+	}
+	s.value += delta
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	samples := make([]sample, 0, len(c.values))
+	for _, s := range c.values {
+		samples = append(samples, *s)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\xff") < strings.Join(samples[j].labels, "\xff")
+	})
+	return writeFamily(w, c.name, c.help, "counter", c.labels, samples)
+}
+
+// GaugeFunc is a gauge whose values are read when the metrics are written
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	read   func() []Sample
+}
+
+// Sample is one value of a GaugeFunc with its label values
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// NewGaugeFunc registers a gauge read from fn at each scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, fn func() []Sample) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, read: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	read := g.read()
+	samples := make([]sample, len(read))
+	for i, s := range read {
+		samples[i] = sample{labels: s.Labels, value: s.Value}
+	}
+	return writeFamily(w, g.name, g.help, "gauge", g.labels, samples)
+}
+
+func writeFamily(w io.Writer, name, help, kind string, labels []string, samples []sample) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, escapeHelp(help), name, kind); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		var b strings.Builder
+		b.WriteString(name)
+		if len(labels) > 0 {
+			b.WriteByte('{')
+			for i, label := range labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				value := ""
+				if i < len(s.labels) {
+					value = s.labels[i]
+				}
+				b.WriteString(label)
+				b.WriteString(`="`)
+				b.WriteString(escapeLabel(value))
+				b.WriteByte('"')
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatValue(s.value))
+		b.WriteByte('\n')
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,93 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ChannelSMS  = "sms"
+	ChannelZalo = "zalo"
+)
+
+// Message is a short text delivered to a user over one channel
+type Message struct {
+	Channel string `json:"channel"`
+	To      string `json:"to"` // phone number or Zalo ID
+	Text    string `json:"text"`
+
+	// Secrets are the parts of Text that grant access, e.g. a reset code or a download link. They
+	// are delivered but never written to the log.
+	Secrets []string `json:"-"`
+}
+
+// Redacted returns Text with its secrets masked, fit for the log
+func (m Message) Redacted() string {
+	text := m.Text
+	for _, secret := range m.Secrets {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "[redacted]")
+		}
+	}
+	return text
+}
+
+// Sender delivers messages to users
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns a sender posting to the SMS/Zalo gateway webhook at webhookURL.
+// Without a webhook, messages are only written to the log, which is meant for development; their
+// secrets are masked there, so a password reset cannot be completed from the log.
+func New(webhookURL string) Sender {
+	if webhookURL == "" {
+		return logSender{}
+	}
+	return &webhookSender{
+		url:    webhookURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type logSender struct{}
+
+func (logSender) Send(ctx context.Context, msg Message) error {
+	log.Printf("Notify (no webhook configured) %s to %s: %s", msg.Channel, msg.To, msg.Redacted())
+	return nil
+}
+
+type webhookSender struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSender) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify webhook returned %s", resp.Status)
+	}
+	return nil
+}
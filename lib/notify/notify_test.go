@@ -0,0 +1,65 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogSenderMasksSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	msg := Message{
+		Channel: ChannelSMS,
+		To:      "0900000000",
+		Text:    "Mã đặt lại mật khẩu TP25 của bạn: 482913. Mã có hiệu lực trong 15 phút.",
+		Secrets: []string{"482913"},
+	}
+	if err := (logSender{}).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := buf.String()
+	if strings.Contains(logged, "482913") {
+		t.Errorf("the reset code reached the log: %s", logged)
+	}
+	if !strings.Contains(logged, "[redacted]") {
+		t.Errorf("the log does not show where the code was: %s", logged)
+	}
+}
+
+func TestRedactedKeepsTextWithoutSecrets(t *testing.T) {
+	msg := Message{Text: "Tác vụ TP25 reindex (abc) đã hoàn tất", Secrets: []string{""}}
+	if got := msg.Redacted(); got != msg.Text {
+		t.Errorf("Redacted() = %q, want the text unchanged", got)
+	}
+}
+
+func TestNewPostsToWebhook(t *testing.T) {
+	if _, ok := New("").(logSender); !ok {
+		t.Error("without a webhook, messages are not only logged")
+	}
+
+	var got Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	msg := Message{Channel: ChannelZalo, To: "z123", Text: "Tác vụ TP25 reindex (abc) đã hoàn tất"}
+	if err := New(srv.URL).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got.Channel != msg.Channel || got.To != msg.To || got.Text != msg.Text {
+		t.Errorf("webhook received %+v, want %+v", got, msg)
+	}
+}
@@ -1,6 +1,8 @@
 package lib
 
 import (
+	crand "crypto/rand"
+	"math/big"
 	"math/rand"
 	"time"
 )
@@ -39,6 +41,22 @@ func (r *baserandom) Num(len int) string {
 	)
 }
 
+// SecureChar returns n alphanumeric characters drawn from crypto/rand, for passwords and tokens
+func SecureChar(n int) (string, error) {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	max := big.NewInt(int64(len(chars)))
+
+	b := make([]byte, n)
+	for i := range b {
+		v, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[v.Int64()]
+	}
+	return string(b), nil
+}
+
 type random interface {
 	Char(len int) string
 	Upper(len int) string
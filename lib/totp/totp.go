@@ -0,0 +1,89 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the parameters every
+// authenticator app supports: HMAC-SHA1, 6 digits, 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	period = 30
+	digits = 6
+	// skew is the number of periods accepted on either side of the current one, for clock drift
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32 secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// URL returns the otpauth:// URL authenticator apps import, usually rendered as a QR code
+func URL(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(digits))
+	query.Set("period", fmt.Sprint(period))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// Validate reports whether code is valid for t, allowing one period of clock drift
+func Validate(secret, code string, t time.Time) bool {
+	_, ok := Match(secret, code, t)
+	return ok
+}
+
+// Match returns the time step code was generated for when it is valid for t, allowing one period
+// of clock drift. Storing the step lets a caller refuse a code used before, or an older one.
+func Match(secret, code string, t time.Time) (int64, bool) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != digits {
+		return 0, false
+	}
+
+	counter := t.Unix() / period
+	for i := int64(-skew); i <= skew; i++ {
+		expected := generate(key, uint64(counter+i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + i, true
+		}
+	}
+	return 0, false
+}
+
+func generate(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
@@ -0,0 +1,42 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		at      int64
+		counter int64
+		ok      bool
+	}{
+		// The RFC vectors have 8 digits; the 6-digit codes are their last 6
+		{name: "current step", code: "287082", at: 59, counter: 1, ok: true},
+		{name: "current step later on", code: "081804", at: 1111111109, counter: 37037036, ok: true},
+		{name: "previous step", code: "081804", at: 1111111109 + period, counter: 37037036, ok: true},
+		{name: "next step", code: "081804", at: 1111111109 - period, counter: 37037036, ok: true},
+		{name: "two steps late", code: "081804", at: 1111111109 + 2*period, ok: false},
+		{name: "wrong code", code: "000000", at: 59, ok: false},
+		{name: "too short", code: "28708", at: 59, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, ok := Match(rfcSecret, tt.code, time.Unix(tt.at, 0))
+			if ok != tt.ok {
+				t.Fatalf("Match() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && counter != tt.counter {
+				t.Errorf("Match() counter = %d, want %d", counter, tt.counter)
+			}
+			if Validate(rfcSecret, tt.code, time.Unix(tt.at, 0)) != tt.ok {
+				t.Errorf("Validate() disagrees with Match()")
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Package xlsxtemplate fills xlsx files prepared in Excel through their defined names.
+//
+// A single-cell name receives one value. A row name refers to one row of cells whose text
+// are column keys; it is repeated once per data row, keeping the template row's cell styles,
+// and everything below it moves down so footers such as signature blocks stay under the data.
+//
+// time.Time values become Excel datetimes shown with the number format of their cell, or Excel's
+// default datetime format when the cell has none.
+package xlsxtemplate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Range is the area a defined name refers to
+type Range struct {
+	Sheet    string
+	FromCol  int
+	FromRow  int
+	ToCol    int
+	ToRow    int
+	RefersTo string
+}
+
+// IsCell reports whether the range is a single cell
+func (r Range) IsCell() bool {
+	return r.FromCol == r.ToCol && r.FromRow == r.ToRow
+}
+
+// IsRow reports whether the range lies within a single row
+func (r Range) IsRow() bool {
+	return r.FromRow == r.ToRow
+}
+
+// Template is an opened template. Values are applied on Write.
+type Template struct {
+	file   *excelize.File
+	ranges map[string]Range
+	values map[string]interface{}
+	rows   map[string][][]interface{}
+}
+
+// Open reads a template and resolves its defined names. Names whose reference is not a
+// plain cell or range, such as formulas or references to other workbooks, are skipped.
+func Open(r io.Reader) (*Template, error) {
+	file, err := excelize.OpenReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Template{
+		file:   file,
+		ranges: make(map[string]Range),
+		values: make(map[string]interface{}),
+		rows:   make(map[string][][]interface{}),
+	}
+	for _, name := range file.GetDefinedName() {
+		if rng, ok := parseRange(name.RefersTo); ok {
+			t.ranges[name.Name] = rng
+		}
+	}
+	return t, nil
+}
+
+// Close releases the temporary files of the underlying workbook
+func (t *Template) Close() error {
+	return t.file.Close()
+}
+
+// Names returns the usable defined names, sorted
+func (t *Template) Names() []string {
+	names := make([]string, 0, len(t.ranges))
+	for name := range t.ranges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Range returns the range of a defined name
+func (t *Template) Range(name string) (Range, bool) {
+	rng, ok := t.ranges[name]
+	return rng, ok
+}
+
+// Keys returns the column keys of a row name: the trimmed text of each of its cells
+func (t *Template) Keys(name string) ([]string, error) {
+	rng, ok := t.ranges[name]
+	if !ok {
+		return nil, fmt.Errorf("defined name %s not found", name)
+	}
+	if !rng.IsRow() {
+		return nil, fmt.Errorf("defined name %s must refer to a single row, refers to %s", name, rng.RefersTo)
+	}
+
+	keys := make([]string, 0, rng.ToCol-rng.FromCol+1)
+	for col := rng.FromCol; col <= rng.ToCol; col++ {
+		cell, _ := excelize.CoordinatesToCellName(col, rng.FromRow)
+		value, err := t.file.GetCellValue(rng.Sheet, cell)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, strings.TrimSpace(value))
+	}
+	return keys, nil
+}
+
+// SetValue sets the value of a single-cell name. Names missing from the template are ignored.
+func (t *Template) SetValue(name string, value interface{}) {
+	if rng, ok := t.ranges[name]; ok && rng.IsCell() {
+		t.values[name] = value
+	}
+}
+
+// SetRows sets the data rows of a row name, each holding one value per key in Keys order
+func (t *Template) SetRows(name string, rows [][]interface{}) {
+	t.rows[name] = rows
+}
+
+// fill is one pending write, applied bottom-up so inserted rows do not move pending targets
+type fill struct {
+	rng   Range
+	value interface{}
+	rows  [][]interface{}
+	isRow bool
+}
+
+// Write applies the values and rows and writes the workbook
+func (t *Template) Write(w io.Writer) error {
+	var fills []fill
+	for name, value := range t.values {
+		fills = append(fills, fill{rng: t.ranges[name], value: value})
+	}
+	for name, rows := range t.rows {
+		fills = append(fills, fill{rng: t.ranges[name], rows: rows, isRow: true})
+	}
+	sort.SliceStable(fills, func(i, j int) bool {
+		if fills[i].rng.Sheet != fills[j].rng.Sheet {
+			return fills[i].rng.Sheet < fills[j].rng.Sheet
+		}
+		return fills[i].rng.FromRow > fills[j].rng.FromRow
+	})
+
+	for _, f := range fills {
+		var err error
+		if f.isRow {
+			err = t.fillRows(f.rng, f.rows)
+		} else {
+			cell, _ := excelize.CoordinatesToCellName(f.rng.FromCol, f.rng.FromRow)
+			err = t.setCell(f.rng.Sheet, cell, f.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.file.Write(w)
+}
+
+// fillRows writes rows from the template row down, inserting the rows needed after it
+// and copying the template row's cell styles onto them
+func (t *Template) fillRows(rng Range, rows [][]interface{}) error {
+	if len(rows) > 1 {
+		if err := t.file.InsertRows(rng.Sheet, rng.FromRow+1, len(rows)-1); err != nil {
+			return err
+		}
+
+		for col := rng.FromCol; col <= rng.ToCol; col++ {
+			top, _ := excelize.CoordinatesToCellName(col, rng.FromRow)
+			style, err := t.file.GetCellStyle(rng.Sheet, top)
+			if err != nil {
+				return err
+			}
+			bottom, _ := excelize.CoordinatesToCellName(col, rng.FromRow+len(rows)-1)
+			if err := t.file.SetCellStyle(rng.Sheet, top, bottom, style); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Without data the template row is blanked rather than removed so the layout is unchanged
+	if len(rows) == 0 {
+		rows = [][]interface{}{nil}
+	}
+
+	for i, row := range rows {
+		for col := rng.FromCol; col <= rng.ToCol; col++ {
+			var value interface{}
+			if idx := col - rng.FromCol; idx < len(row) {
+				value = row[idx]
+			}
+			cell, _ := excelize.CoordinatesToCellName(col, rng.FromRow+i)
+			if err := t.setCell(rng.Sheet, cell, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseRange parses references like Sheet1!$A$1, 'My sheet'!$A$5:$F$5 or =Sheet1!A5:F5
+func parseRange(refersTo string) (Range, bool) {
+	ref := strings.TrimPrefix(strings.TrimSpace(refersTo), "=")
+	bang := strings.LastIndex(ref, "!")
+	if bang <= 0 {
+		return Range{}, false
+	}
+
+	sheet := ref[:bang]
+	if strings.HasPrefix(sheet, "'") && strings.HasSuffix(sheet, "'") && len(sheet) >= 2 {
+		sheet = strings.ReplaceAll(sheet[1:len(sheet)-1], "''", "'")
+	}
+	if sheet == "" || strings.ContainsAny(sheet, "[]") {
+		return Range{}, false
+	}
+
+	cells := strings.Split(strings.ReplaceAll(ref[bang+1:], "$", ""), ":")
+	if len(cells) > 2 {
+		return Range{}, false
+	}
+
+	fromCol, fromRow, err := excelize.CellNameToCoordinates(cells[0])
+	if err != nil {
+		return Range{}, false
+	}
+	toCol, toRow := fromCol, fromRow
+	if len(cells) == 2 {
+		if toCol, toRow, err = excelize.CellNameToCoordinates(cells[1]); err != nil {
+			return Range{}, false
+		}
+	}
+	if toCol < fromCol {
+		fromCol, toCol = toCol, fromCol
+	}
+	if toRow < fromRow {
+		fromRow, toRow = toRow, fromRow
+	}
+
+	return Range{
+		Sheet:    sheet,
+		FromCol:  fromCol,
+		FromRow:  fromRow,
+		ToCol:    toCol,
+		ToRow:    toRow,
+		RefersTo: refersTo,
+	}, true
+}
+
+// setCell writes a value. excelize gives datetimes its default format, replacing the cell's, so
+// datetimes are written as Excel serial dates in cells that have a number format of their own.
+func (t *Template) setCell(sheet, cell string, value interface{}) error {
+	if at, ok := value.(time.Time); ok {
+		formatted, err := t.hasNumberFormat(sheet, cell)
+		if err != nil {
+			return err
+		}
+		if formatted {
+			value = excelTime(at)
+		}
+	}
+	return t.file.SetCellValue(sheet, cell, value)
+}
+
+func (t *Template) hasNumberFormat(sheet, cell string) (bool, error) {
+	id, err := t.file.GetCellStyle(sheet, cell)
+	if err != nil || id == 0 {
+		return false, err
+	}
+	style, err := t.file.GetStyle(id)
+	if err != nil {
+		return false, err
+	}
+	return style.NumFmt != 0 || style.CustomNumFmt != nil, nil
+}
+
+// excelTime returns the Excel serial date (1900 date system) of the wall clock of at
+func excelTime(at time.Time) float64 {
+	_, offset := at.Zone()
+	const unixEpoch = 25569 // days from Excel's day 0, 1899-12-30, to 1970-01-01
+	return float64(at.Unix()+int64(offset))/86400 + unixEpoch
+}
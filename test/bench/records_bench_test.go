@@ -0,0 +1,514 @@
+//go:build integration
+
+// Package bench measures the latency of the record endpoints against a seeded database and fails
+// when it regressed past a baseline. The benchmarks serve the real router in-process, in a
+// throwaway database that is dropped before seeding (TEST_MONGO_DB, tp25_loadtest by default).
+// They only build with the integration tag.
+//
+// Without MONGO_URI the benchmarks start MongoDB (-mongo-image) in a container with
+// testcontainers-go and remove it when they end; they are skipped when Docker is not available.
+// Set MONGO_URI to run them against an existing server instead.
+//
+// Each benchmark reports the p50 and p95 latency of its requests. The first run, or a run with
+// -update-baseline, writes them to the baseline file; later runs fail a benchmark whose p50 or p95
+// exceeds its baseline by more than -factor. Baselines depend on the machine, so compare runs on
+// the same hardware.
+//
+// The benchmarks also count the queries of the user collection per request, and fail an endpoint
+// loading the user on every request instead of authorizing it from the access token.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"tp25-api/internal/config"
+	"tp25-api/internal/domain"
+	"tp25-api/internal/middleware"
+	"tp25-api/internal/repository/mongodb"
+	"tp25-api/internal/server"
+	"tp25-api/lib/database"
+	"tp25-api/lib/jwtkeys"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+var (
+	boxCount       = flag.Int("boxes", 20, "boxes in the seeded group")
+	recordCount    = flag.Int("records", 20000, "records per box, 10 minutes apart")
+	concurrency    = flag.Int("concurrency", 8, "requests in flight per benchmark")
+	baselinePath   = flag.String("baseline", "baseline.json", "baseline latencies file")
+	factor         = flag.Float64("factor", 1.5, "fail when a latency exceeds its baseline by more than this factor")
+	updateBaseline = flag.Bool("update-baseline", false, "write the measured latencies as the new baseline")
+	mongoImage     = flag.String("mongo-image", "mongo:7", "image of the MongoDB container started when MONGO_URI is unset")
+)
+
+// seedInterval is the spacing of seeded records, the usual logger period
+const seedInterval = 10 * 60
+
+// userCollection is the collection of mongodb.UserRepository, which authenticating a request must not query
+const userCollection = "user"
+
+// Result is the measured latency of one endpoint, in milliseconds
+type Result struct {
+	Name     string  `json:"name"`
+	Requests int     `json:"requests"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+
+	UserQueries float64 `json:"user_queries_per_request"`
+}
+
+// env is the seeded database and the server in front of it, shared by the benchmarks
+type env struct {
+	mongo    *testcontainers.DockerContainer // nil when MONGO_URI names the server
+	db       *database.MongoDB
+	srv      *httptest.Server
+	shutdown func(context.Context) error
+	token    string
+	seed     *seeded
+	err      error
+}
+
+var (
+	setupOnce sync.Once
+	shared    env
+
+	resultsMu sync.Mutex
+	results   = map[string]Result{}
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+
+	if shared.srv != nil {
+		shared.srv.Close()
+		shared.shutdown(context.Background())
+	}
+	if shared.db != nil {
+		shared.db.Close()
+	}
+	if err := testcontainers.TerminateContainer(shared.mongo); err != nil {
+		log.Printf("Failed to remove the MongoDB container: %v", err)
+	}
+	if len(results) > 0 && (*updateBaseline || !baselineExists()) {
+		if err := writeBaseline(*baselinePath); err != nil {
+			log.Printf("Failed to write the baseline: %v", err)
+			code = 1
+		} else {
+			log.Printf("Wrote baseline %s", *baselinePath)
+		}
+	}
+	os.Exit(code)
+}
+
+// errNoDocker is returned by startMongo when there is neither MONGO_URI nor Docker to run MongoDB in
+var errNoDocker = errors.New("MONGO_URI is not set and Docker is not available")
+
+// setup seeds the database and starts the server the first time a benchmark needs them
+func setup(b *testing.B) *env {
+	setupOnce.Do(func() {
+		shared.err = start(&shared)
+	})
+	if errors.Is(shared.err, errNoDocker) {
+		b.Skip(shared.err)
+	}
+	if shared.err != nil {
+		b.Fatal(shared.err)
+	}
+	return &shared
+}
+
+// startMongo returns the URI of MONGO_URI, or starts MongoDB in a container and returns its URI
+func startMongo(ctx context.Context, e *env) (string, error) {
+	if uri := os.Getenv("MONGO_URI"); uri != "" {
+		return uri, nil
+	}
+	if err := dockerHealth(ctx); err != nil {
+		return "", fmt.Errorf("%w: %v", errNoDocker, err)
+	}
+
+	begin := time.Now()
+	const port = "27017/tcp"
+	container, err := testcontainers.Run(ctx, *mongoImage,
+		testcontainers.WithExposedPorts(port),
+		testcontainers.WithWaitStrategy(wait.ForLog("Waiting for connections"), wait.ForListeningPort(port)),
+	)
+	// A container that failed to get ready is removed by TestMain too
+	e.mongo = container
+	if err != nil {
+		return "", fmt.Errorf("starting %s: %w", *mongoImage, err)
+	}
+	uri, err := container.PortEndpoint(ctx, port, "mongodb")
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Started %s at %s in %s", *mongoImage, uri, time.Since(begin).Round(time.Millisecond))
+	return uri, nil
+}
+
+// dockerHealth reports why Docker cannot be used, nil when it can. testcontainers panics when it
+// finds no Docker host at all.
+func dockerHealth(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	provider, err := testcontainers.ProviderDocker.GetProvider()
+	if err != nil {
+		return err
+	}
+	defer provider.Close()
+	return provider.Health(ctx)
+}
+
+func start(e *env) error {
+	if os.Getenv("TOTP_ENCRYPTION_KEY") == "" {
+		os.Setenv("TOTP_ENCRYPTION_KEY", "loadtest")
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	ctx := context.Background()
+	if cfg.Database.URL, err = startMongo(ctx, e); err != nil {
+		return err
+	}
+	cfg.Database.Name = os.Getenv("TEST_MONGO_DB")
+	if cfg.Database.Name == "" {
+		cfg.Database.Name = "tp25_loadtest"
+	}
+	if cfg.Auth.JWTSecret == "" {
+		cfg.Auth.JWTSecret = "loadtest"
+		cfg.Auth.JWTSecrets = []string{cfg.Auth.JWTSecret}
+	}
+
+	if e.db, err = database.NewMongoDB(cfg); err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	if err := e.db.Database.Drop(ctx); err != nil {
+		return fmt.Errorf("dropping the load test database: %w", err)
+	}
+
+	begin := time.Now()
+	if e.seed, err = seedData(ctx, e.db); err != nil {
+		return fmt.Errorf("seeding: %w", err)
+	}
+	log.Printf("Seeded %d boxes with %d records each in %s", *boxCount, *recordCount, time.Since(begin).Round(time.Millisecond))
+
+	router, shutdown := server.New(cfg, e.db)
+	e.shutdown = shutdown
+	e.srv = httptest.NewServer(router)
+
+	e.token, err = accessToken(cfg, e.seed.user)
+	return err
+}
+
+type seeded struct {
+	user   *domain.User
+	group  *domain.BoxGroup
+	boxes  []*domain.Box
+	latest int64
+}
+
+// seedData creates an admin, a zone with one group of boxes reporting WAU and DR, and their records
+func seedData(ctx context.Context, db *database.MongoDB) (*seeded, error) {
+	userRepo := mongodb.NewUserRepository(db.Database)
+	zoneRepo := mongodb.NewZoneRepository(db.Database)
+	sensorRepo := mongodb.NewSensorRepository(db.Database)
+
+	user := domain.NewUser(domain.CreateUserParams{Username: "loadtest", FullName: "Load test", Role: domain.RoleAdmin})
+	if err := userRepo.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	zone := domain.NewZone(domain.CreateZoneParams{Name: "Load test", Code: "LOADTEST"})
+	if err := zoneRepo.CreateZone(ctx, zone); err != nil {
+		return nil, err
+	}
+	group := domain.NewBoxGroup(domain.CreateGroupParams{Name: "Load test", ZoneID: zone.ID})
+	if err := zoneRepo.CreateGroup(ctx, group); err != nil {
+		return nil, err
+	}
+
+	for _, code := range []string{"WAU", "DR"} {
+		metric := domain.NewMetric(domain.CreateMetricParams{Code: code, Name: code, Unit: "m"})
+		if err := sensorRepo.CreateMetric(ctx, metric); err != nil {
+			return nil, err
+		}
+	}
+
+	latest := time.Now().Unix() / seedInterval * seedInterval
+	first := latest - int64(*recordCount-1)*seedInterval
+	s := &seeded{user: user, group: group, latest: latest}
+	for i := 0; i < *boxCount; i++ {
+		box := domain.NewBox(domain.CreateBoxParams{
+			Name:     fmt.Sprintf("Box %d", i+1),
+			GroupID:  group.ID,
+			ZoneID:   zone.ID,
+			Location: domain.Location{Lat: 16, Lng: 107},
+			DeviceID: fmt.Sprintf("loadtest-%d", i+1),
+			Metrics:  []domain.BoxMetric{{Code: "WAU"}, {Code: "DR"}},
+		})
+		if err := zoneRepo.CreateBox(ctx, box); err != nil {
+			return nil, err
+		}
+		if err := seedRecords(ctx, sensorRepo, box.ID, first, *recordCount); err != nil {
+			return nil, err
+		}
+		s.boxes = append(s.boxes, box)
+	}
+	return s, nil
+}
+
+// seedRecords inserts count records from first on, with a slowly varying level and gate opening
+func seedRecords(ctx context.Context, repo *mongodb.SensorRepository, boxID string, first int64, count int) error {
+	const batchSize = 5000
+	random := rand.New(rand.NewSource(int64(len(boxID)) + first))
+	level := 20.0
+	batch := make([]domain.Record, 0, batchSize)
+	for i := 0; i < count; i++ {
+		level += random.Float64()*0.2 - 0.1
+		timestamp := first + int64(i)*seedInterval
+		batch = append(batch, domain.Record{
+			"_id": timestamp,
+			"c":   timestamp * 1000,
+			"WAU": domain.RoundValue(level),
+			"DR":  domain.RoundValue(random.Float64() * 2),
+		})
+		if len(batch) == batchSize || i == count-1 {
+			if _, err := repo.InsertRecords(ctx, boxID, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return nil
+}
+
+// accessToken signs a token for user the way login does. The seeded user is an admin, whose
+// token lists no zone groups.
+func accessToken(cfg *config.Config, user *domain.User) (string, error) {
+	return jwtkeys.New(cfg.Auth.JWTSecrets).Sign(middleware.NewClaims(user, 24*time.Hour))
+}
+
+// The benchmarks query random boxes over the last week, or the last 30 days for reports and exports
+
+func BenchmarkListRecords(b *testing.B) {
+	e := setup(b)
+	week := e.timeRange(7)
+	bench(b, e, func(r *rand.Rand) string {
+		return fmt.Sprintf("/api/boxes/%s/records?%s&page=%d&page_size=100", e.randomBox(r), week, r.Intn(5)+1)
+	})
+}
+
+func BenchmarkListRecordsByGroup(b *testing.B) {
+	e := setup(b)
+	week := e.timeRange(7)
+	bench(b, e, func(r *rand.Rand) string {
+		return fmt.Sprintf("/api/groups/%s/records?%s&page=%d&page_size=100", e.seed.group.ID, week, r.Intn(5)+1)
+	})
+}
+
+func BenchmarkReportRecords(b *testing.B) {
+	e := setup(b)
+	month := e.timeRange(30)
+	bench(b, e, func(r *rand.Rand) string {
+		return fmt.Sprintf("/api/boxes/%s/reports?%s", e.randomBox(r), month)
+	})
+}
+
+func BenchmarkExportRecords(b *testing.B) {
+	e := setup(b)
+	month := e.timeRange(30)
+	bench(b, e, func(r *rand.Rand) string {
+		return fmt.Sprintf("/api/boxes/%s/records/export?%s", e.randomBox(r), month)
+	})
+}
+
+func (e *env) timeRange(days int64) string {
+	return fmt.Sprintf("time_min=%d&time_max=%d", e.seed.latest-days*24*3600, e.seed.latest)
+}
+
+func (e *env) randomBox(r *rand.Rand) string {
+	return e.seed.boxes[r.Intn(len(e.seed.boxes))].ID
+}
+
+// bench sends b.N requests to the paths of path, -concurrency at a time, reports their p50 and p95
+// latency and fails on a regression past the baseline
+func bench(b *testing.B, e *env, path func(r *rand.Rand) string) {
+	before := e.db.CommandCounts()[userCollection]
+	b.ResetTimer()
+	latencies, err := send(e.srv.URL, e.token, b.N, path)
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result := Result{
+		Name:        b.Name(),
+		Requests:    b.N,
+		P50:         percentile(latencies, 0.50),
+		P95:         percentile(latencies, 0.95),
+		UserQueries: float64(e.db.CommandCounts()[userCollection]-before) / float64(b.N),
+	}
+	b.ReportMetric(result.P50, "p50-ms")
+	b.ReportMetric(result.P95, "p95-ms")
+	b.ReportMetric(result.UserQueries, "user-queries/op")
+
+	// Token revocations are read from the users every few seconds, not per request
+	if result.UserQueries >= 1 {
+		b.Errorf("%.2f user queries per request, the access token should authorize it", result.UserQueries)
+	}
+	if err := compare(result); err != nil {
+		b.Error(err)
+	}
+
+	resultsMu.Lock()
+	results[result.Name] = result
+	resultsMu.Unlock()
+}
+
+// send sends n requests, -concurrency at a time, and returns their latency
+func send(baseURL, token string, n int, path func(r *rand.Rand) string) ([]time.Duration, error) {
+	latencies := make([]time.Duration, n)
+	jobs := make(chan int)
+	errs := make(chan error, *concurrency)
+	var wg sync.WaitGroup
+
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(w)))
+			for i := range jobs {
+				req, err := http.NewRequest(http.MethodGet, baseURL+path(random), nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				req.Header.Set("Authorization", "Bearer "+token)
+
+				start := time.Now()
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				latencies[i] = time.Since(start)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if resp.StatusCode != http.StatusOK {
+					errs <- fmt.Errorf("%s answered %d", req.URL.Path, resp.StatusCode)
+					return
+				}
+			}
+		}(w)
+	}
+
+	var err error
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return latencies, err
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies, in milliseconds
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+// compare checks a result against the baseline file, when there is one and it is not being rewritten
+func compare(r Result) error {
+	if *updateBaseline || !baselineExists() {
+		return nil
+	}
+	data, err := os.ReadFile(*baselinePath)
+	if err != nil {
+		return fmt.Errorf("reading the baseline: %w", err)
+	}
+	var baseline []Result
+	if err := json.Unmarshal(data, &baseline); err != nil {
+		return fmt.Errorf("parsing the baseline: %w", err)
+	}
+
+	for _, base := range baseline {
+		if base.Name != r.Name {
+			continue
+		}
+		for _, m := range []struct {
+			label     string
+			now, then float64
+		}{{"p50", r.P50, base.P50}, {"p95", r.P95, base.P95}} {
+			if m.then > 0 && m.now > m.then**factor {
+				return fmt.Errorf("%s regressed: %.1f ms, baseline %.1f ms (limit x%.2f)", m.label, m.now, m.then, *factor)
+			}
+		}
+		return nil
+	}
+	log.Printf("%s: no baseline", r.Name)
+	return nil
+}
+
+func baselineExists() bool {
+	_, err := os.Stat(*baselinePath)
+	return err == nil
+}
+
+// writeBaseline writes the results measured in this run, by name
+func writeBaseline(path string) error {
+	list := make([]Result, 0, len(results))
+	for _, r := range results {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}